@@ -0,0 +1,37 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+// byteArena hands out byte slices which stay valid until the next reset, so
+// that the values decoded while matching a document can be kept without
+// allocating for each of them.  When the current buffer runs out a larger
+// one is started, and the old one is left to the slices still referencing
+// it.  Reset then sizes the buffer to everything used since the previous
+// reset, so a matcher running over similar documents settles on a single
+// buffer and stops allocating altogether.
+type byteArena struct {
+	buf []byte
+	// Bytes handed out since the last reset, across every buffer
+	used int
+}
+
+func (a *byteArena) reset() {
+	if a.used > cap(a.buf) {
+		a.buf = make([]byte, 0, a.used)
+	} else {
+		a.buf = a.buf[:0]
+	}
+	a.used = 0
+}
+
+// alloc returns n bytes which stay valid until the next reset
+func (a *byteArena) alloc(n int) []byte {
+	start := len(a.buf)
+	if cap(a.buf)-start < n {
+		a.buf = make([]byte, 0, 2*cap(a.buf)+n)
+		start = 0
+	}
+	a.buf = a.buf[:start+n]
+	a.used += n
+	return a.buf[start : start+n : start+n]
+}
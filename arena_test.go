@@ -0,0 +1,75 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestByteArena(t *testing.T) {
+	assert := assert.New(t)
+
+	var arena byteArena
+	first := arena.alloc(4)
+	copy(first, "abcd")
+	second := arena.alloc(100)
+	copy(second, "efgh")
+
+	// Growing must not move bytes which were already handed out
+	assert.Equal("abcd", string(first))
+	assert.Equal(4, cap(first))
+	assert.Equal(100, len(second))
+
+	arena.reset()
+	assert.True(cap(arena.buf) >= 104)
+
+	// The same allocations now fit within a single buffer
+	bufStart := &arena.buf[:1][0]
+	arena.alloc(4)
+	arena.alloc(100)
+	assert.True(bufStart == &arena.buf[0])
+}
+
+func TestMatcherEscapedStrings(t *testing.T) {
+	assert := assert.New(t)
+
+	var trans Transformer
+	def := trans.Transform([]Expression{
+		EqualsExpr{
+			FieldExpr{Root: 0, Path: []string{"a"}},
+			FieldExpr{Root: 0, Path: []string{"b"}},
+		},
+	})
+	m := NewFastMatcher(def)
+
+	matched, err := m.Match([]byte(`{"a":"x\"1","b":"x\"2"}`))
+	assert.Nil(err)
+	assert.False(matched)
+
+	m.Reset()
+	matched, err = m.Match([]byte(`{"a":"x\"1","b":"x\"1"}`))
+	assert.Nil(err)
+	assert.True(matched)
+}
+
+func TestMatcherNoAllocs(t *testing.T) {
+	assert := assert.New(t)
+
+	var trans Transformer
+	def := trans.Transform([]Expression{AndExpr{
+		EqualsExpr{FieldExpr{Root: 0, Path: []string{"name"}}, ValueExpr{"Brett"}},
+		LessThanExpr{FieldExpr{Root: 0, Path: []string{"city"}}, ValueExpr{"Vancouver"}},
+		GreaterThanExpr{FieldExpr{Root: 0, Path: []string{"age"}}, ValueExpr{30}},
+	}})
+	m := NewFastMatcher(def)
+	doc := []byte(`{"name":"Brett","city":"Toronto","age":31}`)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		m.Reset()
+		matched, _ := m.Match(doc)
+		assert.True(matched)
+	})
+	assert.Equal(0.0, allocs)
+}
@@ -0,0 +1,437 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	avroTypeNull = iota
+	avroTypeBoolean
+	avroTypeInt
+	avroTypeLong
+	avroTypeFloat
+	avroTypeDouble
+	avroTypeBytes
+	avroTypeString
+	avroTypeRecord
+	avroTypeEnum
+	avroTypeArray
+	avroTypeMap
+	avroTypeUnion
+	avroTypeFixed
+)
+
+var avroPrimitiveTypes = map[string]int{
+	"null":    avroTypeNull,
+	"boolean": avroTypeBoolean,
+	"int":     avroTypeInt,
+	"long":    avroTypeLong,
+	"float":   avroTypeFloat,
+	"double":  avroTypeDouble,
+	"bytes":   avroTypeBytes,
+	"string":  avroTypeString,
+}
+
+// Guards against stack exhaustion on hostile input
+const avroMaxDepth = 512
+
+type avroField struct {
+	name   string
+	schema *avroSchemaNode
+}
+
+type avroSchemaNode struct {
+	avroType int
+	// logicalType holds the Avro logical type annotation, if any
+	logicalType string
+	fields      []avroField
+	symbols     []string
+	items       *avroSchemaNode
+	branches    []*avroSchemaNode
+	size        int
+}
+
+// AvroSchema is a parsed Avro schema which describes how to decode records
+// for an Avro matcher.
+type AvroSchema struct {
+	root *avroSchemaNode
+}
+
+type avroSchemaParser struct {
+	named     map[string]*avroSchemaNode
+	namespace string
+}
+
+// ParseAvroSchema parses an Avro schema from its JSON representation
+func ParseAvroSchema(schema []byte) (*AvroSchema, error) {
+	var decoded interface{}
+	if err := json.Unmarshal(schema, &decoded); err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrorAvroInvalidSchema, err)
+	}
+
+	parser := avroSchemaParser{
+		named: make(map[string]*avroSchemaNode),
+	}
+	root, err := parser.parse(decoded)
+	if err != nil {
+		return nil, err
+	}
+	return &AvroSchema{root}, nil
+}
+
+func (p *avroSchemaParser) fullName(name, namespace string) string {
+	if strings.Contains(name, ".") {
+		return name
+	}
+	if namespace == "" {
+		namespace = p.namespace
+	}
+	if namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+func (p *avroSchemaParser) parse(schema interface{}) (*avroSchemaNode, error) {
+	switch schema := schema.(type) {
+	case string:
+		if avroType, ok := avroPrimitiveTypes[schema]; ok {
+			return &avroSchemaNode{avroType: avroType}, nil
+		}
+		if node, ok := p.named[p.fullName(schema, "")]; ok {
+			return node, nil
+		}
+		if node, ok := p.named[schema]; ok {
+			return node, nil
+		}
+		return nil, fmt.Errorf("%v: unknown type %s", ErrorAvroInvalidSchema, schema)
+	case []interface{}:
+		node := &avroSchemaNode{avroType: avroTypeUnion}
+		for _, branch := range schema {
+			branchNode, err := p.parse(branch)
+			if err != nil {
+				return nil, err
+			}
+			node.branches = append(node.branches, branchNode)
+		}
+		return node, nil
+	case map[string]interface{}:
+		return p.parseComplex(schema)
+	}
+
+	return nil, fmt.Errorf("%v: unexpected schema value %v", ErrorAvroInvalidSchema, schema)
+}
+
+func (p *avroSchemaParser) parseComplex(schema map[string]interface{}) (*avroSchemaNode, error) {
+	typeName, ok := schema["type"].(string)
+	if !ok {
+		// A nested type definition, such as {"type": {"type": "array", ...}}
+		return p.parse(schema["type"])
+	}
+	logicalType, _ := schema["logicalType"].(string)
+
+	if avroType, ok := avroPrimitiveTypes[typeName]; ok {
+		return &avroSchemaNode{avroType: avroType, logicalType: logicalType}, nil
+	}
+
+	node := &avroSchemaNode{logicalType: logicalType}
+
+	// Named types may be referred to by themselves, so register them before
+	// parsing any children
+	switch typeName {
+	case "record", "error", "enum", "fixed":
+		name, _ := schema["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("%v: %s without a name", ErrorAvroInvalidSchema, typeName)
+		}
+		namespace, _ := schema["namespace"].(string)
+		fullName := p.fullName(name, namespace)
+		p.named[fullName] = node
+
+		oldNamespace := p.namespace
+		if idx := strings.LastIndex(fullName, "."); idx >= 0 {
+			p.namespace = fullName[:idx]
+		}
+		defer func() { p.namespace = oldNamespace }()
+	}
+
+	switch typeName {
+	case "record", "error":
+		node.avroType = avroTypeRecord
+		fields, ok := schema["fields"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v: record without fields", ErrorAvroInvalidSchema)
+		}
+		for _, field := range fields {
+			fieldDef, ok := field.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%v: invalid record field", ErrorAvroInvalidSchema)
+			}
+			fieldName, _ := fieldDef["name"].(string)
+			fieldSchema, err := p.parse(fieldDef["type"])
+			if err != nil {
+				return nil, err
+			}
+			node.fields = append(node.fields, avroField{fieldName, fieldSchema})
+		}
+	case "enum":
+		node.avroType = avroTypeEnum
+		symbols, _ := schema["symbols"].([]interface{})
+		for _, symbol := range symbols {
+			symbolName, ok := symbol.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v: invalid enum symbol", ErrorAvroInvalidSchema)
+			}
+			node.symbols = append(node.symbols, symbolName)
+		}
+	case "fixed":
+		node.avroType = avroTypeFixed
+		size, ok := schema["size"].(float64)
+		if !ok || size < 0 {
+			return nil, fmt.Errorf("%v: fixed without a size", ErrorAvroInvalidSchema)
+		}
+		node.size = int(size)
+	case "array", "map":
+		node.avroType = avroTypeArray
+		itemsKey := "items"
+		if typeName == "map" {
+			node.avroType = avroTypeMap
+			itemsKey = "values"
+		}
+		items, err := p.parse(schema[itemsKey])
+		if err != nil {
+			return nil, err
+		}
+		node.items = items
+	default:
+		return p.parse(typeName)
+	}
+
+	return node, nil
+}
+
+// avroTokenizer produces the JSON token sequence for an Avro binary encoded
+// datum.  Unions are matched by the value of their selected branch, bytes
+// and fixed values become base64 strings, enums become their symbol, and
+// timestamp and date logical types become RFC3339 strings usable with DATE().
+type avroTokenizer struct {
+	tokenStream
+	schema *AvroSchema
+	data   []byte
+	pos    int
+	depth  int
+}
+
+func (tkn *avroTokenizer) Reset(data []byte) {
+	tkn.reset()
+	tkn.data = data
+	tkn.pos = 0
+	tkn.depth = 0
+	if len(data) == 0 {
+		return
+	}
+
+	if err := tkn.decodeValue(tkn.schema.root); err != nil {
+		tkn.err = err
+	} else if tkn.pos != len(data) {
+		tkn.err = ErrorAvroMalformed
+	}
+}
+
+func (tkn *avroTokenizer) readLong() (int64, error) {
+	value, n := binary.Uvarint(tkn.data[tkn.pos:])
+	if n <= 0 {
+		return 0, ErrorAvroMalformed
+	}
+	tkn.pos += n
+	// Values are zig-zag encoded
+	return int64(value>>1) ^ -int64(value&1), nil
+}
+
+func (tkn *avroTokenizer) read(n int64) ([]byte, error) {
+	if n < 0 || int64(len(tkn.data)-tkn.pos) < n {
+		return nil, ErrorAvroMalformed
+	}
+	value := tkn.data[tkn.pos : tkn.pos+int(n)]
+	tkn.pos += int(n)
+	return value, nil
+}
+
+func (tkn *avroTokenizer) readBytes() ([]byte, error) {
+	length, err := tkn.readLong()
+	if err != nil {
+		return nil, err
+	}
+	return tkn.read(length)
+}
+
+func (tkn *avroTokenizer) binaryValue(value []byte) {
+	encoded := tkn.scratchBytes(base64.StdEncoding.EncodedLen(len(value)))
+	base64.StdEncoding.Encode(encoded, value)
+	tkn.stringValue(encoded)
+}
+
+func (tkn *avroTokenizer) timeValue(value time.Time) {
+	encoded := tkn.scratchBytes(len(time.RFC3339Nano) + 8)
+	tkn.stringValue(value.UTC().AppendFormat(encoded[:0], time.RFC3339Nano))
+}
+
+func (tkn *avroTokenizer) longValue(node *avroSchemaNode, value int64) {
+	switch node.logicalType {
+	case "date":
+		tkn.timeValue(time.Unix(value*86400, 0))
+	case "timestamp-millis":
+		tkn.timeValue(time.Unix(value/1000, (value%1000)*int64(time.Millisecond)))
+	case "timestamp-micros":
+		tkn.timeValue(time.Unix(value/1000000, (value%1000000)*int64(time.Microsecond)))
+	default:
+		tkn.intValue(value)
+	}
+}
+
+// decodeBlocks walks the blocks of an array or map, calling handler once
+// for every item
+func (tkn *avroTokenizer) decodeBlocks(handler func() error) error {
+	for {
+		count, err := tkn.readLong()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		if count < 0 {
+			// Negative counts are followed by the block size in bytes
+			count = -count
+			if _, err := tkn.readLong(); err != nil {
+				return err
+			}
+		}
+		for i := int64(0); i < count; i++ {
+			if err := handler(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (tkn *avroTokenizer) decodeValue(node *avroSchemaNode) error {
+	tkn.depth++
+	defer func() { tkn.depth-- }()
+	if tkn.depth > avroMaxDepth {
+		return ErrorAvroMalformed
+	}
+
+	switch node.avroType {
+	case avroTypeNull:
+		tkn.nullValue()
+	case avroTypeBoolean:
+		value, err := tkn.read(1)
+		if err != nil {
+			return err
+		}
+		tkn.boolValue(value[0] != 0)
+	case avroTypeInt, avroTypeLong:
+		value, err := tkn.readLong()
+		if err != nil {
+			return err
+		}
+		tkn.longValue(node, value)
+	case avroTypeFloat:
+		value, err := tkn.read(4)
+		if err != nil {
+			return err
+		}
+		tkn.floatValue(float64(math.Float32frombits(binary.LittleEndian.Uint32(value))))
+	case avroTypeDouble:
+		value, err := tkn.read(8)
+		if err != nil {
+			return err
+		}
+		tkn.floatValue(math.Float64frombits(binary.LittleEndian.Uint64(value)))
+	case avroTypeBytes:
+		value, err := tkn.readBytes()
+		if err != nil {
+			return err
+		}
+		tkn.binaryValue(value)
+	case avroTypeString:
+		value, err := tkn.readBytes()
+		if err != nil {
+			return err
+		}
+		tkn.stringValue(value)
+	case avroTypeFixed:
+		value, err := tkn.read(int64(node.size))
+		if err != nil {
+			return err
+		}
+		tkn.binaryValue(value)
+	case avroTypeEnum:
+		index, err := tkn.readLong()
+		if err != nil {
+			return err
+		}
+		if index < 0 || index >= int64(len(node.symbols)) {
+			return ErrorAvroMalformed
+		}
+		tkn.stringValue([]byte(node.symbols[index]))
+	case avroTypeUnion:
+		index, err := tkn.readLong()
+		if err != nil {
+			return err
+		}
+		if index < 0 || index >= int64(len(node.branches)) {
+			return ErrorAvroMalformed
+		}
+		return tkn.decodeValue(node.branches[index])
+	case avroTypeRecord:
+		tkn.beginObject()
+		for _, field := range node.fields {
+			tkn.key([]byte(field.name))
+			if err := tkn.decodeValue(field.schema); err != nil {
+				return err
+			}
+		}
+		tkn.end()
+	case avroTypeArray:
+		tkn.beginArray()
+		err := tkn.decodeBlocks(func() error {
+			return tkn.decodeValue(node.items)
+		})
+		if err != nil {
+			return err
+		}
+		tkn.end()
+	case avroTypeMap:
+		tkn.beginObject()
+		err := tkn.decodeBlocks(func() error {
+			name, err := tkn.readBytes()
+			if err != nil {
+				return err
+			}
+			tkn.key(name)
+			return tkn.decodeValue(node.items)
+		})
+		if err != nil {
+			return err
+		}
+		tkn.end()
+	}
+
+	return nil
+}
+
+// NewAvroMatcher returns a matcher which evaluates Avro binary encoded
+// records written with the given schema
+func NewAvroMatcher(def *MatchDef, schema *AvroSchema) *FastMatcher {
+	return newFastMatcherWithTokenizer(def, &avroTokenizer{schema: schema})
+}
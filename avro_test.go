@@ -0,0 +1,124 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAvroSchema = `{
+	"type": "record",
+	"name": "Person",
+	"namespace": "com.example",
+	"fields": [
+		{"name": "name", "type": "string"},
+		{"name": "age", "type": "int"},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["ACTIVE", "INACTIVE"]}},
+		{"name": "created", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "scores", "type": {"type": "map", "values": "double"}},
+		{"name": "manager", "type": ["null", "Person"]}
+	]
+}`
+
+func avroAppendLong(out []byte, value int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], value)
+	return append(out, tmp[:n]...)
+}
+
+func avroAppendString(out []byte, value string) []byte {
+	out = avroAppendLong(out, int64(len(value)))
+	return append(out, value...)
+}
+
+func avroAppendPerson(out []byte, name string, age int64, tags []string, status int64, manager string) []byte {
+	out = avroAppendString(out, name)
+	out = avroAppendLong(out, age)
+	out = avroAppendLong(out, int64(len(tags)))
+	for _, tag := range tags {
+		out = avroAppendString(out, tag)
+	}
+	if len(tags) > 0 {
+		out = avroAppendLong(out, 0)
+	}
+	out = avroAppendLong(out, status)
+	out = avroAppendLong(out, 1551434400000)
+
+	// Write the map as a single block with a byte size, as writers may
+	out = avroAppendLong(out, -1)
+	out = avroAppendLong(out, 13)
+	out = avroAppendString(out, "math")
+	var score [8]byte
+	binary.LittleEndian.PutUint64(score[:], 0x4058c00000000000)
+	out = append(out, score[:]...)
+	out = avroAppendLong(out, 0)
+
+	if manager == "" {
+		return avroAppendLong(out, 0)
+	}
+	out = avroAppendLong(out, 1)
+	return avroAppendPerson(out, manager, 50, nil, 0, "")
+}
+
+func TestAvroMatcher(t *testing.T) {
+	assert := assert.New(t)
+
+	schema, err := ParseAvroSchema([]byte(testAvroSchema))
+	if !assert.Nil(err) {
+		return
+	}
+
+	expr, err := ParseFilterExpression(
+		"age > 30 AND tags[1] = \"admin\" AND status = \"ACTIVE\" AND scores.math = 99 AND manager.name = \"Bob\"")
+	if !assert.Nil(err) {
+		return
+	}
+
+	var trans Transformer
+	matcher := NewAvroMatcher(trans.Transform([]Expression{expr}), schema)
+
+	doc := avroAppendPerson(nil, "Alice", 42, []string{"staff", "admin"}, 0, "Bob")
+	matched, err := matcher.Match(doc)
+	assert.Nil(err)
+	assert.True(matched)
+
+	matcher.Reset()
+	matched, err = matcher.Match(avroAppendPerson(nil, "Carol", 42, []string{"staff", "admin"}, 1, "Bob"))
+	assert.Nil(err)
+	assert.False(matched)
+
+	matcher.Reset()
+	matched, err = matcher.Match(avroAppendPerson(nil, "Dave", 42, []string{"staff", "admin"}, 0, ""))
+	assert.Nil(err)
+	assert.False(matched)
+
+	dateExpr := EqualsExpr{
+		FuncExpr{DateFunc, []Expression{FieldExpr{0, []string{"created"}}}},
+		FuncExpr{DateFunc, []Expression{ValueExpr{"2019-03-01T10:00:00Z"}}},
+	}
+	dateMatcher := NewAvroMatcher(trans.Transform([]Expression{dateExpr}), schema)
+	matched, err = dateMatcher.Match(doc)
+	assert.Nil(err)
+	assert.True(matched)
+
+	matcher.Reset()
+	_, err = matcher.Match(doc[:len(doc)-2])
+	assert.Equal(ErrorAvroMalformed, err)
+}
+
+func TestParseAvroSchemaErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := ParseAvroSchema([]byte(`{"type": "record", "name": "A", "fields": [{"name": "b", "type": "Missing"}]}`))
+	assert.NotNil(err)
+
+	_, err = ParseAvroSchema([]byte(`{"type": "fixed", "name": "F"}`))
+	assert.NotNil(err)
+
+	_, err = ParseAvroSchema([]byte(`{"type": "record"`))
+	assert.NotNil(err)
+}
@@ -15,8 +15,13 @@ const (
 	nodeTypeOr
 	nodeTypeAnd
 	nodeTypeNot
+	// Non-exiting OR, which is only decided once both of its children are,
+	// rather than as soon as either of them is true.  This keeps the other
+	// child from being resolved early so that its own value is still found.
 	nodeTypeNeor
 	nodeTypeLoop
+	// Non-exiting AND, the counterpart of nodeTypeNeor
+	nodeTypeNeand
 )
 
 func binTreeNodeTypeToString(nodeType BinTreeNodeType) string {
@@ -33,6 +38,8 @@ func binTreeNodeTypeToString(nodeType BinTreeNodeType) string {
 		return "neor"
 	case nodeTypeLoop:
 		return "loop"
+	case nodeTypeNeand:
+		return "neand"
 	}
 	return "??ERROR??"
 }
@@ -54,6 +61,9 @@ type binTreePointers struct {
 type binTreeNode struct {
 	binTreePointers
 	NodeType BinTreeNodeType
+	// The index after the last node of this node's subtree, or 0 when the
+	// ends of the tree have not been marked
+	SubtreeEnd int
 }
 
 func NewBinTreeNode(nodeType BinTreeNodeType, parent, left, right int) *binTreeNode {
@@ -109,6 +119,11 @@ type binTreeState struct {
 	tree       *binTree
 	data       []binTreeStateValue
 	stallIndex int
+	// Work list of the nodes left to visit when walking a subtree
+	pending []int
+	// The first error hit while updating the state, after which marking
+	// nodes has no effect until the state is reset
+	err error
 }
 
 func (state binTreeState) itemToString(item int) string {
@@ -142,8 +157,9 @@ func (state binTreeState) String() string {
 
 func (tree *binTree) NewState() *binTreeState {
 	return &binTreeState{
-		tree: tree,
-		data: make([]binTreeStateValue, len(tree.data)),
+		tree:    tree,
+		data:    make([]binTreeStateValue, len(tree.data)),
+		pending: make([]int, 0, len(tree.data)),
 	}
 }
 
@@ -163,6 +179,7 @@ func (tree *binTree) validateItem(item int, parent int) (int, error) {
 	case nodeTypeNot:
 	case nodeTypeNeor:
 	case nodeTypeLoop:
+	case nodeTypeNeand:
 	default:
 		// Invalid node type
 		return -1, errors.New("unexpected node type")
@@ -230,6 +247,44 @@ func (tree *binTree) Validate() error {
 	return nil
 }
 
+// markSubtreeEnds records where the subtree of each node ends.  A valid tree
+// stores every subtree as a contiguous run of nodes starting with its root,
+// which lets a whole subtree be reset or resolved with a single loop.  Trees
+// laid out in any other way are left to be walked node by node.
+func (tree *binTree) markSubtreeEnds() {
+	if len(tree.data) == 0 || tree.Validate() != nil {
+		return
+	}
+
+	// Children always follow their parent, so walking backwards means the
+	// subtrees of a node's children have already been marked
+	for i := len(tree.data) - 1; i >= 0; i-- {
+		node := &tree.data[i]
+		node.SubtreeEnd = i + 1
+
+		if binTreeNodeTypeHasLeft(node.NodeType) {
+			if node.Left != i+1 {
+				tree.clearSubtreeEnds()
+				return
+			}
+			node.SubtreeEnd = tree.data[node.Left].SubtreeEnd
+		}
+		if binTreeNodeTypeHasRight(node.NodeType) {
+			if node.Right != node.SubtreeEnd {
+				tree.clearSubtreeEnds()
+				return
+			}
+			node.SubtreeEnd = tree.data[node.Right].SubtreeEnd
+		}
+	}
+}
+
+func (tree *binTree) clearSubtreeEnds() {
+	for i := range tree.data {
+		tree.data[i].SubtreeEnd = 0
+	}
+}
+
 func (tree *binParserTree) NumNodes() int {
 	return len(tree.data)
 }
@@ -244,6 +299,46 @@ func (state *binTreeState) CopyFrom(ostate *binTreeState) {
 	}
 }
 
+// binTreeSnapshot holds a copy of a state taken by Save, which the state can
+// later be rolled back to with Restore
+type binTreeSnapshot struct {
+	tree       *binTree
+	data       []binTreeStateValue
+	stallIndex int
+	err        error
+}
+
+// Save takes a snapshot of the state, so that nodes can be marked
+// speculatively and then undone with Restore
+func (state *binTreeState) Save() *binTreeSnapshot {
+	snap := &binTreeSnapshot{}
+	state.SaveTo(snap)
+	return snap
+}
+
+// SaveTo takes a snapshot of the state in the same way as Save, reusing the
+// memory of an earlier snapshot
+func (state *binTreeState) SaveTo(snap *binTreeSnapshot) {
+	snap.tree = state.tree
+	snap.data = append(snap.data[:0], state.data...)
+	snap.stallIndex = state.stallIndex
+	snap.err = state.err
+}
+
+// Restore rolls the state back to a snapshot taken from a state of the same
+// tree.  The snapshot is left intact and can be restored again.  A snapshot
+// of another tree is not restored and sets the error of the state instead.
+func (state *binTreeState) Restore(snap *binTreeSnapshot) {
+	if state.tree != snap.tree {
+		state.setErr(ErrorMatchTreeInvalidNode)
+		return
+	}
+
+	copy(state.data, snap.data)
+	state.stallIndex = snap.stallIndex
+	state.err = snap.err
+}
+
 func (state *binTreeState) SetStallIndex(index int) int {
 	oldStallIndex := state.stallIndex
 	state.stallIndex = index
@@ -275,122 +370,282 @@ func (state *binTreeState) Resolve() {
 	}
 }
 
+// ResolveNode resolves the subtree of a node in the same way as Resolve does
+// for the whole tree, marking every node left undecided below it as false
+func (state *binTreeState) ResolveNode(index int) {
+	if !state.validIndex(index) {
+		state.setErr(ErrorMatchTreeInvalidNode)
+		return
+	}
+
+	end := state.tree.data[index].SubtreeEnd
+	if end == 0 {
+		state.resolveNodeWalk(index)
+		return
+	}
+
+	for i := end - 1; i >= index && state.data[index] == binTreeStateUnknown; i-- {
+		if state.data[i] == binTreeStateUnknown {
+			state.MarkNode(i, false)
+		}
+	}
+}
+
+// resolveNodeWalk resolves the subtree of a node by following the child
+// links, for trees which do not have their subtree ends marked
+func (state *binTreeState) resolveNodeWalk(index int) {
+	// Children are visited after their parent, so going through the nodes
+	// in reverse resolves them before it
+	var nodes []int
+	pending := []int{index}
+	for len(pending) > 0 {
+		nodeIdx := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if !state.validIndex(nodeIdx) || len(nodes) >= len(state.data) {
+			state.setErr(ErrorMatchTreeInvalidNode)
+			return
+		}
+		nodes = append(nodes, nodeIdx)
+
+		defNode := &state.tree.data[nodeIdx]
+		if binTreeNodeTypeHasLeft(defNode.NodeType) {
+			pending = append(pending, defNode.Left)
+		}
+		if binTreeNodeTypeHasRight(defNode.NodeType) {
+			pending = append(pending, defNode.Right)
+		}
+	}
+
+	for i := len(nodes) - 1; i >= 0 && state.data[index] == binTreeStateUnknown; i-- {
+		if state.data[nodes[i]] == binTreeStateUnknown {
+			state.MarkNode(nodes[i], false)
+		}
+	}
+}
+
 func (state *binTreeState) Reset() {
 	state.stallIndex = 0
+	state.err = nil
 	for i := range state.data {
 		state.data[i] = binTreeStateUnknown
 	}
 }
 
-func (state *binTreeState) resetNodeRecursive(index int) {
-	// TODO(brett19): This is technically quite slow.  It would be ideal if
-	// the binary tree itself marked the end of each node so we could do a
-	// quick loop through all the entries at once.
+func (state *binTreeState) setErr(err error) {
+	if state.err == nil {
+		state.err = err
+	}
+}
 
-	state.data[index] = binTreeStateUnknown
+// Err returns the error which stopped the state from being updated, such as
+// from a malformed tree, or nil if there was none
+func (state *binTreeState) Err() error {
+	return state.err
+}
 
-	defNode := state.tree.data[index]
-	if binTreeNodeTypeHasLeft(defNode.NodeType) {
-		state.resetNodeRecursive(defNode.Left)
-	}
-	if binTreeNodeTypeHasRight(defNode.NodeType) {
-		state.resetNodeRecursive(defNode.Right)
+func (state *binTreeState) validIndex(index int) bool {
+	return index >= 0 && index < len(state.data)
+}
+
+// resetNodeWalk resets the subtree of a node by following the child links of
+// every node, for trees which do not have their subtree ends marked
+func (state *binTreeState) resetNodeWalk(index int) {
+	pending := append(state.pending[:0], index)
+	// A tree cannot have more nodes below a node than it has in total, so
+	// visiting more than that means the child links form a cycle
+	for visits := 0; len(pending) > 0; visits++ {
+		index = pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if !state.validIndex(index) || visits >= len(state.data) {
+			state.setErr(ErrorMatchTreeInvalidNode)
+			break
+		}
+		state.data[index] = binTreeStateUnknown
+
+		defNode := &state.tree.data[index]
+		if binTreeNodeTypeHasLeft(defNode.NodeType) {
+			pending = append(pending, defNode.Left)
+		}
+		if binTreeNodeTypeHasRight(defNode.NodeType) {
+			pending = append(pending, defNode.Right)
+		}
 	}
+	state.pending = pending[:0]
 }
 
 func (state *binTreeState) ResetNode(index int) {
-	state.resetNodeRecursive(index)
+	end := state.tree.data[index].SubtreeEnd
+	if end == 0 {
+		state.resetNodeWalk(index)
+		return
+	}
+
+	subtree := state.data[index:end]
+	for i := range subtree {
+		subtree[i] = binTreeStateUnknown
+	}
 }
 
-func (state *binTreeState) resolveRecursive(index int) {
-	defNode := state.tree.data[index]
-	if binTreeNodeTypeHasLeft(defNode.NodeType) {
-		if state.data[defNode.Left] == binTreeStateUnknown {
+// resolveWalk marks every unknown node below a node as resolved by following
+// the child links, skipping the subtrees of nodes which are already resolved
+func (state *binTreeState) resolveWalk(index int) {
+	pending := append(state.pending[:0], index)
+	for len(pending) > 0 {
+		index = pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		defNode := &state.tree.data[index]
+		hasLeft, hasRight := binTreeNodeTypeHasLeft(defNode.NodeType), binTreeNodeTypeHasRight(defNode.NodeType)
+		if (hasLeft && !state.validIndex(defNode.Left)) || (hasRight && !state.validIndex(defNode.Right)) {
+			state.setErr(ErrorMatchTreeInvalidNode)
+			break
+		}
+
+		if hasLeft && state.data[defNode.Left] == binTreeStateUnknown {
 			state.data[defNode.Left] = binTreeStateResolved
-			state.resolveRecursive(defNode.Left)
+			pending = append(pending, defNode.Left)
 		}
-	}
-	if binTreeNodeTypeHasRight(defNode.NodeType) {
-		if state.data[defNode.Right] == binTreeStateUnknown {
+		if hasRight && state.data[defNode.Right] == binTreeStateUnknown {
 			state.data[defNode.Right] = binTreeStateResolved
-			state.resolveRecursive(defNode.Right)
+			pending = append(pending, defNode.Right)
 		}
 	}
+	state.pending = pending[:0]
 }
 
-func (state *binTreeState) checkNode(index int) {
-	defNode := state.tree.data[index]
-	if defNode.NodeType == nodeTypeLeaf {
-		panic("cannot check leaf")
+// resolveSubtree marks every unknown node below a node as resolved.  When
+// the node was decided by one of its children, skipIdx gives that child so
+// that its subtree, which is already resolved, is not visited again.
+func (state *binTreeState) resolveSubtree(index, skipIdx int) {
+	end := state.tree.data[index].SubtreeEnd
+	if end == 0 {
+		state.resolveWalk(index)
+		return
+	}
+
+	if skipIdx > 0 {
+		state.resolveRange(index+1, skipIdx)
+		state.resolveRange(state.tree.data[skipIdx].SubtreeEnd, end)
+	} else {
+		state.resolveRange(index+1, end)
 	}
+}
 
-	if defNode.NodeType == nodeTypeOr {
-		if state.data[defNode.Left] == binTreeStateTrue || state.data[defNode.Right] == binTreeStateTrue {
-			state.MarkNode(index, true)
-		} else if state.data[defNode.Left] == binTreeStateFalse && state.data[defNode.Right] == binTreeStateFalse {
-			state.MarkNode(index, false)
+func (state *binTreeState) resolveRange(start, end int) {
+	// A resolved node only ever has resolved nodes below it, so there is no
+	// need to skip over the subtrees of the nodes which are already resolved
+	nodes := state.data[start:end]
+	for i, value := range nodes {
+		if value == binTreeStateUnknown {
+			nodes[i] = binTreeStateResolved
 		}
-		return
-	} else if defNode.NodeType == nodeTypeNeor {
-		if state.data[defNode.Left] != binTreeStateUnknown && state.data[defNode.Right] != binTreeStateUnknown {
-			if state.data[defNode.Left] == binTreeStateTrue || state.data[defNode.Right] == binTreeStateTrue {
-				state.MarkNode(index, true)
-			} else {
-				state.MarkNode(index, false)
-			}
+	}
+}
+
+// checkNode works out the value of a node from the states of its children,
+// returning false as the second value if it cannot be decided yet
+func (state *binTreeState) checkNode(index int) (bool, bool, error) {
+	if !state.validIndex(index) {
+		return false, false, ErrorMatchTreeInvalidNode
+	}
+
+	defNode := &state.tree.data[index]
+	switch defNode.NodeType {
+	case nodeTypeOr, nodeTypeNeor, nodeTypeAnd, nodeTypeNeand:
+		if !state.validIndex(defNode.Left) || !state.validIndex(defNode.Right) {
+			return false, false, ErrorMatchTreeInvalidNode
 		}
-		return
-	} else if defNode.NodeType == nodeTypeAnd {
-		if state.data[defNode.Left] == binTreeStateTrue && state.data[defNode.Right] == binTreeStateTrue {
-			state.MarkNode(index, true)
-		} else if state.data[defNode.Left] == binTreeStateFalse || state.data[defNode.Right] == binTreeStateFalse {
-			state.MarkNode(index, false)
+	case nodeTypeNot, nodeTypeLoop:
+		if !state.validIndex(defNode.Left) {
+			return false, false, ErrorMatchTreeInvalidNode
 		}
-		return
-	} else if defNode.NodeType == nodeTypeNot {
-		if state.data[defNode.Left] == binTreeStateTrue {
-			state.MarkNode(index, !true)
-		} else if state.data[defNode.Left] == binTreeStateFalse {
-			state.MarkNode(index, !false)
+	default:
+		// Leaves have no children to be checked
+		return false, false, ErrorMatchTreeInvalidNode
+	}
+
+	switch defNode.NodeType {
+	case nodeTypeOr:
+		leftState, rightState := state.data[defNode.Left], state.data[defNode.Right]
+		if leftState == binTreeStateTrue || rightState == binTreeStateTrue {
+			return true, true, nil
 		}
-		return
-	} else if defNode.NodeType == nodeTypeLoop {
-		if state.data[defNode.Left] == binTreeStateTrue {
-			state.MarkNode(index, true)
-		} else if state.data[defNode.Left] == binTreeStateFalse {
-			state.MarkNode(index, false)
+		return false, leftState == binTreeStateFalse && rightState == binTreeStateFalse, nil
+	case nodeTypeNeor:
+		leftState, rightState := state.data[defNode.Left], state.data[defNode.Right]
+		if leftState != binTreeStateUnknown && rightState != binTreeStateUnknown {
+			return leftState == binTreeStateTrue || rightState == binTreeStateTrue, true, nil
 		}
-		return
+		return false, false, nil
+	case nodeTypeAnd:
+		leftState, rightState := state.data[defNode.Left], state.data[defNode.Right]
+		if leftState == binTreeStateFalse || rightState == binTreeStateFalse {
+			return false, true, nil
+		}
+		return true, leftState == binTreeStateTrue && rightState == binTreeStateTrue, nil
+	case nodeTypeNeand:
+		leftState, rightState := state.data[defNode.Left], state.data[defNode.Right]
+		if leftState != binTreeStateUnknown && rightState != binTreeStateUnknown {
+			return leftState == binTreeStateTrue && rightState == binTreeStateTrue, true, nil
+		}
+		return false, false, nil
+	case nodeTypeNot:
+		leftState := state.data[defNode.Left]
+		return leftState == binTreeStateFalse, leftState == binTreeStateTrue || leftState == binTreeStateFalse, nil
+	default:
+		leftState := state.data[defNode.Left]
+		return leftState == binTreeStateTrue, leftState == binTreeStateTrue || leftState == binTreeStateFalse, nil
 	}
-
-	panic("invalid node mode")
 }
 
+// MarkNode sets the value of a node, and then of each of its parents in turn
+// for as long as the new value decides them.  Any problem with the tree is
+// recorded rather than raised, and is returned by Err.
 func (state *binTreeState) MarkNode(index int, value bool) {
-	if state.data[index] != binTreeStateUnknown {
-		panic("cannot resolve same state node twice")
+	if state.err != nil {
+		return
 	}
 
-	if value {
-		state.data[index] = binTreeStateTrue
-	} else {
-		state.data[index] = binTreeStateFalse
-	}
-	state.resolveRecursive(index)
+	childIdx := -1
+	for {
+		if !state.validIndex(index) {
+			state.setErr(ErrorMatchTreeInvalidNode)
+			return
+		}
+		if state.data[index] != binTreeStateUnknown {
+			state.setErr(ErrorMatchTreeResolvedTwice)
+			return
+		}
 
-	// We are done if we are the root node
-	if index == 0 {
-		return
-	}
+		if value {
+			state.data[index] = binTreeStateTrue
+		} else {
+			state.data[index] = binTreeStateFalse
+		}
+		state.resolveSubtree(index, childIdx)
 
-	// If we are the marked stall index, we should stop recursing.
-	if index == state.stallIndex {
-		return
-	}
+		// We are done if we are the root node
+		if index == 0 {
+			return
+		}
+
+		// If we are the marked stall index, we should stop propagating.
+		if index == state.stallIndex {
+			return
+		}
 
-	// Check for parent satisfaction
-	defNode := state.tree.data[index]
-	state.checkNode(defNode.ParentIdx)
+		// Check for parent satisfaction
+		parentIdx := state.tree.data[index].ParentIdx
+		parentValue, decided, err := state.checkNode(parentIdx)
+		if err != nil {
+			state.setErr(err)
+			return
+		}
+		if !decided {
+			return
+		}
+		childIdx, index, value = index, parentIdx, parentValue
+	}
 }
 
 func (state *binTreeState) IsResolved(index int) bool {
@@ -192,3 +192,282 @@ func TestBinTree(t *testing.T) {
 		tCheckNode(t, state, 5, binTreeStateFalse)
 	}
 }
+
+func TestBinTreeSubtreeEnds(t *testing.T) {
+	tree := binTree{
+		[]binTreeNode{
+			*NewBinTreeNode(nodeTypeOr, 0, 1, 2),
+			*NewBinTreeNode(nodeTypeLeaf, 0, 0, 0),
+			*NewBinTreeNode(nodeTypeAnd, 0, 3, 4),
+			*NewBinTreeNode(nodeTypeLeaf, 2, 0, 0),
+			*NewBinTreeNode(nodeTypeNot, 2, 5, 0),
+			*NewBinTreeNode(nodeTypeLeaf, 4, 0, 0),
+		},
+	}
+	tree.markSubtreeEnds()
+
+	expectedEnds := []int{6, 2, 6, 4, 6, 6}
+	for i, end := range expectedEnds {
+		if tree.data[i].SubtreeEnd != end {
+			t.Fatalf("tree item %d had subtree end %d, expected %d", i, tree.data[i].SubtreeEnd, end)
+		}
+	}
+
+	state := tree.NewState()
+	state.SetStallIndex(2)
+	state.MarkNode(3, false)
+	tCheckNode(t, state, 2, binTreeStateFalse)
+	tCheckNode(t, state, 4, binTreeStateResolved)
+	tCheckNode(t, state, 5, binTreeStateResolved)
+	tCheckNode(t, state, 0, binTreeStateUnknown)
+
+	state.ResetNode(2)
+	for i := 2; i < 6; i++ {
+		tCheckNode(t, state, i, binTreeStateUnknown)
+	}
+
+	state.SetStallIndex(0)
+	state.MarkNode(1, true)
+	for i := 2; i < 6; i++ {
+		tCheckNode(t, state, i, binTreeStateResolved)
+	}
+}
+
+func TestBinTreeInvalidSubtreeEnds(t *testing.T) {
+	// The children of the root are not stored in depth first order
+	tree := binTree{
+		[]binTreeNode{
+			*NewBinTreeNode(nodeTypeAnd, 0, 2, 1),
+			*NewBinTreeNode(nodeTypeLeaf, 0, 0, 0),
+			*NewBinTreeNode(nodeTypeLeaf, 0, 0, 0),
+		},
+	}
+	tree.markSubtreeEnds()
+
+	for i := range tree.data {
+		if tree.data[i].SubtreeEnd != 0 {
+			t.Fatalf("tree item %d should not have had its subtree end marked", i)
+		}
+	}
+
+	state := tree.NewState()
+	state.MarkNode(2, false)
+	tCheckNode(t, state, 0, binTreeStateFalse)
+	tCheckNode(t, state, 1, binTreeStateResolved)
+
+	state.ResetNode(0)
+	for i := range tree.data {
+		tCheckNode(t, state, i, binTreeStateUnknown)
+	}
+}
+
+// deepNotTree builds a chain of NOT nodes ending in a single leaf
+func deepNotTree(depth int) binTree {
+	var tree binTree
+	for i := 0; i < depth; i++ {
+		parent := i - 1
+		if parent < 0 {
+			parent = 0
+		}
+		tree.data = append(tree.data, *NewBinTreeNode(nodeTypeNot, parent, i+1, 0))
+	}
+	tree.data = append(tree.data, *NewBinTreeNode(nodeTypeLeaf, depth-1, 0, 0))
+	return tree
+}
+
+func BenchmarkBinTreeDeep(b *testing.B) {
+	tree := deepNotTree(10000)
+	tree.markSubtreeEnds()
+	state := tree.NewState()
+
+	b.ResetTimer()
+
+	for j := 0; j < b.N; j++ {
+		state.Reset()
+		state.MarkNode(10000, true)
+	}
+}
+
+func TestBinTreeDeep(t *testing.T) {
+	const depth = 1000000
+
+	tree := deepNotTree(depth)
+	state := tree.NewState()
+
+	// Without subtree ends the tree is walked node by node
+	state.MarkNode(depth, false)
+	tCheckNode(t, state, 0, binTreeStateFalse)
+	tCheckNode(t, state, 1, binTreeStateTrue)
+
+	state.ResetNode(0)
+	tCheckNode(t, state, depth, binTreeStateUnknown)
+
+	state.MarkNode(depth-1, true)
+	tCheckNode(t, state, 0, binTreeStateFalse)
+	tCheckNode(t, state, depth, binTreeStateResolved)
+
+	tree.markSubtreeEnds()
+	if tree.data[0].SubtreeEnd != depth+1 {
+		t.Fatalf("root had subtree end %d", tree.data[0].SubtreeEnd)
+	}
+
+	state = tree.NewState()
+	state.MarkNode(depth, true)
+	tCheckNode(t, state, 0, binTreeStateTrue)
+}
+
+func TestBinTreeStateErrors(t *testing.T) {
+	tree := binTree{
+		[]binTreeNode{
+			*NewBinTreeNode(nodeTypeAnd, 0, 1, 2),
+			*NewBinTreeNode(nodeTypeLeaf, 0, 0, 0),
+			*NewBinTreeNode(nodeTypeLeaf, 0, 0, 0),
+		},
+	}
+	state := tree.NewState()
+
+	state.MarkNode(1, true)
+	state.MarkNode(1, false)
+	if state.Err() != ErrorMatchTreeResolvedTwice {
+		t.Fatalf("expected resolving twice to fail, got %v", state.Err())
+	}
+
+	// Nothing changes once the state has failed
+	state.MarkNode(2, true)
+	tCheckNode(t, state, 2, binTreeStateUnknown)
+
+	state.Reset()
+	if state.Err() != nil {
+		t.Fatalf("expected reset to clear the error, got %v", state.Err())
+	}
+	state.MarkNode(3, true)
+	if state.Err() != ErrorMatchTreeInvalidNode {
+		t.Fatalf("expected marking outside the tree to fail, got %v", state.Err())
+	}
+
+	tree.data[0].NodeType = BinTreeNodeType(99)
+	state.Reset()
+	state.MarkNode(1, true)
+	if state.Err() != ErrorMatchTreeInvalidNode {
+		t.Fatalf("expected an invalid node type to fail, got %v", state.Err())
+	}
+
+	// Child links which loop back on themselves
+	tree = binTree{
+		[]binTreeNode{
+			*NewBinTreeNode(nodeTypeNot, 0, 1, 0),
+			*NewBinTreeNode(nodeTypeNot, 0, 0, 0),
+		},
+	}
+	state = tree.NewState()
+	state.ResetNode(0)
+	if state.Err() != ErrorMatchTreeInvalidNode {
+		t.Fatalf("expected a cycle to fail, got %v", state.Err())
+	}
+}
+
+func TestBinTreeStateSnapshot(t *testing.T) {
+	tree := binTree{
+		[]binTreeNode{
+			*NewBinTreeNode(nodeTypeOr, 0, 1, 2),
+			*NewBinTreeNode(nodeTypeLeaf, 0, 0, 0),
+			*NewBinTreeNode(nodeTypeAnd, 0, 3, 4),
+			*NewBinTreeNode(nodeTypeLeaf, 2, 0, 0),
+			*NewBinTreeNode(nodeTypeLeaf, 2, 0, 0),
+		},
+	}
+	state := tree.NewState()
+
+	state.MarkNode(3, true)
+	snap := state.Save()
+
+	// Speculatively resolve the whole tree, then roll it back
+	state.MarkNode(4, true)
+	tCheckNode(t, state, 0, binTreeStateTrue)
+	state.Restore(snap)
+	tCheckNode(t, state, 0, binTreeStateUnknown)
+	tCheckNode(t, state, 2, binTreeStateUnknown)
+	tCheckNode(t, state, 3, binTreeStateTrue)
+	tCheckNode(t, state, 4, binTreeStateUnknown)
+
+	// The snapshot can be restored more than once
+	state.MarkNode(4, false)
+	tCheckNode(t, state, 2, binTreeStateFalse)
+	state.Restore(snap)
+	tCheckNode(t, state, 2, binTreeStateUnknown)
+
+	// Errors are rolled back along with the nodes
+	state.MarkNode(3, false)
+	if state.Err() != ErrorMatchTreeResolvedTwice {
+		t.Fatalf("expected resolving twice to fail, got %v", state.Err())
+	}
+	state.Restore(snap)
+	if state.Err() != nil {
+		t.Fatalf("expected restore to clear the error, got %v", state.Err())
+	}
+
+	state.MarkNode(1, true)
+	state.SaveTo(snap)
+	state.Reset()
+	state.Restore(snap)
+	tCheckNode(t, state, 0, binTreeStateTrue)
+	tCheckNode(t, state, 3, binTreeStateTrue)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		state.SaveTo(snap)
+		state.Restore(snap)
+	})
+	if allocs != 0 {
+		t.Fatalf("expected reusing a snapshot not to allocate, got %v allocs", allocs)
+	}
+
+	otherTree := tree
+	otherState := otherTree.NewState()
+	otherState.Restore(snap)
+	if otherState.Err() != ErrorMatchTreeInvalidNode {
+		t.Fatalf("expected restoring a snapshot of another tree to fail, got %v", otherState.Err())
+	}
+	tCheckNode(t, otherState, 0, binTreeStateUnknown)
+}
+
+func TestBinTreeResolveNode(t *testing.T) {
+	tree := binTree{
+		[]binTreeNode{
+			*NewBinTreeNode(nodeTypeLoop, 0, 1, 0),
+			*NewBinTreeNode(nodeTypeNeand, 0, 2, 5),
+			*NewBinTreeNode(nodeTypeNeor, 1, 3, 4),
+			*NewBinTreeNode(nodeTypeLeaf, 2, 0, 0),
+			*NewBinTreeNode(nodeTypeLeaf, 2, 0, 0),
+			*NewBinTreeNode(nodeTypeNot, 1, 6, 0),
+			*NewBinTreeNode(nodeTypeLeaf, 5, 0, 0),
+		},
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is invalid: %s", err)
+	}
+
+	for _, markEnds := range []bool{false, true} {
+		if markEnds {
+			tree.markSubtreeEnds()
+		}
+		state := tree.NewState()
+		state.SetStallIndex(1)
+
+		// Non-exiting nodes stay undecided until both children are known
+		state.MarkNode(3, true)
+		tCheckNode(t, state, 2, binTreeStateUnknown)
+		state.MarkNode(4, false)
+		tCheckNode(t, state, 2, binTreeStateTrue)
+		tCheckNode(t, state, 1, binTreeStateUnknown)
+
+		// Resolving stops at the stall index, leaving the loop undecided
+		state.ResolveNode(1)
+		tCheckNode(t, state, 6, binTreeStateFalse)
+		tCheckNode(t, state, 5, binTreeStateTrue)
+		tCheckNode(t, state, 1, binTreeStateTrue)
+		tCheckNode(t, state, 0, binTreeStateUnknown)
+		if state.Err() != nil {
+			t.Fatalf("unexpected error: %v", state.Err())
+		}
+	}
+}
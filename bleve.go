@@ -0,0 +1,308 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"math"
+	"strings"
+)
+
+// bleveConverter translates expressions into Bleve queries which select a
+// superset of the matching documents.  Any clause which cannot be translated
+// is widened to match every document and recorded, so that the query can be
+// used to pre-filter documents before they are evaluated by the matcher.
+type bleveConverter struct {
+	// vars holds the field path iterated over by each loop variable
+	vars         map[VariableID]string
+	untranslated []Expression
+}
+
+func bleveMatchAll() map[string]interface{} {
+	return map[string]interface{}{"match_all": map[string]interface{}{}}
+}
+
+func bleveMatchNone() map[string]interface{} {
+	return map[string]interface{}{"match_none": map[string]interface{}{}}
+}
+
+func bleveIsMatchAll(query map[string]interface{}) bool {
+	_, ok := query["match_all"]
+	return ok
+}
+
+// widen records an untranslatable clause and returns the query standing in
+// for it
+func (conv *bleveConverter) widen(expr Expression) map[string]interface{} {
+	conv.untranslated = append(conv.untranslated, expr)
+	return bleveMatchAll()
+}
+
+// field returns the Bleve field name for a path.  Bleve indexes the elements
+// of an array under the name of the array itself, so array indexes are dropped,
+// which only widens the query.
+func (conv *bleveConverter) field(expr FieldExpr) (string, bool) {
+	var parts []string
+	if expr.Root != 0 {
+		rootPath, ok := conv.vars[expr.Root]
+		if !ok {
+			return "", false
+		}
+		parts = append(parts, rootPath)
+	}
+
+	for _, elem := range expr.Path {
+		if fmtArrayIndexRegex.MatchString(elem) {
+			continue
+		}
+		if len(elem) == 0 || strings.Contains(elem, ".") || elem == OperatorMeta+"()" {
+			return "", false
+		}
+		parts = append(parts, elem)
+	}
+
+	if len(parts) == 0 {
+		return "", false
+	}
+	return strings.Join(parts, "."), true
+}
+
+func bleveNumber(value interface{}) (float64, bool) {
+	var out float64
+	switch value := value.(type) {
+	case int:
+		out = float64(value)
+	case int8:
+		out = float64(value)
+	case int16:
+		out = float64(value)
+	case int32:
+		out = float64(value)
+	case int64:
+		out = float64(value)
+	case uint:
+		out = float64(value)
+	case uint8:
+		out = float64(value)
+	case uint16:
+		out = float64(value)
+	case uint32:
+		out = float64(value)
+	case uint64:
+		out = float64(value)
+	case float32:
+		out = float64(value)
+	case float64:
+		out = value
+	default:
+		return 0, false
+	}
+	if math.IsNaN(out) || math.IsInf(out, 0) {
+		return 0, false
+	}
+	return out, true
+}
+
+// bleveDate returns the date string of a DATE() call or time literal
+func bleveDate(expr Expression) (string, bool) {
+	switch expr := expr.(type) {
+	case TimeExpr:
+		timeStr, ok := expr.Time.(string)
+		return timeStr, ok
+	case FuncExpr:
+		if expr.FuncName != DateFunc || len(expr.Params) != 1 {
+			return "", false
+		}
+		if valExpr, ok := expr.Params[0].(ValueExpr); ok {
+			timeStr, ok := valExpr.Value.(string)
+			return timeStr, ok
+		}
+	}
+	return "", false
+}
+
+// bleveDateField returns the field of a DATE() call on a field
+func bleveDateField(expr Expression) (FieldExpr, bool) {
+	funcExpr, ok := expr.(FuncExpr)
+	if !ok || funcExpr.FuncName != DateFunc || len(funcExpr.Params) != 1 {
+		return FieldExpr{}, false
+	}
+	fieldExpr, ok := funcExpr.Params[0].(FieldExpr)
+	return fieldExpr, ok
+}
+
+// bleveRange builds a range query for `field op bound` using the given key
+// names for the lower and upper bounds
+func bleveRange(op, field string, bound interface{}, minKey, maxKey string) map[string]interface{} {
+	query := map[string]interface{}{"field": field}
+	switch op {
+	case "=":
+		query[minKey] = bound
+		query[maxKey] = bound
+		query["inclusive_"+minKey] = true
+		query["inclusive_"+maxKey] = true
+	case "<", "<=":
+		query[maxKey] = bound
+		query["inclusive_"+maxKey] = op == "<="
+	case ">", ">=":
+		query[minKey] = bound
+		query["inclusive_"+minKey] = op == ">="
+	}
+	return query
+}
+
+var bleveFlippedOps = map[string]string{
+	"=":  "=",
+	"<":  ">",
+	"<=": ">=",
+	">":  "<",
+	">=": "<=",
+}
+
+func (conv *bleveConverter) comparison(expr Expression, op string, lhs, rhs Expression) map[string]interface{} {
+	_, lhsIsField := lhs.(FieldExpr)
+	_, lhsIsDate := bleveDateField(lhs)
+	if !lhsIsField && !lhsIsDate {
+		lhs, rhs = rhs, lhs
+		op = bleveFlippedOps[op]
+	}
+
+	if fieldExpr, ok := bleveDateField(lhs); ok {
+		field, ok := conv.field(fieldExpr)
+		date, isDate := bleveDate(rhs)
+		if !ok || !isDate {
+			return conv.widen(expr)
+		}
+		return bleveRange(op, field, date, "start", "end")
+	}
+
+	fieldExpr, ok := lhs.(FieldExpr)
+	if !ok {
+		return conv.widen(expr)
+	}
+	field, ok := conv.field(fieldExpr)
+	valExpr, isValue := rhs.(ValueExpr)
+	if !ok || !isValue {
+		return conv.widen(expr)
+	}
+
+	if number, ok := bleveNumber(valExpr.Value); ok {
+		return bleveRange(op, field, number, "min", "max")
+	}
+	if op != "=" {
+		// Term ranges compare the analyzed terms rather than the values
+		return conv.widen(expr)
+	}
+
+	switch value := valExpr.Value.(type) {
+	case bool:
+		return map[string]interface{}{"bool": value, "field": field}
+	case string:
+		// An empty phrase matches nothing, rather than empty strings
+		if len(value) == 0 {
+			return conv.widen(expr)
+		}
+		// The phrase is analyzed the same way as the field, so this matches
+		// whether or not the field uses the keyword analyzer
+		return map[string]interface{}{"match_phrase": value, "field": field}
+	}
+
+	// Null values are not indexed
+	return conv.widen(expr)
+}
+
+func (conv *bleveConverter) loop(expr Expression, varID VariableID, inExpr, subExpr Expression) map[string]interface{} {
+	fieldExpr, ok := inExpr.(FieldExpr)
+	if !ok {
+		return conv.widen(expr)
+	}
+	field, ok := conv.field(fieldExpr)
+	if !ok {
+		return conv.widen(expr)
+	}
+
+	// Fields of the loop variable are indexed under the array they belong to,
+	// however clauses on different fields may then be satisfied by different
+	// elements, so the query is only a superset of the loop
+	if conv.vars == nil {
+		conv.vars = make(map[VariableID]string)
+	}
+	conv.vars[varID] = field
+	defer delete(conv.vars, varID)
+	return conv.convert(subExpr)
+}
+
+func (conv *bleveConverter) join(exprs []Expression, key string) map[string]interface{} {
+	var queries []interface{}
+	for i, subExpr := range exprs {
+		query := conv.convert(subExpr)
+		if bleveIsMatchAll(query) {
+			if key == "conjuncts" {
+				continue
+			}
+			// The remaining clauses are still converted so that all of the
+			// untranslated clauses are reported
+			for _, rest := range exprs[i+1:] {
+				conv.convert(rest)
+			}
+			return bleveMatchAll()
+		}
+		queries = append(queries, query)
+	}
+
+	if len(queries) == 0 {
+		if key == "conjuncts" {
+			return bleveMatchAll()
+		}
+		return bleveMatchNone()
+	}
+	if len(queries) == 1 {
+		return queries[0].(map[string]interface{})
+	}
+	return map[string]interface{}{key: queries}
+}
+
+func (conv *bleveConverter) convert(expr Expression) map[string]interface{} {
+	switch expr := expr.(type) {
+	case TrueExpr:
+		return bleveMatchAll()
+	case FalseExpr:
+		return bleveMatchNone()
+	case AndExpr:
+		return conv.join(expr, "conjuncts")
+	case OrExpr:
+		return conv.join(expr, "disjuncts")
+	case EqualsExpr:
+		return conv.comparison(expr, "=", expr.Lhs, expr.Rhs)
+	case LessThanExpr:
+		return conv.comparison(expr, "<", expr.Lhs, expr.Rhs)
+	case LessEqualsExpr:
+		return conv.comparison(expr, "<=", expr.Lhs, expr.Rhs)
+	case GreaterThanExpr:
+		return conv.comparison(expr, ">", expr.Lhs, expr.Rhs)
+	case GreaterEqualsExpr:
+		return conv.comparison(expr, ">=", expr.Lhs, expr.Rhs)
+	case AnyInExpr:
+		return conv.loop(expr, expr.VarId, expr.InExpr, expr.SubExpr)
+	case AnyEveryInExpr:
+		// A non-empty array whose every element matches has one that does
+		return conv.loop(expr, expr.VarId, expr.InExpr, expr.SubExpr)
+	}
+
+	// Negations would need an exact translation of the negated clause, every
+	// loops also match empty arrays, existence is not indexed and Bleve
+	// regular expressions must match a whole analyzed term
+	return conv.widen(expr)
+}
+
+// ToBleveQuery produces a Bleve (Couchbase FTS) query, suitable for encoding
+// with encoding/json, which matches a superset of the documents matched by
+// the expression.  Clauses which cannot be translated are widened to match
+// every document and returned, and the matcher must still be used to
+// evaluate the documents returned by the query.  Fields are assumed to be
+// indexed with their dotted path, numbers as numeric fields and dates as
+// datetime fields.
+func ToBleveQuery(expr Expression) (map[string]interface{}, []Expression) {
+	var conv bleveConverter
+	query := conv.convert(expr)
+	return query, conv.untranslated
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func bleveQueryJSON(t *testing.T, expr Expression) (string, []Expression) {
+	query, untranslated := ToBleveQuery(expr)
+	out, err := json.Marshal(query)
+	if err != nil {
+		t.Fatalf("Failed to encode query: %v", err)
+	}
+	return string(out), untranslated
+}
+
+func TestToBleveQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	query, untranslated := bleveQueryJSON(t, AndExpr{
+		EqualsExpr{FieldExpr{0, []string{"name", "first"}}, ValueExpr{"Bob"}},
+		OrExpr{
+			LessThanExpr{FieldExpr{0, []string{"arr", "[1]"}}, ValueExpr{-2}},
+			GreaterEqualsExpr{ValueExpr{10.5}, FieldExpr{0, []string{"age"}}},
+		},
+		EqualsExpr{FieldExpr{0, []string{"isActive"}}, ValueExpr{true}},
+	})
+	assert.Empty(untranslated)
+	assert.Equal(`{"conjuncts":[`+
+		`{"field":"name.first","match_phrase":"Bob"},`+
+		`{"disjuncts":[`+
+		`{"field":"arr","inclusive_max":false,"max":-2},`+
+		`{"field":"age","inclusive_max":true,"max":10.5}]},`+
+		`{"bool":true,"field":"isActive"}]}`, query)
+
+	query, untranslated = bleveQueryJSON(t, AnyInExpr{1, FieldExpr{0, []string{"friends"}},
+		AndExpr{
+			EqualsExpr{FieldExpr{1, []string{"age"}}, ValueExpr{uint8(30)}},
+			GreaterThanExpr{
+				FuncExpr{DateFunc, []Expression{FieldExpr{1, []string{"since"}}}},
+				FuncExpr{DateFunc, []Expression{ValueExpr{"2019-01-01T00:00:00Z"}}},
+			},
+		},
+	})
+	assert.Empty(untranslated)
+	assert.Equal(`{"conjuncts":[`+
+		`{"field":"friends.age","inclusive_max":true,"inclusive_min":true,"max":30,"min":30},`+
+		`{"field":"friends.since","inclusive_start":false,"start":"2019-01-01T00:00:00Z"}]}`, query)
+}
+
+func TestToBleveQueryUntranslated(t *testing.T) {
+	assert := assert.New(t)
+
+	notExpr := NotExpr{EqualsExpr{FieldExpr{0, []string{"a"}}, ValueExpr{1}}}
+	likeExpr := LikeExpr{FieldExpr{0, []string{"b"}}, RegexExpr{"^x"}}
+	nullExpr := EqualsExpr{FieldExpr{0, []string{"c"}}, ValueExpr{nil}}
+
+	// Untranslated clauses of a conjunction are dropped
+	query, untranslated := bleveQueryJSON(t, AndExpr{
+		notExpr,
+		EqualsExpr{FieldExpr{0, []string{"d"}}, ValueExpr{"x"}},
+	})
+	assert.Equal([]Expression{notExpr}, untranslated)
+	assert.Equal(`{"field":"d","match_phrase":"x"}`, query)
+
+	// While they widen a disjunction to every document
+	query, untranslated = bleveQueryJSON(t, OrExpr{
+		EqualsExpr{FieldExpr{0, []string{"d"}}, ValueExpr{"x"}},
+		likeExpr,
+		nullExpr,
+	})
+	assert.Equal([]Expression{likeExpr, nullExpr}, untranslated)
+	assert.Equal(`{"match_all":{}}`, query)
+
+	everyExpr := EveryInExpr{1, FieldExpr{0, []string{"tags"}},
+		EqualsExpr{FieldExpr{1, nil}, ValueExpr{"x"}}}
+	query, untranslated = bleveQueryJSON(t, everyExpr)
+	assert.Equal([]Expression{everyExpr}, untranslated)
+	assert.Equal(`{"match_all":{}}`, query)
+
+	query, untranslated = bleveQueryJSON(t, AndExpr{FalseExpr{}, TrueExpr{}})
+	assert.Empty(untranslated)
+	assert.Equal(`{"match_none":{}}`, query)
+}
@@ -0,0 +1,247 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	bsonTypeDouble     = 0x01
+	bsonTypeString     = 0x02
+	bsonTypeDocument   = 0x03
+	bsonTypeArray      = 0x04
+	bsonTypeBinary     = 0x05
+	bsonTypeUndefined  = 0x06
+	bsonTypeObjectId   = 0x07
+	bsonTypeBool       = 0x08
+	bsonTypeDateTime   = 0x09
+	bsonTypeNull       = 0x0A
+	bsonTypeRegex      = 0x0B
+	bsonTypeDBPointer  = 0x0C
+	bsonTypeJavaScript = 0x0D
+	bsonTypeSymbol     = 0x0E
+	bsonTypeCodeScope  = 0x0F
+	bsonTypeInt32      = 0x10
+	bsonTypeTimestamp  = 0x11
+	bsonTypeInt64      = 0x12
+	bsonTypeDecimal128 = 0x13
+	bsonTypeMinKey     = 0xFF
+	bsonTypeMaxKey     = 0x7F
+)
+
+// bsonTokenizer produces the JSON token sequence for a BSON document.
+// Values without a JSON equivalent are mapped the same way as MongoDB's
+// relaxed extended JSON would present them to a user: ObjectIds become hex
+// strings, dates become RFC3339 strings usable with DATE(), and binary data
+// becomes a base64 string.
+type bsonTokenizer struct {
+	tokenStream
+}
+
+func (tkn *bsonTokenizer) Reset(data []byte) {
+	tkn.reset()
+	if len(data) == 0 {
+		return
+	}
+	if _, err := tkn.decodeDocument(data, false); err != nil {
+		tkn.err = err
+	}
+}
+
+func bsonCString(data []byte) ([]byte, int, error) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return nil, 0, ErrorBsonMalformed
+	}
+	return data[:end], end + 1, nil
+}
+
+func bsonString(data []byte) ([]byte, int, error) {
+	if len(data) < 4 {
+		return nil, 0, ErrorBsonMalformed
+	}
+	length := int(int32(binary.LittleEndian.Uint32(data)))
+	if length < 1 || len(data)-4 < length || data[4+length-1] != 0 {
+		return nil, 0, ErrorBsonMalformed
+	}
+	return data[4 : 4+length-1], 4 + length, nil
+}
+
+// decodeDocument emits the tokens for the document at the start of data and
+// returns the number of bytes it occupied
+func (tkn *bsonTokenizer) decodeDocument(data []byte, isArray bool) (int, error) {
+	if len(data) < 5 {
+		return 0, ErrorBsonMalformed
+	}
+	length := int(int32(binary.LittleEndian.Uint32(data)))
+	if length < 5 || length > len(data) || data[length-1] != 0 {
+		return 0, ErrorBsonMalformed
+	}
+
+	if isArray {
+		tkn.beginArray()
+	} else {
+		tkn.beginObject()
+	}
+
+	pos := 4
+	for pos < length-1 {
+		elemType := data[pos]
+		pos++
+
+		name, n, err := bsonCString(data[pos : length-1])
+		if err != nil {
+			return 0, err
+		}
+		pos += n
+
+		// Array keys are just the indexes, so only objects use them
+		if !isArray {
+			tkn.key(name)
+		}
+
+		n, err = tkn.decodeValue(elemType, data[pos:length-1])
+		if err != nil {
+			return 0, err
+		}
+		pos += n
+	}
+
+	tkn.end()
+	return length, nil
+}
+
+func (tkn *bsonTokenizer) decodeValue(elemType byte, data []byte) (int, error) {
+	fixedSize := func(size int) error {
+		if len(data) < size {
+			return ErrorBsonMalformed
+		}
+		return nil
+	}
+
+	switch elemType {
+	case bsonTypeDouble:
+		if err := fixedSize(8); err != nil {
+			return 0, err
+		}
+		tkn.floatValue(math.Float64frombits(binary.LittleEndian.Uint64(data)))
+		return 8, nil
+	case bsonTypeString, bsonTypeJavaScript, bsonTypeSymbol:
+		value, n, err := bsonString(data)
+		if err != nil {
+			return 0, err
+		}
+		tkn.stringValue(value)
+		return n, nil
+	case bsonTypeDocument:
+		return tkn.decodeDocument(data, false)
+	case bsonTypeArray:
+		return tkn.decodeDocument(data, true)
+	case bsonTypeBinary:
+		if err := fixedSize(5); err != nil {
+			return 0, err
+		}
+		length := int(int32(binary.LittleEndian.Uint32(data)))
+		if length < 0 || len(data)-5 < length {
+			return 0, ErrorBsonMalformed
+		}
+		value := data[5 : 5+length]
+		encoded := tkn.scratchBytes(base64.StdEncoding.EncodedLen(len(value)))
+		base64.StdEncoding.Encode(encoded, value)
+		tkn.stringValue(encoded)
+		return 5 + length, nil
+	case bsonTypeUndefined, bsonTypeNull, bsonTypeMinKey, bsonTypeMaxKey:
+		tkn.nullValue()
+		return 0, nil
+	case bsonTypeObjectId:
+		if err := fixedSize(12); err != nil {
+			return 0, err
+		}
+		encoded := tkn.scratchBytes(24)
+		hex.Encode(encoded, data[:12])
+		tkn.stringValue(encoded)
+		return 12, nil
+	case bsonTypeBool:
+		if err := fixedSize(1); err != nil {
+			return 0, err
+		}
+		tkn.boolValue(data[0] != 0)
+		return 1, nil
+	case bsonTypeDateTime:
+		if err := fixedSize(8); err != nil {
+			return 0, err
+		}
+		millis := int64(binary.LittleEndian.Uint64(data))
+		timeVal := time.Unix(millis/1000, (millis%1000)*int64(time.Millisecond)).UTC()
+		encoded := tkn.scratchBytes(len(time.RFC3339Nano) + 8)
+		tkn.stringValue(timeVal.AppendFormat(encoded[:0], time.RFC3339Nano))
+		return 8, nil
+	case bsonTypeRegex:
+		pattern, n, err := bsonCString(data)
+		if err != nil {
+			return 0, err
+		}
+		_, m, err := bsonCString(data[n:])
+		if err != nil {
+			return 0, err
+		}
+		tkn.stringValue(pattern)
+		return n + m, nil
+	case bsonTypeDBPointer:
+		_, n, err := bsonString(data)
+		if err != nil {
+			return 0, err
+		}
+		if len(data)-n < 12 {
+			return 0, ErrorBsonMalformed
+		}
+		tkn.nullValue()
+		return n + 12, nil
+	case bsonTypeCodeScope:
+		if err := fixedSize(4); err != nil {
+			return 0, err
+		}
+		length := int(int32(binary.LittleEndian.Uint32(data)))
+		if length < 4 || len(data) < length {
+			return 0, ErrorBsonMalformed
+		}
+		code, _, err := bsonString(data[4:length])
+		if err != nil {
+			return 0, err
+		}
+		tkn.stringValue(code)
+		return length, nil
+	case bsonTypeInt32:
+		if err := fixedSize(4); err != nil {
+			return 0, err
+		}
+		tkn.intValue(int64(int32(binary.LittleEndian.Uint32(data))))
+		return 4, nil
+	case bsonTypeTimestamp:
+		if err := fixedSize(8); err != nil {
+			return 0, err
+		}
+		tkn.uintValue(binary.LittleEndian.Uint64(data))
+		return 8, nil
+	case bsonTypeInt64:
+		if err := fixedSize(8); err != nil {
+			return 0, err
+		}
+		tkn.intValue(int64(binary.LittleEndian.Uint64(data)))
+		return 8, nil
+	}
+
+	return 0, fmt.Errorf("%v: type 0x%02x", ErrorBsonUnsupported, elemType)
+}
+
+// NewBSONMatcher returns a matcher which evaluates documents encoded as BSON
+func NewBSONMatcher(def *MatchDef) *FastMatcher {
+	return newFastMatcherWithTokenizer(def, &bsonTokenizer{})
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func bsonAppendDocument(out []byte, value interface{}) []byte {
+	start := len(out)
+	out = append(out, 0, 0, 0, 0)
+
+	appendElem := func(name string, elemValue interface{}) {
+		typePos := len(out)
+		out = append(out, 0)
+		out = append(out, name...)
+		out = append(out, 0)
+		var elemType byte
+		elemType, out = bsonAppendValue(out, elemValue)
+		out[typePos] = elemType
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for _, key := range mongoSortedKeys(value) {
+			appendElem(key, value[key])
+		}
+	case []interface{}:
+		for i, elem := range value {
+			appendElem(strconv.Itoa(i), elem)
+		}
+	}
+
+	out = append(out, 0)
+	binary.LittleEndian.PutUint32(out[start:], uint32(len(out)-start))
+	return out
+}
+
+func bsonAppendUint32(out []byte, value uint32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], value)
+	return append(out, tmp[:]...)
+}
+
+func bsonAppendUint64(out []byte, value uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], value)
+	return append(out, tmp[:]...)
+}
+
+func bsonAppendValue(out []byte, value interface{}) (byte, []byte) {
+	switch value := value.(type) {
+	case nil:
+		return bsonTypeNull, out
+	case bool:
+		if value {
+			return bsonTypeBool, append(out, 1)
+		}
+		return bsonTypeBool, append(out, 0)
+	case json.Number:
+		if intVal, err := value.Int64(); err == nil {
+			if intVal >= math.MinInt32 && intVal <= math.MaxInt32 {
+				return bsonTypeInt32, bsonAppendUint32(out, uint32(intVal))
+			}
+			return bsonTypeInt64, bsonAppendUint64(out, uint64(intVal))
+		}
+		floatVal, _ := value.Float64()
+		return bsonTypeDouble, bsonAppendUint64(out, math.Float64bits(floatVal))
+	case string:
+		out = bsonAppendUint32(out, uint32(len(value)+1))
+		out = append(out, value...)
+		return bsonTypeString, append(out, 0)
+	case map[string]interface{}:
+		return bsonTypeDocument, bsonAppendDocument(out, value)
+	case []interface{}:
+		return bsonTypeArray, bsonAppendDocument(out, value)
+	}
+	panic("unexpected value")
+}
+
+func jsonToBson(t *testing.T, data []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("Failed to decode test document: %v", err)
+	}
+	return bsonAppendDocument(nil, value)
+}
+
+func runBsonMatchTest(t *testing.T, expr Expression) {
+	t.Helper()
+
+	var trans Transformer
+	matchDef := trans.Transform([]Expression{expr})
+
+	jsonMatcher := NewFastMatcher(matchDef)
+	bsonMatcher := NewBSONMatcher(matchDef)
+	for _, doc := range getTestPeopleDocs() {
+		jsonMatcher.Reset()
+		expected, err := jsonMatcher.Match(doc)
+		if err != nil {
+			t.Fatalf("JSON matcher error: %v", err)
+		}
+
+		bsonMatcher.Reset()
+		matched, err := bsonMatcher.Match(jsonToBson(t, doc))
+		if err != nil {
+			t.Fatalf("BSON matcher error: %v", err)
+		}
+
+		if matched != expected {
+			t.Fatalf("BSON match result %v differs from JSON for %v", matched, expr)
+		}
+	}
+}
+
+func TestBSONMatcherPeople(t *testing.T) {
+	runBsonMatchTest(t, AndExpr{
+		GreaterThanExpr{FieldExpr{0, []string{"age"}}, ValueExpr{25}},
+		EqualsExpr{FieldExpr{0, []string{"isActive"}}, ValueExpr{true}},
+	})
+	runBsonMatchTest(t, OrExpr{
+		EqualsExpr{FieldExpr{0, []string{"name"}}, ValueExpr{"Daphne Sutton"}},
+		LessThanExpr{FieldExpr{0, []string{"latitude"}}, ValueExpr{-50.5}},
+	})
+	runBsonMatchTest(t, AnyInExpr{1, FieldExpr{0, []string{"friends"}},
+		LikeExpr{FieldExpr{1, []string{"name"}}, RegexExpr{"^G"}}})
+	runBsonMatchTest(t, EveryInExpr{1, FieldExpr{0, []string{"tags"}},
+		NotEqualsExpr{FieldExpr{1, nil}, ValueExpr{"ex"}}})
+	runBsonMatchTest(t, EqualsExpr{FieldExpr{0, []string{"tags", "[1]"}}, ValueExpr{"laborum"}})
+	runBsonMatchTest(t, NotExistsExpr{FieldExpr{0, []string{"sometimesValue"}}})
+	runBsonMatchTest(t, EqualsExpr{FieldExpr{0, []string{"sometimesValue"}}, ValueExpr{nil}})
+}
+
+func TestBSONMatcherTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	// {_id: ObjectId("5b47eb0936ff92a567a0307e"), at: ISODate("2019-03-01T10:00:00Z"),
+	//  bin: BinData(0, "aGk="), n: NumberLong(7), ts: Timestamp}
+	var doc []byte
+	doc = append(doc, 0, 0, 0, 0)
+	doc = append(doc, bsonTypeObjectId, '_', 'i', 'd', 0)
+	doc = append(doc, 0x5b, 0x47, 0xeb, 0x09, 0x36, 0xff, 0x92, 0xa5, 0x67, 0xa0, 0x30, 0x7e)
+	doc = append(doc, bsonTypeDateTime, 'a', 't', 0)
+	doc = bsonAppendUint64(doc, uint64(1551434400000))
+	doc = append(doc, bsonTypeBinary, 'b', 'i', 'n', 0, 2, 0, 0, 0, 0, 'h', 'i')
+	doc = append(doc, bsonTypeInt64, 'n', 0)
+	doc = bsonAppendUint64(doc, 7)
+	doc = append(doc, bsonTypeTimestamp, 't', 's', 0)
+	doc = bsonAppendUint64(doc, 1<<32|5)
+	doc = append(doc, 0)
+	binary.LittleEndian.PutUint32(doc, uint32(len(doc)))
+
+	expr := AndExpr{
+		EqualsExpr{FieldExpr{0, []string{"_id"}}, ValueExpr{"5b47eb0936ff92a567a0307e"}},
+		GreaterThanExpr{
+			FuncExpr{DateFunc, []Expression{FieldExpr{0, []string{"at"}}}},
+			FuncExpr{DateFunc, []Expression{ValueExpr{"2019-02-28"}}},
+		},
+		EqualsExpr{FieldExpr{0, []string{"bin"}}, ValueExpr{"aGk="}},
+		EqualsExpr{FieldExpr{0, []string{"n"}}, ValueExpr{7}},
+		GreaterThanExpr{FieldExpr{0, []string{"ts"}}, ValueExpr{1 << 32}},
+	}
+
+	var trans Transformer
+	matcher := NewBSONMatcher(trans.Transform([]Expression{expr}))
+	matched, err := matcher.Match(doc)
+	assert.Nil(err)
+	assert.True(matched)
+
+	matcher.Reset()
+	_, err = matcher.Match(doc[:len(doc)-3])
+	assert.Equal(ErrorBsonMalformed, err)
+
+	matcher.Reset()
+	doc[4] = bsonTypeDecimal128
+	_, err = matcher.Match(doc)
+	assert.NotNil(err)
+}
@@ -0,0 +1,318 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	cborMajorUint   = 0
+	cborMajorNegInt = 1
+	cborMajorBytes  = 2
+	cborMajorText   = 3
+	cborMajorArray  = 4
+	cborMajorMap    = 5
+	cborMajorTag    = 6
+	cborMajorSimple = 7
+
+	cborIndefinite = 31
+	cborBreak      = 0xFF
+
+	cborTagDateString = 0
+	cborTagEpochDate  = 1
+
+	// Guards against stack exhaustion on hostile input
+	cborMaxDepth = 512
+)
+
+// cborTokenizer produces the JSON token sequence for a CBOR data item.
+// Byte strings become base64 strings, date tags become RFC3339 strings
+// usable with DATE(), and other tags are matched by their content.
+type cborTokenizer struct {
+	tokenStream
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (tkn *cborTokenizer) Reset(data []byte) {
+	tkn.reset()
+	tkn.data = data
+	tkn.pos = 0
+	tkn.depth = 0
+	if len(data) == 0 {
+		return
+	}
+
+	if err := tkn.decodeItem(); err != nil {
+		tkn.err = err
+	} else if tkn.pos != len(data) {
+		tkn.err = ErrorCborMalformed
+	}
+}
+
+// readHead reads the initial byte of an item along with its argument
+func (tkn *cborTokenizer) readHead() (byte, byte, uint64, error) {
+	if tkn.pos >= len(tkn.data) {
+		return 0, 0, 0, ErrorCborMalformed
+	}
+	initial := tkn.data[tkn.pos]
+	tkn.pos++
+
+	major := initial >> 5
+	info := initial & 0x1f
+
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	case info == cborIndefinite:
+		return major, info, 0, nil
+	default:
+		return 0, 0, 0, ErrorCborMalformed
+	}
+
+	if len(tkn.data)-tkn.pos < size {
+		return 0, 0, 0, ErrorCborMalformed
+	}
+	var arg uint64
+	for _, b := range tkn.data[tkn.pos : tkn.pos+size] {
+		arg = arg<<8 | uint64(b)
+	}
+	tkn.pos += size
+	return major, info, arg, nil
+}
+
+func (tkn *cborTokenizer) atBreak() bool {
+	if tkn.pos < len(tkn.data) && tkn.data[tkn.pos] == cborBreak {
+		tkn.pos++
+		return true
+	}
+	return false
+}
+
+// readString reads the content of a byte or text string, joining the chunks
+// of indefinite length strings together
+func (tkn *cborTokenizer) readString(major, info byte, length uint64) ([]byte, error) {
+	if info != cborIndefinite {
+		if uint64(len(tkn.data)-tkn.pos) < length {
+			return nil, ErrorCborMalformed
+		}
+		value := tkn.data[tkn.pos : tkn.pos+int(length)]
+		tkn.pos += int(length)
+		return value, nil
+	}
+
+	var chunks [][]byte
+	totalLen := 0
+	for !tkn.atBreak() {
+		chunkMajor, chunkInfo, chunkLen, err := tkn.readHead()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor != major || chunkInfo == cborIndefinite {
+			return nil, ErrorCborMalformed
+		}
+		chunk, err := tkn.readString(chunkMajor, chunkInfo, chunkLen)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+		totalLen += len(chunk)
+	}
+
+	value := tkn.scratchBytes(totalLen)[:0]
+	for _, chunk := range chunks {
+		value = append(value, chunk...)
+	}
+	return value, nil
+}
+
+func (tkn *cborTokenizer) readKey() error {
+	major, info, arg, err := tkn.readHead()
+	if err != nil {
+		return err
+	}
+
+	switch major {
+	case cborMajorText, cborMajorBytes:
+		name, err := tkn.readString(major, info, arg)
+		if err != nil {
+			return err
+		}
+		tkn.key(name)
+	case cborMajorUint:
+		tkn.key(strconv.AppendUint(tkn.scratchBytes(20)[:0], arg, 10))
+	case cborMajorNegInt:
+		name := append(tkn.scratchBytes(21)[:0], '-')
+		tkn.key(strconv.AppendUint(name, arg+1, 10))
+	default:
+		return fmt.Errorf("%v: map key of major type %d", ErrorCborUnsupported, major)
+	}
+	return nil
+}
+
+func cborHalfFloat(bits uint16) float64 {
+	exp := int(bits>>10) & 0x1f
+	mant := float64(bits & 0x3ff)
+
+	var value float64
+	switch exp {
+	case 0:
+		value = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if bits&0x8000 != 0 {
+		return -value
+	}
+	return value
+}
+
+func (tkn *cborTokenizer) epochValue(seconds float64) {
+	whole, frac := math.Modf(seconds)
+	timeVal := time.Unix(int64(whole), int64(frac*float64(time.Second))).UTC()
+	encoded := tkn.scratchBytes(len(time.RFC3339Nano) + 8)
+	tkn.stringValue(timeVal.AppendFormat(encoded[:0], time.RFC3339Nano))
+}
+
+func (tkn *cborTokenizer) decodeItem() error {
+	tkn.depth++
+	defer func() { tkn.depth-- }()
+	if tkn.depth > cborMaxDepth {
+		return ErrorCborMalformed
+	}
+
+	major, info, arg, err := tkn.readHead()
+	if err != nil {
+		return err
+	}
+	if info == cborIndefinite && (major == cborMajorUint || major == cborMajorNegInt ||
+		major == cborMajorTag || major == cborMajorSimple) {
+		return ErrorCborMalformed
+	}
+
+	switch major {
+	case cborMajorUint:
+		tkn.uintValue(arg)
+	case cborMajorNegInt:
+		if arg > math.MaxInt64 {
+			tkn.floatValue(-1 - float64(arg))
+		} else {
+			tkn.intValue(-1 - int64(arg))
+		}
+	case cborMajorBytes:
+		value, err := tkn.readString(major, info, arg)
+		if err != nil {
+			return err
+		}
+		encoded := tkn.scratchBytes(base64.StdEncoding.EncodedLen(len(value)))
+		base64.StdEncoding.Encode(encoded, value)
+		tkn.stringValue(encoded)
+	case cborMajorText:
+		value, err := tkn.readString(major, info, arg)
+		if err != nil {
+			return err
+		}
+		tkn.stringValue(value)
+	case cborMajorArray:
+		tkn.beginArray()
+		for i := uint64(0); info == cborIndefinite || i < arg; i++ {
+			if info == cborIndefinite && tkn.atBreak() {
+				break
+			}
+			if err := tkn.decodeItem(); err != nil {
+				return err
+			}
+		}
+		tkn.end()
+	case cborMajorMap:
+		tkn.beginObject()
+		for i := uint64(0); info == cborIndefinite || i < arg; i++ {
+			if info == cborIndefinite && tkn.atBreak() {
+				break
+			}
+			if err := tkn.readKey(); err != nil {
+				return err
+			}
+			if err := tkn.decodeItem(); err != nil {
+				return err
+			}
+		}
+		tkn.end()
+	case cborMajorTag:
+		return tkn.decodeTag(arg)
+	case cborMajorSimple:
+		switch info {
+		case 20:
+			tkn.boolValue(false)
+		case 21:
+			tkn.boolValue(true)
+		case 22, 23:
+			tkn.nullValue()
+		case 25:
+			tkn.floatValue(cborHalfFloat(uint16(arg)))
+		case 26:
+			tkn.floatValue(float64(math.Float32frombits(uint32(arg))))
+		case 27:
+			tkn.floatValue(math.Float64frombits(arg))
+		default:
+			return fmt.Errorf("%v: simple value %d", ErrorCborUnsupported, arg)
+		}
+	}
+
+	return nil
+}
+
+func (tkn *cborTokenizer) decodeTag(tag uint64) error {
+	if tag != cborTagEpochDate {
+		// Date strings are already RFC3339, and other tags are matched by
+		// their content
+		return tkn.decodeItem()
+	}
+
+	major, info, arg, err := tkn.readHead()
+	if err != nil {
+		return err
+	}
+	switch {
+	case major == cborMajorUint:
+		tkn.epochValue(float64(arg))
+	case major == cborMajorNegInt:
+		tkn.epochValue(-1 - float64(arg))
+	case major == cborMajorSimple && info == 25:
+		tkn.epochValue(cborHalfFloat(uint16(arg)))
+	case major == cborMajorSimple && info == 26:
+		tkn.epochValue(float64(math.Float32frombits(uint32(arg))))
+	case major == cborMajorSimple && info == 27:
+		tkn.epochValue(math.Float64frombits(arg))
+	default:
+		return ErrorCborMalformed
+	}
+	return nil
+}
+
+// NewCBORMatcher returns a matcher which evaluates documents encoded as CBOR
+func NewCBORMatcher(def *MatchDef) *FastMatcher {
+	return newFastMatcherWithTokenizer(def, &cborTokenizer{})
+}
@@ -0,0 +1,173 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cborAppendHead(out []byte, major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return append(out, major<<5|byte(arg))
+	case arg <= math.MaxUint8:
+		return append(out, major<<5|24, byte(arg))
+	case arg <= math.MaxUint16:
+		return append(out, major<<5|25, byte(arg>>8), byte(arg))
+	case arg <= math.MaxUint32:
+		return append(out, major<<5|26, byte(arg>>24), byte(arg>>16), byte(arg>>8), byte(arg))
+	}
+	out = append(out, major<<5|27)
+	for shift := 56; shift >= 0; shift -= 8 {
+		out = append(out, byte(arg>>uint(shift)))
+	}
+	return out
+}
+
+func cborAppendValue(out []byte, value interface{}) []byte {
+	switch value := value.(type) {
+	case nil:
+		return append(out, 0xf6)
+	case bool:
+		if value {
+			return append(out, 0xf5)
+		}
+		return append(out, 0xf4)
+	case json.Number:
+		if intVal, err := value.Int64(); err == nil {
+			if intVal < 0 {
+				return cborAppendHead(out, cborMajorNegInt, uint64(-1-intVal))
+			}
+			return cborAppendHead(out, cborMajorUint, uint64(intVal))
+		}
+		floatVal, _ := value.Float64()
+		bits := math.Float64bits(floatVal)
+		out = append(out, cborMajorSimple<<5|27)
+		for shift := 56; shift >= 0; shift -= 8 {
+			out = append(out, byte(bits>>uint(shift)))
+		}
+		return out
+	case string:
+		out = cborAppendHead(out, cborMajorText, uint64(len(value)))
+		return append(out, value...)
+	case map[string]interface{}:
+		out = cborAppendHead(out, cborMajorMap, uint64(len(value)))
+		for _, key := range mongoSortedKeys(value) {
+			out = cborAppendValue(out, key)
+			out = cborAppendValue(out, value[key])
+		}
+		return out
+	case []interface{}:
+		out = cborAppendHead(out, cborMajorArray, uint64(len(value)))
+		for _, elem := range value {
+			out = cborAppendValue(out, elem)
+		}
+		return out
+	}
+	panic("unexpected value")
+}
+
+func jsonToCbor(t *testing.T, data []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("Failed to decode test document: %v", err)
+	}
+	return cborAppendValue(nil, value)
+}
+
+func runCborMatchTest(t *testing.T, expr Expression) {
+	t.Helper()
+
+	var trans Transformer
+	matchDef := trans.Transform([]Expression{expr})
+
+	jsonMatcher := NewFastMatcher(matchDef)
+	cborMatcher := NewCBORMatcher(matchDef)
+	for _, doc := range getTestPeopleDocs() {
+		jsonMatcher.Reset()
+		expected, err := jsonMatcher.Match(doc)
+		if err != nil {
+			t.Fatalf("JSON matcher error: %v", err)
+		}
+
+		cborMatcher.Reset()
+		matched, err := cborMatcher.Match(jsonToCbor(t, doc))
+		if err != nil {
+			t.Fatalf("CBOR matcher error: %v", err)
+		}
+
+		if matched != expected {
+			t.Fatalf("CBOR match result %v differs from JSON for %v", matched, expr)
+		}
+	}
+}
+
+func TestCBORMatcherPeople(t *testing.T) {
+	runCborMatchTest(t, AndExpr{
+		GreaterThanExpr{FieldExpr{0, []string{"age"}}, ValueExpr{25}},
+		EqualsExpr{FieldExpr{0, []string{"isActive"}}, ValueExpr{true}},
+	})
+	runCborMatchTest(t, OrExpr{
+		EqualsExpr{FieldExpr{0, []string{"name"}}, ValueExpr{"Daphne Sutton"}},
+		LessThanExpr{FieldExpr{0, []string{"latitude"}}, ValueExpr{-50.5}},
+	})
+	runCborMatchTest(t, AnyInExpr{1, FieldExpr{0, []string{"friends"}},
+		LikeExpr{FieldExpr{1, []string{"name"}}, RegexExpr{"^G"}}})
+	runCborMatchTest(t, EveryInExpr{1, FieldExpr{0, []string{"tags"}},
+		NotEqualsExpr{FieldExpr{1, nil}, ValueExpr{"ex"}}})
+	runCborMatchTest(t, EqualsExpr{FieldExpr{0, []string{"tags", "[1]"}}, ValueExpr{"laborum"}})
+	runCborMatchTest(t, NotExistsExpr{FieldExpr{0, []string{"sometimesValue"}}})
+	runCborMatchTest(t, EqualsExpr{FieldExpr{0, []string{"sometimesValue"}}, ValueExpr{nil}})
+}
+
+func TestCBORMatcherTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	// {_("at"): 1(1551434400), "bin": h'6869', "n": 1.5 (half float),
+	//  "s": (_ "ab", "c"), "l": [_ -3, null], 7: "seven"}
+	var doc []byte
+	doc = append(doc, 0xbf)
+	doc = append(doc, 0x7f, 0x61, 'a', 0x61, 't', 0xff)
+	doc = append(doc, 0xc1)
+	doc = cborAppendHead(doc, cborMajorUint, 1551434400)
+	doc = append(doc, 0x63, 'b', 'i', 'n', 0x42, 'h', 'i')
+	doc = append(doc, 0x61, 'n', 0xf9, 0x3e, 0x00)
+	doc = append(doc, 0x61, 's', 0x7f, 0x62, 'a', 'b', 0x61, 'c', 0xff)
+	doc = append(doc, 0x61, 'l', 0x9f, 0x22, 0xf6, 0xff)
+	doc = append(doc, 0x07, 0x65, 's', 'e', 'v', 'e', 'n')
+	doc = append(doc, 0xff)
+
+	expr := AndExpr{
+		EqualsExpr{
+			FuncExpr{DateFunc, []Expression{FieldExpr{0, []string{"at"}}}},
+			FuncExpr{DateFunc, []Expression{ValueExpr{"2019-03-01T10:00:00Z"}}},
+		},
+		EqualsExpr{FieldExpr{0, []string{"bin"}}, ValueExpr{"aGk="}},
+		EqualsExpr{FieldExpr{0, []string{"n"}}, ValueExpr{1.5}},
+		EqualsExpr{FieldExpr{0, []string{"s"}}, ValueExpr{"abc"}},
+		EqualsExpr{FieldExpr{0, []string{"l", "[0]"}}, ValueExpr{-3}},
+		EqualsExpr{FieldExpr{0, []string{"l", "[1]"}}, ValueExpr{nil}},
+		EqualsExpr{FieldExpr{0, []string{"7"}}, ValueExpr{"seven"}},
+	}
+
+	var trans Transformer
+	matcher := NewCBORMatcher(trans.Transform([]Expression{expr}))
+	matched, err := matcher.Match(doc)
+	assert.Nil(err)
+	assert.True(matched)
+
+	matcher.Reset()
+	_, err = matcher.Match(doc[:len(doc)-3])
+	assert.Equal(ErrorCborMalformed, err)
+
+	matcher.Reset()
+	_, err = matcher.Match([]byte{0xa1, 0x80, 0x01})
+	assert.NotNil(err)
+}
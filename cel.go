@@ -0,0 +1,640 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Supports the subset of CEL (Common Expression Language) which maps onto
+// the matcher.  The document is available as `doc`, and the supported
+// constructs are:
+//
+//   && || ! == != < <= > >= in, has(doc.x), list literals,
+//   s.startsWith(x) s.endsWith(x) s.contains(x) s.matches(re),
+//   list.exists(v, pred) list.all(v, pred)
+
+const CelDocumentVariable = "doc"
+
+type celTokenType int
+
+const (
+	celTokenEOF    celTokenType = iota
+	celTokenIdent  celTokenType = iota
+	celTokenInt    celTokenType = iota
+	celTokenFloat  celTokenType = iota
+	celTokenString celTokenType = iota
+	celTokenSymbol celTokenType = iota
+)
+
+type celToken struct {
+	tokenType celTokenType
+	value     string
+	pos       int
+}
+
+var celSymbols []string = []string{"&&", "||", "==", "!=", "<=", ">=", "!", "<", ">", "(", ")", "[", "]", ".", ",", "-", "?", ":"}
+
+func celErrorAt(pos int, format string, args ...interface{}) error {
+	return &FilterExpressionError{
+		Kind:   ErrSyntax,
+		Line:   1,
+		Column: pos + 1,
+		Msg:    fmt.Sprintf(format, args...),
+		Offset: pos,
+	}
+}
+
+func celIsIdentChar(c byte, first bool) bool {
+	if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
+
+func celReadString(input string, pos int) (string, int, error) {
+	start := pos
+	raw := false
+	if input[pos] == 'r' || input[pos] == 'R' {
+		raw = true
+		pos++
+	}
+	quote := input[pos]
+	pos++
+
+	var out strings.Builder
+	for {
+		if pos >= len(input) {
+			return "", 0, celErrorAt(start, "unterminated string")
+		}
+		c := input[pos]
+		if c == quote {
+			return out.String(), pos + 1, nil
+		}
+		if raw || c != '\\' {
+			out.WriteByte(c)
+			pos++
+			continue
+		}
+
+		value, multibyte, tail, err := strconv.UnquoteChar(input[pos:], quote)
+		if err != nil {
+			return "", 0, celErrorAt(pos, "invalid escape sequence")
+		}
+		if multibyte || value >= utf8.RuneSelf {
+			out.WriteRune(value)
+		} else {
+			out.WriteByte(byte(value))
+		}
+		pos = len(input) - len(tail)
+	}
+}
+
+func celTokenize(input string) ([]celToken, error) {
+	var tokens []celToken
+
+	pos := 0
+	for pos < len(input) {
+		c := input[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			pos++
+		case c == '"' || c == '\'' ||
+			((c == 'r' || c == 'R') && pos+1 < len(input) && (input[pos+1] == '"' || input[pos+1] == '\'')):
+			value, end, err := celReadString(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, celToken{celTokenString, value, pos})
+			pos = end
+		case c >= '0' && c <= '9':
+			start := pos
+			tokenType := celTokenInt
+			for pos < len(input) && strings.IndexByte("0123456789.eE", input[pos]) >= 0 {
+				if input[pos] == '.' || input[pos] == 'e' || input[pos] == 'E' {
+					// Stop at member access on an integer literal
+					if input[pos] == '.' && (pos+1 >= len(input) || input[pos+1] < '0' || input[pos+1] > '9') {
+						break
+					}
+					tokenType = celTokenFloat
+				}
+				if (input[pos] == 'e' || input[pos] == 'E') && pos+1 < len(input) &&
+					(input[pos+1] == '-' || input[pos+1] == '+') {
+					pos++
+				}
+				pos++
+			}
+			value := input[start:pos]
+			// Unsigned suffix
+			if tokenType == celTokenInt && pos < len(input) && (input[pos] == 'u' || input[pos] == 'U') {
+				pos++
+			}
+			tokens = append(tokens, celToken{tokenType, value, start})
+		case celIsIdentChar(c, true):
+			start := pos
+			for pos < len(input) && celIsIdentChar(input[pos], false) {
+				pos++
+			}
+			tokens = append(tokens, celToken{celTokenIdent, input[start:pos], start})
+		default:
+			matched := false
+			for _, symbol := range celSymbols {
+				if strings.HasPrefix(input[pos:], symbol) {
+					tokens = append(tokens, celToken{celTokenSymbol, symbol, pos})
+					pos += len(symbol)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, celErrorAt(pos, "unexpected character %q", c)
+			}
+		}
+	}
+
+	tokens = append(tokens, celToken{celTokenEOF, "", len(input)})
+	return tokens, nil
+}
+
+// celListExpr holds a list literal, which is only valid on the right of `in`
+type celListExpr []Expression
+
+func (expr celListExpr) String() string {
+	var items []string
+	for _, item := range expr {
+		items = append(items, item.String())
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+type celParser struct {
+	tokens  []celToken
+	pos     int
+	scopes  []map[string]VariableID
+	nextVar VariableID
+}
+
+func (p *celParser) peek() celToken {
+	return p.tokens[p.pos]
+}
+
+func (p *celParser) next() celToken {
+	token := p.tokens[p.pos]
+	if token.tokenType != celTokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *celParser) errorf(format string, args ...interface{}) error {
+	return celErrorAt(p.peek().pos, format, args...)
+}
+
+func (p *celParser) acceptSymbol(symbol string) bool {
+	token := p.peek()
+	if token.tokenType == celTokenSymbol && token.value == symbol {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *celParser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return p.errorf("expected %q", symbol)
+	}
+	return nil
+}
+
+func (p *celParser) lookupVar(name string) (VariableID, bool) {
+	for i := len(p.scopes) - 1; i >= 0; i-- {
+		if varID, ok := p.scopes[i][name]; ok {
+			return varID, true
+		}
+	}
+	return 0, false
+}
+
+// celCondition turns a value used where a boolean is expected into a condition
+func (p *celParser) celCondition(expr Expression, pos int) (Expression, error) {
+	switch expr := expr.(type) {
+	case FieldExpr:
+		return EqualsExpr{expr, ValueExpr{true}}, nil
+	case ValueExpr:
+		if boolVal, ok := expr.Value.(bool); ok {
+			if boolVal {
+				return TrueExpr{}, nil
+			}
+			return FalseExpr{}, nil
+		}
+		return nil, celErrorAt(pos, "expected a boolean expression")
+	case celListExpr:
+		return nil, celErrorAt(pos, "expected a boolean expression")
+	}
+	return expr, nil
+}
+
+func (p *celParser) parseOr() (Expression, error) {
+	var exprs OrExpr
+	for {
+		pos := p.peek().pos
+		expr, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.acceptSymbol("||") {
+			break
+		}
+		if exprs[0], err = p.celCondition(exprs[0], pos); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	for i, expr := range exprs {
+		var err error
+		if exprs[i], err = p.celCondition(expr, 0); err != nil {
+			return nil, err
+		}
+	}
+	return exprs, nil
+}
+
+func (p *celParser) parseAnd() (Expression, error) {
+	var exprs AndExpr
+	for {
+		expr, err := p.parseRelation()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.acceptSymbol("&&") {
+			break
+		}
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	for i, expr := range exprs {
+		var err error
+		if exprs[i], err = p.celCondition(expr, 0); err != nil {
+			return nil, err
+		}
+	}
+	return exprs, nil
+}
+
+func (p *celParser) parseRelation() (Expression, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	token := p.peek()
+	isIn := token.tokenType == celTokenIdent && token.value == "in"
+	if token.tokenType != celTokenSymbol && !isIn {
+		return lhs, nil
+	}
+
+	switch token.value {
+	case "==", "!=", "<", "<=", ">", ">=", "in":
+		p.pos++
+	default:
+		return lhs, nil
+	}
+
+	rhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token.value {
+	case "==":
+		return EqualsExpr{lhs, rhs}, nil
+	case "!=":
+		return NotEqualsExpr{lhs, rhs}, nil
+	case "<":
+		return LessThanExpr{lhs, rhs}, nil
+	case "<=":
+		return LessEqualsExpr{lhs, rhs}, nil
+	case ">":
+		return GreaterThanExpr{lhs, rhs}, nil
+	case ">=":
+		return GreaterEqualsExpr{lhs, rhs}, nil
+	}
+
+	// in
+	switch rhs := rhs.(type) {
+	case celListExpr:
+		var exprs OrExpr
+		for _, item := range rhs {
+			exprs = append(exprs, EqualsExpr{lhs, item})
+		}
+		if len(exprs) == 0 {
+			return FalseExpr{}, nil
+		}
+		return exprs, nil
+	case FieldExpr:
+		p.nextVar++
+		varID := p.nextVar
+		return AnyInExpr{varID, rhs, EqualsExpr{FieldExpr{varID, nil}, lhs}}, nil
+	}
+	return nil, celErrorAt(token.pos, "in requires a list")
+}
+
+func (p *celParser) parseUnary() (Expression, error) {
+	pos := p.peek().pos
+
+	if p.acceptSymbol("!") {
+		subExpr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		subExpr, err = p.celCondition(subExpr, pos)
+		if err != nil {
+			return nil, err
+		}
+		return NotExpr{subExpr}, nil
+	}
+
+	if p.acceptSymbol("-") {
+		token := p.next()
+		switch token.tokenType {
+		case celTokenInt, celTokenFloat:
+			return celNumber(token, true)
+		}
+		return nil, celErrorAt(token.pos, "negation is only supported on number literals")
+	}
+
+	return p.parseMember()
+}
+
+func celNumber(token celToken, negate bool) (Expression, error) {
+	numStr := token.value
+	if negate {
+		numStr = "-" + numStr
+	}
+	if token.tokenType == celTokenInt {
+		if intVal, err := strconv.ParseInt(numStr, 10, 64); err == nil {
+			return ValueExpr{int(intVal)}, nil
+		}
+	}
+	floatVal, err := strconv.ParseFloat(numStr, 64)
+	if err != nil {
+		return nil, celErrorAt(token.pos, "invalid number %v", token.value)
+	}
+	return ValueExpr{floatVal}, nil
+}
+
+func (p *celParser) parsePrimary() (Expression, error) {
+	token := p.next()
+
+	switch token.tokenType {
+	case celTokenInt, celTokenFloat:
+		return celNumber(token, false)
+	case celTokenString:
+		return ValueExpr{token.value}, nil
+	case celTokenIdent:
+		switch token.value {
+		case "true":
+			return ValueExpr{true}, nil
+		case "false":
+			return ValueExpr{false}, nil
+		case "null":
+			return ValueExpr{nil}, nil
+		case "has":
+			return p.parseHas()
+		}
+		if varID, ok := p.lookupVar(token.value); ok {
+			return FieldExpr{varID, nil}, nil
+		}
+		return nil, celErrorAt(token.pos, "undeclared reference to %q", token.value)
+	case celTokenSymbol:
+		switch token.value {
+		case "(":
+			expr, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectSymbol(")"); err != nil {
+				return nil, err
+			}
+			return expr, nil
+		case "[":
+			var list celListExpr
+			for !p.acceptSymbol("]") {
+				if len(list) > 0 {
+					if err := p.expectSymbol(","); err != nil {
+						return nil, err
+					}
+				}
+				item, err := p.parseUnary()
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			return list, nil
+		}
+	}
+
+	return nil, celErrorAt(token.pos, "unexpected %q", token.value)
+}
+
+func (p *celParser) parseHas() (Expression, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	pos := p.peek().pos
+	field, err := p.parseMember()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+
+	fieldExpr, ok := field.(FieldExpr)
+	if !ok || len(fieldExpr.Path) == 0 {
+		return nil, celErrorAt(pos, "has() requires a field selection")
+	}
+	return ExistsExpr{fieldExpr}, nil
+}
+
+func (p *celParser) parseMember() (Expression, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case p.acceptSymbol("."):
+			nameToken := p.next()
+			if nameToken.tokenType != celTokenIdent {
+				return nil, celErrorAt(nameToken.pos, "expected a field or method name")
+			}
+			if p.acceptSymbol("(") {
+				expr, err = p.parseMethod(expr, nameToken)
+			} else {
+				expr, err = celSelect(expr, nameToken.value, nameToken.pos)
+			}
+			if err != nil {
+				return nil, err
+			}
+		case p.acceptSymbol("["):
+			indexToken := p.next()
+			if err := p.expectSymbol("]"); err != nil {
+				return nil, err
+			}
+			switch indexToken.tokenType {
+			case celTokenString:
+				expr, err = celSelect(expr, indexToken.value, indexToken.pos)
+			case celTokenInt:
+				expr, err = celSelect(expr, "["+indexToken.value+"]", indexToken.pos)
+			default:
+				err = celErrorAt(indexToken.pos, "index must be a string or integer literal")
+			}
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return expr, nil
+		}
+	}
+}
+
+func celSelect(expr Expression, name string, pos int) (Expression, error) {
+	field, ok := expr.(FieldExpr)
+	if !ok {
+		return nil, celErrorAt(pos, "cannot select %q from a non-field value", name)
+	}
+	path := make([]string, len(field.Path), len(field.Path)+1)
+	copy(path, field.Path)
+	return FieldExpr{field.Root, append(path, name)}, nil
+}
+
+func (p *celParser) parseMethod(target Expression, nameToken celToken) (Expression, error) {
+	switch nameToken.value {
+	case "exists", "all":
+		return p.parseMacro(target, nameToken)
+	case "startsWith", "endsWith", "contains", "matches":
+	default:
+		return nil, celErrorAt(nameToken.pos, "unsupported function %q", nameToken.value)
+	}
+
+	argToken := p.next()
+	if argToken.tokenType != celTokenString {
+		return nil, celErrorAt(argToken.pos, "%v requires a string literal", nameToken.value)
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+
+	var pattern string
+	switch nameToken.value {
+	case "startsWith":
+		pattern = "^" + regexp.QuoteMeta(argToken.value)
+	case "endsWith":
+		pattern = regexp.QuoteMeta(argToken.value) + "$"
+	case "contains":
+		pattern = regexp.QuoteMeta(argToken.value)
+	default:
+		pattern = argToken.value
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, newFilterExpressionError(ErrBadRegex, "Invalid regular expression %v: %v", pattern, err)
+		}
+	}
+
+	return LikeExpr{target, RegexExpr{pattern}}, nil
+}
+
+func (p *celParser) parseMacro(target Expression, nameToken celToken) (Expression, error) {
+	field, ok := target.(FieldExpr)
+	if !ok {
+		return nil, celErrorAt(nameToken.pos, "%v() requires a field", nameToken.value)
+	}
+
+	varToken := p.next()
+	if varToken.tokenType != celTokenIdent {
+		return nil, celErrorAt(varToken.pos, "expected a variable name")
+	}
+	if err := p.expectSymbol(","); err != nil {
+		return nil, err
+	}
+
+	p.nextVar++
+	varID := p.nextVar
+	p.scopes = append(p.scopes, map[string]VariableID{varToken.value: varID})
+
+	pos := p.peek().pos
+	subExpr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if subExpr, err = p.celCondition(subExpr, pos); err != nil {
+		return nil, err
+	}
+	p.scopes = p.scopes[:len(p.scopes)-1]
+
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+
+	if nameToken.value == "all" {
+		return EveryInExpr{varID, field, subExpr}, nil
+	}
+	return AnyInExpr{varID, field, subExpr}, nil
+}
+
+// ParseCelExpression converts a CEL boolean expression over `doc` into an
+// expression
+func ParseCelExpression(expression string) (Expression, error) {
+	tokens, err := celTokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &celParser{
+		tokens: tokens,
+		scopes: []map[string]VariableID{{CelDocumentVariable: 0}},
+	}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().tokenType != celTokenEOF {
+		return nil, p.errorf("unexpected %q", p.peek().value)
+	}
+
+	return p.celCondition(expr, 0)
+}
+
+// CompileCelExpression compiles a CEL boolean expression into a MatchDef
+func CompileCelExpression(expression string) (*MatchDef, error) {
+	expr, err := ParseCelExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	var trans Transformer
+	return trans.Transform([]Expression{expr}), nil
+}
+
+func GetCelMatcher(expression string) (Matcher, error) {
+	matchDef, err := CompileCelExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFastMatcher(matchDef), nil
+}
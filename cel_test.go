@@ -0,0 +1,82 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func runCelMatchTest(t *testing.T, expression string, expectedDocIDs []string) {
+	expr, err := ParseCelExpression(expression)
+	if err != nil {
+		t.Fatalf("Failed to parse %v: %v", expression, err)
+	}
+
+	runExprMatchTest(t, expr, expectedDocIDs)
+}
+
+func TestCelExpression(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseCelExpression(`doc.age > 21 && doc["a b"].c[1].startsWith("a.")`)
+	assert.Nil(err)
+	assert.Equal(AndExpr{
+		GreaterThanExpr{FieldExpr{0, []string{"age"}}, ValueExpr{21}},
+		LikeExpr{FieldExpr{0, []string{"a b", "c", "[1]"}}, RegexExpr{`^a\.`}},
+	}, expr)
+
+	expr, err = ParseCelExpression(`!has(doc.x) || doc.flag || doc.y in [1, -2.5, 'z']`)
+	assert.Nil(err)
+	assert.Equal(OrExpr{
+		NotExpr{ExistsExpr{FieldExpr{0, []string{"x"}}}},
+		EqualsExpr{FieldExpr{0, []string{"flag"}}, ValueExpr{true}},
+		OrExpr{
+			EqualsExpr{FieldExpr{0, []string{"y"}}, ValueExpr{1}},
+			EqualsExpr{FieldExpr{0, []string{"y"}}, ValueExpr{-2.5}},
+			EqualsExpr{FieldExpr{0, []string{"y"}}, ValueExpr{"z"}},
+		},
+	}, expr)
+
+	expr, err = ParseCelExpression(`doc.list.exists(e, e.v == null)`)
+	assert.Nil(err)
+	assert.Equal(AnyInExpr{1, FieldExpr{0, []string{"list"}},
+		EqualsExpr{FieldExpr{1, []string{"v"}}, ValueExpr{nil}}}, expr)
+
+	_, err = ParseCelExpression(`doc.age > 21 ? true : false`)
+	assert.NotNil(err)
+	_, err = ParseCelExpression(`other.age > 21`)
+	assert.NotNil(err)
+	_, err = ParseCelExpression(`doc.name.size() > 2`)
+	assert.NotNil(err)
+	_, err = ParseCelExpression(`doc.list.exists(e, e > 1) && e == 2`)
+	assert.NotNil(err)
+	_, err = ParseCelExpression(`doc.name == "unterminated`)
+	assert.NotNil(err)
+	_, err = ParseCelExpression(`doc.age`)
+	assert.Nil(err)
+	_, err = ParseCelExpression(`1`)
+	assert.NotNil(err)
+}
+
+func TestCelMatcher(t *testing.T) {
+	runCelMatchTest(t, `doc.age > 30 && doc.name.startsWith("C")`, []string{
+		"5b47eb0962222a37d066e231",
+		"5b47eb09996a4154c35b2f98",
+	})
+
+	runCelMatchTest(t, `"laborum" in doc.tags && !doc.isActive`, []string{
+		"5b47eb096b1d911c0b9492fb",
+		"5b47eb093771f06ced629663",
+	})
+
+	runCelMatchTest(t, `doc.friends.exists(f, f.name.endsWith('Walker')) || doc.eyeColor in ["blue"]`, []string{
+		"5b47eb096b1d911c0b9492fb",
+		"5b47eb093771f06ced629663",
+		"5b47eb095c3ad73b9925f7f8",
+	})
+
+	runCelMatchTest(t, `doc.tags.all(t, t.matches("^...")) && has(doc.age)`, []string{
+		"5b47eb091f57571d3c3b1aa1",
+	})
+}
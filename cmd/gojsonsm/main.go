@@ -0,0 +1,242 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+// Command gojsonsm evaluates a filter expression against JSON documents, to
+// allow testing filters before deploying them.
+//
+//	gojsonsm [-count] [-explain] EXPRESSION [FILE...]
+//	gojsonsm -codegen FUNC [-package PKG] EXPRESSION
+//
+// Documents are read from the files given, or stdin when there are none.
+// Input may be a single JSON document, newline delimited JSON, or any other
+// sequence of concatenated JSON values.  Matching documents are printed one
+// per line.  The exit status is 0 if any document matched, 1 if none did and
+// 2 if an error occurred, in the same way as grep.
+//
+// With -codegen, the Go source of a function implementing the filter is
+// printed instead, see gojsonsm.GenerateGoFilter.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/couchbaselabs/gojsonsm"
+)
+
+const (
+	exitMatched   = 0
+	exitNoMatch   = 1
+	exitFailure   = 2
+	stdinFileName = "-"
+)
+
+type options struct {
+	count   bool
+	explain bool
+	codegen string
+	pkgName string
+}
+
+// filter holds a compiled expression along with the top-level clauses of it,
+// which are matched separately to explain the result
+type filter struct {
+	opts    options
+	clauses []gojsonsm.Expression
+	matcher *gojsonsm.FastMatcher
+	matches int
+}
+
+// topLevelClauses returns the operands of the outermost AND or OR
+func topLevelClauses(expr gojsonsm.Expression) []gojsonsm.Expression {
+	for {
+		var operands []gojsonsm.Expression
+		switch typedExpr := expr.(type) {
+		case gojsonsm.AndExpr:
+			operands = typedExpr
+		case gojsonsm.OrExpr:
+			operands = typedExpr
+		default:
+			return nil
+		}
+
+		// The parser wraps expressions in single operand groups
+		if len(operands) != 1 {
+			return operands
+		}
+		expr = operands[0]
+	}
+}
+
+// describe returns the expression on a single line where possible
+func describe(expr gojsonsm.Expression) string {
+	if formatted, err := gojsonsm.FormatExpression(expr); err == nil {
+		return formatted
+	}
+	return expr.String()
+}
+
+func newFilter(expression string, opts options, stdout io.Writer) (*filter, error) {
+	expr, err := gojsonsm.ParseFilterExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	exprs := []gojsonsm.Expression{expr}
+	var clauses []gojsonsm.Expression
+	if opts.explain {
+		clauses = topLevelClauses(expr)
+		exprs = append(exprs, clauses...)
+	}
+
+	// Explaining needs the value of every clause, not just enough of them to
+	// decide the expression
+	trans := gojsonsm.Transformer{Exhaustive: opts.explain}
+	matchDef := trans.Transform(exprs)
+
+	if opts.explain {
+		fmt.Fprintf(stdout, "Expression: %s\n", describe(expr))
+		fmt.Fprintf(stdout, "Match definition:\n%v\n", matchDef)
+	}
+
+	return &filter{
+		opts:    opts,
+		clauses: clauses,
+		matcher: gojsonsm.NewFastMatcher(matchDef),
+	}, nil
+}
+
+func (f *filter) matchDocument(doc []byte, name string, index int, stdout io.Writer) error {
+	f.matcher.Reset()
+	_, err := f.matcher.Match(doc)
+	if err != nil {
+		return fmt.Errorf("%s: document %d: %v", name, index, err)
+	}
+
+	// Match reports whether any of the compiled expressions matched, which
+	// includes the clauses when explaining
+	matched := f.matcher.ExpressionMatched(0)
+	if matched {
+		f.matches++
+	}
+
+	if f.opts.explain {
+		fmt.Fprintf(stdout, "%s: document %d: matched=%v\n", name, index, matched)
+		for i, clause := range f.clauses {
+			fmt.Fprintf(stdout, "  %-5v %s\n", f.matcher.ExpressionMatched(i+1), describe(clause))
+		}
+	}
+	if matched && !f.opts.count {
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, doc); err != nil {
+			return err
+		}
+		compacted.WriteByte('\n')
+		stdout.Write(compacted.Bytes())
+	}
+	return nil
+}
+
+func (f *filter) matchStream(input io.Reader, name string, stdout io.Writer) error {
+	decoder := json.NewDecoder(input)
+	for index := 0; ; index++ {
+		var doc json.RawMessage
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: document %d: %v", name, index, err)
+		}
+
+		if err := f.matchDocument(doc, name, index, stdout); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *filter) matchFile(fileName string, stdin io.Reader, stdout io.Writer) error {
+	if fileName == stdinFileName {
+		return f.matchStream(stdin, "stdin", stdout)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return f.matchStream(file, fileName, stdout)
+}
+
+func generate(expression string, opts options, stdout, stderr io.Writer) int {
+	expr, err := gojsonsm.ParseFilterExpression(expression)
+	if err != nil {
+		fmt.Fprintf(stderr, "gojsonsm: invalid expression: %v\n", err)
+		return exitFailure
+	}
+
+	src, err := gojsonsm.GenerateGoFilter(expr, opts.pkgName, opts.codegen)
+	if err != nil {
+		fmt.Fprintf(stderr, "gojsonsm: %v\n", err)
+		return exitFailure
+	}
+	stdout.Write(src)
+	return exitMatched
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("gojsonsm", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: gojsonsm [flags] EXPRESSION [FILE...]\n")
+		flags.PrintDefaults()
+	}
+
+	var opts options
+	flags.BoolVar(&opts.count, "count", false, "print the number of matching documents instead of the documents")
+	flags.BoolVar(&opts.explain, "explain", false, "print the compiled expression and which top-level clauses matched each document")
+	flags.StringVar(&opts.codegen, "codegen", "", "print Go source for a function of this name implementing the expression")
+	flags.StringVar(&opts.pkgName, "package", "filters", "package of the Go source printed by -codegen")
+	if err := flags.Parse(args); err != nil {
+		return exitFailure
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return exitFailure
+	}
+
+	if opts.codegen != "" {
+		return generate(flags.Arg(0), opts, stdout, stderr)
+	}
+
+	f, err := newFilter(flags.Arg(0), opts, stdout)
+	if err != nil {
+		fmt.Fprintf(stderr, "gojsonsm: invalid expression: %v\n", err)
+		return exitFailure
+	}
+
+	fileNames := flags.Args()[1:]
+	if len(fileNames) == 0 {
+		fileNames = []string{stdinFileName}
+	}
+	for _, fileName := range fileNames {
+		if err := f.matchFile(fileName, stdin, stdout); err != nil {
+			fmt.Fprintf(stderr, "gojsonsm: %v\n", err)
+			return exitFailure
+		}
+	}
+
+	if opts.count {
+		fmt.Fprintf(stdout, "%d\n", f.matches)
+	}
+	if f.matches == 0 {
+		return exitNoMatch
+	}
+	return exitMatched
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
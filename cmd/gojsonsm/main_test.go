@@ -0,0 +1,82 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testInput = `{"name": "a", "age": 10}
+{"name": "b", "age": 30}
+{
+  "name": "c",
+  "age": 40
+}
+`
+
+func runWithInput(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	status := run(args, strings.NewReader(testInput), &stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+func TestRunPrintsMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	status, stdout, _ := runWithInput("age > 20")
+	assert.Equal(exitMatched, status)
+	assert.Equal("{\"name\":\"b\",\"age\":30}\n{\"name\":\"c\",\"age\":40}\n", stdout)
+
+	status, stdout, _ = runWithInput("-count", "age > 20")
+	assert.Equal(exitMatched, status)
+	assert.Equal("2\n", stdout)
+
+	status, stdout, _ = runWithInput("age > 100")
+	assert.Equal(exitNoMatch, status)
+	assert.Equal("", stdout)
+}
+
+func TestRunExplain(t *testing.T) {
+	assert := assert.New(t)
+
+	status, stdout, _ := runWithInput("-explain", "-count", "age > 20 AND name = \"c\"")
+	assert.Equal(exitMatched, status)
+	assert.Contains(stdout, "Match definition:")
+	// Explaining evaluates every clause rather than short-circuiting
+	assert.Contains(stdout, "neand")
+	assert.Contains(stdout, "stdin: document 1: matched=false\n")
+	assert.Contains(stdout, "stdin: document 2: matched=true\n")
+	assert.True(strings.HasSuffix(stdout, "1\n"))
+}
+
+func TestRunErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	status, _, stderr := runWithInput("age >")
+	assert.Equal(exitFailure, status)
+	assert.Contains(stderr, "invalid expression")
+
+	status, _, stderr = runWithInput("age > 1", "/nonexistent/input.json")
+	assert.Equal(exitFailure, status)
+	assert.Contains(stderr, "/nonexistent/input.json")
+
+	status, _, _ = runWithInput()
+	assert.Equal(exitFailure, status)
+}
+
+func TestRunCodegen(t *testing.T) {
+	assert := assert.New(t)
+
+	status, stdout, _ := runWithInput("-codegen", "IsAdult", "age >= 18")
+	assert.Equal(exitMatched, status)
+	assert.Contains(stdout, "package filters\n")
+	assert.Contains(stdout, "func IsAdult(data []byte) (bool, error) {")
+
+	status, _, stderr := runWithInput("-codegen", "not-a-name", "age >= 18")
+	assert.Equal(exitFailure, status)
+	assert.Contains(stderr, "Invalid Go package or function name")
+}
@@ -0,0 +1,536 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+var codegenFuncs map[string]string = map[string]string{
+	MathFuncAbs:       "FastValMathAbs",
+	MathFuncAcos:      "FastValMathAcos",
+	MathFuncAsin:      "FastValMathAsin",
+	MathFuncAtan:      "FastValMathAtan",
+	MathFuncAtan2:     "FastValMathAtan2",
+	MathFuncRound:     "FastValMathRound",
+	MathFuncRoundEven: "FastValMathRoundEven",
+	MathFuncCos:       "FastValMathCos",
+	MathFuncSin:       "FastValMathSin",
+	MathFuncTan:       "FastValMathTan",
+	MathFuncSqrt:      "FastValMathSqrt",
+	MathFuncExp:       "FastValMathExp",
+	MathFuncLn:        "FastValMathLn",
+	MathFuncLog:       "FastValMathLog",
+	MathFuncLog10:     "FastValMathLog10",
+	MathFuncLog2:      "FastValMathLog2",
+	MathFuncCeil:      "FastValMathCeil",
+	MathFuncFloor:     "FastValMathFloor",
+	MathFuncDegrees:   "FastValMathDegrees",
+	MathFuncRadians:   "FastValMathRadians",
+	MathFuncPow:       "FastValMathPow",
+	DateFunc:          "FastValDateFunc",
+	MathFuncAdd:       "FastValMathAdd",
+	MathFuncSub:       "FastValMathSub",
+	MathFuncMul:       "FastValMathMul",
+	MathFuncDiv:       "FastValMathDiv",
+	MathFuncMod:       "FastValMathMod",
+	MathFuncNeg:       "FastValMathNeg",
+	TokenMatchFunc:    "FastValTokenMatch",
+	Base64DecFunc:     "FastValBase64Decode",
+	Base64EncFunc:     "FastValBase64Encode",
+	DecodeJsonFunc:    "FastValDecodeJson",
+	EncodeJsonFunc:    "FastValEncodeJson",
+	DateTruncFunc:     "FastValDateTrunc",
+	DateWeekdayFunc:   "FastValWeekday",
+}
+
+type goCodegen struct {
+	prefix     string
+	paths      [][]string
+	pathIdx    map[string]int
+	consts     []string
+	constIdx   map[string]int
+	usesRegexp bool
+}
+
+func (g *goCodegen) field(expr FieldExpr, fields map[int]bool) (string, error) {
+	// Loop variables are not supported, so every field is in the document
+	if expr.Root != 0 || len(expr.Path) == 0 {
+		return "", ErrorCodegenUnsupported
+	}
+
+	key := strings.Join(expr.Path, "\x00")
+	idx, ok := g.pathIdx[key]
+	if !ok {
+		idx = len(g.paths)
+		g.paths = append(g.paths, expr.Path)
+		g.pathIdx[key] = idx
+	}
+	fields[idx] = true
+	return fmt.Sprintf("vals[%d]", idx), nil
+}
+
+func (g *goCodegen) constant(value string) string {
+	idx, ok := g.constIdx[value]
+	if !ok {
+		idx = len(g.consts)
+		g.consts = append(g.consts, value)
+		g.constIdx[value] = idx
+	}
+	return fmt.Sprintf("%sConsts[%d]", g.prefix, idx)
+}
+
+func (g *goCodegen) value(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return g.constant("gojsonsm.NewNullFastVal()"), nil
+	case bool:
+		return g.constant(fmt.Sprintf("gojsonsm.NewBoolFastVal(%t)", value)), nil
+	case string:
+		// Strings are escaped ahead of time, in the same way as the transformer
+		escaped, err := NewStringFastVal(value).ToJsonString()
+		if err != nil {
+			return "", err
+		}
+		return g.constant(fmt.Sprintf("gojsonsm.NewJsonStringFastVal([]byte(%q))", escaped.sliceData)), nil
+	case float32:
+		return g.value(float64(value))
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return "", ErrorCodegenUnsupported
+		}
+		return g.constant(fmt.Sprintf("gojsonsm.NewFloatFastVal(%s)", strconv.FormatFloat(value, 'g', -1, 64))), nil
+	}
+
+	val := NewFastVal(value)
+	switch {
+	case val.IsInt():
+		return g.constant(fmt.Sprintf("gojsonsm.NewIntFastVal(%d)", val.GetInt())), nil
+	case val.IsUInt():
+		return g.constant(fmt.Sprintf("gojsonsm.NewUintFastVal(%d)", val.GetUint())), nil
+	}
+	return "", ErrorCodegenUnsupported
+}
+
+func (g *goCodegen) operand(expr Expression, fields map[int]bool) (string, error) {
+	switch expr := expr.(type) {
+	case FieldExpr:
+		return g.field(expr, fields)
+	case ValueExpr:
+		return g.value(expr.Value)
+	case RegexExpr:
+		pattern, ok := expr.Regex.(string)
+		if !ok {
+			return "", ErrorCodegenUnsupported
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return "", newFilterExpressionError(ErrBadRegex, "failed to compile RegexExpr: %v", err)
+		}
+		g.usesRegexp = true
+		return g.constant(fmt.Sprintf("gojsonsm.NewFastVal(regexp.MustCompile(%q))", pattern)), nil
+	case FuncExpr:
+		name, ok := codegenFuncs[expr.FuncName]
+		if !ok {
+			return "", ErrorCodegenUnsupported
+		}
+		numParams := 1
+		if vmFuncs[expr.FuncName].fn2 != nil {
+			numParams = 2
+		}
+		if len(expr.Params) != numParams {
+			return "", ErrorCodegenUnsupported
+		}
+
+		var params []string
+		for _, param := range expr.Params {
+			paramStr, err := g.operand(param, fields)
+			if err != nil {
+				return "", err
+			}
+			params = append(params, paramStr)
+		}
+		return fmt.Sprintf("gojsonsm.%s(%s)", name, strings.Join(params, ", ")), nil
+	}
+
+	return "", ErrorCodegenUnsupported
+}
+
+// comparison produces the code for a single op of the matcher.  As with the
+// FastMatcher, an op is false if any of the fields it refers to is missing
+// or is not a literal value.
+func (g *goCodegen) comparison(lhs, rhs Expression, format string) (string, error) {
+	fields := make(map[int]bool)
+	lhsStr, err := g.operand(lhs, fields)
+	if err != nil {
+		return "", err
+	}
+	rhsStr, err := g.operand(rhs, fields)
+	if err != nil {
+		return "", err
+	}
+
+	var conds []string
+	for idx := range g.paths {
+		if fields[idx] {
+			conds = append(conds, fmt.Sprintf("!vals[%d].IsMissing()", idx))
+		}
+	}
+	conds = append(conds, fmt.Sprintf(format, lhsStr, rhsStr))
+	return "(" + strings.Join(conds, " && ") + ")", nil
+}
+
+func (g *goCodegen) exists(expr Expression) (string, error) {
+	field, ok := expr.(FieldExpr)
+	if !ok {
+		return "", ErrorCodegenUnsupported
+	}
+	return g.field(field, make(map[int]bool))
+}
+
+func (g *goCodegen) junction(exprs []Expression, op, empty string) (string, error) {
+	if len(exprs) == 0 {
+		return empty, nil
+	} else if len(exprs) == 1 {
+		return g.condition(exprs[0])
+	}
+
+	var out []string
+	for _, subExpr := range exprs {
+		subStr, err := g.condition(subExpr)
+		if err != nil {
+			return "", err
+		}
+		out = append(out, subStr)
+	}
+	return "(" + strings.Join(out, op) + ")", nil
+}
+
+func (g *goCodegen) condition(expr Expression) (string, error) {
+	switch expr := expr.(type) {
+	case TrueExpr:
+		return "true", nil
+	case FalseExpr:
+		return "false", nil
+	case AndExpr:
+		return g.junction(expr, " && ", "true")
+	case OrExpr:
+		return g.junction(expr, " || ", "false")
+	case NotExpr:
+		subStr, err := g.condition(expr.SubExpr)
+		if err != nil {
+			return "", err
+		}
+		return "!" + subStr, nil
+	case ExistsExpr:
+		fieldStr, err := g.exists(expr.SubExpr)
+		if err != nil {
+			return "", err
+		}
+		return "!" + fieldStr + ".IsMissing()", nil
+	case NotExistsExpr:
+		fieldStr, err := g.exists(expr.SubExpr)
+		if err != nil {
+			return "", err
+		}
+		return fieldStr + ".IsMissing()", nil
+	case EqualsExpr:
+		return g.comparison(expr.Lhs, expr.Rhs, "%s.Equals(%s)")
+	case NotEqualsExpr:
+		eqStr, err := g.comparison(expr.Lhs, expr.Rhs, "%s.Equals(%s)")
+		if err != nil {
+			return "", err
+		}
+		return "!" + eqStr, nil
+	case LessThanExpr:
+		return g.comparison(expr.Lhs, expr.Rhs, "%s.Compare(%s) < 0")
+	case LessEqualsExpr:
+		return g.comparison(expr.Lhs, expr.Rhs, "%s.Compare(%s) <= 0")
+	case GreaterThanExpr:
+		return g.comparison(expr.Lhs, expr.Rhs, "%s.Compare(%s) > 0")
+	case GreaterEqualsExpr:
+		return g.comparison(expr.Lhs, expr.Rhs, "%s.Compare(%s) >= 0")
+	case LikeExpr:
+		return g.comparison(expr.Lhs, expr.Rhs, "%s.Matches(%s)")
+	}
+
+	return "", ErrorCodegenUnsupported
+}
+
+// GenerateGoFilter produces the source of a Go file in the package pkgName,
+// declaring a function funcName(data []byte) (bool, error) which reports
+// whether a JSON document matches the expression.  The filter is evaluated
+// as straight-line code after extracting the fields it refers to, rather
+// than interpreting a MatchDef, for services with a small set of filters
+// known at build time.  Loops, PCRE and loop variables are not supported.
+func GenerateGoFilter(expr Expression, pkgName, funcName string) ([]byte, error) {
+	if !token.IsIdentifier(pkgName) || !token.IsIdentifier(funcName) {
+		return nil, ErrorCodegenInvalidName
+	}
+
+	first, size := utf8.DecodeRuneInString(funcName)
+	g := &goCodegen{
+		prefix:   string(unicode.ToLower(first)) + funcName[size:],
+		pathIdx:  make(map[string]int),
+		constIdx: make(map[string]int),
+	}
+	cond, err := g.condition(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by gojsonsm. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&out, "package %s\n\n", pkgName)
+	fmt.Fprintf(&out, "import (\n")
+	if g.usesRegexp {
+		fmt.Fprintf(&out, "\"regexp\"\n\n")
+	}
+	fmt.Fprintf(&out, "\"github.com/couchbaselabs/gojsonsm\"\n)\n\n")
+
+	if len(g.paths) > 0 {
+		fmt.Fprintf(&out, "var %sFields = gojsonsm.NewJsonFieldScanner([][]string{\n", g.prefix)
+		for _, path := range g.paths {
+			var elems []string
+			for _, elem := range path {
+				elems = append(elems, strconv.Quote(elem))
+			}
+			fmt.Fprintf(&out, "{%s},\n", strings.Join(elems, ", "))
+		}
+		fmt.Fprintf(&out, "})\n\n")
+	}
+
+	if len(g.consts) > 0 {
+		fmt.Fprintf(&out, "var %sConsts = [...]gojsonsm.FastVal{\n", g.prefix)
+		for _, value := range g.consts {
+			fmt.Fprintf(&out, "%s,\n", value)
+		}
+		fmt.Fprintf(&out, "}\n\n")
+	}
+
+	description := expr.String()
+	if formatted, err := FormatExpression(expr); err == nil {
+		description = formatted
+	}
+	fmt.Fprintf(&out, "// %s reports whether a JSON document matches the filter:\n//\n", funcName)
+	for _, line := range strings.Split(description, "\n") {
+		fmt.Fprintf(&out, "//\t%s\n", line)
+	}
+	fmt.Fprintf(&out, "func %s(data []byte) (bool, error) {\n", funcName)
+	if len(g.paths) > 0 {
+		fmt.Fprintf(&out, "var vals [%d]gojsonsm.FastVal\n", len(g.paths))
+		fmt.Fprintf(&out, "if err := %sFields.Scan(data, vals[:]); err != nil {\n", g.prefix)
+		fmt.Fprintf(&out, "return false, err\n}\n")
+	}
+	fmt.Fprintf(&out, "return %s, nil\n}\n", cond)
+
+	return format.Source(out.Bytes())
+}
+
+// JsonFieldScanner extracts the values of a fixed set of fields from JSON
+// documents, for use by filters produced by GenerateGoFilter.  It is safe
+// for concurrent use.
+type JsonFieldScanner struct {
+	root      scanNode
+	numFields int
+	scans     sync.Pool
+}
+
+type scanNode struct {
+	elems map[string]*scanNode
+	// Indexes of the values this node is stored to
+	fields []int
+}
+
+// NewJsonFieldScanner creates a scanner for the fields at each of the paths,
+// elements of arrays are named by their index such as "[0]"
+func NewJsonFieldScanner(paths [][]string) *JsonFieldScanner {
+	s := &JsonFieldScanner{numFields: len(paths)}
+	for i, path := range paths {
+		node := &s.root
+		for _, elem := range path {
+			child := node.elems[elem]
+			if child == nil {
+				child = &scanNode{}
+				if node.elems == nil {
+					node.elems = make(map[string]*scanNode)
+				}
+				node.elems[elem] = child
+			}
+			node = child
+		}
+		node.fields = append(node.fields, i)
+	}
+	return s
+}
+
+type fieldScan struct {
+	tokens    jsonTokenizer
+	vals      []FastVal
+	found     []bool
+	remaining int
+}
+
+// skipValue moves past the rest of an object or array
+func (scan *fieldScan) skipValue(token tokenType) error {
+	if token != tknObjectStart && token != tknArrayStart {
+		return nil
+	}
+
+	depth := 0
+	for {
+		token, _, _, err := scan.tokens.Step()
+		if err != nil {
+			return err
+		}
+
+		switch token {
+		case tknObjectStart, tknArrayStart:
+			depth++
+		case tknObjectEnd, tknArrayEnd:
+			if depth == 0 {
+				return nil
+			}
+			depth--
+		case tknEnd:
+			return ErrorJsonMalformed
+		}
+	}
+}
+
+func (scan *fieldScan) storeValue(token tokenType, tokenData []byte, node *scanNode) error {
+	val := NewMissingFastVal()
+	if token == tknEscString {
+		// The literal parser unescapes into a buffer which is shared by
+		// every value, so these need their own copy
+		unescaped, err := unescapeJsonString(tokenData[1:len(tokenData)-1], nil)
+		if err != nil {
+			return err
+		}
+		val = NewBinStringFastVal(unescaped)
+	} else if isLiteralToken(token) {
+		val = scan.tokens.ParseLiteral(token, tokenData)
+	}
+
+	// The first occurrence of duplicated keys is used, as the matcher does
+	for _, field := range node.fields {
+		if !scan.found[field] {
+			scan.found[field] = true
+			scan.vals[field] = val
+			scan.remaining--
+		}
+	}
+	return nil
+}
+
+func (scan *fieldScan) scanValue(token tokenType, tokenData []byte, node *scanNode) error {
+	if len(node.fields) > 0 {
+		err := scan.storeValue(token, tokenData, node)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(node.elems) == 0 || (token != tknObjectStart && token != tknArrayStart) {
+		return scan.skipValue(token)
+	}
+
+	arrayMode := token == tknArrayStart
+	for i := 0; ; i++ {
+		token, tokenData, tokenDataLen, err := scan.tokens.Step()
+		if err != nil {
+			return err
+		}
+
+		// Every entry after the first is preceded by a list delimiter
+		if i != 0 && token == tknListDelim {
+			token, tokenData, tokenDataLen, err = scan.tokens.Step()
+			if err != nil {
+				return err
+			}
+		}
+
+		switch token {
+		case tknObjectEnd, tknArrayEnd:
+			return nil
+		case tknEnd, tknListDelim:
+			return ErrorJsonMalformed
+		}
+
+		var child *scanNode
+		if arrayMode {
+			child = node.elems["["+strconv.Itoa(i)+"]"]
+		} else {
+			if token != tknString && token != tknEscString {
+				return ErrorJsonMalformed
+			}
+			key := scan.tokens.ParseKey(token, tokenData, tokenDataLen)
+			child = node.elems[string(key)]
+
+			token, _, _, err = scan.tokens.Step()
+			if err != nil {
+				return err
+			}
+			if token != tknObjectKeyDelim {
+				return ErrorJsonMalformed
+			}
+
+			token, tokenData, _, err = scan.tokens.Step()
+			if err != nil {
+				return err
+			}
+		}
+
+		if child != nil {
+			err = scan.scanValue(token, tokenData, child)
+		} else {
+			err = scan.skipValue(token)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Stop reading the document once every field has been found
+		if scan.remaining == 0 {
+			return nil
+		}
+	}
+}
+
+// Scan stores the value of each field in vals, fields which are missing or
+// are objects or arrays are stored as missing values
+func (s *JsonFieldScanner) Scan(data []byte, vals []FastVal) error {
+	scan, _ := s.scans.Get().(*fieldScan)
+	if scan == nil {
+		scan = &fieldScan{found: make([]bool, s.numFields)}
+	}
+	defer s.scans.Put(scan)
+
+	for i := range vals[:s.numFields] {
+		vals[i] = NewMissingFastVal()
+		scan.found[i] = false
+	}
+	scan.vals = vals
+	scan.remaining = s.numFields
+	scan.tokens.Reset(data)
+	if len(data) == 0 {
+		return nil
+	}
+
+	token, tokenData, _, err := scan.tokens.Step()
+	if err != nil {
+		return err
+	}
+	err = scan.scanValue(token, tokenData, &s.root)
+	scan.vals = nil
+	return err
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateGoFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseFilterExpression(`age > 30 AND (name = "Neil" OR REGEXP_CONTAINS(address.city, "^To")) AND EXISTS(tags)`)
+	assert.Nil(err)
+
+	src, err := GenerateGoFilter(expr, "filters", "MatchPeople")
+	assert.Nil(err)
+	assert.Equal(`// Code generated by gojsonsm. DO NOT EDIT.
+
+package filters
+
+import (
+	"regexp"
+
+	"github.com/couchbaselabs/gojsonsm"
+)
+
+var matchPeopleFields = gojsonsm.NewJsonFieldScanner([][]string{
+	{"age"},
+	{"name"},
+	{"address", "city"},
+	{"tags"},
+})
+
+var matchPeopleConsts = [...]gojsonsm.FastVal{
+	gojsonsm.NewIntFastVal(30),
+	gojsonsm.NewJsonStringFastVal([]byte("Neil")),
+	gojsonsm.NewFastVal(regexp.MustCompile("^To")),
+}
+
+// MatchPeople reports whether a JSON document matches the filter:
+//
+//	age > 30 AND (name = "Neil" OR REGEXP_CONTAINS(address.city, "^To")) AND EXISTS(tags)
+func MatchPeople(data []byte) (bool, error) {
+	var vals [4]gojsonsm.FastVal
+	if err := matchPeopleFields.Scan(data, vals[:]); err != nil {
+		return false, err
+	}
+	return ((!vals[0].IsMissing() && vals[0].Compare(matchPeopleConsts[0]) > 0) && ((!vals[1].IsMissing() && vals[1].Equals(matchPeopleConsts[1])) || (!vals[2].IsMissing() && vals[2].Matches(matchPeopleConsts[2]))) && !vals[3].IsMissing()), nil
+}
+`, string(src))
+}
+
+func TestGenerateGoFilterErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseFilterExpression(`age > 30`)
+	assert.Nil(err)
+	_, err = GenerateGoFilter(expr, "filters", "bad-name")
+	assert.Equal(ErrorCodegenInvalidName, err)
+
+	_, err = GenerateGoFilter(AnyInExpr{
+		VarId:   1,
+		InExpr:  FieldExpr{Root: 0, Path: []string{"tags"}},
+		SubExpr: EqualsExpr{FieldExpr{Root: 1}, ValueExpr{"a"}},
+	}, "filters", "MatchTags")
+	assert.Equal(ErrorCodegenUnsupported, err)
+}
+
+func TestJsonFieldScanner(t *testing.T) {
+	assert := assert.New(t)
+
+	scanner := NewJsonFieldScanner([][]string{
+		{"name", "first"},
+		{"age"},
+		{"tags", "[1]"},
+		{"name"},
+		{"missing"},
+		{"quote"},
+		{"age"},
+	})
+
+	vals := make([]FastVal, 7)
+	err := scanner.Scan([]byte(`{"name":{"first":"Brett"},"tags":["a","b"],"quote":"a\"b","age":31,"age":32}`), vals)
+	assert.Nil(err)
+	assert.Equal(NewBinStringFastVal([]byte("Brett")), vals[0])
+	assert.Equal(NewIntFastVal(31), vals[1])
+	assert.Equal(NewBinStringFastVal([]byte("b")), vals[2])
+	assert.True(vals[3].IsMissing())
+	assert.True(vals[4].IsMissing())
+	assert.Equal(NewBinStringFastVal([]byte(`a"b`)), vals[5])
+	assert.Equal(NewIntFastVal(31), vals[6])
+
+	err = scanner.Scan([]byte(`{"name":"Neil"`), vals)
+	assert.Equal(ErrorJsonMalformed, err)
+}
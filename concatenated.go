@@ -0,0 +1,134 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ConcatenatedPolicy decides what a FastMatcher reading JSON does with
+// input holding more than one JSON value, such as `{"a":1}{"a":2}` or
+// `{"a":1} trailing`, which some log formats write
+type ConcatenatedPolicy int
+
+const (
+	// ConcatenatedIgnore matches the first value and ignores anything after
+	// it, which is the default
+	ConcatenatedIgnore ConcatenatedPolicy = iota
+	// ConcatenatedReject makes Match return ErrorTrailingData when anything
+	// other than whitespace follows the first value
+	ConcatenatedReject
+	// ConcatenatedIterate matches each of the values in turn, and Match
+	// reports whether any of them matched, stopping at the first which did
+	ConcatenatedIterate
+)
+
+// SetConcatenatedPolicy sets what Match does with input holding more than
+// one JSON value.  It has no effect on matchers for other formats.
+func (m *FastMatcher) SetConcatenatedPolicy(policy ConcatenatedPolicy) {
+	m.concatenated = policy
+}
+
+// valueEnd returns where the JSON value starting at or after pos ends, or
+// -1 if there is only whitespace left.  The contents of objects and arrays
+// are not validated, which is left to matching them.
+func (m *FastMatcher) valueEnd(data []byte, pos int) (int, error) {
+	tokens := &m.valueTokens
+	tokens.Reset(data)
+	tokens.Seek(pos)
+
+	token, _, _, err := tokens.Step()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case token == tknEnd:
+		return -1, nil
+	case token == tknObjectStart || token == tknArrayStart:
+		if err := tokens.SkipValue(); err != nil {
+			return 0, err
+		}
+	case !isLiteralToken(token):
+		return 0, ErrorJsonMalformed
+	}
+	return tokens.Position(), nil
+}
+
+// checkTrailingData returns ErrorTrailingData if data holds more than
+// whitespace after its first JSON value
+func (m *FastMatcher) checkTrailingData(data []byte) error {
+	end, err := m.valueEnd(data, 0)
+	if err != nil || end < 0 {
+		// Left for matching to report
+		return nil
+	}
+	if next, err := m.valueEnd(data, end); err != nil || next >= 0 {
+		return ErrorTrailingData
+	}
+	return nil
+}
+
+// MatchEach matches each of the JSON values concatenated in data in turn,
+// whether or not they are separated by whitespace, whatever the
+// concatenated policy of the matcher.  It calls fn with each value and
+// whether it matched, and stops at the first error, either from matching or
+// returned by fn.  The matcher is reset before each value, and is left
+// holding the result for the last one.
+func (m *FastMatcher) MatchEach(data []byte, fn func(value []byte, matched bool) error) error {
+	data, err := m.normalizeText(data)
+	if err != nil {
+		return err
+	}
+	return m.matchEach(data, fn)
+}
+
+func (m *FastMatcher) matchEach(data []byte, fn func(value []byte, matched bool) error) error {
+	for pos := 0; ; {
+		end, err := m.valueEnd(data, pos)
+		if err != nil {
+			return err
+		}
+		if end < 0 {
+			return nil
+		}
+
+		value := bytes.TrimLeft(data[pos:end], " \t\r\n")
+		m.Reset()
+		matched, err := m.matchValue(value)
+		if err != nil {
+			return err
+		}
+		if err := fn(value, matched); err != nil {
+			return err
+		}
+		pos = end
+	}
+}
+
+// errStopMatching stops MatchEach once the result of Match is known
+var errStopMatching = errors.New("stop matching")
+
+// matchConcatenated matches data under the concatenated policy
+func (m *FastMatcher) matchConcatenated(data []byte) (bool, error) {
+	if m.concatenated == ConcatenatedReject {
+		if err := m.checkTrailingData(data); err != nil {
+			m.metrics.record(false, err, 0)
+			return false, err
+		}
+		return m.matchValue(data)
+	}
+
+	anyMatched := false
+	err := m.matchEach(data, func(value []byte, matched bool) error {
+		if matched {
+			anyMatched = true
+			return errStopMatching
+		}
+		return nil
+	})
+	if err == errStopMatching {
+		err = nil
+	}
+	return anyMatched, err
+}
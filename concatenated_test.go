@@ -0,0 +1,105 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcatenatedPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	matcher, err := GetFilterExpressionMatcher(`a = 2`)
+	assert.Nil(err)
+	m := matcher.(*FastMatcher)
+
+	type result struct {
+		matched bool
+		err     error
+	}
+	tests := map[string]map[ConcatenatedPolicy]result{
+		`{"a":2}`: {
+			ConcatenatedIgnore:  {true, nil},
+			ConcatenatedReject:  {true, nil},
+			ConcatenatedIterate: {true, nil},
+		},
+		" {\"a\":2}\n ": {
+			ConcatenatedIgnore:  {true, nil},
+			ConcatenatedReject:  {true, nil},
+			ConcatenatedIterate: {true, nil},
+		},
+		`{"a":1}{"a":2}`: {
+			ConcatenatedIgnore:  {false, nil},
+			ConcatenatedReject:  {false, ErrorTrailingData},
+			ConcatenatedIterate: {true, nil},
+		},
+		"{\"a\":2}\n{\"a\":1}": {
+			ConcatenatedIgnore:  {true, nil},
+			ConcatenatedReject:  {false, ErrorTrailingData},
+			ConcatenatedIterate: {true, nil},
+		},
+		`{"a":2} trailing`: {
+			ConcatenatedIgnore:  {true, nil},
+			ConcatenatedReject:  {false, ErrorTrailingData},
+			ConcatenatedIterate: {true, nil},
+		},
+		`{"a":1} [1] "x" {"a":3}`: {
+			ConcatenatedIgnore:  {false, nil},
+			ConcatenatedReject:  {false, ErrorTrailingData},
+			ConcatenatedIterate: {false, nil},
+		},
+	}
+
+	for doc, policies := range tests {
+		for policy, expected := range policies {
+			m.SetConcatenatedPolicy(policy)
+			m.Reset()
+			matched, err := m.Match([]byte(doc))
+			assert.Equal(expected.err, err, "%q with policy %d", doc, policy)
+			assert.Equal(expected.matched, matched, "%q with policy %d", doc, policy)
+		}
+	}
+
+	m.SetConcatenatedPolicy(ConcatenatedIterate)
+	m.Reset()
+	_, err = m.Match([]byte(`{"a":1} }`))
+	assert.Equal(ErrorJsonMalformed, err)
+}
+
+func TestMatchEach(t *testing.T) {
+	assert := assert.New(t)
+
+	matcher, err := GetFilterExpressionMatcher(`a > 1`)
+	assert.Nil(err)
+	m := matcher.(*FastMatcher)
+
+	var values []string
+	var results []bool
+	err = m.MatchEach([]byte("{\"a\":1}{\"a\":2}\n{\"a\":3} 4"), func(value []byte, matched bool) error {
+		values = append(values, string(value))
+		results = append(results, matched)
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal([]string{`{"a":1}`, `{"a":2}`, `{"a":3}`, `4`}, values)
+	assert.Equal([]bool{false, true, true, false}, results)
+	assert.False(m.ExpressionMatched(0))
+
+	stop := errors.New("stop")
+	count := 0
+	err = m.MatchEach([]byte(`{"a":2}{"a":3}`), func(value []byte, matched bool) error {
+		count++
+		return stop
+	})
+	assert.Equal(stop, err)
+	assert.Equal(1, count)
+
+	assert.Nil(m.MatchEach([]byte("  "), func([]byte, bool) error {
+		count++
+		return nil
+	}))
+	assert.Equal(1, count)
+}
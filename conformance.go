@@ -0,0 +1,249 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+)
+
+// conformanceCase checks one feature of the expressions a matcher may be
+// given, with documents the expression must match and documents it must not
+type conformanceCase struct {
+	feature    string
+	expression string
+	expr       Expression
+	matches    []string
+	misses     []string
+}
+
+func conformanceField(root VariableID, path ...string) FieldExpr {
+	return FieldExpr{root, path}
+}
+
+// conformanceCases covers every kind of expression, and every function, the
+// filter expression parser gives.  Expressions are written as filter
+// expressions unless the parser has no syntax for them.
+var conformanceCases = []conformanceCase{
+	{feature: "TRUE", expression: `TRUE`, matches: []string{`{}`}},
+	{feature: "FALSE", expression: `FALSE`, misses: []string{`{}`}},
+	{feature: "AND", expression: `a = 1 AND b = 2`,
+		matches: []string{`{"a":1,"b":2}`}, misses: []string{`{"a":1,"b":3}`, `{"b":2}`}},
+	{feature: "OR", expression: `a = 1 OR b = 2`,
+		matches: []string{`{"a":1}`, `{"b":2}`}, misses: []string{`{"a":2,"b":1}`}},
+	{feature: "NOT", expression: `NOT a = 1`,
+		matches: []string{`{"a":2}`, `{}`}, misses: []string{`{"a":1}`}},
+	{feature: "=", expression: `a = "x"`,
+		matches: []string{`{"a":"x"}`}, misses: []string{`{"a":"y"}`, `{"a":1}`, `{}`}},
+	{feature: "==", expr: StrictEqualsExpr{conformanceField(0, "a"), ValueExpr{1}},
+		matches: []string{`{"a":1}`, `{"a":1.0}`}, misses: []string{`{"a":"1"}`, `{"a":true}`, `{}`}},
+	{feature: "!=", expression: `a != 1`,
+		matches: []string{`{"a":2}`}, misses: []string{`{"a":1}`}},
+	{feature: "<", expression: `a < 2`,
+		matches: []string{`{"a":1}`, `{"a":-1.5}`}, misses: []string{`{"a":2}`, `{"a":3}`, `{}`}},
+	{feature: "<=", expression: `a <= 2`,
+		matches: []string{`{"a":1}`, `{"a":2}`}, misses: []string{`{"a":3}`, `{}`}},
+	{feature: ">", expression: `a > 2`,
+		matches: []string{`{"a":3}`, `{"a":2.5}`}, misses: []string{`{"a":2}`, `{"a":1}`}},
+	{feature: ">=", expression: `a >= 2`,
+		matches: []string{`{"a":2}`, `{"a":3}`}, misses: []string{`{"a":1}`}},
+	{feature: "string comparison", expression: `a < "b"`,
+		matches: []string{`{"a":"a"}`, `{"a":"ab"}`}, misses: []string{`{"a":"b"}`, `{"a":"c"}`}},
+	{feature: "escaped string", expression: `a = "x\"y"`,
+		matches: []string{`{"a":"x\"y"}`, `{"a":"x\u0022y"}`}, misses: []string{`{"a":"xy"}`}},
+	{feature: "nested field", expression: `a.b.c = 1`,
+		matches: []string{`{"a":{"b":{"c":1}}}`}, misses: []string{`{"a":{"b":1}}`, `{"a":1}`}},
+	{feature: "array index", expression: `a[1] = 2`,
+		matches: []string{`{"a":[1,2]}`}, misses: []string{`{"a":[2,1]}`, `{"a":[2]}`, `{"a":{"1":2}}`}},
+	{feature: "field comparison", expression: `a = b`,
+		matches: []string{`{"a":1,"b":1}`, `{"a":"x","b":"x"}`}, misses: []string{`{"a":1,"b":2}`}},
+	{feature: "array value", expression: `a = [1, "x"]`,
+		matches: []string{`{"a":[1,"x"]}`}, misses: []string{`{"a":["x",1]}`, `{"a":1}`}},
+	{feature: "object value", expression: `a = {"b":1}`,
+		matches: []string{`{"a":{"b":1}}`}, misses: []string{`{"a":{"b":2}}`, `{"a":[1]}`}},
+	{feature: "IS NULL", expression: `a IS NULL`,
+		matches: []string{`{"a":null}`}, misses: []string{`{"a":1}`, `{}`}},
+	{feature: "IS NOT NULL", expression: `a IS NOT NULL`,
+		matches: []string{`{"a":1}`}, misses: []string{`{"a":null}`}},
+	{feature: "EXISTS", expression: `EXISTS(a)`,
+		matches: []string{`{"a":1}`, `{"a":null}`}, misses: []string{`{}`, `{"b":1}`}},
+	{feature: "IS MISSING", expression: `a IS MISSING`,
+		matches: []string{`{}`}, misses: []string{`{"a":1}`, `{"a":null}`}},
+	{feature: "ARRAY_CONTAINS", expression: `ARRAY_CONTAINS(arr, 2)`,
+		matches: []string{`{"arr":[1,2]}`}, misses: []string{`{"arr":[1]}`, `{"arr":2}`, `{}`}},
+	{feature: "EVERY", expr: EveryInExpr{1, conformanceField(0, "arr"), GreaterThanExpr{conformanceField(1), ValueExpr{0}}},
+		matches: []string{`{"arr":[1,2]}`, `{"arr":[]}`}, misses: []string{`{"arr":[1,-1]}`, `{"arr":1}`, `{}`}},
+	{feature: "ANY AND EVERY", expr: AnyEveryInExpr{1, conformanceField(0, "arr"), GreaterThanExpr{conformanceField(1), ValueExpr{0}}},
+		matches: []string{`{"arr":[1,2]}`}, misses: []string{`{"arr":[]}`, `{"arr":[1,-1]}`, `{}`}},
+	{feature: "ANY WITHIN", expression: `ANY v WITHIN o SATISFIES v.k = 1 END`,
+		matches: []string{`{"o":{"x":[{"k":1}]}}`, `{"o":[{"k":1}]}`}, misses: []string{`{"o":{"k":1}}`, `{"o":{"x":[{"k":2}]}}`}},
+	{feature: "**", expression: `a.**.b = 1`,
+		matches: []string{`{"a":{"b":1}}`, `{"a":{"x":[{"b":1}]}}`}, misses: []string{`{"a":{"b":2}}`, `{"b":1}`}},
+	{feature: "FIRST", expression: `FIRST x.v FOR x IN arr WHEN x.k = 1 END = 2`,
+		matches: []string{`{"arr":[{"k":0,"v":1},{"k":1,"v":2}]}`}, misses: []string{`{"arr":[{"k":1,"v":3},{"k":1,"v":2}]}`, `{"arr":[]}`}},
+	{feature: "LET", expression: `LET x = a * 2 WHERE x > 5`,
+		matches: []string{`{"a":3}`}, misses: []string{`{"a":2}`}},
+	{feature: "REGEXP_CONTAINS", expression: `REGEXP_CONTAINS(s, "^ab+c$")`,
+		matches: []string{`{"s":"abbc"}`}, misses: []string{`{"s":"ac"}`, `{"s":1}`, `{}`}},
+	{feature: "DATE", expression: `DATE(d) > DATE("2019-01-01")`,
+		matches: []string{`{"d":"2019-06-01T00:00:00Z"}`, `{"d":"2019-06"}`}, misses: []string{`{"d":"2018-06-01T00:00:00Z"}`}},
+	{feature: "DATE_TRUNC_STR", expression: `DATE_TRUNC_STR(d, "month") = "2019-06-01T00:00:00Z"`,
+		matches: []string{`{"d":"2019-06-15T10:00:00Z"}`}, misses: []string{`{"d":"2019-07-15T10:00:00Z"}`}},
+	{feature: "WEEKDAY_STR", expression: `WEEKDAY_STR(d) = "Saturday"`,
+		matches: []string{`{"d":"2019-06-15T10:00:00Z"}`}, misses: []string{`{"d":"2019-06-16T10:00:00Z"}`}},
+	{feature: "NOW_MILLIS", expression: `t < NOW_MILLIS()`,
+		matches: []string{`{"t":0}`}, misses: []string{`{"t":1e15}`}},
+	{feature: "ABS", expression: `ABS(a) = 2`, matches: []string{`{"a":-2}`}, misses: []string{`{"a":1}`}},
+	{feature: "ACOS", expression: `ACOS(a) = 0`, matches: []string{`{"a":1}`}, misses: []string{`{"a":0}`}},
+	{feature: "ASIN", expression: `ASIN(a) = 0`, matches: []string{`{"a":0}`}, misses: []string{`{"a":1}`}},
+	{feature: "ATAN", expression: `ATAN(a) = 0`, matches: []string{`{"a":0}`}, misses: []string{`{"a":1}`}},
+	{feature: "ATAN2", expression: `ATAN2(a, b) = 0`, matches: []string{`{"a":0,"b":1}`}, misses: []string{`{"a":1,"b":1}`}},
+	{feature: "CEIL", expression: `CEIL(a) = 2`, matches: []string{`{"a":1.2}`}, misses: []string{`{"a":2.2}`}},
+	{feature: "COS", expression: `COS(a) = 1`, matches: []string{`{"a":0}`}, misses: []string{`{"a":1}`}},
+	{feature: "DEGREES", expression: `DEGREES(a) = 180`, matches: []string{`{"a":3.141592653589793}`}, misses: []string{`{"a":1}`}},
+	{feature: "EXP", expression: `EXP(a) = 1`, matches: []string{`{"a":0}`}, misses: []string{`{"a":1}`}},
+	{feature: "FLOOR", expression: `FLOOR(a) = 1`, matches: []string{`{"a":1.8}`}, misses: []string{`{"a":2.1}`}},
+	{feature: "LOG", expression: `LOG(a) = 2`, matches: []string{`{"a":100}`}, misses: []string{`{"a":10}`}},
+	{feature: "LN", expression: `LN(a) = 0`, matches: []string{`{"a":1}`}, misses: []string{`{"a":2}`}},
+	{feature: "LOG10", expression: `LOG10(a) = 3`, matches: []string{`{"a":1000}`}, misses: []string{`{"a":100}`}},
+	{feature: "LOG2", expression: `LOG2(a) = 5`, matches: []string{`{"a":32}`}, misses: []string{`{"a":16}`, `{"a":-32}`}},
+	{feature: "POW", expression: `POW(a, 2) = 9`, matches: []string{`{"a":3}`}, misses: []string{`{"a":2}`}},
+	{feature: "RADIANS", expression: `RADIANS(a) > 3.14`, matches: []string{`{"a":180}`}, misses: []string{`{"a":90}`}},
+	{feature: "ROUND", expression: `ROUND(a) = 3`, matches: []string{`{"a":2.5}`}, misses: []string{`{"a":2.4}`}},
+	{feature: "ROUND_EVEN", expression: `ROUND_EVEN(a) = 2`, matches: []string{`{"a":2.5}`, `{"a":1.5}`}, misses: []string{`{"a":3.5}`}},
+	{feature: "SIN", expression: `SIN(a) = 0`, matches: []string{`{"a":0}`}, misses: []string{`{"a":1}`}},
+	{feature: "SQRT", expression: `SQRT(a) = 3`, matches: []string{`{"a":9}`}, misses: []string{`{"a":8}`, `{"a":-9}`}},
+	{feature: "TAN", expression: `TAN(a) = 0`, matches: []string{`{"a":0}`}, misses: []string{`{"a":1}`}},
+	{feature: "+", expression: `a + 1 = 3`, matches: []string{`{"a":2}`}, misses: []string{`{"a":3}`}},
+	{feature: "-", expression: `a - 1 = 1`, matches: []string{`{"a":2}`}, misses: []string{`{"a":3}`}},
+	{feature: "*", expression: `a * 2 = 6`, matches: []string{`{"a":3}`}, misses: []string{`{"a":2}`}},
+	{feature: "/", expression: `a / 2 = 1.5`, matches: []string{`{"a":3}`}, misses: []string{`{"a":4}`}},
+	{feature: "%", expression: `a % 3 = 1`, matches: []string{`{"a":7}`}, misses: []string{`{"a":6}`}},
+	{feature: "MOD", expression: `MOD(a, 3) = 1`, matches: []string{`{"a":7}`}, misses: []string{`{"a":6}`}},
+	{feature: "MOD divisor", expression: `MOD(a, b) = 1`, matches: []string{`{"a":7,"b":3}`, `{"a":7,"b":3.5}`},
+		misses: []string{`{"a":7,"b":0}`, `{"a":7,"b":0.5}`, `{"a":7}`}},
+	{feature: "unary -", expression: `-a = 2`, matches: []string{`{"a":-2}`}, misses: []string{`{"a":2}`}},
+	{feature: "BASE64_DECODE", expression: `BASE64_DECODE(s) = "hello"`,
+		matches: []string{`{"s":"aGVsbG8="}`}, misses: []string{`{"s":"d29ybGQ="}`}},
+	{feature: "BASE64_ENCODE", expression: `BASE64_ENCODE(s) = "aGVsbG8="`,
+		matches: []string{`{"s":"hello"}`}, misses: []string{`{"s":"help"}`}},
+	{feature: "DECODE_JSON", expression: `DECODE_JSON(s).a = 1`,
+		matches: []string{`{"s":"{\"a\":1}"}`}, misses: []string{`{"s":"{\"a\":2}"}`, `{"s":"x"}`}},
+	{feature: "ENCODE_JSON", expression: `ENCODE_JSON(n) = "1.5"`,
+		matches: []string{`{"n":1.5}`}, misses: []string{`{"n":2}`}},
+	{feature: "TOKENS", expression: `ARRAY_CONTAINS(TOKENS(s), "fox")`,
+		matches: []string{`{"s":"the quick fox"}`}, misses: []string{`{"s":"the quick dog"}`}},
+}
+
+// pcreConformanceCase is only checked when PCRE is built in
+var pcreConformanceCase = conformanceCase{feature: "PCRE", expression: `REGEXP_CONTAINS(s, "a(?=b)")`,
+	matches: []string{`{"s":"cab"}`}, misses: []string{`{"s":"ac"}`}}
+
+// ConformanceFailure is a feature of expressions which a matcher lacks, or
+// gets wrong
+type ConformanceFailure struct {
+	Feature string
+	// The document the matcher gave the wrong result for, or an error for,
+	// which is empty when the matcher could not be created
+	Document string
+	Expected bool
+	Err      error
+}
+
+func (f ConformanceFailure) String() string {
+	if f.Err != nil {
+		if len(f.Document) == 0 {
+			return fmt.Sprintf("%v: %v", f.Feature, f.Err)
+		}
+		return fmt.Sprintf("%v: %v: %v", f.Feature, f.Document, f.Err)
+	}
+	return fmt.Sprintf("%v: %v should have given %v", f.Feature, f.Document, f.Expected)
+}
+
+func (c *conformanceCase) parse() (Expression, error) {
+	expr := c.expr
+	if expr == nil {
+		var err error
+		if expr, err = ParseFilterExpression(c.expression); err != nil {
+			return nil, err
+		}
+	}
+	// Matchers are only given expressions whose constant parts have been
+	// folded away
+	return CompactExpression(expr), nil
+}
+
+// ConformanceFeatures lists the features of expressions checked by
+// CheckConformance
+func ConformanceFeatures() []string {
+	var features []string
+	for _, c := range conformanceCases {
+		features = append(features, c.feature)
+	}
+	if _, err := MakePcreExpression(""); err == nil {
+		features = append(features, pcreConformanceCase.feature)
+	}
+	return features
+}
+
+// CheckConformance checks that the matchers created by newMatcher support
+// each of the features of expressions the filter expression parser gives,
+// by matching documents for which the result is known, and returns those
+// which they lack.  Errors and panics from creating or running a matcher
+// count as failures.  This is meant for testing other implementations of
+// Matcher, and finding what they have not implemented yet.
+func CheckConformance(newMatcher func(expr Expression) (Matcher, error)) []ConformanceFailure {
+	cases := conformanceCases
+	if _, err := MakePcreExpression(""); err == nil {
+		cases = append(cases[:len(cases):len(cases)], pcreConformanceCase)
+	}
+
+	var failures []ConformanceFailure
+	for i := range cases {
+		if failure, failed := checkConformanceCase(&cases[i], newMatcher); failed {
+			failures = append(failures, failure)
+		}
+	}
+	return failures
+}
+
+// checkConformanceCase returns the first failure of the matcher for the
+// case, if it has one
+func checkConformanceCase(c *conformanceCase, newMatcher func(expr Expression) (Matcher, error)) (failure ConformanceFailure, failed bool) {
+	failure.Feature = c.feature
+	defer func() {
+		if r := recover(); r != nil {
+			failure.Err = fmt.Errorf("panic: %v", r)
+			failed = true
+		}
+	}()
+
+	expr, err := c.parse()
+	if err != nil {
+		failure.Err = err
+		return failure, true
+	}
+	matcher, err := newMatcher(expr)
+	if err != nil {
+		failure.Err = err
+		return failure, true
+	}
+
+	check := func(doc string, expected bool) bool {
+		failure.Document, failure.Expected = doc, expected
+		matcher.Reset()
+		matched, err := matcher.Match([]byte(doc))
+		failure.Err = err
+		return err == nil && matched == expected
+	}
+	for _, doc := range c.matches {
+		if !check(doc, true) {
+			return failure, true
+		}
+	}
+	for _, doc := range c.misses {
+		if !check(doc, false) {
+			return failure, true
+		}
+	}
+	return ConformanceFailure{}, false
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newConformanceFastMatcher(expr Expression) (Matcher, error) {
+	var trans Transformer
+	matchDef, err := trans.TransformWithLimits([]Expression{expr}, TransformLimits{})
+	if err != nil {
+		return nil, err
+	}
+	return NewFastMatcher(matchDef), nil
+}
+
+func newConformanceSlowMatcher(expr Expression) (Matcher, error) {
+	return NewSlowMatcher([]Expression{expr}), nil
+}
+
+// newLoopLessMatcher stands in for a matcher which has not implemented loops
+func newLoopLessMatcher(expr Expression) (Matcher, error) {
+	hasLoop := false
+	rewriteExpr(expr, func(expr Expression) Expression {
+		switch expr.(type) {
+		case AnyInExpr, EveryInExpr, AnyEveryInExpr, AnyWithinExpr, FirstInExpr:
+			hasLoop = true
+		}
+		return expr
+	})
+	if hasLoop {
+		return nil, ErrorUnsupportedExpression
+	}
+	return newConformanceSlowMatcher(expr)
+}
+
+func TestConformance(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, failure := range CheckConformance(newConformanceFastMatcher) {
+		assert.Fail("fast matcher", failure.String())
+	}
+	for _, failure := range CheckConformance(newConformanceSlowMatcher) {
+		assert.Fail("slow matcher", failure.String())
+	}
+
+	var lacking []string
+	for _, failure := range CheckConformance(newLoopLessMatcher) {
+		assert.Equal(ErrorUnsupportedExpression, failure.Err)
+		lacking = append(lacking, failure.Feature)
+	}
+	assert.Equal([]string{"ARRAY_CONTAINS", "EVERY", "ANY AND EVERY", "ANY WITHIN", "**", "FIRST"}, lacking)
+
+	// Every function the matcher supports is checked
+	checked := make(map[string]bool)
+	for i := range conformanceCases {
+		expr, err := conformanceCases[i].parse()
+		if !assert.Nil(err, conformanceCases[i].feature) {
+			continue
+		}
+		rewriteExpr(expr, func(expr Expression) Expression {
+			if fn, ok := expr.(FuncExpr); ok {
+				checked[fn.FuncName] = true
+			}
+			return expr
+		})
+	}
+	for name := range supportedFuncs {
+		assert.True(checked[name], name)
+	}
+	assert.Contains(ConformanceFeatures(), "SQRT")
+}
+
+func TestSlowMatcherAgreesWithFastMatcher(t *testing.T) {
+	assert := assert.New(t)
+
+	field := conformanceField
+	tests := []struct {
+		expr     Expression
+		doc      string
+		expected bool
+	}{
+		// Strings are greater than missing values
+		{GreaterThanExpr{field(0, "c"), field(0, "a")}, `{"c":"aGVsbG8="}`, true},
+		{NotEqualsExpr{field(0, "c"), field(0, "b")}, `{}`, false},
+		{EveryInExpr{1, field(0, "a"), GreaterThanExpr{field(1, "a"), field(1, "c")}}, `{"a":[{"a":"b"}]}`, true},
+		// Nothing is compared when a is missing
+		{NotExpr{GreaterEqualsExpr{
+			FuncExpr{MathFuncCos, []Expression{field(0, "a")}},
+			FuncExpr{MathFuncAcos, []Expression{field(0, "a")}},
+		}}, `{}`, true},
+		// ACOS(2) is not finite
+		{NotExpr{GreaterEqualsExpr{FuncExpr{MathFuncAcos, []Expression{field(0, "a")}}, ValueExpr{0}}}, `{"a":2}`, true},
+		{NotExpr{EqualsExpr{field(0, "a"), ValueExpr{1}}}, `{"a":{"b":1}}`, true},
+	}
+	for _, test := range tests {
+		for _, newMatcher := range []func(Expression) (Matcher, error){newConformanceFastMatcher, newConformanceSlowMatcher} {
+			m, err := newMatcher(CompactExpression(test.expr))
+			if !assert.Nil(err) {
+				continue
+			}
+			matched, err := m.Match([]byte(test.doc))
+			assert.Nil(err)
+			assert.Equal(test.expected, matched, "%#v on %s", test.expr, test.doc)
+		}
+	}
+}
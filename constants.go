@@ -10,6 +10,14 @@ import (
 // Function related constants
 const (
 	DateFunc        string = "date"
+	DateTruncFunc   string = "dateTrunc"
+	DateWeekdayFunc string = "dateWeekday"
+	NowMillisFunc   string = "nowMillis"
+	TokenMatchFunc  string = "tokenMatch"
+	Base64DecFunc   string = "base64Decode"
+	Base64EncFunc   string = "base64Encode"
+	DecodeJsonFunc  string = "decodeJson"
+	EncodeJsonFunc  string = "encodeJson"
 	MathFuncAbs     string = "mathAbs"
 	MathFuncAcos    string = "mathAcos"
 	MathFuncAsin    string = "mathAsin"
@@ -23,6 +31,8 @@ const (
 	MathFuncFloor   string = "mathFloor"
 	MathFuncLog     string = "mathLog"
 	MathFuncLn      string = "mathLn"
+	MathFuncLog10   string = "mathLog10"
+	MathFuncLog2    string = "mathLog2"
 	MathFuncPi      string = "mathPi"
 	MathFuncPow     string = "mathPow"
 	MathFuncRadians string = "mathRadians"
@@ -51,15 +61,55 @@ const (
 	FuncFloor  string = "FLOOR"
 	FuncLog    string = "LOG"
 	FuncLn     string = "LN"
+	FuncLog10  string = "LOG10"
+	FuncLog2   string = "LOG2"
 	FuncPower  string = "POW"
+	FuncMod    string = "MOD"
 	FuncRad    string = "RADIANS"
 	FuncRegexp string = "REGEXP_CONTAINS"
 	FuncSin    string = "SIN"
 	FuncTan    string = "TAN"
 	FuncRound  string = "ROUND"
 	FuncSqrt   string = "SQRT"
+
+	// Rounds halves to the even neighbour, as financial users expect,
+	// rather than away from zero like ROUND
+	FuncRoundEven     string = "ROUND_EVEN"
+	MathFuncRoundEven string = "mathRoundEven"
+
+	// Date functions, which like N1QL's give strings
+	FuncDateTruncStr string = "DATE_TRUNC_STR"
+	FuncWeekdayStr   string = "WEEKDAY_STR"
+	// The time a document is matched at, in milliseconds since the epoch
+	FuncNowMillis string = "NOW_MILLIS"
+
+	// Encoding functions
+	FuncBase64Decode string = "BASE64_DECODE"
+	FuncBase64Encode string = "BASE64_ENCODE"
+	FuncDecodeJson   string = "DECODE_JSON"
+	FuncEncodeJson   string = "ENCODE_JSON"
+
+	// Array functions, of which TOKENS() can only be used within
+	// ARRAY_CONTAINS()
+	FuncArrayContains string = "ARRAY_CONTAINS"
+	FuncTokens        string = "TOKENS"
 )
 
+// Functions the matcher is able to evaluate
+var supportedFuncs map[string]bool = map[string]bool{
+	DateFunc: true, MathFuncAbs: true, MathFuncAcos: true, MathFuncAsin: true, MathFuncAtan: true,
+	MathFuncAtan2: true, MathFuncCeil: true, MathFuncCos: true, MathFuncDegrees: true, MathFuncExp: true,
+	MathFuncFloor: true, MathFuncLog: true, MathFuncLn: true, MathFuncLog10: true, MathFuncLog2: true, MathFuncPow: true, MathFuncRadians: true,
+	MathFuncRound: true, MathFuncSin: true, MathFuncSqrt: true, MathFuncTan: true, MathFuncAdd: true,
+	MathFuncSub: true, MathFuncMul: true, MathFuncDiv: true, MathFuncMod: true, MathFuncNeg: true,
+	TokenMatchFunc: true, Base64DecFunc: true, Base64EncFunc: true, DecodeJsonFunc: true, EncodeJsonFunc: true,
+	DateTruncFunc: true, DateWeekdayFunc: true, NowMillisFunc: true, MathFuncRoundEven: true,
+}
+
+func isSupportedFunc(name string) bool {
+	return supportedFuncs[name]
+}
+
 // Parser related constants
 const (
 	OperatorOr            string = "OR"
@@ -81,6 +131,20 @@ const (
 	OperatorNotMissing    string = "IS NOT MISSING"
 	OperatorNull          string = "IS NULL"
 	OperatorNotNull       string = "IS NOT NULL"
+	OperatorAny           string = "ANY"
+	OperatorWithin        string = "WITHIN"
+	OperatorSatisfies     string = "SATISFIES"
+	OperatorEnd           string = "END"
+	OperatorDoc           string = "doc"
+	OperatorDeepWildcard  string = "**"
+	OperatorFirst         string = "FIRST"
+	OperatorFor           string = "FOR"
+	OperatorIn            string = "IN"
+	OperatorWhen          string = "WHEN"
+	OperatorLet           string = "LET"
+	OperatorWhere         string = "WHERE"
+	OperatorSelf          string = "SELF"
+	OperatorInput         string = "$"
 )
 
 // Participle parser can cause stack overflow if certain inputs (i.e. a single word regex) is passed in
@@ -89,7 +153,8 @@ const (
 var GojsonsmOperators []string = []string{OperatorOr, OperatorAnd, OperatorNot, OperatorTrue,
 	OperatorFalse, OperatorMeta, OperatorEquals, OperatorEquals2, OperatorNotEquals, OperatorNotEquals2, OperatorGreaterThan,
 	OperatorGreaterThanEq, OperatorLessThan, OperatorLessThanEq, OperatorExists, OperatorMissing, OperatorNotMissing,
-	OperatorNull, OperatorNotNull /* BooleanFuncs*/, FuncRegexp}
+	OperatorNull, OperatorNotNull, OperatorAny, OperatorWithin, OperatorSatisfies, OperatorEnd, OperatorFirst, OperatorFor,
+	OperatorIn, OperatorWhen, OperatorLet, OperatorWhere, OperatorSelf /* BooleanFuncs*/, FuncRegexp, FuncArrayContains}
 
 // Error constants
 var emptyExpression Expression
@@ -110,9 +175,57 @@ var ErrorEmptyToken error = fmt.Errorf("Token cannot be empty")
 var ErrorInvalidFuncArgs error = fmt.Errorf("Unable to parse arguments to specified built in function")
 var ErrorInvalidTimeFormat error = fmt.Errorf("Invalid given time format")
 var ErrorPcreNotSupported error = fmt.Errorf("Error: Current instance of gojsonsm does not have native PCRE support compiled")
+var ErrorUnknownRegexEngine error = fmt.Errorf("Error: Unknown regular expression engine")
+var ErrorRegexEngineExists error = fmt.Errorf("Error: Regular expression engine is already registered")
 var ErrorFieldPathNotFound error = fmt.Errorf("Error: Unable to find internally stored field path")
 var ErrorMalformedFxInternals error = fmt.Errorf("Error: Malformed internal function helper")
 var ErrorMalformedParenthesis error = fmt.Errorf("Invalid parenthesis case")
+var ErrorNotRepresentable error = fmt.Errorf("Error: Expression cannot be represented as a filter expression")
+var ErrorReparseMismatch error = fmt.Errorf("Error: Reparsed expression is not equivalent to the original")
+var ErrorGrammarVersion error = fmt.Errorf("Error: Expression is not supported by the requested grammar version")
+var ErrorUnknownGrammarVersion error = fmt.Errorf("Error: Unknown grammar version")
+var ErrorStrictParenthesis error = fmt.Errorf("Error: Parenthesis do not match the parsed expression")
+var ErrorStrictAndOr error = fmt.Errorf("Error: AND and OR used together without parenthesis")
+var ErrorStrictQuotedField error = fmt.Errorf("Error: Quoted literal used as a field path")
+var ErrorStrictBareField error = fmt.Errorf("Error: Unquoted literal used as a field path, use backticks for fields")
+var ErrorMongoUnsupported error = fmt.Errorf("Error: Unsupported MongoDB query operator")
+var ErrorStrictComment error = fmt.Errorf("Error: Comments are not allowed in expressions")
+var ErrorN1qlNotRepresentable error = fmt.Errorf("Error: Expression cannot be represented in N1QL")
+var ErrorCodegenUnsupported error = fmt.Errorf("Error: Expression cannot be compiled to Go code")
+var ErrorCodegenInvalidName error = fmt.Errorf("Error: Invalid Go package or function name")
+var ErrorProtoMalformed error = fmt.Errorf("Error: Malformed protocol buffer message")
+var ErrorProtoUnsupported error = fmt.Errorf("Error: Value cannot be encoded as a protocol buffer message")
+var ErrorBsonMalformed error = fmt.Errorf("Error: Malformed BSON document")
+var ErrorBsonUnsupported error = fmt.Errorf("Error: Unsupported BSON element type")
+var ErrorCborMalformed error = fmt.Errorf("Error: Malformed CBOR data item")
+var ErrorCborUnsupported error = fmt.Errorf("Error: Unsupported CBOR data item")
+var ErrorMsgpackMalformed error = fmt.Errorf("Error: Malformed MessagePack value")
+var ErrorMsgpackUnsupported error = fmt.Errorf("Error: Unsupported MessagePack value")
+var ErrorYamlMalformed error = fmt.Errorf("Error: Malformed YAML document")
+var ErrorYamlUnsupported error = fmt.Errorf("Error: Unsupported YAML node")
+var ErrorAvroInvalidSchema error = fmt.Errorf("Error: Invalid Avro schema")
+var ErrorAvroMalformed error = fmt.Errorf("Error: Malformed Avro record")
+var ErrorJsonMalformed error = fmt.Errorf("Error: Malformed JSON document")
+var ErrorMatchTreeInvalidNode error = fmt.Errorf("Error: Invalid match tree node")
+var ErrorMatchTreeResolvedTwice error = fmt.Errorf("Error: Match tree node was resolved twice")
+var ErrorMatchDefInvalid error = fmt.Errorf("Error: Invalid match definition")
+var ErrorFirstResultNotLoopField error = fmt.Errorf("Error: The result of FIRST must be a field of its loop variable")
+var ErrorProjectionPath error = fmt.Errorf("Error: Projected paths must be object fields of the document")
+var ErrorRedactionPath error = fmt.Errorf("Error: Redacted paths must be fields of the document")
+var ErrorRedactionMask error = fmt.Errorf("Error: Redaction mask must be a JSON value")
+var ErrorOutputExpression error = fmt.Errorf("Error: Output expressions can only use fields outside of loops, values and functions")
+var ErrorFilterSetID error = fmt.Errorf("Error: No filter with that ID in the filter set")
+var ErrorExpressionJson error = fmt.Errorf("Error: Expression cannot be written as JSON")
+var ErrorTemplateSyntax error = fmt.Errorf("Error: Unmatched braces in filter template")
+var ErrorTemplateMissingParam error = fmt.Errorf("Error: No parameter given for a filter template placeholder")
+var ErrorTemplateParam error = fmt.Errorf("Error: Filter template parameter cannot be written as a field or value")
+var ErrorNonFiniteValue error = fmt.Errorf("Error: Math function gave a NaN or infinite value")
+var ErrorNotKeyOnly error = fmt.Errorf("Error: Match definition reads more of the document than its key")
+var ErrorInputName error = fmt.Errorf("Error: Input names must be identifiers")
+var ErrorDuplicateKey error = fmt.Errorf("Error: Document has a key more than once in the same object")
+var ErrorTrailingData error = fmt.Errorf("Error: Input has data after its first JSON value")
+var ErrorUTF16Input error = fmt.Errorf("Error: Document is encoded as UTF-16, which the matcher is not set to transcode")
+var ErrorUnsupportedExpression error = fmt.Errorf("Error: Unsupported expression")
 
 // Parse mode is within the context that a valid expression should be generically of the type of:
 // field > op -> value -> chain, repeat.
@@ -186,3 +299,7 @@ func tokenIsPcreValueType(token string) bool {
 	}
 	return false
 }
+
+var ErrorGeneratorFunc error = fmt.Errorf("Error: Expression generator cannot generate calls to that function")
+var ErrorGeneratorField error = fmt.Errorf("Error: Expression generator fields must be non-empty paths")
+var ErrorNoDocumentFound error = fmt.Errorf("Error: Document generator found no document of the kind asked for")
@@ -0,0 +1,202 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// DocumentSource gives documents one at a time, returning false once there
+// are no more, so that documents can be generated as they are needed
+type DocumentSource func() ([]byte, bool)
+
+// DocumentCorpus returns a DocumentSource giving each of the documents in
+// turn
+func DocumentCorpus(docs [][]byte) DocumentSource {
+	return func() ([]byte, bool) {
+		if len(docs) == 0 {
+			return nil, false
+		}
+		doc := docs[0]
+		docs = docs[1:]
+		return doc, true
+	}
+}
+
+// MatcherResult is what a matcher gave for a document
+type MatcherResult struct {
+	Matched bool
+	Err     error
+}
+
+func (r MatcherResult) agrees(other MatcherResult) bool {
+	if r.Err != nil || other.Err != nil {
+		return (r.Err != nil) == (other.Err != nil)
+	}
+	return r.Matched == other.Matched
+}
+
+// Divergence is a document which FastMatcher and SlowMatcher disagree on,
+// either by one matching it and not the other, or by only one failing
+type Divergence struct {
+	// The document as it was given
+	Original []byte
+	// The smallest document found which the matchers still disagree on in
+	// the same way, made by dropping fields and elements from the original
+	Document []byte
+	Fast     MatcherResult
+	Slow     MatcherResult
+}
+
+// differential holds a fast and a slow matcher for the same expression
+type differential struct {
+	fast *FastMatcher
+	slow *SlowMatcher
+}
+
+// runMatcher matches doc, returning a panic in the matcher as its error
+func runMatcher(m Matcher, doc []byte) (result MatcherResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = MatcherResult{Err: fmt.Errorf("panic: %v", r)}
+		}
+	}()
+	m.Reset()
+	result.Matched, result.Err = m.Match(doc)
+	return result
+}
+
+func (d *differential) run(doc []byte) (MatcherResult, MatcherResult) {
+	return runMatcher(d.fast, doc), runMatcher(d.slow, doc)
+}
+
+// CompareMatchers matches each document from docs with both FastMatcher and
+// SlowMatcher, which is the reference implementation, and returns those
+// they disagree on, each with a minimized document reproducing it.  Panics
+// in either matcher are reported as errors from it.  An error
+// is only returned when the expression cannot be compiled.
+func CompareMatchers(expr Expression, docs DocumentSource) ([]Divergence, error) {
+	expr = CompactExpression(expr)
+	var trans Transformer
+	matchDef, err := trans.TransformWithLimits([]Expression{expr}, TransformLimits{})
+	if err != nil {
+		return nil, err
+	}
+	d := &differential{
+		fast: NewFastMatcher(matchDef),
+		slow: NewSlowMatcher([]Expression{expr}),
+	}
+
+	var divergences []Divergence
+	for doc, ok := docs(); ok; doc, ok = docs() {
+		fast, slow := d.run(doc)
+		if fast.agrees(slow) {
+			continue
+		}
+		divergences = append(divergences, Divergence{
+			Original: doc,
+			Document: d.minimize(doc, fast, slow),
+			Fast:     fast,
+			Slow:     slow,
+		})
+	}
+	return divergences, nil
+}
+
+// minimize shrinks a document the matchers disagree on, keeping only the
+// changes after which they still give the same results.  Documents which
+// no longer diverge once decoded and encoded again, such as those with
+// repeated keys, are returned as they are.
+func (d *differential) minimize(doc []byte, fast, slow MatcherResult) []byte {
+	diverges := func(candidate interface{}) bool {
+		encoded, err := json.Marshal(candidate)
+		if err != nil {
+			return false
+		}
+		candidateFast, candidateSlow := d.run(encoded)
+		return candidateFast.agrees(fast) && candidateSlow.agrees(slow)
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil || !diverges(value) {
+		return doc
+	}
+
+	for {
+		shrunk, ok := shrinkJsonValue(value, diverges)
+		if !ok {
+			break
+		}
+		value = shrunk
+	}
+
+	minimized, _ := json.Marshal(value)
+	return minimized
+}
+
+// shrinkJsonValue tries each way of making the value smaller by one step,
+// by dropping a field or element or shrinking one of them in turn, and
+// returns the first for which keep holds
+func shrinkJsonValue(value interface{}, keep func(interface{}) bool) (interface{}, bool) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		with := func(key string, field interface{}, drop bool) map[string]interface{} {
+			out := make(map[string]interface{}, len(value))
+			for otherKey, otherField := range value {
+				out[otherKey] = otherField
+			}
+			if drop {
+				delete(out, key)
+			} else {
+				out[key] = field
+			}
+			return out
+		}
+		for _, key := range keys {
+			if candidate := with(key, nil, true); keep(candidate) {
+				return candidate, true
+			}
+		}
+		for _, key := range keys {
+			shrunk, ok := shrinkJsonValue(value[key], func(field interface{}) bool {
+				return keep(with(key, field, false))
+			})
+			if ok {
+				return with(key, shrunk, false), true
+			}
+		}
+	case []interface{}:
+		with := func(i int, elem interface{}, drop bool) []interface{} {
+			out := append([]interface{}{}, value[:i]...)
+			if !drop {
+				out = append(out, elem)
+			}
+			return append(out, value[i+1:]...)
+		}
+		for i := range value {
+			if candidate := with(i, nil, true); keep(candidate) {
+				return candidate, true
+			}
+		}
+		for i := range value {
+			shrunk, ok := shrinkJsonValue(value[i], func(elem interface{}) bool {
+				return keep(with(i, elem, false))
+			})
+			if ok {
+				return with(i, shrunk, false), true
+			}
+		}
+	}
+	return value, false
+}
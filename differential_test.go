@@ -0,0 +1,131 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareMatchers(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := [][]byte{
+		[]byte(`{"a":1,"b":1}`),
+		[]byte(`{"a":1,"b":2,"c":[1,{"d":2}]}`),
+		[]byte(`{"c":[1,{"d":2}],"e":"x"}`),
+	}
+
+	expr, err := ParseFilterExpression(`a > 0 AND c[1].d = 2`)
+	assert.Nil(err)
+	divergences, err := CompareMatchers(expr, DocumentCorpus(docs))
+	assert.Nil(err)
+	assert.Len(divergences, 0)
+
+	// Both find two missing fields equal
+	expr, err = ParseFilterExpression(`a = b`)
+	assert.Nil(err)
+	divergences, err = CompareMatchers(expr, DocumentCorpus(docs))
+	assert.Nil(err)
+	assert.Len(divergences, 0)
+
+	// Both fail on malformed documents, FastMatcher by panicking, so they agree
+	divergences, err = CompareMatchers(expr, DocumentCorpus([][]byte{[]byte(`{"a":`)}))
+	assert.Nil(err)
+	assert.Len(divergences, 0)
+}
+
+func TestCompareMatchersGenerated(t *testing.T) {
+	assert := assert.New(t)
+
+	var funcs []string
+	for name := range generatorFuncs {
+		funcs = append(funcs, name)
+	}
+	sort.Strings(funcs)
+
+	corpus := [][]byte{
+		[]byte(`{}`),
+		[]byte(`{"a":1,"b":"x","c":null}`),
+		[]byte(`{"a":[1,{"a":"b"}],"b":{"a":2},"c":"aGVsbG8="}`),
+		[]byte(`{"a":{"a":[1,2],"b":true},"b":[],"c":[{"c":1}]}`),
+		[]byte(`{"a":-1.5,"b":0,"c":"2019-06-01T00:00:00Z"}`),
+		[]byte(`{"a":null,"b":[{"a":0},{}],"c":[[1],[2]]}`),
+	}
+
+	for seed := int64(0); seed < 300; seed++ {
+		g, err := NewExpressionGenerator(seed, ExpressionGeneratorOptions{
+			MaxDepth:  3,
+			Fields:    []string{"a", "b", "c", "a.a", "b.a", "c.c", "a.[1]", "b.[0].a"},
+			Functions: funcs,
+			Loops:     true,
+		})
+		if !assert.Nil(err) {
+			return
+		}
+		expr := g.Expression()
+
+		docs := append([][]byte{}, corpus...)
+		docGen, err := NewDocumentGenerator(seed, expr)
+		assert.Nil(err)
+		for i := 0; i < 4; i++ {
+			if doc, err := docGen.Matching(); err == nil {
+				docs = append(docs, doc)
+			}
+			if doc, err := docGen.NearMiss(); err == nil {
+				docs = append(docs, doc)
+			}
+		}
+
+		divergences, err := CompareMatchers(expr, DocumentCorpus(docs))
+		assert.Nil(err)
+		for _, divergence := range divergences {
+			assert.Fail("matchers disagree", "%#v on %s: fast %v, slow %v", expr,
+				divergence.Document, divergence.Fast, divergence.Slow)
+		}
+	}
+}
+
+func TestShrinkJsonValue(t *testing.T) {
+	assert := assert.New(t)
+
+	value := map[string]interface{}{
+		"a": []interface{}{"x", map[string]interface{}{"b": "y", "c": "z"}},
+		"d": "w",
+	}
+	// Keep anything which still has "z" somewhere in it
+	var hasZ func(interface{}) bool
+	hasZ = func(value interface{}) bool {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			for _, field := range value {
+				if hasZ(field) {
+					return true
+				}
+			}
+		case []interface{}:
+			for _, elem := range value {
+				if hasZ(elem) {
+					return true
+				}
+			}
+		case string:
+			return value == "z"
+		}
+		return false
+	}
+
+	var shrunk interface{} = value
+	for {
+		next, ok := shrinkJsonValue(shrunk, hasZ)
+		if !ok {
+			break
+		}
+		shrunk = next
+	}
+	assert.Equal(map[string]interface{}{
+		"a": []interface{}{map[string]interface{}{"c": "z"}},
+	}, shrunk)
+}
@@ -0,0 +1,402 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// documentGeneratorAttempts is how many documents are tried before giving
+// up on finding one of the kind asked for
+const documentGeneratorAttempts = 1000
+
+// nearMissChanges is how many changes to a matching document are tried
+// before starting again from another
+const nearMissChanges = 20
+
+// docShape is what an expression reads at some point in a document, which
+// is the fields of objects, the elements of arrays, and the values it
+// compares them with
+type docShape struct {
+	fields map[string]*docShape
+	elems  *docShape
+	minLen int
+	values []interface{}
+}
+
+func (s *docShape) field(name string) *docShape {
+	if s.fields == nil {
+		s.fields = make(map[string]*docShape)
+	}
+	if s.fields[name] == nil {
+		s.fields[name] = &docShape{}
+	}
+	return s.fields[name]
+}
+
+func (s *docShape) elem(minLen int) *docShape {
+	if s.elems == nil {
+		s.elems = &docShape{}
+	}
+	if minLen > s.minLen {
+		s.minLen = minLen
+	}
+	return s.elems
+}
+
+// addValue adds a value compared with, and those either side of it, so that
+// documents can fall on both sides of the comparison
+func (s *docShape) addValue(value interface{}) {
+	switch value := value.(type) {
+	case int:
+		s.values = append(s.values, value, value-1, value+1, -value)
+	case float64:
+		s.values = append(s.values, value, value-0.5, value+0.5, -value)
+	case string:
+		s.values = append(s.values, value, value+"x", "")
+	case bool:
+		s.values = append(s.values, true, false)
+	default:
+		s.values = append(s.values, value)
+	}
+}
+
+// DocumentGenerator makes random JSON documents which match an expression,
+// or which nearly match it, for load testing and checking what a filter
+// accepts.  Documents are built from the fields the expression reads and the
+// values it compares them with, and are checked with a FastMatcher.
+type DocumentGenerator struct {
+	rand    *rand.Rand
+	matcher *FastMatcher
+	root    *docShape
+}
+
+// NewDocumentGenerator creates a generator of documents for expr, seeded
+// with seed.  It fails if expr cannot be compiled.
+func NewDocumentGenerator(seed int64, expr Expression) (*DocumentGenerator, error) {
+	expr = CompactExpression(expr)
+	var trans Transformer
+	matchDef, err := trans.TransformWithLimits([]Expression{expr}, TransformLimits{})
+	if err != nil {
+		return nil, err
+	}
+
+	g := &DocumentGenerator{
+		rand:    rand.New(rand.NewSource(seed)),
+		matcher: NewFastMatcher(matchDef),
+		root:    &docShape{},
+	}
+	g.addShape(expr, map[VariableID]*docShape{0: g.root})
+	return g, nil
+}
+
+// resolveShape returns the shape of a field, adding it to the shapes
+func resolveShape(field FieldExpr, vars map[VariableID]*docShape) *docShape {
+	shape := vars[field.Root]
+	if shape == nil {
+		shape = &docShape{}
+		vars[field.Root] = shape
+	}
+	for _, part := range field.Path {
+		if strings.HasPrefix(part, "[") && strings.HasSuffix(part, "]") {
+			if index, err := strconv.Atoi(part[1 : len(part)-1]); err == nil && index >= 0 {
+				shape = shape.elem(index + 1)
+				continue
+			}
+		}
+		shape = shape.field(part)
+	}
+	return shape
+}
+
+// operandShapes returns the shapes of the fields an operand reads, either
+// directly or as parameters of functions
+func operandShapes(expr Expression, vars map[VariableID]*docShape) []*docShape {
+	switch expr := expr.(type) {
+	case FieldExpr:
+		return []*docShape{resolveShape(expr, vars)}
+	case FuncExpr:
+		var shapes []*docShape
+		for _, param := range expr.Params {
+			shapes = append(shapes, operandShapes(param, vars)...)
+		}
+		return shapes
+	}
+	return nil
+}
+
+// operandValues returns the values an operand holds, either directly or
+// as parameters of functions
+func operandValues(expr Expression) []interface{} {
+	switch expr := expr.(type) {
+	case ValueExpr:
+		return []interface{}{expr.Value}
+	case TimeExpr:
+		return []interface{}{expr.Time}
+	case FuncExpr:
+		var values []interface{}
+		for _, param := range expr.Params {
+			values = append(values, operandValues(param)...)
+		}
+		return values
+	}
+	return nil
+}
+
+// addComparison adds the values each side of a comparison holds to the
+// fields the other side reads
+func (g *DocumentGenerator) addComparison(lhs, rhs Expression, vars map[VariableID]*docShape) {
+	lhsShapes, rhsShapes := operandShapes(lhs, vars), operandShapes(rhs, vars)
+	for _, value := range operandValues(rhs) {
+		for _, shape := range lhsShapes {
+			shape.addValue(value)
+		}
+	}
+	for _, value := range operandValues(lhs) {
+		for _, shape := range rhsShapes {
+			shape.addValue(value)
+		}
+	}
+}
+
+// addLoop adds the elements of the array a loop reads, as the shape of its
+// variable
+func (g *DocumentGenerator) addLoop(varID VariableID, inExpr Expression, subExprs []Expression, vars map[VariableID]*docShape) {
+	for _, shape := range operandShapes(inExpr, vars) {
+		vars[varID] = shape.elem(0)
+	}
+	for _, subExpr := range subExprs {
+		if subExpr != nil {
+			g.addShape(subExpr, vars)
+		}
+	}
+}
+
+// addShape adds what expr reads of the document to the shapes
+func (g *DocumentGenerator) addShape(expr Expression, vars map[VariableID]*docShape) {
+	switch expr := expr.(type) {
+	case AndExpr:
+		for _, subExpr := range expr {
+			g.addShape(subExpr, vars)
+		}
+	case OrExpr:
+		for _, subExpr := range expr {
+			g.addShape(subExpr, vars)
+		}
+	case NotExpr:
+		g.addShape(expr.SubExpr, vars)
+	case AnyInExpr:
+		g.addLoop(expr.VarId, expr.InExpr, []Expression{expr.SubExpr}, vars)
+	case EveryInExpr:
+		g.addLoop(expr.VarId, expr.InExpr, []Expression{expr.SubExpr}, vars)
+	case AnyEveryInExpr:
+		g.addLoop(expr.VarId, expr.InExpr, []Expression{expr.SubExpr}, vars)
+	case AnyWithinExpr:
+		g.addLoop(expr.VarId, expr.InExpr, []Expression{expr.SubExpr}, vars)
+	case FirstInExpr:
+		g.addLoop(expr.VarId, expr.InExpr, []Expression{expr.ResultExpr, expr.SubExpr}, vars)
+	case ExistsExpr:
+		operandShapes(expr.SubExpr, vars)
+	case NotExistsExpr:
+		operandShapes(expr.SubExpr, vars)
+	case EqualsExpr:
+		g.addComparison(expr.Lhs, expr.Rhs, vars)
+	case StrictEqualsExpr:
+		g.addComparison(expr.Lhs, expr.Rhs, vars)
+	case NotEqualsExpr:
+		g.addComparison(expr.Lhs, expr.Rhs, vars)
+	case LessThanExpr:
+		g.addComparison(expr.Lhs, expr.Rhs, vars)
+	case LessEqualsExpr:
+		g.addComparison(expr.Lhs, expr.Rhs, vars)
+	case GreaterThanExpr:
+		g.addComparison(expr.Lhs, expr.Rhs, vars)
+	case GreaterEqualsExpr:
+		g.addComparison(expr.Lhs, expr.Rhs, vars)
+	case LikeExpr:
+		operandShapes(expr.Lhs, vars)
+	}
+}
+
+// documentGeneratorValues are used for fields which are not compared with
+// any value
+var documentGeneratorValues = []interface{}{nil, true, false, 0, 1, -1, 2.5, "", "a", "b"}
+
+// genValue makes a value of the given shape
+func (g *DocumentGenerator) genValue(shape *docShape) interface{} {
+	kinds := []int{0}
+	if shape.fields != nil {
+		kinds = append(kinds, 1, 1)
+	}
+	if shape.elems != nil {
+		kinds = append(kinds, 2, 2)
+	}
+	if len(shape.values) > 0 {
+		kinds = append(kinds, 3, 3, 3)
+	}
+
+	switch kinds[g.rand.Intn(len(kinds))] {
+	case 1:
+		return g.genObject(shape)
+	case 2:
+		arr := make([]interface{}, shape.minLen+g.rand.Intn(4))
+		for i := range arr {
+			arr[i] = g.genValue(shape.elems)
+		}
+		return arr
+	case 3:
+		return shape.values[g.rand.Intn(len(shape.values))]
+	}
+	return documentGeneratorValues[g.rand.Intn(len(documentGeneratorValues))]
+}
+
+// genObject makes an object with some of the fields of the given shape
+func (g *DocumentGenerator) genObject(shape *docShape) map[string]interface{} {
+	names := make([]string, 0, len(shape.fields))
+	for name := range shape.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	obj := make(map[string]interface{})
+	for _, name := range names {
+		if g.rand.Intn(5) != 0 {
+			obj[name] = g.genValue(shape.fields[name])
+		}
+	}
+	return obj
+}
+
+func (g *DocumentGenerator) matches(doc interface{}) ([]byte, bool) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false
+	}
+	g.matcher.Reset()
+	matched, err := g.matcher.Match(data)
+	return data, matched && err == nil
+}
+
+// Matching returns a random document which matches the expression, or
+// ErrorNoDocumentFound if none was found
+func (g *DocumentGenerator) Matching() ([]byte, error) {
+	_, data, err := g.matching()
+	return data, err
+}
+
+func (g *DocumentGenerator) matching() (map[string]interface{}, []byte, error) {
+	for i := 0; i < documentGeneratorAttempts; i++ {
+		doc := g.genObject(g.root)
+		if data, matched := g.matches(doc); matched {
+			return doc, data, nil
+		}
+	}
+	return nil, nil, ErrorNoDocumentFound
+}
+
+// NearMiss returns a random document which does not match the expression,
+// but which differs from one which does by a single field, which is either
+// added, removed or given another value.  It returns ErrorNoDocumentFound if none
+// was found.
+func (g *DocumentGenerator) NearMiss() ([]byte, error) {
+	var doc map[string]interface{}
+	for i := 0; i < documentGeneratorAttempts; i++ {
+		// Some matching documents are more than one change from any which
+		// do not match, such as those matching both sides of an OR, so a
+		// new one is found every so often
+		if i%nearMissChanges == 0 {
+			var err error
+			if doc, _, err = g.matching(); err != nil {
+				return nil, err
+			}
+		}
+
+		changed, ok := g.mutate(doc, g.root)
+		if !ok {
+			continue
+		}
+		if data, matched := g.matches(changed); !matched && data != nil {
+			return data, nil
+		}
+	}
+	return nil, ErrorNoDocumentFound
+}
+
+// mutate returns a copy of value with one of the fields or elements within
+// it added, removed or given another value of its shape.  It returns false
+// for values which are neither objects nor arrays.
+func (g *DocumentGenerator) mutate(value interface{}, shape *docShape) (interface{}, bool) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		names := make([]string, 0, len(value)+len(shape.fields))
+		for name := range value {
+			names = append(names, name)
+		}
+		for name := range shape.fields {
+			if _, ok := value[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return nil, false
+		}
+		sort.Strings(names)
+		name := names[g.rand.Intn(len(names))]
+
+		fieldShape := &docShape{}
+		if shape.fields[name] != nil {
+			fieldShape = shape.fields[name]
+		}
+		out := make(map[string]interface{}, len(value))
+		for otherName, field := range value {
+			out[otherName] = field
+		}
+		if _, ok := value[name]; !ok {
+			out[name] = g.genValue(fieldShape)
+			return out, true
+		}
+		switch g.rand.Intn(3) {
+		case 0:
+			delete(out, name)
+		case 1:
+			out[name] = g.genValue(fieldShape)
+		default:
+			field, ok := g.mutate(value[name], fieldShape)
+			if !ok {
+				delete(out, name)
+			} else {
+				out[name] = field
+			}
+		}
+		return out, true
+	case []interface{}:
+		if len(value) == 0 {
+			return nil, false
+		}
+		elemShape := &docShape{}
+		if shape.elems != nil {
+			elemShape = shape.elems
+		}
+		i := g.rand.Intn(len(value))
+		out := append([]interface{}{}, value...)
+		switch g.rand.Intn(3) {
+		case 0:
+			out = append(out[:i], out[i+1:]...)
+		case 1:
+			out[i] = g.genValue(elemShape)
+		default:
+			elem, ok := g.mutate(value[i], elemShape)
+			if !ok {
+				out[i] = g.genValue(elemShape)
+			} else {
+				out[i] = elem
+			}
+		}
+		return out, true
+	}
+	return nil, false
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocumentGenerator(t *testing.T) {
+	assert := assert.New(t)
+
+	expressions := []string{
+		`a.b > 10 AND c = "x"`,
+		`d <= 3.5 OR a.b[1] = 2`,
+		`NOT EXISTS(a) AND b IS NOT NULL`,
+		`ARRAY_CONTAINS(arr, 2) AND ABS(n) = 4`,
+		`ANY v WITHIN o SATISFIES v.k = 1 END`,
+	}
+	for _, expression := range expressions {
+		expr, err := ParseFilterExpression(expression)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+
+		var trans Transformer
+		m := NewFastMatcher(trans.Transform([]Expression{CompactExpression(expr)}))
+		g, err := NewDocumentGenerator(1, expr)
+		assert.Nil(err, expression)
+
+		for i := 0; i < 20; i++ {
+			doc, err := g.Matching()
+			assert.Nil(err, expression)
+			m.Reset()
+			matched, err := m.Match(doc)
+			assert.Nil(err)
+			assert.True(matched, "%s on %s", expression, doc)
+
+			doc, err = g.NearMiss()
+			assert.Nil(err, expression)
+			m.Reset()
+			matched, err = m.Match(doc)
+			assert.Nil(err)
+			assert.False(matched, "%s on %s", expression, doc)
+		}
+	}
+
+	// The same seed gives the same documents
+	expr, err := ParseFilterExpression(`a > 1 AND b.c = "x"`)
+	assert.Nil(err)
+	g1, err := NewDocumentGenerator(5, expr)
+	assert.Nil(err)
+	g2, err := NewDocumentGenerator(5, expr)
+	assert.Nil(err)
+	for i := 0; i < 5; i++ {
+		doc1, _ := g1.Matching()
+		doc2, _ := g2.Matching()
+		assert.Equal(doc1, doc2)
+	}
+
+	g, err := NewDocumentGenerator(1, FalseExpr{})
+	assert.Nil(err)
+	_, err = g.Matching()
+	assert.Equal(ErrorNoDocumentFound, err)
+	_, err = g.NearMiss()
+	assert.Equal(ErrorNoDocumentFound, err)
+}
@@ -0,0 +1,205 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Graphviz output for match trees and expressions.  The graphs can be
+// rendered with `dot -Tsvg`, which is much easier to follow than the
+// indented String forms once expressions become large.
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotQuote(value string) string {
+	return `"` + dotEscaper.Replace(value) + `"`
+}
+
+func binTreeStateToDOTColor(value binTreeStateValue) string {
+	switch value {
+	case binTreeStateResolved:
+		return "lightgrey"
+	case binTreeStateTrue:
+		return "palegreen"
+	case binTreeStateFalse:
+		return "lightpink"
+	}
+	return "white"
+}
+
+func binTreeStateToString(value binTreeStateValue) string {
+	switch value {
+	case binTreeStateResolved:
+		return "undefined"
+	case binTreeStateTrue:
+		return "true"
+	case binTreeStateFalse:
+		return "false"
+	}
+	return "unknown"
+}
+
+func (tree *binTree) toDOT(states []binTreeStateValue) string {
+	var out strings.Builder
+	out.WriteString("digraph bintree {\n")
+	out.WriteString("  node [shape=box, style=filled, fillcolor=white];\n")
+
+	for i, node := range tree.data {
+		label := fmt.Sprintf("[%d] %s", i, binTreeNodeTypeToString(node.NodeType))
+		if states != nil {
+			label += "\n" + binTreeStateToString(states[i])
+			fmt.Fprintf(&out, "  n%d [label=%s, fillcolor=%s];\n", i, dotQuote(label), binTreeStateToDOTColor(states[i]))
+		} else {
+			fmt.Fprintf(&out, "  n%d [label=%s];\n", i, dotQuote(label))
+		}
+	}
+
+	for i, node := range tree.data {
+		if binTreeNodeTypeHasLeft(node.NodeType) {
+			fmt.Fprintf(&out, "  n%d -> n%d;\n", i, node.Left)
+		}
+		if binTreeNodeTypeHasRight(node.NodeType) {
+			fmt.Fprintf(&out, "  n%d -> n%d;\n", i, node.Right)
+		}
+	}
+
+	out.WriteString("}\n")
+	return out.String()
+}
+
+// ToDOT returns the tree as a Graphviz graph, labelling each node with its
+// index and type
+func (tree binTree) ToDOT() string {
+	return tree.toDOT(nil)
+}
+
+// ToDOT returns the tree of the state as a Graphviz graph, colouring each
+// node by its current state
+func (state binTreeState) ToDOT() string {
+	return state.tree.toDOT(state.data)
+}
+
+type exprDOTWriter struct {
+	out      strings.Builder
+	numNodes int
+}
+
+func (w *exprDOTWriter) node(label string, leaf bool) int {
+	id := w.numNodes
+	w.numNodes++
+	if leaf {
+		fmt.Fprintf(&w.out, "  n%d [label=%s, shape=ellipse];\n", id, dotQuote(label))
+	} else {
+		fmt.Fprintf(&w.out, "  n%d [label=%s];\n", id, dotQuote(label))
+	}
+	return id
+}
+
+func (w *exprDOTWriter) edge(from, to int, label string) {
+	if label != "" {
+		fmt.Fprintf(&w.out, "  n%d -> n%d [label=%s];\n", from, to, dotQuote(label))
+	} else {
+		fmt.Fprintf(&w.out, "  n%d -> n%d;\n", from, to)
+	}
+}
+
+func (w *exprDOTWriter) parent(label string, children ...Expression) int {
+	id := w.node(label, false)
+	for _, child := range children {
+		w.edge(id, w.expr(child), "")
+	}
+	return id
+}
+
+func (w *exprDOTWriter) loop(label string, varID VariableID, inExpr, subExpr Expression) int {
+	id := w.node(fmt.Sprintf("%s $%d", label, varID), false)
+	w.edge(id, w.expr(inExpr), "in")
+	w.edge(id, w.expr(subExpr), "")
+	return id
+}
+
+func (w *exprDOTWriter) expr(expr Expression) int {
+	switch expr := expr.(type) {
+	case AndExpr:
+		// The parser wraps every condition in an AND and OR of one
+		// element, which only clutter the graph
+		if len(expr) == 1 {
+			return w.expr(expr[0])
+		}
+		return w.parent("AND", expr...)
+	case OrExpr:
+		if len(expr) == 1 {
+			return w.expr(expr[0])
+		}
+		return w.parent("OR", expr...)
+	case NotExpr:
+		return w.parent("NOT", expr.SubExpr)
+	case EqualsExpr:
+		return w.parent("=", expr.Lhs, expr.Rhs)
+	case StrictEqualsExpr:
+		return w.parent("==", expr.Lhs, expr.Rhs)
+	case NotEqualsExpr:
+		return w.parent("!=", expr.Lhs, expr.Rhs)
+	case LessThanExpr:
+		return w.parent("<", expr.Lhs, expr.Rhs)
+	case LessEqualsExpr:
+		return w.parent("<=", expr.Lhs, expr.Rhs)
+	case GreaterThanExpr:
+		return w.parent(">", expr.Lhs, expr.Rhs)
+	case GreaterEqualsExpr:
+		return w.parent(">=", expr.Lhs, expr.Rhs)
+	case LikeExpr:
+		return w.parent("LIKE", expr.Lhs, expr.Rhs)
+	case ExistsExpr:
+		return w.parent("EXISTS", expr.SubExpr)
+	case NotExistsExpr:
+		return w.parent("NOT EXISTS", expr.SubExpr)
+	case FuncExpr:
+		return w.parent("func:"+expr.FuncName, expr.Params...)
+	case AnyInExpr:
+		return w.loop("ANY", expr.VarId, expr.InExpr, expr.SubExpr)
+	case EveryInExpr:
+		return w.loop("EVERY", expr.VarId, expr.InExpr, expr.SubExpr)
+	case AnyEveryInExpr:
+		return w.loop("ANY AND EVERY", expr.VarId, expr.InExpr, expr.SubExpr)
+	case AnyWithinExpr:
+		return w.loop("ANY WITHIN", expr.VarId, expr.InExpr, expr.SubExpr)
+	case FirstInExpr:
+		id := w.node(fmt.Sprintf("FIRST $%d", expr.VarId), false)
+		w.edge(id, w.expr(expr.InExpr), "in")
+		w.edge(id, w.expr(expr.ResultExpr), "result")
+		if expr.SubExpr != nil {
+			w.edge(id, w.expr(expr.SubExpr), "when")
+		}
+		return id
+	case ValueExpr:
+		if str, ok := expr.Value.(string); ok {
+			return w.node(fmt.Sprintf("%q", str), true)
+		}
+	}
+	return w.node(expr.String(), true)
+}
+
+// ExpressionToDOT returns an expression as a Graphviz graph, with operators
+// drawn as boxes and the fields and values they operate on as ellipses
+func ExpressionToDOT(expr Expression) string {
+	var w exprDOTWriter
+	w.out.WriteString("digraph expression {\n")
+	w.out.WriteString("  node [shape=box];\n")
+	w.expr(expr)
+	w.out.WriteString("}\n")
+	return w.out.String()
+}
+
+// FilterExpressionToDOT parses a filter expression and returns the
+// Expression it is lowered to as a Graphviz graph, in the same way as
+// ExpressionToDOT
+func FilterExpressionToDOT(expression string) (string, error) {
+	expr, err := ParseFilterExpression(expression)
+	if err != nil {
+		return "", err
+	}
+	return ExpressionToDOT(expr), nil
+}
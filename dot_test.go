@@ -0,0 +1,110 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinTreeToDOT(t *testing.T) {
+	assert := assert.New(t)
+
+	tree := binTree{
+		[]binTreeNode{
+			*NewBinTreeNode(nodeTypeOr, 0, 1, 2),
+			*NewBinTreeNode(nodeTypeLeaf, 0, 0, 0),
+			*NewBinTreeNode(nodeTypeNot, 0, 3, 0),
+			*NewBinTreeNode(nodeTypeLeaf, 2, 0, 0),
+		},
+	}
+
+	assert.Equal(`digraph bintree {
+  node [shape=box, style=filled, fillcolor=white];
+  n0 [label="[0] or"];
+  n1 [label="[1] leaf"];
+  n2 [label="[2] not"];
+  n3 [label="[3] leaf"];
+  n0 -> n1;
+  n0 -> n2;
+  n2 -> n3;
+}
+`, tree.ToDOT())
+
+	state := tree.NewState()
+	state.MarkNode(3, false)
+	assert.Equal(`digraph bintree {
+  node [shape=box, style=filled, fillcolor=white];
+  n0 [label="[0] or\ntrue", fillcolor=palegreen];
+  n1 [label="[1] leaf\nundefined", fillcolor=lightgrey];
+  n2 [label="[2] not\ntrue", fillcolor=palegreen];
+  n3 [label="[3] leaf\nfalse", fillcolor=lightpink];
+  n0 -> n1;
+  n0 -> n2;
+  n2 -> n3;
+}
+`, state.ToDOT())
+}
+
+func TestExpressionToDOT(t *testing.T) {
+	assert := assert.New(t)
+
+	expr := AndExpr{
+		EqualsExpr{FieldExpr{Root: 0, Path: []string{"name"}}, ValueExpr{`Neil "N"`}},
+		AnyInExpr{
+			VarId:   1,
+			InExpr:  FieldExpr{Root: 0, Path: []string{"tags"}},
+			SubExpr: GreaterThanExpr{FieldExpr{Root: 1}, ValueExpr{2}},
+		},
+	}
+
+	assert.Equal(`digraph expression {
+  node [shape=box];
+  n0 [label="AND"];
+  n1 [label="="];
+  n2 [label="$doc.name", shape=ellipse];
+  n1 -> n2;
+  n3 [label="\"Neil \\\"N\\\"\"", shape=ellipse];
+  n1 -> n3;
+  n0 -> n1;
+  n4 [label="ANY $1"];
+  n5 [label="$doc.tags", shape=ellipse];
+  n4 -> n5 [label="in"];
+  n6 [label=">"];
+  n7 [label="$1", shape=ellipse];
+  n6 -> n7;
+  n8 [label="2", shape=ellipse];
+  n6 -> n8;
+  n4 -> n6;
+  n0 -> n4;
+}
+`, ExpressionToDOT(expr))
+}
+
+func TestFilterExpressionToDOT(t *testing.T) {
+	assert := assert.New(t)
+
+	out, err := FilterExpressionToDOT(`name = "Neil" OR age > 40`)
+	assert.Nil(err)
+	assert.Equal(`digraph expression {
+  node [shape=box];
+  n0 [label="OR"];
+  n1 [label="="];
+  n2 [label="$doc.name", shape=ellipse];
+  n1 -> n2;
+  n3 [label="\"Neil\"", shape=ellipse];
+  n1 -> n3;
+  n0 -> n1;
+  n4 [label=">"];
+  n5 [label="$doc.age", shape=ellipse];
+  n4 -> n5;
+  n6 [label="40", shape=ellipse];
+  n4 -> n6;
+  n0 -> n4;
+}
+`, out)
+
+	_, err = FilterExpressionToDOT(`name =`)
+	assert.NotNil(err)
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+// DryRunTypeMismatch is a field which was found in a document with a
+// different type to the one the expression compares it with
+type DryRunTypeMismatch struct {
+	Field    FieldExpr
+	Expected string
+	Actual   string
+}
+
+// DryRunResult describes how an expression fared against one document
+type DryRunResult struct {
+	Matched bool
+	// The error matching the document, such as when it is not valid JSON,
+	// in which case its fields are not checked
+	Err error
+	// The fields used by the expression which the document does not have
+	Missing []FieldExpr
+	// The fields whose type does not suit the comparisons made with them
+	WrongTypes []DryRunTypeMismatch
+}
+
+// DryRun matches an expression against sample documents and reports, for
+// each of them, which of the fields used by the expression were missing or
+// had a type which the expression did not expect, such as a string field
+// compared with a number.  This allows a new filter to be checked against
+// real data before it is enabled.  Fields of loop variables are not checked.
+func DryRun(expr Expression, sampleDocs [][]byte) []DryRunResult {
+	var trans Transformer
+	def := trans.Transform([]Expression{expr})
+	matcher := NewFastMatcher(def)
+
+	var fields []FieldExpr
+	for _, field := range fetchExprFieldRefs(expr) {
+		if field.Root == 0 && len(field.Path) > 0 {
+			fields = append(fields, field)
+		}
+	}
+	expected := dryRunExpectedTypes(expr)
+
+	results := make([]DryRunResult, len(sampleDocs))
+	for i, doc := range sampleDocs {
+		match, _ := matchOne(matcher, doc)
+		results[i].Matched = match.Matched
+		results[i].Err = match.Err
+		if match.Err != nil {
+			// A matcher which panicked cannot be reused
+			matcher = NewFastMatcher(def)
+			continue
+		}
+
+		for _, field := range fields {
+			var tokens jsonTokenizer
+			tokens.Reset(doc)
+			token, _, ok := jsonValueAtPath(&tokens, field.Path)
+			if !ok {
+				results[i].Missing = append(results[i].Missing, field)
+				continue
+			}
+
+			actual := jsonTypeOfToken(token)
+			if want, ok := expected[field.String()]; ok && want != actual {
+				results[i].WrongTypes = append(results[i].WrongTypes, DryRunTypeMismatch{field, want, actual})
+			}
+		}
+	}
+	return results
+}
+
+// dryRunExpectedTypes finds the type expected of each field which is
+// compared with a value, or looped over, keeping the first when a field is
+// used in several ways
+func dryRunExpectedTypes(expr Expression) map[string]string {
+	expected := make(map[string]string)
+	expect := func(expr Expression, typeName string) {
+		field, ok := expr.(FieldExpr)
+		if !ok || field.Root != 0 || len(field.Path) == 0 || typeName == "" {
+			return
+		}
+		if _, ok := expected[field.String()]; !ok {
+			expected[field.String()] = typeName
+		}
+	}
+	compare := func(lhs, rhs Expression) {
+		if value, ok := rhs.(ValueExpr); ok {
+			expect(lhs, jsonTypeOfValue(value.Value))
+		}
+		if value, ok := lhs.(ValueExpr); ok {
+			expect(rhs, jsonTypeOfValue(value.Value))
+		}
+	}
+
+	rewriteExpr(expr, func(expr Expression) Expression {
+		switch expr := expr.(type) {
+		case EqualsExpr:
+			compare(expr.Lhs, expr.Rhs)
+		case StrictEqualsExpr:
+			compare(expr.Lhs, expr.Rhs)
+		case NotEqualsExpr:
+			compare(expr.Lhs, expr.Rhs)
+		case LessThanExpr:
+			compare(expr.Lhs, expr.Rhs)
+		case LessEqualsExpr:
+			compare(expr.Lhs, expr.Rhs)
+		case GreaterThanExpr:
+			compare(expr.Lhs, expr.Rhs)
+		case GreaterEqualsExpr:
+			compare(expr.Lhs, expr.Rhs)
+		case LikeExpr:
+			expect(expr.Lhs, "string")
+		case AnyInExpr:
+			expect(expr.InExpr, "array")
+		case EveryInExpr:
+			expect(expr.InExpr, "array")
+		case AnyEveryInExpr:
+			expect(expr.InExpr, "array")
+		}
+		return expr
+	})
+	return expected
+}
+
+// jsonTypeOfValue returns the JSON type of a value held by a ValueExpr, or
+// an empty string when any type can be compared with it
+func jsonTypeOfValue(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return "number"
+	}
+	return ""
+}
+
+// jsonTypeOfToken returns the JSON type of the value starting with a token
+func jsonTypeOfToken(token tokenType) string {
+	switch token {
+	case tknString, tknEscString:
+		return "string"
+	case tknInteger, tknNumber:
+		return "number"
+	case tknTrue, tknFalse:
+		return "boolean"
+	case tknNull:
+		return "null"
+	case tknObjectStart:
+		return "object"
+	case tknArrayStart:
+		return "array"
+	}
+	return "unknown"
+}
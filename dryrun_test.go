@@ -0,0 +1,56 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	parsed, err := ParseFilterExpression(`type = "order" AND total > 100 AND REGEXP_CONTAINS(name, "^N")`)
+	assert.Nil(err)
+	expr := AndExpr{
+		parsed,
+		AnyInExpr{
+			VarId:  1,
+			InExpr: FieldExpr{Root: 0, Path: []string{"items"}},
+			SubExpr: EqualsExpr{
+				FieldExpr{Root: 1, Path: []string{"sku"}},
+				ValueExpr{"a"},
+			},
+		},
+	}
+
+	results := DryRun(expr, [][]byte{
+		[]byte(`{"type":"order","total":150,"items":[{"sku":"a"}],"name":"Neil"}`),
+		[]byte(`{"type":"order","total":"150","items":{"sku":"a"}}`),
+		[]byte(`{"type":@}`),
+		[]byte(`{"type":"order","total":150,"items":[],"name":null}`),
+	})
+	assert.Equal(4, len(results))
+
+	assert.True(results[0].Matched)
+	assert.Nil(results[0].Err)
+	assert.Equal(0, len(results[0].Missing))
+	assert.Equal(0, len(results[0].WrongTypes))
+
+	assert.False(results[1].Matched)
+	assert.Equal([]FieldExpr{{Root: 0, Path: []string{"name"}}}, results[1].Missing)
+	assert.Equal([]DryRunTypeMismatch{
+		{FieldExpr{Root: 0, Path: []string{"total"}}, "number", "string"},
+		{FieldExpr{Root: 0, Path: []string{"items"}}, "array", "object"},
+	}, results[1].WrongTypes)
+
+	assert.NotNil(results[2].Err)
+	assert.Equal(0, len(results[2].Missing))
+
+	assert.False(results[3].Matched)
+	assert.Nil(results[3].Err)
+	assert.Equal([]DryRunTypeMismatch{
+		{FieldExpr{Root: 0, Path: []string{"name"}}, "string", "null"},
+	}, results[3].WrongTypes)
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"errors"
+	"fmt"
+	"text/scanner"
+)
+
+// Error categories, callers should test for these using errors.Is
+var ErrSyntax error = fmt.Errorf("Error: Invalid syntax")
+var ErrUnsupportedFunction error = fmt.Errorf("Error: Unsupported function")
+var ErrBadRegex error = fmt.Errorf("Error: Invalid regular expression")
+var ErrMalformedParenthesis error = ErrorMalformedParenthesis
+var ErrLimitExceeded error = fmt.Errorf("Error: Expression exceeds a transform limit")
+var ErrParseLimitExceeded error = fmt.Errorf("Error: Expression exceeds a parser limit")
+
+// FilterExpressionError is returned for failures found while parsing or
+// compiling an expression.  Kind holds one of the error categories above, and
+// Line/Column hold the location within the expression when it is known,
+// along with its byte Offset from the start of the expression.
+type FilterExpressionError struct {
+	Kind   error
+	Line   int
+	Column int
+	Msg    string
+	Offset int
+}
+
+func (e *FilterExpressionError) Error() string {
+	msg := e.Msg
+	if len(msg) == 0 {
+		msg = e.Kind.Error()
+	}
+	if e.Line > 0 {
+		return fmt.Sprintf("%v:%v: %v", e.Line, e.Column, msg)
+	}
+	return msg
+}
+
+func (e *FilterExpressionError) Unwrap() error {
+	return e.Kind
+}
+
+// TransformLimitError is returned by TransformWithLimits when the definition
+// built for an expression would exceed one of the limits it was given
+type TransformLimitError struct {
+	// The limit which was exceeded, one of "leaves", "nodes" or "loop depth"
+	Limit string
+	Max   int
+}
+
+func (e *TransformLimitError) Error() string {
+	return fmt.Sprintf("Error: Expression exceeds the limit of %d %s", e.Max, e.Limit)
+}
+
+func (e *TransformLimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+// ParseLimitError is returned by parsers given FilterExpressionLimits when an
+// expression exceeds one of them
+type ParseLimitError struct {
+	// The limit which was exceeded, one of "bytes", "tokens" or "nesting depth"
+	Limit string
+	Max   int
+}
+
+func (e *ParseLimitError) Error() string {
+	return fmt.Sprintf("Error: Expression exceeds the limit of %d %s", e.Max, e.Limit)
+}
+
+func (e *ParseLimitError) Unwrap() error {
+	return ErrParseLimitExceeded
+}
+
+// JSONLinesError is returned by FastMatcher.MatchJSONLines when a record
+// fails to match, giving where the record is in the input
+type JSONLinesError struct {
+	Line   int
+	Offset int64
+	Err    error
+}
+
+func (e *JSONLinesError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *JSONLinesError) Unwrap() error {
+	return e.Err
+}
+
+func newFilterExpressionError(kind error, format string, args ...interface{}) error {
+	return &FilterExpressionError{
+		Kind: kind,
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// newParenthesisError reports a parenthesis which has no match within its
+// sub-expression
+func newParenthesisError(pos scanner.Position, msg string) error {
+	return &FilterExpressionError{ErrMalformedParenthesis, pos.Line, pos.Column, msg, pos.Offset}
+}
+
+// LocateParenthesisMismatch returns a *FilterExpressionError giving the
+// position of the parenthesis of an expression which has no match, or nil
+// if there is none.  Parsing such an expression returns the
+// ErrorMalformedParenthesis sentinel itself, which holds no position.
+func LocateParenthesisMismatch(expression string) error {
+	_, fe, err := NewFilterExpressionParser(expression)
+	if err != nil {
+		return nil
+	}
+
+	_, err = fe.outputChecked()
+	var feErr *FilterExpressionError
+	if errors.As(err, &feErr) && feErr.Kind == ErrMalformedParenthesis {
+		return feErr
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// matchExplainer gathers the clauses which decide each node of the match
+// tree, described using the paths of the document they read
+type matchExplainer struct {
+	tree      *binTree
+	clauses   map[int][]string
+	slotPaths map[SlotID]string
+}
+
+func explainElemPath(path, key string) string {
+	if fmtArrayIndexRegex.MatchString(key) {
+		return path + key
+	}
+	return path + "." + key
+}
+
+// findSlots records the path of the value stored in each slot, so that ops
+// using slots can name the value they compare with
+func (e *matchExplainer) findSlots(node *ExecNode, path string) {
+	if node == nil {
+		return
+	}
+	if node.StoreId > 0 {
+		e.slotPaths[node.StoreId] = path
+	}
+	for _, key := range sortedExecNodeKeys(node.Elems) {
+		e.findSlots(node.Elems[key], explainElemPath(path, key))
+	}
+	for _, loop := range node.Loops {
+		e.findSlots(loop.Node, e.refString(loop.Target, path)+"[*]")
+	}
+	if node.After != nil {
+		for _, loop := range node.After.Loops {
+			e.findSlots(loop.Node, e.refString(loop.Target, path)+"[*]")
+		}
+	}
+}
+
+func (e *matchExplainer) refString(ref DataRef, path string) string {
+	switch ref := ref.(type) {
+	case nil, activeLitRef:
+		return path
+	case SlotRef:
+		if slotPath, ok := e.slotPaths[ref.Slot]; ok {
+			return slotPath
+		}
+	case FuncRef:
+		params := make([]string, len(ref.Params))
+		for i, param := range ref.Params {
+			params[i] = e.refString(param, path)
+		}
+		return fmt.Sprintf("%s(%s)", ref.FuncName, strings.Join(params, ", "))
+	}
+	return ref.String()
+}
+
+func (e *matchExplainer) addOps(ops []OpNode, path string) {
+	for _, op := range ops {
+		var clause string
+		if op.Op == OpTypeExists {
+			clause = fmt.Sprintf("%s exists", e.refString(op.Lhs, path))
+		} else {
+			clause = fmt.Sprintf("%s %s %s", e.refString(op.Lhs, path), op.Op, e.refString(op.Rhs, path))
+		}
+		e.clauses[int(op.BucketIdx)] = append(e.clauses[int(op.BucketIdx)], clause)
+	}
+}
+
+func (e *matchExplainer) addLoops(loops []LoopNode, path string) {
+	for _, loop := range loops {
+		target := e.refString(loop.Target, path)
+		clause := fmt.Sprintf("%s element of %s", loop.Mode, target)
+		// The bucket of a loop is the root of its body, below the loop node
+		loopIdx := e.tree.data[loop.BucketIdx].ParentIdx
+		e.clauses[loopIdx] = append(e.clauses[loopIdx], clause)
+		e.addNode(loop.Node, target+"[*]")
+	}
+}
+
+func (e *matchExplainer) addNode(node *ExecNode, path string) {
+	if node == nil {
+		return
+	}
+	e.addOps(node.Ops, path)
+	for _, key := range sortedExecNodeKeys(node.Elems) {
+		e.addNode(node.Elems[key], explainElemPath(path, key))
+	}
+	e.addLoops(node.Loops, path)
+	if node.After != nil {
+		e.addOps(node.After.Ops, path)
+		e.addLoops(node.After.Loops, path)
+	}
+}
+
+func (e *matchExplainer) explainItem(def *MatchDef, item int, exprs map[int][]int) string {
+	idata := def.MatchTree.data[item]
+	out := fmt.Sprintf("[%d] %s", item, binTreeNodeTypeToString(idata.NodeType))
+	if clauses := e.clauses[item]; len(clauses) > 0 {
+		out += ": " + strings.Join(clauses, "; ")
+	}
+	for _, exprIdx := range exprs[item] {
+		out += fmt.Sprintf(" <- expression %d", exprIdx)
+	}
+	out += "\n"
+
+	if binTreeNodeTypeHasLeft(idata.NodeType) {
+		out += reindentString(e.explainItem(def, idata.Left, exprs), "  ") + "\n"
+	}
+	if binTreeNodeTypeHasRight(idata.NodeType) {
+		out += reindentString(e.explainItem(def, idata.Right, exprs), "  ") + "\n"
+	}
+	return strings.TrimRight(out, "\n")
+}
+
+// Explain describes the match tree of the definition, listing the clauses
+// which decide each of its leaves and loops in terms of the paths of the
+// document they read, and which node gives the result of each expression.
+// Elements of arrays being looped over are written as `[*]`.
+func (def *MatchDef) Explain() string {
+	var out string
+	exprs := make(map[int][]int)
+	for i, bucket := range def.MatchBuckets {
+		switch bucket {
+		case AlwaysTrueIdent:
+			out += fmt.Sprintf("expression %d: always true\n", i)
+		case AlwaysFalseIdent:
+			out += fmt.Sprintf("expression %d: always false\n", i)
+		default:
+			exprs[bucket] = append(exprs[bucket], i)
+		}
+	}
+
+	if len(def.MatchTree.data) > 0 {
+		e := &matchExplainer{
+			tree:      &def.MatchTree,
+			clauses:   make(map[int][]string),
+			slotPaths: make(map[SlotID]string),
+		}
+		e.findSlots(def.ParseNode, "$doc")
+		e.addNode(def.ParseNode, "$doc")
+		out += e.explainItem(def, 0, exprs) + "\n"
+	}
+	return strings.TrimRight(out, "\n")
+}
@@ -0,0 +1,39 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchDefExplain(t *testing.T) {
+	assert := assert.New(t)
+
+	var trans Transformer
+	def := trans.Transform([]Expression{
+		AndExpr{
+			EqualsExpr{FieldExpr{Root: 0, Path: []string{"name"}}, ValueExpr{"Neil"}},
+			AnyInExpr{
+				VarId:   1,
+				InExpr:  FieldExpr{Root: 0, Path: []string{"tags"}},
+				SubExpr: GreaterThanExpr{FieldExpr{Root: 1, Path: []string{"weight"}}, ValueExpr{2}},
+			},
+		},
+		NotExpr{ExistsExpr{FieldExpr{Root: 0, Path: []string{"deleted"}}}},
+		TrueExpr{},
+	})
+
+	assert.Equal(`expression 2: always true
+[0] neor
+  [1] and <- expression 0
+    [2] leaf: $doc.name eq (jsonString)"Neil"
+    [3] loop: any element of $doc.tags
+      [4] leaf: $doc.tags[*].weight gt (int)2
+  [5] not <- expression 1
+    [6] leaf: $doc.deleted exists`, def.Explain())
+
+	def = trans.Transform([]Expression{FalseExpr{}})
+	assert.Equal(`expression 0: always false`, def.Explain())
+}
@@ -4,6 +4,8 @@ package gojsonsm
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -18,6 +20,8 @@ func (id VariableID) String() string {
 }
 
 type Expression interface {
+	// String outputs the expression for debugging, which is not filter
+	// expression syntax.  FormatExpression outputs text which parses back.
 	String() string
 }
 
@@ -40,7 +44,7 @@ type ValueExpr struct {
 }
 
 func (expr ValueExpr) String() string {
-	return fmt.Sprintf("%v", expr.Value)
+	return valueToString(expr.Value)
 }
 
 type TimeExpr struct {
@@ -48,7 +52,7 @@ type TimeExpr struct {
 }
 
 func (expr TimeExpr) String() string {
-	return fmt.Sprintf("%v", expr.Time)
+	return valueToString(expr.Time)
 }
 
 type RegexExpr struct {
@@ -67,6 +71,17 @@ func (expr PcreExpr) String() string {
 	return fmt.Sprintf("/%v/", expr.Pcre)
 }
 
+// EngineRegexExpr is a regular expression compiled by a RegexEngine which
+// was registered with RegisterRegexEngine
+type EngineRegexExpr struct {
+	Engine string
+	Regex  interface{}
+}
+
+func (expr EngineRegexExpr) String() string {
+	return fmt.Sprintf("/%v/%v", expr.Regex, expr.Engine)
+}
+
 type NotExpr struct {
 	SubExpr Expression
 }
@@ -177,6 +192,38 @@ func (expr AnyEveryInExpr) String() string {
 	return fmt.Sprintf("any and every $%d in %s\n%s\nend", expr.VarId, expr.InExpr, exprStr)
 }
 
+// AnyWithinExpr matches when SubExpr holds for any value nested within
+// InExpr, at any depth, rather than just for the elements of an array
+type AnyWithinExpr struct {
+	VarId   VariableID
+	InExpr  Expression
+	SubExpr Expression
+}
+
+func (expr AnyWithinExpr) String() string {
+	exprStr := reindentString(expr.SubExpr.String(), "  ")
+	return fmt.Sprintf("any $%d within %s\n%s\nend", expr.VarId, expr.InExpr, exprStr)
+}
+
+// FirstInExpr evaluates to ResultExpr for the first element of InExpr which
+// satisfies SubExpr, or to a missing value if no element does.  A nil
+// SubExpr picks the first element.  It is only usable as an operand of a
+// comparison or of EXISTS, and ResultExpr must refer to the loop variable.
+type FirstInExpr struct {
+	VarId      VariableID
+	InExpr     Expression
+	ResultExpr Expression
+	SubExpr    Expression
+}
+
+func (expr FirstInExpr) String() string {
+	if expr.SubExpr == nil {
+		return fmt.Sprintf("first %s for $%d in %s end", expr.ResultExpr, expr.VarId, expr.InExpr)
+	}
+	exprStr := reindentString(expr.SubExpr.String(), "  ")
+	return fmt.Sprintf("first %s for $%d in %s when\n%s\nend", expr.ResultExpr, expr.VarId, expr.InExpr, exprStr)
+}
+
 type ExistsExpr struct {
 	SubExpr Expression
 }
@@ -202,6 +249,18 @@ func (expr EqualsExpr) String() string {
 	return fmt.Sprintf("%s = %s", expr.Lhs, expr.Rhs)
 }
 
+// StrictEqualsExpr is an equality which only matches values of the same
+// JSON type, so that numbers never equal strings or booleans, whatever
+// coercion the matcher applies to EqualsExpr
+type StrictEqualsExpr struct {
+	Lhs Expression
+	Rhs Expression
+}
+
+func (expr StrictEqualsExpr) String() string {
+	return fmt.Sprintf("%s == %s", expr.Lhs, expr.Rhs)
+}
+
 type NotEqualsExpr struct {
 	Lhs Expression
 	Rhs Expression
@@ -255,3 +314,32 @@ type LikeExpr struct {
 func (expr LikeExpr) String() string {
 	return fmt.Sprintf("%s =~ %s", expr.Lhs, expr.Rhs)
 }
+
+// valueToString writes a value so that strings, which are quoted, can be
+// told apart from other values such as the number 5 and the string "5".
+// Numbers are compared by value, so 5 and 5.0 are written the same way.
+func valueToString(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return strconv.Quote(value)
+	case []interface{}:
+		elemStrs := make([]string, len(value))
+		for i, elem := range value {
+			elemStrs[i] = valueToString(elem)
+		}
+		return "[" + strings.Join(elemStrs, ", ") + "]"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fieldStrs := make([]string, len(keys))
+		for i, key := range keys {
+			fieldStrs[i] = strconv.Quote(key) + ": " + valueToString(value[key])
+		}
+		return "{" + strings.Join(fieldStrs, ", ") + "}"
+	}
+	return fmt.Sprintf("%v", value)
+}
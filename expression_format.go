@@ -0,0 +1,1015 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The filter expression grammar reads NOT before AND and AND before OR, with
+// parenthesis grouping conditions, but has no NOT over a parenthesised
+// group.  The formatter keeps the grouping of the Expression it is given,
+// pushing NOT into the groups it applies to, and writes parenthesis around
+// every group within one of the other kind.
+
+var fmtIdentRegex *regexp.Regexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var fmtArrayIndexRegex *regexp.Regexp = regexp.MustCompile(`^\[[0-9]+\]$`)
+var fmtInputRegex *regexp.Regexp = regexp.MustCompile(`^\$[A-Za-z_][A-Za-z0-9_]*$`)
+
+var fmtOneArgFuncs map[string]string = map[string]string{
+	MathFuncAbs:       FuncAbs,
+	MathFuncAcos:      FuncAcos,
+	MathFuncAsin:      FuncAsin,
+	MathFuncAtan:      FuncAtan,
+	MathFuncCeil:      FuncCeil,
+	MathFuncCos:       FuncCos,
+	DateFunc:          FuncDate,
+	MathFuncDegrees:   FuncDeg,
+	MathFuncExp:       FuncExp,
+	MathFuncFloor:     FuncFloor,
+	MathFuncLog:       FuncLog,
+	MathFuncLn:        FuncLn,
+	MathFuncLog10:     FuncLog10,
+	MathFuncLog2:      FuncLog2,
+	MathFuncSin:       FuncSin,
+	MathFuncTan:       FuncTan,
+	MathFuncRadians:   FuncRad,
+	MathFuncRound:     FuncRound,
+	MathFuncRoundEven: FuncRoundEven,
+	MathFuncSqrt:      FuncSqrt,
+	Base64DecFunc:     FuncBase64Decode,
+	Base64EncFunc:     FuncBase64Encode,
+	EncodeJsonFunc:    FuncEncodeJson,
+	DateWeekdayFunc:   FuncWeekdayStr,
+}
+
+var fmtNoArgFuncs map[string]string = map[string]string{
+	NowMillisFunc: FuncNowMillis,
+}
+
+var fmtTwoArgFuncs map[string]string = map[string]string{
+	MathFuncAtan2: FuncAtan2,
+	MathFuncPow:   FuncPower,
+	MathFuncMod:   FuncMod,
+}
+
+var fmtMathOps map[string]string = map[string]string{
+	MathFuncAdd: "+",
+	MathFuncSub: "-",
+	MathFuncMul: "*",
+	MathFuncDiv: "/",
+	MathFuncMod: "%",
+}
+
+// Words that would be consumed by the grammar rather than read as a field
+var fmtReservedWords map[string]bool = map[string]bool{
+	OperatorOr: true, OperatorAnd: true, OperatorNot: true, OperatorTrue: true, OperatorFalse: true,
+	"true": true, "false": true, "IS": true, "NULL": true, "MISSING": true, OperatorExists: true,
+	OperatorMeta: true, "PI": true, "E": true, FuncRegexp: true, OperatorAny: true, OperatorWithin: true,
+	OperatorSatisfies: true, OperatorEnd: true, OperatorFirst: true, OperatorFor: true, OperatorIn: true,
+	OperatorWhen: true, OperatorLet: true, OperatorWhere: true, OperatorSelf: true,
+	FuncArrayContains: true, FuncTokens: true,
+}
+
+func init() {
+	for _, name := range fmtNoArgFuncs {
+		fmtReservedWords[name] = true
+	}
+	for _, name := range fmtOneArgFuncs {
+		fmtReservedWords[name] = true
+	}
+	for _, name := range fmtTwoArgFuncs {
+		fmtReservedWords[name] = true
+	}
+}
+
+type fmtOperandPos int
+
+const (
+	fmtPosLhs fmtOperandPos = iota
+	fmtPosRhs
+	fmtPosFuncArg
+)
+
+func fmtNegate(expr Expression) Expression {
+	switch expr := expr.(type) {
+	case NotExpr:
+		return expr.SubExpr
+	case AndExpr:
+		var out OrExpr
+		for _, subExpr := range expr {
+			out = append(out, fmtNegate(subExpr))
+		}
+		return out
+	case OrExpr:
+		var out AndExpr
+		for _, subExpr := range expr {
+			out = append(out, fmtNegate(subExpr))
+		}
+		return out
+	case TrueExpr:
+		return FalseExpr{}
+	case FalseExpr:
+		return TrueExpr{}
+	}
+	return NotExpr{expr}
+}
+
+// fmtGroups pushes NOT into the groups it applies to, and merges each group
+// into the one it is within when they are of the same kind
+func fmtGroups(expr Expression) (Expression, error) {
+	switch typedExpr := expr.(type) {
+	case AndExpr:
+		if len(typedExpr) == 0 {
+			return nil, ErrorNotRepresentable
+		}
+		var out AndExpr
+		for _, subExpr := range typedExpr {
+			subExpr, err := fmtGroups(subExpr)
+			if err != nil {
+				return nil, err
+			}
+			if subAnd, ok := subExpr.(AndExpr); ok {
+				out = append(out, subAnd...)
+			} else {
+				out = append(out, subExpr)
+			}
+		}
+		if len(out) == 1 {
+			return out[0], nil
+		}
+		return out, nil
+	case OrExpr:
+		if len(typedExpr) == 0 {
+			return nil, ErrorNotRepresentable
+		}
+		var out OrExpr
+		for _, subExpr := range typedExpr {
+			subExpr, err := fmtGroups(subExpr)
+			if err != nil {
+				return nil, err
+			}
+			if subOr, ok := subExpr.(OrExpr); ok {
+				out = append(out, subOr...)
+			} else {
+				out = append(out, subExpr)
+			}
+		}
+		if len(out) == 1 {
+			return out[0], nil
+		}
+		return out, nil
+	case NotExpr:
+		switch typedExpr.SubExpr.(type) {
+		case AndExpr, OrExpr, NotExpr, TrueExpr, FalseExpr:
+			return fmtGroups(fmtNegate(typedExpr.SubExpr))
+		}
+	}
+	return expr, nil
+}
+
+func fmtPathElem(elem string) (string, error) {
+	if fmtIdentRegex.MatchString(elem) && !fmtReservedWords[elem] {
+		return elem, nil
+	}
+	if strings.Contains(elem, "`") || len(elem) == 0 {
+		return "", ErrorNotRepresentable
+	}
+	return "`" + elem + "`", nil
+}
+
+func fmtField(expr FieldExpr) (string, error) {
+	if expr.Root != 0 {
+		return "", ErrorNotRepresentable
+	}
+	if len(expr.Path) == 0 {
+		return OperatorSelf, nil
+	}
+
+	// Single element paths that look like dates are read back as values
+	if len(expr.Path) == 1 && (iso8601Year.MatchString(expr.Path[0]) ||
+		iso8601YearAndMonth.MatchString(expr.Path[0]) ||
+		iso8601CompleteDate.MatchString(expr.Path[0])) {
+		return "", ErrorNotRepresentable
+	}
+
+	var out string
+	for i, elem := range expr.Path {
+		if fmtArrayIndexRegex.MatchString(elem) {
+			if i == 0 {
+				return "", ErrorNotRepresentable
+			}
+			out += elem
+			continue
+		}
+
+		if i > 0 {
+			out += "."
+		}
+		if i == 0 && (elem == OperatorMeta+"()" || fmtInputRegex.MatchString(elem)) {
+			out += elem
+			continue
+		}
+
+		elemStr, err := fmtPathElem(elem)
+		if err != nil {
+			return "", err
+		}
+		out += elemStr
+	}
+	return out, nil
+}
+
+func fmtNumber(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case int:
+		return strconv.FormatInt(int64(value), 10), value >= 0
+	case int8:
+		return strconv.FormatInt(int64(value), 10), value >= 0
+	case int16:
+		return strconv.FormatInt(int64(value), 10), value >= 0
+	case int32:
+		return strconv.FormatInt(int64(value), 10), value >= 0
+	case int64:
+		return strconv.FormatInt(value, 10), value >= 0
+	case uint:
+		return strconv.FormatUint(uint64(value), 10), true
+	case uint8:
+		return strconv.FormatUint(uint64(value), 10), true
+	case uint16:
+		return strconv.FormatUint(uint64(value), 10), true
+	case uint32:
+		return strconv.FormatUint(uint64(value), 10), true
+	case uint64:
+		return strconv.FormatUint(value, 10), true
+	case float32:
+		return fmtFloat(float64(value))
+	case float64:
+		return fmtFloat(value)
+	}
+	return "", false
+}
+
+func fmtFloat(value float64) (string, bool) {
+	if math.IsNaN(value) || math.IsInf(value, 0) || math.Signbit(value) {
+		return "", false
+	}
+	out := strconv.FormatFloat(value, 'g', -1, 64)
+	if !strings.ContainsAny(out, ".e") {
+		// Keep the value a float when it is read back
+		out += ".0"
+	}
+	return out, true
+}
+
+// fmtNested formats a value within an array or object literal, where
+// strings are always values and numbers can be negative
+func fmtNested(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return strconv.Quote(value), nil
+	case []interface{}:
+		elemStrs := make([]string, len(value))
+		for i, elem := range value {
+			elemStr, err := fmtNested(elem)
+			if err != nil {
+				return "", err
+			}
+			elemStrs[i] = elemStr
+		}
+		return "[" + strings.Join(elemStrs, ", ") + "]", nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fieldStrs := make([]string, len(keys))
+		for i, key := range keys {
+			fieldStr, err := fmtNested(value[key])
+			if err != nil {
+				return "", err
+			}
+			fieldStrs[i] = strconv.Quote(key) + ": " + fieldStr
+		}
+		return "{" + strings.Join(fieldStrs, ", ") + "}", nil
+	}
+
+	numStr, ok := fmtNumber(value)
+	if !ok && len(numStr) == 0 {
+		// Negative floats are only refused because of the sign
+		var floatVal float64
+		switch value := value.(type) {
+		case float32:
+			floatVal = float64(value)
+		case float64:
+			floatVal = value
+		default:
+			return "", ErrorNotRepresentable
+		}
+		negStr, negOk := fmtFloat(-floatVal)
+		if !negOk {
+			return "", ErrorNotRepresentable
+		}
+		numStr = "-" + negStr
+	}
+	return numStr, nil
+}
+
+func fmtValue(expr ValueExpr, pos fmtOperandPos) (string, error) {
+	switch value := expr.Value.(type) {
+	case []interface{}, map[string]interface{}:
+		if pos == fmtPosFuncArg {
+			return "", ErrorNotRepresentable
+		}
+		return fmtNested(value)
+	case string:
+		if pos == fmtPosRhs {
+			return strconv.Quote(value), nil
+		}
+		if pos == fmtPosFuncArg && (iso8601Year.MatchString(value) ||
+			iso8601YearAndMonth.MatchString(value) ||
+			iso8601CompleteDate.MatchString(value)) {
+			return strconv.Quote(value), nil
+		}
+		// Strings anywhere else are read back as field names
+		return "", ErrorNotRepresentable
+	case bool:
+		if pos == fmtPosFuncArg {
+			return "", ErrorNotRepresentable
+		}
+		if value {
+			return OperatorTrue, nil
+		}
+		return OperatorFalse, nil
+	}
+
+	if numStr, ok := fmtNumber(expr.Value); ok {
+		return numStr, nil
+	}
+	return "", ErrorNotRepresentable
+}
+
+// fmtFieldMath formats the `{-}field {op value}` forms the grammar allows
+func fmtFieldMath(expr FuncExpr) (string, error) {
+	if expr.FuncName == MathFuncNeg {
+		if len(expr.Params) != 1 {
+			return "", ErrorNotRepresentable
+		}
+		field, ok := expr.Params[0].(FieldExpr)
+		if !ok {
+			return "", ErrorNotRepresentable
+		}
+		fieldStr, err := fmtField(field)
+		if err != nil {
+			return "", err
+		}
+		return "-" + fieldStr, nil
+	}
+
+	opStr := fmtMathOps[expr.FuncName]
+	if len(expr.Params) != 2 {
+		return "", ErrorNotRepresentable
+	}
+
+	var lhsStr string
+	var err error
+	switch lhs := expr.Params[0].(type) {
+	case FieldExpr:
+		lhsStr, err = fmtField(lhs)
+	case FuncExpr:
+		if lhs.FuncName != MathFuncNeg {
+			return "", ErrorNotRepresentable
+		}
+		lhsStr, err = fmtFieldMath(lhs)
+	default:
+		return "", ErrorNotRepresentable
+	}
+	if err != nil {
+		return "", err
+	}
+
+	rhs, ok := expr.Params[1].(ValueExpr)
+	if !ok {
+		return "", ErrorNotRepresentable
+	}
+	rhsStr, ok := fmtNumber(rhs.Value)
+	if !ok {
+		return "", ErrorNotRepresentable
+	}
+
+	return fmt.Sprintf("%s %s %s", lhsStr, opStr, rhsStr), nil
+}
+
+// fmtDecodeJson outputs DECODE_JSON() of a field followed by the path into
+// the decoded value
+func fmtDecodeJson(expr FuncExpr) (string, error) {
+	inner, path, ok := decodeJsonOf(expr)
+	if !ok {
+		return "", ErrorNotRepresentable
+	}
+	innerStr, err := fmtOperand(inner, fmtPosFuncArg)
+	if err != nil {
+		return "", err
+	}
+
+	out := fmt.Sprintf("%s(%s)", FuncDecodeJson, innerStr)
+	for _, elem := range path {
+		if fmtArrayIndexRegex.MatchString(elem) {
+			out += elem
+			continue
+		}
+		elemStr, err := fmtPathElem(elem)
+		if err != nil {
+			return "", err
+		}
+		out += "." + elemStr
+	}
+	return out, nil
+}
+
+// fmtDateTrunc outputs DATE_TRUNC_STR(), whose part is a string value
+// rather than the field that a quoted argument would be read as
+func fmtDateTrunc(expr FuncExpr) (string, error) {
+	if len(expr.Params) != 2 {
+		return "", ErrorNotRepresentable
+	}
+	dateStr, err := fmtOperand(expr.Params[0], fmtPosFuncArg)
+	if err != nil {
+		return "", err
+	}
+	part, ok := expr.Params[1].(ValueExpr)
+	if !ok {
+		return "", ErrorNotRepresentable
+	}
+	partStr, ok := part.Value.(string)
+	if !ok || !isDateTruncPart(partStr) {
+		return "", ErrorNotRepresentable
+	}
+	return fmt.Sprintf("%s(%s, %s)", FuncDateTruncStr, dateStr, strconv.Quote(partStr)), nil
+}
+
+func fmtFunc(expr FuncExpr) (string, error) {
+	if expr.FuncName == DecodeJsonFunc {
+		return fmtDecodeJson(expr)
+	}
+	if expr.FuncName == DateTruncFunc {
+		return fmtDateTrunc(expr)
+	}
+	if _, ok := fmtMathOps[expr.FuncName]; ok || expr.FuncName == MathFuncNeg {
+		out, err := fmtFieldMath(expr)
+		// MOD() also takes the operands which % cannot
+		if _, ok := fmtTwoArgFuncs[expr.FuncName]; err == nil || !ok {
+			return out, err
+		}
+	}
+
+	var name string
+	if noArgName, ok := fmtNoArgFuncs[expr.FuncName]; ok && len(expr.Params) == 0 {
+		name = noArgName
+	} else if oneArgName, ok := fmtOneArgFuncs[expr.FuncName]; ok && len(expr.Params) == 1 {
+		name = oneArgName
+	} else if twoArgName, ok := fmtTwoArgFuncs[expr.FuncName]; ok && len(expr.Params) == 2 {
+		name = twoArgName
+	} else {
+		return "", ErrorNotRepresentable
+	}
+
+	var params []string
+	for _, param := range expr.Params {
+		paramStr, err := fmtOperand(param, fmtPosFuncArg)
+		if err != nil {
+			return "", err
+		}
+		params = append(params, paramStr)
+	}
+
+	return fmt.Sprintf("%s(%s)", name, strings.Join(params, ", ")), nil
+}
+
+func fmtOperand(expr Expression, pos fmtOperandPos) (string, error) {
+	switch expr := expr.(type) {
+	case FieldExpr:
+		return fmtField(expr)
+	case ValueExpr:
+		return fmtValue(expr, pos)
+	case FuncExpr:
+		return fmtFunc(expr)
+	case FirstInExpr:
+		return fmtFirst(expr)
+	}
+	return "", ErrorNotRepresentable
+}
+
+func fmtComparison(opStr, flippedOpStr string, lhs, rhs Expression) (string, error) {
+	// Literal strings on the left would be read back as field names
+	if lhsVal, ok := lhs.(ValueExpr); ok {
+		if _, isStr := lhsVal.Value.(string); isStr {
+			lhs, rhs = rhs, lhs
+			opStr = flippedOpStr
+		}
+	}
+
+	if rhsVal, ok := rhs.(ValueExpr); ok && rhsVal.Value == nil && opStr == OperatorEquals {
+		lhsStr, err := fmtOperand(lhs, fmtPosLhs)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s", lhsStr, OperatorNull), nil
+	}
+
+	lhsStr, err := fmtOperand(lhs, fmtPosLhs)
+	if err != nil {
+		return "", err
+	}
+	rhsStr, err := fmtOperand(rhs, fmtPosRhs)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s", lhsStr, opStr, rhsStr), nil
+}
+
+// fmtArrayContains outputs ARRAY_CONTAINS() of either an array field, or of
+// TOKENS() of a field
+func fmtArrayContains(array Expression, value Expression) (string, error) {
+	var arrayStr string
+	switch array := array.(type) {
+	case FieldExpr:
+		fieldStr, err := fmtField(array)
+		if err != nil {
+			return "", err
+		}
+		arrayStr = fieldStr
+	case FuncExpr:
+		field, ok := array.Params[0].(FieldExpr)
+		if !ok {
+			return "", ErrorNotRepresentable
+		}
+		fieldStr, err := fmtField(field)
+		if err != nil {
+			return "", err
+		}
+		arrayStr = fmt.Sprintf("%s(%s)", FuncTokens, fieldStr)
+	default:
+		return "", ErrorNotRepresentable
+	}
+
+	valueStr, err := fmtOperand(value, fmtPosRhs)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s(%s, %s)", FuncArrayContains, arrayStr, valueStr), nil
+}
+
+func fmtRegexContains(expr LikeExpr) (string, error) {
+	lhsStr, err := fmtOperand(expr.Lhs, fmtPosFuncArg)
+	if err != nil {
+		if lhsField, ok := expr.Lhs.(FieldExpr); ok {
+			lhsStr, err = fmtField(lhsField)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var pattern string
+	switch rhs := expr.Rhs.(type) {
+	case RegexExpr:
+		pattern = fmt.Sprintf("%v", rhs.Regex)
+	case PcreExpr:
+		pattern = fmt.Sprintf("%v", rhs.Pcre)
+	case ValueExpr:
+		strVal, ok := rhs.Value.(string)
+		if !ok {
+			return "", ErrorNotRepresentable
+		}
+		pattern = strVal
+	default:
+		return "", ErrorNotRepresentable
+	}
+
+	return fmt.Sprintf("%s(%s, %s)", FuncRegexp, lhsStr, strconv.Quote(pattern)), nil
+}
+
+// fmtLoopVarName picks a name for a loop variable which does not clash with
+// any top level field the loop body refers to
+func fmtLoopVarName(body Expression) string {
+	return fmtFreeName("v", body, nil)
+}
+
+func fmtAnyWithin(expr AnyWithinExpr) (string, error) {
+	inField, ok := expr.InExpr.(FieldExpr)
+	if !ok {
+		return "", ErrorNotRepresentable
+	}
+
+	rangeStr := OperatorDoc
+	if inField.Root != 0 || len(inField.Path) > 0 {
+		var err error
+		rangeStr, err = fmtField(inField)
+		if err != nil {
+			return "", err
+		}
+		if strings.EqualFold(rangeStr, OperatorDoc) {
+			rangeStr = "`" + rangeStr + "`"
+		}
+	}
+
+	// Variables are written as the first element of a path, which is how
+	// the parser binds them again
+	name := fmtLoopVarName(expr.SubExpr)
+	body := rewriteExpr(expr.SubExpr, func(subExpr Expression) Expression {
+		if field, ok := subExpr.(FieldExpr); ok && field.Root == expr.VarId {
+			return FieldExpr{0, append([]string{name}, field.Path...)}
+		}
+		return subExpr
+	})
+
+	bodyStr, err := FormatExpression(body)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s %s %s %s %s", OperatorAny, name, OperatorWithin, rangeStr,
+		OperatorSatisfies, bodyStr, OperatorEnd), nil
+}
+
+func fmtFirst(expr FirstInExpr) (string, error) {
+	inField, ok := expr.InExpr.(FieldExpr)
+	if !ok {
+		return "", ErrorNotRepresentable
+	}
+	inStr, err := fmtField(inField)
+	if err != nil {
+		return "", err
+	}
+
+	body := AndExpr{expr.ResultExpr}
+	if expr.SubExpr != nil {
+		body = append(body, expr.SubExpr)
+	}
+	name := fmtLoopVarName(body)
+	bindName := func(subExpr Expression) Expression {
+		if field, ok := subExpr.(FieldExpr); ok && field.Root == expr.VarId {
+			return FieldExpr{0, append([]string{name}, field.Path...)}
+		}
+		return subExpr
+	}
+
+	resultField, ok := rewriteExpr(expr.ResultExpr, bindName).(FieldExpr)
+	if !ok {
+		return "", ErrorNotRepresentable
+	}
+	resultStr, err := fmtField(resultField)
+	if err != nil {
+		return "", err
+	}
+
+	out := fmt.Sprintf("%s %s %s %s %s %s", OperatorFirst, resultStr, OperatorFor, name, OperatorIn, inStr)
+	if expr.SubExpr != nil {
+		whenStr, err := FormatExpression(rewriteExpr(expr.SubExpr, bindName))
+		if err != nil {
+			return "", err
+		}
+		out += fmt.Sprintf(" %s %s", OperatorWhen, whenStr)
+	}
+	return out + " " + OperatorEnd, nil
+}
+
+func fmtCondition(expr Expression) (string, error) {
+	switch expr := expr.(type) {
+	case TrueExpr:
+		return OperatorTrue, nil
+	case FalseExpr:
+		return OperatorFalse, nil
+	case NotExpr:
+		if eqExpr, ok := expr.SubExpr.(EqualsExpr); ok {
+			if rhsVal, ok := eqExpr.Rhs.(ValueExpr); ok && rhsVal.Value == nil {
+				lhsStr, err := fmtOperand(eqExpr.Lhs, fmtPosLhs)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%s %s", lhsStr, OperatorNotNull), nil
+			}
+		}
+		if existsExpr, ok := expr.SubExpr.(ExistsExpr); ok {
+			return fmtCondition(NotExistsExpr{existsExpr.SubExpr})
+		}
+		subStr, err := fmtCondition(expr.SubExpr)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s", OperatorNot, subStr), nil
+	case ExistsExpr:
+		if first, ok := expr.SubExpr.(FirstInExpr); ok {
+			firstStr, err := fmtFirst(first)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s %s", firstStr, OperatorNotMissing), nil
+		}
+		if fn, ok := expr.SubExpr.(FuncExpr); ok {
+			fnStr, err := fmtFunc(fn)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s %s", fnStr, OperatorNotMissing), nil
+		}
+		field, ok := expr.SubExpr.(FieldExpr)
+		if !ok {
+			return "", ErrorNotRepresentable
+		}
+		fieldStr, err := fmtField(field)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s(%s)", OperatorExists, fieldStr), nil
+	case NotExistsExpr:
+		lhsStr, err := fmtOperand(expr.SubExpr, fmtPosLhs)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s", lhsStr, OperatorMissing), nil
+	case EqualsExpr:
+		if str, word, ok := tokenMatchOf(expr); ok {
+			return fmtArrayContains(FuncExpr{FuncTokens, []Expression{str}}, word)
+		}
+		return fmtComparison(OperatorEquals, OperatorEquals, expr.Lhs, expr.Rhs)
+	case StrictEqualsExpr:
+		return fmtComparison(OperatorEquals2, OperatorEquals2, expr.Lhs, expr.Rhs)
+	case NotEqualsExpr:
+		return fmtComparison(OperatorNotEquals2, OperatorNotEquals2, expr.Lhs, expr.Rhs)
+	case LessThanExpr:
+		return fmtComparison(OperatorLessThan, OperatorGreaterThan, expr.Lhs, expr.Rhs)
+	case LessEqualsExpr:
+		return fmtComparison(OperatorLessThanEq, OperatorGreaterThanEq, expr.Lhs, expr.Rhs)
+	case GreaterThanExpr:
+		return fmtComparison(OperatorGreaterThan, OperatorLessThan, expr.Lhs, expr.Rhs)
+	case GreaterEqualsExpr:
+		return fmtComparison(OperatorGreaterThanEq, OperatorLessThanEq, expr.Lhs, expr.Rhs)
+	case LikeExpr:
+		return fmtRegexContains(expr)
+	case AnyWithinExpr:
+		return fmtAnyWithin(expr)
+	case AnyInExpr:
+		if array, value, ok := arrayContainsOf(expr); ok {
+			return fmtArrayContains(array, value)
+		}
+	}
+
+	return "", ErrorNotRepresentable
+}
+
+// fmtGroup outputs a group of conditions once it has been through fmtGroups
+func fmtGroup(expr Expression) (string, error) {
+	var subExprs []Expression
+	var opStr string
+	switch expr := expr.(type) {
+	case AndExpr:
+		subExprs, opStr = expr, OperatorAnd
+	case OrExpr:
+		subExprs, opStr = expr, OperatorOr
+	default:
+		return fmtCondition(expr)
+	}
+
+	subStrs := make([]string, len(subExprs))
+	for i, subExpr := range subExprs {
+		subStr, err := fmtGroup(subExpr)
+		if err != nil {
+			return "", err
+		}
+		switch subExpr.(type) {
+		case AndExpr, OrExpr:
+			subStr = "(" + subStr + ")"
+		}
+		subStrs[i] = subStr
+	}
+	return strings.Join(subStrs, " "+opStr+" "), nil
+}
+
+// fmtFreeName picks a name with the given prefix which is not the first
+// element of any top level field of the expression
+func fmtFreeName(prefix string, expr Expression, taken map[string]bool) string {
+	used := make(map[string]bool)
+	rewriteExpr(expr, func(expr Expression) Expression {
+		if field, ok := expr.(FieldExpr); ok && field.Root == 0 && len(field.Path) > 0 {
+			used[field.Path[0]] = true
+		}
+		return expr
+	})
+
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("%s%d", prefix, i)
+		if !used[name] && !taken[name] {
+			return name
+		}
+	}
+}
+
+// fmtLetTerm outputs an operand of arithmetic within a LET binding
+func fmtLetTerm(expr Expression) (string, error) {
+	switch expr := expr.(type) {
+	case FieldExpr:
+		return fmtField(expr)
+	case ValueExpr:
+		if numStr, ok := fmtNumber(expr.Value); ok {
+			return numStr, nil
+		}
+	case FuncExpr:
+		out, err := fmtFunc(expr)
+		if _, ok := fmtMathOps[expr.FuncName]; ok && err == nil {
+			// A field followed by arithmetic would take in the operator
+			// after it
+			out = "(" + out + ")"
+		}
+		return out, err
+	}
+	return "", ErrorNotRepresentable
+}
+
+// fmtLetValue outputs the value of a LET binding, which is arithmetic on
+// any two operands
+func fmtLetValue(expr FuncExpr) (string, error) {
+	opStr, ok := fmtMathOps[expr.FuncName]
+	if !ok || len(expr.Params) != 2 {
+		return "", ErrorNotRepresentable
+	}
+	lhsStr, err := fmtLetTerm(expr.Params[0])
+	if err != nil {
+		return "", err
+	}
+	rhsStr, err := fmtLetTerm(expr.Params[1])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s", lhsStr, opStr, rhsStr), nil
+}
+
+// fmtLets moves the arithmetic which can only be written in a LET binding
+// into one, leaving a field naming the binding in its place.  Arithmetic
+// over loop variables is left to the loop, which formats its body with
+// bindings of its own.
+func fmtLets(expr Expression) (Expression, []string) {
+	names := make(map[string]string)
+	taken := make(map[string]bool)
+	var lets []string
+	out := rewriteExpr(expr, func(subExpr Expression) Expression {
+		fn, ok := subExpr.(FuncExpr)
+		if !ok || exprMaxVarID(fn) != 0 {
+			return subExpr
+		}
+		if _, err := fmtFunc(fn); err == nil {
+			return subExpr
+		}
+
+		key := fn.String()
+		if name, ok := names[key]; ok {
+			return FieldExpr{0, []string{name}}
+		}
+		valueStr, err := fmtLetValue(fn)
+		if err != nil {
+			return subExpr
+		}
+		name := fmtFreeName("t", expr, taken)
+		taken[name] = true
+		names[key] = name
+		lets = append(lets, fmt.Sprintf("%s = %s", name, valueStr))
+		return FieldExpr{0, []string{name}}
+	})
+	return out, lets
+}
+
+// FormatExpression outputs a filter expression string which parses back
+// into an expression equivalent to the one passed in.  Expressions which
+// the filter expression grammar has no way of expressing (such as loops
+// other than ANY ... WITHIN and FIRST)
+// return ErrorNotRepresentable.
+func FormatExpression(expr Expression) (string, error) {
+	expr, lets := fmtLets(expr)
+	out, err := fmtExpression(expr)
+	if err != nil || len(lets) == 0 {
+		return out, err
+	}
+	return fmt.Sprintf("%s %s %s %s", OperatorLet, strings.Join(lets, ", "), OperatorWhere, out), nil
+}
+
+func fmtExpression(expr Expression) (string, error) {
+	expr, err := fmtGroups(expr)
+	if err != nil {
+		return "", err
+	}
+	return fmtGroup(expr)
+}
+
+// FormatFilterExpression parses a filter expression and re-emits it in a
+// normalized form, with consistent spacing, keyword casing and operator
+// spelling, and with parenthesis around every mixed AND/OR group.
+func FormatFilterExpression(expression string) (string, error) {
+	expr, err := ParseFilterExpression(expression)
+	if err != nil {
+		return "", err
+	}
+
+	return FormatExpression(expr)
+}
+
+// FormatExpressionMinified outputs an expression in the same way as
+// FormatExpression, but leaves out every space which is not needed to keep
+// two tokens apart, for storing filters compactly.
+func FormatExpressionMinified(expr Expression) (string, error) {
+	formatted, err := FormatExpression(expr)
+	if err != nil {
+		return "", err
+	}
+
+	return fmtMinify(formatted)
+}
+
+// MinifyFilterExpression parses a filter expression and re-emits it in the
+// minified form of FormatExpressionMinified.
+func MinifyFilterExpression(expression string) (string, error) {
+	expr, err := ParseFilterExpression(expression)
+	if err != nil {
+		return "", err
+	}
+
+	return FormatExpressionMinified(expr)
+}
+
+// fmtMinify joins the tokens of a formatted expression back together, with
+// a space only between words and numbers, and between tokens which would
+// otherwise scan differently, such as two `*` which would become a `**`
+func fmtMinify(formatted string) (string, error) {
+	tokens, err := lexFilterExpression(formatted)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	var prev string
+	for i, token := range tokens {
+		end := len(formatted)
+		if i+1 < len(tokens) {
+			end = tokens[i+1].pos.Offset
+		}
+		text := strings.TrimRightFunc(formatted[token.pos.Offset:end], unicode.IsSpace)
+
+		spaced := i > 0 && token.pos.Offset > tokens[i-1].pos.Offset+len(prev)
+		if spaced && (fmtIsWordEnd(prev, text) || fmtTokensMerge(prev, text) || prev == "*" && text == "*") {
+			out.WriteByte(' ')
+		}
+		out.WriteString(text)
+		prev = text
+	}
+	return out.String(), nil
+}
+
+// fmtIsWordEnd returns whether two tokens are both words or numbers where
+// they meet, which are kept apart even where they would scan correctly, as
+// in `1 AND`
+func fmtIsWordEnd(first, second string) bool {
+	isWord := func(r rune) bool {
+		return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+	last, _ := utf8.DecodeLastRuneInString(first)
+	next, _ := utf8.DecodeRuneInString(second)
+	return isWord(last) && isWord(next)
+}
+
+// fmtTokensMerge returns whether two tokens written next to each other would
+// not scan back as the same two tokens
+func fmtTokensMerge(first, second string) bool {
+	tokens, err := lexFilterExpression(first + second)
+	return err != nil || len(tokens) != 2 || tokens[1].pos.Offset != len(first)
+}
+
+// ReparseExpression formats an expression and parses the output again,
+// returning ErrorReparseMismatch if the two are not equivalent.
+func ReparseExpression(expr Expression) (Expression, error) {
+	formatted, err := FormatExpression(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	reparsed, err := ParseFilterExpression(formatted)
+	if err != nil {
+		return nil, err
+	}
+
+	reformatted, err := FormatExpression(reparsed)
+	if err != nil {
+		return nil, err
+	}
+	if reformatted != formatted {
+		return nil, ErrorReparseMismatch
+	}
+	return reparsed, nil
+}
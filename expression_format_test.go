@@ -0,0 +1,166 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFormatFilterExpression(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]string{
+		"a==1":                                 "a = 1",
+		"a <> \"x\"  AND   b>=2.5":             "a != \"x\" AND b >= 2.5",
+		"a = 1 OR b = 2 AND c = 3":             "a = 1 OR (b = 2 AND c = 3)",
+		"(a = 1 OR b = 2) AND c = 3":           "(a = 1 OR b = 2) AND c = 3",
+		"`field with spaces`.b[1] IS NOT NULL": "`field with spaces`.b[1] IS NOT NULL",
+		"NOT EXISTS(a) AND b IS MISSING":       "a IS MISSING AND b IS MISSING",
+		"ABS( a ) > 2 AND -b + 5 < 10":         "ABS(a) > 2 AND -b + 5 < 10",
+		"REGEXP_CONTAINS(name, \"^abc\")":      "REGEXP_CONTAINS(name, \"^abc\")",
+		"META().xattrs.x = TRUE":               "META().xattrs.x = TRUE",
+		"`AND` = 1 AND POW(a, 2) = 4":          "`AND` = 1 AND POW(a, 2) = 4",
+		"TRUE AND (TRUE OR FALSE) AND FALSE":   "TRUE AND (TRUE OR FALSE) AND FALSE",
+		"DATE(`dateString`) >= DATE(\"2019\")": "DATE(dateString) >= DATE(\"2019\")",
+		"5 < a":                                "5 < a",
+		"MOD(a, 2) = 1 AND MOD(a, b) = 0":      "a % 2 = 1 AND MOD(a, b) = 0",
+
+		"ANY x WITHIN doc SATISFIES x IS NULL END":  "ANY v1 WITHIN doc SATISFIES v1 IS NULL END",
+		"ANY x WITHIN `doc` SATISFIES x.a = v1 END": "ANY v2 WITHIN `doc` SATISFIES v2.a = v1 END",
+		"a.**.b = 1": "a.b = 1 OR ANY v1 WITHIN a SATISFIES v1.b = 1 END",
+
+		"FIRST x.b FOR x IN a WHEN x.c = TRUE END = 1": "FIRST v1.b FOR v1 IN a WHEN v1.c = TRUE END = 1",
+		"FIRST x FOR x IN a END IS NOT MISSING":        "FIRST v1 FOR v1 IN a END IS NOT MISSING",
+
+		"LET t = a * b, u = t + 1 WHERE t > 3 AND u < 10":            "LET t1 = a * b WHERE t1 > 3 AND t1 + 1 < 10",
+		"LET x = a * 2 WHERE x > 3":                                  "a * 2 > 3",
+		"ANY x WITHIN a SATISFIES LET s = x.b * x.c WHERE s > 1 END": "ANY v1 WITHIN a SATISFIES LET t1 = v1.b * v1.c WHERE t1 > 1 END",
+	}
+
+	for input, expected := range tests {
+		output, err := FormatFilterExpression(input)
+		assert.Nil(err, input)
+		assert.Equal(expected, output, input)
+
+		// Formatting must be stable
+		reformatted, err := FormatFilterExpression(output)
+		assert.Nil(err, output)
+		assert.Equal(output, reformatted, output)
+	}
+}
+
+func TestFormatExpression(t *testing.T) {
+	assert := assert.New(t)
+
+	// NOT over a group is pushed inwards since the grammar cannot express it
+	output, err := FormatExpression(NotExpr{OrExpr{
+		EqualsExpr{FieldExpr{0, []string{"a"}}, ValueExpr{1}},
+		EqualsExpr{FieldExpr{0, []string{"b"}}, ValueExpr{nil}},
+	}})
+	assert.Nil(err)
+	assert.Equal("NOT a = 1 AND b IS NOT NULL", output)
+
+	// Nested groups are kept
+	output, err = FormatExpression(OrExpr{
+		EqualsExpr{FieldExpr{0, []string{"a"}}, ValueExpr{1}},
+		AndExpr{
+			EqualsExpr{FieldExpr{0, []string{"b"}}, ValueExpr{2}},
+			OrExpr{
+				EqualsExpr{FieldExpr{0, []string{"c"}}, ValueExpr{3}},
+				EqualsExpr{FieldExpr{0, []string{"d"}}, ValueExpr{4}},
+			},
+		},
+	})
+	assert.Nil(err)
+	assert.Equal("a = 1 OR (b = 2 AND (c = 3 OR d = 4))", output)
+
+	output, err = FormatExpression(EqualsExpr{ValueExpr{"x"}, FieldExpr{0, []string{"a"}}})
+	assert.Nil(err)
+	assert.Equal("a = \"x\"", output)
+
+	_, err = FormatExpression(AnyInExpr{1, FieldExpr{0, []string{"a"}}, TrueExpr{}})
+	assert.Equal(ErrorNotRepresentable, err)
+
+	_, err = FormatExpression(EqualsExpr{FieldExpr{0, []string{"a"}}, ValueExpr{-1}})
+	assert.Equal(ErrorNotRepresentable, err)
+}
+
+func TestFilterExpressionReparse(t *testing.T) {
+	assert := assert.New(t)
+
+	inputs := []string{
+		"a <> 'single quoted' OR b == \"with \\\"escape\\\"\"",
+		"(`a.b` = 1 OR c[2] >= 3.5) AND NOT d IS NULL",
+		"TRUE AND (x = 1 OR x = 2) AND REGEXP_CONTAINS(y, \"^[a-z]+\\\\d\")",
+		"ANY x WITHIN a SATISFIES ANY y WITHIN x.b SATISFIES y = x.c END END",
+		"FIRST x.b FOR x IN a WHEN x.c = d END < FIRST y FOR y IN e END",
+		"MOD(a, b) = 1 OR MOD(ABS(c), 3) = 0",
+		"LET t = 2 - a * (b + 1), t1 = c / d WHERE t = t1 AND (c = 1 OR t = 2)",
+	}
+
+	for _, input := range inputs {
+		_, fe, err := NewFilterExpressionParser(input)
+		assert.Nil(err, input)
+
+		reparsed, err := fe.Reparse()
+		assert.Nil(err, input)
+		assert.Equal(fe.String(), reparsed.String())
+
+		expr, err := fe.OutputExpression()
+		assert.Nil(err)
+		_, err = ReparseExpression(expr)
+		assert.Nil(err, input)
+	}
+
+	// Every expression of the hand parser corpus which can be lowered is
+	// reparsed into an equivalent one
+	for _, test := range handParserTestExpressions {
+		if len(test.raw) == 0 {
+			continue
+		}
+		_, fe, err := NewFilterExpressionParser(test.expression)
+		if err != nil {
+			continue
+		}
+
+		_, lowerErr := fe.OutputExpression()
+		reparsed, err := fe.Reparse()
+		if lowerErr != nil {
+			assert.NotNil(err, test.expression)
+			continue
+		}
+		if assert.Nil(err, test.expression) {
+			assert.Equal(fe.String(), reparsed.String(), test.expression)
+		}
+	}
+}
+
+func TestFormatExpressionMinified(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]string{
+		"a = 1 AND (b > 2 OR c IS MISSING)":  "a=1 AND(b>2 OR c IS MISSING)",
+		"ABS( a ) > 2 AND -b + 5 < 10":       "ABS(a)>2 AND-b+5<10",
+		"REGEXP_CONTAINS(name, \"^abc\")":    "REGEXP_CONTAINS(name,\"^abc\")",
+		"`field with spaces`.b[1] = [1, 2]":  "`field with spaces`.b[1]=[1,2]",
+		"a.**.b = 1":                         "a.b=1 OR ANY v1 WITHIN a SATISFIES v1.b=1 END",
+		"a = 1.5 AND b = \"x\"":              "a=1.5 AND b=\"x\"",
+		"a = 1\r\n\tAND\r\n\tb = 2":          "a=1 AND b=2",
+		"x * 2 = 4 AND y.z IS NOT NULL":      "x*2=4 AND y.z IS NOT NULL",
+		"FIRST x FOR x IN a END IS NOT NULL": "FIRST v1 FOR v1 IN a END IS NOT NULL",
+	}
+
+	for input, expected := range tests {
+		output, err := MinifyFilterExpression(input)
+		assert.Nil(err, input)
+		assert.Equal(expected, output, input)
+
+		// The minified form parses back into the same expression
+		formatted, err := FormatFilterExpression(input)
+		assert.Nil(err, input)
+		reformatted, err := FormatFilterExpression(output)
+		assert.Nil(err, output)
+		assert.Equal(formatted, reformatted, output)
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// ExpressionGeneratorOptions constrains the expressions an
+// ExpressionGenerator makes
+type ExpressionGeneratorOptions struct {
+	// The deepest nesting of AND, OR, NOT and loops, so that 0 gives only
+	// single comparisons
+	MaxDepth int
+	// The fields compared, written as dotted paths such as "a.b" or
+	// "a.[1]", which are a, b and c when there are none
+	Fields []string
+	// The functions applied to fields, by their names in FuncExpr such as
+	// MathFuncAbs, of which none are used when there are none
+	Functions []string
+	// Whether to generate ANY, EVERY and ANY AND EVERY loops over fields
+	Loops bool
+	// Whether to generate only expressions which FormatExpression can write
+	// as a filter expression, so that they can be parsed back.  Loops,
+	// negative numbers, NULL and operators between two fields are then left
+	// out.
+	Formattable bool
+}
+
+// generatorValueKind is the type of value a generated operand gives
+type generatorValueKind int
+
+const (
+	generatorNumber generatorValueKind = iota
+	generatorString
+	generatorDate
+)
+
+type generatorFunc struct {
+	params []generatorValueKind
+	result generatorValueKind
+}
+
+// generatorFuncs are the functions which can be generated, which are those
+// with a simple signature.  DATE is left out, as times can only be compared
+// with other times.
+var generatorFuncs = map[string]generatorFunc{
+	MathFuncAbs:       {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncAcos:      {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncAsin:      {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncAtan:      {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncCeil:      {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncCos:       {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncDegrees:   {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncExp:       {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncFloor:     {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncLog:       {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncLn:        {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncLog10:     {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncLog2:      {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncNeg:       {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncRadians:   {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncRound:     {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncRoundEven: {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncSin:       {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncSqrt:      {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncTan:       {[]generatorValueKind{generatorNumber}, generatorNumber},
+	MathFuncAtan2:     {[]generatorValueKind{generatorNumber, generatorNumber}, generatorNumber},
+	MathFuncPow:       {[]generatorValueKind{generatorNumber, generatorNumber}, generatorNumber},
+	MathFuncAdd:       {[]generatorValueKind{generatorNumber, generatorNumber}, generatorNumber},
+	MathFuncSub:       {[]generatorValueKind{generatorNumber, generatorNumber}, generatorNumber},
+	MathFuncMul:       {[]generatorValueKind{generatorNumber, generatorNumber}, generatorNumber},
+	MathFuncDiv:       {[]generatorValueKind{generatorNumber, generatorNumber}, generatorNumber},
+	MathFuncMod:       {[]generatorValueKind{generatorNumber, generatorNumber}, generatorNumber},
+	Base64EncFunc:     {[]generatorValueKind{generatorString}, generatorString},
+	Base64DecFunc:     {[]generatorValueKind{generatorString}, generatorString},
+	EncodeJsonFunc:    {[]generatorValueKind{generatorNumber}, generatorString},
+	DateWeekdayFunc:   {[]generatorValueKind{generatorDate}, generatorString},
+}
+
+var generatorStrings = []string{"", "a", "b", "hello", "aGVsbG8=", "2019-06-01T00:00:00Z", "Saturday"}
+
+// ExpressionGenerator makes random expressions for property testing, which
+// are the same for the same seed and options
+type ExpressionGenerator struct {
+	rand        *rand.Rand
+	maxDepth    int
+	fields      [][]string
+	funcs       []string
+	loops       bool
+	formattable bool
+	nextVarID   VariableID
+}
+
+// NewExpressionGenerator creates a generator of expressions seeded with
+// seed.  It fails if a field is empty, or a function is not one which can
+// be generated.
+func NewExpressionGenerator(seed int64, options ExpressionGeneratorOptions) (*ExpressionGenerator, error) {
+	g := &ExpressionGenerator{
+		rand:        rand.New(rand.NewSource(seed)),
+		maxDepth:    options.MaxDepth,
+		loops:       options.Loops && !options.Formattable,
+		formattable: options.Formattable,
+	}
+
+	fields := options.Fields
+	if len(fields) == 0 {
+		fields = []string{"a", "b", "c"}
+	}
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		for _, part := range path {
+			if part == "" {
+				return nil, ErrorGeneratorField
+			}
+		}
+		g.fields = append(g.fields, path)
+	}
+
+	for _, name := range options.Functions {
+		if _, ok := generatorFuncs[name]; !ok {
+			return nil, ErrorGeneratorFunc
+		}
+		g.funcs = append(g.funcs, name)
+	}
+	return g, nil
+}
+
+// Expression returns the next random expression
+func (g *ExpressionGenerator) Expression() Expression {
+	g.nextVarID = 1
+	return g.genBool(g.maxDepth, 0)
+}
+
+// genBool makes a condition nested at most depth deep, where loopVar is the
+// variable of the innermost loop it is within, or 0 outside of loops
+func (g *ExpressionGenerator) genBool(depth int, loopVar VariableID) Expression {
+	if depth <= 0 || g.rand.Intn(3) == 0 {
+		return g.genLeaf(loopVar)
+	}
+
+	choices := 3
+	if g.loops {
+		choices = 4
+	}
+	switch g.rand.Intn(choices) {
+	case 0:
+		return AndExpr(g.genBoolList(depth-1, loopVar))
+	case 1:
+		return OrExpr(g.genBoolList(depth-1, loopVar))
+	case 2:
+		return NotExpr{g.genBool(depth-1, loopVar)}
+	}
+
+	varID := g.nextVarID
+	g.nextVarID++
+	inExpr := g.genField(loopVar)
+	subExpr := g.genBool(depth-1, varID)
+	switch g.rand.Intn(3) {
+	case 0:
+		return AnyInExpr{varID, inExpr, subExpr}
+	case 1:
+		return EveryInExpr{varID, inExpr, subExpr}
+	}
+	return AnyEveryInExpr{varID, inExpr, subExpr}
+}
+
+func (g *ExpressionGenerator) genBoolList(depth int, loopVar VariableID) []Expression {
+	exprs := make([]Expression, 2+g.rand.Intn(2))
+	for i := range exprs {
+		exprs[i] = g.genBool(depth, loopVar)
+	}
+	return exprs
+}
+
+// genLeaf makes a single comparison, or a test of whether a field exists
+func (g *ExpressionGenerator) genLeaf(loopVar VariableID) Expression {
+	switch g.rand.Intn(8) {
+	case 0:
+		return ExistsExpr{g.genField(loopVar)}
+	case 1:
+		return NotExistsExpr{g.genField(loopVar)}
+	}
+
+	kind := generatorNumber
+	if g.rand.Intn(3) == 0 {
+		kind = generatorString
+	}
+	lhs := g.genOperand(kind, loopVar)
+
+	var rhs Expression
+	switch g.rand.Intn(4) {
+	case 0:
+		rhs = g.genOperand(kind, loopVar)
+	case 1:
+		rhs = ValueExpr{g.genAnyValue()}
+	default:
+		rhs = ValueExpr{g.genValue(kind)}
+	}
+
+	switch g.rand.Intn(6) {
+	case 0:
+		return EqualsExpr{lhs, rhs}
+	case 1:
+		return NotEqualsExpr{lhs, rhs}
+	case 2:
+		return LessThanExpr{lhs, rhs}
+	case 3:
+		return LessEqualsExpr{lhs, rhs}
+	case 4:
+		return GreaterThanExpr{lhs, rhs}
+	}
+	return GreaterEqualsExpr{lhs, rhs}
+}
+
+// genOperand makes a field, or a function of one which gives kind
+func (g *ExpressionGenerator) genOperand(kind generatorValueKind, loopVar VariableID) Expression {
+	var candidates []string
+	for _, name := range g.funcs {
+		if generatorFuncs[name].result == kind {
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) == 0 || g.rand.Intn(2) == 0 {
+		return g.genField(loopVar)
+	}
+
+	name := candidates[g.rand.Intn(len(candidates))]
+	fn := FuncExpr{FuncName: name}
+	// The grammar only has operators between a field and a number
+	_, isOp := fmtMathOps[name]
+	onlyValues := g.formattable && isOp
+	for i, param := range generatorFuncs[name].params {
+		if i == 0 || (!onlyValues && g.rand.Intn(2) == 0) {
+			fn.Params = append(fn.Params, g.genField(loopVar))
+		} else {
+			fn.Params = append(fn.Params, ValueExpr{g.genValue(param)})
+		}
+	}
+	return fn
+}
+
+// genField picks one of the fields.  Within loops the fields are those of
+// the element of the innermost loop, which may also be the element itself,
+// as the matcher reads each element in turn.
+func (g *ExpressionGenerator) genField(loopVar VariableID) FieldExpr {
+	if loopVar != 0 && g.rand.Intn(2) == 0 {
+		return FieldExpr{Root: loopVar}
+	}
+	path := g.fields[g.rand.Intn(len(g.fields))]
+	return FieldExpr{loopVar, append([]string{}, path...)}
+}
+
+func (g *ExpressionGenerator) genValue(kind generatorValueKind) interface{} {
+	switch kind {
+	case generatorNumber:
+		if g.rand.Intn(4) == 0 {
+			value := float64(g.rand.Intn(200)-100) / 8
+			if g.formattable {
+				return math.Abs(value)
+			}
+			return value
+		}
+		value := g.rand.Intn(21) - 10
+		if g.formattable && value < 0 {
+			return -value
+		}
+		return value
+	case generatorDate:
+		return "2019-06-01T00:00:00Z"
+	}
+	return generatorStrings[g.rand.Intn(len(generatorStrings))]
+}
+
+// genAnyValue makes a value of any type, to compare across types
+func (g *ExpressionGenerator) genAnyValue() interface{} {
+	switch g.rand.Intn(5) {
+	case 0:
+		if !g.formattable {
+			return nil
+		}
+	case 1:
+		return g.rand.Intn(2) == 0
+	case 2:
+		return g.genValue(generatorString)
+	}
+	return g.genValue(generatorNumber)
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// exprDepth returns how deeply conditions are nested in the expression
+func exprDepth(expr Expression) int {
+	maxDepth := func(exprs ...Expression) int {
+		depth := 0
+		for _, subExpr := range exprs {
+			if subDepth := exprDepth(subExpr); subDepth > depth {
+				depth = subDepth
+			}
+		}
+		return depth
+	}
+	switch expr := expr.(type) {
+	case AndExpr:
+		return 1 + maxDepth(expr...)
+	case OrExpr:
+		return 1 + maxDepth(expr...)
+	case NotExpr:
+		return 1 + maxDepth(expr.SubExpr)
+	case AnyInExpr:
+		return 1 + maxDepth(expr.SubExpr)
+	case EveryInExpr:
+		return 1 + maxDepth(expr.SubExpr)
+	case AnyEveryInExpr:
+		return 1 + maxDepth(expr.SubExpr)
+	}
+	return 0
+}
+
+func TestExpressionGenerator(t *testing.T) {
+	assert := assert.New(t)
+
+	options := ExpressionGeneratorOptions{
+		MaxDepth:  3,
+		Fields:    []string{"x", "y.z", "w.[1]"},
+		Functions: []string{MathFuncAbs, MathFuncAdd, Base64EncFunc, DateWeekdayFunc},
+		Loops:     true,
+	}
+	g1, err := NewExpressionGenerator(7, options)
+	assert.Nil(err)
+	g2, err := NewExpressionGenerator(7, options)
+	assert.Nil(err)
+
+	docs := [][]byte{
+		[]byte(`{}`),
+		[]byte(`{"x":-3,"y":{"z":"hello"},"w":[1,2.5,"a"]}`),
+		[]byte(`{"x":[1,{"x":2}],"y":{"z":[[3],"2019-06-01T00:00:00Z"]},"w":null}`),
+	}
+
+	usedLoops := false
+	for i := 0; i < 200; i++ {
+		expr := g1.Expression()
+		assert.Equal(expr, g2.Expression())
+		assert.True(exprDepth(expr) <= options.MaxDepth, expr.String())
+
+		rewriteExpr(expr, func(subExpr Expression) Expression {
+			switch subExpr := subExpr.(type) {
+			case FieldExpr:
+				if len(subExpr.Path) > 0 {
+					assert.Contains([]string{"x", "y.z", "w.[1]"}, strings.Join(subExpr.Path, "."))
+				}
+			case FuncExpr:
+				assert.Contains(options.Functions, subExpr.FuncName)
+			case AnyInExpr, EveryInExpr, AnyEveryInExpr:
+				usedLoops = true
+			}
+			return subExpr
+		})
+
+		var trans Transformer
+		matchDef, err := trans.TransformWithLimits([]Expression{CompactExpression(expr)}, TransformLimits{})
+		if !assert.Nil(err, expr.String()) {
+			continue
+		}
+		m := NewFastMatcher(matchDef)
+		for _, doc := range docs {
+			m.Reset()
+			_, err := m.Match(doc)
+			assert.Nil(err, "%s on %s", expr, doc)
+		}
+	}
+	assert.True(usedLoops)
+
+	g, err := NewExpressionGenerator(1, ExpressionGeneratorOptions{})
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		expr := g.Expression()
+		assert.Equal(0, exprDepth(expr))
+	}
+
+	_, err = NewExpressionGenerator(1, ExpressionGeneratorOptions{Functions: []string{DateFunc}})
+	assert.Equal(ErrorGeneratorFunc, err)
+	_, err = NewExpressionGenerator(1, ExpressionGeneratorOptions{Fields: []string{"a..b"}})
+	assert.Equal(ErrorGeneratorField, err)
+}
+
+func TestExpressionGeneratorFormattable(t *testing.T) {
+	assert := assert.New(t)
+
+	var funcs []string
+	for name := range generatorFuncs {
+		funcs = append(funcs, name)
+	}
+	sort.Strings(funcs)
+	g, err := NewExpressionGenerator(3, ExpressionGeneratorOptions{
+		MaxDepth:    3,
+		Fields:      []string{"x", "y.z", "w.[1]"},
+		Functions:   funcs,
+		Loops:       true,
+		Formattable: true,
+	})
+	assert.Nil(err)
+
+	docs := [][]byte{
+		[]byte(`{}`),
+		[]byte(`{"x":3,"y":{"z":"hello"},"w":[1,2.5,"a"]}`),
+		[]byte(`{"x":-2.5,"y":{"z":4},"w":[null,"aGVsbG8="]}`),
+	}
+
+	// Every expression is written and parsed back into one which matches
+	// the same documents
+	for i := 0; i < 500; i++ {
+		expr := g.Expression()
+		expression, err := FormatExpression(expr)
+		if !assert.Nil(err, expr.String()) {
+			continue
+		}
+		parsed, err := ParseFilterExpression(expression)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+
+		var trans, parsedTrans Transformer
+		m := NewFastMatcher(trans.Transform([]Expression{expr}))
+		parsedM := NewFastMatcher(parsedTrans.Transform([]Expression{parsed}))
+		for _, doc := range docs {
+			m.Reset()
+			matched, err := m.Match(doc)
+			assert.Nil(err, "%s on %s", expr, doc)
+			parsedM.Reset()
+			parsedMatched, err := parsedM.Match(doc)
+			assert.Nil(err, "%s on %s", expression, doc)
+			assert.Equal(matched, parsedMatched, "%s on %s", expression, doc)
+		}
+	}
+}
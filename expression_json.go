@@ -5,6 +5,7 @@ package gojsonsm
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 )
 
 // is this file for simple parser only/ not currently used?
@@ -114,6 +115,15 @@ func parseJsonEquals(data []interface{}) (Expression, error) {
 	return EqualsExpr{lhs, rhs}, nil
 }
 
+func parseJsonStrictEquals(data []interface{}) (Expression, error) {
+	lhs, rhs, err := parseJsonComparison(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return StrictEqualsExpr{lhs, rhs}, nil
+}
+
 func parseJsonNotEquals(data []interface{}) (Expression, error) {
 	lhs, rhs, err := parseJsonComparison(data)
 	if err != nil {
@@ -269,6 +279,46 @@ func parseJsonAnyEveryIn(data []interface{}) (Expression, error) {
 	return AnyEveryInExpr{varID, lhsExpr, subexprExpr}, nil
 }
 
+func parseJsonAnyWithin(data []interface{}) (Expression, error) {
+	varID, lhsExpr, subexprExpr, err := parseJsonLoop(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return AnyWithinExpr{varID, lhsExpr, subexprExpr}, nil
+}
+
+func parseJsonFirstIn(data []interface{}) (Expression, error) {
+	if len(data) != 4 && len(data) != 5 {
+		return nil, errors.New("invalid first expression format")
+	}
+
+	varId, ok := data[1].(float64)
+	if !ok {
+		return nil, errors.New("invalid first expression variable format")
+	}
+
+	var exprs []Expression
+	for i := 2; i < len(data); i++ {
+		exprData, ok := data[i].([]interface{})
+		if !ok {
+			return nil, errors.New("invalid first expression format")
+		}
+
+		expr, err := parseJsonSubexpr(exprData)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+
+	out := FirstInExpr{VarId: VariableID(varId), InExpr: exprs[0], ResultExpr: exprs[1]}
+	if len(exprs) > 2 {
+		out.SubExpr = exprs[2]
+	}
+	return out, nil
+}
+
 func parseJsonLike(data []interface{}) (Expression, error) {
 	lhs, rhs, err := parseJsonComparison(data)
 	if err != nil {
@@ -319,12 +369,18 @@ func parseJsonSubexpr(data []interface{}) (Expression, error) {
 		return parseJsonEveryIn(data)
 	case "anyeveryin":
 		return parseJsonAnyEveryIn(data)
+	case "anywithin":
+		return parseJsonAnyWithin(data)
+	case "first":
+		return parseJsonFirstIn(data)
 	case "exists":
 		return parseJsonExists(data)
 	case "notexists":
 		return parseJsonNotExists(data)
 	case "equals":
 		return parseJsonEquals(data)
+	case "strictequals":
+		return parseJsonStrictEquals(data)
 	case "notequals":
 		return parseJsonNotEquals(data)
 	case "lessthan":
@@ -354,3 +410,90 @@ func ParseJsonExpression(data []byte) (Expression, error) {
 	}
 	return parseJsonSubexpr(parsedData)
 }
+
+func regexJsonPattern(regex interface{}) interface{} {
+	if stringer, ok := regex.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return regex
+}
+
+func expressionJsonData(expr Expression) ([]interface{}, error) {
+	sub := func(head []interface{}, exprs ...Expression) ([]interface{}, error) {
+		for _, subexpr := range exprs {
+			data, err := expressionJsonData(subexpr)
+			if err != nil {
+				return nil, err
+			}
+			head = append(head, data)
+		}
+		return head, nil
+	}
+
+	switch expr := expr.(type) {
+	case ValueExpr:
+		return []interface{}{"value", expr.Value}, nil
+	case FieldExpr:
+		data := []interface{}{"field", expr.Root}
+		for _, elem := range expr.Path {
+			data = append(data, elem)
+		}
+		return data, nil
+	case FuncExpr:
+		return sub([]interface{}{"func", expr.FuncName}, expr.Params...)
+	case NotExpr:
+		return sub([]interface{}{"not"}, expr.SubExpr)
+	case OrExpr:
+		return sub([]interface{}{"or"}, expr...)
+	case AndExpr:
+		return sub([]interface{}{"and"}, expr...)
+	case AnyInExpr:
+		return sub([]interface{}{"anyin", expr.VarId}, expr.InExpr, expr.SubExpr)
+	case EveryInExpr:
+		return sub([]interface{}{"everyin", expr.VarId}, expr.InExpr, expr.SubExpr)
+	case AnyEveryInExpr:
+		return sub([]interface{}{"anyeveryin", expr.VarId}, expr.InExpr, expr.SubExpr)
+	case AnyWithinExpr:
+		return sub([]interface{}{"anywithin", expr.VarId}, expr.InExpr, expr.SubExpr)
+	case FirstInExpr:
+		if expr.SubExpr == nil {
+			return sub([]interface{}{"first", expr.VarId}, expr.InExpr, expr.ResultExpr)
+		}
+		return sub([]interface{}{"first", expr.VarId}, expr.InExpr, expr.ResultExpr, expr.SubExpr)
+	case ExistsExpr:
+		return sub([]interface{}{"exists"}, expr.SubExpr)
+	case NotExistsExpr:
+		return sub([]interface{}{"notexists"}, expr.SubExpr)
+	case EqualsExpr:
+		return sub([]interface{}{"equals"}, expr.Lhs, expr.Rhs)
+	case StrictEqualsExpr:
+		return sub([]interface{}{"strictequals"}, expr.Lhs, expr.Rhs)
+	case NotEqualsExpr:
+		return sub([]interface{}{"notequals"}, expr.Lhs, expr.Rhs)
+	case LessThanExpr:
+		return sub([]interface{}{"lessthan"}, expr.Lhs, expr.Rhs)
+	case LessEqualsExpr:
+		return sub([]interface{}{"lessequals"}, expr.Lhs, expr.Rhs)
+	case GreaterThanExpr:
+		return sub([]interface{}{"greaterthan"}, expr.Lhs, expr.Rhs)
+	case GreaterEqualsExpr:
+		return sub([]interface{}{"greaterequals"}, expr.Lhs, expr.Rhs)
+	case LikeExpr:
+		return sub([]interface{}{"like"}, expr.Lhs, expr.Rhs)
+	case RegexExpr:
+		return []interface{}{"regex", regexJsonPattern(expr.Regex)}, nil
+	case TimeExpr:
+		return []interface{}{"time", expr.Time}, nil
+	}
+	return nil, fmt.Errorf("%v: %T", ErrorExpressionJson, expr)
+}
+
+// ExpressionToJson writes an expression in the JSON form read by
+// ParseJsonExpression
+func ExpressionToJson(expr Expression) ([]byte, error) {
+	data, err := expressionJsonData(expr)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(data)
+}
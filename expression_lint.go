@@ -0,0 +1,587 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+type LintWarningType int
+
+const (
+	LintTautology LintWarningType = iota
+	LintContradiction
+	LintUnreachable
+	LintRedundant
+	LintAndOrPrecedence
+)
+
+func (value LintWarningType) String() string {
+	switch value {
+	case LintTautology:
+		return "tautology"
+	case LintContradiction:
+		return "contradiction"
+	case LintUnreachable:
+		return "unreachable"
+	case LintRedundant:
+		return "redundant"
+	case LintAndOrPrecedence:
+		return "and/or precedence"
+	}
+
+	return "??unknown??"
+}
+
+// LintWarning describes a single problem found by the linter.  Expr is
+// the sub-expression the warning refers to.
+type LintWarning struct {
+	Type    LintWarningType
+	Expr    Expression
+	Message string
+}
+
+func (warning LintWarning) String() string {
+	return fmt.Sprintf("%s: %s", warning.Type, warning.Message)
+}
+
+// lintResult is the statically known outcome of a sub-expression
+type lintResult int
+
+const (
+	lintUnknown lintResult = iota
+	lintAlwaysTrue
+	lintAlwaysFalse
+)
+
+type exprLinter struct {
+	warnings []LintWarning
+}
+
+func (l *exprLinter) warn(warnType LintWarningType, expr Expression, format string, args ...interface{}) {
+	l.warnings = append(l.warnings, LintWarning{
+		Type:    warnType,
+		Expr:    expr,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// unwrapSingle strips the single-element AND/OR wrappers that the filter
+// expression parser generates around every condition.
+func lintUnwrapSingle(expr Expression) Expression {
+	for {
+		switch typedExpr := expr.(type) {
+		case AndExpr:
+			if len(typedExpr) != 1 {
+				return expr
+			}
+			expr = typedExpr[0]
+		case OrExpr:
+			if len(typedExpr) != 1 {
+				return expr
+			}
+			expr = typedExpr[0]
+		default:
+			return expr
+		}
+	}
+}
+
+func lintExprKey(expr Expression) string {
+	return lintUnwrapSingle(expr).String()
+}
+
+// lintClauseKey identifies a clause when looking for repeats, telling apart
+// values such as 1 and "1" which String() outputs the same way
+func lintClauseKey(expr Expression) string {
+	return fmt.Sprintf("%#v", lintUnwrapSingle(expr))
+}
+
+func (l *exprLinter) lintOne(expr Expression) lintResult {
+	switch expr := expr.(type) {
+	case TrueExpr:
+		return lintAlwaysTrue
+	case FalseExpr:
+		return lintAlwaysFalse
+	case NotExpr:
+		switch l.lintOne(expr.SubExpr) {
+		case lintAlwaysTrue:
+			return lintAlwaysFalse
+		case lintAlwaysFalse:
+			return lintAlwaysTrue
+		}
+		return lintUnknown
+	case AndExpr:
+		return l.lintAnd(expr)
+	case OrExpr:
+		return l.lintOr(expr)
+	case AnyInExpr:
+		l.lintOne(expr.SubExpr)
+	case EveryInExpr:
+		l.lintOne(expr.SubExpr)
+	case AnyEveryInExpr:
+		l.lintOne(expr.SubExpr)
+	case AnyWithinExpr:
+		l.lintOne(expr.SubExpr)
+	case EqualsExpr:
+		return l.lintComparison(expr, expr.Lhs, expr.Rhs)
+	case StrictEqualsExpr:
+		return l.lintComparison(expr, expr.Lhs, expr.Rhs)
+	case NotEqualsExpr:
+		return l.lintComparison(expr, expr.Lhs, expr.Rhs)
+	case LessThanExpr:
+		return l.lintComparison(expr, expr.Lhs, expr.Rhs)
+	case LessEqualsExpr:
+		return l.lintComparison(expr, expr.Lhs, expr.Rhs)
+	case GreaterThanExpr:
+		return l.lintComparison(expr, expr.Lhs, expr.Rhs)
+	case GreaterEqualsExpr:
+		return l.lintComparison(expr, expr.Lhs, expr.Rhs)
+	}
+
+	return lintUnknown
+}
+
+// lintComparison catches comparisons between two constant values, which
+// can be fully evaluated without looking at any document.
+func (l *exprLinter) lintComparison(expr Expression, lhs, rhs Expression) lintResult {
+	lhsVal, lhsOk := lhs.(ValueExpr)
+	rhsVal, rhsOk := rhs.(ValueExpr)
+	if !lhsOk || !rhsOk {
+		return lintUnknown
+	}
+
+	cmp, ok := lintCompareValues(lhsVal.Value, rhsVal.Value)
+	if !ok {
+		return lintUnknown
+	}
+
+	var res bool
+	switch expr.(type) {
+	case EqualsExpr, StrictEqualsExpr:
+		res = cmp == 0
+	case NotEqualsExpr:
+		res = cmp != 0
+	case LessThanExpr:
+		res = cmp < 0
+	case LessEqualsExpr:
+		res = cmp <= 0
+	case GreaterThanExpr:
+		res = cmp > 0
+	case GreaterEqualsExpr:
+		res = cmp >= 0
+	default:
+		return lintUnknown
+	}
+
+	if res {
+		l.warn(LintTautology, expr, "comparison `%s` between constants is always true", expr)
+		return lintAlwaysTrue
+	}
+	l.warn(LintContradiction, expr, "comparison `%s` between constants is always false", expr)
+	return lintAlwaysFalse
+}
+
+func (l *exprLinter) lintAnd(expr AndExpr) lintResult {
+	result := lintAlwaysTrue
+	seen := make(map[string]bool)
+	var clauses []Expression
+
+	for i, subExpr := range expr {
+		subRes := l.lintOne(subExpr)
+
+		key := lintExprKey(subExpr)
+		if seen[lintClauseKey(subExpr)] {
+			l.warn(LintRedundant, subExpr, "clause `%s` is repeated within the same AND", key)
+		}
+		seen[lintClauseKey(subExpr)] = true
+
+		if subRes == lintAlwaysFalse {
+			if result != lintAlwaysFalse {
+				l.warn(LintContradiction, expr, "AND containing an always-false clause `%s` can never match", key)
+				for _, unreachable := range expr[i+1:] {
+					l.warn(LintUnreachable, unreachable, "clause `%s` is never evaluated after an always-false AND clause",
+						lintExprKey(unreachable))
+				}
+			}
+			result = lintAlwaysFalse
+			break
+		} else if subRes == lintUnknown {
+			result = lintUnknown
+		}
+
+		clauses = append(clauses, lintUnwrapSingle(subExpr))
+	}
+
+	if result != lintUnknown {
+		return result
+	}
+
+	// A clause and its negation can never be true at the same time
+	for _, clause := range clauses {
+		if notExpr, ok := clause.(NotExpr); ok && seen[lintClauseKey(notExpr.SubExpr)] {
+			l.warn(LintContradiction, expr, "AND requires both `%s` and its negation", lintExprKey(notExpr.SubExpr))
+			return lintAlwaysFalse
+		}
+	}
+
+	if l.lintRanges(expr, clauses) {
+		return lintAlwaysFalse
+	}
+
+	return lintUnknown
+}
+
+func (l *exprLinter) lintOr(expr OrExpr) lintResult {
+	result := lintAlwaysFalse
+	seen := make(map[string]bool)
+	var clauses []Expression
+
+	for i, subExpr := range expr {
+		subRes := l.lintOne(subExpr)
+
+		key := lintExprKey(subExpr)
+		if seen[lintClauseKey(subExpr)] {
+			l.warn(LintRedundant, subExpr, "clause `%s` is repeated within the same OR", key)
+		}
+		seen[lintClauseKey(subExpr)] = true
+
+		if subRes == lintAlwaysTrue {
+			if result != lintAlwaysTrue {
+				l.warn(LintTautology, expr, "OR containing an always-true clause `%s` always matches", key)
+				for _, unreachable := range expr[i+1:] {
+					l.warn(LintUnreachable, unreachable, "clause `%s` is never evaluated after an always-true OR clause",
+						lintExprKey(unreachable))
+				}
+			}
+			result = lintAlwaysTrue
+			break
+		} else if subRes == lintUnknown {
+			result = lintUnknown
+		}
+
+		clauses = append(clauses, lintUnwrapSingle(subExpr))
+	}
+
+	if result != lintUnknown {
+		return result
+	}
+
+	// Either a clause or its negation is always true.  Note that this holds
+	// for missing fields as well since the negation of a false comparison
+	// against a missing field is true.
+	for _, clause := range clauses {
+		if notExpr, ok := clause.(NotExpr); ok && seen[lintClauseKey(notExpr.SubExpr)] {
+			l.warn(LintTautology, expr, "OR accepts both `%s` and its negation", lintExprKey(notExpr.SubExpr))
+			return lintAlwaysTrue
+		}
+	}
+
+	return lintUnknown
+}
+
+// lintBound is one side of the range of values a field is allowed to take
+type lintBound struct {
+	set       bool
+	value     interface{}
+	inclusive bool
+	source    Expression
+}
+
+type lintFieldRange struct {
+	lower     lintBound
+	upper     lintBound
+	equals    lintBound
+	notEquals []lintBound
+}
+
+// lintRanges builds up the set of values each field may take across the
+// clauses of an AND, and reports any field whose range ends up empty.
+func (l *exprLinter) lintRanges(expr AndExpr, clauses []Expression) bool {
+	ranges := make(map[string]*lintFieldRange)
+	var fieldOrder []string
+
+	for _, clause := range clauses {
+		field, value, op, ok := lintSplitComparison(clause)
+		if !ok {
+			continue
+		}
+
+		fieldKey := field.String()
+		fieldRange := ranges[fieldKey]
+		if fieldRange == nil {
+			fieldRange = &lintFieldRange{}
+			ranges[fieldKey] = fieldRange
+			fieldOrder = append(fieldOrder, fieldKey)
+		}
+
+		bound := lintBound{true, value, false, clause}
+		switch op.(type) {
+		case EqualsExpr:
+			bound.inclusive = true
+			if fieldRange.equals.set {
+				if cmp, ok := lintCompareValues(fieldRange.equals.value, value); ok && cmp != 0 {
+					l.warn(LintContradiction, expr, "`%s` cannot equal both %s and %s", fieldKey,
+						lintValueString(fieldRange.equals.value), lintValueString(value))
+					return true
+				}
+			}
+			fieldRange.equals = bound
+		case NotEqualsExpr:
+			fieldRange.notEquals = append(fieldRange.notEquals, bound)
+		case LessThanExpr:
+			fieldRange.upper = lintTighterBound(fieldRange.upper, bound, -1)
+		case LessEqualsExpr:
+			bound.inclusive = true
+			fieldRange.upper = lintTighterBound(fieldRange.upper, bound, -1)
+		case GreaterThanExpr:
+			fieldRange.lower = lintTighterBound(fieldRange.lower, bound, 1)
+		case GreaterEqualsExpr:
+			bound.inclusive = true
+			fieldRange.lower = lintTighterBound(fieldRange.lower, bound, 1)
+		}
+	}
+
+	for _, fieldKey := range fieldOrder {
+		fieldRange := ranges[fieldKey]
+
+		if fieldRange.lower.set && fieldRange.upper.set {
+			if cmp, ok := lintCompareValues(fieldRange.lower.value, fieldRange.upper.value); ok {
+				if cmp > 0 || (cmp == 0 && !(fieldRange.lower.inclusive && fieldRange.upper.inclusive)) {
+					l.warn(LintContradiction, expr, "no value of `%s` satisfies both `%s` and `%s`", fieldKey,
+						lintExprKey(fieldRange.lower.source), lintExprKey(fieldRange.upper.source))
+					return true
+				}
+			}
+		}
+
+		if !fieldRange.equals.set {
+			continue
+		}
+
+		for boundIdx, bound := range []lintBound{fieldRange.lower, fieldRange.upper} {
+			if !bound.set {
+				continue
+			}
+			if !lintValueWithinBound(fieldRange.equals.value, bound, boundIdx == 0) {
+				l.warn(LintContradiction, expr, "no value of `%s` satisfies both `%s` and `%s`", fieldKey,
+					lintExprKey(fieldRange.equals.source), lintExprKey(bound.source))
+				return true
+			}
+		}
+
+		for _, bound := range fieldRange.notEquals {
+			if cmp, ok := lintCompareValues(fieldRange.equals.value, bound.value); ok && cmp == 0 {
+				l.warn(LintContradiction, expr, "no value of `%s` satisfies both `%s` and `%s`", fieldKey,
+					lintExprKey(fieldRange.equals.source), lintExprKey(bound.source))
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// lintTighterBound returns whichever of the two bounds is more restrictive.
+// direction is 1 for lower bounds and -1 for upper bounds.
+func lintTighterBound(current, candidate lintBound, direction int) lintBound {
+	if !current.set {
+		return candidate
+	}
+
+	cmp, ok := lintCompareValues(candidate.value, current.value)
+	if !ok {
+		return current
+	}
+
+	if cmp*direction > 0 || (cmp == 0 && !candidate.inclusive) {
+		return candidate
+	}
+	return current
+}
+
+func lintValueWithinBound(value interface{}, bound lintBound, isLower bool) bool {
+	cmp, ok := lintCompareValues(value, bound.value)
+	if !ok {
+		// Values of different types may still be compared by the matcher,
+		// such as when numeric strings are coerced
+		return true
+	}
+
+	if cmp == 0 {
+		return bound.inclusive
+	}
+	if isLower {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// lintSplitComparison normalizes a `field op value` or `value op field`
+// comparison so that the field always comes first.
+func lintSplitComparison(expr Expression) (FieldExpr, interface{}, Expression, bool) {
+	var lhs, rhs Expression
+	var flipped Expression
+
+	switch expr := expr.(type) {
+	case EqualsExpr:
+		lhs, rhs, flipped = expr.Lhs, expr.Rhs, EqualsExpr{}
+	case NotEqualsExpr:
+		lhs, rhs, flipped = expr.Lhs, expr.Rhs, NotEqualsExpr{}
+	case LessThanExpr:
+		lhs, rhs, flipped = expr.Lhs, expr.Rhs, GreaterThanExpr{}
+	case LessEqualsExpr:
+		lhs, rhs, flipped = expr.Lhs, expr.Rhs, GreaterEqualsExpr{}
+	case GreaterThanExpr:
+		lhs, rhs, flipped = expr.Lhs, expr.Rhs, LessThanExpr{}
+	case GreaterEqualsExpr:
+		lhs, rhs, flipped = expr.Lhs, expr.Rhs, LessEqualsExpr{}
+	default:
+		return FieldExpr{}, nil, nil, false
+	}
+
+	if field, ok := lhs.(FieldExpr); ok {
+		if value, ok := rhs.(ValueExpr); ok {
+			return field, value.Value, expr, true
+		}
+	}
+	if field, ok := rhs.(FieldExpr); ok {
+		if value, ok := lhs.(ValueExpr); ok {
+			return field, value.Value, flipped, true
+		}
+	}
+
+	return FieldExpr{}, nil, nil, false
+}
+
+func lintValueToInt(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int:
+		return int64(value), true
+	case int64:
+		return value, true
+	case uint64:
+		if value <= math.MaxInt64 {
+			return int64(value), true
+		}
+	}
+	return 0, false
+}
+
+func lintValueToFloat(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case float32:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
+
+// lintCompareValues compares two constant values, returning false when the
+// values are of types that cannot be meaningfully ordered against each other.
+func lintCompareValues(lhs, rhs interface{}) (int, bool) {
+	// Integers are compared exactly, as large ones lose precision as floats
+	if lhsInt, ok := lintValueToInt(lhs); ok {
+		if rhsInt, ok := lintValueToInt(rhs); ok {
+			if lhsInt < rhsInt {
+				return -1, true
+			} else if lhsInt > rhsInt {
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	if lhsFloat, ok := lintValueToFloat(lhs); ok {
+		rhsFloat, ok := lintValueToFloat(rhs)
+		if !ok {
+			return 0, false
+		}
+		if lhsFloat < rhsFloat {
+			return -1, true
+		} else if lhsFloat > rhsFloat {
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch lhs := lhs.(type) {
+	case string:
+		if rhs, ok := rhs.(string); ok {
+			return strings.Compare(lhs, rhs), true
+		}
+	case bool:
+		if rhs, ok := rhs.(bool); ok {
+			if lhs == rhs {
+				return 0, true
+			} else if rhs {
+				return -1, true
+			}
+			return 1, true
+		}
+	case nil:
+		if rhs == nil {
+			return 0, true
+		}
+	}
+
+	return 0, false
+}
+
+func lintValueString(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return fmt.Sprintf("%q", str)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// LintExpression analyses an expression for clauses that are always true,
+// always false, can never be reached or are repeated.  The returned
+// warnings are informational; the expression is still valid to compile.
+func LintExpression(expr Expression) []LintWarning {
+	var linter exprLinter
+	switch linter.lintOne(expr) {
+	case lintAlwaysTrue:
+		linter.warn(LintTautology, expr, "expression always matches")
+	case lintAlwaysFalse:
+		linter.warn(LintContradiction, expr, "expression never matches")
+	}
+	return linter.warnings
+}
+
+// LintFilterExpression parses a filter expression string and lints the
+// result, also warning when AND and OR are used together without parenthesis
+// to show which of them binds first
+func LintFilterExpression(expression string) ([]LintWarning, error) {
+	_, fe, err := NewFilterExpressionParser(expression)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := fe.OutputExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	warnings := LintExpression(expr)
+	if fe.mixesAndOr() {
+		readAs, err := FormatExpression(expr)
+		if err != nil {
+			readAs = expression
+		}
+		warnings = append(warnings, LintWarning{
+			Type:    LintAndOrPrecedence,
+			Expr:    expr,
+			Message: fmt.Sprintf("AND and OR are used together without parenthesis, AND binds first so this is `%s`", readAs),
+		})
+	}
+	return warnings, nil
+}
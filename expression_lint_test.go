@@ -0,0 +1,112 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func lintWarningTypes(warnings []LintWarning) []LintWarningType {
+	var types []LintWarningType
+	for _, warning := range warnings {
+		types = append(types, warning.Type)
+	}
+	return types
+}
+
+func TestLintExpressionContradictions(t *testing.T) {
+	assert := assert.New(t)
+
+	warnings, err := LintFilterExpression("a > 5 AND a < 3")
+	assert.Nil(err)
+	assert.Contains(lintWarningTypes(warnings), LintContradiction)
+
+	warnings, err = LintFilterExpression("a >= 5 AND a <= 5")
+	assert.Nil(err)
+	assert.Equal(0, len(warnings))
+
+	warnings, err = LintFilterExpression("a > 5 AND a <= 5")
+	assert.Nil(err)
+	assert.Contains(lintWarningTypes(warnings), LintContradiction)
+
+	warnings, err = LintFilterExpression("a = \"x\" AND a = \"y\"")
+	assert.Nil(err)
+	assert.Contains(lintWarningTypes(warnings), LintContradiction)
+
+	warnings, err = LintFilterExpression("a = 4 AND a > 5")
+	assert.Nil(err)
+	assert.Contains(lintWarningTypes(warnings), LintContradiction)
+
+	warnings, err = LintFilterExpression("a = 4 AND b > 5")
+	assert.Nil(err)
+	assert.Equal(0, len(warnings))
+
+	warnings, err = LintFilterExpression("a = 4 AND NOT a = 4")
+	assert.Nil(err)
+	assert.Contains(lintWarningTypes(warnings), LintContradiction)
+
+	// Values of different types may still match the same document, such as
+	// when numeric strings are coerced
+	warnings, err = LintFilterExpression("a = 1 AND a = \"1\"")
+	assert.Nil(err)
+	assert.Equal(0, len(warnings))
+
+	warnings, err = LintFilterExpression("a = 1 AND a < \"2\"")
+	assert.Nil(err)
+	assert.Equal(0, len(warnings))
+
+	// Large integers are told apart even where their floats are equal
+	a := FieldExpr{0, []string{"a"}}
+	warnings = LintExpression(AndExpr{
+		EqualsExpr{a, ValueExpr{int64(1 << 53)}},
+		EqualsExpr{a, ValueExpr{int64(1<<53 + 1)}},
+	})
+	assert.Contains(lintWarningTypes(warnings), LintContradiction)
+
+	warnings = LintExpression(EqualsExpr{ValueExpr{int64(1 << 53)}, ValueExpr{int64(1<<53 + 1)}})
+	assert.Contains(lintWarningTypes(warnings), LintContradiction)
+}
+
+func TestLintExpressionTautologies(t *testing.T) {
+	assert := assert.New(t)
+
+	warnings, err := LintFilterExpression("TRUE OR x = 1")
+	assert.Nil(err)
+	types := lintWarningTypes(warnings)
+	assert.Contains(types, LintTautology)
+	assert.Contains(types, LintUnreachable)
+
+	warnings, err = LintFilterExpression("x = 1 OR NOT x = 1")
+	assert.Nil(err)
+	assert.Contains(lintWarningTypes(warnings), LintTautology)
+
+	warnings, err = LintFilterExpression("x = 1 OR x = 1")
+	assert.Nil(err)
+	assert.Contains(lintWarningTypes(warnings), LintRedundant)
+
+	warnings = LintExpression(EqualsExpr{ValueExpr{1}, ValueExpr{1.0}})
+	assert.Contains(lintWarningTypes(warnings), LintTautology)
+
+	warnings = LintExpression(AndExpr{
+		FalseExpr{},
+		EqualsExpr{FieldExpr{0, []string{"a"}}, ValueExpr{1}},
+	})
+	types = lintWarningTypes(warnings)
+	assert.Contains(types, LintContradiction)
+	assert.Contains(types, LintUnreachable)
+}
+
+func TestLintAndOrPrecedence(t *testing.T) {
+	assert := assert.New(t)
+
+	warnings, err := LintFilterExpression("a = 1 OR b = 2 AND c = 3")
+	assert.Nil(err)
+	if assert.Equal([]LintWarningType{LintAndOrPrecedence}, lintWarningTypes(warnings)) {
+		assert.Contains(warnings[0].Message, "`a = 1 OR (b = 2 AND c = 3)`")
+	}
+
+	warnings, err = LintFilterExpression("a = 1 OR (b = 2 AND c = 3)")
+	assert.Nil(err)
+	assert.Empty(warnings)
+}
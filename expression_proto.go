@@ -0,0 +1,902 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Field numbers and enum values below must match gojsonsm.proto
+
+const (
+	protoExprUnknown = iota
+	protoExprTrue
+	protoExprFalse
+	protoExprValue
+	protoExprTime
+	protoExprRegex
+	protoExprPcre
+	protoExprNot
+	protoExprAnd
+	protoExprOr
+	protoExprField
+	protoExprFunc
+	protoExprAnyIn
+	protoExprEveryIn
+	protoExprAnyEveryIn
+	protoExprExists
+	protoExprNotExists
+	protoExprEquals
+	protoExprNotEquals
+	protoExprLessThan
+	protoExprLessEquals
+	protoExprGreaterThan
+	protoExprGreaterEquals
+	protoExprLike
+	protoExprAnyWithin
+	protoExprFirstIn
+	protoExprStrictEquals
+)
+
+const (
+	protoDataRefNone = iota
+	protoDataRefActiveLiteral
+	protoDataRefSlot
+	protoDataRefFunc
+	protoDataRefValue
+)
+
+func encodeProtoValue(w *protoWriter, value interface{}) error {
+	switch value := value.(type) {
+	case nil:
+		w.tag(1, protoWireVarint)
+		w.buf = protoAppendUvarint(w.buf, 1)
+	case bool:
+		w.tag(2, protoWireVarint)
+		if value {
+			w.buf = protoAppendUvarint(w.buf, 1)
+		} else {
+			w.buf = protoAppendUvarint(w.buf, 0)
+		}
+	case int, int8, int16, int32, int64:
+		intVal := NewFastVal(value).GetInt()
+		w.tag(3, protoWireVarint)
+		w.buf = protoAppendUvarint(w.buf, uint64(intVal<<1)^uint64(intVal>>63))
+	case uint, uint8, uint16, uint32, uint64:
+		w.tag(4, protoWireVarint)
+		w.buf = protoAppendUvarint(w.buf, NewFastVal(value).GetUint())
+	case float32, float64:
+		w.tag(5, protoWireFixed64)
+		w.buf = protoAppendFixed64(w.buf, math.Float64bits(NewFastVal(value).GetFloat()))
+	case string:
+		w.tag(6, protoWireBytes)
+		w.buf = protoAppendUvarint(w.buf, uint64(len(value)))
+		w.buf = append(w.buf, value...)
+	case []byte:
+		w.tag(7, protoWireBytes)
+		w.buf = protoAppendUvarint(w.buf, uint64(len(value)))
+		w.buf = append(w.buf, value...)
+	case []interface{}:
+		return w.message(8, func(w *protoWriter) error {
+			for _, elem := range value {
+				err := w.message(1, func(w *protoWriter) error {
+					return encodeProtoValue(w, elem)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		return w.message(9, func(w *protoWriter) error {
+			for _, key := range keys {
+				elem := value[key]
+				err := w.message(1, func(w *protoWriter) error {
+					w.tag(1, protoWireBytes)
+					w.buf = protoAppendUvarint(w.buf, uint64(len(key)))
+					w.buf = append(w.buf, key...)
+					return w.message(2, func(w *protoWriter) error {
+						return encodeProtoValue(w, elem)
+					})
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	default:
+		return fmt.Errorf("%v: value of type %T", ErrorProtoUnsupported, value)
+	}
+	return nil
+}
+
+func decodeProtoValue(data []byte) (interface{}, error) {
+	var value interface{}
+	err := readProtoFields(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			value = nil
+		case 2:
+			value = f.value != 0
+		case 3:
+			value = int(f.sint())
+		case 4:
+			value = f.value
+		case 5:
+			value = f.double()
+		case 6:
+			value = string(f.data)
+		case 7:
+			value = append([]byte{}, f.data...)
+		case 8:
+			elems := []interface{}{}
+			err := readProtoFields(f.data, func(f protoField) error {
+				if f.num != 1 {
+					return nil
+				}
+				elem, err := decodeProtoValue(f.data)
+				elems = append(elems, elem)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			value = elems
+		case 9:
+			fields := map[string]interface{}{}
+			err := readProtoFields(f.data, func(f protoField) error {
+				if f.num != 1 {
+					return nil
+				}
+				var key string
+				var elem interface{}
+				err := readProtoFields(f.data, func(f protoField) error {
+					var err error
+					switch f.num {
+					case 1:
+						key = string(f.data)
+					case 2:
+						elem, err = decodeProtoValue(f.data)
+					}
+					return err
+				})
+				fields[key] = elem
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			value = fields
+		}
+		return nil
+	})
+	return value, err
+}
+
+func encodeProtoExpression(w *protoWriter, expr Expression) error {
+	var exprType int64
+	var operands []Expression
+	// Fields after the operands, kept separate so fields are written in order
+	var tail protoWriter
+
+	switch expr := expr.(type) {
+	case TrueExpr:
+		exprType = protoExprTrue
+	case FalseExpr:
+		exprType = protoExprFalse
+	case ValueExpr:
+		exprType = protoExprValue
+		err := tail.message(3, func(w *protoWriter) error {
+			return encodeProtoValue(w, expr.Value)
+		})
+		if err != nil {
+			return err
+		}
+	case TimeExpr:
+		exprType = protoExprTime
+		tail.string(4, fmt.Sprintf("%v", expr.Time))
+	case RegexExpr:
+		exprType = protoExprRegex
+		tail.string(4, fmt.Sprintf("%v", expr.Regex))
+	case PcreExpr:
+		exprType = protoExprPcre
+		tail.string(4, fmt.Sprintf("%v", expr.Pcre))
+	case NotExpr:
+		exprType = protoExprNot
+		operands = []Expression{expr.SubExpr}
+	case AndExpr:
+		exprType = protoExprAnd
+		operands = expr
+	case OrExpr:
+		exprType = protoExprOr
+		operands = expr
+	case FieldExpr:
+		exprType = protoExprField
+		tail.varint(5, int64(expr.Root))
+		for _, elem := range expr.Path {
+			// Empty path elements are valid, so always write them
+			tail.tag(6, protoWireBytes)
+			tail.buf = protoAppendUvarint(tail.buf, uint64(len(elem)))
+			tail.buf = append(tail.buf, elem...)
+		}
+	case FuncExpr:
+		exprType = protoExprFunc
+		tail.string(4, expr.FuncName)
+		operands = expr.Params
+	case AnyInExpr:
+		exprType = protoExprAnyIn
+		tail.varint(5, int64(expr.VarId))
+		operands = []Expression{expr.InExpr, expr.SubExpr}
+	case EveryInExpr:
+		exprType = protoExprEveryIn
+		tail.varint(5, int64(expr.VarId))
+		operands = []Expression{expr.InExpr, expr.SubExpr}
+	case AnyEveryInExpr:
+		exprType = protoExprAnyEveryIn
+		tail.varint(5, int64(expr.VarId))
+		operands = []Expression{expr.InExpr, expr.SubExpr}
+	case AnyWithinExpr:
+		exprType = protoExprAnyWithin
+		tail.varint(5, int64(expr.VarId))
+		operands = []Expression{expr.InExpr, expr.SubExpr}
+	case FirstInExpr:
+		exprType = protoExprFirstIn
+		tail.varint(5, int64(expr.VarId))
+		operands = []Expression{expr.InExpr, expr.ResultExpr}
+		if expr.SubExpr != nil {
+			operands = append(operands, expr.SubExpr)
+		}
+	case ExistsExpr:
+		exprType = protoExprExists
+		operands = []Expression{expr.SubExpr}
+	case NotExistsExpr:
+		exprType = protoExprNotExists
+		operands = []Expression{expr.SubExpr}
+	case EqualsExpr:
+		exprType = protoExprEquals
+		operands = []Expression{expr.Lhs, expr.Rhs}
+	case StrictEqualsExpr:
+		exprType = protoExprStrictEquals
+		operands = []Expression{expr.Lhs, expr.Rhs}
+	case NotEqualsExpr:
+		exprType = protoExprNotEquals
+		operands = []Expression{expr.Lhs, expr.Rhs}
+	case LessThanExpr:
+		exprType = protoExprLessThan
+		operands = []Expression{expr.Lhs, expr.Rhs}
+	case LessEqualsExpr:
+		exprType = protoExprLessEquals
+		operands = []Expression{expr.Lhs, expr.Rhs}
+	case GreaterThanExpr:
+		exprType = protoExprGreaterThan
+		operands = []Expression{expr.Lhs, expr.Rhs}
+	case GreaterEqualsExpr:
+		exprType = protoExprGreaterEquals
+		operands = []Expression{expr.Lhs, expr.Rhs}
+	case LikeExpr:
+		exprType = protoExprLike
+		operands = []Expression{expr.Lhs, expr.Rhs}
+	default:
+		return fmt.Errorf("%v: expression of type %T", ErrorProtoUnsupported, expr)
+	}
+
+	w.varint(1, exprType)
+	for _, operand := range operands {
+		err := w.message(2, func(w *protoWriter) error {
+			return encodeProtoExpression(w, operand)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.buf = append(w.buf, tail.buf...)
+	return nil
+}
+
+func decodeProtoExpression(data []byte) (Expression, error) {
+	var exprType int64
+	var operands []Expression
+	var value interface{}
+	var text string
+	var varID VariableID
+	var path []string
+
+	err := readProtoFields(data, func(f protoField) error {
+		var err error
+		switch f.num {
+		case 1:
+			exprType = f.int()
+		case 2:
+			var operand Expression
+			operand, err = decodeProtoExpression(f.data)
+			operands = append(operands, operand)
+		case 3:
+			value, err = decodeProtoValue(f.data)
+		case 4:
+			text = string(f.data)
+		case 5:
+			varID = VariableID(f.int())
+		case 6:
+			path = append(path, string(f.data))
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	numOperands := map[int64]int{
+		protoExprNot: 1, protoExprAnyIn: 2, protoExprEveryIn: 2, protoExprAnyEveryIn: 2,
+		protoExprExists: 1, protoExprNotExists: 1, protoExprEquals: 2, protoExprNotEquals: 2,
+		protoExprLessThan: 2, protoExprLessEquals: 2, protoExprGreaterThan: 2,
+		protoExprGreaterEquals: 2, protoExprLike: 2, protoExprAnyWithin: 2, protoExprStrictEquals: 2,
+	}
+	if expected, ok := numOperands[exprType]; ok && len(operands) != expected {
+		return nil, ErrorProtoMalformed
+	}
+
+	switch exprType {
+	case protoExprTrue:
+		return TrueExpr{}, nil
+	case protoExprFalse:
+		return FalseExpr{}, nil
+	case protoExprValue:
+		return ValueExpr{value}, nil
+	case protoExprTime:
+		return TimeExpr{text}, nil
+	case protoExprRegex:
+		return RegexExpr{text}, nil
+	case protoExprPcre:
+		return PcreExpr{text}, nil
+	case protoExprNot:
+		return NotExpr{operands[0]}, nil
+	case protoExprAnd:
+		return AndExpr(operands), nil
+	case protoExprOr:
+		return OrExpr(operands), nil
+	case protoExprField:
+		return FieldExpr{varID, path}, nil
+	case protoExprFunc:
+		return FuncExpr{text, operands}, nil
+	case protoExprAnyIn:
+		return AnyInExpr{varID, operands[0], operands[1]}, nil
+	case protoExprEveryIn:
+		return EveryInExpr{varID, operands[0], operands[1]}, nil
+	case protoExprAnyEveryIn:
+		return AnyEveryInExpr{varID, operands[0], operands[1]}, nil
+	case protoExprAnyWithin:
+		return AnyWithinExpr{varID, operands[0], operands[1]}, nil
+	case protoExprFirstIn:
+		if len(operands) == 2 {
+			return FirstInExpr{varID, operands[0], operands[1], nil}, nil
+		} else if len(operands) == 3 {
+			return FirstInExpr{varID, operands[0], operands[1], operands[2]}, nil
+		}
+		return nil, ErrorProtoMalformed
+	case protoExprExists:
+		return ExistsExpr{operands[0]}, nil
+	case protoExprNotExists:
+		return NotExistsExpr{operands[0]}, nil
+	case protoExprEquals:
+		return EqualsExpr{operands[0], operands[1]}, nil
+	case protoExprStrictEquals:
+		return StrictEqualsExpr{operands[0], operands[1]}, nil
+	case protoExprNotEquals:
+		return NotEqualsExpr{operands[0], operands[1]}, nil
+	case protoExprLessThan:
+		return LessThanExpr{operands[0], operands[1]}, nil
+	case protoExprLessEquals:
+		return LessEqualsExpr{operands[0], operands[1]}, nil
+	case protoExprGreaterThan:
+		return GreaterThanExpr{operands[0], operands[1]}, nil
+	case protoExprGreaterEquals:
+		return GreaterEqualsExpr{operands[0], operands[1]}, nil
+	case protoExprLike:
+		return LikeExpr{operands[0], operands[1]}, nil
+	}
+
+	return nil, fmt.Errorf("%v: unknown expression type %d", ErrorProtoMalformed, exprType)
+}
+
+func encodeProtoFastVal(w *protoWriter, val FastVal) error {
+	w.varint(1, int64(val.dataType))
+
+	switch val.dataType {
+	case IntValue:
+		w.svarint(2, val.GetInt())
+	case UintValue:
+		w.uvarint(3, val.GetUint())
+	case FloatValue:
+		w.double(4, val.GetFloat())
+	case JsonIntValue, JsonUintValue, JsonFloatValue, BinStringValue, JsonStringValue, BinaryValue:
+		w.bytes(5, val.sliceData)
+	case StringValue:
+		w.string(6, val.data.(string))
+	case RegexValue:
+		w.string(6, val.data.(*regexp.Regexp).String())
+	case TimeValue:
+		w.string(6, val.GetTime().Format(time.RFC3339Nano))
+	case InvalidValue, MissingValue, NullValue, TrueValue, FalseValue:
+	default:
+		// Compiled PCRE expressions do not keep their pattern around
+		return fmt.Errorf("%v: %v", ErrorProtoUnsupported, val)
+	}
+	return nil
+}
+
+func decodeProtoFastVal(data []byte) (FastVal, error) {
+	var valType ValueType
+	var intVal int64
+	var uintVal uint64
+	var floatVal float64
+	var sliceData []byte
+	var text string
+
+	err := readProtoFields(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			valType = ValueType(f.int())
+		case 2:
+			intVal = f.sint()
+		case 3:
+			uintVal = f.value
+		case 4:
+			floatVal = f.double()
+		case 5:
+			sliceData = append([]byte{}, f.data...)
+		case 6:
+			text = string(f.data)
+		}
+		return nil
+	})
+	if err != nil {
+		return FastVal{}, err
+	}
+
+	switch valType {
+	case InvalidValue:
+		return NewInvalidFastVal(), nil
+	case MissingValue:
+		return NewMissingFastVal(), nil
+	case NullValue:
+		return NewNullFastVal(), nil
+	case TrueValue:
+		return NewBoolFastVal(true), nil
+	case FalseValue:
+		return NewBoolFastVal(false), nil
+	case IntValue:
+		return NewIntFastVal(intVal), nil
+	case UintValue:
+		return NewUintFastVal(uintVal), nil
+	case FloatValue:
+		return NewFloatFastVal(floatVal), nil
+	case JsonIntValue:
+		return NewJsonIntFastVal(sliceData), nil
+	case JsonUintValue:
+		return NewJsonUintFastVal(sliceData), nil
+	case JsonFloatValue:
+		return NewJsonFloatFastVal(sliceData), nil
+	case BinStringValue:
+		return NewBinStringFastVal(sliceData), nil
+	case JsonStringValue:
+		return NewJsonStringFastVal(sliceData), nil
+	case BinaryValue:
+		return NewBinaryFastVal(sliceData), nil
+	case StringValue:
+		return NewStringFastVal(text), nil
+	case RegexValue:
+		regex, err := compileCachedRegex(text)
+		if err != nil {
+			return FastVal{}, newFilterExpressionError(ErrBadRegex, "Invalid regular expression %v: %v", text, err)
+		}
+		return NewRegexpFastVal(regex), nil
+	case TimeValue:
+		timeVal, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return FastVal{}, ErrorInvalidTimeFormat
+		}
+		return NewTimeFastVal(&timeVal), nil
+	}
+
+	return FastVal{}, fmt.Errorf("%v: unsupported value type %d", ErrorProtoMalformed, valType)
+}
+
+func encodeProtoDataRef(w *protoWriter, ref DataRef) error {
+	switch ref := ref.(type) {
+	case nil:
+	case activeLitRef:
+		w.varint(1, protoDataRefActiveLiteral)
+	case SlotRef:
+		w.varint(1, protoDataRefSlot)
+		w.varint(2, int64(ref.Slot))
+	case FuncRef:
+		w.varint(1, protoDataRefFunc)
+		w.string(3, ref.FuncName)
+		for _, param := range ref.Params {
+			err := w.message(4, func(w *protoWriter) error {
+				return encodeProtoDataRef(w, param)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	case FastVal:
+		w.varint(1, protoDataRefValue)
+		return w.message(5, func(w *protoWriter) error {
+			return encodeProtoFastVal(w, ref)
+		})
+	default:
+		return fmt.Errorf("%v: data reference of type %T", ErrorProtoUnsupported, ref)
+	}
+	return nil
+}
+
+func decodeProtoDataRef(data []byte) (DataRef, error) {
+	var refType int64
+	var slot SlotID
+	var funcName string
+	var params []DataRef
+	var value FastVal
+
+	err := readProtoFields(data, func(f protoField) error {
+		var err error
+		switch f.num {
+		case 1:
+			refType = f.int()
+		case 2:
+			slot = SlotID(f.int())
+		case 3:
+			funcName = string(f.data)
+		case 4:
+			var param DataRef
+			param, err = decodeProtoDataRef(f.data)
+			params = append(params, param)
+		case 5:
+			value, err = decodeProtoFastVal(f.data)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch refType {
+	case protoDataRefNone:
+		return nil, nil
+	case protoDataRefActiveLiteral:
+		return activeLitRef{}, nil
+	case protoDataRefSlot:
+		return SlotRef{slot}, nil
+	case protoDataRefFunc:
+		return FuncRef{funcName, params}, nil
+	case protoDataRefValue:
+		return value, nil
+	}
+	return nil, fmt.Errorf("%v: unknown data reference type %d", ErrorProtoMalformed, refType)
+}
+
+func encodeProtoOpNode(w *protoWriter, op OpNode) error {
+	w.varint(1, int64(op.BucketIdx))
+	w.varint(2, int64(op.Op))
+	if op.Lhs != nil {
+		err := w.message(3, func(w *protoWriter) error {
+			return encodeProtoDataRef(w, op.Lhs)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if op.Rhs != nil {
+		return w.message(4, func(w *protoWriter) error {
+			return encodeProtoDataRef(w, op.Rhs)
+		})
+	}
+	return nil
+}
+
+func decodeProtoOpNode(data []byte) (OpNode, error) {
+	var op OpNode
+	err := readProtoFields(data, func(f protoField) error {
+		var err error
+		switch f.num {
+		case 1:
+			op.BucketIdx = BucketID(f.int())
+		case 2:
+			op.Op = OpType(f.int())
+		case 3:
+			op.Lhs, err = decodeProtoDataRef(f.data)
+		case 4:
+			op.Rhs, err = decodeProtoDataRef(f.data)
+		}
+		return err
+	})
+	return op, err
+}
+
+func encodeProtoLoopNode(w *protoWriter, loop LoopNode) error {
+	w.varint(1, int64(loop.BucketIdx))
+	w.varint(2, int64(loop.Mode))
+	if loop.Target != nil {
+		err := w.message(3, func(w *protoWriter) error {
+			return encodeProtoDataRef(w, loop.Target)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if loop.Capture > 0 {
+		w.varint(5, int64(loop.Capture))
+	}
+	if loop.Node != nil {
+		return w.message(4, func(w *protoWriter) error {
+			return encodeProtoExecNode(w, loop.Node)
+		})
+	}
+	return nil
+}
+
+func decodeProtoLoopNode(data []byte) (LoopNode, error) {
+	var loop LoopNode
+	err := readProtoFields(data, func(f protoField) error {
+		var err error
+		switch f.num {
+		case 1:
+			loop.BucketIdx = BucketID(f.int())
+		case 2:
+			loop.Mode = LoopType(f.int())
+		case 3:
+			loop.Target, err = decodeProtoDataRef(f.data)
+		case 4:
+			loop.Node, err = decodeProtoExecNode(f.data)
+		case 5:
+			loop.Capture = SlotID(f.int())
+		}
+		return err
+	})
+	return loop, err
+}
+
+func encodeProtoOpsAndLoops(w *protoWriter, opsField int, ops []OpNode, loops []LoopNode) error {
+	for _, op := range ops {
+		err := w.message(opsField, func(w *protoWriter) error {
+			return encodeProtoOpNode(w, op)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, loop := range loops {
+		err := w.message(opsField+1, func(w *protoWriter) error {
+			return encodeProtoLoopNode(w, loop)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedExecNodeKeys(elems map[string]*ExecNode) []string {
+	var keys []string
+	for key := range elems {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func encodeProtoExecNode(w *protoWriter, node *ExecNode) error {
+	w.varint(1, int64(node.StoreId))
+
+	// Map entries are written in a stable order so the encoding is deterministic
+	for _, key := range sortedExecNodeKeys(node.Elems) {
+		elem := node.Elems[key]
+		err := w.message(2, func(w *protoWriter) error {
+			w.tag(1, protoWireBytes)
+			w.buf = protoAppendUvarint(w.buf, uint64(len(key)))
+			w.buf = append(w.buf, key...)
+			return w.message(2, func(w *protoWriter) error {
+				return encodeProtoExecNode(w, elem)
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := encodeProtoOpsAndLoops(w, 3, node.Ops, node.Loops); err != nil {
+		return err
+	}
+
+	if node.After != nil {
+		return w.message(5, func(w *protoWriter) error {
+			return encodeProtoOpsAndLoops(w, 1, node.After.Ops, node.After.Loops)
+		})
+	}
+	return nil
+}
+
+func decodeProtoOpOrLoop(f protoField, opsField int, ops *[]OpNode, loops *[]LoopNode) error {
+	switch f.num {
+	case opsField:
+		op, err := decodeProtoOpNode(f.data)
+		if err != nil {
+			return err
+		}
+		*ops = append(*ops, op)
+	case opsField + 1:
+		loop, err := decodeProtoLoopNode(f.data)
+		if err != nil {
+			return err
+		}
+		*loops = append(*loops, loop)
+	}
+	return nil
+}
+
+func decodeProtoExecNode(data []byte) (*ExecNode, error) {
+	node := &ExecNode{}
+	err := readProtoFields(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			node.StoreId = SlotID(f.int())
+		case 2:
+			var key string
+			var elem *ExecNode
+			err := readProtoFields(f.data, func(f protoField) error {
+				var err error
+				switch f.num {
+				case 1:
+					key = string(f.data)
+				case 2:
+					elem, err = decodeProtoExecNode(f.data)
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if elem == nil {
+				elem = &ExecNode{}
+			}
+			if node.Elems == nil {
+				node.Elems = make(map[string]*ExecNode)
+			}
+			node.Elems[key] = elem
+		case 5:
+			node.After = &AfterNode{}
+			return readProtoFields(f.data, func(f protoField) error {
+				return decodeProtoOpOrLoop(f, 1, &node.After.Ops, &node.After.Loops)
+			})
+		default:
+			return decodeProtoOpOrLoop(f, 3, &node.Ops, &node.Loops)
+		}
+		return nil
+	})
+	return node, err
+}
+
+// MarshalExpressionProto encodes an expression as an Expression message
+// from gojsonsm.proto
+func MarshalExpressionProto(expr Expression) ([]byte, error) {
+	var w protoWriter
+	if err := encodeProtoExpression(&w, expr); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+// UnmarshalExpressionProto decodes an Expression message.  Integer values
+// are returned as int and unsigned ones as uint64.
+func UnmarshalExpressionProto(data []byte) (Expression, error) {
+	return decodeProtoExpression(data)
+}
+
+// MarshalMatchDefProto encodes a compiled match definition as a MatchDef
+// message from gojsonsm.proto.  Definitions containing PCRE expressions
+// cannot be encoded, as the compiled form does not keep the pattern, and
+// neither can definitions with outputs.
+func MarshalMatchDefProto(def *MatchDef) ([]byte, error) {
+	if len(def.Outputs) > 0 {
+		return nil, ErrorProtoUnsupported
+	}
+
+	var w protoWriter
+
+	if def.ParseNode != nil {
+		err := w.message(1, func(w *protoWriter) error {
+			return encodeProtoExecNode(w, def.ParseNode)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, node := range def.MatchTree.data {
+		err := w.message(2, func(w *protoWriter) error {
+			w.varint(1, int64(node.NodeType))
+			w.svarint(2, int64(node.ParentIdx))
+			w.svarint(3, int64(node.Left))
+			w.svarint(4, int64(node.Right))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(def.MatchBuckets) > 0 {
+		var packed protoWriter
+		for _, bucket := range def.MatchBuckets {
+			packed.buf = protoAppendUvarint(packed.buf, uint64(bucket))
+		}
+		w.tag(3, protoWireBytes)
+		w.buf = protoAppendUvarint(w.buf, uint64(len(packed.buf)))
+		w.buf = append(w.buf, packed.buf...)
+	}
+
+	w.varint(4, int64(def.NumBuckets))
+	w.varint(5, int64(def.NumSlots))
+	return w.buf, nil
+}
+
+// UnmarshalMatchDefProto decodes a MatchDef message, the result can be
+// passed directly to NewFastMatcher
+func UnmarshalMatchDefProto(data []byte) (*MatchDef, error) {
+	def := &MatchDef{}
+	err := readProtoFields(data, func(f protoField) error {
+		var err error
+		switch f.num {
+		case 1:
+			def.ParseNode, err = decodeProtoExecNode(f.data)
+		case 2:
+			var node binTreeNode
+			err = readProtoFields(f.data, func(f protoField) error {
+				switch f.num {
+				case 1:
+					node.NodeType = BinTreeNodeType(f.int())
+				case 2:
+					node.ParentIdx = int(f.sint())
+				case 3:
+					node.Left = int(f.sint())
+				case 4:
+					node.Right = int(f.sint())
+				}
+				return nil
+			})
+			def.MatchTree.data = append(def.MatchTree.data, node)
+		case 3:
+			var buckets []uint64
+			buckets, err = f.packedVarints()
+			for _, bucket := range buckets {
+				def.MatchBuckets = append(def.MatchBuckets, int(int64(bucket)))
+			}
+		case 4:
+			def.NumBuckets = int(f.int())
+		case 5:
+			def.NumSlots = int(f.int())
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if def.ParseNode == nil {
+		def.ParseNode = &ExecNode{}
+	}
+	def.compilePrograms()
+	return def, nil
+}
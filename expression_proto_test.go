@@ -0,0 +1,116 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestExpressionProtoRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	exprs := []Expression{
+		TrueExpr{},
+		AndExpr{
+			EqualsExpr{FieldExpr{0, []string{"name", "", "[2]"}}, ValueExpr{"Bob"}},
+			NotExpr{LessThanExpr{FieldExpr{0, []string{"age"}}, ValueExpr{-5}}},
+			OrExpr{
+				GreaterEqualsExpr{ValueExpr{0}, ValueExpr{1.5}},
+				NotEqualsExpr{ValueExpr{nil}, ValueExpr{false}},
+				FalseExpr{},
+			},
+		},
+		AnyInExpr{1, FieldExpr{0, []string{"friends"}},
+			EveryInExpr{2, FieldExpr{1, []string{"tags"}},
+				LikeExpr{FieldExpr{2, nil}, RegexExpr{"^a.*"}}}},
+		AnyEveryInExpr{3, FieldExpr{0, nil}, ExistsExpr{FieldExpr{3, []string{"x"}}}},
+		LessEqualsExpr{
+			FuncExpr{DateFunc, []Expression{FieldExpr{0, []string{"d"}}}},
+			TimeExpr{"2019-01-01"},
+		},
+		NotExistsExpr{FieldExpr{0, []string{"x"}}},
+		GreaterThanExpr{FuncExpr{MathFuncPi, nil}, ValueExpr{uint64(1 << 63)}},
+		LikeExpr{FieldExpr{0, []string{"a"}}, PcreExpr{"(?i)x"}},
+		EqualsExpr{FirstInExpr{1, FieldExpr{0, []string{"a"}}, FieldExpr{1, []string{"b"}}, nil}, ValueExpr{2}},
+		ExistsExpr{FirstInExpr{1, FieldExpr{0, []string{"a"}}, FieldExpr{1, nil},
+			EqualsExpr{FieldExpr{1, []string{"c"}}, ValueExpr{true}}}},
+		EqualsExpr{FieldExpr{0, []string{"a"}}, ValueExpr{[]interface{}{1, "x", nil, []interface{}{}, []interface{}{1.5}}}},
+		EqualsExpr{FieldExpr{0, []string{"a"}}, ValueExpr{map[string]interface{}{
+			"x": 1, "y": []interface{}{"z"}, "w": map[string]interface{}{}, "": nil}}},
+	}
+
+	for _, expr := range exprs {
+		data, err := MarshalExpressionProto(expr)
+		assert.Nil(err)
+		decoded, err := UnmarshalExpressionProto(data)
+		assert.Nil(err)
+		assert.Equal(expr, decoded)
+	}
+
+	// Pin the wire format of a small expression
+	data, err := MarshalExpressionProto(EqualsExpr{FieldExpr{0, []string{"a"}}, ValueExpr{1}})
+	assert.Nil(err)
+	assert.Equal([]byte{
+		0x08, 0x11,
+		0x12, 0x05, 0x08, 0x0a, 0x32, 0x01, 'a',
+		0x12, 0x06, 0x08, 0x03, 0x1a, 0x02, 0x18, 0x02,
+	}, data)
+
+	// Object values are written with their keys in order
+	data, err = MarshalExpressionProto(ValueExpr{map[string]interface{}{"b": true, "a": nil}})
+	assert.Nil(err)
+	assert.Equal([]byte{
+		0x08, 0x03,
+		0x1a, 0x14, 0x4a, 0x12,
+		0x0a, 0x07, 0x0a, 0x01, 'a', 0x12, 0x02, 0x08, 0x01,
+		0x0a, 0x07, 0x0a, 0x01, 'b', 0x12, 0x02, 0x10, 0x01,
+	}, data)
+
+	_, err = MarshalExpressionProto(mergeExpr{})
+	assert.NotNil(err)
+	_, err = UnmarshalExpressionProto([]byte{0x08, 0x07})
+	assert.Equal(ErrorProtoMalformed, err)
+	_, err = UnmarshalExpressionProto([]byte{0x12, 0x05, 0x08})
+	assert.Equal(ErrorProtoMalformed, err)
+}
+
+func TestMatchDefProtoRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	expr := OrExpr{
+		EqualsExpr{FieldExpr{0, []string{"name"}}, ValueExpr{"Daphne Sutton"}},
+		AndExpr{
+			GreaterThanExpr{FieldExpr{0, []string{"age"}}, ValueExpr{30}},
+			EqualsExpr{FieldExpr{0, []string{"tags", "[0]"}}, ValueExpr{"ex"}},
+		},
+		LessThanExpr{
+			FuncExpr{DateFunc, []Expression{FieldExpr{0, []string{"registered"}}}},
+			FuncExpr{DateFunc, []Expression{ValueExpr{"2015-01-01"}}},
+		},
+		AnyInExpr{1, FieldExpr{0, []string{"friends"}},
+			LikeExpr{FieldExpr{1, []string{"name"}}, RegexExpr{"^Gib"}}},
+		EqualsExpr{
+			FirstInExpr{2, FieldExpr{0, []string{"friends"}}, FieldExpr{2, []string{"name"}}, nil},
+			ValueExpr{"Wright Farley"},
+		},
+	}
+
+	var trans Transformer
+	matchDef := trans.Transform([]Expression{expr})
+
+	data, err := MarshalMatchDefProto(matchDef)
+	assert.Nil(err)
+	decoded, err := UnmarshalMatchDefProto(data)
+	assert.Nil(err)
+	assert.Equal(matchDef.String(), decoded.String())
+
+	// The decoded definition must match the same documents
+	for _, doc := range getTestPeopleDocs() {
+		expected, err := NewFastMatcher(matchDef).Match(doc)
+		assert.Nil(err)
+		matched, err := NewFastMatcher(decoded).Match(doc)
+		assert.Nil(err)
+		assert.Equal(expected, matched)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+// ShrinkExpression reduces an expression for which keep holds, such as one
+// the matchers disagree on or which fails to compile, to a smaller one for
+// which it still holds.  It tries in turn replacing AND and OR with fewer of
+// their operands, NOT with its operand, functions with their parameters, and
+// conditions with TRUE or FALSE, keeping each change for which keep holds,
+// until no change does.  keep is expected to hold for expr.
+func ShrinkExpression(expr Expression, keep func(Expression) bool) Expression {
+	for {
+		shrunk := false
+		for _, candidate := range exprShrinks(expr) {
+			if keep(candidate) {
+				expr = candidate
+				shrunk = true
+				break
+			}
+		}
+		if !shrunk {
+			return expr
+		}
+	}
+}
+
+// exprShrinks returns each of the expressions which are one change smaller
+// than expr, from the largest change to the smallest
+func exprShrinks(expr Expression) []Expression {
+	var shrinks []Expression
+
+	switch expr := expr.(type) {
+	case AndExpr:
+		shrinks = append(shrinks, shrinkExprList(expr, func(exprs []Expression) Expression {
+			return AndExpr(exprs)
+		})...)
+	case OrExpr:
+		shrinks = append(shrinks, shrinkExprList(expr, func(exprs []Expression) Expression {
+			return OrExpr(exprs)
+		})...)
+	case NotExpr:
+		shrinks = append(shrinks, expr.SubExpr)
+	case FuncExpr:
+		shrinks = append(shrinks, expr.Params...)
+	}
+
+	if isConditionExpr(expr) {
+		shrinks = append(shrinks, TrueExpr{}, FalseExpr{})
+	}
+
+	for i, child := range exprChildren(expr) {
+		for _, shrunkChild := range exprShrinks(child) {
+			shrinks = append(shrinks, withExprChild(expr, i, shrunkChild))
+		}
+	}
+	return shrinks
+}
+
+// shrinkExprList returns each of the operands of AND or OR alone, followed
+// by the operator without each of them in turn
+func shrinkExprList(exprs []Expression, rebuild func([]Expression) Expression) []Expression {
+	shrinks := append([]Expression{}, exprs...)
+	if len(exprs) > 2 {
+		for i := range exprs {
+			without := append(append([]Expression{}, exprs[:i]...), exprs[i+1:]...)
+			shrinks = append(shrinks, rebuild(without))
+		}
+	}
+	return shrinks
+}
+
+// isConditionExpr returns whether expr is true or false, rather than giving
+// a value.  TRUE and FALSE themselves are left out, as they cannot shrink.
+func isConditionExpr(expr Expression) bool {
+	switch expr.(type) {
+	case AndExpr, OrExpr, NotExpr, AnyInExpr, EveryInExpr, AnyEveryInExpr, AnyWithinExpr,
+		ExistsExpr, NotExistsExpr, EqualsExpr, StrictEqualsExpr, NotEqualsExpr,
+		LessThanExpr, LessEqualsExpr, GreaterThanExpr, GreaterEqualsExpr, LikeExpr:
+		return true
+	}
+	return false
+}
+
+// exprChildren returns the expressions expr is made of, in the order
+// withExprChild numbers them
+func exprChildren(expr Expression) []Expression {
+	switch expr := expr.(type) {
+	case FuncExpr:
+		return expr.Params
+	case NotExpr:
+		return []Expression{expr.SubExpr}
+	case AndExpr:
+		return expr
+	case OrExpr:
+		return expr
+	case AnyInExpr:
+		return []Expression{expr.InExpr, expr.SubExpr}
+	case EveryInExpr:
+		return []Expression{expr.InExpr, expr.SubExpr}
+	case AnyEveryInExpr:
+		return []Expression{expr.InExpr, expr.SubExpr}
+	case AnyWithinExpr:
+		return []Expression{expr.InExpr, expr.SubExpr}
+	case FirstInExpr:
+		if expr.SubExpr == nil {
+			return []Expression{expr.InExpr, expr.ResultExpr}
+		}
+		return []Expression{expr.InExpr, expr.ResultExpr, expr.SubExpr}
+	case ExistsExpr:
+		return []Expression{expr.SubExpr}
+	case NotExistsExpr:
+		return []Expression{expr.SubExpr}
+	case EqualsExpr:
+		return []Expression{expr.Lhs, expr.Rhs}
+	case StrictEqualsExpr:
+		return []Expression{expr.Lhs, expr.Rhs}
+	case NotEqualsExpr:
+		return []Expression{expr.Lhs, expr.Rhs}
+	case LessThanExpr:
+		return []Expression{expr.Lhs, expr.Rhs}
+	case LessEqualsExpr:
+		return []Expression{expr.Lhs, expr.Rhs}
+	case GreaterThanExpr:
+		return []Expression{expr.Lhs, expr.Rhs}
+	case GreaterEqualsExpr:
+		return []Expression{expr.Lhs, expr.Rhs}
+	case LikeExpr:
+		return []Expression{expr.Lhs, expr.Rhs}
+	}
+	return nil
+}
+
+// withExprChild returns a copy of expr with its i'th child replaced
+func withExprChild(expr Expression, i int, child Expression) Expression {
+	replace := func(exprs []Expression) []Expression {
+		out := append([]Expression{}, exprs...)
+		out[i] = child
+		return out
+	}
+	pair := func(lhs, rhs Expression) (Expression, Expression) {
+		out := replace([]Expression{lhs, rhs})
+		return out[0], out[1]
+	}
+
+	switch expr := expr.(type) {
+	case FuncExpr:
+		return FuncExpr{expr.FuncName, replace(expr.Params)}
+	case NotExpr:
+		return NotExpr{child}
+	case AndExpr:
+		return AndExpr(replace(expr))
+	case OrExpr:
+		return OrExpr(replace(expr))
+	case AnyInExpr:
+		inExpr, subExpr := pair(expr.InExpr, expr.SubExpr)
+		return AnyInExpr{expr.VarId, inExpr, subExpr}
+	case EveryInExpr:
+		inExpr, subExpr := pair(expr.InExpr, expr.SubExpr)
+		return EveryInExpr{expr.VarId, inExpr, subExpr}
+	case AnyEveryInExpr:
+		inExpr, subExpr := pair(expr.InExpr, expr.SubExpr)
+		return AnyEveryInExpr{expr.VarId, inExpr, subExpr}
+	case AnyWithinExpr:
+		inExpr, subExpr := pair(expr.InExpr, expr.SubExpr)
+		return AnyWithinExpr{expr.VarId, inExpr, subExpr}
+	case FirstInExpr:
+		out := replace([]Expression{expr.InExpr, expr.ResultExpr, expr.SubExpr})
+		return FirstInExpr{expr.VarId, out[0], out[1], out[2]}
+	case ExistsExpr:
+		return ExistsExpr{child}
+	case NotExistsExpr:
+		return NotExistsExpr{child}
+	case EqualsExpr:
+		lhs, rhs := pair(expr.Lhs, expr.Rhs)
+		return EqualsExpr{lhs, rhs}
+	case StrictEqualsExpr:
+		lhs, rhs := pair(expr.Lhs, expr.Rhs)
+		return StrictEqualsExpr{lhs, rhs}
+	case NotEqualsExpr:
+		lhs, rhs := pair(expr.Lhs, expr.Rhs)
+		return NotEqualsExpr{lhs, rhs}
+	case LessThanExpr:
+		lhs, rhs := pair(expr.Lhs, expr.Rhs)
+		return LessThanExpr{lhs, rhs}
+	case LessEqualsExpr:
+		lhs, rhs := pair(expr.Lhs, expr.Rhs)
+		return LessEqualsExpr{lhs, rhs}
+	case GreaterThanExpr:
+		lhs, rhs := pair(expr.Lhs, expr.Rhs)
+		return GreaterThanExpr{lhs, rhs}
+	case GreaterEqualsExpr:
+		lhs, rhs := pair(expr.Lhs, expr.Rhs)
+		return GreaterEqualsExpr{lhs, rhs}
+	case LikeExpr:
+		lhs, rhs := pair(expr.Lhs, expr.Rhs)
+		return LikeExpr{lhs, rhs}
+	}
+	return expr
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShrinkExpression(t *testing.T) {
+	assert := assert.New(t)
+
+	field := func(name string) FieldExpr {
+		return FieldExpr{Root: 0, Path: []string{name}}
+	}
+
+	// Shrinks to the smallest expression still reading c
+	var expr Expression = AndExpr{
+		OrExpr{EqualsExpr{field("a"), ValueExpr{1}}, GreaterThanExpr{field("b"), ValueExpr{2}}},
+		NotExpr{LessThanExpr{field("c"), FuncExpr{MathFuncAbs, []Expression{field("d")}}}},
+	}
+	readsC := func(expr Expression) bool {
+		for _, ref := range fetchExprFieldRefs(expr) {
+			if len(ref.Path) == 1 && ref.Path[0] == "c" {
+				return true
+			}
+		}
+		return false
+	}
+	assert.Equal(LessThanExpr{field("c"), field("d")}, ShrinkExpression(expr, readsC))
+
+	// Shrinks to the part which fails to compile
+	nested := AnyInExpr{1, field("a"), AnyInExpr{2, FieldExpr{Root: 1}, EqualsExpr{FieldExpr{Root: 2}, ValueExpr{1}}}}
+	expr = OrExpr{
+		GreaterThanExpr{field("c"), ValueExpr{1}},
+		AndExpr{NotExistsExpr{field("x")}, nested, LessThanExpr{field("d"), ValueExpr{5}}},
+	}
+	failsToCompile := func(expr Expression) bool {
+		var trans Transformer
+		_, err := trans.TransformWithLimits([]Expression{expr}, TransformLimits{MaxLoopDepth: 1})
+		return err != nil
+	}
+	assert.True(failsToCompile(expr))
+	assert.Equal(AnyInExpr{1, field("a"), AnyInExpr{2, FieldExpr{Root: 1}, TrueExpr{}}}, ShrinkExpression(expr, failsToCompile))
+
+	// Loops keep their variables, so only their bodies shrink
+	loop := AnyInExpr{1, field("arr"), AndExpr{
+		EqualsExpr{FieldExpr{Root: 1}, ValueExpr{2}},
+		ExistsExpr{FieldExpr{1, []string{"k"}}},
+	}}
+	hasLoop := func(expr Expression) bool {
+		_, ok := expr.(AnyInExpr)
+		return ok
+	}
+	assert.Equal(AnyInExpr{1, field("arr"), TrueExpr{}}, ShrinkExpression(loop, hasLoop))
+
+	never := func(Expression) bool { return false }
+	assert.Equal(loop, ShrinkExpression(loop, never))
+}
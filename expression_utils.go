@@ -43,9 +43,12 @@ func fetchExprFieldRefsRecurse(expr Expression, loopVars []VariableID, fields []
 		}
 
 		fields = append(fields, expr)
+	case TrueExpr:
+	case FalseExpr:
 	case ValueExpr:
 	case RegexExpr:
 	case PcreExpr:
+	case EngineRegexExpr:
 	case TimeExpr:
 	case FuncExpr:
 		for _, subexpr := range expr.Params {
@@ -78,9 +81,25 @@ func fetchExprFieldRefsRecurse(expr Expression, loopVars []VariableID, fields []
 		loopVars = append(loopVars, expr.VarId)
 		fields = fetchExprFieldRefsRecurse(expr.SubExpr, loopVars, fields)
 		loopVars = loopVars[0 : len(loopVars)-1]
+	case AnyWithinExpr:
+		fields = fetchExprFieldRefsRecurse(expr.InExpr, loopVars, fields)
+		loopVars = append(loopVars, expr.VarId)
+		fields = fetchExprFieldRefsRecurse(expr.SubExpr, loopVars, fields)
+		loopVars = loopVars[0 : len(loopVars)-1]
+	case FirstInExpr:
+		fields = fetchExprFieldRefsRecurse(expr.InExpr, loopVars, fields)
+		loopVars = append(loopVars, expr.VarId)
+		fields = fetchExprFieldRefsRecurse(expr.ResultExpr, loopVars, fields)
+		if expr.SubExpr != nil {
+			fields = fetchExprFieldRefsRecurse(expr.SubExpr, loopVars, fields)
+		}
+		loopVars = loopVars[0 : len(loopVars)-1]
 	case EqualsExpr:
 		fields = fetchExprFieldRefsRecurse(expr.Lhs, loopVars, fields)
 		fields = fetchExprFieldRefsRecurse(expr.Rhs, loopVars, fields)
+	case StrictEqualsExpr:
+		fields = fetchExprFieldRefsRecurse(expr.Lhs, loopVars, fields)
+		fields = fetchExprFieldRefsRecurse(expr.Rhs, loopVars, fields)
 	case NotEqualsExpr:
 		fields = fetchExprFieldRefsRecurse(expr.Lhs, loopVars, fields)
 		fields = fetchExprFieldRefsRecurse(expr.Rhs, loopVars, fields)
@@ -98,6 +117,8 @@ func fetchExprFieldRefsRecurse(expr Expression, loopVars []VariableID, fields []
 		fields = fetchExprFieldRefsRecurse(expr.Rhs, loopVars, fields)
 	case ExistsExpr:
 		fields = fetchExprFieldRefsRecurse(expr.SubExpr, loopVars, fields)
+	case NotExistsExpr:
+		fields = fetchExprFieldRefsRecurse(expr.SubExpr, loopVars, fields)
 	case LikeExpr:
 		fields = fetchExprFieldRefsRecurse(expr.Lhs, loopVars, fields)
 		fields = fetchExprFieldRefsRecurse(expr.Rhs, loopVars, fields)
@@ -111,3 +132,122 @@ func fetchExprFieldRefsRecurse(expr Expression, loopVars []VariableID, fields []
 func fetchExprFieldRefs(expr Expression) []FieldExpr {
 	return fetchExprFieldRefsRecurse(expr, nil, nil)
 }
+
+func rewriteExprList(exprs []Expression, fn func(Expression) Expression) []Expression {
+	out := make([]Expression, len(exprs))
+	for i, subexpr := range exprs {
+		out[i] = rewriteExpr(subexpr, fn)
+	}
+	return out
+}
+
+// rewriteExpr rebuilds the expression bottom up, replacing every node with
+// whatever fn returns for it once its children have been rewritten
+func rewriteExpr(expr Expression, fn func(Expression) Expression) Expression {
+	switch typedExpr := expr.(type) {
+	case FuncExpr:
+		expr = FuncExpr{typedExpr.FuncName, rewriteExprList(typedExpr.Params, fn)}
+	case NotExpr:
+		expr = NotExpr{rewriteExpr(typedExpr.SubExpr, fn)}
+	case AndExpr:
+		expr = AndExpr(rewriteExprList(typedExpr, fn))
+	case OrExpr:
+		expr = OrExpr(rewriteExprList(typedExpr, fn))
+	case AnyInExpr:
+		expr = AnyInExpr{typedExpr.VarId, rewriteExpr(typedExpr.InExpr, fn), rewriteExpr(typedExpr.SubExpr, fn)}
+	case EveryInExpr:
+		expr = EveryInExpr{typedExpr.VarId, rewriteExpr(typedExpr.InExpr, fn), rewriteExpr(typedExpr.SubExpr, fn)}
+	case AnyEveryInExpr:
+		expr = AnyEveryInExpr{typedExpr.VarId, rewriteExpr(typedExpr.InExpr, fn), rewriteExpr(typedExpr.SubExpr, fn)}
+	case AnyWithinExpr:
+		expr = AnyWithinExpr{typedExpr.VarId, rewriteExpr(typedExpr.InExpr, fn), rewriteExpr(typedExpr.SubExpr, fn)}
+	case FirstInExpr:
+		subExpr := typedExpr.SubExpr
+		if subExpr != nil {
+			subExpr = rewriteExpr(subExpr, fn)
+		}
+		expr = FirstInExpr{typedExpr.VarId, rewriteExpr(typedExpr.InExpr, fn), rewriteExpr(typedExpr.ResultExpr, fn), subExpr}
+	case ExistsExpr:
+		expr = ExistsExpr{rewriteExpr(typedExpr.SubExpr, fn)}
+	case NotExistsExpr:
+		expr = NotExistsExpr{rewriteExpr(typedExpr.SubExpr, fn)}
+	case EqualsExpr:
+		expr = EqualsExpr{rewriteExpr(typedExpr.Lhs, fn), rewriteExpr(typedExpr.Rhs, fn)}
+	case StrictEqualsExpr:
+		expr = StrictEqualsExpr{rewriteExpr(typedExpr.Lhs, fn), rewriteExpr(typedExpr.Rhs, fn)}
+	case NotEqualsExpr:
+		expr = NotEqualsExpr{rewriteExpr(typedExpr.Lhs, fn), rewriteExpr(typedExpr.Rhs, fn)}
+	case LessThanExpr:
+		expr = LessThanExpr{rewriteExpr(typedExpr.Lhs, fn), rewriteExpr(typedExpr.Rhs, fn)}
+	case LessEqualsExpr:
+		expr = LessEqualsExpr{rewriteExpr(typedExpr.Lhs, fn), rewriteExpr(typedExpr.Rhs, fn)}
+	case GreaterThanExpr:
+		expr = GreaterThanExpr{rewriteExpr(typedExpr.Lhs, fn), rewriteExpr(typedExpr.Rhs, fn)}
+	case GreaterEqualsExpr:
+		expr = GreaterEqualsExpr{rewriteExpr(typedExpr.Lhs, fn), rewriteExpr(typedExpr.Rhs, fn)}
+	case LikeExpr:
+		expr = LikeExpr{rewriteExpr(typedExpr.Lhs, fn), rewriteExpr(typedExpr.Rhs, fn)}
+	}
+	return fn(expr)
+}
+
+// exprMaxVarID returns the highest variable referenced or declared by the
+// expression, or 0 if it only refers to the document itself
+func exprMaxVarID(expr Expression) VariableID {
+	var maxID VariableID
+	raise := func(id VariableID) {
+		if id > maxID {
+			maxID = id
+		}
+	}
+
+	rewriteExpr(expr, func(expr Expression) Expression {
+		switch expr := expr.(type) {
+		case FieldExpr:
+			raise(expr.Root)
+		case AnyInExpr:
+			raise(expr.VarId)
+		case EveryInExpr:
+			raise(expr.VarId)
+		case AnyEveryInExpr:
+			raise(expr.VarId)
+		case AnyWithinExpr:
+			raise(expr.VarId)
+		case FirstInExpr:
+			raise(expr.VarId)
+		case deepFieldExpr:
+			raise(expr.Root)
+		}
+		return expr
+	})
+	return maxID
+}
+
+// tokenMatchOf returns the operands of ARRAY_CONTAINS(TOKENS(str), word),
+// which is output as checking that the token match function gives true
+func tokenMatchOf(expr EqualsExpr) (Expression, Expression, bool) {
+	fn, ok := expr.Lhs.(FuncExpr)
+	if !ok || fn.FuncName != TokenMatchFunc || len(fn.Params) != 2 {
+		return nil, nil, false
+	}
+	if rhsVal, ok := expr.Rhs.(ValueExpr); !ok || rhsVal.Value != true {
+		return nil, nil, false
+	}
+	return fn.Params[0], fn.Params[1], true
+}
+
+// arrayContainsOf returns the operands of ARRAY_CONTAINS(array, value),
+// which is output as a loop over the array checking for the value
+func arrayContainsOf(expr AnyInExpr) (Expression, Expression, bool) {
+	eqExpr, ok := expr.SubExpr.(EqualsExpr)
+	if !ok {
+		return nil, nil, false
+	}
+	if varField, ok := eqExpr.Lhs.(FieldExpr); !ok || varField.Root != expr.VarId || len(varField.Path) > 0 {
+		return nil, nil, false
+	}
+	if exprMaxVarID(eqExpr.Rhs) >= expr.VarId {
+		return nil, nil, false
+	}
+	return expr.InExpr, eqExpr.Rhs, true
+}
@@ -71,6 +71,23 @@ func (stats *ExpressionStats) scanOne(expr Expression, loopDepth int) error {
 		}
 		stats.scanOne(expr.InExpr, loopDepth)
 		stats.scanOne(expr.SubExpr, loopDepth+1)
+	case AnyWithinExpr:
+		stats.NumLoops++
+		if loopDepth == 1 {
+			stats.NumNestedLoops++
+		}
+		stats.scanOne(expr.InExpr, loopDepth)
+		stats.scanOne(expr.SubExpr, loopDepth+1)
+	case FirstInExpr:
+		stats.NumLoops++
+		if loopDepth == 1 {
+			stats.NumNestedLoops++
+		}
+		stats.scanOne(expr.InExpr, loopDepth)
+		stats.scanOne(expr.ResultExpr, loopDepth+1)
+		if expr.SubExpr != nil {
+			stats.scanOne(expr.SubExpr, loopDepth+1)
+		}
 	case ExistsExpr:
 		stats.scanOne(expr.SubExpr, loopDepth)
 	case NotExistsExpr:
@@ -78,6 +95,9 @@ func (stats *ExpressionStats) scanOne(expr Expression, loopDepth int) error {
 	case EqualsExpr:
 		stats.scanOne(expr.Lhs, loopDepth)
 		stats.scanOne(expr.Rhs, loopDepth)
+	case StrictEqualsExpr:
+		stats.scanOne(expr.Lhs, loopDepth)
+		stats.scanOne(expr.Rhs, loopDepth)
 	case NotEqualsExpr:
 		stats.scanOne(expr.Lhs, loopDepth)
 		stats.scanOne(expr.Rhs, loopDepth)
@@ -3,7 +3,12 @@
 package gojsonsm
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
+	"time"
 )
 
 type slotData struct {
@@ -15,26 +20,180 @@ type FastMatcher struct {
 	def     MatchDef
 	slots   []slotData
 	buckets *binTreeState
-	tokens  jsonTokenizer
+	tokens  tokenizer
+	skipper valueSkipper
+	stack   []FastVal
+	// The values of shared functions computed by the program being run
+	locals    []FastVal
+	localsSet []bool
+	// Holds the values converted while matching the current document
+	arena byteArena
+	// Whether integer tokens hold their decimal text, as with JSON
+	textIntegers bool
+	// Which of the top level keys have been seen in the current document
+	seenKeys []bool
+	// The values of the outputs of the definition for the last document
+	outputs []FastVal
+	// The result of the last op run by a program, shared by the buckets of
+	// ops which only differ by their bucket
+	opResult  bool
+	opDecided bool
+	// How comparisons treat NaN and infinite function results
+	nonFinite NonFinitePolicy
+	// How numbers are compared when one of them is a float, or nil to
+	// compare them as FastVal.Compare does
+	floatEq *FloatEquality
+	// Whether strings holding numbers are compared with numbers as numbers
+	coerceStrings bool
+	// The kinds of empty values treated as missing, and the kind of empty
+	// value the after node being run is for
+	emptyAsMissing EmptyValues
+	activeEmpty    EmptyValues
+	// The document built from the key, metadata or inputs given to MatchKey,
+	// MatchWithMeta or MatchInputs, and the tokenizer reading it, which is
+	// kept apart from the one for bodies
+	keyDoc    []byte
+	keyTokens jsonTokenizer
+	// Gives the time NOW_MILLIS() reads, which is time.Now when nil, and the
+	// value it had for the current document once it has been read
+	clock  func() time.Time
+	now    FastVal
+	nowSet bool
+	// Updated for each document matched when set
+	metrics *MatcherMetrics
+	// Which value of a repeated key is read, and for the keys the
+	// expression reads of each object being matched, how many of their
+	// values have been read or, with DuplicateKeysLastWins, are left
+	dupKeys   DuplicateKeyPolicy
+	keyCounts []int32
+	// What Match does with input holding more than one JSON value, and the
+	// tokenizer finding where each value ends
+	concatenated ConcatenatedPolicy
+	valueTokens  jsonTokenizer
+	// Whether UTF-16 documents are converted to UTF-8, into transcoded
+	transcodeUTF16 bool
+	transcoded     []byte
+}
+
+// DuplicateKeyPolicy decides which value a FastMatcher reads for a key which
+// appears more than once in the same object, such as `a` in
+// `{"a":1,"a":2}`.  Only the keys an expression reads are looked at, in the
+// objects whose fields the matcher reads.
+type DuplicateKeyPolicy int
+
+const (
+	// DuplicateKeysFirstWins reads the first value of the key and skips the
+	// others, which is the default
+	DuplicateKeysFirstWins DuplicateKeyPolicy = iota
+	// DuplicateKeysLastWins reads the last value of the key, as most JSON
+	// parsers do, which takes a second pass over each object holding keys
+	// the expression reads
+	DuplicateKeysLastWins
+	// DuplicateKeysError makes Match return ErrorDuplicateKey for an object
+	// with more than one value for the key, which is checked with a second
+	// pass in the same way as for DuplicateKeysLastWins before any of the
+	// fields of the object are read
+	DuplicateKeysError
+)
+
+// valueSkipper is implemented by tokenizers which can move past the rest of
+// an object or array faster than by stepping through its tokens
+type valueSkipper interface {
+	SkipValue() error
 }
 
 func NewFastMatcher(def *MatchDef) *FastMatcher {
-	return &FastMatcher{
-		def:     *def,
-		slots:   make([]slotData, def.NumSlots),
-		buckets: def.MatchTree.NewState(),
+	return newFastMatcherWithTokenizer(def, &jsonTokenizer{})
+}
+
+// SetNonFinitePolicy sets how the matcher treats NaN and infinite values
+// given by math functions, which is NonFiniteNoMatch by default
+func (m *FastMatcher) SetNonFinitePolicy(policy NonFinitePolicy) {
+	m.nonFinite = policy
+}
+
+// SetFloatEquality sets when the matcher treats floats as equal, such as to
+// compare them exactly or to tell -0 apart from 0.  Numbers are compared as
+// floats whenever either of them is a float.
+func (m *FastMatcher) SetFloatEquality(eq FloatEquality) {
+	m.floatEq = &eq
+}
+
+// SetCoerceNumericStrings sets whether strings holding a JSON number are
+// compared with numbers as that number, so that `"42" > 10` matches.  Two
+// strings are still compared as strings, and comparisons between numbers and
+// strings which do not hold a number are always false.
+func (m *FastMatcher) SetCoerceNumericStrings(coerce bool) {
+	m.coerceStrings = coerce
+}
+
+// SetDuplicateKeyPolicy sets which value of a repeated key the matcher
+// reads, which is the first by default
+func (m *FastMatcher) SetDuplicateKeyPolicy(policy DuplicateKeyPolicy) {
+	m.dupKeys = policy
+}
+
+// SetEmptyAsMissing sets which kinds of empty values are treated as missing
+// by EXISTS and IS MISSING, so that `name IS MISSING` matches `{"name":""}`
+// with EmptyStrings.  Comparisons with empty values are not affected.
+func (m *FastMatcher) SetEmptyAsMissing(empty EmptyValues) {
+	m.emptyAsMissing = empty
+}
+
+// SetClock sets the clock NOW_MILLIS() reads, which is time.Now by default.
+// The clock is read at most once per document, so every use of NOW_MILLIS()
+// in an expression sees the same time.
+func (m *FastMatcher) SetClock(clock func() time.Time) {
+	m.clock = clock
+}
+
+// SetMetrics sets the metrics the matcher updates for each document, or
+// stops updating them when metrics is nil
+func (m *FastMatcher) SetMetrics(metrics *MatcherMetrics) {
+	m.metrics = metrics
+}
+
+func (m *FastMatcher) nowMillis() FastVal {
+	if !m.nowSet {
+		var now time.Time
+		if m.clock != nil {
+			now = m.clock()
+		} else {
+			now = time.Now()
+		}
+		m.now = NewIntFastVal(now.UnixNano() / int64(time.Millisecond))
+		m.nowSet = true
 	}
+	return m.now
 }
 
 func (m *FastMatcher) Reset() {
-	m.slots = m.slots[:0]
+	for i := range m.slots {
+		m.slots[i] = slotData{}
+	}
 	m.buckets.Reset()
 }
 
+// clearSlots empties the slots stored by the node and those within it, so
+// that a field which one element of a loop does not have is missing, rather
+// than taking its value from an element before
+func (m *FastMatcher) clearSlots(node *ExecNode) {
+	if node.StoreId > 0 {
+		m.slots[node.StoreId-1] = slotData{}
+	}
+	for _, elem := range node.Elems {
+		m.clearSlots(elem)
+	}
+}
+
 func (m *FastMatcher) leaveValue() error {
+	if m.skipper != nil {
+		return m.skipper.SkipValue()
+	}
+
 	depth := 0
 
-	tokens := &m.tokens
+	tokens := m.tokens
 	for {
 		token, _, _, err := tokens.Step()
 		if err != nil {
@@ -92,12 +251,19 @@ func (m *FastMatcher) literalFromSlot(slot SlotID) FastVal {
 	savePos := m.tokens.Position()
 
 	slotInfo := m.slots[slot-1]
+	if slotInfo.size == 0 {
+		// Nothing was stored in the slot for this document
+		return value
+	}
 	m.tokens.Seek(slotInfo.start)
 	token, tokenData, _, _ := m.tokens.Step()
 
 	if isLiteralToken(token) {
-		var parser fastLitParser
-		value = parser.Parse(token, tokenData)
+		value = m.tokens.ParseLiteral(token, tokenData)
+	} else if token == tknArrayStart || token == tknObjectStart {
+		if containerVal, err := m.containerValue(token); err == nil {
+			value = containerVal
+		}
 	}
 
 	m.tokens.Seek(savePos)
@@ -105,174 +271,6 @@ func (m *FastMatcher) literalFromSlot(slot SlotID) FastVal {
 	return value
 }
 
-// does this need to handle no arg funcs like MathFuncPi?
-func (m *FastMatcher) resolveFunc(fn FuncRef, activeLit *FastVal) FastVal {
-	switch fn.FuncName {
-	case MathFuncAbs:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathAbs(p1)
-	case MathFuncAcos:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathAcos(p1)
-	case MathFuncAsin:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathAsin(p1)
-	case MathFuncAtan:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathAtan(p1)
-	case MathFuncAtan2:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		p2 := m.resolveParam(fn.Params[1], activeLit)
-		return FastValMathAtan2(p1, p2)
-	case MathFuncRound:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathRound(p1)
-	case MathFuncCos:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathCos(p1)
-	case MathFuncSin:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathSin(p1)
-	case MathFuncTan:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathTan(p1)
-	case MathFuncSqrt:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathSqrt(p1)
-	case MathFuncExp:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathExp(p1)
-	case MathFuncLn:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathLn(p1)
-	case MathFuncLog:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathLog(p1)
-	case MathFuncCeil:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathCeil(p1)
-	case MathFuncFloor:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathFloor(p1)
-	case MathFuncDegrees:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathDegrees(p1)
-	case MathFuncRadians:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathRadians(p1)
-	case MathFuncPow:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		p2 := m.resolveParam(fn.Params[1], activeLit)
-		return FastValMathPow(p1, p2)
-	case DateFunc:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValDateFunc(p1)
-	case MathFuncAdd:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		p2 := m.resolveParam(fn.Params[1], activeLit)
-		return FastValMathAdd(p1, p2)
-	case MathFuncSub:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		p2 := m.resolveParam(fn.Params[1], activeLit)
-		return FastValMathSub(p1, p2)
-	case MathFuncMul:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		p2 := m.resolveParam(fn.Params[1], activeLit)
-		return FastValMathMul(p1, p2)
-	case MathFuncDiv:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		p2 := m.resolveParam(fn.Params[1], activeLit)
-		return FastValMathDiv(p1, p2)
-	case MathFuncMod:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		p2 := m.resolveParam(fn.Params[1], activeLit)
-		return FastValMathMod(p1, p2)
-	case MathFuncNeg:
-		p1 := m.resolveParam(fn.Params[0], activeLit)
-		return FastValMathNeg(p1)
-	default:
-		panic(fmt.Sprintf("encountered unexpected function name: %v", fn.FuncName))
-	}
-}
-
-func (m *FastMatcher) resolveParam(in interface{}, activeLit *FastVal) FastVal {
-	switch opVal := in.(type) {
-	case FastVal:
-		return opVal
-	case activeLitRef:
-		if activeLit == nil {
-			panic("cannot resolve active literal without having an active context")
-		}
-
-		return *activeLit
-	case SlotRef:
-		return m.literalFromSlot(opVal.Slot)
-	case FuncRef:
-		return m.resolveFunc(opVal, activeLit)
-	default:
-		panic(fmt.Sprintf("unexpected op value: %#v", in))
-	}
-}
-
-func (m *FastMatcher) matchOp(op *OpNode, litVal *FastVal) error {
-	bucketIdx := int(op.BucketIdx)
-
-	if m.buckets.IsResolved(bucketIdx) {
-		// If the bucket for this op is already resolved  in the binary tree,
-		// we don't need to perform the op and can just skip it.
-		return nil
-	}
-
-	// it seems a bit weird that, when op.Lhs == op.Rhs == nil, we will
-	// do litVal op litVal
-	lhsVal := NewMissingFastVal()
-	if op.Lhs != nil {
-		lhsVal = m.resolveParam(op.Lhs, litVal)
-	} else if litVal != nil {
-		lhsVal = *litVal
-	}
-
-	rhsVal := NewMissingFastVal()
-	if op.Rhs != nil {
-		rhsVal = m.resolveParam(op.Rhs, litVal)
-	} else if litVal != nil {
-		rhsVal = *litVal
-	}
-
-	var opRes bool
-	switch op.Op {
-	case OpTypeEquals:
-		opRes = lhsVal.Equals(rhsVal)
-	case OpTypeLessThan:
-		opRes = lhsVal.Compare(rhsVal) < 0
-	case OpTypeLessEquals:
-		opRes = lhsVal.Compare(rhsVal) <= 0
-	case OpTypeGreaterThan:
-		opRes = lhsVal.Compare(rhsVal) > 0
-	case OpTypeGreaterEquals:
-		opRes = lhsVal.Compare(rhsVal) >= 0
-	case OpTypeMatches:
-		opRes = lhsVal.Matches(rhsVal)
-	case OpTypeExists:
-		// why? is it because a litVal is passed in? do we need to check litVal != nil?
-		opRes = true
-	default:
-		panic("invalid op type")
-	}
-
-	// Mark the result of this operation
-	m.buckets.MarkNode(bucketIdx, opRes)
-
-	// this code is no op since we are not in a loop
-	// Check if running this values ops has resolved the entirety
-	// of the expression, if so we can leave immediately.
-	if m.buckets.IsResolved(0) {
-		return nil
-	}
-
-	return nil
-}
-
 // this method is not being used. is it expected?
 func (m *FastMatcher) matchElems(token tokenType, tokenData []byte, elems map[string]*ExecNode) error {
 	// Note that this assumes that the tokenizer has already been placed at the target
@@ -284,8 +282,6 @@ func (m *FastMatcher) matchElems(token tokenType, tokenData []byte, elems map[st
 		return nil
 	}
 
-	var keyLitParse fastLitParser
-
 	for i := 0; ; i++ {
 		// If this is not the first entry in the object, there should be a
 		// list delimiter ('c') that shows up in the input first.
@@ -303,7 +299,7 @@ func (m *FastMatcher) matchElems(token tokenType, tokenData []byte, elems map[st
 			}
 		}
 
-		token, tokenData, _, err := m.tokens.Step()
+		token, tokenData, tokenDataLen, err := m.tokens.Step()
 		if err != nil {
 			return err
 		}
@@ -312,10 +308,8 @@ func (m *FastMatcher) matchElems(token tokenType, tokenData []byte, elems map[st
 		}
 
 		var keyBytes []byte
-		if token == tknString {
-			keyBytes = keyLitParse.ParseString(tokenData)
-		} else if token == tknEscString {
-			keyBytes = keyLitParse.ParseEscString(tokenData)
+		if token == tknString || token == tknEscString {
+			keyBytes = m.tokens.ParseKey(token, tokenData, tokenDataLen)
 		} else {
 			panic("expected literal")
 		}
@@ -328,7 +322,7 @@ func (m *FastMatcher) matchElems(token tokenType, tokenData []byte, elems map[st
 			panic("expected object key delimiter")
 		}
 
-		token, tokenData, tokenDataLen, err := m.tokens.Step()
+		token, tokenData, tokenDataLen, err = m.tokens.Step()
 		if err != nil {
 			return err
 		}
@@ -355,6 +349,16 @@ func (m *FastMatcher) matchLoop(token tokenType, tokenData []byte, loop *LoopNod
 	// Note that this assumes that the tokenizer has already been placed at the target
 	// that referenced the loop node itself...
 
+	if loop.Mode == LoopTypeAnyWithin {
+		return m.matchLoopWithin(token, loop)
+	}
+
+	// A capture from an earlier value of the target must not be mistaken
+	// for a result of this one
+	if loop.Capture > 0 {
+		m.slots[loop.Capture-1] = slotData{}
+	}
+
 	// Check that the token that we started with is an array that we can loop over,
 	// if it is not, we need to exit early as this LoopNode does not apply.
 	if token != tknArrayStart {
@@ -373,7 +377,7 @@ func (m *FastMatcher) matchLoop(token tokenType, tokenData []byte, loop *LoopNod
 	// We need to keep track of the overall loop result value while the bin tree
 	// is being iterated on, reset, etc...
 	var loopState bool
-	if loop.Mode == LoopTypeAny {
+	if loop.Mode == LoopTypeAny || loop.Mode == LoopTypeFirst {
 		loopState = false
 	} else if loop.Mode == LoopTypeEvery {
 		loopState = true
@@ -417,6 +421,7 @@ func (m *FastMatcher) matchLoop(token tokenType, tokenData []byte, loop *LoopNod
 		// Reset the looping node in the binary tree so that previous iterations
 		// of the loop do not impact the results of this iteration
 		m.buckets.ResetNode(loopBucketIdx)
+		m.clearSlots(loop.Node)
 
 		// Run the execution node for this element of the array.
 		err = m.matchExec(token, tokenData, tokenDataLen, loop.Node)
@@ -424,8 +429,13 @@ func (m *FastMatcher) matchLoop(token tokenType, tokenData []byte, loop *LoopNod
 			return err
 		}
 
+		// Anything this element did not decide, such as from a field it does
+		// not have, is resolved now in the same way as for the whole document
+		// once it has been read.  Without this the non-exiting nodes used by
+		// exhaustive definitions would leave every iteration undecided.
+		m.buckets.ResolveNode(loopBucketIdx)
 		iterationMatched := m.buckets.IsTrue(loopBucketIdx)
-		if loop.Mode == LoopTypeAny {
+		if loop.Mode == LoopTypeAny || loop.Mode == LoopTypeFirst {
 			if iterationMatched {
 				// If any element of the array matches, we know that
 				// this loop is successful
@@ -464,6 +474,11 @@ func (m *FastMatcher) matchLoop(token tokenType, tokenData []byte, loop *LoopNod
 		}
 	}
 
+	// The capture of the last element tried is only kept if it matched
+	if loop.Capture > 0 && !loopState {
+		m.slots[loop.Capture-1] = slotData{}
+	}
+
 	// We have to reset the node before we can mark it or our double-marking
 	// protection on the binary tree will trigger, this helpfully also marks
 	// the children of the loop to undefined resolution, which makes more sense
@@ -481,7 +496,122 @@ func (m *FastMatcher) matchLoop(token tokenType, tokenData []byte, loop *LoopNod
 	return nil
 }
 
-func (m *FastMatcher) matchAfter(node *AfterNode) error {
+// matchLoopWithin runs a within loop, which tries the loop body against
+// every value nested inside the object or array it targets.  Each value is
+// first matched as a whole, and then the tokenizer is moved back to its start
+// so that the values inside of it can be tried in turn.
+func (m *FastMatcher) matchLoopWithin(token tokenType, loop *LoopNode) error {
+	if token != tknObjectStart && token != tknArrayStart {
+		return nil
+	}
+
+	loopBucketIdx := int(loop.BucketIdx)
+
+	if m.buckets.IsResolved(loopBucketIdx) {
+		m.skipValue(token)
+		return nil
+	}
+
+	startPos := m.tokens.Position()
+	previousStallIndex := m.buckets.SetStallIndex(loopBucketIdx)
+
+	loopState, err := m.matchWithinValues(token, loop)
+	if err != nil {
+		return err
+	}
+
+	// A match can be found part way through any of the nested values, so
+	// the rest of the target is skipped from its start
+	if loopState {
+		m.tokens.Seek(startPos)
+		m.leaveValue()
+	}
+
+	m.buckets.ResetNode(loopBucketIdx)
+	m.buckets.SetStallIndex(previousStallIndex)
+	m.buckets.MarkNode(loopBucketIdx, loopState)
+
+	return nil
+}
+
+// matchWithinValues tries the body of a within loop against each value of
+// the object or array which was just read, descending into the values which
+// are objects or arrays themselves.  It stops as soon as one matches.
+func (m *FastMatcher) matchWithinValues(containerToken tokenType, loop *LoopNode) (bool, error) {
+	endToken := tknArrayEnd
+	if containerToken == tknObjectStart {
+		endToken = tknObjectEnd
+	}
+	loopBucketIdx := int(loop.BucketIdx)
+
+	for i := 0; ; i++ {
+		token, tokenData, tokenDataLen, err := m.tokens.Step()
+		if err != nil {
+			return false, err
+		}
+		if token == endToken {
+			return false, nil
+		}
+
+		if i != 0 {
+			if token != tknListDelim {
+				panic(fmt.Sprintf("expected element delimiter got %s", tokenToText(token)))
+			}
+
+			token, tokenData, tokenDataLen, err = m.tokens.Step()
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if containerToken == tknObjectStart {
+			// Only the values of an object are looped over, so its keys
+			// are read past
+			if token != tknString && token != tknEscString {
+				panic(fmt.Sprintf("expected object key got %s", tokenToText(token)))
+			}
+
+			token, _, _, err = m.tokens.Step()
+			if err != nil {
+				return false, err
+			}
+			if token != tknObjectKeyDelim {
+				panic(fmt.Sprintf("expected object key delimiter got %s", tokenToText(token)))
+			}
+
+			token, tokenData, tokenDataLen, err = m.tokens.Step()
+			if err != nil {
+				return false, err
+			}
+		}
+
+		valuePos := m.tokens.Position()
+
+		m.buckets.ResetNode(loopBucketIdx)
+		m.clearSlots(loop.Node)
+
+		err = m.matchExec(token, tokenData, tokenDataLen, loop.Node)
+		if err != nil {
+			return false, err
+		}
+
+		m.buckets.ResolveNode(loopBucketIdx)
+		if m.buckets.IsTrue(loopBucketIdx) {
+			return true, nil
+		}
+
+		if token == tknObjectStart || token == tknArrayStart {
+			m.tokens.Seek(valuePos)
+
+			matched, err := m.matchWithinValues(token, loop)
+			if err != nil || matched {
+				return matched, err
+			}
+		}
+	}
+}
+
+func (m *FastMatcher) matchAfter(node *AfterNode, empty EmptyValues) error {
 	savePos := m.tokens.Position()
 
 	// Run loop matching
@@ -507,12 +637,9 @@ func (m *FastMatcher) matchAfter(node *AfterNode) error {
 	}
 
 	// Run op matching
-	for _, op := range node.Ops {
-		err := m.matchOp(&op, nil)
-		if err != nil {
-			return err
-		}
-
+	if node.program != nil {
+		m.activeEmpty = empty
+		m.runProgram(node.program, nil)
 		if m.buckets.IsResolved(0) {
 			return nil
 		}
@@ -523,37 +650,71 @@ func (m *FastMatcher) matchAfter(node *AfterNode) error {
 	return nil
 }
 
+// storeSlot records where the value which was just read starts and ends.
+// This has to happen before the after node runs, as its loops may read the
+// stored value again.
+func (m *FastMatcher) storeSlot(node *ExecNode, startPos int) {
+	if node.StoreId > 0 {
+		slotData := &m.slots[node.StoreId-1]
+		slotData.start = startPos
+		slotData.size = m.tokens.Position() - startPos
+	}
+}
+
 func (m *FastMatcher) matchExec(token tokenType, tokenData []byte, tokenDataLen int, node *ExecNode) error {
 	startPos := m.tokens.Position()
-	endPos := -1
 
 	// The start position needs to include the token we already parsed, so lets
 	// back up our position based on how long that is...
 	// TODO(brett19): We should probably find a more optimal way to handle this...
 	startPos -= tokenDataLen
 
-	if isLiteralToken(token) {
-		var litParse fastLitParser
-
-		// TODO(brett19): Move the litVal generation to be lazy-evaluated by the
-		// op execution below so we avoid performing any translations when the op
-		// is already resolved by something else.
-
-		// Parse the literal token from the tokenizer into a FastVal value
-		// to be used for op execution below.
-		litVal := litParse.Parse(token, tokenData)
+	var empty EmptyValues
+	if m.emptyAsMissing != 0 && node.After != nil {
+		empty = m.emptyTokenKind(token, tokenData)
+	}
 
-		for _, op := range node.Ops {
-			err := m.matchOp(&op, &litVal)
-			if err != nil {
-				return err
-			}
+	if (token == tknArrayStart || token == tknObjectStart) && node.program != nil && node.program.readsContainers {
+		if err := m.matchContainer(token, node.program); err != nil {
+			return err
+		}
+		if m.buckets.IsResolved(0) {
+			return nil
+		}
+	}
 
+	if isLiteralToken(token) {
+		// The literal is only parsed into a FastVal value if one of the ops
+		// below needs it, so that ops which have already been resolved by
+		// something else do not cost any translation.
+		if node.program != nil {
+			lit := activeLiteral{token: token, data: tokenData}
+			m.runProgram(node.program, &lit)
 			if m.buckets.IsResolved(0) {
 				return nil
 			}
 		}
 	} else if token == tknObjectStart {
+		if len(node.Loops) > 0 {
+			// Only within loops apply to objects.  They each read through the
+			// object from its start, and the elements get a pass of their own
+			// afterwards.
+			savePos := m.tokens.Position()
+
+			for _, loop := range node.Loops {
+				err := m.matchLoop(token, tokenData, &loop)
+				if err != nil {
+					return err
+				}
+
+				if m.buckets.IsResolved(0) {
+					return nil
+				}
+
+				m.tokens.Seek(savePos)
+			}
+		}
+
 		if len(node.Elems) == 0 {
 			// If we have no element handlers, we can just skip the whole thing...
 			m.skipValue(token)
@@ -561,7 +722,8 @@ func (m *FastMatcher) matchExec(token tokenType, tokenData []byte, tokenDataLen
 			err, shouldReturn := m.matchObjectOrArray(token, tokenData, node)
 			// should we do matchAfter when shouldReturn is true?
 			if err == nil && node.After != nil {
-				m.matchAfter(node.After)
+				m.storeSlot(node, startPos)
+				m.matchAfter(node.After, empty)
 			}
 
 			if shouldReturn {
@@ -612,36 +774,125 @@ func (m *FastMatcher) matchExec(token tokenType, tokenData []byte, tokenDataLen
 					return nil
 				}
 			}
+
+			// Elements which are read by their index get a pass of their own
+			// once the loops are done
+			if len(node.Elems) > 0 {
+				m.tokens.Seek(savePos)
+				err, shouldReturn := m.matchObjectOrArray(token, tokenData, node)
+				if shouldReturn {
+					return err
+				}
+			}
 		}
 	} else {
 		panic(fmt.Sprintf("invalid token read - tokenType: %v data: %v", token, string(tokenData)))
 	}
 
+	m.storeSlot(node, startPos)
+
 	if node.After != nil {
-		m.matchAfter(node.After)
+		m.matchAfter(node.After, empty)
 
 		if m.buckets.IsResolved(0) {
 			return nil
 		}
 	}
 
-	endPos = m.tokens.Position()
-
-	if node.StoreId > 0 {
-		slotData := &m.slots[node.StoreId-1]
-		slotData.start = startPos
-		slotData.size = endPos - startPos
-	}
-
 	return nil
 }
 
 // Returns an error code, and a boolean to dictate whether or not for the caller to return immediately
 func (m *FastMatcher) matchObjectOrArray(token tokenType, tokenData []byte, node *ExecNode) (error, bool) {
-	var keyLitParse fastLitParser
+	if token != tknObjectStart || len(node.Elems) == 0 {
+		return m.matchFields(token, tokenData, node, nil)
+	}
+
+	// Each object keeps its counts at the end of keyCounts while its fields
+	// are matched, so that they are freed when it ends
+	base := len(m.keyCounts)
+	for range node.Elems {
+		m.keyCounts = append(m.keyCounts, 0)
+	}
+	keyCounts := m.keyCounts[base:]
+	defer func() {
+		m.keyCounts = m.keyCounts[:base]
+	}()
+
+	if m.dupKeys != DuplicateKeysFirstWins {
+		if err := m.countKeys(node, keyCounts); err != nil {
+			return err, true
+		}
+	}
+	if m.dupKeys == DuplicateKeysError {
+		for i, count := range keyCounts {
+			if count > 1 {
+				return ErrorDuplicateKey, true
+			}
+			keyCounts[i] = 0
+		}
+	}
+	return m.matchFields(token, tokenData, node, keyCounts)
+}
+
+// countKeys counts how many values each of the keys of node has in the
+// object being matched, leaving the tokenizer where it was
+func (m *FastMatcher) countKeys(node *ExecNode, keyCounts []int32) error {
+	start := m.tokens.Position()
+	defer m.tokens.Seek(start)
+
+	for {
+		token, tokenData, tokenDataLen, err := m.tokens.Step()
+		if err != nil {
+			return err
+		}
+		if token == tknObjectEnd || token == tknEnd {
+			return nil
+		}
+		if token == tknListDelim {
+			continue
+		}
+		if token != tknString && token != tknEscString {
+			return ErrorJsonMalformed
+		}
+		keyBytes := m.tokens.ParseKey(token, tokenData, tokenDataLen)
+		if keyElem, keyIdx := node.elemTrie.Lookup(keyBytes); keyElem != nil {
+			keyCounts[keyIdx]++
+		}
+
+		if token, _, _, err = m.tokens.Step(); err != nil {
+			return err
+		} else if token != tknObjectKeyDelim {
+			return ErrorJsonMalformed
+		}
+		if token, _, _, err = m.tokens.Step(); err != nil {
+			return err
+		}
+		if err = m.skipValue(token); err != nil {
+			return err
+		}
+	}
+}
+
+// readKeyValue decides whether the value of a key of the expression is read
+// under the duplicate key policy, given how many of its values have been
+// read, or with DuplicateKeysLastWins are left
+func (m *FastMatcher) readKeyValue(keyCount *int32) bool {
+	if m.dupKeys == DuplicateKeysLastWins {
+		*keyCount--
+		return *keyCount == 0
+	}
+	*keyCount++
+	return *keyCount == 1
+}
+
+// matchFields matches the fields of an object or the elements of an array,
+// where keyCounts holds the counts of the keys of node for objects
+func (m *FastMatcher) matchFields(token tokenType, tokenData []byte, node *ExecNode, keyCounts []int32) (error, bool) {
 	var endToken tokenType
 	var arrayIndex int
 	var arrayMode bool
+	var indexKey [24]byte
 
 	switch token {
 	case tknObjectStart:
@@ -653,6 +904,16 @@ func (m *FastMatcher) matchObjectOrArray(token tokenType, tokenData []byte, node
 		panic("Unexpected type input for function call matchObjectOrArray")
 	}
 
+	// Once every key of the top level object which the expression refers to
+	// has been seen, the rest of the document cannot change the result
+	prefilter := !arrayMode && node == m.def.ParseNode && node.StoreId == 0
+	keysLeft := len(node.Elems)
+	if prefilter {
+		for i := range m.seenKeys {
+			m.seenKeys[i] = false
+		}
+	}
+
 	for i := 0; ; i++ {
 		// If this is not the first entry in the object, there should be a
 		// list delimiter ('c') that shows up in the input first.
@@ -681,19 +942,16 @@ func (m *FastMatcher) matchObjectOrArray(token tokenType, tokenData []byte, node
 		if err != nil {
 			return err, true
 		}
-		// Keep this here to catch any empty array or empty objs
+		// Keep this here to catch any empty array or empty objs, which still
+		// need their slot stored and their after node run like any other
 		if token == endToken {
-			return nil, true
+			return nil, false
 		}
 
-		// TODO(brett19): These byte-string conversion pieces are a bit wierd
-		var keyString string
 		var keyBytes []byte
 		switch token {
-		case tknString:
-			keyBytes = keyLitParse.ParseStringWLen(tokenData, tokenDataLen)
-		case tknEscString:
-			keyBytes = keyLitParse.ParseEscStringWLen(tokenData, tokenDataLen)
+		case tknString, tknEscString:
+			keyBytes = m.tokens.ParseKey(token, tokenData, tokenDataLen)
 		case tknArrayStart:
 			// Do nothing
 		case tknObjectStart:
@@ -707,7 +965,9 @@ func (m *FastMatcher) matchObjectOrArray(token tokenType, tokenData []byte, node
 
 		if arrayMode {
 			// Fake a key element by using the array index, and use the key as the actual value, tokenData
-			keyString = fmt.Sprintf("[%d]", arrayIndex)
+			keyBytes = append(indexKey[:0], '[')
+			keyBytes = strconv.AppendInt(keyBytes, int64(arrayIndex), 10)
+			keyBytes = append(keyBytes, ']')
 		} else {
 			token, tokenData, tokenDataLen, err = m.tokens.Step()
 			if err != nil {
@@ -722,19 +982,33 @@ func (m *FastMatcher) matchObjectOrArray(token tokenType, tokenData []byte, node
 			if err != nil {
 				return err, true
 			}
-			keyString = string(keyBytes)
 		}
 
-		if keyElem, ok := node.Elems[keyString]; ok {
+		keyElem, keyIdx := node.elemTrie.Lookup(keyBytes)
+		if keyElem != nil && keyCounts != nil && !m.readKeyValue(&keyCounts[keyIdx]) {
+			keyElem = nil
+		}
+
+		if keyElem != nil {
 			// Run the execution node that applies to this particular
 			// key of the object.
-			m.matchExec(token, tokenData, tokenDataLen, keyElem)
+			if err := m.matchExec(token, tokenData, tokenDataLen, keyElem); err != nil {
+				return err, true
+			}
 
 			// Check if running this keys execution has resolved the entirety
 			// of the expression, if so we can leave immediately.
 			if m.buckets.IsResolved(0) {
 				return nil, true
 			}
+
+			if prefilter && !m.seenKeys[keyIdx] {
+				m.seenKeys[keyIdx] = true
+				keysLeft--
+				if keysLeft == 0 {
+					return nil, false
+				}
+			}
 		} else {
 			// If we don't have any parse requirements for this key in
 			// the object, we can just skip its value and continue
@@ -745,12 +1019,58 @@ func (m *FastMatcher) matchObjectOrArray(token tokenType, tokenData []byte, node
 }
 
 func (m *FastMatcher) Match(data []byte) (bool, error) {
+	if m.readsJsonText() {
+		var err error
+		if data, err = m.normalizeText(data); err != nil {
+			m.metrics.record(false, err, 0)
+			return false, err
+		}
+	}
+	if m.concatenated != ConcatenatedIgnore {
+		if _, isJson := m.tokens.(*jsonTokenizer); isJson {
+			return m.matchConcatenated(data)
+		}
+	}
+	return m.matchValue(data)
+}
+
+// matchValue matches the first value of data
+func (m *FastMatcher) matchValue(data []byte) (bool, error) {
 	m.tokens.Reset(data)
 
 	if len(data) == 0 {
+		m.metrics.record(false, nil, 0)
 		return false, nil
 	}
 
+	return m.matchTokens()
+}
+
+// matchTokens evaluates the document the tokenizer was last reset to,
+// updating the metrics of the matcher if it has any
+func (m *FastMatcher) matchTokens() (bool, error) {
+	if m.metrics == nil {
+		return m.evalTokens()
+	}
+
+	m.metrics.start()
+	defer m.metrics.finish()
+	start := time.Now()
+	matched, err := m.evalTokens()
+	m.metrics.record(matched, err, time.Since(start))
+	return matched, err
+}
+
+func (m *FastMatcher) evalTokens() (bool, error) {
+	if m.def.ParseNode == nil {
+		// Definitions made only of expressions which are always true or
+		// always false have nothing to read from the document
+		return len(m.def.MatchBuckets) > 0 && m.def.MatchBuckets[0] == AlwaysTrueIdent, nil
+	}
+
+	m.arena.reset()
+	m.nowSet = false
+
 	token, tokenData, tokenDataLen, err := m.tokens.Step()
 	if err != nil {
 		return false, err
@@ -764,12 +1084,193 @@ func (m *FastMatcher) Match(data []byte) (bool, error) {
 	// Resolve any outstanding buckets in the tree.  This is required for
 	// operators such as NOT and NEOR to correctly be resolved.
 	m.buckets.Resolve()
+	if err := m.buckets.Err(); err != nil {
+		return false, err
+	}
 
 	return m.buckets.IsTrue(0), nil
 }
 
+// MatchWithOutputs matches a document in the same way as Match, and for
+// documents which matched also computes the outputs of the definition.  The
+// outputs are only valid until the next document is matched.  Fields which
+// are objects or arrays, or which are missing, give missing values.
+func (m *FastMatcher) MatchWithOutputs(data []byte) (bool, []FastVal, error) {
+	matched, err := m.Match(data)
+	if err != nil || !matched || m.def.outputProgram == nil {
+		return matched, nil, err
+	}
+
+	if len(m.outputs) < len(m.def.Outputs) {
+		m.outputs = make([]FastVal, len(m.def.Outputs))
+	}
+	m.runProgram(m.def.outputProgram, nil)
+	return true, m.outputs[:len(m.def.Outputs)], nil
+}
+
+// The fields of META() holding the key and expiry of the document
+const (
+	metaKeyField        = "id"
+	metaExpirationField = "expiration"
+)
+
+// DocumentMeta is the metadata of a document which is kept apart from its
+// body, such as by a database, and which expressions read through META()
+type DocumentMeta struct {
+	// Read as `META().id`
+	Key []byte
+	// Read as `META().expiration`, in seconds since the epoch, or 0 for a
+	// document which never expires
+	Expiration uint32
+}
+
+// appendMetaObject appends the fields of META() for a document, as
+// `{"META()":{"id":"<key>"` followed by the expiration when withExpiration
+// is set, leaving the outer object open
+func appendMetaObject(doc []byte, meta DocumentMeta, withExpiration bool) []byte {
+	const hexDigits = "0123456789abcdef"
+
+	doc = append(doc, `{"`+OperatorMeta+`()":{"`+metaKeyField+`":"`...)
+	for _, c := range meta.Key {
+		switch {
+		case c == '"' || c == '\\':
+			doc = append(doc, '\\', c)
+		case c < 0x20:
+			doc = append(doc, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			doc = append(doc, c)
+		}
+	}
+	doc = append(doc, '"')
+	if withExpiration {
+		doc = append(doc, `,"`+metaExpirationField+`":`...)
+		doc = strconv.AppendUint(doc, uint64(meta.Expiration), 10)
+	}
+	return append(doc, '}')
+}
+
+// appendKeyDocument appends a JSON document holding only a key, as
+// `{"META()":{"id":"<key>"}}`
+func appendKeyDocument(doc, key []byte) []byte {
+	doc = appendMetaObject(doc, DocumentMeta{Key: key}, false)
+	return append(doc, '}')
+}
+
+// appendMetaDocument appends a JSON document holding the fields of META()
+// for a document followed by the fields of its body.  Bodies which are not
+// objects add no fields.
+func appendMetaDocument(doc []byte, meta DocumentMeta, body []byte) []byte {
+	doc = appendMetaObject(doc, meta, true)
+	return appendObjectFields(doc, body, false)
+}
+
+// appendObjectFields appends the fields of body to an object whose fields
+// are being written, and closes it.  Bodies which are not objects add no
+// fields.
+func appendObjectFields(doc, body []byte, first bool) []byte {
+	body = bytes.TrimLeft(body, " \t\r\n")
+	if len(body) == 0 || body[0] != '{' {
+		return append(doc, '}')
+	}
+	body = body[1:]
+	if rest := bytes.TrimLeft(body, " \t\r\n"); !first && len(rest) > 0 && rest[0] != '}' {
+		doc = append(doc, ',')
+	}
+	return append(doc, body...)
+}
+
+// appendInputsDocument appends a JSON document holding each of the named
+// inputs other than the document being matched as a `$name` field, followed
+// by the fields of that document
+func appendInputsDocument(doc []byte, inputs map[string][]byte) ([]byte, error) {
+	names := make([]string, 0, len(inputs))
+	for name := range inputs {
+		if !fmtIdentRegex.MatchString(name) {
+			return doc, ErrorInputName
+		}
+		if name != OperatorDoc {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	doc = append(doc, '{')
+	for i, name := range names {
+		// Inputs are written into the document as they are, so they have to
+		// be checked to hold a single value which cannot add fields of its own
+		input := inputs[name]
+		if !json.Valid(input) {
+			return doc, ErrorJsonMalformed
+		}
+		if i > 0 {
+			doc = append(doc, ',')
+		}
+		doc = append(doc, `"`+OperatorInput...)
+		doc = append(doc, name...)
+		doc = append(doc, `":`...)
+		doc = append(doc, input...)
+	}
+	return appendObjectFields(doc, inputs[OperatorDoc], len(names) == 0), nil
+}
+
+// matchMetaDocument matches the document built in keyDoc, which is always
+// JSON whatever format the matcher otherwise reads
+func (m *FastMatcher) matchMetaDocument() (bool, error) {
+	tokens, skipper, textIntegers := m.tokens, m.skipper, m.textIntegers
+	m.tokens, m.skipper, m.textIntegers = &m.keyTokens, &m.keyTokens, true
+	defer func() {
+		m.tokens, m.skipper, m.textIntegers = tokens, skipper, textIntegers
+	}()
+
+	m.tokens.Reset(m.keyDoc)
+	return m.matchTokens()
+}
+
+// MatchKey matches a document by its key alone, for definitions which only
+// read `META().id` as reported by MatchDef.KeyOnly.  The body of the
+// document is never read, so filters on keys are much cheaper this way than
+// by matching a body holding the key.  Other definitions give
+// ErrorNotKeyOnly.
+func (m *FastMatcher) MatchKey(key []byte) (bool, error) {
+	if !m.def.keyOnly {
+		return false, ErrorNotKeyOnly
+	}
+
+	m.keyDoc = appendKeyDocument(m.keyDoc[:0], key)
+	return m.matchMetaDocument()
+}
+
+// MatchWithMeta matches a JSON document whose metadata is supplied apart
+// from its body, so that expressions such as
+// `META().expiration * 1000 > NOW_MILLIS()` can filter on it.  The body must
+// be JSON, and should not have a `META()` field of its own.
+func (m *FastMatcher) MatchWithMeta(meta DocumentMeta, data []byte) (bool, error) {
+	m.keyDoc = appendMetaDocument(m.keyDoc[:0], meta, data)
+	return m.matchMetaDocument()
+}
+
+// MatchInputs matches several named JSON documents at once, for expressions
+// which compare documents with each other such as `$doc.total = $order.total`.
+// The document named `doc` is the one whose fields are read without naming
+// it, and the others are read as `$name.field`.  Missing inputs are treated
+// as documents with no fields.
+func (m *FastMatcher) MatchInputs(inputs map[string][]byte) (bool, error) {
+	var err error
+	m.keyDoc, err = appendInputsDocument(m.keyDoc[:0], inputs)
+	if err != nil {
+		return false, err
+	}
+	return m.matchMetaDocument()
+}
+
 func (m *FastMatcher) ExpressionMatched(expressionIdx int) bool {
 	binTreeIdx := m.def.MatchBuckets[expressionIdx]
+	switch binTreeIdx {
+	case AlwaysTrueIdent:
+		return true
+	case AlwaysFalseIdent:
+		return false
+	}
 	return m.buckets.IsResolved(binTreeIdx) &&
 		m.buckets.IsTrue(binTreeIdx)
 }
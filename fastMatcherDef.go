@@ -72,6 +72,7 @@ const (
 	OpTypeExists
 	OpTypeIn
 	OpTypeMatches
+	OpTypeStrictEquals
 )
 
 func (value OpType) String() string {
@@ -92,6 +93,8 @@ func (value OpType) String() string {
 		return "exists"
 	case OpTypeMatches:
 		return "matches"
+	case OpTypeStrictEquals:
+		return "seq"
 	}
 
 	return "??unknown??"
@@ -118,6 +121,11 @@ const (
 	LoopTypeAny LoopType = iota
 	LoopTypeEvery
 	LoopTypeAnyEvery
+	// Loops over every value nested within the target, at any depth
+	LoopTypeAnyWithin
+	// Stops at the first element which matches, like LoopTypeAny, keeping
+	// the value captured from that element
+	LoopTypeFirst
 )
 
 func (value LoopType) String() string {
@@ -128,6 +136,10 @@ func (value LoopType) String() string {
 		return "every"
 	case LoopTypeAnyEvery:
 		return "anyevery"
+	case LoopTypeAnyWithin:
+		return "anywithin"
+	case LoopTypeFirst:
+		return "first"
 	}
 
 	return "??unknown??"
@@ -138,11 +150,19 @@ type LoopNode struct {
 	Mode      LoopType
 	Target    DataRef
 	Node      *ExecNode
+	// The slot which FIRST loops capture their result into, it is cleared
+	// unless an element matched
+	Capture SlotID
 }
 
 func (node *LoopNode) String() string {
+	target := dataRefToString(node.Target)
+	if node.Capture > 0 {
+		target += fmt.Sprintf(" capture $%d", node.Capture)
+	}
+
 	out := ""
-	out += fmt.Sprintf("[%d] :%s in %s:\n", node.BucketIdx, node.Mode, dataRefToString(node.Target))
+	out += fmt.Sprintf("[%d] :%s in %s:\n", node.BucketIdx, node.Mode, target)
 	out += reindentString(node.Node.String(), "  ")
 	return out
 }
@@ -150,6 +170,8 @@ func (node *LoopNode) String() string {
 type AfterNode struct {
 	Ops   []OpNode
 	Loops []LoopNode
+
+	program *matchProgram
 }
 
 type ExecNode struct {
@@ -158,6 +180,9 @@ type ExecNode struct {
 	Ops     []OpNode
 	Loops   []LoopNode
 	After   *AfterNode
+
+	program  *matchProgram
+	elemTrie *fieldTrie
 }
 
 type MatchDef struct {
@@ -166,6 +191,12 @@ type MatchDef struct {
 	MatchBuckets []int
 	NumBuckets   int
 	NumSlots     int
+	// Values computed for each matched document, see TransformWithOutputs
+	Outputs []DataRef
+
+	compiled      bool
+	outputProgram *matchProgram
+	keyOnly       bool
 }
 
 func (def MatchDef) String() string {
@@ -183,9 +214,261 @@ func (def MatchDef) String() string {
 	}
 	out += fmt.Sprintf("num buckets: %d\n", def.NumBuckets)
 	out += fmt.Sprintf("num slots: %d\n", def.NumSlots)
+	if len(def.Outputs) > 0 {
+		out += "outputs:\n"
+		for i, output := range def.Outputs {
+			out += fmt.Sprintf("  %d: %v\n", i, output)
+		}
+	}
 	return strings.TrimRight(out, "\n")
 }
 
+// TopLevelKeys returns the keys of the top level object which can affect the
+// result of the match.  The matcher skips over the values of other keys
+// without parsing them, and stops reading a document once each of these keys
+// has been seen.  The result is false when the whole document is needed.
+func (def *MatchDef) TopLevelKeys() ([]string, bool) {
+	node := def.ParseNode
+	if node == nil {
+		return nil, true
+	}
+	if node.StoreId > 0 || len(node.Ops) > 0 || len(node.Loops) > 0 {
+		return nil, false
+	}
+
+	keys := make([]string, 0, len(node.Elems))
+	for key := range node.Elems {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, true
+}
+
+// KeyOnly returns whether the definition reads nothing of a document other
+// than its key, `META().id`, in which case documents can be matched by their
+// key alone with FastMatcher.MatchKey, without reading their body.
+func (def *MatchDef) KeyOnly() bool {
+	if !def.compiled {
+		return def.readsOnlyKey()
+	}
+	return def.keyOnly
+}
+
+func (def *MatchDef) readsOnlyKey() bool {
+	node := def.ParseNode
+	if node == nil {
+		return true
+	}
+	if node.StoreId > 0 || len(node.Ops) > 0 || len(node.Loops) > 0 || len(node.Elems) > 1 {
+		return false
+	}
+	if len(node.Elems) == 0 {
+		return node.After == nil
+	}
+
+	meta := node.Elems[OperatorMeta+"()"]
+	if meta == nil || meta.StoreId > 0 || len(meta.Ops) > 0 || len(meta.Loops) > 0 {
+		return false
+	}
+	return len(meta.Elems) == 1 && meta.Elems[metaKeyField] != nil
+}
+
+// Validate checks that the parts of a MatchDef are consistent with each
+// other, so that a definition which was decoded or built by hand can be
+// rejected before use instead of failing while matching documents
+func (def *MatchDef) Validate() error {
+	if def.NumBuckets != len(def.MatchTree.data) {
+		return fmt.Errorf("%v: %d buckets for a tree of %d nodes", ErrorMatchDefInvalid, def.NumBuckets, len(def.MatchTree.data))
+	}
+	if def.NumSlots < 0 {
+		return fmt.Errorf("%v: negative slot count", ErrorMatchDefInvalid)
+	}
+
+	if len(def.MatchTree.data) > 0 {
+		if err := def.MatchTree.Validate(); err != nil {
+			return fmt.Errorf("%v: %v", ErrorMatchDefInvalid, err)
+		}
+	}
+
+	for i, bucket := range def.MatchBuckets {
+		if bucket == AlwaysTrueIdent || bucket == AlwaysFalseIdent {
+			continue
+		}
+		if bucket < 0 || bucket >= def.NumBuckets {
+			return fmt.Errorf("%v: match bucket %d refers to missing bucket %d", ErrorMatchDefInvalid, i, bucket)
+		}
+	}
+
+	if def.ParseNode == nil {
+		return nil
+	}
+	v := matchDefValidator{def: def, seen: make(map[*ExecNode]bool)}
+	return v.execNode(def.ParseNode)
+}
+
+type matchDefValidator struct {
+	def *MatchDef
+	// Nodes which have already been checked, as each may appear only once
+	seen map[*ExecNode]bool
+}
+
+func (v *matchDefValidator) fail(format string, args ...interface{}) error {
+	return fmt.Errorf("%v: %s", ErrorMatchDefInvalid, fmt.Sprintf(format, args...))
+}
+
+func (v *matchDefValidator) bucket(bucket BucketID) error {
+	if bucket < 0 || int(bucket) >= v.def.NumBuckets {
+		return v.fail("bucket %d is outside the tree", bucket)
+	}
+	return nil
+}
+
+func (v *matchDefValidator) slot(slot SlotID) error {
+	if slot <= 0 || int(slot) > v.def.NumSlots {
+		return v.fail("slot %d does not exist", slot)
+	}
+	return nil
+}
+
+func (v *matchDefValidator) dataRef(ref DataRef) error {
+	switch ref := ref.(type) {
+	case nil, FastVal, activeLitRef:
+		return nil
+	case SlotRef:
+		return v.slot(ref.Slot)
+	case FuncRef:
+		if ref.FuncName == NowMillisFunc {
+			if len(ref.Params) != 0 {
+				return v.fail("function %s takes 0 parameters, not %d", ref.FuncName, len(ref.Params))
+			}
+			return nil
+		}
+		impl, ok := vmFuncs[ref.FuncName]
+		if !ok {
+			return v.fail("unknown function %s", ref.FuncName)
+		}
+		numParams := 1
+		if impl.fn2 != nil {
+			numParams = 2
+		}
+		if len(ref.Params) != numParams {
+			return v.fail("function %s takes %d parameters, not %d", ref.FuncName, numParams, len(ref.Params))
+		}
+		for _, param := range ref.Params {
+			if err := v.dataRef(param); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return v.fail("unexpected value %v", ref)
+}
+
+func (v *matchDefValidator) ops(ops []OpNode) error {
+	for _, op := range ops {
+		if err := v.bucket(op.BucketIdx); err != nil {
+			return err
+		}
+		if v.def.MatchTree.data[op.BucketIdx].NodeType != nodeTypeLeaf {
+			return v.fail("op marks bucket %d which is not a leaf", op.BucketIdx)
+		}
+
+		switch op.Op {
+		case OpTypeExists:
+			continue
+		case OpTypeEquals, OpTypeLessThan, OpTypeLessEquals, OpTypeGreaterThan, OpTypeGreaterEquals, OpTypeMatches, OpTypeStrictEquals:
+		default:
+			return v.fail("op type %s is not supported", op.Op)
+		}
+
+		if err := v.dataRef(op.Lhs); err != nil {
+			return err
+		}
+		if err := v.dataRef(op.Rhs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *matchDefValidator) loops(loops []LoopNode, after bool) error {
+	for _, loop := range loops {
+		if err := v.bucket(loop.BucketIdx); err != nil {
+			return err
+		}
+		parentIdx := v.def.MatchTree.data[loop.BucketIdx].ParentIdx
+		if loop.BucketIdx == 0 || v.def.MatchTree.data[parentIdx].NodeType != nodeTypeLoop {
+			return v.fail("loop bucket %d is not below a loop node", loop.BucketIdx)
+		}
+		if loop.Mode < LoopTypeAny || loop.Mode > LoopTypeFirst {
+			return v.fail("loop of bucket %d has unknown mode %d", loop.BucketIdx, loop.Mode)
+		}
+		if loop.Capture > 0 {
+			if err := v.slot(loop.Capture); err != nil {
+				return err
+			}
+		}
+
+		// Loops after an object run over a stored value, whereas others run
+		// over the value being matched
+		if slot, ok := loop.Target.(SlotRef); ok && after {
+			if err := v.slot(slot.Slot); err != nil {
+				return err
+			}
+		} else if after || loop.Target != nil {
+			return v.fail("loop of bucket %d has an invalid target", loop.BucketIdx)
+		}
+
+		if loop.Node == nil {
+			return v.fail("loop of bucket %d has no node", loop.BucketIdx)
+		}
+		if err := v.execNode(loop.Node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *matchDefValidator) execNode(node *ExecNode) error {
+	if v.seen[node] {
+		return v.fail("exec node is used more than once")
+	}
+	v.seen[node] = true
+
+	if node.StoreId != 0 {
+		if err := v.slot(node.StoreId); err != nil {
+			return err
+		}
+	}
+
+	if err := v.ops(node.Ops); err != nil {
+		return err
+	}
+	if err := v.loops(node.Loops, false); err != nil {
+		return err
+	}
+
+	for _, key := range sortedExecNodeKeys(node.Elems) {
+		elem := node.Elems[key]
+		if elem == nil {
+			return v.fail("element %s has no node", key)
+		}
+		if err := v.execNode(elem); err != nil {
+			return err
+		}
+	}
+
+	if node.After != nil {
+		if err := v.ops(node.After.Ops); err != nil {
+			return err
+		}
+		if err := v.loops(node.After.Loops, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (node ExecNode) String() string {
 	var out string
 	if node.StoreId > 0 {
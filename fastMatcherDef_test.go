@@ -0,0 +1,109 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchDefValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	newDef := func() *MatchDef {
+		var trans Transformer
+		return trans.Transform([]Expression{AndExpr{
+			EqualsExpr{FieldExpr{Root: 0, Path: []string{"name"}}, ValueExpr{"Neil"}},
+			GreaterThanExpr{
+				FuncExpr{MathFuncAbs, []Expression{FieldExpr{Root: 0, Path: []string{"age"}}}},
+				FieldExpr{Root: 0, Path: []string{"min"}},
+			},
+			AnyInExpr{
+				VarId:   1,
+				InExpr:  FieldExpr{Root: 0, Path: []string{"tags"}},
+				SubExpr: EqualsExpr{FieldExpr{Root: 1}, ValueExpr{"a"}},
+			},
+		}})
+	}
+
+	def := newDef()
+	assert.Nil(def.Validate())
+
+	data, err := MarshalMatchDefProto(def)
+	assert.Nil(err)
+	decoded, err := UnmarshalMatchDefProto(data)
+	assert.Nil(err)
+	assert.Nil(decoded.Validate())
+
+	assert.Nil((&MatchDef{}).Validate())
+
+	invalidDefs := map[string]func(def *MatchDef){
+		"bucket count": func(def *MatchDef) {
+			def.NumBuckets++
+		},
+		"match bucket": func(def *MatchDef) {
+			def.MatchBuckets[0] = def.NumBuckets
+		},
+		"tree": func(def *MatchDef) {
+			def.MatchTree.data[1].ParentIdx = 5
+		},
+		"op bucket": func(def *MatchDef) {
+			def.ParseNode.Elems["name"].Ops[0].BucketIdx = BucketID(def.NumBuckets)
+		},
+		"op on inner node": func(def *MatchDef) {
+			def.ParseNode.Elems["name"].Ops[0].BucketIdx = 0
+		},
+		"op type": func(def *MatchDef) {
+			def.ParseNode.Elems["name"].Ops[0].Op = OpTypeIn
+		},
+		"slot": func(def *MatchDef) {
+			def.NumSlots = 0
+		},
+		"function": func(def *MatchDef) {
+			for _, op := range def.ParseNode.After.Ops {
+				op.Lhs = FuncRef{"nope", []DataRef{SlotRef{1}}}
+				def.ParseNode.After.Ops[0] = op
+			}
+		},
+		"loop target": func(def *MatchDef) {
+			def.ParseNode.Elems["tags"].Loops[0].Target = SlotRef{1}
+		},
+		"shared node": func(def *MatchDef) {
+			def.ParseNode.Elems["min"] = def.ParseNode.Elems["name"]
+		},
+	}
+	for name, breakDef := range invalidDefs {
+		def := newDef()
+		breakDef(def)
+		err := def.Validate()
+		if assert.NotNil(err, name) {
+			assert.Contains(err.Error(), ErrorMatchDefInvalid.Error(), name)
+		}
+	}
+}
+
+func TestMatchDefStringStable(t *testing.T) {
+	assert := assert.New(t)
+
+	// Strings are quoted, so that values of different types which would
+	// otherwise look the same give different keys
+	assert.Equal(`$doc.a = "5"`, EqualsExpr{FieldExpr{Root: 0, Path: []string{"a"}}, ValueExpr{"5"}}.String())
+	assert.Equal(`$doc.a = 5`, EqualsExpr{FieldExpr{Root: 0, Path: []string{"a"}}, ValueExpr{5}}.String())
+	assert.Equal(`"2018-01-02"`, TimeExpr{"2018-01-02"}.String())
+
+	// Floats keep every digit needed to tell them apart
+	assert.Equal("(float)1e-07", NewFloatFastVal(1e-7).String())
+	assert.Equal("(float)2.5", NewFloatFastVal(2.5).String())
+
+	var exprs []Expression
+	for _, key := range []string{"k", "c", "x", "a", "m", "b", "z", "q"} {
+		exprs = append(exprs, EqualsExpr{FieldExpr{Root: 0, Path: []string{key}}, ValueExpr{key}})
+	}
+	var trans Transformer
+	first := trans.Transform(exprs).String()
+	for i := 0; i < 20; i++ {
+		var trans Transformer
+		assert.Equal(first, trans.Transform(exprs).String())
+	}
+}
@@ -4,12 +4,22 @@ package gojsonsm
 
 import (
 	"encoding/json"
+	"math"
 	"sort"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func runExprMatchTest(t *testing.T, expr Expression, expectedDocIDs []string) {
+	runExprMatchTestMode(t, expr, expectedDocIDs, false)
+	// Evaluating every clause must never change which documents match
+	runExprMatchTestMode(t, expr, expectedDocIDs, true)
+}
+
+func runExprMatchTestMode(t *testing.T, expr Expression, expectedDocIDs []string, exhaustive bool) {
 	parseDocID := func(docBytes []byte) string {
 		var data struct {
 			ID string `json:"_id"`
@@ -20,8 +30,11 @@ func runExprMatchTest(t *testing.T, expr Expression, expectedDocIDs []string) {
 
 	docs := getTestPeopleDocs()
 
-	var trans Transformer
+	trans := Transformer{Exhaustive: exhaustive}
 	matchDef := trans.Transform([]Expression{expr})
+	if err := matchDef.Validate(); err != nil {
+		t.Errorf("Invalid match definition: %s", err)
+	}
 
 	var matchedDocIDs []string
 
@@ -61,7 +74,7 @@ func runExprMatchTest(t *testing.T, expr Expression, expectedDocIDs []string) {
 	}
 
 	if !documentsMatched {
-		t.Errorf("Matched documents did not match expectations:")
+		t.Errorf("Matched documents did not match expectations (exhaustive=%v):", exhaustive)
 		t.Errorf("  Expected: %s", strings.Join(expectedDocIDs, ", "))
 		t.Errorf("  Matched: %s", strings.Join(matchedDocIDs, ", "))
 		t.Errorf("  Match Tree:")
@@ -355,6 +368,231 @@ func TestMatcherCrossScopeLoop(t *testing.T) {
 	})
 }
 
+func TestMatcherLoopMissingField(t *testing.T) {
+	// Fields missing from an element are treated as not matching, the same
+	// as fields missing from the document are
+	runJSONExprMatchTest(t, `
+		["anyin",
+			1,
+			["field", "friends"],
+			["not",
+				["equals",
+					["field", 1, "nickname"],
+					["value", "Bob"]
+				]
+			]
+		]
+	`, []string{
+		"5b47eb091f57571d3c3b1aa1",
+		"5b47eb0936ff92a567a0307e",
+		"5b47eb093771f06ced629663",
+		"5b47eb0950e9076fc0aecd52",
+		"5b47eb095c3ad73b9925f7f8",
+		"5b47eb0962222a37d066e231",
+		"5b47eb096b1d911c0b9492fb",
+		"5b47eb098eee4b4c4330ec64",
+		"5b47eb09996a4154c35b2f98",
+		"5b47eb09ffac5a6ce37042e7",
+	})
+}
+
+func TestMatcherLoopElementFields(t *testing.T) {
+	assert := assert.New(t)
+
+	field := func(root VariableID, path ...string) FieldExpr {
+		return FieldExpr{Root: root, Path: path}
+	}
+	match := func(expr Expression, doc string) bool {
+		var trans Transformer
+		m := NewFastMatcher(trans.Transform([]Expression{expr}))
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err)
+		return matched
+	}
+
+	// Fields an element does not have are missing, rather than keeping the
+	// values of the element before
+	expr := AnyInExpr{1, field(0, "c"), EqualsExpr{field(1, "c"), field(1, "b")}}
+	assert.True(match(expr, `{"c":[{"c":-1},6.75]}`))
+	assert.False(match(expr, `{"c":[{"c":-1},{"b":1}]}`))
+
+	// Elements are still read by their index when the array is looped over
+	expr2 := AndExpr{
+		ExistsExpr{field(0, "a", "[1]")},
+		AnyInExpr{1, field(0, "a"), EqualsExpr{field(1), ValueExpr{1}}},
+	}
+	assert.True(match(expr2, `{"a":[1,{}]}`))
+	assert.False(match(expr2, `{"a":[1]}`))
+}
+
+func TestMatcherAnyWithin(t *testing.T) {
+	runJSONExprMatchTest(t, `
+		["anywithin",
+			1,
+			["field", 0],
+			["equals",
+				["field", 1, "name"],
+				["value", "Wright Farley"]
+			]
+		]
+	`, []string{
+		"5b47eb0936ff92a567a0307e",
+	})
+
+	runJSONExprMatchTest(t, `
+		["anywithin",
+			1,
+			["field", "nestedArray"],
+			["equals",
+				["field", 1],
+				["value", "l"]
+			]
+		]
+	`, []string{
+		"5b47eb096b1d911c0b9492fb",
+	})
+
+	// Loops over the whole document alongside fields of it
+	runJSONExprMatchTest(t, `
+		["and",
+			["anywithin",
+				1,
+				["field", 0],
+				["equals",
+					["field", 1, "name"],
+					["value", "Bird Richmond"]
+				]
+			],
+			["lessthan",
+				["field", "age"],
+				["value", 30]
+			]
+		]
+	`, []string{
+		"5b47eb096b1d911c0b9492fb",
+	})
+
+	runJSONExprMatchTest(t, `
+		["anywithin",
+			1,
+			["field", "friends"],
+			["equals",
+				["field", 1, "id"],
+				["field", "index"]
+			]
+		]
+	`, []string{
+		"5b47eb0936ff92a567a0307e",
+		"5b47eb096b1d911c0b9492fb",
+		"5b47eb0950e9076fc0aecd52",
+	})
+}
+
+func TestMatcherAnyWithinNesting(t *testing.T) {
+	assert := assert.New(t)
+
+	expr := AndExpr{
+		AnyWithinExpr{
+			VarId:   1,
+			InExpr:  FieldExpr{Root: 0},
+			SubExpr: EqualsExpr{FieldExpr{Root: 1, Path: []string{"type"}}, ValueExpr{"error"}},
+		},
+		EqualsExpr{FieldExpr{Root: 0, Path: []string{"last"}}, ValueExpr{"yes"}},
+	}
+	tests := map[string]bool{
+		// The document itself is not one of the values within it
+		`{"type":"error","last":"yes"}`:                                                false,
+		`{"a":{"type":"error"},"last":"yes"}`:                                          true,
+		`{"a":[[],{},[{"b":{"type":"error","more":[1,{"c":"d"}]}}],"e"],"last":"yes"}`: true,
+		`{"a":{"x\"y":[{"type":"info"},{"type":"err\u006fr"}]},"last":"yes"}`:          true,
+		`{"a":[{"type":"info"},{"b":"error"}],"last":"yes"}`:                           false,
+		`{"a":{"type":"error"},"last":"no"}`:                                           false,
+		`{"last":"yes","a":[{"type":"error"}]}`:                                        true,
+		`{"a":[],"b":{},"c":"error","last":"yes"}`:                                     false,
+		`{"a":[{"b":[{"c":[{"type":"error"}]}]}],"z":[{"type":"error"}],"last":"yes"}`: true,
+	}
+
+	var trans Transformer
+	m := NewFastMatcher(trans.Transform([]Expression{expr}))
+	for doc, expected := range tests {
+		m.Reset()
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err, doc)
+		assert.Equal(expected, matched, doc)
+	}
+}
+
+func TestMatcherFirstIn(t *testing.T) {
+	assert := assert.New(t)
+
+	primaryEmail := FirstInExpr{
+		VarId:      1,
+		InExpr:     FieldExpr{Root: 0, Path: []string{"contacts"}},
+		ResultExpr: FieldExpr{Root: 1, Path: []string{"email"}},
+		SubExpr:    EqualsExpr{FieldExpr{Root: 1, Path: []string{"primary"}}, ValueExpr{true}},
+	}
+	firstTag := FirstInExpr{
+		VarId:      1,
+		InExpr:     FieldExpr{Root: 0, Path: []string{"tags"}},
+		ResultExpr: FieldExpr{Root: 1},
+	}
+
+	tests := []struct {
+		expr     Expression
+		doc      string
+		expected bool
+	}{
+		{EqualsExpr{primaryEmail, ValueExpr{"a@x"}}, `{"contacts":[{"primary":false,"email":"b@x"},{"primary":true,"email":"a@x"}]}`, true},
+		{EqualsExpr{primaryEmail, ValueExpr{"a@x"}}, `{"contacts":[{"email":"a@x","primary":true}]}`, true},
+		// Only the first element which matches is compared
+		{EqualsExpr{primaryEmail, ValueExpr{"a@x"}}, `{"contacts":[{"primary":true,"email":"c@x"},{"primary":true,"email":"a@x"}]}`, false},
+		{EqualsExpr{primaryEmail, ValueExpr{"a@x"}}, `{"contacts":[{"primary":true},{"primary":true,"email":"a@x"}]}`, false},
+		{EqualsExpr{primaryEmail, ValueExpr{"a@x"}}, `{"contacts":[{"primary":false,"email":"a@x"}]}`, false},
+		{EqualsExpr{primaryEmail, ValueExpr{"a@x"}}, `{"contacts":"a@x"}`, false},
+		{EqualsExpr{primaryEmail, ValueExpr{"a@x"}}, `{}`, false},
+		{EqualsExpr{ValueExpr{"a@x"}, primaryEmail}, `{"contacts":[{"primary":true,"email":"a@x"}]}`, true},
+		{EqualsExpr{primaryEmail, FieldExpr{Root: 0, Path: []string{"login"}}}, `{"contacts":[{"primary":true,"email":"a@x"}],"login":"a@x"}`, true},
+		{EqualsExpr{primaryEmail, FieldExpr{Root: 0, Path: []string{"login"}}}, `{"login":"a@x","contacts":[{"primary":true,"email":"b@x"}]}`, false},
+		{NotExistsExpr{primaryEmail}, `{"contacts":[{"primary":false,"email":"a@x"}]}`, true},
+		{NotExistsExpr{primaryEmail}, `{"contacts":[{"primary":true,"email":"a@x"}]}`, false},
+		{EqualsExpr{firstTag, ValueExpr{"red"}}, `{"tags":["red","blue"]}`, true},
+		{EqualsExpr{firstTag, ValueExpr{"red"}}, `{"tags":["blue","red"]}`, false},
+		{EqualsExpr{firstTag, ValueExpr{"red"}}, `{"tags":[]}`, false},
+		{GreaterThanExpr{firstTag, ValueExpr{3}}, `{"tags":[{"a":5},4]}`, false},
+		{GreaterThanExpr{firstTag, ValueExpr{3}}, `{"tags":[4,{"a":5}]}`, true},
+		// Captures do not carry over from one element of an outer loop to the next
+		{
+			AnyInExpr{
+				VarId:  2,
+				InExpr: FieldExpr{Root: 0, Path: []string{"groups"}},
+				SubExpr: EqualsExpr{
+					FirstInExpr{
+						VarId:      3,
+						InExpr:     FieldExpr{Root: 2, Path: []string{"tags"}},
+						ResultExpr: FieldExpr{Root: 3},
+					},
+					FieldExpr{Root: 0, Path: []string{"tag"}},
+				},
+			},
+			`{"groups":[{"tags":["a"]},{"tags":"b"}],"tag":"b"}`,
+			false,
+		},
+	}
+
+	for _, exhaustive := range []bool{false, true} {
+		for _, test := range tests {
+			trans := Transformer{Exhaustive: exhaustive}
+			def := trans.Transform([]Expression{test.expr})
+			assert.Nil(def.Validate(), test.expr.String())
+
+			m := NewFastMatcher(def)
+			matched, err := m.Match([]byte(test.doc))
+			assert.Nil(err, test.doc)
+			assert.Equal(test.expected, matched, "%s\n%s", test.expr, test.doc)
+		}
+	}
+}
+
 func TestMatcherEqualsFunc(t *testing.T) {
 	runJSONExprMatchTest(t, `
 	["equals",
@@ -368,3 +606,576 @@ func TestMatcherEqualsFunc(t *testing.T) {
 		"5b47eb093771f06ced629663",
 	})
 }
+
+func TestMatcherTopLevelKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseFilterExpression(`name = "Neil" AND NOT age > 40`)
+	assert.Nil(err)
+
+	var trans Transformer
+	matchDef := trans.Transform([]Expression{expr})
+	keys, ok := matchDef.TopLevelKeys()
+	assert.True(ok)
+	assert.Equal([]string{"age", "name"}, keys)
+
+	m := NewFastMatcher(matchDef)
+	matched, err := m.Match([]byte(`{"other": {"a": ["]", "\\\"}"]}, "name": "Neil", "more": [[{}]], "age": 31}`))
+	assert.Nil(err)
+	assert.True(matched)
+
+	// The rest of the document is not read once both keys have been seen,
+	// even though the value of name leaves the expression unresolved
+	m.Reset()
+	matched, err = m.Match([]byte(`{"age": 31, "name": {"first": "Neil"}, "more": ][`))
+	assert.Nil(err)
+	assert.False(matched)
+
+	m.Reset()
+	matched, err = m.Match([]byte(`{"name": "Neil"}`))
+	assert.Nil(err)
+	assert.True(matched)
+
+	matchDef = trans.Transform([]Expression{EqualsExpr{FieldExpr{Root: 0}, ValueExpr{1}}})
+	_, ok = matchDef.TopLevelKeys()
+	assert.False(ok)
+}
+
+func TestMatcherMalformedMatchTree(t *testing.T) {
+	assert := assert.New(t)
+
+	def := &MatchDef{
+		ParseNode: &ExecNode{
+			Elems: map[string]*ExecNode{
+				"age": {
+					Ops: []OpNode{
+						{BucketIdx: 1, Op: OpTypeGreaterThan, Rhs: NewIntFastVal(30)},
+					},
+				},
+			},
+		},
+		MatchTree: binTree{data: []binTreeNode{
+			*NewBinTreeNode(BinTreeNodeType(99), 0, 1, 2),
+			*NewBinTreeNode(nodeTypeLeaf, 0, 0, 0),
+			*NewBinTreeNode(nodeTypeLeaf, 0, 0, 0),
+		}},
+		MatchBuckets: []int{0},
+		NumBuckets:   3,
+	}
+
+	m := NewFastMatcher(def)
+	matched, err := m.Match([]byte(`{"name":"Brett","age":31}`))
+	assert.Equal(ErrorMatchTreeInvalidNode, err)
+	assert.False(matched)
+}
+
+func TestMatchWithOutputs(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseFilterExpression("type = \"order\"")
+	if !assert.Nil(err) {
+		return
+	}
+	outputs := []Expression{
+		FuncExpr{MathFuncMul, []Expression{FieldExpr{0, []string{"price"}}, FieldExpr{0, []string{"qty"}}}},
+		FieldExpr{0, []string{"customer", "name"}},
+		FieldExpr{0, []string{"items"}},
+		ValueExpr{"fixed"},
+	}
+
+	var trans Transformer
+	def, err := trans.TransformWithOutputs([]Expression{expr}, outputs)
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal(1, len(def.MatchBuckets))
+	m := NewFastMatcher(def)
+
+	// The fields the outputs need come after the type which decides the match
+	matched, values, err := m.MatchWithOutputs([]byte(`{"type":"order","items":[1],"price":2.5,"customer":{"name":"a"},"qty":4}`))
+	assert.Nil(err)
+	assert.True(matched)
+	if assert.Equal(4, len(values)) {
+		assert.Equal(10.0, values[0].AsFloat())
+		assert.Equal("a", string(values[1].sliceData))
+		assert.True(values[2].IsMissing())
+		assert.Equal("fixed", string(values[3].sliceData))
+	}
+
+	m.Reset()
+	matched, values, err = m.MatchWithOutputs([]byte(`{"price":1,"qty":1,"type":"other"}`))
+	assert.Nil(err)
+	assert.False(matched)
+	assert.Nil(values)
+
+	// Fields which only the outputs use do not affect the match
+	m.Reset()
+	matched, values, err = m.MatchWithOutputs([]byte(`{"type":"order"}`))
+	assert.Nil(err)
+	assert.True(matched)
+	if assert.Equal(4, len(values)) {
+		assert.True(values[1].IsMissing())
+	}
+
+	_, err = trans.TransformWithOutputs([]Expression{expr}, []Expression{FieldExpr{1, []string{"a"}}})
+	assert.NotNil(err)
+	_, err = trans.TransformWithOutputs([]Expression{expr}, []Expression{EqualsExpr{FieldExpr{0, []string{"a"}}, ValueExpr{1}}})
+	assert.NotNil(err)
+}
+
+func TestNonFinitePolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	matchExpr := func(policy NonFinitePolicy, expr Expression, doc string) (bool, error) {
+		var trans Transformer
+		m := NewFastMatcher(trans.Transform([]Expression{expr}))
+		m.SetNonFinitePolicy(policy)
+		return m.Match([]byte(doc))
+	}
+	match := func(policy NonFinitePolicy, expression, doc string) (bool, error) {
+		expr, err := ParseFilterExpression(expression)
+		assert.Nil(err)
+		return matchExpr(policy, expr, doc)
+	}
+
+	// Without a policy NaN would compare as equal to every number
+	matched, err := match(NonFiniteNoMatch, `SQRT(num) <= 5`, `{"num":-4}`)
+	assert.Nil(err)
+	assert.False(matched)
+	matched, err = match(NonFiniteNoMatch, `SQRT(num) <= 5`, `{"num":4}`)
+	assert.Nil(err)
+	assert.True(matched)
+	matched, err = match(NonFiniteNoMatch, `NOT SQRT(num) <= 5`, `{"num":-4}`)
+	assert.Nil(err)
+	assert.True(matched)
+	matched, err = match(NonFiniteNoMatch, `POW(num, 1000) > 5`, `{"num":10}`)
+	assert.Nil(err)
+	assert.False(matched)
+
+	matched, err = match(NonFiniteMissing, `SQRT(num) <= 5 OR num < 0`, `{"num":-4}`)
+	assert.Nil(err)
+	assert.True(matched)
+	exists := ExistsExpr{FuncExpr{MathFuncSqrt, []Expression{FieldExpr{Root: 0, Path: []string{"num"}}}}}
+	matched, err = matchExpr(NonFiniteNoMatch, exists, `{"num":-4}`)
+	assert.Nil(err)
+	assert.False(matched)
+	matched, err = matchExpr(NonFiniteMissing, exists, `{"num":4}`)
+	assert.Nil(err)
+	assert.True(matched)
+	matched, err = matchExpr(NonFiniteMissing, exists, `{"num":-4}`)
+	assert.Nil(err)
+	assert.False(matched)
+
+	_, err = match(NonFiniteError, `SQRT(num) <= 5`, `{"num":-4}`)
+	assert.Equal(ErrorNonFiniteValue, err)
+	matched, err = match(NonFiniteError, `SQRT(num) <= 5`, `{"num":4}`)
+	assert.Nil(err)
+	assert.True(matched)
+
+	// Modulo by zero, including by divisors truncated to it, is NaN
+	for _, mod := range []string{`num % 0`, `num % 0.5`} {
+		matched, err = match(NonFiniteNoMatch, mod+` = 0`, `{"num":4}`)
+		assert.Nil(err)
+		assert.False(matched, mod)
+		matched, err = match(NonFiniteNoMatch, `NOT `+mod+` = 0`, `{"num":4}`)
+		assert.Nil(err)
+		assert.True(matched, mod)
+		matched, err = match(NonFiniteMissing, mod+` = 0 OR num > 1`, `{"num":4}`)
+		assert.Nil(err)
+		assert.True(matched, mod)
+		matched, err = match(NonFiniteMissing, mod+` = 0 OR NOT EXISTS(num)`, `{"num":4}`)
+		assert.Nil(err)
+		assert.False(matched, mod)
+		_, err = match(NonFiniteError, mod+` = 0`, `{"num":4}`)
+		assert.Equal(ErrorNonFiniteValue, err, mod)
+	}
+	matched, err = match(NonFiniteError, `num % 3 = 1`, `{"num":4}`)
+	assert.Nil(err)
+	assert.True(matched)
+}
+
+func TestFloatEquality(t *testing.T) {
+	assert := assert.New(t)
+
+	reading := FieldExpr{Root: 0, Path: []string{"reading"}}
+	match := func(eq *FloatEquality, expr Expression, doc string) bool {
+		var trans Transformer
+		m := NewFastMatcher(trans.Transform([]Expression{expr}))
+		if eq != nil {
+			m.SetFloatEquality(*eq)
+		}
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err)
+		return matched
+	}
+
+	equalsOne := EqualsExpr{reading, ValueExpr{1.0}}
+	assert.True(match(nil, equalsOne, `{"reading":1.00000001}`))
+	assert.False(match(&FloatEquality{}, equalsOne, `{"reading":1.00000001}`))
+	assert.True(match(&FloatEquality{}, equalsOne, `{"reading":1.0}`))
+	assert.True(match(&FloatEquality{Epsilon: 0.01}, equalsOne, `{"reading":1.005}`))
+	assert.True(match(&FloatEquality{Epsilon: 0.01}, LessEqualsExpr{reading, ValueExpr{1.0}}, `{"reading":1.005}`))
+	assert.False(match(&FloatEquality{Epsilon: 0.01}, LessThanExpr{reading, ValueExpr{1.0}}, `{"reading":0.995}`))
+
+	equalsZero := EqualsExpr{reading, ValueExpr{0.0}}
+	assert.True(match(nil, equalsZero, `{"reading":-0.0}`))
+	assert.True(match(&FloatEquality{}, equalsZero, `{"reading":-0.0}`))
+	assert.False(match(&FloatEquality{SignedZero: true}, equalsZero, `{"reading":-0.0}`))
+	assert.True(match(&FloatEquality{SignedZero: true}, LessThanExpr{reading, ValueExpr{0.0}}, `{"reading":-0.0}`))
+	assert.True(match(&FloatEquality{SignedZero: true}, equalsZero, `{"reading":0.0}`))
+}
+
+func TestCompareLargeIntegers(t *testing.T) {
+	assert := assert.New(t)
+
+	// Neither value survives a round trip through float64
+	assert.Equal(-1, NewFloatFastVal(9007199254740992).Compare(NewIntFastVal(9007199254740993)))
+	assert.Equal(1, NewIntFastVal(9007199254740993).Compare(NewFloatFastVal(9007199254740992)))
+	assert.Equal(0, NewIntFastVal(9007199254740992).Compare(NewFloatFastVal(9007199254740992)))
+	assert.Equal(1, NewUintFastVal(math.MaxUint64).Compare(NewIntFastVal(-1)))
+	assert.Equal(-1, NewIntFastVal(-1).Compare(NewUintFastVal(math.MaxUint64)))
+	assert.Equal(-1, NewIntFastVal(math.MinInt64).Compare(NewFloatFastVal(-9223372036854774784)))
+	assert.Equal(0, NewIntFastVal(math.MinInt64).Compare(NewFloatFastVal(math.MinInt64)))
+
+	// Fractions are still compared as floats
+	assert.Equal(-1, NewIntFastVal(5).Compare(NewFloatFastVal(5.3)))
+	assert.Equal(1, NewIntFastVal(-5).Compare(NewFloatFastVal(-5.3)))
+	assert.Equal(0, NewIntFastVal(5).Compare(NewFloatFastVal(5.00000001)))
+
+	id := FieldExpr{Root: 0, Path: []string{"id"}}
+	match := func(expr Expression, doc string) bool {
+		var trans Transformer
+		m := NewFastMatcher(trans.Transform([]Expression{expr}))
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err)
+		return matched
+	}
+	assert.False(match(EqualsExpr{id, ValueExpr{int64(-1)}}, `{"id":18446744073709551615}`))
+	assert.True(match(EqualsExpr{id, ValueExpr{uint64(math.MaxUint64)}}, `{"id":18446744073709551615}`))
+	assert.False(match(EqualsExpr{id, ValueExpr{5.3}}, `{"id":5}`))
+	assert.True(match(EqualsExpr{id, ValueExpr{5.0}}, `{"id":5}`))
+	assert.False(match(EqualsExpr{id, ValueExpr{9007199254740992.0}}, `{"id":9007199254740993}`))
+	assert.True(match(GreaterThanExpr{id, ValueExpr{9007199254740992.0}}, `{"id":9007199254740993}`))
+}
+
+func TestCoerceNumericStrings(t *testing.T) {
+	assert := assert.New(t)
+
+	match := func(coerce bool, expression, doc string) bool {
+		expr, err := ParseFilterExpression(expression)
+		assert.Nil(err)
+		var trans Transformer
+		m := NewFastMatcher(trans.Transform([]Expression{expr}))
+		m.SetCoerceNumericStrings(coerce)
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err)
+		return matched
+	}
+
+	assert.False(match(false, `count = 42`, `{"count":"42"}`))
+	assert.True(match(true, `count > 10`, `{"count":"42"}`))
+	assert.True(match(true, `count = 42`, `{"count":"42"}`))
+	assert.True(match(true, `count = 4.2`, `{"count":"4.2"}`))
+	assert.True(match(true, `count < 1`, `{"count":"-1.5e3"}`))
+	assert.True(match(true, `count = "42"`, `{"count":42}`))
+	assert.True(match(true, `ABS(count) = 42`, `{"count":-42}`))
+	assert.True(match(true, `count > 10`, `{"count":"18446744073709551615"}`))
+
+	// Strings which are not JSON numbers are not coerced
+	assert.False(match(true, `count = 42`, `{"count":"042"}`))
+	assert.False(match(true, `count = 42`, `{"count":" 42"}`))
+	assert.False(match(true, `count = 0`, `{"count":""}`))
+	assert.False(match(true, `count > 10`, `{"count":"many"}`))
+	assert.False(match(true, `count < 10`, `{"count":"many"}`))
+	assert.False(match(true, `count = 42`, `{"count":"0x2a"}`))
+
+	// Two strings are still compared as strings
+	assert.True(match(true, `count > "10"`, `{"count":"9"}`))
+}
+
+func TestStrictEquals(t *testing.T) {
+	assert := assert.New(t)
+
+	options := FilterExpressionParserOptions{StrictEquals: true}
+	match := func(expression, doc string) bool {
+		_, fe, err := NewFilterExpressionParserWithOptions(expression, options)
+		assert.Nil(err)
+		expr, err := fe.OutputExpression()
+		assert.Nil(err)
+		var trans Transformer
+		m := NewFastMatcher(trans.Transform([]Expression{expr}))
+		m.SetCoerceNumericStrings(true)
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err)
+		return matched
+	}
+
+	// `=` applies the coercion of the matcher, while `==` does not
+	assert.True(match(`count = 42`, `{"count":"42"}`))
+	assert.False(match(`count == 42`, `{"count":"42"}`))
+	assert.True(match(`count == 42`, `{"count":42}`))
+	assert.True(match(`count == 42`, `{"count":42.0}`))
+	assert.False(match(`count = "42"`, `{"count":"042"}`))
+	assert.True(match(`count = "42"`, `{"count":42}`))
+	assert.False(match(`count == "42"`, `{"count":42}`))
+	assert.True(match(`count == "42"`, `{"count":"42"}`))
+	assert.False(match(`flag == 1`, `{"flag":true}`))
+	assert.True(match(`flag == TRUE`, `{"flag":true}`))
+	assert.False(match(`count == other`, `{"count":"1","other":1}`))
+	assert.True(match(`count == other`, `{"count":1,"other":1.0}`))
+
+	// Without the option both spellings are the same
+	expr, err := ParseFilterExpression(`count == 42`)
+	assert.Nil(err)
+	assert.IsType(EqualsExpr{}, expr.(OrExpr)[0].(AndExpr)[0])
+
+	_, fe, err := NewFilterExpressionParserWithOptions(`count == 42`, options)
+	assert.Nil(err)
+	expr, err = fe.OutputExpression()
+	assert.Nil(err)
+	assert.IsType(StrictEqualsExpr{}, expr.(OrExpr)[0].(AndExpr)[0])
+	str, err := FormatExpression(expr)
+	assert.Nil(err)
+	assert.Equal(`count == 42`, str)
+}
+
+func TestEmptyAsMissing(t *testing.T) {
+	assert := assert.New(t)
+
+	match := func(empty EmptyValues, expression, doc string) bool {
+		expr, err := ParseFilterExpression(expression)
+		assert.Nil(err)
+		var trans Transformer
+		m := NewFastMatcher(trans.Transform([]Expression{expr}))
+		m.SetEmptyAsMissing(empty)
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err)
+		return matched
+	}
+
+	// Empty values exist by default
+	assert.True(match(0, `EXISTS(name)`, `{"name":""}`))
+	assert.True(match(0, `tags IS NOT MISSING`, `{"tags":[]}`))
+	assert.True(match(0, `EXISTS(address)`, `{"address":{}}`))
+
+	assert.True(match(EmptyStrings, `name IS MISSING`, `{"name":""}`))
+	assert.False(match(EmptyStrings, `EXISTS(name)`, `{"name":""}`))
+	assert.True(match(EmptyStrings, `EXISTS(name)`, `{"name":"Neil"}`))
+	assert.True(match(EmptyStrings, `EXISTS(tags)`, `{"tags":[]}`))
+
+	assert.False(match(EmptyArrays, `EXISTS(tags)`, `{"tags":[ ]}`))
+	assert.True(match(EmptyArrays, `EXISTS(tags)`, `{"tags":[1]}`))
+	assert.True(match(EmptyArrays, `EXISTS(address)`, `{"address":{}}`))
+
+	assert.False(match(EmptyObjects, `EXISTS(address)`, `{"address":{}}`))
+	assert.True(match(EmptyObjects, `EXISTS(address)`, `{"address":{"city":"x"}}`))
+	assert.False(match(EmptyAll, `EXISTS(address.city)`, `{"address":{"city":""}}`))
+	assert.True(match(EmptyAll, `address IS MISSING AND name IS MISSING`, `{"address":{},"name":""}`))
+
+	// Comparisons are not affected
+	assert.True(match(EmptyAll, `name = ""`, `{"name":""}`))
+}
+
+func TestMatchKey(t *testing.T) {
+	assert := assert.New(t)
+
+	compile := func(expression string) *MatchDef {
+		expr, err := ParseFilterExpression(expression)
+		assert.Nil(err)
+		var trans Transformer
+		return trans.Transform([]Expression{expr})
+	}
+
+	def := compile(`REGEXP_CONTAINS(META().id, "^user_") AND META().id != "user_0"`)
+	assert.True(def.KeyOnly())
+	m := NewFastMatcher(def)
+	for key, expected := range map[string]bool{
+		"user_1":      true,
+		"user_0":      false,
+		"order_1":     false,
+		"user_\"\\\n": true,
+		"":            false,
+	} {
+		m.Reset()
+		matched, err := m.MatchKey([]byte(key))
+		assert.Nil(err, key)
+		assert.Equal(expected, matched, key)
+	}
+
+	// The body is still matched as before after matching keys
+	m.Reset()
+	matched, err := m.Match([]byte(`{"META()":{"id":"user_1"}}`))
+	assert.Nil(err)
+	assert.True(matched)
+
+	assert.True(compile(`META().id = "a" OR META().id = "b"`).KeyOnly())
+	for _, expression := range []string{
+		`META().id = "a" AND type = "user"`,
+		`META().expiration > 0`,
+		`META().id = "a" OR EXISTS(META().xattrs)`,
+	} {
+		def := compile(expression)
+		assert.False(def.KeyOnly(), expression)
+		_, err := NewFastMatcher(def).MatchKey([]byte("a"))
+		assert.Equal(ErrorNotKeyOnly, err, expression)
+	}
+}
+
+func TestMatchWithMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	compile := func(expression string) *FastMatcher {
+		expr, err := ParseFilterExpression(expression)
+		assert.Nil(err)
+		var trans Transformer
+		return NewFastMatcher(trans.Transform([]Expression{expr}))
+	}
+
+	// Skip documents which expire within a day
+	m := compile(`LET cutoff = NOW_MILLIS() + 86400000 WHERE META().expiration = 0 OR META().expiration * 1000 > cutoff`)
+	now := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	m.SetClock(func() time.Time { return now })
+
+	nowSecs := uint32(now.Unix())
+	for expiration, expected := range map[uint32]bool{
+		0:                   true,
+		nowSecs - 1:         false,
+		nowSecs + 3600:      false,
+		nowSecs + 2*86400:   true,
+		nowSecs + 86400 + 1: true,
+	} {
+		m.Reset()
+		matched, err := m.MatchWithMeta(DocumentMeta{Key: []byte("a"), Expiration: expiration}, []byte(`{"a":1}`))
+		assert.Nil(err)
+		assert.Equal(expected, matched, "expiration %d", expiration)
+	}
+
+	m = compile(`META().id = "doc\"1" AND type = "user"`)
+	for body, expected := range map[string]bool{
+		`{"type":"user"}`:                    true,
+		` { "type" : "user" } `:              true,
+		`{"type":"order"}`:                   false,
+		`{}`:                                 false,
+		`{ }`:                                false,
+		`[1]`:                                false,
+		`{"a":[{"type":"x"}],"type":"user"}`: true,
+	} {
+		m.Reset()
+		matched, err := m.MatchWithMeta(DocumentMeta{Key: []byte(`doc"1`)}, []byte(body))
+		assert.Nil(err, body)
+		assert.Equal(expected, matched, body)
+	}
+
+	m = compile(`META().id = "a"`)
+	matched, err := m.MatchWithMeta(DocumentMeta{Key: []byte("a")}, []byte(`{}`))
+	assert.Nil(err)
+	assert.True(matched)
+}
+
+func TestMatchInputs(t *testing.T) {
+	assert := assert.New(t)
+
+	compile := func(expression string) *FastMatcher {
+		expr, err := ParseFilterExpression(expression)
+		assert.Nil(err)
+		var trans Transformer
+		return NewFastMatcher(trans.Transform([]Expression{expr}))
+	}
+
+	m := compile(`$doc.total = $order.total AND status = "paid" AND $order.items[0].sku = $doc.sku`)
+	order := []byte(`{"total":10,"items":[{"sku":"a"}]}`)
+	for doc, expected := range map[string]bool{
+		`{"total":10,"status":"paid","sku":"a"}`:  true,
+		`{"total":11,"status":"paid","sku":"a"}`:  false,
+		`{"total":10,"status":"paid","sku":"b"}`:  false,
+		`{"total":10,"status":"open","sku":"a"}`:  false,
+		` {"sku":"a","status":"paid","total":10}`: true,
+		`{}`: false,
+	} {
+		m.Reset()
+		matched, err := m.MatchInputs(map[string][]byte{"doc": []byte(doc), "order": order})
+		assert.Nil(err, doc)
+		assert.Equal(expected, matched, doc)
+	}
+
+	// Missing inputs have no fields
+	m.Reset()
+	matched, err := m.MatchInputs(map[string][]byte{"order": order})
+	assert.Nil(err)
+	assert.False(matched)
+
+	m = compile(`$a.x = $b.x AND EXISTS($c)`)
+	m.Reset()
+	matched, err = m.MatchInputs(map[string][]byte{"a": []byte(`{"x":[1,2]}`), "b": []byte(` {"x":[1,2]} `), "c": []byte(`1`)})
+	assert.Nil(err)
+	assert.True(matched)
+
+	// Inputs must be single values, so they cannot add fields of their own
+	_, err = m.MatchInputs(map[string][]byte{"a": []byte(`1,"$c":1`), "b": []byte(`1`)})
+	assert.Equal(ErrorJsonMalformed, err)
+	_, err = m.MatchInputs(map[string][]byte{"a\"": []byte(`1`)})
+	assert.Equal(ErrorInputName, err)
+
+	expr, err := ParseFilterExpression(`$doc.a = $other.b AND $other.**.c = 1`)
+	assert.Nil(err)
+	formatted, err := FormatExpression(expr)
+	assert.Nil(err)
+	assert.Equal(`a = $other.b AND ($other.c = 1 OR ANY v1 WITHIN $other SATISFIES v1.c = 1 END)`, formatted)
+	_, err = ReparseExpression(expr)
+	assert.Nil(err)
+	_, _, err = NewFilterExpressionParserWithOptions(`a = $other.b`, FilterExpressionParserOptions{Version: FilterExpressionV14})
+	assert.NotNil(err)
+	_, err = ParseFilterExpression(`$ other.b = 1`)
+	assert.NotNil(err)
+}
+
+func TestDuplicateKeyPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := []string{
+		`{"a":1,"b":{"c":"x"},"a":2}`,
+		`{"a":2,"b":{"c":"y","c":"x"},"a":1}`,
+		`{"b":{"c":"x"},"z":[1,{"a":5}],"a":1}`,
+	}
+	expressions := map[string]map[DuplicateKeyPolicy][]bool{
+		`a = 1`: {
+			DuplicateKeysFirstWins: {true, false, true},
+			DuplicateKeysLastWins:  {false, true, true},
+		},
+		`a = 2 AND b.c = "x"`: {
+			DuplicateKeysFirstWins: {false, false, false},
+			DuplicateKeysLastWins:  {true, false, false},
+		},
+		`b.c = "y" OR a = 7`: {
+			DuplicateKeysFirstWins: {false, true, false},
+			DuplicateKeysLastWins:  {false, false, false},
+		},
+	}
+
+	for expression, policies := range expressions {
+		expr, err := ParseFilterExpression(expression)
+		assert.Nil(err)
+		var trans Transformer
+		m := NewFastMatcher(trans.Transform([]Expression{expr}))
+		for policy, expected := range policies {
+			m.SetDuplicateKeyPolicy(policy)
+			for i, doc := range docs {
+				m.Reset()
+				matched, err := m.Match([]byte(doc))
+				assert.Nil(err, "%s on %s", expression, doc)
+				assert.Equal(expected[i], matched, "%s with policy %d on %s", expression, policy, doc)
+			}
+		}
+
+		m.SetDuplicateKeyPolicy(DuplicateKeysError)
+		for i, doc := range docs {
+			m.Reset()
+			_, err := m.Match([]byte(doc))
+			if i == 2 {
+				assert.Nil(err, "%s on %s", expression, doc)
+			} else {
+				assert.Equal(ErrorDuplicateKey, err, "%s on %s", expression, doc)
+			}
+		}
+	}
+}
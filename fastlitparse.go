@@ -7,11 +7,13 @@ import (
 )
 
 type fastLitParser struct {
-	tmpInt       int64
-	tmpNum       float64
-	tmpBool      bool
-	tmpBytes     []byte
-	tmpBytesData [64]byte
+	tmpInt   int64
+	tmpNum   float64
+	tmpBool  bool
+	tmpBytes []byte
+	// Holds unescaped strings until the tokenizer is reset, as values
+	// parsed earlier in the document may still be in use
+	arena byteArena
 }
 
 // why not use strvconv.ParseInt?
@@ -44,6 +46,22 @@ func (p *fastLitParser) ParseInt(bytes []byte) int64 {
 	}
 }
 
+// parseIntValue parses an integer token, keeping integers too large for an
+// int64 as a uint64, or as a float64 beyond that, rather than overflowing
+func (p *fastLitParser) parseIntValue(bytes []byte) FastVal {
+	// Anything shorter fits in an int64
+	if len(bytes) < 19 {
+		return NewIntFastVal(p.ParseInt(bytes))
+	}
+	if intVal, err := strconv.ParseInt(string(bytes), 10, 64); err == nil {
+		return NewIntFastVal(intVal)
+	}
+	if uintVal, err := strconv.ParseUint(string(bytes), 10, 64); err == nil {
+		return NewUintFastVal(uintVal)
+	}
+	return NewFloatFastVal(p.ParseNumber(bytes))
+}
+
 func (p *fastLitParser) ParseNumber(bytes []byte) float64 {
 	// is it safe to ignore error?
 	val, _ := strconv.ParseFloat(string(bytes), 64)
@@ -60,13 +78,15 @@ func (p *fastLitParser) ParseStringWLen(bytes []byte, size int) []byte {
 }
 
 func (p *fastLitParser) ParseEscString(bytes []byte) []byte {
-	bytesOut, _ := unescapeJsonString(bytes[1:len(bytes)-1], p.tmpBytesData[:])
+	escBytes := bytes[1 : len(bytes)-1]
+	bytesOut, _ := unescapeJsonString(escBytes, p.arena.alloc(len(escBytes)))
 	return bytesOut
 }
 
 func (p *fastLitParser) ParseEscStringWLen(bytes []byte, size int) []byte {
 	// length check first?
-	bytesOut, _ := unescapeJsonString(bytes[1:size-1], p.tmpBytesData[:])
+	escBytes := bytes[1 : size-1]
+	bytesOut, _ := unescapeJsonString(escBytes, p.arena.alloc(len(escBytes)))
 	return bytesOut
 }
 
@@ -77,7 +97,7 @@ func (p *fastLitParser) Parse(token tokenType, bytes []byte) FastVal {
 	case tknEscString:
 		return NewBinStringFastVal(p.ParseEscString(bytes))
 	case tknInteger:
-		return NewIntFastVal(p.ParseInt(bytes))
+		return p.parseIntValue(bytes)
 	case tknNumber:
 		return NewFloatFastVal(p.ParseNumber(bytes))
 	case tknNull:
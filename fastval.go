@@ -3,10 +3,12 @@
 package gojsonsm
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"math"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -57,7 +59,7 @@ func (val FastVal) String() string {
 	case UintValue:
 		return "(uint)" + fmt.Sprintf("%d", val.GetUint())
 	case FloatValue:
-		return "(float)" + fmt.Sprintf("%f", val.GetFloat())
+		return "(float)" + strconv.FormatFloat(val.GetFloat(), 'g', -1, 64)
 	case JsonIntValue:
 		return "(jsonInt)" + string(val.sliceData)
 	case JsonUintValue:
@@ -81,11 +83,19 @@ func (val FastVal) String() string {
 	case FalseValue:
 		return "false"
 	case ArrayValue:
-		// TODO: Implement array value stringification
-		return "??ARRAY??"
+		elems := val.data.([]FastVal)
+		elemStrs := make([]string, len(elems))
+		for i, elem := range elems {
+			elemStrs[i] = elem.String()
+		}
+		return "[" + strings.Join(elemStrs, ",") + "]"
 	case ObjectValue:
-		// TODO: Implement array value stringification
-		return "??OBJECT??"
+		fields := val.data.(map[string]FastVal)
+		fieldStrs := make([]string, 0, len(fields))
+		for _, key := range sortedFastValKeys(fields) {
+			fieldStrs = append(fieldStrs, strconv.Quote(key)+":"+fields[key].String())
+		}
+		return "{" + strings.Join(fieldStrs, ",") + "}"
 	case TimeValue:
 		return val.GetTime().String()
 	case RegexValue:
@@ -305,25 +315,9 @@ func (val FastVal) ToJsonString() (FastVal, error) {
 	return val, errors.New("invalid type coercion")
 }
 
-func (val FastVal) floatToIntOverflows() bool {
-	floatVal := val.GetFloat()
-
-	// comments no longer applicable?
-
-	// Instead of using math constants that could potentially lead to rounding errors,
-	// force a float-to-float comparison here
-	if !(floatVal >= math.MinInt64 && floatVal <= math.MaxInt64) {
-		return true
-	} else {
-		return false
-	}
-}
-
 func (val FastVal) compareInt(other FastVal) int {
-	//should check if float value in "val" overflows int as well
-	// or, should we do overflow check in AsInt() instead?
-	if other.dataType == FloatValue && other.floatToIntOverflows() {
-		return val.compareFloat(other)
+	if other.IsNumeric() {
+		return compareNumbers(val, other, DefaultFloatEquality)
 	}
 
 	intVal := val.AsInt()
@@ -339,7 +333,10 @@ func (val FastVal) compareInt(other FastVal) int {
 }
 
 func (val FastVal) compareUint(other FastVal) int {
-	// how about float overflow check?
+	if other.IsNumeric() {
+		return compareNumbers(val, other, DefaultFloatEquality)
+	}
+
 	uintVal := val.AsUint()
 	uintOval := other.AsUint()
 	if uintVal < uintOval {
@@ -352,15 +349,112 @@ func (val FastVal) compareUint(other FastVal) int {
 }
 
 func (val FastVal) compareFloat(other FastVal) int {
-	// TODO(brett19): EPISLON probably should be defined better than this
-	// possibly even 0 if we want to force exact matching for floats...
-	EPSILON := 0.0000001
+	if other.IsNumeric() {
+		return compareNumbers(val, other, DefaultFloatEquality)
+	}
+	return compareFloats(val.AsFloat(), other.AsFloat(), DefaultFloatEquality)
+}
+
+// integerParts splits a number holding an integer into its sign and its
+// magnitude, which covers every int64 and uint64.  Floats with a fraction
+// or outside of that range, and integers which cannot be parsed, fail.
+func (val FastVal) integerParts() (bool, uint64, bool) {
+	switch val.dataType {
+	case IntValue:
+		return integerPartsOfInt(val.GetInt())
+	case UintValue:
+		return false, val.GetUint(), true
+	case JsonIntValue:
+		intVal, err := strconv.ParseInt(string(val.sliceData), 10, 64)
+		if err != nil {
+			return false, 0, false
+		}
+		return integerPartsOfInt(intVal)
+	case JsonUintValue:
+		uintVal, err := strconv.ParseUint(string(val.sliceData), 10, 64)
+		if err != nil {
+			return false, 0, false
+		}
+		return false, uintVal, true
+	case FloatValue, JsonFloatValue:
+		floatVal := val.AsFloat()
+		if floatVal != math.Trunc(floatVal) || floatVal < math.MinInt64 || floatVal >= math.MaxUint64 {
+			return false, 0, false
+		}
+		if floatVal < 0 {
+			return true, uint64(-floatVal), true
+		}
+		return false, uint64(floatVal), true
+	}
+	return false, 0, false
+}
+
+func integerPartsOfInt(intVal int64) (bool, uint64, bool) {
+	if intVal < 0 {
+		// Negating math.MinInt64 overflows back to itself, which still
+		// converts to the right magnitude
+		return true, uint64(-intVal), true
+	}
+	return false, uint64(intVal), true
+}
 
-	floatVal := val.AsFloat()
-	floatOval := other.AsFloat()
+// compareNumbers compares two numbers exactly when both hold integers, so
+// that 64-bit IDs which only differ past the precision of a float64 are not
+// equal, and only compares them as float64 when either has a fraction
+func compareNumbers(val, other FastVal, eq FloatEquality) int {
+	valNeg, valMag, valOk := val.integerParts()
+	otherNeg, otherMag, otherOk := other.integerParts()
+	if !valOk || !otherOk || (eq.SignedZero && (valMag == 0 || otherMag == 0)) {
+		return compareFloats(val.AsFloat(), other.AsFloat(), eq)
+	}
+
+	if valNeg != otherNeg {
+		if valMag == 0 && otherMag == 0 {
+			return 0
+		} else if valNeg {
+			return -1
+		}
+		return 1
+	}
+
+	res := 0
+	if valMag < otherMag {
+		res = -1
+	} else if valMag > otherMag {
+		res = 1
+	}
+	if valNeg {
+		return -res
+	}
+	return res
+}
+
+// FloatEquality controls when two floats compare as equal
+type FloatEquality struct {
+	// Floats closer together than Epsilon are equal, where an Epsilon of 0
+	// only treats identical values as equal
+	Epsilon float64
+	// SignedZero makes -0 compare as less than 0 rather than equal to it
+	SignedZero bool
+}
+
+// DefaultFloatEquality is how floats are compared unless a FastMatcher is
+// given another FloatEquality
+var DefaultFloatEquality = FloatEquality{Epsilon: 0.0000001}
+
+func compareFloats(floatVal, floatOval float64, eq FloatEquality) int {
+	if eq.SignedZero && floatVal == 0 && floatOval == 0 {
+		valNeg, ovalNeg := math.Signbit(floatVal), math.Signbit(floatOval)
+		if valNeg && !ovalNeg {
+			return -1
+		} else if !valNeg && ovalNeg {
+			return 1
+		}
+		return 0
+	}
 
 	// Perform epsilon comparison first
-	if math.Abs(floatVal-floatOval) < EPSILON {
+	if math.Abs(floatVal-floatOval) < eq.Epsilon {
 		return 0
 	}
 
@@ -386,7 +480,84 @@ func (val FastVal) compareStrings(other FastVal) int {
 	// TODO: Improve string comparisons to avoid casting or converting
 	escVal, _ := val.ToJsonString()
 	escOval, _ := other.ToJsonString()
-	return strings.Compare(string(escVal.sliceData), string(escOval.sliceData))
+	return bytes.Compare(escVal.sliceData, escOval.sliceData)
+}
+
+// fastValKind groups the types of values which can be compared with each
+// other, such as the different kinds of numbers
+func fastValKind(val FastVal) ValueType {
+	switch {
+	case val.IsNumeric():
+		return IntValue
+	case val.IsString():
+		return StringValue
+	case val.dataType == FalseValue:
+		return TrueValue
+	}
+	return val.dataType
+}
+
+// compareNested compares values held by arrays and objects, which are
+// ordered by their kind rather than being converted when their kinds differ
+func compareNested(val, other FastVal) int {
+	kind, otherKind := fastValKind(val), fastValKind(other)
+	if kind < otherKind {
+		return -1
+	} else if kind > otherKind {
+		return 1
+	}
+	return val.Compare(other)
+}
+
+// compareArrays compares arrays element by element, and then by length, so
+// that arrays are only equal when all of their elements are
+func (val FastVal) compareArrays(other FastVal) int {
+	elems, otherElems := val.data.([]FastVal), other.data.([]FastVal)
+	for i := 0; i < len(elems) && i < len(otherElems); i++ {
+		if res := compareNested(elems[i], otherElems[i]); res != 0 {
+			return res
+		}
+	}
+
+	if len(elems) < len(otherElems) {
+		return -1
+	} else if len(elems) > len(otherElems) {
+		return 1
+	}
+	return 0
+}
+
+func sortedFastValKeys(fields map[string]FastVal) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// compareObjects compares objects by their sorted keys and then by the
+// values of those keys, so the order of the fields makes no difference
+func (val FastVal) compareObjects(other FastVal) int {
+	fields, otherFields := val.data.(map[string]FastVal), other.data.(map[string]FastVal)
+	keys, otherKeys := sortedFastValKeys(fields), sortedFastValKeys(otherFields)
+	for i := 0; i < len(keys) && i < len(otherKeys); i++ {
+		if res := strings.Compare(keys[i], otherKeys[i]); res != 0 {
+			return res
+		}
+	}
+	if len(keys) < len(otherKeys) {
+		return -1
+	} else if len(keys) > len(otherKeys) {
+		return 1
+	}
+
+	for _, key := range keys {
+		if res := compareNested(fields[key], otherFields[key]); res != 0 {
+			return res
+		}
+	}
+	return 0
 }
 
 func (val FastVal) compareTime(other FastVal) int {
@@ -428,6 +599,14 @@ func (val FastVal) Compare(other FastVal) int {
 		return val.compareBoolean(other)
 	case TimeValue:
 		return val.compareTime(other)
+	case ArrayValue:
+		if other.dataType == ArrayValue {
+			return val.compareArrays(other)
+		}
+	case ObjectValue:
+		if other.dataType == ObjectValue {
+			return val.compareObjects(other)
+		}
 	}
 
 	if val.dataType < other.dataType {
@@ -506,6 +685,18 @@ func NewFastVal(val interface{}) FastVal {
 		return NewTimeFastVal(val)
 	case nil:
 		return NewNullFastVal()
+	case []interface{}:
+		elems := make([]FastVal, len(val))
+		for i, elem := range val {
+			elems[i] = NewFastVal(elem)
+		}
+		return NewArrayFastVal(elems)
+	case map[string]interface{}:
+		fields := make(map[string]FastVal, len(val))
+		for key, field := range val {
+			fields[key] = NewFastVal(field)
+		}
+		return NewObjectFastVal(fields)
 	}
 
 	return FastVal{
@@ -513,6 +704,20 @@ func NewFastVal(val interface{}) FastVal {
 	}
 }
 
+func NewArrayFastVal(elems []FastVal) FastVal {
+	return FastVal{
+		dataType: ArrayValue,
+		data:     elems,
+	}
+}
+
+func NewObjectFastVal(fields map[string]FastVal) FastVal {
+	return FastVal{
+		dataType: ObjectValue,
+		data:     fields,
+	}
+}
+
 func NewInvalidFastVal() FastVal {
 	return FastVal{
 		dataType: InvalidValue,
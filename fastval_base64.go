@@ -0,0 +1,40 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"encoding/base64"
+)
+
+// FastValBase64Decode decodes a base64 string, with or without padding, into
+// the string it holds.  Anything else gives null.
+func FastValBase64Decode(val FastVal) FastVal {
+	encoded, ok := fastValStringBytes(val)
+	if !ok {
+		return NewNullFastVal()
+	}
+
+	// Unpadded input can decode to more than StdEncoding.DecodedLen allows for
+	decoded := make([]byte, base64.RawStdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(decoded, encoded)
+	if err != nil {
+		n, err = base64.RawStdEncoding.Decode(decoded, encoded)
+		if err != nil {
+			return NewNullFastVal()
+		}
+	}
+	return NewBinStringFastVal(decoded[:n])
+}
+
+// FastValBase64Encode encodes a string as padded base64.  Unlike N1QL's
+// BASE64_ENCODE, the string itself is encoded rather than its JSON form.
+func FastValBase64Encode(val FastVal) FastVal {
+	str, ok := fastValStringBytes(val)
+	if !ok {
+		return NewNullFastVal()
+	}
+
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(str)))
+	base64.StdEncoding.Encode(encoded, str)
+	return NewBinStringFastVal(encoded)
+}
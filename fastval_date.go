@@ -3,6 +3,7 @@ package gojsonsm
 import (
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
 )
 
@@ -71,3 +72,67 @@ func GetNewTimeFastVal(input string) (FastVal, error) {
 		return NewInvalidFastVal(), err
 	}
 }
+
+// isDateTruncPart checks whether DATE_TRUNC_STR() can truncate to a part,
+// which is case insensitive as in N1QL
+func isDateTruncPart(part string) bool {
+	switch strings.ToLower(part) {
+	case "year", "month", "day", "hour", "minute", "second":
+		return true
+	}
+	return false
+}
+
+// truncateTime zeroes every part of the time below the given part, keeping
+// its time zone
+func truncateTime(t time.Time, part string) (time.Time, bool) {
+	year, month, day := t.Date()
+	hour, min, sec := t.Clock()
+	switch strings.ToLower(part) {
+	case "year":
+		month = time.January
+		fallthrough
+	case "month":
+		day = 1
+		fallthrough
+	case "day":
+		hour = 0
+		fallthrough
+	case "hour":
+		min = 0
+		fallthrough
+	case "minute":
+		sec = 0
+		fallthrough
+	case "second":
+		return time.Date(year, month, day, hour, min, sec, 0, t.Location()), true
+	}
+	return t, false
+}
+
+// FastValDateTrunc truncates a date to the given part, such as "day", and
+// returns it as an RFC3339 string so that dates on the same day are equal.
+// Anything which is not a date gives null.
+func FastValDateTrunc(val, part FastVal) FastVal {
+	dateVal := FastValDateFunc(val)
+	partBytes, ok := fastValStringBytes(part)
+	if dateVal.Type() != TimeValue || !ok {
+		return NewNullFastVal()
+	}
+
+	truncated, ok := truncateTime(*dateVal.GetTime(), string(partBytes))
+	if !ok {
+		return NewNullFastVal()
+	}
+	return NewBinStringFastVal([]byte(truncated.Format(time.RFC3339)))
+}
+
+// FastValWeekday returns the name of the day of the week of a date, such as
+// "Saturday".  Anything which is not a date gives null.
+func FastValWeekday(val FastVal) FastVal {
+	dateVal := FastValDateFunc(val)
+	if dateVal.Type() != TimeValue {
+		return NewNullFastVal()
+	}
+	return NewBinStringFastVal([]byte(dateVal.GetTime().Weekday().String()))
+}
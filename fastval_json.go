@@ -0,0 +1,210 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+// encodeJsonPath writes the path applied to the result of DECODE_JSON() as
+// the constant that FastValDecodeJson takes
+func encodeJsonPath(path []string) string {
+	if path == nil {
+		path = []string{}
+	}
+	encoded, _ := json.Marshal(path)
+	return string(encoded)
+}
+
+func decodeJsonPath(val FastVal) ([]string, bool) {
+	pathBytes, ok := fastValStringBytes(val)
+	if !ok {
+		return nil, false
+	}
+	var path []string
+	if err := json.Unmarshal(pathBytes, &path); err != nil {
+		return nil, false
+	}
+	return path, true
+}
+
+// decodeJsonOf returns the string operand of DECODE_JSON() and the path
+// applied to its result
+func decodeJsonOf(expr FuncExpr) (Expression, []string, bool) {
+	if expr.FuncName != DecodeJsonFunc || len(expr.Params) != 2 {
+		return nil, nil, false
+	}
+	pathVal, ok := expr.Params[1].(ValueExpr)
+	if !ok {
+		return nil, nil, false
+	}
+	pathStr, ok := pathVal.Value.(string)
+	if !ok {
+		return nil, nil, false
+	}
+	var path []string
+	if err := json.Unmarshal([]byte(pathStr), &path); err != nil {
+		return nil, nil, false
+	}
+	return expr.Params[0], path, true
+}
+
+// jsonValueAtPath steps the tokenizer from the start of a value to the value
+// found by following the path, returning its first token
+func jsonValueAtPath(tokens *jsonTokenizer, path []string) (tokenType, []byte, bool) {
+	token, tokenData, _, err := tokens.Step()
+	if err != nil {
+		return tknUnknown, nil, false
+	}
+
+	for _, elem := range path {
+		var ok bool
+		if fmtArrayIndexRegex.MatchString(elem) {
+			index, err := strconv.Atoi(elem[1 : len(elem)-1])
+			if err != nil || token != tknArrayStart {
+				return tknUnknown, nil, false
+			}
+			token, tokenData, ok = jsonArrayElem(tokens, index)
+		} else {
+			if token != tknObjectStart {
+				return tknUnknown, nil, false
+			}
+			token, tokenData, ok = jsonObjectElem(tokens, elem)
+		}
+		if !ok {
+			return tknUnknown, nil, false
+		}
+	}
+	return token, tokenData, true
+}
+
+// jsonArrayElem steps into the element of the array at the given index
+func jsonArrayElem(tokens *jsonTokenizer, index int) (tokenType, []byte, bool) {
+	for i := 0; ; i++ {
+		token, tokenData, _, err := tokens.Step()
+		if err != nil || token == tknArrayEnd {
+			return tknUnknown, nil, false
+		}
+		if i != 0 {
+			if token != tknListDelim {
+				return tknUnknown, nil, false
+			}
+			token, tokenData, _, err = tokens.Step()
+			if err != nil {
+				return tknUnknown, nil, false
+			}
+		}
+
+		if i == index {
+			return token, tokenData, true
+		}
+		if token == tknObjectStart || token == tknArrayStart {
+			if tokens.SkipValue() != nil {
+				return tknUnknown, nil, false
+			}
+		}
+	}
+}
+
+// jsonObjectElem steps into the value of the object under the given key
+func jsonObjectElem(tokens *jsonTokenizer, key string) (tokenType, []byte, bool) {
+	for i := 0; ; i++ {
+		token, tokenData, tokenDataLen, err := tokens.Step()
+		if err != nil || token == tknObjectEnd {
+			return tknUnknown, nil, false
+		}
+		if i != 0 {
+			if token != tknListDelim {
+				return tknUnknown, nil, false
+			}
+			token, tokenData, tokenDataLen, err = tokens.Step()
+			if err != nil {
+				return tknUnknown, nil, false
+			}
+		}
+		if token != tknString && token != tknEscString {
+			return tknUnknown, nil, false
+		}
+		keyBytes := tokens.ParseKey(token, tokenData, tokenDataLen)
+
+		if token, _, _, err = tokens.Step(); err != nil || token != tknObjectKeyDelim {
+			return tknUnknown, nil, false
+		}
+		token, tokenData, _, err = tokens.Step()
+		if err != nil {
+			return tknUnknown, nil, false
+		}
+
+		if string(keyBytes) == key {
+			return token, tokenData, true
+		}
+		if token == tknObjectStart || token == tknArrayStart {
+			if tokens.SkipValue() != nil {
+				return tknUnknown, nil, false
+			}
+		}
+	}
+}
+
+// FastValDecodeJson parses a string holding a JSON document and returns the
+// value at the path within it, which is a JSON array of path elements as
+// written by encodeJsonPath.  As for fields, only literals have a value, and
+// anything else, including strings which are not JSON, is missing.
+func FastValDecodeJson(val, path FastVal) FastVal {
+	data, ok := fastValStringBytes(val)
+	if !ok {
+		return NewMissingFastVal()
+	}
+	pathElems, ok := decodeJsonPath(path)
+	if !ok {
+		return NewMissingFastVal()
+	}
+
+	var tokens jsonTokenizer
+	tokens.Reset(data)
+	token, tokenData, ok := jsonValueAtPath(&tokens, pathElems)
+	if !ok || !isLiteralToken(token) {
+		return NewMissingFastVal()
+	}
+	return tokens.ParseLiteral(token, tokenData)
+}
+
+// FastValEncodeJson returns the JSON text of a value as a string, so that
+// for example the string a"b gives "a\"b" including its quotes
+func FastValEncodeJson(val FastVal) FastVal {
+	var encoded []byte
+	switch val.dataType {
+	case MissingValue:
+		return val
+	case NullValue:
+		encoded = []byte("null")
+	case TrueValue:
+		encoded = []byte("true")
+	case FalseValue:
+		encoded = []byte("false")
+	case IntValue, JsonIntValue:
+		encoded = strconv.AppendInt(nil, val.AsInt(), 10)
+	case UintValue, JsonUintValue:
+		encoded = strconv.AppendUint(nil, val.AsUint(), 10)
+	case FloatValue, JsonFloatValue:
+		floatVal := val.AsFloat()
+		if math.IsInf(floatVal, 0) || math.IsNaN(floatVal) {
+			return NewNullFastVal()
+		}
+		encoded = strconv.AppendFloat(nil, floatVal, 'g', -1, 64)
+	default:
+		str, ok := fastValStringBytes(val)
+		if !ok {
+			return NewNullFastVal()
+		}
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(string(str))
+		encoded = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	}
+	return NewBinStringFastVal(encoded)
+}
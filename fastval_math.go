@@ -34,6 +34,18 @@ func FastValMathRound(val FastVal) FastVal {
 	return NewInvalidFastVal()
 }
 
+// FastValMathRoundEven rounds halves to the even neighbour, so that 2.5
+// gives 2 where FastValMathRound gives 3
+func FastValMathRoundEven(val FastVal) FastVal {
+	if val.IsFloat() {
+		return NewFloatFastVal(math.RoundToEven(val.AsFloat()))
+	} else if val.IsInt() || val.IsUInt() {
+		return val
+	}
+
+	return NewInvalidFastVal()
+}
+
 func FastValMathAbs(val FastVal) FastVal {
 	if val.IsUInt() {
 		// Not gonna do abs on an uint
@@ -150,6 +162,16 @@ func FastValMathLog(val FastVal) FastVal {
 	return genericFastValFloatOp(val, math.Log10)
 }
 
+// FastValMathLog10 is the same as FastValMathLog, for those who expect the
+// base in the name
+func FastValMathLog10(val FastVal) FastVal {
+	return genericFastValFloatOp(val, math.Log10)
+}
+
+func FastValMathLog2(val FastVal) FastVal {
+	return genericFastValFloatOp(val, math.Log2)
+}
+
 func FastValMathCeil(val FastVal) FastVal {
 	return genericFastValFloatOp(val, math.Ceil)
 }
@@ -190,7 +212,14 @@ func FastValMathDiv(val, val1 FastVal) FastVal {
 	return genericFastVal2FloatsOp(val, val1, fastValMathDiv)
 }
 
+// FastValMathMod works on the integer parts of its operands.  A divisor
+// which is zero once truncated, such as 0.5, gives NaN rather than dividing
+// by zero, so that it follows the NonFinitePolicy of the matcher in the same
+// way as a float division by zero.
 func FastValMathMod(val, val1 FastVal) FastVal {
+	if val.IsNumeric() && val1.IsNumeric() && val1.AsInt() == 0 {
+		return NewFloatFastVal(math.NaN())
+	}
 	return genericFastVal2IntsOp(val, val1, fastValMathMod)
 }
 
@@ -0,0 +1,62 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"unicode"
+	"unicode/utf8"
+)
+
+// fastValStringBytes returns the unescaped bytes of a string value
+func fastValStringBytes(val FastVal) ([]byte, bool) {
+	switch val.dataType {
+	case StringValue:
+		return []byte(val.data.(string)), true
+	case BinStringValue:
+		return val.sliceData, true
+	case JsonStringValue:
+		unescaped, err := unescapeJsonString(val.sliceData, nil)
+		return unescaped, err == nil
+	}
+	return nil, false
+}
+
+func isTokenRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// FastValTokenMatch checks whether word is one of the tokens of str, which
+// are the runs of letters and digits that it is made up of, in the same way
+// as N1QL's ARRAY_CONTAINS(TOKENS(str), word).  Values which are not
+// strings give null.
+func FastValTokenMatch(str, word FastVal) FastVal {
+	strBytes, ok := fastValStringBytes(str)
+	if !ok {
+		return NewNullFastVal()
+	}
+	wordBytes, ok := fastValStringBytes(word)
+	if !ok {
+		return NewNullFastVal()
+	}
+
+	tokenStart := -1
+	for pos := 0; pos <= len(strBytes); {
+		r, size := utf8.DecodeRune(strBytes[pos:])
+		if pos < len(strBytes) && isTokenRune(r) {
+			if tokenStart < 0 {
+				tokenStart = pos
+			}
+		} else if tokenStart >= 0 {
+			if bytes.Equal(strBytes[tokenStart:pos], wordBytes) {
+				return NewBoolFastVal(true)
+			}
+			tokenStart = -1
+		}
+		if size == 0 {
+			break
+		}
+		pos += size
+	}
+	return NewBoolFastVal(false)
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"sort"
+)
+
+// fieldTrie finds the ExecNode for an object key directly from the bytes
+// read by the tokenizer, without converting them to a string for a map
+// lookup.  Chains of nodes with a single child are merged into a prefix.
+type fieldTrie struct {
+	nodes []fieldTrieNode
+}
+
+type fieldTrieNode struct {
+	// Bytes which must follow on from the parent
+	prefix []byte
+	// The next byte of the key for each child
+	labels   []byte
+	children []int32
+	elem     *ExecNode
+	// Position of the key amongst the sorted keys of the trie
+	elemIdx int
+}
+
+func newFieldTrie(elems map[string]*ExecNode) *fieldTrie {
+	if len(elems) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(elems))
+	for key := range elems {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	trie := &fieldTrie{}
+	trie.build(keys, 0, elems, 0)
+	return trie
+}
+
+// build adds the node for a sorted set of keys which share their first depth
+// bytes and start at position keyIdx, returning its index
+func (trie *fieldTrie) build(keys []string, depth int, elems map[string]*ExecNode, keyIdx int) int32 {
+	nodeIdx := int32(len(trie.nodes))
+	trie.nodes = append(trie.nodes, fieldTrieNode{})
+
+	// Sorted keys share the longest common prefix of the first and last
+	first, last := keys[0][depth:], keys[len(keys)-1][depth:]
+	prefixLen := 0
+	for prefixLen < len(first) && prefixLen < len(last) && first[prefixLen] == last[prefixLen] {
+		prefixLen++
+	}
+
+	node := fieldTrieNode{prefix: []byte(first[:prefixLen]), elemIdx: -1}
+	depth += prefixLen
+
+	for len(keys) > 0 {
+		if len(keys[0]) == depth {
+			node.elem = elems[keys[0]]
+			node.elemIdx = keyIdx
+			keys = keys[1:]
+			keyIdx++
+			continue
+		}
+
+		label := keys[0][depth]
+		groupLen := 1
+		for groupLen < len(keys) && keys[groupLen][depth] == label {
+			groupLen++
+		}
+
+		node.labels = append(node.labels, label)
+		node.children = append(node.children, trie.build(keys[:groupLen], depth+1, elems, keyIdx))
+		keys = keys[groupLen:]
+		keyIdx += groupLen
+	}
+
+	trie.nodes[nodeIdx] = node
+	return nodeIdx
+}
+
+// Lookup returns the node for a key along with the position of the key in
+// sorted order, or nil when it is not of interest
+func (trie *fieldTrie) Lookup(key []byte) (*ExecNode, int) {
+	if trie == nil {
+		return nil, -1
+	}
+
+	node := &trie.nodes[0]
+	for {
+		if len(key) < len(node.prefix) || string(key[:len(node.prefix)]) != string(node.prefix) {
+			return nil, -1
+		}
+		key = key[len(node.prefix):]
+
+		if len(key) == 0 {
+			return node.elem, node.elemIdx
+		}
+
+		next := int32(-1)
+		for i, label := range node.labels {
+			if label == key[0] {
+				next = node.children[i]
+				break
+			}
+		}
+		if next < 0 {
+			return nil, -1
+		}
+
+		key = key[1:]
+		node = &trie.nodes[next]
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldTrie(t *testing.T) {
+	assert := assert.New(t)
+
+	elems := make(map[string]*ExecNode)
+	for _, key := range []string{"", "a", "ab", "abc", "abd", "name", "names", "nation", "[0]", "[10]", "[1]", "\xff"} {
+		elems[key] = &ExecNode{}
+	}
+	trie := newFieldTrie(elems)
+
+	for key, elem := range elems {
+		found, _ := trie.Lookup([]byte(key))
+		assert.True(found == elem, "key %q", key)
+	}
+	for _, key := range []string{"b", "abcd", "nam", "nations", "[", "[2]", "\xfe"} {
+		found, _ := trie.Lookup([]byte(key))
+		assert.Nil(found, "key %q", key)
+	}
+
+	// Chains of single children are merged
+	trie = newFieldTrie(map[string]*ExecNode{"address": {}, "addresses": {}})
+	assert.Equal(2, len(trie.nodes))
+	assert.Equal("address", string(trie.nodes[0].prefix))
+
+	assert.Nil(newFieldTrie(nil))
+	found, _ := newFieldTrie(nil).Lookup([]byte("a"))
+	assert.Nil(found)
+}
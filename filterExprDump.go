@@ -0,0 +1,84 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"encoding/json"
+)
+
+// pruneAstJson drops the members of the parse tree which were not filled in
+// by the parser, which are most of them as each node only uses one of its
+// alternatives
+func pruneAstJson(data interface{}) (interface{}, bool) {
+	switch data := data.(type) {
+	case nil:
+		return nil, false
+	case string:
+		return data, data != ""
+	case map[string]interface{}:
+		for key, value := range data {
+			if pruned, keep := pruneAstJson(value); keep {
+				data[key] = pruned
+			} else {
+				delete(data, key)
+			}
+		}
+		return data, len(data) > 0
+	case []interface{}:
+		var out []interface{}
+		for _, value := range data {
+			if pruned, keep := pruneAstJson(value); keep {
+				out = append(out, pruned)
+			}
+		}
+		return out, len(out) > 0
+	}
+	return data, true
+}
+
+func dumpAST(expression string, withExpression bool) ([]byte, error) {
+	_, fe, err := NewFilterExpressionParser(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	feJson, err := json.Marshal(fe)
+	if err != nil {
+		return nil, err
+	}
+	var feData interface{}
+	if err := json.Unmarshal(feJson, &feData); err != nil {
+		return nil, err
+	}
+	feData, _ = pruneAstJson(feData)
+
+	dump := map[string]interface{}{
+		"filter": feData,
+	}
+	if withExpression {
+		expr, err := fe.OutputExpression()
+		if err != nil {
+			return nil, err
+		}
+		exprData, err := expressionJsonData(expr)
+		if err != nil {
+			return nil, err
+		}
+		dump["expression"] = exprData
+	}
+	return json.MarshalIndent(dump, "", "  ")
+}
+
+// DumpAST parses a filter expression and returns its parse tree as JSON,
+// under the "filter" member, for debugging and tooling.  Parts of the tree
+// which the expression does not use are left out.
+func DumpAST(expression string) ([]byte, error) {
+	return dumpAST(expression, false)
+}
+
+// DumpASTWithExpression returns the parse tree of a filter expression in the
+// same way as DumpAST, along with the Expression it is lowered to under the
+// "expression" member, in the form read by ParseJsonExpression
+func DumpASTWithExpression(expression string) ([]byte, error) {
+	return dumpAST(expression, true)
+}
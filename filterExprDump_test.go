@@ -0,0 +1,68 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpAST(t *testing.T) {
+	assert := assert.New(t)
+
+	out, err := DumpAST(`a > 2`)
+	assert.Nil(err)
+	assert.JSONEq(`{"filter": {"AndConditions": [{"OrConditions": [{"Operand": {
+		"LHS": {"Field": {"Path": [{"StrValue": {"StrValue": "a"}}]}},
+		"Op": {"OpChars0": {"GreaterThan": true}},
+		"RHS": {"Value": {"IntValue": 2}}
+	}}]}]}}`, string(out))
+
+	out, err = DumpASTWithExpression(`a > 2 AND (b = "c" OR NOT EXISTS(d))`)
+	assert.Nil(err)
+	var dump struct {
+		Filter     map[string]interface{}
+		Expression json.RawMessage
+	}
+	assert.Nil(json.Unmarshal(out, &dump))
+	assert.NotNil(dump.Filter["AndConditions"])
+
+	expr, err := ParseJsonExpression(dump.Expression)
+	assert.Nil(err)
+	parsed, err := ParseFilterExpression(`a > 2 AND (b = "c" OR NOT EXISTS(d))`)
+	assert.Nil(err)
+	assert.Equal(parsed.String(), expr.String())
+
+	_, err = DumpAST(`a >`)
+	assert.NotNil(err)
+}
+
+func TestExpressionToJson(t *testing.T) {
+	assert := assert.New(t)
+
+	expr := AndExpr{
+		AnyInExpr{
+			VarId:  1,
+			InExpr: FieldExpr{Root: 0, Path: []string{"items"}},
+			SubExpr: EqualsExpr{
+				FuncExpr{MathFuncAbs, []Expression{FieldExpr{Root: 1, Path: []string{"qty"}}}},
+				ValueExpr{2.5},
+			},
+		},
+		LikeExpr{FieldExpr{Root: 0, Path: []string{"name"}}, RegexExpr{"^N"}},
+		NotExistsExpr{FieldExpr{Root: 0, Path: []string{"deleted"}}},
+	}
+
+	out, err := ExpressionToJson(expr)
+	assert.Nil(err)
+	assert.Equal(`["and",["anyin",1,["field",0,"items"],["equals",["func","mathAbs",["field",1,"qty"]],["value",2.5]]],["like",["field",0,"name"],["regex","^N"]],["notexists",["field",0,"deleted"]]]`, string(out))
+
+	reparsed, err := ParseJsonExpression(out)
+	assert.Nil(err)
+	assert.Equal(expr.String(), reparsed.String())
+
+	_, err = ExpressionToJson(TrueExpr{})
+	assert.NotNil(err)
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// fuzzTransformLimits bounds the definitions FuzzParse compiles, so that
+// inputs which blow up in size are rejected rather than slowing the fuzzer
+var fuzzTransformLimits = TransformLimits{
+	MaxNodes:     10000,
+	MaxLeaves:    10000,
+	MaxLoopDepth: 32,
+}
+
+// fuzzParseLimits bounds the inputs FuzzParse parses for the same reason
+var fuzzParseLimits = FilterExpressionLimits{
+	MaxLength: 4096,
+	MaxTokens: 1024,
+	MaxDepth:  64,
+}
+
+// FuzzParse is an entry point for fuzzing the filter expression grammar, in
+// the form used by go-fuzz and simple to call from a native Go fuzz target.
+// It parses data as a filter expression and, when it parses, checks that it
+// formats and parses back into the same expression and that it compiles into
+// a matcher.  Errors are expected for most inputs, but a panic, or a failed
+// check, which FuzzParse reports by panicking, is a bug.  It returns 1 for
+// inputs which parsed and 0 otherwise, so that fuzzers favour inputs which
+// get past the parser.
+func FuzzParse(data []byte) int {
+	parser := &feHandParser{limits: fuzzParseLimits}
+	fe := &FilterExpression{}
+	if err := parseFilterExpressionStringWith(parser, string(data), fe); err != nil {
+		return 0
+	}
+	expr, err := fe.OutputExpression()
+	if err != nil {
+		return 0
+	}
+
+	formatted, err := FormatExpression(expr)
+	if err == ErrorNotRepresentable {
+		return 1
+	} else if err != nil {
+		panic(fmt.Sprintf("failed to format %q: %v", data, err))
+	}
+	if _, err := ReparseExpression(expr); err != nil {
+		panic(fmt.Sprintf("failed to reparse %q formatted as %q: %v", data, formatted, err))
+	}
+
+	var trans Transformer
+	if _, err := trans.TransformWithLimits([]Expression{expr}, fuzzTransformLimits); err != nil {
+		if _, ok := err.(*TransformLimitError); !ok {
+			panic(fmt.Sprintf("failed to transform %q: %v", data, err))
+		}
+	}
+	return 1
+}
+
+// filterExprFuzzCorpus covers each production of the grammar at least once
+var filterExprFuzzCorpus = []string{
+	`a = 1`,
+	`a == "b" AND c != 2.5`,
+	`a <> 1 OR b >= 2 OR c <= 3e2`,
+	`a > 1 AND (b < 2 OR NOT c = 3)`,
+	`NOT a = 1 OR NOT EXISTS(b)`,
+	`a IS NULL AND b IS NOT NULL`,
+	`a IS MISSING OR b IS NOT MISSING`,
+	`a = TRUE AND b = false`,
+	`TRUE`,
+	`EXISTS(a.b)`,
+	"`field name`.`a-b` = \"c\"",
+	`a.b[1].c = 1`,
+	`a.**.c = 1`,
+	`META().id = "key"`,
+	`META().expiration > 0`,
+	`a + 1 > b * 2`,
+	`a - 1 = b / 2 AND c % 3 = 0`,
+	`ABS(a) = 1 AND CEIL(b) > FLOOR(c)`,
+	`ACOS(a) < ASIN(b) OR ATAN(c) = COS(d)`,
+	`DEGREES(a) = RADIANS(b) AND EXP(c) > LOG(d)`,
+	`LN(a) = SIN(b) OR TAN(c) = ROUND(d) OR SQRT(e) = 2`,
+	`ATAN2(a, b) = POW(c, 2)`,
+	`MOD(a, 3) = 1`,
+	`PI() < a AND E() > b`,
+	`NOW_MILLIS() < META().expiration * 1000`,
+	`DATE(a) > DATE("2019-01-01T00:00:00Z")`,
+	`DATE_TRUNC_STR(a, "year") = "2019-01-01"`,
+	`WEEKDAY_STR(a) = "Monday"`,
+	`BASE64_DECODE(a) = BASE64_ENCODE("b")`,
+	`ENCODE_JSON(a) = "{}"`,
+	`DECODE_JSON(payload).a[1].b = 2`,
+	`REGEXP_CONTAINS(a, "^x") AND NOT REGEXP_CONTAINS(b, "y$")`,
+	`ARRAY_CONTAINS(tags, "a")`,
+	`ARRAY_CONTAINS(TOKENS(a), "b")`,
+	`tags = ["a", 1, -2.5, []]`,
+	`address = {"zip": "10001", "loc": [-1.5, 2]}`,
+	`ANY x WITHIN a SATISFIES x.b = 1 END`,
+	`ANY x WITHIN a SATISFIES x.**.b = 1 END`,
+	`ANY x WITHIN a SATISFIES ANY y WITHIN x.b SATISFIES y = 1 END END`,
+	`FIRST x.a FOR x IN b WHEN x.c = 1 END = 2`,
+	`LET t = a * b WHERE t > 1`,
+	`LET t = a.b, u = t WHERE u = 1`,
+	`SELF.a = SELF`,
+	`$doc.a = $other.a`,
+	`a = 1 AND b = 2 OR c = 3`,
+	`((a = 1) OR (b = 2)) AND c = 3`,
+}
+
+// FilterExpressionFuzzCorpus returns inputs to seed a corpus for FuzzParse
+// with, covering each production of the filter expression grammar
+func FilterExpressionFuzzCorpus() [][]byte {
+	corpus := make([][]byte, len(filterExprFuzzCorpus))
+	for i, expression := range filterExprFuzzCorpus {
+		corpus[i] = []byte(expression)
+	}
+	return corpus
+}
+
+// WriteFilterExpressionFuzzCorpus writes the inputs returned by
+// FilterExpressionFuzzCorpus into a directory, creating it if needed, as one
+// file per input named after the SHA-1 of its contents, which is the layout
+// go-fuzz uses for its corpus
+func WriteFilterExpressionFuzzCorpus(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, input := range FilterExpressionFuzzCorpus() {
+		sum := sha1.Sum(input)
+		name := filepath.Join(dir, hex.EncodeToString(sum[:]))
+		if err := ioutil.WriteFile(name, input, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuzzParseCorpus(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, input := range FilterExpressionFuzzCorpus() {
+		assert.Equal(1, FuzzParse(input), string(input))
+	}
+}
+
+func TestFuzzParseNoPanic(t *testing.T) {
+	assert := assert.New(t)
+
+	// Inputs which used to panic while lexing or compiling
+	inputs := []string{
+		`'`,
+		"`",
+		`a = '`,
+		"a = 1 AND `b",
+		`a.** = b.**`,
+		`a.**.c = ** * 1`,
+		`ANY x WITHIN a SATISFIES ANY y WITHIN b SATISFIES y = 1 END END`,
+		`ANY x WITHIN a SATISFIES b.** = 1 END`,
+		`FIRST x.a FOR x IN b WHEN ANY y WITHIN c SATISFIES y = x END END = 1`,
+	}
+	for _, input := range inputs {
+		assert.NotPanics(func() {
+			assert.Equal(0, FuzzParse([]byte(input)), input)
+		}, input)
+	}
+
+	_, err := ParseFilterExpression(`a.** = b.**`)
+	assert.True(errors.Is(err, ErrSyntax))
+	_, err = ParseFilterExpression(`ANY x WITHIN a SATISFIES x.** = 1 END`)
+	assert.Nil(err)
+}
+
+func TestWriteFilterExpressionFuzzCorpus(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gojsonsm-corpus")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	corpusDir := filepath.Join(dir, "corpus")
+	assert.Nil(WriteFilterExpressionFuzzCorpus(corpusDir))
+	files, err := ioutil.ReadDir(corpusDir)
+	assert.Nil(err)
+	assert.Equal(len(FilterExpressionFuzzCorpus()), len(files))
+
+	data, err := ioutil.ReadFile(filepath.Join(corpusDir, files[0].Name()))
+	assert.Nil(err)
+	assert.Equal(1, FuzzParse(data))
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+// GrammarProduction is a single EBNF rule of the filter expression grammar
+type GrammarProduction struct {
+	Name       string
+	Definition string
+}
+
+type GrammarFunctionKind int
+
+const (
+	// Returns a value, usable as either side of a comparison
+	GrammarFunctionValue GrammarFunctionKind = iota
+	// Returns a boolean, usable as a whole condition
+	GrammarFunctionBoolean GrammarFunctionKind = iota
+	// Usable as the first element of a field path
+	GrammarFunctionPath GrammarFunctionKind = iota
+)
+
+func (kind GrammarFunctionKind) String() string {
+	switch kind {
+	case GrammarFunctionValue:
+		return "value"
+	case GrammarFunctionBoolean:
+		return "boolean"
+	case GrammarFunctionPath:
+		return "path"
+	default:
+		return "unknown"
+	}
+}
+
+type GrammarFunction struct {
+	Name    string
+	NumArgs int
+	Kind    GrammarFunctionKind
+}
+
+type GrammarOperatorKind int
+
+const (
+	GrammarOperatorLogical    GrammarOperatorKind = iota
+	GrammarOperatorComparison GrammarOperatorKind = iota
+	GrammarOperatorCheck      GrammarOperatorKind = iota
+	GrammarOperatorArithmetic GrammarOperatorKind = iota
+)
+
+func (kind GrammarOperatorKind) String() string {
+	switch kind {
+	case GrammarOperatorLogical:
+		return "logical"
+	case GrammarOperatorComparison:
+		return "comparison"
+	case GrammarOperatorCheck:
+		return "check"
+	case GrammarOperatorArithmetic:
+		return "arithmetic"
+	default:
+		return "unknown"
+	}
+}
+
+type GrammarOperator struct {
+	Symbol string
+	Kind   GrammarOperatorKind
+}
+
+// FilterExpressionGrammar describes the grammar accepted by the filter
+// expression parser, for use by editors and other tooling
+type FilterExpressionGrammar struct {
+	Productions []GrammarProduction
+	Keywords    []string
+	Operators   []GrammarOperator
+	Functions   []GrammarFunction
+}
+
+// Keep in sync with the EBNF description in filterExprParser.go
+var filterExprProductions []GrammarProduction = []GrammarProduction{
+	{"FilterExpression", `[ LetClause ] ( AndCondition { "OR" AndCondition } ) { "AND" FilterExpression }`},
+	{"LetClause", `"LET" LetBinding { "," LetBinding } "WHERE"`},
+	{"LetBinding", `@Ident "=" LetValue`},
+	{"LetValue", `LetTerm { MathOp LetTerm }`},
+	{"LetTerm", `( "(" LetValue ")" ) | ConstFuncExpr | Value | Field`},
+	{"AndCondition", `{ OpenParens } Condition { "AND" Condition } { CloseParen }`},
+	{"Condition", `( [ "NOT" ] Condition ) | AnyWithinClause | Operand`},
+	{"AnyWithinClause", `"ANY" @Ident "WITHIN" ( "doc" | Field ) "SATISFIES" FilterExpression "END"`},
+	{"Operand", `BooleanExpr | ( LHS ( CheckOp | ( CompareOp RHS) ) )`},
+	{"BooleanExpr", `Boolean | BooleanFuncExpr`},
+	{"LHS", `FirstClause | ConstFuncExpr | Boolean | Field | Value`},
+	{"RHS", `FirstClause | ConstFuncExpr | Boolean | Value | Field`},
+	{"FirstClause", `"FIRST" Field "FOR" @Ident "IN" Field [ "WHEN" FilterExpression ] "END"`},
+	{"CompareOp", `"=" | "==" | "<>" | "!=" | ">" | ">=" | "<" | "<="`},
+	{"CheckOp", `( "IS" [ "NOT" ] ( NULL | MISSING ) )`},
+	{"Field", `{ @"-" } ( "SELF" | Input | DecodeJson | OnePath ) { "." OnePath } { MathOp MathValue }`},
+	{"Input", `"$" @Ident`},
+	{"DecodeJson", `"DECODE_JSON" "(" Field ")"`},
+	{"OnePath", `"**" | ( ( PathFuncExpression | StringType ){ ArrayIndex } )`},
+	{"StringType", `@String | @Ident | @RawString | @Char`},
+	{"ArrayIndex", `"[" @Int "]"`},
+	{"Value", `@String | @Int | @Float | ArrayValue | ObjectValue`},
+	{"ArrayValue", `"[" [ ArrayElem { "," ArrayElem } ] "]"`},
+	{"ArrayElem", `( @"-" ( @Int | @Float ) ) | Value`},
+	{"ObjectValue", `"{" [ @String ":" ArrayElem { "," @String ":" ArrayElem } ] "}"`},
+	{"ConstFuncExpr", `ConstFuncNoArg | ConstFuncOneArg | ConstFuncTwoArgs | DateTruncStr`},
+	{"ConstFuncNoArg", `ConstFuncNoArgName "(" ")"`},
+	{"ConstFuncNoArgName", `"PI" | "E" | "NOW_MILLIS"`},
+	{"ConstFuncOneArg", `ConstFuncOneArgName "(" ConstFuncArgument ")"`},
+	{"ConstFuncOneArgName", `"ABS" | "ACOS" | "ASIN" | "ATAN" | "CEIL" | "COS" | "DATE" | "DEGREES" | "EXP" | "FLOOR" | "LOG" | "LN" | "LOG10" | "LOG2" | "SIN" | "TAN" | "RADIANS" | "ROUND" | "ROUND_EVEN" | "SQRT" | "BASE64_DECODE" | "BASE64_ENCODE" | "ENCODE_JSON" | "WEEKDAY_STR"`},
+	{"ConstFuncTwoArgs", `ConstFuncTwoArgsName "(" ConstFuncArgument "," ConstFuncArgument ")"`},
+	{"ConstFuncTwoArgsName", `"ATAN2" | "POW" | "MOD"`},
+	{"DateTruncStr", `"DATE_TRUNC_STR" "(" ConstFuncArgument "," @String ")"`},
+	{"ConstFuncArgument", `ConstFuncExpr | Field | Value`},
+	{"ConstFuncArgumentRHS", `ConstFuncExpr | Value`},
+	{"PathFuncExpression", `OnePathFuncNoArg`},
+	{"OnePathFuncNoArg", `OnePathFuncNoArgName "(" ")"`},
+	{"OnePathFuncNoArgName", `"META"`},
+	{"MathOp", `@"+" | @"-" | @"*" | @"/" | @"%"`},
+	{"MathValue", `@Int | @Float`},
+	{"BooleanFuncExpr", `BooleanFuncTwoArgs | ArrayContainsClause | ExistsClause`},
+	{"BooleanFuncTwoArgs", `BooleanFuncTwoArgsName "(" ConstFuncArgument "," ConstFuncArgumentRHS ")"`},
+	{"BooleanFuncTwoArgsName", `"REGEXP_CONTAINS"`},
+	{"ArrayContainsClause", `"ARRAY_CONTAINS" "(" ( ( "TOKENS" "(" Field ")" ) | Field ) "," ConstFuncArgumentRHS ")"`},
+	{"ExistsClause", `( "EXISTS" "(" Field ")" )`},
+}
+
+var filterExprKeywords []string = []string{OperatorOr, OperatorAnd, OperatorNot, OperatorTrue, "true",
+	OperatorFalse, "false", "IS", "NULL", "MISSING", OperatorExists, OperatorMeta, OperatorAny, OperatorWithin,
+	OperatorDoc, OperatorSatisfies, OperatorEnd, OperatorFirst, OperatorFor, OperatorIn, OperatorWhen,
+	OperatorLet, OperatorWhere, OperatorSelf, FuncTokens}
+
+var filterExprOperators []GrammarOperator = []GrammarOperator{
+	{OperatorOr, GrammarOperatorLogical},
+	{OperatorAnd, GrammarOperatorLogical},
+	{OperatorNot, GrammarOperatorLogical},
+	{OperatorEquals, GrammarOperatorComparison},
+	{OperatorEquals2, GrammarOperatorComparison},
+	{OperatorNotEquals, GrammarOperatorComparison},
+	{OperatorNotEquals2, GrammarOperatorComparison},
+	{OperatorGreaterThan, GrammarOperatorComparison},
+	{OperatorGreaterThanEq, GrammarOperatorComparison},
+	{OperatorLessThan, GrammarOperatorComparison},
+	{OperatorLessThanEq, GrammarOperatorComparison},
+	{OperatorNull, GrammarOperatorCheck},
+	{OperatorNotNull, GrammarOperatorCheck},
+	{OperatorMissing, GrammarOperatorCheck},
+	{OperatorNotMissing, GrammarOperatorCheck},
+	{"+", GrammarOperatorArithmetic},
+	{"-", GrammarOperatorArithmetic},
+	{"*", GrammarOperatorArithmetic},
+	{"/", GrammarOperatorArithmetic},
+	{"%", GrammarOperatorArithmetic},
+}
+
+var filterExprFunctions []GrammarFunction = []GrammarFunction{
+	{"PI", 0, GrammarFunctionValue},
+	{"E", 0, GrammarFunctionValue},
+	{FuncNowMillis, 0, GrammarFunctionValue},
+	{FuncAbs, 1, GrammarFunctionValue},
+	{FuncAcos, 1, GrammarFunctionValue},
+	{FuncAsin, 1, GrammarFunctionValue},
+	{FuncAtan, 1, GrammarFunctionValue},
+	{FuncCeil, 1, GrammarFunctionValue},
+	{FuncCos, 1, GrammarFunctionValue},
+	{FuncDate, 1, GrammarFunctionValue},
+	{FuncDeg, 1, GrammarFunctionValue},
+	{FuncExp, 1, GrammarFunctionValue},
+	{FuncFloor, 1, GrammarFunctionValue},
+	{FuncLog, 1, GrammarFunctionValue},
+	{FuncLn, 1, GrammarFunctionValue},
+	{FuncLog10, 1, GrammarFunctionValue},
+	{FuncLog2, 1, GrammarFunctionValue},
+	{FuncSin, 1, GrammarFunctionValue},
+	{FuncTan, 1, GrammarFunctionValue},
+	{FuncRad, 1, GrammarFunctionValue},
+	{FuncRound, 1, GrammarFunctionValue},
+	{FuncRoundEven, 1, GrammarFunctionValue},
+	{FuncSqrt, 1, GrammarFunctionValue},
+	{FuncBase64Decode, 1, GrammarFunctionValue},
+	{FuncBase64Encode, 1, GrammarFunctionValue},
+	{FuncEncodeJson, 1, GrammarFunctionValue},
+	{FuncDecodeJson, 1, GrammarFunctionValue},
+	{FuncWeekdayStr, 1, GrammarFunctionValue},
+	{FuncAtan2, 2, GrammarFunctionValue},
+	{FuncPower, 2, GrammarFunctionValue},
+	{FuncMod, 2, GrammarFunctionValue},
+	{FuncDateTruncStr, 2, GrammarFunctionValue},
+	{FuncRegexp, 2, GrammarFunctionBoolean},
+	{FuncArrayContains, 2, GrammarFunctionBoolean},
+	{OperatorExists, 1, GrammarFunctionBoolean},
+	{OperatorMeta, 0, GrammarFunctionPath},
+}
+
+// GetFilterExpressionGrammar returns a description of the filter expression
+// grammar.  The returned value is a copy and may be modified by the caller.
+func GetFilterExpressionGrammar() FilterExpressionGrammar {
+	grammar := FilterExpressionGrammar{
+		Productions: make([]GrammarProduction, len(filterExprProductions)),
+		Keywords:    make([]string, len(filterExprKeywords)),
+		Operators:   make([]GrammarOperator, len(filterExprOperators)),
+		Functions:   make([]GrammarFunction, len(filterExprFunctions)),
+	}
+	copy(grammar.Productions, filterExprProductions)
+	copy(grammar.Keywords, filterExprKeywords)
+	copy(grammar.Operators, filterExprOperators)
+	copy(grammar.Functions, filterExprFunctions)
+	return grammar
+}
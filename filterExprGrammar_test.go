@@ -0,0 +1,48 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestFilterExpressionGrammarFunctions(t *testing.T) {
+	assert := assert.New(t)
+
+	grammar := GetFilterExpressionGrammar()
+	assert.NotEqual(0, len(grammar.Productions))
+	assert.Equal("FilterExpression", grammar.Productions[0].Name)
+
+	// Every advertised function must be accepted by the parser
+	for _, fn := range grammar.Functions {
+		args := make([]string, fn.NumArgs)
+		for i := range args {
+			args[i] = fmt.Sprintf("f%d", i)
+		}
+		call := fmt.Sprintf("%s(%s)", fn.Name, strings.Join(args, ", "))
+		if fn.Name == FuncDateTruncStr {
+			// The part to truncate to has to be a string naming one
+			call = strings.Replace(call, "f1", "\"day\"", 1)
+		}
+
+		var expression string
+		switch fn.Kind {
+		case GrammarFunctionValue:
+			expression = call + " > 1"
+		case GrammarFunctionBoolean:
+			expression = strings.Replace(call, "f1", "\"x\"", 1)
+		case GrammarFunctionPath:
+			expression = call + ".id = \"x\""
+		}
+
+		_, _, err := NewFilterExpressionParser(expression)
+		assert.Nil(err, expression)
+	}
+
+	// Modifying the result must not affect later callers
+	grammar.Keywords[0] = "changed"
+	assert.Equal(OperatorOr, GetFilterExpressionGrammar().Keywords[0])
+}
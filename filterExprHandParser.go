@@ -0,0 +1,1203 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/scanner"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A hand-written recursive-descent parser for the grammar described in
+// filterExprParser.go, filling in the FilterExpression structures.  Each
+// function below mirrors one grammar production, tries alternatives in the
+// order the grammar lists them, and leaves the position unchanged when it
+// does not match.  No reflection is involved, so expressions can also be
+// parsed on targets such as TinyGo/WASM.
+
+// feToken is a token as produced by text/scanner, with string literals
+// already unquoted
+type feToken struct {
+	typ   rune
+	value string
+	pos   scanner.Position
+}
+
+type feHandParser struct {
+	tokens []feToken
+	pos    int
+	// Keyspace names and aliases which are dropped from the start of fields
+	aliases []string
+	// Whether `==` only matches values of the same JSON type
+	strictEquals bool
+	limits       FilterExpressionLimits
+	// Conversion failures abort the whole parse
+	err error
+}
+
+func lexFilterExpression(expression string) ([]feToken, error) {
+	var lexErr error
+	var s scanner.Scanner
+	s.Init(strings.NewReader(expression))
+	s.Error = func(s *scanner.Scanner, msg string) {
+		// Single quoted strings are reported as invalid char literals, but
+		// are accepted as strings
+		if !strings.HasSuffix(msg, "char literal") && lexErr == nil {
+			pos := s.Pos()
+			lexErr = &FilterExpressionError{ErrSyntax, pos.Line, pos.Column, msg, pos.Offset}
+		}
+	}
+
+	var tokens []feToken
+	for typ := s.Scan(); typ != scanner.EOF; typ = s.Scan() {
+		// Stop at the first error, as the text of an unterminated literal
+		// is missing the closing quote that is stripped below
+		if lexErr != nil {
+			return nil, lexErr
+		}
+		// The scanner only skips ASCII spaces, tabs and newlines, other
+		// whitespace such as form feeds and non-breaking spaces is returned
+		// as tokens of its own
+		if unicode.IsSpace(typ) {
+			continue
+		}
+		token := feToken{typ, s.TokenText(), s.Position}
+		switch typ {
+		case scanner.Char:
+			token.value = "\"" + token.value[1:len(token.value)-1] + "\""
+			fallthrough
+		case scanner.String:
+			value, err := strconv.Unquote(token.value)
+			if err != nil {
+				return nil, &FilterExpressionError{ErrSyntax, token.pos.Line, token.pos.Column,
+					fmt.Sprintf("%v: %q", err, token.value), token.pos.Offset}
+			}
+			token.value = value
+			if typ == scanner.Char && utf8.RuneCountInString(value) > 1 {
+				token.typ = scanner.String
+			}
+		case scanner.RawString:
+			token.value = token.value[1 : len(token.value)-1]
+		}
+		tokens = append(tokens, token)
+	}
+	if lexErr != nil {
+		return nil, lexErr
+	}
+	return tokens, nil
+}
+
+// parseFilterExpressionString parses the expression into fe
+func parseFilterExpressionString(expression string, fe *FilterExpression) error {
+	return parseFilterExpressionStringWithAliases(expression, nil, fe)
+}
+
+// parseFilterExpressionStringWithAliases parses the expression into fe,
+// leaving out any of the aliases that prefix a field
+func parseFilterExpressionStringWithAliases(expression string, aliases []string, fe *FilterExpression) error {
+	return parseFilterExpressionStringWith(&feHandParser{aliases: aliases}, expression, fe)
+}
+
+// parseFilterExpressionStringWith parses the expression into fe using a
+// parser holding the options to parse it with
+func parseFilterExpressionStringWith(p *feHandParser, expression string, fe *FilterExpression) error {
+	if err := p.limits.checkLength(expression); err != nil {
+		return err
+	}
+	tokens, err := lexFilterExpression(expression)
+	if err != nil {
+		return err
+	}
+	if err := p.limits.checkTokens(tokens); err != nil {
+		return err
+	}
+
+	p.tokens = tokens
+	parsed := p.filterExpression()
+	if p.err != nil {
+		return p.err
+	}
+	if parsed == nil || p.pos < len(p.tokens) {
+		return p.unexpected()
+	}
+
+	*fe = *parsed
+	return nil
+}
+
+func (p *feHandParser) unexpected() error {
+	if p.pos >= len(p.tokens) {
+		return newFilterExpressionError(ErrSyntax, "unexpected end of expression")
+	}
+	token := p.tokens[p.pos]
+	return &FilterExpressionError{ErrSyntax, token.pos.Line, token.pos.Column,
+		fmt.Sprintf("unexpected %q", token.value), token.pos.Offset}
+}
+
+func (p *feHandParser) peek() *feToken {
+	if p.pos >= len(p.tokens) || p.err != nil {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+// literal consumes the next token if its value is one of the given literals
+func (p *feHandParser) literal(values ...string) (string, bool) {
+	token := p.peek()
+	if token == nil {
+		return "", false
+	}
+	for _, value := range values {
+		if token.value == value {
+			p.pos++
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// ofType consumes the next token if it is of the given type
+func (p *feHandParser) ofType(typ rune) (string, bool) {
+	token := p.peek()
+	if token == nil || token.typ != typ {
+		return "", false
+	}
+	p.pos++
+	return token.value, true
+}
+
+// sequence consumes each of the literals in order, or nothing at all
+func (p *feHandParser) sequence(values ...string) bool {
+	start := p.pos
+	for _, value := range values {
+		if _, ok := p.literal(value); !ok {
+			p.pos = start
+			return false
+		}
+	}
+	return true
+}
+
+func feTrue() *bool {
+	value := true
+	return &value
+}
+
+func (p *feHandParser) intValue() *int {
+	text, ok := p.ofType(scanner.Int)
+	if !ok {
+		return nil
+	}
+	value, err := strconv.ParseInt(text, 0, strconv.IntSize)
+	if err != nil {
+		p.err = newFilterExpressionError(ErrSyntax, "invalid integer %q: %v", text, err)
+		return nil
+	}
+	intValue := int(value)
+	return &intValue
+}
+
+func (p *feHandParser) floatValue() *float64 {
+	text, ok := p.ofType(scanner.Float)
+	if !ok {
+		return nil
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		p.err = newFilterExpressionError(ErrSyntax, "invalid float %q: %v", text, err)
+		return nil
+	}
+	return &value
+}
+
+func (p *feHandParser) filterExpression() *FilterExpression {
+	start := p.pos
+	lets := p.letClause()
+
+	first := p.andCondition()
+	if first == nil {
+		p.pos = start
+		return nil
+	}
+	fe := &FilterExpression{Lets: lets, AndConditions: []*FEAndCondition{first}}
+
+	for {
+		start := p.pos
+		if _, ok := p.literal(OperatorOr); ok {
+			if cond := p.andCondition(); cond != nil {
+				fe.AndConditions = append(fe.AndConditions, cond)
+				continue
+			}
+		}
+		p.pos = start
+		break
+	}
+
+	for {
+		start := p.pos
+		if _, ok := p.literal(OperatorAnd); ok {
+			if sub := p.filterExpression(); sub != nil {
+				fe.SubFilterExpr = append(fe.SubFilterExpr, sub)
+				continue
+			}
+		}
+		p.pos = start
+		break
+	}
+
+	return fe
+}
+
+func (p *feHandParser) letClause() []*FELetBinding {
+	start := p.pos
+	if _, ok := p.literal(OperatorLet); !ok {
+		return nil
+	}
+
+	var lets []*FELetBinding
+	for {
+		name, ok := p.ofType(scanner.Ident)
+		if !ok {
+			break
+		}
+		if _, ok := p.literal("="); !ok {
+			break
+		}
+		value := p.letValue()
+		if value == nil {
+			break
+		}
+		lets = append(lets, &FELetBinding{Name: name, Value: value})
+
+		if _, ok := p.literal(","); ok {
+			continue
+		}
+		if _, ok := p.literal(OperatorWhere); ok {
+			return lets
+		}
+		break
+	}
+
+	p.pos = start
+	return nil
+}
+
+func (p *feHandParser) letValue() *FELetValue {
+	first := p.letTerm()
+	if first == nil {
+		return nil
+	}
+	value := &FELetValue{Terms: []*FELetTerm{first}}
+
+	for {
+		opStart := p.pos
+		if op := p.mathArithmeticOp(); op != nil {
+			if term := p.letTerm(); term != nil {
+				value.Ops = append(value.Ops, op)
+				value.Terms = append(value.Terms, term)
+				continue
+			}
+		}
+		p.pos = opStart
+		break
+	}
+	return value
+}
+
+func (p *feHandParser) letTerm() *FELetTerm {
+	start := p.pos
+	if _, ok := p.literal("("); ok {
+		if value := p.letValue(); value != nil {
+			if _, ok := p.literal(")"); ok {
+				return &FELetTerm{Paren: value}
+			}
+		}
+		p.pos = start
+	}
+
+	if fn := p.constFuncExpression(); fn != nil {
+		return &FELetTerm{Func: fn}
+	}
+	if value := p.value(); value != nil {
+		return &FELetTerm{Value: value}
+	}
+	if field := p.field(); field != nil {
+		return &FELetTerm{Field: field}
+	}
+	return nil
+}
+
+func (p *feHandParser) andCondition() *FEAndCondition {
+	start := p.pos
+	ac := &FEAndCondition{}
+	for {
+		token := p.peek()
+		if _, ok := p.literal("("); !ok {
+			break
+		}
+		ac.OpenParens = append(ac.OpenParens, &FEOpenParen{"(", token.pos})
+	}
+
+	first := p.condition()
+	if first == nil {
+		p.pos = start
+		return nil
+	}
+	ac.OrConditions = append(ac.OrConditions, first)
+
+	for {
+		condStart := p.pos
+		if _, ok := p.literal(OperatorAnd); ok {
+			if cond := p.condition(); cond != nil {
+				ac.OrConditions = append(ac.OrConditions, cond)
+				continue
+			}
+		}
+		p.pos = condStart
+		break
+	}
+
+	for {
+		token := p.peek()
+		if _, ok := p.literal(")"); !ok {
+			break
+		}
+		ac.CloseParens = append(ac.CloseParens, &FECloseParen{")", token.pos})
+	}
+	return ac
+}
+
+func (p *feHandParser) condition() *FECondition {
+	start := p.pos
+	if _, ok := p.literal(OperatorNot); ok {
+		if not := p.condition(); not != nil {
+			return &FECondition{Not: not}
+		}
+		p.pos = start
+	}
+
+	if anyWithin := p.anyWithinClause(); anyWithin != nil {
+		return &FECondition{AnyWithin: anyWithin}
+	}
+
+	if operand := p.operand(); operand != nil {
+		return &FECondition{Operand: operand}
+	}
+	return nil
+}
+
+func (p *feHandParser) anyWithinClause() *FEAnyWithinClause {
+	start := p.pos
+	if _, ok := p.literal(OperatorAny); !ok {
+		return nil
+	}
+
+	clause := &FEAnyWithinClause{}
+	if name, ok := p.ofType(scanner.Ident); ok {
+		clause.Var = name
+		if _, ok := p.literal(OperatorWithin); ok {
+			// A backticked `doc` is still read as a field
+			if token := p.peek(); token != nil && token.typ == scanner.Ident && strings.EqualFold(token.value, OperatorDoc) {
+				p.pos++
+				clause.Doc = feTrue()
+			} else {
+				clause.Field = p.field()
+			}
+
+			if clause.Doc != nil || clause.Field != nil {
+				if _, ok := p.literal(OperatorSatisfies); ok {
+					if clause.Satisfies = p.filterExpression(); clause.Satisfies != nil {
+						if _, ok := p.literal(OperatorEnd); ok {
+							return clause
+						}
+					}
+				}
+			}
+		}
+	}
+
+	p.pos = start
+	return nil
+}
+
+func (p *feHandParser) operand() *FEOperand {
+	if boolExpr := p.booleanExpr(); boolExpr != nil {
+		return &FEOperand{BooleanExpr: boolExpr}
+	}
+
+	start := p.pos
+	lhs := p.lhs()
+	if lhs == nil {
+		return nil
+	}
+
+	opStart := p.pos
+	if op := p.compareOp(); op != nil {
+		if rhs := p.rhs(); rhs != nil {
+			return &FEOperand{LHS: lhs, Op: op, RHS: rhs}
+		}
+	}
+	p.pos = opStart
+
+	if checkOp := p.checkOp(); checkOp != nil {
+		return &FEOperand{LHS: lhs, CheckOp: checkOp}
+	}
+
+	p.pos = start
+	return nil
+}
+
+func (p *feHandParser) booleanExpr() *FEBooleanExpr {
+	if boolVal := p.boolean(); boolVal != nil {
+		return &FEBooleanExpr{BooleanVal: boolVal}
+	}
+	if boolFunc := p.booleanFuncExpr(); boolFunc != nil {
+		return &FEBooleanExpr{BooleanFunc: boolFunc}
+	}
+	return nil
+}
+
+func (p *feHandParser) boolean() *FEBoolean {
+	value, ok := p.literal("TRUE", "true", "FALSE", "false")
+	if !ok {
+		return nil
+	}
+
+	switch value {
+	case "TRUE":
+		return &FEBoolean{TVal: feTrue()}
+	case "true":
+		return &FEBoolean{TVal1: feTrue()}
+	case "FALSE":
+		return &FEBoolean{FVal: feTrue()}
+	default:
+		return &FEBoolean{FVal1: feTrue()}
+	}
+}
+
+func (p *feHandParser) booleanFuncExpr() *FEBooleanFuncExpr {
+	if twoArgs := p.booleanFuncTwoArgs(); twoArgs != nil {
+		return &FEBooleanFuncExpr{BooleanFuncTwoArgs: twoArgs}
+	}
+	if arrayContains := p.arrayContainsClause(); arrayContains != nil {
+		return &FEBooleanFuncExpr{ArrayContains: arrayContains}
+	}
+	if exists := p.existsClause(); exists != nil {
+		return &FEBooleanFuncExpr{ExistsClause: exists}
+	}
+	return nil
+}
+
+func (p *feHandParser) booleanFuncTwoArgs() *FEBooleanFuncTwoArgs {
+	start := p.pos
+	if !p.sequence(FuncRegexp, "(") {
+		return nil
+	}
+
+	arg0 := p.constFuncArgument()
+	if arg0 != nil {
+		if _, ok := p.literal(","); ok {
+			arg1 := p.constFuncArgumentRHS()
+			if _, ok := p.literal(")"); ok && arg1 != nil {
+				return &FEBooleanFuncTwoArgs{
+					BooleanFuncTwoArgsName: &FEBooleanFuncTwoArgsName{RegexContains: feTrue()},
+					Argument0:              arg0,
+					Argument1:              arg1,
+				}
+			}
+		}
+	}
+
+	p.pos = start
+	return nil
+}
+
+func (p *feHandParser) arrayContainsClause() *FEArrayContainsClause {
+	start := p.pos
+	if !p.sequence(FuncArrayContains, "(") {
+		return nil
+	}
+
+	clause := &FEArrayContainsClause{}
+	if p.sequence(FuncTokens, "(") {
+		if clause.Tokens = p.field(); clause.Tokens != nil {
+			if _, ok := p.literal(")"); !ok {
+				clause.Tokens = nil
+			}
+		}
+	} else {
+		clause.Field = p.field()
+	}
+
+	if clause.Tokens != nil || clause.Field != nil {
+		if _, ok := p.literal(","); ok {
+			clause.Value = p.constFuncArgumentRHS()
+			if _, ok := p.literal(")"); ok && clause.Value != nil {
+				return clause
+			}
+		}
+	}
+
+	p.pos = start
+	return nil
+}
+
+func (p *feHandParser) existsClause() *FEExistsClause {
+	start := p.pos
+	if !p.sequence(OperatorExists, "(") {
+		return nil
+	}
+
+	if field := p.field(); field != nil {
+		if _, ok := p.literal(")"); ok {
+			return &FEExistsClause{Field: field}
+		}
+	}
+
+	p.pos = start
+	return nil
+}
+
+func (p *feHandParser) firstClause() *FEFirstClause {
+	start := p.pos
+	if _, ok := p.literal(OperatorFirst); !ok {
+		return nil
+	}
+
+	clause := &FEFirstClause{}
+	if clause.Result = p.field(); clause.Result != nil {
+		if _, ok := p.literal(OperatorFor); ok {
+			if name, ok := p.ofType(scanner.Ident); ok {
+				clause.Var = name
+				if _, ok := p.literal(OperatorIn); ok {
+					if clause.In = p.field(); clause.In != nil {
+						whenStart := p.pos
+						if _, ok := p.literal(OperatorWhen); ok {
+							if clause.When = p.filterExpression(); clause.When == nil {
+								p.pos = whenStart
+							}
+						}
+						if _, ok := p.literal(OperatorEnd); ok {
+							return clause
+						}
+					}
+				}
+			}
+		}
+	}
+
+	p.pos = start
+	return nil
+}
+
+func (p *feHandParser) lhs() *FELhs {
+	if first := p.firstClause(); first != nil {
+		return &FELhs{First: first}
+	}
+	if fn := p.constFuncExpression(); fn != nil {
+		return &FELhs{Func: fn}
+	}
+	if boolVal := p.boolean(); boolVal != nil {
+		return &FELhs{Bool: boolVal}
+	}
+	if field := p.field(); field != nil {
+		return &FELhs{Field: field}
+	}
+	if value := p.value(); value != nil {
+		return &FELhs{Value: value}
+	}
+	return nil
+}
+
+func (p *feHandParser) rhs() *FERhs {
+	if first := p.firstClause(); first != nil {
+		return &FERhs{First: first}
+	}
+	if fn := p.constFuncExpression(); fn != nil {
+		return &FERhs{Func: fn}
+	}
+	if boolVal := p.boolean(); boolVal != nil {
+		return &FERhs{Bool: boolVal}
+	}
+	if value := p.value(); value != nil {
+		return &FERhs{Value: value}
+	}
+	if field := p.field(); field != nil {
+		return &FERhs{Field: field}
+	}
+	return nil
+}
+
+func (p *feHandParser) field() *FEField {
+	start := p.pos
+	field := &FEField{}
+	for {
+		if _, ok := p.literal("-"); !ok {
+			break
+		}
+		field.MathNeg = feTrue()
+	}
+
+	// A backticked `SELF` is still read as a field
+	if token := p.peek(); token != nil && token.typ == scanner.Ident && token.value == OperatorSelf {
+		p.pos++
+		field.Self = feTrue()
+	} else if inner := p.decodeJson(); inner != nil {
+		field.DecodeJson = inner
+	} else if name, ok := p.inputName(); ok {
+		field.Input = &name
+	} else {
+		p.aliasPrefix()
+		first := p.onePath()
+		if first == nil {
+			p.pos = start
+			return nil
+		}
+		field.Path = append(field.Path, first)
+	}
+
+	for {
+		pathStart := p.pos
+		if _, ok := p.literal("."); ok {
+			if path := p.onePath(); path != nil {
+				field.Path = append(field.Path, path)
+				continue
+			}
+		}
+		p.pos = pathStart
+		break
+	}
+
+	for {
+		mathStart := p.pos
+		if op := p.mathArithmeticOp(); op != nil {
+			if value := p.mathValue(); value != nil {
+				field.MathOp = op
+				field.MathValue = value
+				continue
+			}
+		}
+		p.pos = mathStart
+		break
+	}
+
+	return field
+}
+
+// isAlias checks whether the token at the given position names one of the
+// aliases, either plainly or within backticks
+func (p *feHandParser) isAlias(pos int) bool {
+	if pos >= len(p.tokens) || p.err != nil {
+		return false
+	}
+	token := p.tokens[pos]
+	if token.typ != scanner.Ident && token.typ != scanner.RawString {
+		return false
+	}
+	for _, alias := range p.aliases {
+		if token.value == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeJson consumes DECODE_JSON() of a field
+func (p *feHandParser) decodeJson() *FEField {
+	start := p.pos
+	if !p.sequence(FuncDecodeJson, "(") {
+		return nil
+	}
+	if inner := p.field(); inner != nil {
+		if _, ok := p.literal(")"); ok {
+			return inner
+		}
+	}
+	p.pos = start
+	return nil
+}
+
+// aliasPrefix consumes a keyspace name or alias followed by a ".", as in
+// `t.type` copied out of a N1QL query, which is just the field `type`
+func (p *feHandParser) aliasPrefix() bool {
+	if !p.isAlias(p.pos) || p.pos+1 >= len(p.tokens) || p.tokens[p.pos+1].typ != '.' {
+		return false
+	}
+	p.pos += 2
+	return true
+}
+
+// metaOfAlias consumes N1QL's META(t), where t is one of the aliases, which
+// is the same as META()
+func (p *feHandParser) metaOfAlias() bool {
+	start := p.pos
+	if p.sequence(OperatorMeta, "(") && p.isAlias(p.pos) {
+		p.pos++
+		if _, ok := p.literal(")"); ok {
+			return true
+		}
+	}
+	p.pos = start
+	return false
+}
+
+// inputName consumes a named input such as `$other`, which the scanner
+// returns as a `$` followed by an adjacent identifier
+func (p *feHandParser) inputName() (string, bool) {
+	if p.pos+1 >= len(p.tokens) || p.err != nil {
+		return "", false
+	}
+	first, second := p.tokens[p.pos], p.tokens[p.pos+1]
+	if first.value != OperatorInput || second.typ != scanner.Ident || second.pos.Offset != first.pos.Offset+1 {
+		return "", false
+	}
+	p.pos += 2
+	return second.value, true
+}
+
+// deepWildcard consumes `**`, which the scanner returns as two adjacent `*`
+func (p *feHandParser) deepWildcard() bool {
+	if p.pos+1 >= len(p.tokens) || p.err != nil {
+		return false
+	}
+	first, second := p.tokens[p.pos], p.tokens[p.pos+1]
+	if first.typ != '*' || second.typ != '*' || second.pos.Offset != first.pos.Offset+1 {
+		return false
+	}
+	p.pos += 2
+	return true
+}
+
+func (p *feHandParser) onePath() *FEOnePath {
+	path := &FEOnePath{}
+	if p.deepWildcard() {
+		path.DeepWildcard = feTrue()
+		return path
+	}
+
+	if fn := p.onePathFuncExpr(); fn != nil {
+		path.OnePathFunc = fn
+	} else if str := p.stringType(); str != nil {
+		path.StrValue = str
+	} else {
+		return nil
+	}
+
+	for {
+		if index := p.arrayIndex(); index != nil {
+			path.ArrayIndexes = append(path.ArrayIndexes, index)
+			continue
+		}
+		break
+	}
+	return path
+}
+
+func (p *feHandParser) stringType() *FEStringType {
+	token := p.peek()
+	if token == nil {
+		return nil
+	}
+
+	var str FEStringType
+	switch token.typ {
+	case scanner.String:
+		str.EscapedStrVal = token.value
+	case scanner.Char:
+		str.CharVal = token.value
+	case scanner.RawString:
+		str.RawStr = token.value
+	case scanner.Ident:
+		str.StrValue = token.value
+	default:
+		return nil
+	}
+	p.pos++
+	return &str
+}
+
+func (p *feHandParser) arrayIndex() *FEArrayIndex {
+	start := p.pos
+	if _, ok := p.literal("["); ok {
+		if index, ok := p.ofType(scanner.Int); ok {
+			if _, ok := p.literal("]"); ok {
+				return &FEArrayIndex{index}
+			}
+		}
+	}
+	p.pos = start
+	return nil
+}
+
+func (p *feHandParser) onePathFuncExpr() *FEOnePathFuncExpr {
+	if !p.sequence(OperatorMeta, "(", ")") && !p.metaOfAlias() {
+		return nil
+	}
+	return &FEOnePathFuncExpr{
+		&FEOnePathFuncNoArg{&FEOnePathFuncNoArgName{Meta: feTrue()}},
+	}
+}
+
+func (p *feHandParser) mathArithmeticOp() *FEMathArithmeticOp {
+	value, ok := p.literal("+", "-", "*", "/", "%")
+	if !ok {
+		return nil
+	}
+
+	switch value {
+	case "+":
+		return &FEMathArithmeticOp{Addition: feTrue()}
+	case "-":
+		return &FEMathArithmeticOp{Subtraction: feTrue()}
+	case "*":
+		return &FEMathArithmeticOp{Multiply: feTrue()}
+	case "/":
+		return &FEMathArithmeticOp{Division: feTrue()}
+	default:
+		return &FEMathArithmeticOp{Modulo: feTrue()}
+	}
+}
+
+func (p *feHandParser) mathValue() *FEMathValue {
+	if intValue := p.intValue(); intValue != nil {
+		return &FEMathValue{IntValue: intValue}
+	}
+	if floatValue := p.floatValue(); floatValue != nil {
+		return &FEMathValue{FloatValue: floatValue}
+	}
+	return nil
+}
+
+func (p *feHandParser) value() *FEValue {
+	if str, ok := p.ofType(scanner.String); ok {
+		return &FEValue{StrValue: &str}
+	}
+	if intValue := p.intValue(); intValue != nil {
+		return &FEValue{IntValue: intValue}
+	}
+	if floatValue := p.floatValue(); floatValue != nil {
+		return &FEValue{FloatValue: floatValue}
+	}
+	if arrayValue := p.arrayValue(); arrayValue != nil {
+		return &FEValue{ArrayValue: arrayValue}
+	}
+	if objectValue := p.objectValue(); objectValue != nil {
+		return &FEValue{ObjectValue: objectValue}
+	}
+	return nil
+}
+
+func (p *feHandParser) objectValue() *FEObjectValue {
+	start := p.pos
+	if _, ok := p.literal("{"); !ok {
+		return nil
+	}
+	object := &FEObjectValue{}
+	if _, ok := p.literal("}"); ok {
+		return object
+	}
+	for {
+		key, ok := p.ofType(scanner.String)
+		if !ok {
+			p.pos = start
+			return nil
+		}
+		if _, ok := p.literal(":"); !ok {
+			p.pos = start
+			return nil
+		}
+		value := p.arrayElem()
+		if value == nil {
+			p.pos = start
+			return nil
+		}
+		object.Keys = append(object.Keys, key)
+		object.Values = append(object.Values, value)
+		if _, ok := p.literal("}"); ok {
+			return object
+		}
+		if _, ok := p.literal(","); !ok {
+			p.pos = start
+			return nil
+		}
+	}
+}
+
+// arrayElem is a value within an array literal, where numbers can also be
+// negative since there is no field for a minus sign to apply to
+func (p *feHandParser) arrayElem() *FEValue {
+	start := p.pos
+	if _, ok := p.literal("-"); !ok {
+		return p.value()
+	}
+	if intValue := p.intValue(); intValue != nil {
+		*intValue = -*intValue
+		return &FEValue{IntValue: intValue}
+	}
+	if floatValue := p.floatValue(); floatValue != nil {
+		*floatValue = -*floatValue
+		return &FEValue{FloatValue: floatValue}
+	}
+	p.pos = start
+	return nil
+}
+
+func (p *feHandParser) arrayValue() *FEArrayValue {
+	start := p.pos
+	if _, ok := p.literal("["); !ok {
+		return nil
+	}
+	array := &FEArrayValue{Values: []*FEValue{}}
+	if _, ok := p.literal("]"); ok {
+		return array
+	}
+	for {
+		value := p.arrayElem()
+		if value == nil {
+			p.pos = start
+			return nil
+		}
+		array.Values = append(array.Values, value)
+		if _, ok := p.literal("]"); ok {
+			return array
+		}
+		if _, ok := p.literal(","); !ok {
+			p.pos = start
+			return nil
+		}
+	}
+}
+
+func (p *feHandParser) opChar() *FEOpChar {
+	value, ok := p.literal("!", "=", "<", ">")
+	if !ok {
+		return nil
+	}
+
+	switch value {
+	case "!":
+		return &FEOpChar{Not: feTrue()}
+	case "=":
+		return &FEOpChar{Equal: feTrue()}
+	case "<":
+		return &FEOpChar{LessThan: feTrue()}
+	default:
+		return &FEOpChar{GreaterThan: feTrue()}
+	}
+}
+
+func (p *feHandParser) compareOp() *FECompareOp {
+	first := p.opChar()
+	if first == nil {
+		return nil
+	}
+	op := &FECompareOp{OpChars0: first, OpChars1: p.opChar()}
+	op.strictEquals = p.strictEquals && op.IsEqual() && op.OpChars1 != nil
+	return op
+}
+
+func (p *feHandParser) checkOp() *FECheckOp {
+	start := p.pos
+	if _, ok := p.literal("IS"); !ok {
+		return nil
+	}
+
+	checkOp := &FECheckOp{}
+	if _, ok := p.literal(OperatorNot); ok {
+		checkOp.Not = feTrue()
+	}
+
+	switch value, _ := p.literal("NULL", "MISSING"); value {
+	case "NULL":
+		checkOp.Null = feTrue()
+	case "MISSING":
+		checkOp.Missing = feTrue()
+	default:
+		p.pos = start
+		return nil
+	}
+	return checkOp
+}
+
+func (p *feHandParser) constFuncExpression() *FEConstFuncExpression {
+	if noArg := p.constFuncNoArg(); noArg != nil {
+		return &FEConstFuncExpression{ConstFuncNoArg: noArg}
+	}
+	if oneArg := p.constFuncOneArg(); oneArg != nil {
+		return &FEConstFuncExpression{ConstFuncOneArg: oneArg}
+	}
+	if twoArgs := p.constFuncTwoArgs(); twoArgs != nil {
+		return &FEConstFuncExpression{ConstFuncTwoArgs: twoArgs}
+	}
+	if dateTrunc := p.dateTruncStr(); dateTrunc != nil {
+		return &FEConstFuncExpression{DateTruncStr: dateTrunc}
+	}
+	return nil
+}
+
+func (p *feHandParser) constFuncNoArg() *FEConstFuncNoArg {
+	start := p.pos
+	value, ok := p.literal("PI", "E", FuncNowMillis)
+	if !ok || !p.sequence("(", ")") {
+		p.pos = start
+		return nil
+	}
+
+	name := &FEConstFuncNoArgName{}
+	switch value {
+	case "PI":
+		name.Pi = feTrue()
+	case "E":
+		name.E = feTrue()
+	default:
+		name.NowMillis = feTrue()
+	}
+	return &FEConstFuncNoArg{name}
+}
+
+func (p *feHandParser) constFuncOneArgName() *FEConstFuncOneArgName {
+	value, ok := p.literal("ABS", "ACOS", "ASIN", "ATAN", "CEIL", "COS", "DATE", "DEGREES",
+		"EXP", "FLOOR", "LOG", "LN", "SIN", "TAN", "RADIANS", "ROUND", "SQRT", FuncBase64Decode, FuncBase64Encode,
+		FuncEncodeJson, FuncWeekdayStr, FuncLog10, FuncLog2, FuncRoundEven)
+	if !ok {
+		return nil
+	}
+
+	name := &FEConstFuncOneArgName{}
+	switch value {
+	case "ABS":
+		name.Abs = feTrue()
+	case "ACOS":
+		name.Acos = feTrue()
+	case "ASIN":
+		name.Asin = feTrue()
+	case "ATAN":
+		name.Atan = feTrue()
+	case "CEIL":
+		name.Ceil = feTrue()
+	case "COS":
+		name.Cos = feTrue()
+	case "DATE":
+		name.Date = feTrue()
+	case "DEGREES":
+		name.Degrees = feTrue()
+	case "EXP":
+		name.Exp = feTrue()
+	case "FLOOR":
+		name.Floor = feTrue()
+	case "LOG":
+		name.Log = feTrue()
+	case "LN":
+		name.Ln = feTrue()
+	case FuncLog10:
+		name.Log10 = feTrue()
+	case FuncLog2:
+		name.Log2 = feTrue()
+	case "SIN":
+		name.Sine = feTrue()
+	case "TAN":
+		name.Tangent = feTrue()
+	case "RADIANS":
+		name.Radians = feTrue()
+	case "ROUND":
+		name.Round = feTrue()
+	case FuncRoundEven:
+		name.RoundEven = feTrue()
+	case "SQRT":
+		name.Sqrt = feTrue()
+	case FuncBase64Decode:
+		name.Base64Decode = feTrue()
+	case FuncBase64Encode:
+		name.Base64Encode = feTrue()
+	case FuncEncodeJson:
+		name.EncodeJson = feTrue()
+	case FuncWeekdayStr:
+		name.WeekdayStr = feTrue()
+	}
+	return name
+}
+
+func (p *feHandParser) constFuncOneArg() *FEConstFuncOneArg {
+	start := p.pos
+	name := p.constFuncOneArgName()
+	if name != nil {
+		if _, ok := p.literal("("); ok {
+			if arg := p.constFuncArgument(); arg != nil {
+				if _, ok := p.literal(")"); ok {
+					return &FEConstFuncOneArg{name, arg}
+				}
+			}
+		}
+	}
+	p.pos = start
+	return nil
+}
+
+func (p *feHandParser) constFuncTwoArgs() *FEConstFuncTwoArgs {
+	start := p.pos
+	value, ok := p.literal("ATAN2", "POW", FuncMod)
+	if ok {
+		if _, ok := p.literal("("); ok {
+			arg0 := p.constFuncArgument()
+			if _, ok := p.literal(","); ok && arg0 != nil {
+				arg1 := p.constFuncArgument()
+				if _, ok := p.literal(")"); ok && arg1 != nil {
+					name := &FEConstFuncTwoArgsName{}
+					switch value {
+					case "ATAN2":
+						name.Atan2 = feTrue()
+					case "POW":
+						name.Power = feTrue()
+					default:
+						name.Mod = feTrue()
+					}
+					return &FEConstFuncTwoArgs{name, arg0, arg1}
+				}
+			}
+		}
+	}
+	p.pos = start
+	return nil
+}
+
+func (p *feHandParser) dateTruncStr() *FEDateTruncStr {
+	start := p.pos
+	if p.sequence(FuncDateTruncStr, "(") {
+		arg := p.constFuncArgument()
+		if _, ok := p.literal(","); ok && arg != nil {
+			if part, ok := p.ofType(scanner.String); ok {
+				if _, ok := p.literal(")"); ok {
+					return &FEDateTruncStr{arg, &part}
+				}
+			}
+		}
+	}
+	p.pos = start
+	return nil
+}
+
+func (p *feHandParser) constFuncArgument() *FEConstFuncArgument {
+	if fn := p.constFuncExpression(); fn != nil {
+		return &FEConstFuncArgument{SubFunc: fn}
+	}
+	if field := p.field(); field != nil {
+		return &FEConstFuncArgument{Field: field}
+	}
+	if value := p.value(); value != nil {
+		return &FEConstFuncArgument{Argument: value}
+	}
+	return nil
+}
+
+func (p *feHandParser) constFuncArgumentRHS() *FEConstFuncArgumentRHS {
+	if fn := p.constFuncExpression(); fn != nil {
+		return &FEConstFuncArgumentRHS{SubFunc: fn}
+	}
+	if value := p.value(); value != nil {
+		return &FEConstFuncArgumentRHS{Argument: value}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Each expression with the raw form of what it parses into, or an empty
+// string if it is rejected.  These were recorded from the participle parser
+// the hand-written one replaced.
+var handParserTestExpressions = []struct {
+	expression string
+	raw        string
+}{
+	{"(((TRUE) OR FALSE) OR FALSE))", "( ( ( TRUE(bool) ) OR FALSE(bool) ) OR FALSE(bool) ) )"},
+	{"((TRUE OR FALSE)) OR (TRUE)", "( ( TRUE(bool) OR FALSE(bool) ) ) OR ( TRUE(bool) )"},
+	{"((TRUE OR FALSE))", "( ( TRUE(bool) OR FALSE(bool) ) )"},
+	{"(TRUE AND FALSE) OR (FALSE AND TRUE)", "( TRUE(bool) AND FALSE(bool) ) OR ( FALSE(bool) AND TRUE(bool) )"},
+	{"(TRUE AND FALSE) OR (FALSE)", "( TRUE(bool) AND FALSE(bool) ) OR ( FALSE(bool) )"},
+	{"(TRUE AND FALSE)", "( TRUE(bool) AND FALSE(bool) )"},
+	{"(TRUE OR FALSE) AND (FALSE OR TRUE) AND TRUE", "( TRUE(bool) OR FALSE(bool) ) AND (FALSE OR TRUE) AND TRUE"},
+	{"(TRUE OR FALSE) AND (FALSE OR TRUE)", "( TRUE(bool) OR FALSE(bool) ) AND FALSE OR TRUE"},
+	{"(TRUE) OR FALSE)", "( TRUE(bool) ) OR FALSE(bool) )"},
+	{"(a = 1) OR b = 2)", "( a = 1 ) OR b = 2 )"},
+	{"ABS(-achievements[2]*10) > 0", "ABS( -achievements [2] * 10 ) > 0"},
+	{"ABS(a) > 1", "ABS( a ) > 1"},
+	{"DATE(fieldpath.path) = DATE(\"2019-01-01\")", "DATE( fieldpath.path ) = DATE( 2019-01-01 )"},
+	{"EXISTS (`[$%XDCRInternalMeta*%$]`.metaKey) AND `[$%XDCRInternalMeta*%$]`.metaKey = \"value\"", "EXISTS ( [$%XDCRInternalMeta*%$].metaKey ) AND [$%XDCRInternalMeta*%$].metaKey = value"},
+	{"META().`onePath.Only` = \"value\"", "META().onePath.Only = value"},
+	{"NOT NOT NOT TRUE", "NOT NOT NOT TRUE(bool)"},
+	{"REGEXP_CONTAINS(METAS().ID(), \"something)", ""},
+	{"REGEXP_CONTAINS(METAS().ID(), \"something\")", ""},
+	{"REGEXP_CONTAINS(METAS().id, \"something\")", ""},
+	{"REGEXP_CONTAINS(`[$%XDCRInternalKey*%$]`, \"^d\")", "REGEXP_CONTAINS( [$%XDCRInternalKey*%$] , ^d )"},
+	{"REGEXP_CONTAINS(`[$%XDCRInternalKey*%$]`, \"^xyz*\")", "REGEXP_CONTAINS( [$%XDCRInternalKey*%$] , ^xyz* )"},
+	{"REGEXP_CONTAINS(`[$%XDCRInternalKey*%$]`, \"a(?=foo)\")", "REGEXP_CONTAINS( [$%XDCRInternalKey*%$] , a(?=foo) )"},
+	{"REGEXP_CONTAINS(`[$%XDCRInternalKey*%$]`, \"q(?!uit)\")", "REGEXP_CONTAINS( [$%XDCRInternalKey*%$] , q(?!uit) )"},
+	{"REGEXP_CONTAINS(a, \"[a-\")", "REGEXP_CONTAINS( a , [a- )"},
+	{"REGEXP_CONTAINS(a, \"^b\")", "REGEXP_CONTAINS( a , ^b )"},
+	{"REGEX_CONTAINS(KEY, \"something\") AND OR", ""},
+	{"REGEX_CONTAINS(KEY, \"something\")", ""},
+	{"SomeKey EXISTS", ""},
+	{"TRUE AND (TRUE OR FALSE) AND FALSE", "TRUE(bool) AND (TRUE OR FALSE) AND FALSE"},
+	{"TRUE OR FALSE AND NOT FALSE", "TRUE(bool) OR FALSE(bool) AND NOT FALSE(bool)"},
+	{"TRUE", "TRUE(bool)"},
+	{"Testdoc = true AND REGEXP_CONTAINS(`[$%XDCRInternalKey*%$]`, \"^abc\")", "Testdoc = true(bool) AND REGEXP_CONTAINS( [$%XDCRInternalKey*%$] , ^abc )"},
+	{"`1DarrayPath`[1] = \"arrayVal1\"", "1DarrayPath [1] = arrayVal1"},
+	{"`2DarrayPath`[1][-2] = fieldpath2.path2", ""},
+	{"`[$%XDCRInternalMeta*%$]`.metaKey = \"value\"", "[$%XDCRInternalMeta*%$].metaKey = value"},
+	{"`field is unfinished = \"unfinished_value", ""},
+	{"`field` = TRUE", "field = TRUE(bool)"},
+	{"`onePath.Only` < field2", "onePath.Only < field2"},
+	{"`onePath.Only` <> \"value\" OR `onePath.Only` <> \"value2\"", "onePath.Only <> value OR onePath.Only <> value2"},
+	{"a + 1 > 1", "a + 1 > 1"},
+	{"a = 1 AND (b > 2 OR c IS MISSING)", "a = 1 AND b > 2 OR c IS MISSING"},
+	{"a = 1 AND EXISTS(b) OR META().id IS NOT NULL", "a = 1 AND EXISTS ( b ) OR META().id IS NOT NULL"},
+	{"a = 1 b", ""},
+	{"a = 1", "a = 1"},
+	{"a.b = \"x\" AND (c IS NOT NULL OR NOT d > 5)", "a.b = x AND c IS NOT NULL OR NOT d > 5"},
+	{"achievement * 2 +1", ""},
+	{"achievements * 10 = 10", "achievements * 10 = 10"},
+	{"achievements[0] = 49 AND achievements[1] = 58 AND achievements[2] = 108 AND arrOfObjs[0].`1D` = 50 AND floatArrs[0] = 1.1", "achievements [0] = 49 AND achievements [1] = 58 AND achievements [2] = 108 AND arrOfObjs [0].1D = 50 AND floatArrs [0] = 1.1"},
+	{"arrayPath[1].path2.arrayPath3[-10].`multiword array`[20] = fieldpath2.path2", ""},
+	{"arrayPath[1].path2.arrayPath3[10].`multiword array`[20] = fieldpath2.path2", "arrayPath [1].path2.arrayPath3 [10].multiword array [20] = fieldpath2.path2"},
+	{"face == \"😂\"", "face = 😂"},
+	{"field >< \"value\"", "field >< value"},
+	{"fieldpath.`path = fieldPath2", ""},
+	{"fieldpath.path != POW(ABS(CEIL(PI())),2)", "fieldpath.path <> POW( ABS( CEIL( PI() ) ) , 2 )"},
+	{"fieldpath.path <= ABS(5)", "fieldpath.path <= ABS( 5 )"},
+	{"fieldpath.path <> POW(ABS(CEIL(PI())),2)", "fieldpath.path <> POW( ABS( CEIL( PI() ) ) , 2 )"},
+	{"fieldpath.path = DATE(`field with spaces`)", "fieldpath.path = DATE( field with spaces )"},
+	{"fieldpath.path = POW(ABS(CEIL(PI())),2) AND REGEXP_CONTAINS(fieldPath2, \"^abc*$\")", "fieldpath.path = POW( ABS( CEIL( PI() ) ) , 2 ) AND REGEXP_CONTAINS( fieldPath2 , ^abc*$ )"},
+	{"fieldpath.path = \"value\"", "fieldpath.path = value"},
+	{"fieldpath.path == \"value\"", "fieldpath.path = value"},
+	{"fieldpath.path >= ABS(CEIL(PI()))", "fieldpath.path >= ABS( CEIL( PI() ) )"},
+	{"fieldpath.path >= field2", "fieldpath.path >= field2"},
+	{"fieldpath.path IS NOT NULL AND fieldpath.path IS NOT MISSING", "fieldpath.path IS NOT NULL AND fieldpath.path IS NOT MISSING"},
+	{"fieldpath.path IS NOT NULL", "fieldpath.path IS NOT NULL"},
+	{"fieldpath.path IS NULL", "fieldpath.path IS NULL"},
+	{"fieldpath.path2 IS MISSING", "fieldpath.path2 IS MISSING"},
+	{"key < PI()", "key < PI()"},
+	{"onePath.field1 < onePath.field2", "onePath.field1 < onePath.field2"},
+	{"onePath.field1 <> onePath.field2", "onePath.field1 <> onePath.field2"},
+	{"中文 IS NOT NULL AND REGEXP_CONTAINS(中文, \"白人\")", "中文 IS NOT NULL AND REGEXP_CONTAINS( 中文 , 白人 )"},
+	{"name = 'single quoted' AND initial = 'x'", "name = single quoted AND initial = x"},
+	{"E > 5 AND PI() < E()", "E > 5 AND PI() < E()"},
+	{"count = 0x10 OR ratio >= 1.5e3", "count = 16 OR ratio >= 1500"},
+	{"a = 1 /* comment */ AND b = 2", "a = 1 AND b = 2"},
+	{"-a.b - 1 > -2", ""},
+	{"`quoted`.\"escaped\\tname\" IS NOT MISSING", "quoted.escaped\tname IS NOT MISSING"},
+	{"a = ", ""},
+	{"(a = 1", "( a = 1"},
+	{"a IS NOT", ""},
+	{"ATAN2(a, 1) > 0 AND DATE(\"2019-01-01\") < DATE(b)", "ATAN2( a , 1 ) > 0 AND DATE( 2019-01-01 ) < DATE( b )"},
+	{"a = 99999999999999999999", ""},
+}
+
+func TestHandParserCorpus(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, test := range handParserTestExpressions {
+		var fe FilterExpression
+		err := parseFilterExpressionString(test.expression, &fe)
+		if len(test.raw) == 0 {
+			assert.NotNil(err, test.expression)
+			continue
+		}
+		if assert.Nil(err, test.expression) {
+			assert.Equal(test.raw, fe.rawString(), test.expression)
+		}
+	}
+}
+
+func TestHandParserErrorPosition(t *testing.T) {
+	assert := assert.New(t)
+
+	var fe FilterExpression
+	err := parseFilterExpressionString("a = 1 b", &fe)
+	if feErr, ok := err.(*FilterExpressionError); assert.True(ok) {
+		assert.Equal(ErrSyntax, feErr.Kind)
+		assert.Equal(1, feErr.Line)
+		assert.Equal(7, feErr.Column)
+	}
+}
+
+func TestHandParserWhitespace(t *testing.T) {
+	assert := assert.New(t)
+
+	separators := []string{"\r\n", "\t", "\n\n\t  ", "\v", "\f", "\u00a0", "\u2003"}
+	for _, test := range handParserTestExpressions {
+		if len(test.raw) == 0 {
+			continue
+		}
+		tokens, err := lexFilterExpression(test.expression)
+		if !assert.Nil(err, test.expression) {
+			continue
+		}
+
+		for _, sep := range separators {
+			// Put the separator between every token, except the two `*` of
+			// a `**`, which must be written together
+			spaced := sep
+			for i, token := range tokens {
+				end := len(test.expression)
+				if i+1 < len(tokens) {
+					end = tokens[i+1].pos.Offset
+				}
+				text := strings.TrimSpace(test.expression[token.pos.Offset:end])
+				spaced += text
+				if text != "*" || i+1 >= len(tokens) || tokens[i+1].pos.Offset != token.pos.Offset+1 {
+					spaced += sep
+				}
+			}
+
+			var fe FilterExpression
+			err := parseFilterExpressionString(spaced, &fe)
+			if assert.Nil(err, "%q", spaced) {
+				assert.Equal(test.raw, fe.rawString(), "%q", spaced)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"text/scanner"
+)
+
+// FilterExpressionLimits caps the size of the expressions a parser accepts,
+// bounding the cost of parsing filters from untrusted sources.  A limit of
+// zero is not enforced.
+type FilterExpressionLimits struct {
+	// Maximum length of the expression in bytes, checked before it is read
+	MaxLength int
+	// Maximum number of tokens, such as fields, values and operators
+	MaxTokens int
+	// Maximum depth of parenthesis, brackets, NOTs and ANY or FIRST clauses
+	// nested within each other
+	MaxDepth int
+}
+
+func (limits FilterExpressionLimits) checkLength(expression string) error {
+	if limits.MaxLength > 0 && len(expression) > limits.MaxLength {
+		return &ParseLimitError{"bytes", limits.MaxLength}
+	}
+	return nil
+}
+
+// checkTokens checks the number of tokens, and how deeply they nest, before
+// the parser recurses into them
+func (limits FilterExpressionLimits) checkTokens(tokens []feToken) error {
+	if limits.MaxTokens > 0 && len(tokens) > limits.MaxTokens {
+		return &ParseLimitError{"tokens", limits.MaxTokens}
+	}
+	if limits.MaxDepth <= 0 {
+		return nil
+	}
+
+	// A run of NOTs nests each condition within the one before it
+	depth, nots := 0, 0
+	for _, token := range tokens {
+		if token.typ == scanner.Ident && token.value == OperatorNot {
+			nots++
+		} else {
+			nots = 0
+		}
+
+		switch token.typ {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case scanner.Ident:
+			switch token.value {
+			case OperatorAny, OperatorFirst:
+				depth++
+			case OperatorEnd:
+				depth--
+			}
+		}
+
+		if depth+nots > limits.MaxDepth {
+			return &ParseLimitError{"nesting depth", limits.MaxDepth}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterExpressionLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	limits := FilterExpressionLimits{MaxLength: 64, MaxTokens: 20, MaxDepth: 3}
+	parse := func(expression string) error {
+		_, _, err := NewFilterExpressionParserWithOptions(expression, FilterExpressionParserOptions{Limits: limits})
+		return err
+	}
+	limitOf := func(err error) string {
+		var limitErr *ParseLimitError
+		if assert.True(errors.As(err, &limitErr), "%v", err) {
+			assert.True(errors.Is(err, ErrParseLimitExceeded))
+			return limitErr.Limit
+		}
+		return ""
+	}
+
+	assert.Nil(parse(`NOT a = 1 AND (b = 2 OR c = [1])`))
+	assert.Nil(parse(`ANY x WITHIN doc SATISFIES (x = 1) END`))
+
+	assert.Equal("bytes", limitOf(parse(`name = "`+strings.Repeat("x", 64)+`"`)))
+	assert.Equal("tokens", limitOf(parse(`a = 1 AND b = 2 AND c = 3 AND d = 4 AND e = 5 AND f = 6`)))
+	assert.Equal("nesting depth", limitOf(parse(`((((a = 1))))`)))
+	assert.Equal("nesting depth", limitOf(parse(`NOT NOT NOT NOT a = 1`)))
+	assert.Equal("nesting depth", limitOf(parse(`ANY x WITHIN doc SATISFIES ((x = [[1]])) END`)))
+
+	// Parenthesis within strings do not nest
+	assert.Nil(parse(`a = "(((("`))
+
+	// Without limits, any size is accepted
+	_, _, err := NewFilterExpressionParserWithOptions(`((((a = 1))))`, FilterExpressionParserOptions{})
+	assert.Nil(err)
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+// FilterExpressionMatcherOptions gathers every setting of a matcher created
+// from a filter expression, so that services accepting filters from their
+// users can bound the cost of each filter in one place.  The zero value
+// creates the same matcher as GetFilterExpressionMatcher.
+type FilterExpressionMatcherOptions struct {
+	// How the expression is parsed, including caps on its length, number of
+	// tokens and nesting depth
+	Parser FilterExpressionParserOptions
+	// Caps on the size of the definition the expression compiles into
+	Transform TransformLimits
+	// The engine compiling the patterns of REGEXP_CONTAINS, which is RE2
+	// when empty
+	RegexEngine string
+
+	// The policies of the matcher, as set by the FastMatcher methods of the
+	// same names
+	CoerceNumericStrings bool
+	NonFinite            NonFinitePolicy
+	DuplicateKeys        DuplicateKeyPolicy
+	EmptyAsMissing       EmptyValues
+	Concatenated         ConcatenatedPolicy
+	TranscodeUTF16       bool
+	// When floats are treated as equal, which is DefaultFloatEquality when
+	// nil
+	FloatEquality *FloatEquality
+}
+
+// GetFilterExpressionMatcherWithOptions creates a matcher for a filter
+// expression with the given options.  Expressions exceeding the limits in
+// the options are rejected with a *ParseLimitError or *TransformLimitError.
+// Unlike GetFilterExpressionMatcher, the filter cache is not used.
+func GetFilterExpressionMatcherWithOptions(expression string, options FilterExpressionMatcherOptions) (*FastMatcher, error) {
+	_, fe, err := NewFilterExpressionParserWithOptions(expression, options.Parser)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := fe.OutputExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.RegexEngine != "" && options.RegexEngine != RegexEngineRE2 {
+		expr, err = WithRegexEngine(expr, options.RegexEngine)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var trans Transformer
+	matchDef, err := trans.TransformWithLimits([]Expression{expr}, options.Transform)
+	if err != nil {
+		return nil, err
+	}
+
+	matcher := NewFastMatcher(matchDef)
+	matcher.SetCoerceNumericStrings(options.CoerceNumericStrings)
+	matcher.SetNonFinitePolicy(options.NonFinite)
+	matcher.SetDuplicateKeyPolicy(options.DuplicateKeys)
+	matcher.SetEmptyAsMissing(options.EmptyAsMissing)
+	matcher.SetConcatenatedPolicy(options.Concatenated)
+	matcher.SetTranscodeUTF16(options.TranscodeUTF16)
+	if options.FloatEquality != nil {
+		matcher.SetFloatEquality(*options.FloatEquality)
+	}
+	return matcher, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterExpressionMatcherOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	match := func(m *FastMatcher, doc string) bool {
+		m.Reset()
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err, doc)
+		return matched
+	}
+
+	// The zero value behaves like GetFilterExpressionMatcher
+	m, err := GetFilterExpressionMatcherWithOptions(`a < 100 AND name IS MISSING`, FilterExpressionMatcherOptions{})
+	assert.Nil(err)
+	assert.False(match(m, `{"a":"42"}`))
+	assert.True(match(m, `{"a":42}`))
+	assert.False(match(m, `{"a":42,"name":""}`))
+
+	m, err = GetFilterExpressionMatcherWithOptions(`a < 100 AND name IS MISSING`, FilterExpressionMatcherOptions{
+		CoerceNumericStrings: true,
+		EmptyAsMissing:       EmptyStrings,
+		DuplicateKeys:        DuplicateKeysLastWins,
+	})
+	assert.Nil(err)
+	assert.True(match(m, `{"a":"42"}`))
+	assert.True(match(m, `{"a":42,"name":""}`))
+	assert.True(match(m, `{"a":1000,"a":42}`))
+
+	m, err = GetFilterExpressionMatcherWithOptions(`reading = 1`, FilterExpressionMatcherOptions{})
+	assert.Nil(err)
+	assert.True(match(m, `{"reading":1.00000001}`))
+	m, err = GetFilterExpressionMatcherWithOptions(`reading = 1`, FilterExpressionMatcherOptions{
+		FloatEquality: &FloatEquality{},
+	})
+	assert.Nil(err)
+	assert.False(match(m, `{"reading":1.00000001}`))
+	assert.True(match(m, `{"reading":1.0}`))
+
+	_, err = GetFilterExpressionMatcherWithOptions(`a = 1 AND b = 2 AND c = 3`, FilterExpressionMatcherOptions{
+		Parser: FilterExpressionParserOptions{Limits: FilterExpressionLimits{MaxTokens: 5}},
+	})
+	var parseErr *ParseLimitError
+	assert.True(errors.As(err, &parseErr))
+
+	_, err = GetFilterExpressionMatcherWithOptions(`a = 1 OR b = 2 OR c = 3`, FilterExpressionMatcherOptions{
+		Transform: TransformLimits{MaxLeaves: 2},
+	})
+	var transformErr *TransformLimitError
+	assert.True(errors.As(err, &transformErr))
+
+	_, err = GetFilterExpressionMatcherWithOptions(`a = 1`, FilterExpressionMatcherOptions{
+		Parser: FilterExpressionParserOptions{Version: FilterExpressionV1},
+	})
+	assert.Nil(err)
+	_, err = GetFilterExpressionMatcherWithOptions(`NOW_MILLIS() > 1`, FilterExpressionMatcherOptions{
+		Parser: FilterExpressionParserOptions{Version: FilterExpressionV1},
+	})
+	assert.True(errors.Is(err, ErrorGrammarVersion))
+
+	assert.Nil(RegisterRegexEngine("test-options", &substringEngine{}))
+	m, err = GetFilterExpressionMatcherWithOptions(`REGEXP_CONTAINS(a, "^x")`, FilterExpressionMatcherOptions{
+		RegexEngine: "test-options",
+	})
+	assert.Nil(err)
+	assert.True(match(m, `{"a":"1^x2"}`))
+	_, err = GetFilterExpressionMatcherWithOptions(`REGEXP_CONTAINS(a, "^x")`, FilterExpressionMatcherOptions{
+		RegexEngine: "test-missing",
+	})
+	assert.True(errors.Is(err, ErrorUnknownRegexEngine))
+}
@@ -3,35 +3,55 @@
 package gojsonsm
 
 import (
+	"errors"
 	"fmt"
-	"github.com/alecthomas/participle"
 	"math"
+	"reflect"
+	"strconv"
 	"strings"
+	"text/scanner"
 )
 
-// EBNF Grammar describing the parser
-
-// FilterExpression         = ( AndCondition { "OR" AndCondition } ) { "AND" FilterExpression }
+// EBNF Grammar describing the parser, also available through GetFilterExpressionGrammar()
+//
+// The grammar only says where parenthesis can appear.  Conditions are grouped
+// by the parenthesis around them, and otherwise NOT binds tighter than AND,
+// which binds tighter than OR, so `a OR b AND (c OR d)` is read as
+// `a OR (b AND (c OR d))`.
+
+// FilterExpression         = [ LetClause ] ( AndCondition { "OR" AndCondition } ) { "AND" FilterExpression }
+// LetClause                = "LET" LetBinding { "," LetBinding } "WHERE"
+// LetBinding               = @Ident "=" LetValue
+// LetValue                 = LetTerm { MathOp LetTerm }
+// LetTerm                  = ( "(" LetValue ")" ) | ConstFuncExpr | Value | Field
 // AndCondition             = { OpenParens } Condition { "AND" Condition } { CloseParen }
-// Condition                = ( [ "NOT" ] Condition ) | Operand
+// Condition                = ( [ "NOT" ] Condition ) | AnyWithinClause | Operand
+// AnyWithinClause          = "ANY" @Ident "WITHIN" ( "doc" | Field ) "SATISFIES" FilterExpression "END"
 // Operand                  = BooleanExpr | ( LHS ( CheckOp | ( CompareOp RHS) ) )
 // BooleanExpr              = Boolean | BooleanFuncExpr
-// LHS                      = ConstFuncExpr | Boolean | Field | Value
-// RHS                      = ConstFuncExpr | Boolean | Value | Field
+// LHS                      = FirstClause | ConstFuncExpr | Boolean | Field | Value
+// RHS                      = FirstClause | ConstFuncExpr | Boolean | Value | Field
+// FirstClause              = "FIRST" Field "FOR" @Ident "IN" Field [ "WHEN" FilterExpression ] "END"
 // CompareOp                = "=" | "==" | "<>" | "!=" | ">" | ">=" | "<" | "<="
 // CheckOp                  = ( "IS" [ "NOT" ] ( NULL | MISSING ) )
-// Field                    = { @"-" } OnePath { "." OnePath } { MathOp MathValue }
-// OnePath                  = ( PathFuncExpression | StringType ){ ArrayIndex }
+// Field                    = { @"-" } ( "SELF" | Input | DecodeJson | OnePath ) { "." OnePath } { MathOp MathValue }
+// Input                    = "$" @Ident
+// DecodeJson               = "DECODE_JSON" "(" Field ")"
+// OnePath                  = "**" | ( ( PathFuncExpression | StringType ){ ArrayIndex } )
 // StringType               = @String | @Ident | @RawString | @Char
 // ArrayIndex               = "[" @Int "]"
-// Value                    = @String
-// ConstFuncExpr            = ConstFuncNoArg | ConstFuncOneArg | ConstFuncTwoArgs
+// Value                    = @String | @Int | @Float | ArrayValue | ObjectValue
+// ArrayValue               = "[" [ ArrayElem { "," ArrayElem } ] "]"
+// ArrayElem                = ( @"-" ( @Int | @Float ) ) | Value
+// ObjectValue              = "{" [ @String ":" ArrayElem { "," @String ":" ArrayElem } ] "}"
+// ConstFuncExpr            = ConstFuncNoArg | ConstFuncOneArg | ConstFuncTwoArgs | DateTruncStr
 // ConstFuncNoArg           = ConstFuncNoArgName "(" ")"
-// ConstFuncNoArgName       = "PI" | "E"
+// ConstFuncNoArgName       = "PI" | "E" | "NOW_MILLIS"
 // ConstFuncOneArg          = ConstFuncOneArgName "(" ConstFuncArgument ")"
-// ConstFuncOneArgName      = "ABS" | "ACOS"...
+// ConstFuncOneArgName      = "ABS" | "ACOS"... | "BASE64_DECODE" | "BASE64_ENCODE" | "ENCODE_JSON" | "WEEKDAY_STR" | "LOG10" | "LOG2" | "ROUND_EVEN"
 // ConstFuncTwoArgs         = ConstFuncTwoArgsName "(" ConstFuncArgument "," ConstFuncArgument ")"
-// ConstFuncTwoArgsName     = "ATAN2" | "POW"
+// ConstFuncTwoArgsName     = "ATAN2" | "POW" | "MOD"
+// DateTruncStr             = "DATE_TRUNC_STR" "(" ConstFuncArgument "," @String ")"
 // ConstFuncArgument        = Field | Value | ConstFuncExpr
 
 // should this be   ConstFuncArgumentRHS     = Value | ConstFuncExpr
@@ -41,14 +61,17 @@ import (
 // MathOp                   = @"+" | @"-" | @"*" | @"/" | @"%"
 // MathValue                = @Int | @Float
 // OnePathFuncNoArgName     = "META"
-// BooleanFuncExpr          = BooleanFuncTwoArgs | ExistsClause
+// BooleanFuncExpr          = BooleanFuncTwoArgs | ArrayContainsClause | ExistsClause
 // BooleanFuncTwoArgs       = BooleanFuncTwoArgsName "(" ConstFuncArgument "," ConstFuncArgumentRHS ")"
 // BooleanFuncTwoArgsName   = "REGEXP_CONTAINS"
+// ArrayContainsClause      = "ARRAY_CONTAINS" "(" ( ( "TOKENS" "(" Field ")" ) | Field ) "," ConstFuncArgumentRHS ")"
 // ExistsClause              = ( "EXISTS" "(" Field ")" )
 
 type FilterExpression struct {
-	AndConditions []*FEAndCondition   `( @@ { "OR" @@ } )`
-	SubFilterExpr []*FilterExpression `{ "AND" @@ }`
+	// Bindings usable throughout the rest of the expression
+	Lets          []*FELetBinding
+	AndConditions []*FEAndCondition
+	SubFilterExpr []*FilterExpression
 }
 
 func (f *FilterExpression) GetTotalOpenParens() (count int) {
@@ -79,9 +102,30 @@ func (f *FilterExpression) GetTotalCloseParens() (count int) {
 	return
 }
 
+// String outputs the expression in its canonical form, which is guaranteed
+// to parse back into an equivalent expression. Expressions that cannot be
+// canonicalized fall back to the text as it was parsed.
 func (fe *FilterExpression) String() string {
+	expr, err := fe.OutputExpression()
+	if err == nil {
+		if canonical, err := FormatExpression(expr); err == nil {
+			return canonical
+		}
+	}
+	return fe.rawString()
+}
+
+func (fe *FilterExpression) rawString() string {
 	output := []string{}
 
+	if len(fe.Lets) > 0 {
+		var lets []string
+		for _, let := range fe.Lets {
+			lets = append(lets, let.String())
+		}
+		output = append(output, OperatorLet, strings.Join(lets, ", "), OperatorWhere)
+	}
+
 	first := true
 	for _, expr := range fe.AndConditions {
 		if first {
@@ -106,43 +150,391 @@ func (fe *FilterExpression) String() string {
 
 // Outputs the head of the Expression match tree of which represents everything underneath
 func (f *FilterExpression) OutputExpression() (Expression, error) {
+	expr, err := f.outputChecked()
+	if errors.Is(err, ErrMalformedParenthesis) {
+		// LocateParenthesisMismatch gives the position of the parenthesis
+		return nil, ErrorMalformedParenthesis
+	}
+	return expr, err
+}
+
+// outputChecked outputs the expression, reporting where a parenthesis
+// without a match is
+func (f *FilterExpression) outputChecked() (Expression, error) {
+	if err := f.checkParens(); err != nil {
+		return nil, err
+	}
+	expr, err := f.outputExpression()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNestedLoops(expr); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+// outputExpression outputs the expression once its parenthesis have been
+// checked, as those of the expressions it is ANDed with are checked along
+// with its own
+func (f *FilterExpression) outputExpression() (Expression, error) {
+	expr, err := f.outputConditions()
+	if err != nil || len(f.Lets) == 0 {
+		return expr, err
+	}
+	return bindLets(f.Lets, expr)
+}
+
+// outputConditions outputs the conditions of the expression, and of the
+// expressions ANDed to it, with NOT binding tighter than AND and AND binding
+// tighter than OR, grouped by their parenthesis.  The grammar starts a new
+// expression at each AND which is followed by a parenthesis, so the
+// conditions are put back into one list before they are grouped.
+func (f *FilterExpression) outputConditions() (Expression, error) {
+	var out feOutput
+	out.appendExpression(f)
+	return out.orExpr()
+}
+
+// feOutputItem is a parenthesis, an AND or OR, or a condition of a filter
+// expression, in the order they appear
+type feOutputItem struct {
+	open  bool
+	close bool
+	op    string
+	cond  *FECondition
+	// An expression ANDed to the one before it with bindings of its own,
+	// which covers everything up to its end
+	lets *FilterExpression
+}
+
+type feOutput struct {
+	items []feOutputItem
+	pos   int
+}
+
+func (out *feOutput) appendExpression(f *FilterExpression) {
+	for i, ac := range f.AndConditions {
+		if i > 0 {
+			out.items = append(out.items, feOutputItem{op: OperatorOr})
+		}
+		for range ac.OpenParens {
+			out.items = append(out.items, feOutputItem{open: true})
+		}
+		for j, cond := range ac.OrConditions {
+			if j > 0 {
+				out.items = append(out.items, feOutputItem{op: OperatorAnd})
+			}
+			out.items = append(out.items, feOutputItem{cond: cond})
+		}
+		for range ac.CloseParens {
+			out.items = append(out.items, feOutputItem{close: true})
+		}
+	}
+
+	for _, sub := range f.SubFilterExpr {
+		out.items = append(out.items, feOutputItem{op: OperatorAnd})
+		if len(sub.Lets) > 0 {
+			out.items = append(out.items, feOutputItem{lets: sub})
+		} else {
+			out.appendExpression(sub)
+		}
+	}
+}
+
+func (out *feOutput) nextOp(op string) bool {
+	if out.pos < len(out.items) && out.items[out.pos].op == op {
+		out.pos++
+		return true
+	}
+	return false
+}
+
+// orExpr outputs an OR of AND lists, where an AND list made up of only a
+// parenthesized OR is merged in, so redundant parenthesis leave no trace
+func (out *feOutput) orExpr() (Expression, error) {
 	var outExpr OrExpr
+	for {
+		andExpr, err := out.andExpr()
+		if err != nil {
+			return nil, err
+		}
+		if orExpr, ok := andExpr[0].(OrExpr); ok && len(andExpr) == 1 {
+			outExpr = append(outExpr, orExpr...)
+		} else {
+			outExpr = append(outExpr, andExpr)
+		}
 
-	// a stricter check is to check each subexpr is paren balanced, e.g., by letting each subexpr do the check itself
-	if f.GetTotalOpenParens() != f.GetTotalCloseParens() {
-		return outExpr, ErrorMalformedParenthesis
+		if !out.nextOp(OperatorOr) {
+			return outExpr, nil
+		}
 	}
+}
 
-	for _, oneExpr := range f.AndConditions {
-		andExpr, err := oneExpr.OutputExpression()
+// andExpr outputs an AND list, where parenthesized AND lists are merged in
+func (out *feOutput) andExpr() (AndExpr, error) {
+	var outExpr AndExpr
+	for {
+		expr, err := out.term()
 		if err != nil {
-			// better return nil, err
-			return outExpr, err
+			return nil, err
+		}
+		if orExpr, ok := expr.(OrExpr); ok && len(orExpr) == 1 {
+			outExpr = append(outExpr, orExpr[0].(AndExpr)...)
+		} else {
+			outExpr = append(outExpr, expr)
+		}
+
+		if !out.nextOp(OperatorAnd) {
+			return outExpr, nil
 		}
-		outExpr = append(outExpr, andExpr)
 	}
+}
 
-	if len(f.SubFilterExpr) > 0 {
-		var combinedExpr AndExpr
-		combinedExpr = append(combinedExpr, outExpr)
+func (out *feOutput) term() (Expression, error) {
+	if out.pos >= len(out.items) {
+		return nil, ErrorMalformedParenthesis
+	}
+	item := out.items[out.pos]
+	out.pos++
 
-		for _, subFilterExpr := range f.SubFilterExpr {
-			subExpr, err := subFilterExpr.OutputExpression()
-			if err != nil {
-				// better return nil, err
-				return combinedExpr, err
+	switch {
+	case item.open:
+		expr, err := out.orExpr()
+		if err != nil {
+			return nil, err
+		}
+		if out.pos >= len(out.items) || !out.items[out.pos].close {
+			return nil, ErrorMalformedParenthesis
+		}
+		out.pos++
+		return expr, nil
+	case item.cond != nil:
+		return item.cond.OutputExpression()
+	case item.lets != nil:
+		return item.lets.outputExpression()
+	}
+	return nil, ErrorMalformedParenthesis
+}
+
+// mixesAndOr checks whether AND and OR are used together anywhere in the
+// expression without parenthesis to show which of them binds first, as in
+// `a = 1 OR b = 2 AND c = 3`
+func (f *FilterExpression) mixesAndOr() bool {
+	var out feOutput
+	out.appendExpression(f)
+
+	// The operators seen within each open parenthesis, and outside of them
+	type opsSeen struct{ and, or bool }
+	stack := []opsSeen{{}}
+	for _, item := range out.items {
+		top := &stack[len(stack)-1]
+		switch {
+		case item.open:
+			stack = append(stack, opsSeen{})
+		case item.close:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case item.op == OperatorAnd:
+			top.and = true
+		case item.op == OperatorOr:
+			top.or = true
+		}
+		if top.and && top.or {
+			return true
+		}
+	}
+	return false
+}
+
+// checkParens checks that each parenthesis of the expression is matched in
+// the order they appear.  The expressions within ANY ... END and FIRST ...
+// END check their own parenthesis when they are output, so a parenthesis
+// cannot be closed on the other side of their END.
+func (f *FilterExpression) checkParens() error {
+	var opens []scanner.Position
+	if err := f.matchParens(&opens); err != nil {
+		return err
+	}
+	if len(opens) > 0 {
+		return newParenthesisError(opens[len(opens)-1], "Unmatched opening parenthesis")
+	}
+	return nil
+}
+
+// matchParens matches the closing parenthesis of the expression with the
+// opening ones before them, which are kept on the opens stack until then
+func (f *FilterExpression) matchParens(opens *[]scanner.Position) error {
+	for _, ac := range f.AndConditions {
+		for _, open := range ac.OpenParens {
+			*opens = append(*opens, open.pos)
+		}
+		for _, close := range ac.CloseParens {
+			if len(*opens) == 0 {
+				return newParenthesisError(close.pos, "Unmatched closing parenthesis")
 			}
-			combinedExpr = append(combinedExpr, subExpr)
+			*opens = (*opens)[:len(*opens)-1]
 		}
+	}
+	for _, sub := range f.SubFilterExpr {
+		if err := sub.matchParens(opens); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type FELetBinding struct {
+	Name  string
+	Value *FELetValue
+}
 
-		return combinedExpr, nil
+func (f *FELetBinding) String() string {
+	return fmt.Sprintf("%v = %v", f.Name, f.Value.String())
+}
+
+// bindLets replaces the fields naming each binding with its value, so that
+// each use of a binding becomes the same sub-expression.  Bindings can use
+// the ones before them, and like loop variables are only referred to by
+// their bare name.
+func bindLets(lets []*FELetBinding, expr Expression) (Expression, error) {
+	values := make(map[string]Expression)
+	var bindErr error
+	bind := func(expr Expression) Expression {
+		if _, ok := expr.(deepFieldExpr); ok && bindErr == nil {
+			bindErr = newFilterExpressionError(ErrSyntax, "%v bindings cannot use %v", OperatorLet, OperatorDeepWildcard)
+		}
+
+		field, ok := expr.(FieldExpr)
+		if !ok || field.Root != 0 || len(field.Path) == 0 {
+			return expr
+		}
+		value, ok := values[field.Path[0]]
+		if !ok {
+			return expr
+		}
+		if len(field.Path) > 1 && bindErr == nil {
+			bindErr = newFilterExpressionError(ErrSyntax, "%v binding %v has no fields", OperatorLet, field.Path[0])
+		}
+		return value
+	}
+
+	for _, let := range lets {
+		value, err := let.Value.OutputExpression()
+		if err != nil {
+			return nil, err
+		}
+		values[let.Name] = rewriteExpr(value, bind)
+	}
+
+	expr = rewriteExpr(expr, bind)
+	if bindErr != nil {
+		return nil, bindErr
+	}
+	return expr, nil
+}
+
+type FELetValue struct {
+	Terms []*FELetTerm
+	// The operators between each of the terms
+	Ops []*FEMathArithmeticOp
+}
+
+func (f *FELetValue) String() string {
+	output := []string{f.Terms[0].String()}
+	for i, op := range f.Ops {
+		output = append(output, op.String(), f.Terms[i+1].String())
+	}
+	return strings.Join(output, " ")
+}
+
+func (f *FELetValue) OutputExpression() (Expression, error) {
+	applyOp := func(op *FEMathArithmeticOp, lhs, rhs Expression) (Expression, error) {
+		opExpr, err := op.OutputExpression()
+		if err != nil {
+			return nil, err
+		}
+		fn := opExpr.(FuncExpr)
+		fn.Params = []Expression{lhs, rhs}
+		return fn, nil
+	}
+
+	// Multiplication, division and modulo bind tighter than addition and
+	// subtraction, everything else is applied left to right
+	var sum, product Expression
+	var sumOp *FEMathArithmeticOp
+	for i, term := range f.Terms {
+		termExpr, err := term.OutputExpression()
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			product = termExpr
+			continue
+		}
+		op := f.Ops[i-1]
+		if op.Addition == nil && op.Subtraction == nil {
+			if product, err = applyOp(op, product, termExpr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if sum == nil {
+			sum = product
+		} else if sum, err = applyOp(sumOp, sum, product); err != nil {
+			return nil, err
+		}
+		sumOp = op
+		product = termExpr
+	}
+
+	if sum == nil {
+		return product, nil
+	}
+	return applyOp(sumOp, sum, product)
+}
+
+type FELetTerm struct {
+	Paren *FELetValue
+	Func  *FEConstFuncExpression
+	Value *FEValue
+	Field *FEField
+}
+
+func (f *FELetTerm) String() string {
+	if f.Paren != nil {
+		return "(" + f.Paren.String() + ")"
+	} else if f.Func != nil {
+		return f.Func.String()
+	} else if f.Value != nil {
+		return f.Value.String()
+	} else if f.Field != nil {
+		return f.Field.String()
 	} else {
-		return outExpr, nil
+		return "?? (FELetTerm)"
+	}
+}
+
+func (f *FELetTerm) OutputExpression() (Expression, error) {
+	if f.Paren != nil {
+		return f.Paren.OutputExpression()
+	} else if f.Func != nil {
+		return f.Func.OutputExpression()
+	} else if f.Value != nil {
+		return f.Value.OutputExpression()
+	} else if f.Field != nil {
+		return f.Field.OutputExpression()
+	} else {
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FELetTerm %v", f.String())
 	}
 }
 
 type FEOpenParen struct {
-	Parens string `@"("`
+	Parens string
+	pos    scanner.Position
 }
 
 func (feop *FEOpenParen) String() string {
@@ -150,7 +542,8 @@ func (feop *FEOpenParen) String() string {
 }
 
 type FECloseParen struct {
-	Parens string `@")"`
+	Parens string
+	pos    scanner.Position
 }
 
 func (fecp *FECloseParen) String() string {
@@ -158,10 +551,10 @@ func (fecp *FECloseParen) String() string {
 }
 
 type FEAndCondition struct {
-	OpenParens []*FEOpenParen `{ @@ }`
+	OpenParens []*FEOpenParen
 	// better rename to Conditions
-	OrConditions []*FECondition  `@@ { "AND" @@ }`
-	CloseParens  []*FECloseParen `{ @@ }`
+	OrConditions []*FECondition
+	CloseParens  []*FECloseParen
 }
 
 func (f *FEAndCondition) GetTotalOpenParens() (count int) {
@@ -222,14 +615,18 @@ func (f *FEAndCondition) OutputExpression() (Expression, error) {
 }
 
 type FECondition struct {
-	Not     *FECondition `"NOT" @@`
-	Operand *FEOperand   `| @@`
+	Not       *FECondition
+	AnyWithin *FEAnyWithinClause
+	Operand   *FEOperand
 }
 
 func (f *FECondition) GetTotalOpenParens() (count int) {
 	if f.Not != nil {
 		count += f.Not.GetTotalOpenParens()
 	}
+	if f.AnyWithin != nil {
+		count += f.AnyWithin.Satisfies.GetTotalOpenParens()
+	}
 	// Operand has no open or close parens
 	return
 }
@@ -238,6 +635,9 @@ func (f *FECondition) GetTotalCloseParens() (count int) {
 	if f.Not != nil {
 		count += f.Not.GetTotalCloseParens()
 	}
+	if f.AnyWithin != nil {
+		count += f.AnyWithin.Satisfies.GetTotalCloseParens()
+	}
 	// Operand has no open or close parens
 	return
 }
@@ -248,6 +648,8 @@ func (fec *FECondition) String() string {
 
 	if fec.Not != nil {
 		outputStr = append(outputStr, fmt.Sprintf("%v %v", OperatorNot, fec.Not.String()))
+	} else if fec.AnyWithin != nil {
+		outputStr = append(outputStr, fec.AnyWithin.String())
 	} else if fec.Operand != nil {
 		outputStr = append(outputStr, fec.Operand.String())
 	} else {
@@ -261,21 +663,190 @@ func (f *FECondition) OutputExpression() (Expression, error) {
 	if f.Not != nil {
 		subNot, err := f.Not.OutputExpression()
 		return NotExpr{subNot}, err
+	} else if f.AnyWithin != nil {
+		return f.AnyWithin.OutputExpression()
 	} else if f.Operand != nil {
-		return f.Operand.OutputExpression()
+		expr, err := f.Operand.OutputExpression()
+		if err != nil {
+			return nil, err
+		}
+		return expandDeepFields(expr), nil
 	} else {
-		return nil, fmt.Errorf("Invalid FECondition %v", f.String())
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FECondition %v", f.String())
+	}
+}
+
+type FEAnyWithinClause struct {
+	Var string
+	// Either the whole document, or the field to search within
+	Doc       *bool
+	Field     *FEField
+	Satisfies *FilterExpression
+}
+
+func (f *FEAnyWithinClause) String() string {
+	rangeStr := OperatorDoc
+	if f.Field != nil {
+		rangeStr = f.Field.String()
+	}
+	return fmt.Sprintf("%v %v %v %v %v %v %v", OperatorAny, f.Var, OperatorWithin, rangeStr,
+		OperatorSatisfies, f.Satisfies.rawString(), OperatorEnd)
+}
+
+func (f *FEAnyWithinClause) OutputExpression() (Expression, error) {
+	subExpr, err := f.Satisfies.outputChecked()
+	if err != nil {
+		return nil, err
+	}
+
+	var inExpr Expression = FieldExpr{}
+	if f.Field != nil {
+		inExpr, err = f.Field.OutputExpression()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := inExpr.(FieldExpr); !ok {
+			return nil, newFilterExpressionError(ErrSyntax, "%v %v must be followed by a field path, not %v",
+				OperatorAny, OperatorWithin, f.Field.String())
+		}
+	}
+
+	// The variable is parsed as the first element of a field path.  Paths
+	// starting with it are bound to the loop, leaving any nested clause
+	// which declared the same name to shadow it.
+	varID := exprMaxVarID(AndExpr{inExpr, subExpr}) + 1
+	subExpr = rewriteExpr(subExpr, func(expr Expression) Expression {
+		if field, ok := expr.(FieldExpr); ok && field.Root == 0 && len(field.Path) > 0 && field.Path[0] == f.Var {
+			return FieldExpr{varID, field.Path[1:]}
+		}
+		return expr
+	})
+
+	return AnyWithinExpr{varID, inExpr, subExpr}, nil
+}
+
+// deepFieldExpr is a field path containing `**`, split at each of them.  It
+// only exists while a condition is being output, expandDeepFields turns it
+// into ANY ... WITHIN loops before the condition is returned.
+type deepFieldExpr struct {
+	Root  VariableID
+	Paths [][]string
+}
+
+func (expr deepFieldExpr) String() string {
+	var paths []string
+	for _, path := range expr.Paths {
+		paths = append(paths, strings.Join(path, "."))
 	}
+	return fmt.Sprintf("%s.%s", expr.Root, strings.Join(paths, "."+OperatorDeepWildcard+"."))
+}
+
+// expandDeepFields rewrites a condition referencing `base.**.rest` into
+// `base.rest OR ANY v WITHIN base SATISFIES <condition on v.rest> END`, so
+// that like a glob `**` matches zero or more levels of nesting.  Conditions
+// with several wildcards are expanded one wildcard at a time.
+func expandDeepFields(expr Expression) Expression {
+	var deep *deepFieldExpr
+	rewriteExpr(expr, func(expr Expression) Expression {
+		if field, ok := expr.(deepFieldExpr); ok && deep == nil {
+			deep = &field
+		}
+		return expr
+	})
+	if deep == nil {
+		return expr
+	}
+
+	replaceDeep := func(root VariableID, paths [][]string) Expression {
+		var replacement Expression = FieldExpr{root, paths[0]}
+		if len(paths) > 1 {
+			replacement = deepFieldExpr{root, paths}
+		}
+
+		replaced := false
+		return rewriteExpr(expr, func(expr Expression) Expression {
+			if _, ok := expr.(deepFieldExpr); ok && !replaced {
+				replaced = true
+				return replacement
+			}
+			return expr
+		})
+	}
+
+	joined := append(append([]string{}, deep.Paths[0]...), deep.Paths[1]...)
+	direct := replaceDeep(deep.Root, append([][]string{joined}, deep.Paths[2:]...))
+
+	varID := exprMaxVarID(expr) + 1
+	nested := replaceDeep(varID, deep.Paths[1:])
+
+	return OrExpr{
+		expandDeepFields(direct),
+		AnyWithinExpr{varID, FieldExpr{deep.Root, deep.Paths[0]}, expandDeepFields(nested)},
+	}
+}
+
+// nestedLoopExpr stands in for a loop while checkNestedLoops looks for the
+// loops directly within the one around it, holding the variable the loop
+// iterates over a field of
+type nestedLoopExpr struct {
+	Root VariableID
+}
+
+func (expr nestedLoopExpr) String() string {
+	return fmt.Sprintf("loop over %s", expr.Root)
+}
+
+// checkNestedLoops checks that each loop within another loop iterates over a
+// field of the variable of that loop, as matching descends into the element
+// being looped over and cannot go back to the rest of the document.  Such
+// loops are written with ANY ... WITHIN or FIRST, or come from a `**` used
+// within a loop, or on both sides of a comparison.
+func checkNestedLoops(expr Expression) error {
+	var loopErr error
+	checkBody := func(varID VariableID, body Expression) {
+		rewriteExpr(body, func(expr Expression) Expression {
+			if nested, ok := expr.(nestedLoopExpr); ok && nested.Root != varID && loopErr == nil {
+				loopErr = newFilterExpressionError(ErrSyntax,
+					"a loop within another loop must iterate over a field of its variable, not of %v", nested.Root)
+			}
+			return expr
+		})
+	}
+	loopOver := func(inExpr Expression) Expression {
+		if field, ok := inExpr.(FieldExpr); ok {
+			return nestedLoopExpr{field.Root}
+		}
+		return TrueExpr{}
+	}
+
+	// Loops are replaced bottom up, so those deeper in the body of a loop
+	// have been replaced along with the loop they are within
+	expr = rewriteExpr(expr, func(expr Expression) Expression {
+		switch expr := expr.(type) {
+		case AnyWithinExpr:
+			checkBody(expr.VarId, expr.SubExpr)
+			return loopOver(expr.InExpr)
+		case FirstInExpr:
+			checkBody(expr.VarId, expr.ResultExpr)
+			if expr.SubExpr != nil {
+				checkBody(expr.VarId, expr.SubExpr)
+			}
+			return loopOver(expr.InExpr)
+		}
+		return expr
+	})
+	checkBody(0, expr)
+	return loopErr
 }
 
 type FEOperand struct {
 	// not sure how the grouping on "(" works. if we have "LHS OP RHS",
 	// would this produce "( @@ ( ( @@ @@ )", which is not balanced?
-	BooleanExpr *FEBooleanExpr `@@ |`
-	LHS         *FELhs         `( @@ (`
-	Op          *FECompareOp   `( @@`
-	RHS         *FERhs         `@@ ) | `
-	CheckOp     *FECheckOp     `@@ ) )`
+	BooleanExpr *FEBooleanExpr
+	LHS         *FELhs
+	Op          *FECompareOp
+	RHS         *FERhs
+	CheckOp     *FECheckOp
 }
 
 func (feo *FEOperand) String() string {
@@ -310,16 +881,16 @@ func (f *FEOperand) OutputExpression() (Expression, error) {
 			}
 			return f.Op.OutputExpression(lhsExpr, rhsExpr)
 		} else {
-			return nil, fmt.Errorf("Invalid FEOperand %v", f.String())
+			return nil, newFilterExpressionError(ErrSyntax, "Invalid FEOperand %v", f.String())
 		}
 	} else {
-		return nil, fmt.Errorf("Invalid FEOperand %v", f.String())
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FEOperand %v", f.String())
 	}
 }
 
 type FEBooleanExpr struct {
-	BooleanVal  *FEBoolean         `@@ |`
-	BooleanFunc *FEBooleanFuncExpr `@@`
+	BooleanVal  *FEBoolean
+	BooleanFunc *FEBooleanFuncExpr
 }
 
 func (be *FEBooleanExpr) String() string {
@@ -339,14 +910,14 @@ func (f *FEBooleanExpr) OutputExpression() (Expression, error) {
 		return f.BooleanFunc.OutputExpression()
 	}
 
-	return nil, fmt.Errorf("Invalid FEBooleanExpr %v", f.String())
+	return nil, newFilterExpressionError(ErrSyntax, "Invalid FEBooleanExpr %v", f.String())
 }
 
 type FEBoolean struct {
-	TVal  *bool `@"TRUE" |`
-	TVal1 *bool `@"true" |`
-	FVal  *bool `@"FALSE" |`
-	FVal1 *bool `@"false"`
+	TVal  *bool
+	TVal1 *bool
+	FVal  *bool
+	FVal1 *bool
 }
 
 func (feb *FEBoolean) String() string {
@@ -384,7 +955,7 @@ func (feb *FEBoolean) IsSet() bool {
 
 func (f *FEBoolean) OutputExpression(asValue bool) (Expression, error) {
 	if !f.IsSet() {
-		return nil, fmt.Errorf("Invalid FEBoolean (not set)")
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FEBoolean (not set)")
 	}
 	if f.GetBool() == true {
 		if asValue {
@@ -402,14 +973,17 @@ func (f *FEBoolean) OutputExpression(asValue bool) (Expression, error) {
 }
 
 type FELhs struct {
-	Func  *FEConstFuncExpression `( @@ |`
-	Bool  *FEBoolean             `@@ |`
-	Field *FEField               `@@ |`
-	Value *FEValue               `@@ )`
+	First *FEFirstClause
+	Func  *FEConstFuncExpression
+	Bool  *FEBoolean
+	Field *FEField
+	Value *FEValue
 }
 
 func (fel *FELhs) String() string {
-	if fel.Field != nil {
+	if fel.First != nil {
+		return fel.First.String()
+	} else if fel.Field != nil {
 		return fel.Field.String()
 	} else if fel.Value != nil {
 		return fel.Value.String()
@@ -423,7 +997,9 @@ func (fel *FELhs) String() string {
 }
 
 func (f *FELhs) OutputExpression() (Expression, error) {
-	if f.Field != nil {
+	if f.First != nil {
+		return f.First.OutputExpression()
+	} else if f.Field != nil {
 		return f.Field.OutputExpression()
 	} else if f.Value != nil {
 		return f.Value.OutputExpression()
@@ -432,20 +1008,23 @@ func (f *FELhs) OutputExpression() (Expression, error) {
 	} else if f.Bool != nil {
 		return f.Bool.OutputExpression(true /* asValue */)
 	} else {
-		return nil, fmt.Errorf("Invalid FELhs %v", f.String())
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FELhs %v", f.String())
 	}
 }
 
 // Normally users do values on the RHS, so prioritize it over field
 type FERhs struct {
-	Func  *FEConstFuncExpression `( @@ |`
-	Bool  *FEBoolean             `@@ |`
-	Value *FEValue               `@@ |`
-	Field *FEField               `@@ )`
+	First *FEFirstClause
+	Func  *FEConstFuncExpression
+	Bool  *FEBoolean
+	Value *FEValue
+	Field *FEField
 }
 
 func (fer *FERhs) String() string {
-	if fer.Field != nil {
+	if fer.First != nil {
+		return fer.First.String()
+	} else if fer.Field != nil {
 		return fer.Field.String()
 	} else if fer.Value != nil {
 		return fer.Value.String()
@@ -459,7 +1038,9 @@ func (fer *FERhs) String() string {
 }
 
 func (f *FERhs) OutputExpression() (Expression, error) {
-	if f.Field != nil {
+	if f.First != nil {
+		return f.First.OutputExpression()
+	} else if f.Field != nil {
 		return f.Field.OutputExpression()
 	} else if f.Value != nil {
 		return f.Value.OutputExpression()
@@ -468,20 +1049,94 @@ func (f *FERhs) OutputExpression() (Expression, error) {
 	} else if f.Bool != nil {
 		return f.Bool.OutputExpression(true /*asValue*/)
 	} else {
-		return nil, fmt.Errorf("Invalid FERhs %v", f.String())
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FERhs %v", f.String())
+	}
+}
+
+type FEFirstClause struct {
+	Result *FEField
+	Var    string
+	In     *FEField
+	When   *FilterExpression
+}
+
+func (f *FEFirstClause) String() string {
+	out := fmt.Sprintf("%v %v %v %v %v %v", OperatorFirst, f.Result.String(), OperatorFor, f.Var, OperatorIn, f.In.String())
+	if f.When != nil {
+		out += fmt.Sprintf(" %v %v", OperatorWhen, f.When.rawString())
 	}
+	return out + " " + OperatorEnd
+}
+
+func (f *FEFirstClause) OutputExpression() (Expression, error) {
+	inExpr, err := f.In.OutputExpression()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := inExpr.(FieldExpr); !ok {
+		return nil, newFilterExpressionError(ErrSyntax, "%v %v must be followed by a field path, not %v",
+			OperatorFor, OperatorIn, f.In.String())
+	}
+
+	resultExpr, err := f.Result.OutputExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	var subExpr Expression
+	varIDExprs := AndExpr{inExpr, resultExpr}
+	if f.When != nil {
+		subExpr, err = f.When.outputChecked()
+		if err != nil {
+			return nil, err
+		}
+		varIDExprs = append(varIDExprs, subExpr)
+	}
+
+	// The variable is bound in the same way as for ANY ... WITHIN
+	varID := exprMaxVarID(varIDExprs) + 1
+	bindVar := func(expr Expression) Expression {
+		if field, ok := expr.(FieldExpr); ok && field.Root == 0 && len(field.Path) > 0 && field.Path[0] == f.Var {
+			return FieldExpr{varID, field.Path[1:]}
+		}
+		return expr
+	}
+
+	resultExpr = rewriteExpr(resultExpr, bindVar)
+	if field, ok := resultExpr.(FieldExpr); !ok || field.Root != varID {
+		return nil, newFilterExpressionError(ErrSyntax, "%v must be followed by a field path of %v, not %v",
+			OperatorFirst, f.Var, f.Result.String())
+	}
+	if subExpr != nil {
+		subExpr = rewriteExpr(subExpr, bindVar)
+	}
+
+	return FirstInExpr{varID, inExpr, resultExpr, subExpr}, nil
 }
 
 type FEField struct {
-	MathNeg   *bool               `{ @"-" }`
-	Path      []*FEOnePath        `@@ { "." @@ }`
-	MathOp    *FEMathArithmeticOp `{ ( @@`
-	MathValue *FEMathValue        `@@ ) }`
+	MathNeg *bool
+	// `SELF`, the document itself, which the path is then relative to
+	Self *bool
+	// A named input such as `$other`, which the path is then relative to
+	Input *string
+	// A string field holding JSON, which the path is then applied to
+	DecodeJson *FEField
+	Path       []*FEOnePath
+	MathOp     *FEMathArithmeticOp
+	MathValue  *FEMathValue
 }
 
 func (fef *FEField) String() string {
 	output := []string{}
 	outerOutput := []string{}
+	if fef.Self != nil {
+		output = append(output, OperatorSelf)
+	} else if fef.Input != nil {
+		output = append(output, OperatorInput+*fef.Input)
+	} else if fef.DecodeJson != nil {
+		output = append(output, fmt.Sprintf("%v( %v )", FuncDecodeJson, fef.DecodeJson.String()))
+	}
 	for _, onePath := range fef.Path {
 		output = append(output, onePath.String())
 	}
@@ -507,7 +1162,19 @@ func (f *FEField) OutputExpression() (Expression, error) {
 		return f.OutputExpressionSpecialAsValue()
 	}
 
+	// Inputs other than the document being matched are its fields
+	if f.Input != nil && *f.Input != OperatorDoc {
+		outExpr.Path = append(outExpr.Path, OperatorInput+*f.Input)
+	}
+
+	var deepPaths [][]string
 	for _, onePath := range f.Path {
+		if onePath.DeepWildcard != nil {
+			deepPaths = append(deepPaths, outExpr.Path)
+			outExpr.Path = nil
+			continue
+		}
+
 		pathName, arrays, err := onePath.OutputOnePath()
 		if err != nil {
 			// retrn nil err
@@ -519,6 +1186,21 @@ func (f *FEField) OutputExpression() (Expression, error) {
 		}
 	}
 
+	var fieldExpr Expression = outExpr
+	if f.DecodeJson != nil {
+		if deepPaths != nil {
+			return nil, newFilterExpressionError(ErrSyntax, "%v cannot be followed by %v: %v",
+				FuncDecodeJson, OperatorDeepWildcard, f.String())
+		}
+		innerExpr, err := f.DecodeJson.OutputExpression()
+		if err != nil {
+			return nil, err
+		}
+		fieldExpr = FuncExpr{DecodeJsonFunc, []Expression{innerExpr, ValueExpr{encodeJsonPath(outExpr.Path)}}}
+	} else if deepPaths != nil {
+		fieldExpr = deepFieldExpr{Paths: append(deepPaths, outExpr.Path)}
+	}
+
 	// following is a better way to structure code
 	// mathOutExpr = outExpr
 	// if Neg != nil {
@@ -534,7 +1216,7 @@ func (f *FEField) OutputExpression() (Expression, error) {
 		if f.MathOp == nil {
 			// Only thing is a negation of the field value
 			mathOutExpr.FuncName = MathFuncNeg
-			mathOutExpr.Params = append(mathOutExpr.Params, outExpr)
+			mathOutExpr.Params = append(mathOutExpr.Params, fieldExpr)
 		} else {
 			// {-}field mathOp mathVal
 			mathOpExpr, err := f.MathOp.OutputExpression()
@@ -545,10 +1227,10 @@ func (f *FEField) OutputExpression() (Expression, error) {
 
 			if f.MathNeg != nil {
 				negativeFieldExpr := FuncExpr{FuncName: MathFuncNeg}
-				negativeFieldExpr.Params = append(negativeFieldExpr.Params, outExpr)
+				negativeFieldExpr.Params = append(negativeFieldExpr.Params, fieldExpr)
 				mathOutExpr.Params = append(mathOutExpr.Params, negativeFieldExpr)
 			} else {
-				mathOutExpr.Params = append(mathOutExpr.Params, outExpr)
+				mathOutExpr.Params = append(mathOutExpr.Params, fieldExpr)
 			}
 
 			valueExpr, err := f.MathValue.OutputExpression()
@@ -559,7 +1241,7 @@ func (f *FEField) OutputExpression() (Expression, error) {
 		}
 		return mathOutExpr, nil
 	} else {
-		return outExpr, nil
+		return fieldExpr, nil
 	}
 }
 
@@ -574,7 +1256,7 @@ func (f *FEField) OutputExpression() (Expression, error) {
 // over field. In the DATE() function, however, it doesn't have this luxury to prioritize value or field
 // since it only has one variable.
 func (f *FEField) ShouldHandleSpecialValue() bool {
-	if len(f.Path) == 1 {
+	if len(f.Path) == 1 && f.Self == nil && f.Input == nil && f.DecodeJson == nil {
 		if iso8601Year.MatchString(f.Path[0].String()) ||
 			iso8601YearAndMonth.MatchString(f.Path[0].String()) ||
 			iso8601CompleteDate.MatchString(f.Path[0].String()) {
@@ -589,10 +1271,10 @@ func (f *FEField) OutputExpressionSpecialAsValue() (Expression, error) {
 }
 
 type FEStringType struct {
-	EscapedStrVal string `( @String  |`
-	CharVal       string `@Char |`
-	RawStr        string `@RawString |`
-	StrValue      string `@Ident )`
+	EscapedStrVal string
+	CharVal       string
+	RawStr        string
+	StrValue      string
 }
 
 func (f *FEStringType) String() string {
@@ -611,14 +1293,18 @@ func (f *FEStringType) String() string {
 }
 
 type FEOnePath struct {
-	OnePathFunc  *FEOnePathFuncExpr `( @@  |`
-	StrValue     *FEStringType      ` @@ )`
-	ArrayIndexes []*FEArrayIndex    `{ @@ }`
+	// `**`, matching any number of levels of nesting
+	DeepWildcard *bool
+	OnePathFunc  *FEOnePathFuncExpr
+	StrValue     *FEStringType
+	ArrayIndexes []*FEArrayIndex
 }
 
 func (feop *FEOnePath) String() string {
 	output := []string{}
-	if feop.OnePathFunc != nil {
+	if feop.DeepWildcard != nil {
+		return OperatorDeepWildcard
+	} else if feop.OnePathFunc != nil {
 		output = append(output, feop.OnePathFunc.String())
 	} else if len(feop.StrValue.String()) > 0 {
 		output = append(output, feop.StrValue.String())
@@ -644,14 +1330,13 @@ func (f *FEOnePath) OutputOnePath() (string, []string, error) {
 	} else if f.OnePathFunc != nil {
 		return f.OnePathFunc.String(), arrayIdx, nil
 	} else {
-		return "", arrayIdx, fmt.Errorf("Invalid internal FEOnePath: %v", f.String())
+		return "", arrayIdx, newFilterExpressionError(ErrSyntax, "Invalid internal FEOnePath: %v", f.String())
 	}
 }
 
 type FEArrayIndex struct {
 	// For now we are not supporting negative indexes
-	// ArrayIndex string `"[" [ @"-" ] @Int "]"`
-	ArrayIndex string `"[" @Int "]"`
+	ArrayIndex string
 }
 
 func (i *FEArrayIndex) String() string {
@@ -659,7 +1344,7 @@ func (i *FEArrayIndex) String() string {
 }
 
 type FEOnePathFuncExpr struct {
-	OnePathFuncNoArg *FEOnePathFuncNoArg `@@`
+	OnePathFuncNoArg *FEOnePathFuncNoArg
 }
 
 func (e *FEOnePathFuncExpr) String() string {
@@ -671,7 +1356,7 @@ func (e *FEOnePathFuncExpr) String() string {
 }
 
 type FEOnePathFuncNoArg struct {
-	OnePathFuncNoArgName *FEOnePathFuncNoArgName `( @@ "(" ")" )`
+	OnePathFuncNoArgName *FEOnePathFuncNoArgName
 }
 
 func (na *FEOnePathFuncNoArg) String() string {
@@ -683,7 +1368,7 @@ func (na *FEOnePathFuncNoArg) String() string {
 }
 
 type FEOnePathFuncNoArgName struct {
-	Meta *bool `@"META"`
+	Meta *bool
 }
 
 func (n *FEOnePathFuncNoArgName) String() string {
@@ -697,15 +1382,15 @@ func (n *FEOnePathFuncNoArgName) String() string {
 // There's currently no special Expression for META function, but it's useful to have a parser gramar for it
 // as it is being used internally
 func (f *FEOnePathFuncNoArgName) OutputExpression() (Expression, error) {
-	return nil, fmt.Errorf("Not supported (FEOnePathFuncNoArgName) %v", f.String())
+	return nil, newFilterExpressionError(ErrUnsupportedFunction, "Not supported (FEOnePathFuncNoArgName) %v", f.String())
 }
 
 type FEMathArithmeticOp struct {
-	Addition    *bool `@"+" |`
-	Subtraction *bool `@"-" |`
-	Multiply    *bool `@"*" |`
-	Division    *bool `@"/" |`
-	Modulo      *bool `@"%"`
+	Addition    *bool
+	Subtraction *bool
+	Multiply    *bool
+	Division    *bool
+	Modulo      *bool
 }
 
 func (f *FEMathArithmeticOp) String() string {
@@ -736,13 +1421,13 @@ func (f *FEMathArithmeticOp) OutputExpression() (Expression, error) {
 	} else if f.Modulo != nil {
 		return FuncExpr{FuncName: MathFuncMod}, nil
 	} else {
-		return nil, fmt.Errorf("Invalid FEMathArithmeticOp %v", f.String())
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FEMathArithmeticOp %v", f.String())
 	}
 }
 
 type FEMathValue struct {
-	IntValue   *int     `@Int |`
-	FloatValue *float64 `@Float`
+	IntValue   *int
+	FloatValue *float64
 }
 
 func (f *FEMathValue) String() string {
@@ -761,14 +1446,16 @@ func (f *FEMathValue) OutputExpression() (Expression, error) {
 	} else if f.FloatValue != nil {
 		return ValueExpr{*f.FloatValue}, nil
 	} else {
-		return nil, fmt.Errorf("Invalid FEMathValue %v", f.String())
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FEMathValue %v", f.String())
 	}
 }
 
 type FEValue struct {
-	StrValue   *string  `@String |`
-	IntValue   *int     `@Int |`
-	FloatValue *float64 `@Float`
+	StrValue    *string
+	IntValue    *int
+	FloatValue  *float64
+	ArrayValue  *FEArrayValue
+	ObjectValue *FEObjectValue
 }
 
 func (fev *FEValue) String() string {
@@ -778,6 +1465,10 @@ func (fev *FEValue) String() string {
 		return fmt.Sprintf("%v", *fev.IntValue)
 	} else if fev.FloatValue != nil {
 		return fmt.Sprintf("%v", *fev.FloatValue)
+	} else if fev.ArrayValue != nil {
+		return fev.ArrayValue.String()
+	} else if fev.ObjectValue != nil {
+		return fev.ObjectValue.String()
 	} else {
 		return "?? (FEValue)"
 	}
@@ -796,9 +1487,78 @@ func (f *FEValue) OutputExpression() (Expression, error) {
 		return ValueExpr{
 			*f.FloatValue,
 		}, nil
+	} else if f.ArrayValue != nil {
+		return f.ArrayValue.OutputExpression()
+	} else if f.ObjectValue != nil {
+		return f.ObjectValue.OutputExpression()
 	} else {
-		return ValueExpr{}, fmt.Errorf("Invalid FEValue: %v", f.String())
+		return ValueExpr{}, newFilterExpressionError(ErrSyntax, "Invalid FEValue: %v", f.String())
+	}
+}
+
+// FEArrayValue is an array literal, such as `["a", "b"]`, which is compared
+// with arrays in the document as a whole
+type FEArrayValue struct {
+	Values []*FEValue
+}
+
+// nestedString writes a value held by an array or object literal, where
+// strings are always quoted
+func (fev *FEValue) nestedString() string {
+	if fev.StrValue != nil {
+		return strconv.Quote(*fev.StrValue)
+	}
+	return fev.String()
+}
+
+func (fea *FEArrayValue) String() string {
+	output := []string{}
+	for _, value := range fea.Values {
+		output = append(output, value.nestedString())
 	}
+	return fmt.Sprintf("[%v]", strings.Join(output, ", "))
+}
+
+func (f *FEArrayValue) OutputExpression() (Expression, error) {
+	values := []interface{}{}
+	for _, value := range f.Values {
+		expr, err := value.OutputExpression()
+		if err != nil {
+			return ValueExpr{}, err
+		}
+		values = append(values, expr.(ValueExpr).Value)
+	}
+	return ValueExpr{values}, nil
+}
+
+// FEObjectValue is an object literal, such as `{"city": "NYC"}`, which is
+// compared with objects in the document as a whole, in any order of fields
+type FEObjectValue struct {
+	Keys   []string
+	Values []*FEValue
+}
+
+func (feo *FEObjectValue) String() string {
+	output := []string{}
+	for i, key := range feo.Keys {
+		output = append(output, fmt.Sprintf("%v: %v", strconv.Quote(key), feo.Values[i].nestedString()))
+	}
+	return fmt.Sprintf("{%v}", strings.Join(output, ", "))
+}
+
+func (f *FEObjectValue) OutputExpression() (Expression, error) {
+	fields := map[string]interface{}{}
+	for i, key := range f.Keys {
+		if _, ok := fields[key]; ok {
+			return ValueExpr{}, newFilterExpressionError(ErrSyntax, "duplicate key %q in object", key)
+		}
+		expr, err := f.Values[i].OutputExpression()
+		if err != nil {
+			return ValueExpr{}, err
+		}
+		fields[key] = expr.(ValueExpr).Value
+	}
+	return ValueExpr{fields}, nil
 }
 
 // i do not get the complication. is it that op chars could collide with symbols in other types of operands?
@@ -809,10 +1569,10 @@ func (f *FEValue) OutputExpression() (Expression, error) {
 // and go to the other type of operands
 
 type FEOpChar struct {
-	Not         *bool `( @"!" |`
-	Equal       *bool `@"=" |`
-	LessThan    *bool `@"<" |`
-	GreaterThan *bool `@">" )`
+	Not         *bool
+	Equal       *bool
+	LessThan    *bool
+	GreaterThan *bool
 }
 
 func (f *FEOpChar) String() string {
@@ -829,8 +1589,11 @@ func (f *FEOpChar) String() string {
 }
 
 type FECompareOp struct {
-	OpChars0 *FEOpChar `@@`
-	OpChars1 *FEOpChar `[ @@ ]`
+	OpChars0 *FEOpChar
+	OpChars1 *FEOpChar
+	// Set for `==` when the parser was asked to only match values of the
+	// same JSON type with it
+	strictEquals bool
 }
 
 func (feo *FECompareOp) IsEqual() bool {
@@ -870,7 +1633,9 @@ func (feo *FECompareOp) IsLessThanOrEqualTo() bool {
 }
 
 func (feo *FECompareOp) String() string {
-	if feo.IsEqual() {
+	if feo.strictEquals {
+		return OperatorEquals2
+	} else if feo.IsEqual() {
 		return OperatorEquals
 	} else if feo.IsNotEqual() {
 		return OperatorNotEquals
@@ -898,7 +1663,12 @@ func (feo *FECompareOp) String() string {
 }
 
 func (f *FECompareOp) OutputExpression(lhs Expression, rhs Expression) (Expression, error) {
-	if f.IsEqual() {
+	if f.strictEquals {
+		return StrictEqualsExpr{
+			Lhs: lhs,
+			Rhs: rhs,
+		}, nil
+	} else if f.IsEqual() {
 		return EqualsExpr{
 			Lhs: lhs,
 			Rhs: rhs,
@@ -929,13 +1699,13 @@ func (f *FECompareOp) OutputExpression(lhs Expression, rhs Expression) (Expressi
 			Rhs: rhs,
 		}, nil
 	}
-	return nil, fmt.Errorf("Invalid FECompareOp %v", f.String())
+	return nil, newFilterExpressionError(ErrSyntax, "Invalid FECompareOp %v", f.String())
 }
 
 type FECheckOp struct {
-	Not     *bool `( "IS" [ @"NOT" ]`
-	Null    *bool `( @"NULL" |`
-	Missing *bool `@"MISSING" ) )`
+	Not     *bool
+	Null    *bool
+	Missing *bool
 }
 
 func (feco *FECheckOp) isNot() bool {
@@ -1003,15 +1773,16 @@ func (f *FECheckOp) OutputExpression(subExpr Expression) (Expression, error) {
 		}, nil
 	}
 
-	return nil, fmt.Errorf("Invalid FECheckOp %v", f.String())
+	return nil, newFilterExpressionError(ErrSyntax, "Invalid FECheckOp %v", f.String())
 }
 
 // Technically we could have an slice of arguments, but having OneArg vs NoArg vs TwoArg could
 // allow us to do more strict function check (i.e. certain funcs should only allow one argument, etc, at this level)
 type FEConstFuncExpression struct {
-	ConstFuncNoArg   *FEConstFuncNoArg   `@@ |`
-	ConstFuncOneArg  *FEConstFuncOneArg  `@@ |`
-	ConstFuncTwoArgs *FEConstFuncTwoArgs `@@`
+	ConstFuncNoArg   *FEConstFuncNoArg
+	ConstFuncOneArg  *FEConstFuncOneArg
+	ConstFuncTwoArgs *FEConstFuncTwoArgs
+	DateTruncStr     *FEDateTruncStr
 }
 
 func (f *FEConstFuncExpression) String() string {
@@ -1021,6 +1792,8 @@ func (f *FEConstFuncExpression) String() string {
 		return f.ConstFuncOneArg.String()
 	} else if f.ConstFuncTwoArgs != nil {
 		return f.ConstFuncTwoArgs.String()
+	} else if f.DateTruncStr != nil {
+		return f.DateTruncStr.String()
 	} else {
 		return "?? (FEConstFuncExpression)"
 	}
@@ -1033,13 +1806,15 @@ func (f *FEConstFuncExpression) OutputExpression() (Expression, error) {
 		return f.ConstFuncOneArg.OutputExpression()
 	} else if f.ConstFuncTwoArgs != nil {
 		return f.ConstFuncTwoArgs.OutputExpression()
+	} else if f.DateTruncStr != nil {
+		return f.DateTruncStr.OutputExpression()
 	} else {
-		return nil, fmt.Errorf("Invalid FEConstFuncExpression %v", f.String())
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FEConstFuncExpression %v", f.String())
 	}
 }
 
 type FEConstFuncNoArg struct {
-	ConstFuncNoArgName *FEConstFuncNoArgName `( @@ "(" ")" )`
+	ConstFuncNoArgName *FEConstFuncNoArgName
 }
 
 func (f *FEConstFuncNoArg) String() string {
@@ -1052,19 +1827,23 @@ func (f *FEConstFuncNoArg) String() string {
 
 func (f *FEConstFuncNoArg) OutputExpression() (Expression, error) {
 	if f.ConstFuncNoArgName == nil {
-		return nil, fmt.Errorf("Invalid FEConstFuncNoArg")
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FEConstFuncNoArg")
 	} else if f.ConstFuncNoArgName.Pi != nil && *f.ConstFuncNoArgName.Pi {
 		return ValueExpr{float64(math.Pi)}, nil
 	} else if f.ConstFuncNoArgName.E != nil && *f.ConstFuncNoArgName.E {
 		return ValueExpr{float64(math.E)}, nil
+	} else if f.ConstFuncNoArgName.NowMillis != nil && *f.ConstFuncNoArgName.NowMillis {
+		// Unlike PI and E this is not a constant, so it is left to the matcher
+		return FuncExpr{NowMillisFunc, nil}, nil
 	} else {
-		return nil, fmt.Errorf("Invalid FEConstFuncNoArg")
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FEConstFuncNoArg")
 	}
 }
 
 type FEConstFuncNoArgName struct {
-	Pi *bool `@"PI" |` // FuncPi
-	E  *bool `@"E"`    // FuncE
+	Pi        *bool // FuncPi
+	E         *bool // FuncE
+	NowMillis *bool // FuncNowMillis
 }
 
 func (n *FEConstFuncNoArgName) String() string {
@@ -1072,6 +1851,8 @@ func (n *FEConstFuncNoArgName) String() string {
 		return "E"
 	} else if n.Pi != nil && *n.Pi == true {
 		return "PI"
+	} else if n.NowMillis != nil && *n.NowMillis == true {
+		return FuncNowMillis
 	} else {
 		return "?? (FEConstFuncNoArgName)"
 	}
@@ -1081,9 +1862,9 @@ func (n *FEConstFuncNoArgName) String() string {
 
 // Order matters
 type FEConstFuncArgument struct {
-	SubFunc  *FEConstFuncExpression `@@ |`
-	Field    *FEField               `@@ |`
-	Argument *FEValue               `@@`
+	SubFunc  *FEConstFuncExpression
+	Field    *FEField
+	Argument *FEValue
 }
 
 func (arg *FEConstFuncArgument) String() string {
@@ -1106,15 +1887,15 @@ func (f *FEConstFuncArgument) OutputExpression() (Expression, error) {
 	} else if f.SubFunc != nil {
 		return f.SubFunc.OutputExpression()
 	} else {
-		return nil, fmt.Errorf("Invalid FEConstFuncArgument %v", f.String())
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FEConstFuncArgument %v", f.String())
 	}
 }
 
 // comment not applicable
 // Prioritize value over field
 type FEConstFuncArgumentRHS struct {
-	SubFunc  *FEConstFuncExpression `@@ |`
-	Argument *FEValue               `@@`
+	SubFunc  *FEConstFuncExpression
+	Argument *FEValue
 }
 
 func (arg *FEConstFuncArgumentRHS) String() string {
@@ -1133,24 +1914,27 @@ func (f *FEConstFuncArgumentRHS) OutputExpression() (Expression, error) {
 	} else if f.Argument != nil {
 		return f.Argument.OutputExpression()
 	} else {
-		return nil, fmt.Errorf("Invalid FEConstFuncArgumentRHS %v", f.String())
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FEConstFuncArgumentRHS %v", f.String())
 	}
 }
 
 func (f *FEConstFuncArgumentRHS) OutputRegexExpression() (Expression, error) {
 	if f.Argument == nil {
-		return nil, fmt.Errorf("Invalid FEConstFuncArgumentRHS for regex expression %v", f.String())
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FEConstFuncArgumentRHS for regex expression %v", f.String())
 	}
 	if tokenIsPcreValueType(f.Argument.String()) {
 		return MakePcreExpression(f.Argument.String())
 	} else {
+		if _, err := compileCachedRegex(f.Argument.String()); err != nil {
+			return nil, newFilterExpressionError(ErrBadRegex, "Invalid regular expression %v: %v", f.Argument.String(), err)
+		}
 		return RegexExpr{f.Argument.String()}, nil
 	}
 }
 
 type FEConstFuncOneArg struct {
-	ConstFuncOneArgName *FEConstFuncOneArgName `( @@ "("`
-	Argument            *FEConstFuncArgument   `@@ ")" )`
+	ConstFuncOneArgName *FEConstFuncOneArgName
+	Argument            *FEConstFuncArgument
 }
 
 func (oa *FEConstFuncOneArg) String() string {
@@ -1163,7 +1947,7 @@ func (oa *FEConstFuncOneArg) String() string {
 func (f *FEConstFuncOneArg) OutputExpression() (Expression, error) {
 	var outExpr FuncExpr
 	if f.ConstFuncOneArgName == nil || f.Argument == nil {
-		return outExpr, fmt.Errorf("Invalid FEConstFuncOneArg %v", f.String())
+		return outExpr, newFilterExpressionError(ErrSyntax, "Invalid FEConstFuncOneArg %v", f.String())
 	}
 	name, err := f.ConstFuncOneArgName.OutputExpression()
 	if err != nil {
@@ -1182,23 +1966,32 @@ func (f *FEConstFuncOneArg) OutputExpression() (Expression, error) {
 
 type FEConstFuncOneArgName struct {
 	// N1QL also supports sign(expr) and random(expr)
-	Abs     *bool `@"ABS" |`
-	Acos    *bool `@"ACOS" |`
-	Asin    *bool `@"ASIN" |`
-	Atan    *bool `@"ATAN" |`
-	Ceil    *bool `@"CEIL" |`
-	Cos     *bool `@"COS" |`
-	Date    *bool `@"DATE" |`
-	Degrees *bool `@"DEGREES" |`
-	Exp     *bool `@"EXP" |`
-	Floor   *bool `@"FLOOR" |`
-	Log     *bool `@"LOG" |`
-	Ln      *bool `@"LN" |`
-	Sine    *bool `@"SIN" |`
-	Tangent *bool `@"TAN" |`
-	Radians *bool `@"RADIANS" |`
-	Round   *bool `@"ROUND" |`
-	Sqrt    *bool `@"SQRT"`
+	Abs     *bool
+	Acos    *bool
+	Asin    *bool
+	Atan    *bool
+	Ceil    *bool
+	Cos     *bool
+	Date    *bool
+	Degrees *bool
+	Exp     *bool
+	Floor   *bool
+	Log     *bool
+	Ln      *bool
+	Log10   *bool
+	Log2    *bool
+	Sine    *bool
+	Tangent *bool
+	Radians *bool
+	Round   *bool
+	Sqrt    *bool
+	// Rounds halves to even rather than away from zero
+	RoundEven *bool
+	// Decoded strings are compared byte for byte
+	Base64Decode *bool
+	Base64Encode *bool
+	EncodeJson   *bool
+	WeekdayStr   *bool
 }
 
 func (arg *FEConstFuncOneArgName) String() string {
@@ -1226,6 +2019,10 @@ func (arg *FEConstFuncOneArgName) String() string {
 		return FuncLog
 	} else if arg.Ln != nil && *arg.Ln == true {
 		return FuncLn
+	} else if arg.Log10 != nil && *arg.Log10 == true {
+		return FuncLog10
+	} else if arg.Log2 != nil && *arg.Log2 == true {
+		return FuncLog2
 	} else if arg.Sine != nil && *arg.Sine == true {
 		return FuncSin
 	} else if arg.Tangent != nil && *arg.Tangent == true {
@@ -1234,8 +2031,18 @@ func (arg *FEConstFuncOneArgName) String() string {
 		return FuncRad
 	} else if arg.Round != nil && *arg.Round == true {
 		return FuncRound
+	} else if arg.RoundEven != nil && *arg.RoundEven == true {
+		return FuncRoundEven
 	} else if arg.Sqrt != nil && *arg.Sqrt == true {
 		return FuncSqrt
+	} else if arg.Base64Decode != nil && *arg.Base64Decode == true {
+		return FuncBase64Decode
+	} else if arg.Base64Encode != nil && *arg.Base64Encode == true {
+		return FuncBase64Encode
+	} else if arg.EncodeJson != nil && *arg.EncodeJson == true {
+		return FuncEncodeJson
+	} else if arg.WeekdayStr != nil && *arg.WeekdayStr == true {
+		return FuncWeekdayStr
 	} else {
 		return "?? (FEConstFuncOneArgName)"
 	}
@@ -1266,6 +2073,10 @@ func (arg *FEConstFuncOneArgName) OutputExpression() (string, error) {
 		return MathFuncLog, nil
 	} else if arg.Ln != nil && *arg.Ln == true {
 		return MathFuncLn, nil
+	} else if arg.Log10 != nil && *arg.Log10 == true {
+		return MathFuncLog10, nil
+	} else if arg.Log2 != nil && *arg.Log2 == true {
+		return MathFuncLog2, nil
 	} else if arg.Sine != nil && *arg.Sine == true {
 		return MathFuncSin, nil
 	} else if arg.Tangent != nil && *arg.Tangent == true {
@@ -1274,17 +2085,27 @@ func (arg *FEConstFuncOneArgName) OutputExpression() (string, error) {
 		return MathFuncRadians, nil
 	} else if arg.Round != nil && *arg.Round == true {
 		return MathFuncRound, nil
+	} else if arg.RoundEven != nil && *arg.RoundEven == true {
+		return MathFuncRoundEven, nil
 	} else if arg.Sqrt != nil && *arg.Sqrt == true {
 		return MathFuncSqrt, nil
+	} else if arg.Base64Decode != nil && *arg.Base64Decode == true {
+		return Base64DecFunc, nil
+	} else if arg.Base64Encode != nil && *arg.Base64Encode == true {
+		return Base64EncFunc, nil
+	} else if arg.EncodeJson != nil && *arg.EncodeJson == true {
+		return EncodeJsonFunc, nil
+	} else if arg.WeekdayStr != nil && *arg.WeekdayStr == true {
+		return DateWeekdayFunc, nil
 	} else {
 		return "?? (FEConstFuncOneArgName)", ErrorNotFound
 	}
 }
 
 type FEConstFuncTwoArgs struct {
-	ConstFuncTwoArgsName *FEConstFuncTwoArgsName `( @@ "("`
-	Argument0            *FEConstFuncArgument    `@@ "," `
-	Argument1            *FEConstFuncArgument    `@@ ")" )`
+	ConstFuncTwoArgsName *FEConstFuncTwoArgsName
+	Argument0            *FEConstFuncArgument
+	Argument1            *FEConstFuncArgument
 }
 
 func (fta *FEConstFuncTwoArgs) String() string {
@@ -1297,7 +2118,7 @@ func (fta *FEConstFuncTwoArgs) String() string {
 func (f *FEConstFuncTwoArgs) OutputExpression() (Expression, error) {
 	var outExpr FuncExpr
 	if f.ConstFuncTwoArgsName == nil || f.Argument0 == nil || f.Argument1 == nil {
-		return outExpr, fmt.Errorf("Invalid FEConstFuncTwoArgs %v", f.String())
+		return outExpr, newFilterExpressionError(ErrSyntax, "Invalid FEConstFuncTwoArgs %v", f.String())
 	}
 	name, err := f.ConstFuncTwoArgsName.OutputExpression()
 	if err != nil {
@@ -1323,8 +2144,10 @@ func (f *FEConstFuncTwoArgs) OutputExpression() (Expression, error) {
 type FEConstFuncTwoArgsName struct {
 	// n1ql has POWER(), not POW()
 	// n1ql also has ROUND() and TRUNC() which could take 1-2 args
-	Atan2 *bool `@"ATAN2" |`
-	Power *bool `@"POW"`
+	Atan2 *bool
+	Power *bool
+	// The same as the % operator, as written by SQL translators
+	Mod *bool
 }
 
 func (arg *FEConstFuncTwoArgsName) String() string {
@@ -1332,6 +2155,8 @@ func (arg *FEConstFuncTwoArgsName) String() string {
 		return FuncAtan2
 	} else if arg.Power != nil && *arg.Power == true {
 		return FuncPower
+	} else if arg.Mod != nil && *arg.Mod == true {
+		return FuncMod
 	} else {
 		return "?? (FEConstFuncTwoArgsName)"
 	}
@@ -1342,19 +2167,53 @@ func (arg *FEConstFuncTwoArgsName) OutputExpression() (string, error) {
 		return MathFuncAtan2, nil
 	} else if arg.Power != nil && *arg.Power == true {
 		return MathFuncPow, nil
+	} else if arg.Mod != nil && *arg.Mod == true {
+		return MathFuncMod, nil
 	} else {
 		return "?? (FEConstFuncTwoArgsName)", ErrorNotFound
 	}
 }
 
+// FEDateTruncStr truncates a date to a part such as "day", which has to be
+// a string rather than the field that a quoted argument would usually be
+type FEDateTruncStr struct {
+	Argument *FEConstFuncArgument
+	Part     *string
+}
+
+func (f *FEDateTruncStr) String() string {
+	if f.Argument == nil || f.Part == nil {
+		return "?? (FEDateTruncStr)"
+	}
+	return fmt.Sprintf("%v( %v , %v )", FuncDateTruncStr, f.Argument.String(), *f.Part)
+}
+
+func (f *FEDateTruncStr) OutputExpression() (Expression, error) {
+	if f.Argument == nil || f.Part == nil {
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FEDateTruncStr %v", f.String())
+	}
+	if !isDateTruncPart(*f.Part) {
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid %v part %v, expected one of year, month, day, hour, minute or second",
+			FuncDateTruncStr, *f.Part)
+	}
+	arg, err := f.Argument.OutputExpression()
+	if err != nil {
+		return nil, err
+	}
+	return FuncExpr{DateTruncFunc, []Expression{arg, ValueExpr{strings.ToLower(*f.Part)}}}, nil
+}
+
 type FEBooleanFuncExpr struct {
-	BooleanFuncTwoArgs *FEBooleanFuncTwoArgs `@@ |`
-	ExistsClause       *FEExistsClause       `@@`
+	BooleanFuncTwoArgs *FEBooleanFuncTwoArgs
+	ArrayContains      *FEArrayContainsClause
+	ExistsClause       *FEExistsClause
 }
 
 func (f *FEBooleanFuncExpr) String() string {
 	if f.BooleanFuncTwoArgs != nil {
 		return f.BooleanFuncTwoArgs.String()
+	} else if f.ArrayContains != nil {
+		return f.ArrayContains.String()
 	} else if f.ExistsClause != nil {
 		return f.ExistsClause.String()
 	} else {
@@ -1365,16 +2224,72 @@ func (f *FEBooleanFuncExpr) String() string {
 func (f *FEBooleanFuncExpr) OutputExpression() (Expression, error) {
 	if f.BooleanFuncTwoArgs != nil {
 		return f.BooleanFuncTwoArgs.OutputExpression()
+	} else if f.ArrayContains != nil {
+		return f.ArrayContains.OutputExpression()
 	} else if f.ExistsClause != nil {
 		return f.ExistsClause.OutputExpression()
 	}
-	return nil, fmt.Errorf("Invalid FEBooleanFuncExpr")
+	return nil, newFilterExpressionError(ErrSyntax, "Invalid FEBooleanFuncExpr")
+}
+
+// FEArrayContainsClause checks for a value within an array field, or for a
+// word within the TOKENS() of a string field
+type FEArrayContainsClause struct {
+	Tokens *FEField
+	Field  *FEField
+	Value  *FEConstFuncArgumentRHS
+}
+
+func (f *FEArrayContainsClause) String() string {
+	if f.Value == nil {
+		return "?? (FEArrayContainsClause)"
+	} else if f.Tokens != nil {
+		return fmt.Sprintf("%v( %v( %v ) , %v )", FuncArrayContains, FuncTokens, f.Tokens.String(), f.Value.String())
+	} else if f.Field != nil {
+		return fmt.Sprintf("%v( %v , %v )", FuncArrayContains, f.Field.String(), f.Value.String())
+	} else {
+		return "?? (FEArrayContainsClause)"
+	}
+}
+
+func (f *FEArrayContainsClause) OutputExpression() (Expression, error) {
+	if f.Value == nil || (f.Tokens == nil && f.Field == nil) {
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FEArrayContainsClause %v", f.String())
+	}
+
+	valueExpr, err := f.Value.OutputExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Tokens != nil {
+		strExpr, err := f.Tokens.OutputExpression()
+		if err != nil {
+			return nil, err
+		}
+		return EqualsExpr{
+			FuncExpr{TokenMatchFunc, []Expression{strExpr, valueExpr}},
+			ValueExpr{true},
+		}, nil
+	}
+
+	arrayExpr, err := f.Field.OutputExpression()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := arrayExpr.(FieldExpr); !ok {
+		return nil, newFilterExpressionError(ErrSyntax, "%v must be given a field path, not %v",
+			FuncArrayContains, f.Field.String())
+	}
+
+	varID := exprMaxVarID(AndExpr{arrayExpr, valueExpr}) + 1
+	return AnyInExpr{varID, arrayExpr, EqualsExpr{FieldExpr{varID, nil}, valueExpr}}, nil
 }
 
 type FEBooleanFuncTwoArgs struct {
-	BooleanFuncTwoArgsName *FEBooleanFuncTwoArgsName `( @@ "("`
-	Argument0              *FEConstFuncArgument      `@@ ","`
-	Argument1              *FEConstFuncArgumentRHS   `@@ ")" )`
+	BooleanFuncTwoArgsName *FEBooleanFuncTwoArgsName
+	Argument0              *FEConstFuncArgument
+	Argument1              *FEConstFuncArgumentRHS
 }
 
 func (a *FEBooleanFuncTwoArgs) String() string {
@@ -1410,12 +2325,12 @@ func (f *FEBooleanFuncTwoArgs) OutputExpression() (Expression, error) {
 
 		return outExpr, nil
 	} else {
-		return nil, fmt.Errorf("Invalid FEBooleanFuncTwoArgs %v", f.BooleanFuncTwoArgsName.String())
+		return nil, newFilterExpressionError(ErrSyntax, "Invalid FEBooleanFuncTwoArgs %v", f.BooleanFuncTwoArgsName.String())
 	}
 }
 
 type FEBooleanFuncTwoArgsName struct {
-	RegexContains *bool `@"REGEXP_CONTAINS"`
+	RegexContains *bool
 }
 
 func (n *FEBooleanFuncTwoArgsName) String() string {
@@ -1435,7 +2350,7 @@ func (n *FEBooleanFuncTwoArgsName) OutputExpression() (Expression, error) {
 }
 
 type FEExistsClause struct {
-	Field *FEField `( "EXISTS" "(" @@ ")" )`
+	Field *FEField
 }
 
 func (f *FEExistsClause) String() string {
@@ -1457,51 +2372,98 @@ func (f *FEExistsClause) OutputExpression() (Expression, error) {
 		}, nil
 	}
 
-	return nil, fmt.Errorf("Invalid FEExistsClause %v", f.String())
+	return nil, newFilterExpressionError(ErrSyntax, "Invalid FEExistsClause %v", f.String())
 }
 
-func parserWrapper(parser *participle.Parser, expression string, fe *FilterExpression, err *error) {
-	defer func() {
-		if r := recover(); r != nil {
-			*err = fmt.Errorf("Error from parser: %v", r)
-		}
-	}()
+// FilterExpressionParser parses filter expressions with the hand-written
+// parser in filterExprHandParser.go.  It holds no state other than the
+// options it was created with, and can be used to parse any number of
+// further expressions.
+type FilterExpressionParser struct {
+	aliases      []string
+	strictEquals bool
+	limits       FilterExpressionLimits
+}
 
-	*err = parser.ParseString(expression, fe)
+// ParseString parses the expression into fe, replacing its contents
+func (p *FilterExpressionParser) ParseString(expression string, fe *FilterExpression) error {
+	hand := &feHandParser{aliases: p.aliases, strictEquals: p.strictEquals, limits: p.limits}
+	return parseFilterExpressionStringWith(hand, expression, fe)
 }
 
-func NewFilterExpressionParser(expression string) (*participle.Parser, *FilterExpression, error) {
-	fe := &FilterExpression{}
+// NewFilterExpressionParser parses the expression, returning the parser and
+// the parsed expression, both of which are nil if there is an error
+func NewFilterExpressionParser(expression string) (*FilterExpressionParser, *FilterExpression, error) {
 	if len(expression) == 0 {
-		return nil, fe, ErrorEmptyInput
+		return nil, nil, ErrorEmptyInput
 	}
 
-	parser, err := participle.Build(fe)
-	if err != nil {
-		// nil nil err
-		return parser, fe, err
+	parser := &FilterExpressionParser{}
+	fe := &FilterExpression{}
+	if err := parser.ParseString(expression, fe); err != nil {
+		return nil, nil, err
 	}
-
-	// Use a wrapper so we can recover any panic and set the error gracefully
-	parserWrapper(parser, expression, fe, &err)
-
-	// return nil nil when err != nil
-	return parser, fe, err
+	return parser, fe, nil
 }
 
-func GetFilterExpressionMatcher(expression string) (Matcher, error) {
+// ParseFilterExpression parses a filter expression straight into its Expression
+func ParseFilterExpression(expression string) (Expression, error) {
 	_, fe, err := NewFilterExpressionParser(expression)
 	if err != nil {
 		return nil, err
 	}
 
+	expr, err := fe.OutputExpression()
+	if err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+// Reparse parses the String() output of the expression again, and returns
+// ErrorReparseMismatch if the result does not lower to an expression
+// equivalent to that of the original.
+func (fe *FilterExpression) Reparse() (*FilterExpression, error) {
 	expr, err := fe.OutputExpression()
 	if err != nil {
 		return nil, err
 	}
 
-	var trans Transformer
-	matchDef := trans.Transform([]Expression{expr})
+	_, reparsed, err := NewFilterExpressionParser(fe.String())
+	if err != nil {
+		return nil, err
+	}
+	reparsedExpr, err := reparsed.OutputExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	if !reparseEquivalent(expr, reparsedExpr) {
+		return nil, ErrorReparseMismatch
+	}
+	return reparsed, nil
+}
+
+// reparseEquivalent checks whether two expressions are the same, either as
+// they are or once their groups are put into the form String() writes them in
+func reparseEquivalent(expr, reparsed Expression) bool {
+	if reflect.DeepEqual(expr, reparsed) {
+		return true
+	}
+
+	groups, err := fmtGroups(expr)
+	if err != nil {
+		return false
+	}
+	reparsedGroups, err := fmtGroups(reparsed)
+	return err == nil && reflect.DeepEqual(groups, reparsedGroups)
+}
+
+func GetFilterExpressionMatcher(expression string) (Matcher, error) {
+	matchDef, err := GetFilterExpressionMatchDef(expression)
+	if err != nil {
+		return nil, err
+	}
 
 	matcher := NewFastMatcher(matchDef)
 	return matcher, nil
@@ -4,7 +4,9 @@ package gojsonsm
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
 )
 
@@ -677,3 +679,767 @@ func TestFilterExpressionParser(t *testing.T) {
 	_, err = fe.OutputExpression()
 	assert.NotNil(err)
 }
+
+func TestFilterExpressionParserErrorReturns(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, expression := range []string{"", "a = ", "a = 1 AND"} {
+		parser, fe, err := NewFilterExpressionParser(expression)
+		assert.NotNil(err, expression)
+		assert.Nil(parser, expression)
+		assert.Nil(fe, expression)
+
+		parser, fe, err = NewFilterExpressionParserWithOptions(expression, FilterExpressionParserOptions{})
+		assert.NotNil(err, expression)
+		assert.Nil(parser, expression)
+		assert.Nil(fe, expression)
+
+		expr, err := ParseFilterExpression(expression)
+		assert.NotNil(err, expression)
+		assert.Nil(expr, expression)
+	}
+
+	// Bindings are rejected under a grammar version older than LET
+	parser, fe, err := NewFilterExpressionParserWithOptions(`LET n = name WHERE n = "a"`,
+		FilterExpressionParserOptions{Version: FilterExpressionV1})
+	assert.NotNil(err)
+	assert.Nil(parser)
+	assert.Nil(fe)
+
+	expr, err := ParseFilterExpression("a = 1 AND b > 2")
+	assert.Nil(err)
+	_, fe, err = NewFilterExpressionParser("a = 1 AND b > 2")
+	assert.Nil(err)
+	expected, err := fe.OutputExpression()
+	assert.Nil(err)
+	assert.Equal(expected, expr)
+}
+
+func TestFilterExpressionErrorCategories(t *testing.T) {
+	assert := assert.New(t)
+
+	_, _, err := NewFilterExpressionParser("a = 1 b")
+	assert.True(errors.Is(err, ErrSyntax))
+	var feErr *FilterExpressionError
+	if assert.True(errors.As(err, &feErr)) {
+		assert.Equal(1, feErr.Line)
+		assert.Equal(7, feErr.Column)
+	}
+
+	_, err = GetFilterExpressionMatcher("(a = 1) OR b = 2)")
+	assert.Equal(ErrorMalformedParenthesis, err)
+	err = LocateParenthesisMismatch("(a = 1) OR b = 2)")
+	assert.True(errors.Is(err, ErrMalformedParenthesis))
+	if assert.True(errors.As(err, &feErr)) {
+		assert.Equal(17, feErr.Column)
+	}
+
+	_, err = GetFilterExpressionMatcher("REGEXP_CONTAINS(a, \"[a-\")")
+	assert.True(errors.Is(err, ErrBadRegex))
+
+	var trans Transformer
+	_, err = trans.makeDataRef(FuncExpr{"mathNope", []Expression{ValueExpr{1}}}, nodeRef{})
+	assert.True(errors.Is(err, ErrUnsupportedFunction))
+}
+
+func TestFilterExpressionParenthesisOffsets(t *testing.T) {
+	assert := assert.New(t)
+
+	offsetOf := func(expression string) int {
+		_, err := ParseFilterExpression(expression)
+		assert.Equal(ErrorMalformedParenthesis, err, expression)
+		var feErr *FilterExpressionError
+		if !assert.True(errors.As(LocateParenthesisMismatch(expression), &feErr), expression) {
+			return -1
+		}
+		return feErr.Offset
+	}
+
+	assert.Equal(16, offsetOf("(a = 1) OR b = 2)"))
+	assert.Equal(0, offsetOf("(a = 1 OR b = 2"))
+	assert.Equal(11, offsetOf("(a = 1) OR (b = 2 OR c = 3"))
+	// The counts match, but the first closes before anything was opened
+	assert.Equal(5, offsetOf("a = 1) OR (b = 2"))
+	// The parenthesis opened within ANY ... END cannot be closed after it
+	assert.Equal(37, offsetOf("ANY x WITHIN doc SATISFIES (x = 1 END)"))
+	assert.Equal(27, offsetOf("ANY x WITHIN doc SATISFIES (x = 1 END"))
+
+	for _, expression := range []string{
+		"(a = 1 AND (b = 2 OR c = 3))",
+		"((a = 1) OR b = 2) AND c = 3",
+		"(ANY x WITHIN doc SATISFIES (x = 1) END)",
+	} {
+		_, err := ParseFilterExpression(expression)
+		assert.Nil(err, expression)
+		assert.Nil(LocateParenthesisMismatch(expression), expression)
+	}
+}
+
+func TestFilterExpressionPrecedence(t *testing.T) {
+	assert := assert.New(t)
+
+	readAs := map[string]string{
+		"a = 1 OR b = 2 AND c = 3":                       "a = 1 OR (b = 2 AND c = 3)",
+		"a = 1 AND b = 2 OR c = 3":                       "(a = 1 AND b = 2) OR c = 3",
+		"a = 1 OR b = 2 AND (c = 3 OR d = 4)":            "a = 1 OR (b = 2 AND (c = 3 OR d = 4))",
+		"(a = 1 OR b = 2) AND (c = 3 OR d = 4) OR e = 5": "((a = 1 OR b = 2) AND (c = 3 OR d = 4)) OR e = 5",
+		"(a = 1 OR b = 2) AND c = 3":                     "(a = 1 OR b = 2) AND c = 3",
+		"NOT a = 1 AND b = 2":                            "NOT a = 1 AND b = 2",
+		"((a = 1)) AND ((b = 2 OR c = 3))":               "a = 1 AND (b = 2 OR c = 3)",
+	}
+	for expression, expected := range readAs {
+		expr, err := ParseFilterExpression(expression)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+		str, err := FormatExpression(expr)
+		assert.Nil(err)
+		assert.Equal(expected, str, expression)
+	}
+
+	matcher, err := GetFilterExpressionMatcher("a = 1 OR b = 2 AND (c = 3 OR d = 4)")
+	assert.Nil(err)
+	matched, err := matcher.Match([]byte(`{"a":1}`))
+	assert.Nil(err)
+	assert.True(matched)
+}
+
+func TestParseFilterExpressionConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	expected, err := ParseFilterExpression("a = 1 AND (b > 2 OR c IS MISSING)")
+	assert.Nil(err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				expr, err := ParseFilterExpression("a = 1 AND (b > 2 OR c IS MISSING)")
+				assert.Nil(err)
+				assert.Equal(expected.String(), expr.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, err = ParseFilterExpression("")
+	assert.Equal(ErrorEmptyInput, err)
+}
+
+func TestFilterExpressionAnyWithin(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := []string{
+		`{"type":"error"}`,
+		`{"log":[{"type":"info"},{"entry":{"type":"error"}}]}`,
+		`{"log":[{"type":"info"},{"entry":{"type":"warn"}}]}`,
+		`{"log":{"type":"error"},"other":{"type":"warn"}}`,
+		`{"other":[[{"type":"error"}]]}`,
+	}
+
+	tests := map[string][]bool{
+		"ANY x WITHIN doc SATISFIES x.type = \"error\" END": {false, true, false, true, true},
+		"ANY x WITHIN log SATISFIES x.type = \"error\" END": {false, true, false, false, false},
+		"**.type = \"error\"":                               {true, true, false, true, true},
+		"log.**.type = \"error\"":                           {false, true, false, true, false},
+		"log.** = \"warn\"":                                 {false, false, true, false, false},
+		"NOT ANY x WITHIN doc SATISFIES x = \"warn\" END":   {true, true, false, false, true},
+		"ANY x WITHIN doc SATISFIES ANY y WITHIN x SATISFIES y.type = \"error\" AND x.type IS MISSING END END": {
+			false, true, false, false, true},
+	}
+
+	for expression, expected := range tests {
+		m, err := GetFilterExpressionMatcher(expression)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+		for i, doc := range docs {
+			m.Reset()
+			matched, err := m.Match([]byte(doc))
+			assert.Nil(err, expression)
+			assert.Equal(expected[i], matched, "%s on %s", expression, doc)
+		}
+	}
+
+	// The loop variable is bound within the body only
+	expr, err := ParseFilterExpression("ANY x WITHIN x SATISFIES x.a = 1 END")
+	assert.Nil(err)
+	assert.Equal(AnyWithinExpr{1, FieldExpr{0, []string{"x"}}, OrExpr{AndExpr{
+		EqualsExpr{FieldExpr{1, []string{"a"}}, ValueExpr{1}},
+	}}}, expr.(OrExpr)[0].(AndExpr)[0])
+
+	_, _, err = NewFilterExpressionParser("ANY x WITHIN doc SATISFIES x.a = 1")
+	assert.NotNil(err)
+	_, err = ParseFilterExpression("ANY x WITHIN a.** SATISFIES x.a = 1 END")
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParser("a.* * = 1")
+	assert.NotNil(err)
+}
+
+func TestFilterExpressionFirst(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := []string{
+		`{"contacts":[{"primary":false,"email":"b@x"},{"primary":true,"email":"a@x"}],"login":"a@x"}`,
+		`{"contacts":[{"primary":true,"email":"c@x"},{"primary":true,"email":"a@x"}],"login":"a@x"}`,
+		`{"contacts":[{"primary":false,"email":"a@x"}],"login":"b@x"}`,
+		`{"contacts":[{"email":"a@x"}]}`,
+	}
+
+	tests := map[string][]bool{
+		"FIRST x.email FOR x IN contacts WHEN x.primary = true END = \"a@x\"":     {true, false, false, false},
+		"login = FIRST x.email FOR x IN contacts WHEN x.primary = true END":       {true, false, false, false},
+		"FIRST x.email FOR x IN contacts WHEN x.primary = true END = login":       {true, false, false, false},
+		"FIRST x.email FOR x IN contacts END = \"a@x\"":                           {false, false, true, true},
+		"FIRST x.email FOR x IN contacts WHEN x.primary = true END IS MISSING":    {false, false, true, true},
+		"FIRST x.email FOR x IN contacts WHEN x.email = login END IS NOT MISSING": {true, true, false, false},
+	}
+
+	for expression, expected := range tests {
+		m, err := GetFilterExpressionMatcher(expression)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+		for i, doc := range docs {
+			m.Reset()
+			matched, err := m.Match([]byte(doc))
+			assert.Nil(err, expression)
+			assert.Equal(expected[i], matched, "%s on %s", expression, doc)
+		}
+	}
+
+	expr, err := ParseFilterExpression("FIRST x.a FOR x IN x END = 1")
+	assert.Nil(err)
+	assert.Equal(EqualsExpr{
+		FirstInExpr{1, FieldExpr{0, []string{"x"}}, FieldExpr{1, []string{"a"}}, nil},
+		ValueExpr{1},
+	}, expr.(OrExpr)[0].(AndExpr)[0])
+
+	// The result must come from the loop variable
+	_, err = ParseFilterExpression("FIRST y.a FOR x IN b END = 1")
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParser("FIRST x.a FOR x IN b WHEN x.c = 1 = 1")
+	assert.NotNil(err)
+}
+
+func TestFilterExpressionLet(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := []string{
+		`{"price":20,"qty":6,"tax":0.5,"name":"a"}`,
+		`{"price":20,"qty":5,"tax":0.5,"name":"b"}`,
+		`{"price":100,"qty":6,"tax":0,"name":"a"}`,
+	}
+
+	tests := map[string][]bool{
+		"LET total = price * qty WHERE total > 100 AND total < 500":            {true, false, false},
+		"LET total = price * qty, due = total + total * tax WHERE due >= 180":  {true, false, true},
+		"LET due = (price + 10) * qty WHERE due = 180":                         {true, false, false},
+		"LET n = name WHERE n = \"a\" AND price * 1 = price":                   {true, false, true},
+		"name = \"a\" AND LET total = price * qty WHERE total = 120":           {true, false, false},
+		"ANY x WITHIN doc SATISFIES LET half = x / 2 WHERE half = 3 END":       {true, false, true},
+		"LET price = qty WHERE ANY price WITHIN doc SATISFIES price = 100 END": {false, false, true},
+	}
+
+	for expression, expected := range tests {
+		m, err := GetFilterExpressionMatcher(expression)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+		for i, doc := range docs {
+			m.Reset()
+			matched, err := m.Match([]byte(doc))
+			assert.Nil(err, expression)
+			assert.Equal(expected[i], matched, "%s on %s", expression, doc)
+		}
+	}
+
+	// Each use of a binding is the same expression
+	expr, err := ParseFilterExpression("LET t = a * b WHERE t > 1")
+	assert.Nil(err)
+	assert.Equal(OrExpr{AndExpr{GreaterThanExpr{
+		FuncExpr{MathFuncMul, []Expression{FieldExpr{0, []string{"a"}}, FieldExpr{0, []string{"b"}}}},
+		ValueExpr{1},
+	}}}, expr)
+
+	_, err = ParseFilterExpression("LET t = a WHERE t.b > 1")
+	assert.NotNil(err)
+	_, err = ParseFilterExpression("LET t = a.**.b WHERE t > 1")
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParser("LET t = a t > 1")
+	assert.NotNil(err)
+}
+
+func TestFilterExpressionSelf(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := []string{
+		`{"a":{"b":1},"c":[1,2]}`,
+		`{}`,
+		`5`,
+	}
+
+	tests := map[string][]bool{
+		"SELF IS NOT MISSING":                   {true, true, true},
+		"EXISTS(SELF)":                          {true, true, true},
+		"a IS NOT MISSING AND EXISTS(c)":        {true, false, false},
+		"SELF.a.b = 1":                          {true, false, false},
+		"SELF = 5":                              {false, false, true},
+		"SELF * 2 = 10":                         {false, false, true},
+		"`SELF` IS MISSING":                     {true, true, true},
+		"ANY x WITHIN SELF SATISFIES x = 2 END": {true, false, false},
+		"NOT EXISTS(a) OR SELF.a.b > 0":         {true, true, true},
+	}
+
+	for expression, expected := range tests {
+		m, err := GetFilterExpressionMatcher(expression)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+		for i, doc := range docs {
+			m.Reset()
+			matched, err := m.Match([]byte(doc))
+			assert.Nil(err, expression)
+			assert.Equal(expected[i], matched, "%s on %s", expression, doc)
+		}
+	}
+
+	expr, err := ParseFilterExpression("SELF.a = SELF")
+	assert.Nil(err)
+	assert.Equal(OrExpr{AndExpr{EqualsExpr{FieldExpr{0, []string{"a"}}, FieldExpr{0, nil}}}}, expr)
+
+	formatted, err := FormatExpression(ExistsExpr{FieldExpr{0, nil}})
+	assert.Nil(err)
+	assert.Equal("EXISTS(SELF)", formatted)
+	formatted, err = FormatExpression(EqualsExpr{FieldExpr{0, []string{"SELF"}}, ValueExpr{1}})
+	assert.Nil(err)
+	assert.Equal("`SELF` = 1", formatted)
+}
+
+func TestFilterExpressionArrayContains(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := []string{
+		`{"title":"The quick, brown fox!","tags":["fox","dog"],"n":[1,2]}`,
+		`{"title":"foxes\u0020jump","tags":["cat"],"n":3}`,
+		`{"title":12,"tags":"fox"}`,
+	}
+
+	tests := map[string][]bool{
+		"ARRAY_CONTAINS(TOKENS(title), \"brown\")":              {true, false, false},
+		"ARRAY_CONTAINS(TOKENS(title), \"fox\")":                {true, false, false},
+		"ARRAY_CONTAINS(TOKENS(title), \"jump\")":               {false, true, false},
+		"ARRAY_CONTAINS(TOKENS(title), \"Quick\")":              {false, false, false},
+		"NOT ARRAY_CONTAINS(TOKENS(title), \"fox\")":            {false, true, true},
+		"ARRAY_CONTAINS(tags, \"fox\")":                         {true, false, false},
+		"ARRAY_CONTAINS(n, 2) OR ARRAY_CONTAINS(tags, \"cat\")": {true, true, false},
+	}
+
+	for expression, expected := range tests {
+		m, err := GetFilterExpressionMatcher(expression)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+		for i, doc := range docs {
+			m.Reset()
+			matched, err := m.Match([]byte(doc))
+			assert.Nil(err, expression)
+			assert.Equal(expected[i], matched, "%s on %s", expression, doc)
+		}
+	}
+
+	for _, expression := range []string{
+		"ARRAY_CONTAINS(TOKENS(title), \"fox\")",
+		"ARRAY_CONTAINS(tags, 1)",
+	} {
+		expr, err := ParseFilterExpression(expression)
+		assert.Nil(err)
+		formatted, err := FormatExpression(expr)
+		assert.Nil(err)
+		assert.Equal(expression, formatted)
+	}
+
+	_, err := ParseFilterExpression("ARRAY_CONTAINS(TOKENS(title) \"fox\")")
+	assert.NotNil(err)
+}
+
+func TestFilterExpressionBase64(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := []string{
+		`{"blob":"aGVsbG8gd29ybGQ=","name":"hello world"}`,
+		`{"blob":"aGVsbG8gd29ybGQ","name":"hi"}`,
+		`{"blob":"not base64!","name":"aGk="}`,
+	}
+
+	tests := map[string][]bool{
+		"BASE64_DECODE(blob) = \"hello world\"":     {true, true, false},
+		"BASE64_ENCODE(name) = blob":                {true, false, false},
+		"BASE64_DECODE(name) = \"hi\"":              {false, false, true},
+		"BASE64_DECODE(blob) IS NULL":               {false, false, true},
+		"BASE64_DECODE(BASE64_ENCODE(name)) = name": {true, true, true},
+	}
+
+	for expression, expected := range tests {
+		m, err := GetFilterExpressionMatcher(expression)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+		for i, doc := range docs {
+			m.Reset()
+			matched, err := m.Match([]byte(doc))
+			assert.Nil(err, expression)
+			assert.Equal(expected[i], matched, "%s on %s", expression, doc)
+		}
+	}
+
+	expr, err := ParseFilterExpression("BASE64_DECODE(blob) = \"x\"")
+	assert.Nil(err)
+	formatted, err := FormatExpression(expr)
+	assert.Nil(err)
+	assert.Equal("BASE64_DECODE(blob) = \"x\"", formatted)
+}
+
+func TestFilterExpressionDecodeJson(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := []string{
+		`{"payload":"{\"type\":\"click\",\"a\":[1,{\"b\":2}]}","name":"a\"b"}`,
+		`{"payload":"{\"type\":\"view\",\"a\":{\"b\":3}}","name":"x"}`,
+		`{"payload":"not json","name":1}`,
+	}
+
+	tests := map[string][]bool{
+		"DECODE_JSON(payload).type = \"click\"": {true, false, false},
+		"DECODE_JSON(payload).a[1].b = 2":       {true, false, false},
+		"DECODE_JSON(payload).a.b > 2":          {false, true, false},
+		"EXISTS(DECODE_JSON(payload).a[0])":     {true, false, false},
+		"DECODE_JSON(payload).type IS MISSING":  {false, false, true},
+		"ENCODE_JSON(name) = \"\\\"x\\\"\"":     {false, true, false},
+		"ENCODE_JSON(name) = \"1\"":             {false, false, true},
+	}
+
+	for expression, expected := range tests {
+		m, err := GetFilterExpressionMatcher(expression)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+		for i, doc := range docs {
+			m.Reset()
+			matched, err := m.Match([]byte(doc))
+			assert.Nil(err, expression)
+			assert.Equal(expected[i], matched, "%s on %s", expression, doc)
+		}
+	}
+
+	_, err := ParseFilterExpression("DECODE_JSON(payload).**.b = 1")
+	assert.NotNil(err)
+
+	expr, err := ParseFilterExpression("DECODE_JSON(payload).a[1].`b-c` = 2")
+	assert.Nil(err)
+	formatted, err := FormatExpression(expr)
+	assert.Nil(err)
+	assert.Equal("DECODE_JSON(payload).a[1].`b-c` = 2", formatted)
+}
+
+func TestFilterExpressionDateTrunc(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := []string{
+		`{"created":"2019-03-09T10:15:00Z","updated":"2019-03-09T23:59:59Z"}`,
+		`{"created":"2019-03-11T10:15:00+08:00","updated":"2019-03-12T01:00:00+08:00"}`,
+		`{"created":"2019-03-31","updated":"not a date"}`,
+	}
+
+	tests := map[string][]bool{
+		"WEEKDAY_STR(created) = \"Saturday\" OR WEEKDAY_STR(created) = \"Sunday\"": {true, false, true},
+		"DATE_TRUNC_STR(created, \"day\") = DATE_TRUNC_STR(updated, \"day\")":      {true, false, false},
+		"DATE_TRUNC_STR(created, \"MONTH\") = DATE_TRUNC_STR(updated, \"month\")":  {true, true, false},
+		"DATE_TRUNC_STR(created, \"hour\") = \"2019-03-11T10:00:00+08:00\"":        {false, true, false},
+		"DATE_TRUNC_STR(created, \"year\") = \"2019-01-01T00:00:00Z\"":             {true, false, true},
+		"WEEKDAY_STR(updated) IS NULL":                                             {false, false, true},
+	}
+
+	for expression, expected := range tests {
+		m, err := GetFilterExpressionMatcher(expression)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+		for i, doc := range docs {
+			m.Reset()
+			matched, err := m.Match([]byte(doc))
+			assert.Nil(err, expression)
+			assert.Equal(expected[i], matched, "%s on %s", expression, doc)
+		}
+	}
+
+	_, err := ParseFilterExpression("DATE_TRUNC_STR(created, \"week\") = \"x\"")
+	assert.NotNil(err)
+	_, err = ParseFilterExpression("DATE_TRUNC_STR(created, day) = \"x\"")
+	assert.NotNil(err)
+
+	expr, err := ParseFilterExpression("DATE_TRUNC_STR(created, \"Day\") = \"x\" AND WEEKDAY_STR(created) = \"Monday\"")
+	assert.Nil(err)
+	formatted, err := FormatExpression(expr)
+	assert.Nil(err)
+	assert.Equal("DATE_TRUNC_STR(created, \"day\") = \"x\" AND WEEKDAY_STR(created) = \"Monday\"", formatted)
+}
+
+func TestFilterExpressionNowMillis(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseFilterExpression("META().expiration * 1000 < NOW_MILLIS()")
+	assert.Nil(err)
+	formatted, err := FormatExpression(expr)
+	assert.Nil(err)
+	assert.Equal("META().expiration * 1000 < NOW_MILLIS()", formatted)
+
+	expr, err = ParseFilterExpression("LET cutoff = NOW_MILLIS() + 86400000 WHERE META().expiration * 1000 < cutoff")
+	assert.Nil(err)
+	n1ql, err := ToN1QL(expr)
+	assert.Nil(err)
+	assert.Equal("(META().`expiration` * 1000) < (NOW_MILLIS() + 86400000)", n1ql)
+
+	// Without parentheses it is still a field
+	_, err = ParseFilterExpression("NOW_MILLIS = 1")
+	assert.Nil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("NOW_MILLIS() > 0", FilterExpressionParserOptions{Version: FilterExpressionV13})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("NOW_MILLIS() > 0", FilterExpressionParserOptions{Version: FilterExpressionV14})
+	assert.Nil(err)
+}
+
+func TestFilterExpressionArrayLiteral(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := []string{
+		`{"tags":["a","b"],"ids":[1,-2.5,["x"]],"other":["a","b"]}`,
+		`{"tags":["b","a"],"ids":[1,-2.5],"other":"a"}`,
+		`{"tags":["a","b","c"],"ids":[1.0,-2.5,["x"]],"other":[]}`,
+		`{"tags":[],"ids":[1,{"x":1},["x"]]}`,
+		`{"tags":"a","ids":1}`,
+	}
+	tests := map[string][]bool{
+		`tags = ["a", "b"]`:                        {true, false, false, false, false},
+		`tags != ["a", "b"]`:                       {false, true, true, true, true},
+		`tags = []`:                                {false, false, false, true, false},
+		`tags = ["a", "b"] OR tags = ["a"]`:        {true, false, false, false, false},
+		`ids = [1, -2.5, ["x"]]`:                   {true, false, true, false, false},
+		`ids = [1, -2.5]`:                          {false, true, false, false, false},
+		`tags > ["a", "a"]`:                        {true, true, true, false, false},
+		`tags = other`:                             {true, false, false, false, false},
+		`["a", "b"] = tags`:                        {true, false, false, false, false},
+		`tags[0] = "a" AND tags = ["a", "b", "c"]`: {false, false, true, false, false},
+	}
+
+	for expression, expected := range tests {
+		m, err := GetFilterExpressionMatcher(expression)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+		for i, doc := range docs {
+			m.Reset()
+			matched, err := m.Match([]byte(doc))
+			assert.Nil(err, expression)
+			assert.Equal(expected[i], matched, "%s on %s", expression, doc)
+		}
+	}
+
+	expr, err := ParseFilterExpression(`tags = ["a", 1, -2.5, []]`)
+	assert.Nil(err)
+	eqExpr := expr.(OrExpr)[0].(AndExpr)[0]
+	assert.Equal(EqualsExpr{
+		FieldExpr{Root: 0, Path: []string{"tags"}},
+		ValueExpr{[]interface{}{"a", 1, -2.5, []interface{}{}}},
+	}, eqExpr)
+	assert.Equal(`$doc.tags = ["a", 1, -2.5, []]`, eqExpr.String())
+
+	formatted, err := FormatExpression(expr)
+	assert.Nil(err)
+	assert.Equal(`tags = ["a", 1, -2.5, []]`, formatted)
+
+	_, err = ParseFilterExpression(`tags = ["a", ]`)
+	assert.NotNil(err)
+	_, err = ParseFilterExpression(`tags = ["a"`)
+	assert.NotNil(err)
+	_, err = ParseFilterExpression(`tags = [name]`)
+	assert.NotNil(err)
+}
+
+func TestFilterExpressionObjectLiteral(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := []string{
+		`{"address":{"city":"NYC","zip":"10001"}}`,
+		`{"address":{"zip":"10001","city":"NYC"}}`,
+		`{"address":{"city":"NYC","zip":"10001","street":"Main"}}`,
+		`{"address":{"city":"NYC","zip":10001}}`,
+		`{"address":["NYC","10001"],"home":{"zip":"10001","city":"NYC"}}`,
+		`{"address":{"city":"NYC","tags":[{"a":1},[]],"":0}}`,
+	}
+	tests := map[string][]bool{
+		`address = {"city": "NYC", "zip": "10001"}`:  {true, true, false, false, false, false},
+		`address = {"zip": "10001", "city": "NYC"}`:  {true, true, false, false, false, false},
+		`address != {"city": "NYC", "zip": "10001"}`: {false, false, true, true, true, true},
+		`address = {}`: {false, false, false, false, false, false},
+		`address = {"city": "NYC", "tags": [{"a": 1}, []], "": 0}`:         {false, false, false, false, false, true},
+		`address.city = "NYC" AND address = {"city": "NYC", "zip": 10001}`: {false, false, false, true, false, false},
+		`address = home`: {false, false, false, false, false, false},
+	}
+
+	for expression, expected := range tests {
+		m, err := GetFilterExpressionMatcher(expression)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+		for i, doc := range docs {
+			m.Reset()
+			matched, err := m.Match([]byte(doc))
+			assert.Nil(err, expression)
+			assert.Equal(expected[i], matched, "%s on %s", expression, doc)
+		}
+	}
+
+	var trans Transformer
+	def := trans.Transform([]Expression{EqualsExpr{
+		FieldExpr{Root: 0, Path: []string{"address"}},
+		FieldExpr{Root: 0, Path: []string{"home"}},
+	}})
+	m := NewFastMatcher(def)
+	matched, err := m.Match([]byte(`{"address":{"city":"NYC","n":[1,{"x":true}]},"home":{"n":[1,{"x":true}],"city":"NYC"}}`))
+	assert.Nil(err)
+	assert.True(matched)
+
+	expr, err := ParseFilterExpression(`address = {"zip": "10001", "city": "NYC", "loc": [-1.5, 2]}`)
+	assert.Nil(err)
+	eqExpr := expr.(OrExpr)[0].(AndExpr)[0]
+	assert.Equal(EqualsExpr{
+		FieldExpr{Root: 0, Path: []string{"address"}},
+		ValueExpr{map[string]interface{}{"zip": "10001", "city": "NYC", "loc": []interface{}{-1.5, 2}}},
+	}, eqExpr)
+	assert.Equal(`$doc.address = {"city": "NYC", "loc": [-1.5, 2], "zip": "10001"}`, eqExpr.String())
+
+	formatted, err := FormatExpression(expr)
+	assert.Nil(err)
+	assert.Equal(`address = {"city": "NYC", "loc": [-1.5, 2], "zip": "10001"}`, formatted)
+
+	_, err = ParseFilterExpression(`address = {"city": "NYC", "city": "LA"}`)
+	assert.NotNil(err)
+	_, err = ParseFilterExpression(`address = {city: "NYC"}`)
+	assert.NotNil(err)
+	_, err = ParseFilterExpression(`address = {"city" "NYC"}`)
+	assert.NotNil(err)
+}
+
+func TestFilterExpressionModFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	parser, fe, err := NewFilterExpressionParser("MOD(a, 3) = 1")
+	assert.Nil(err)
+	assert.NotNil(parser)
+	assert.Equal(FuncMod, fe.AndConditions[0].OrConditions[0].Operand.LHS.Func.ConstFuncTwoArgs.ConstFuncTwoArgsName.String())
+
+	// MOD() is the same as the % operator
+	modExpr, err := ParseFilterExpression("MOD(a, 3) = 1")
+	assert.Nil(err)
+	opExpr, err := ParseFilterExpression("a % 3 = 1")
+	assert.Nil(err)
+	assert.Equal(opExpr, modExpr)
+
+	matcher, err := GetFilterExpressionMatcher("MOD(a, b) = 1 AND MOD(7, a) = 1")
+	assert.Nil(err)
+	m := matcher.(*FastMatcher)
+	for doc, expected := range map[string]bool{
+		`{"a":3,"b":2}`:   true,
+		`{"a":6,"b":5}`:   true,
+		`{"a":3,"b":3}`:   false,
+		`{"a":5,"b":2}`:   false,
+		`{"a":"3","b":2}`: false,
+		`{"a":3}`:         false,
+		// The divisor is truncated, and zero divisors give no value
+		`{"a":3,"b":2.5}`: true,
+		`{"a":3,"b":0}`:   false,
+		`{"a":3,"b":0.5}`: false,
+	} {
+		m.Reset()
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err)
+		assert.Equal(expected, matched, doc)
+	}
+
+	for _, expression := range []string{"MOD(a, 0) = 1", "a % 0 = 1", "MOD(a, 0.5) = 1"} {
+		matcher, err := GetFilterExpressionMatcher(expression)
+		assert.Nil(err)
+		matched, err := matcher.Match([]byte(`{"a":4}`))
+		assert.Nil(err)
+		assert.False(matched, expression)
+	}
+
+	_, err = ParseFilterExpression("MOD(a) = 1")
+	assert.NotNil(err)
+
+	simpleExpr, err := ParseSimpleExpression("MOD(a,3) == 1")
+	assert.Nil(err)
+	assert.Contains(simpleExpr.String(), "func:"+MathFuncMod)
+}
+
+func TestFilterExpressionLogFuncs(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseFilterExpression("LOG10(a) = 2 AND LOG2(b) = 3")
+	assert.Nil(err)
+	formatted, err := FormatExpression(expr)
+	assert.Nil(err)
+	assert.Equal("LOG10(a) = 2 AND LOG2(b) = 3", formatted)
+
+	matcher, err := GetFilterExpressionMatcher("LOG10(a) = 2 AND LOG2(b) = 3")
+	assert.Nil(err)
+	m := matcher.(*FastMatcher)
+	for doc, expected := range map[string]bool{
+		`{"a":100,"b":8}`:   true,
+		`{"a":100.0,"b":8}`: true,
+		`{"a":10,"b":8}`:    false,
+		`{"a":100,"b":3}`:   false,
+		`{"a":100,"b":-8}`:  false,
+		`{"a":"100","b":8}`: false,
+	} {
+		m.Reset()
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err)
+		assert.Equal(expected, matched, doc)
+	}
+}
+
+func TestFilterExpressionRoundEven(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseFilterExpression("ROUND_EVEN(a) = ROUND(a)")
+	assert.Nil(err)
+	formatted, err := FormatExpression(expr)
+	assert.Nil(err)
+	assert.Equal("ROUND_EVEN(a) = ROUND(a)", formatted)
+
+	// Only halves round differently, those between odd and even numbers
+	matcher, err := GetFilterExpressionMatcher("ROUND_EVEN(a) = ROUND(a)")
+	assert.Nil(err)
+	m := matcher.(*FastMatcher)
+	for doc, expected := range map[string]bool{
+		`{"a":2.5}`:  false,
+		`{"a":-2.5}`: false,
+		`{"a":3.5}`:  true,
+		`{"a":2.4}`:  true,
+		`{"a":2.6}`:  true,
+		`{"a":7}`:    true,
+	} {
+		m.Reset()
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err)
+		assert.Equal(expected, matched, doc)
+	}
+
+	// N1QL has no function rounding halves to even
+	_, err = ToN1QL(expr)
+	assert.Equal(ErrorN1qlNotRepresentable, err)
+}
@@ -0,0 +1,256 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"strings"
+	"text/scanner"
+)
+
+// In strict mode every parenthesis has to be matched, and AND and OR can
+// only be used together with parenthesis showing which of them binds first
+type strictChecker struct {
+	// The number of parenthesis which are open
+	depth int
+}
+
+func (c *strictChecker) checkLink(link *FilterExpression) error {
+	for _, let := range link.Lets {
+		if err := checkStrictLetValue(let.Value); err != nil {
+			return err
+		}
+	}
+
+	for _, ac := range link.AndConditions {
+		c.depth += len(ac.OpenParens)
+
+		for _, cond := range ac.OrConditions {
+			if err := checkStrictCondition(cond); err != nil {
+				return err
+			}
+		}
+
+		for range ac.CloseParens {
+			if c.depth == 0 {
+				return newFilterExpressionError(ErrorStrictParenthesis, "%v: unexpected \")\" after %v", ErrorStrictParenthesis, ac.String())
+			}
+			c.depth--
+		}
+	}
+
+	for _, subLink := range link.SubFilterExpr {
+		if err := c.checkLink(subLink); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check checks a whole expression, which ends with every parenthesis closed
+func (c *strictChecker) check(fe *FilterExpression, within string) error {
+	if err := c.checkLink(fe); err != nil {
+		return err
+	}
+	if c.depth > 0 {
+		return newFilterExpressionError(ErrorStrictParenthesis, "%v: %v unclosed \"(\"%v", ErrorStrictParenthesis, c.depth, within)
+	}
+	if fe.mixesAndOr() {
+		return newFilterExpressionError(ErrorStrictAndOr, "%v: %v", ErrorStrictAndOr, fe.rawString())
+	}
+	return nil
+}
+
+func checkStrictCondition(cond *FECondition) error {
+	if cond.Not != nil {
+		return checkStrictCondition(cond.Not)
+	}
+	if cond.AnyWithin != nil {
+		return checkStrictAnyWithin(cond.AnyWithin)
+	}
+	if cond.Operand == nil {
+		return nil
+	}
+
+	operand := cond.Operand
+	if operand.LHS != nil {
+		if err := checkStrictLhs(operand.LHS); err != nil {
+			return err
+		}
+	}
+	if operand.RHS != nil {
+		if operand.RHS.Field != nil && isBareIdentField(operand.RHS.Field) {
+			return newFilterExpressionError(ErrorStrictBareField, "%v: %v", ErrorStrictBareField, operand.RHS.Field.String())
+		}
+		if err := checkStrictField(operand.RHS.Field); err != nil {
+			return err
+		}
+		if err := checkStrictFirst(operand.RHS.First); err != nil {
+			return err
+		}
+		if err := checkStrictFunc(operand.RHS.Func); err != nil {
+			return err
+		}
+	}
+	if operand.BooleanExpr != nil && operand.BooleanExpr.BooleanFunc != nil {
+		boolFunc := operand.BooleanExpr.BooleanFunc
+		if boolFunc.BooleanFuncTwoArgs != nil {
+			if err := checkStrictFuncArg(boolFunc.BooleanFuncTwoArgs.Argument0); err != nil {
+				return err
+			}
+		}
+		if boolFunc.ArrayContains != nil {
+			if err := checkStrictField(boolFunc.ArrayContains.Tokens); err != nil {
+				return err
+			}
+			if err := checkStrictField(boolFunc.ArrayContains.Field); err != nil {
+				return err
+			}
+		}
+		if boolFunc.ExistsClause != nil {
+			if err := checkStrictField(boolFunc.ExistsClause.Field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The body of ANY ... WITHIN is a filter expression of its own, so its
+// parenthesis are checked separately from the surrounding ones
+func checkStrictAnyWithin(clause *FEAnyWithinClause) error {
+	if err := checkStrictField(clause.Field); err != nil {
+		return err
+	}
+
+	checker := &strictChecker{}
+	return checker.check(clause.Satisfies, " in "+clause.String())
+}
+
+func checkStrictLhs(lhs *FELhs) error {
+	if err := checkStrictFirst(lhs.First); err != nil {
+		return err
+	}
+	if err := checkStrictField(lhs.Field); err != nil {
+		return err
+	}
+	return checkStrictFunc(lhs.Func)
+}
+
+// Like the body of ANY ... WITHIN, the WHEN of FIRST is checked on its own
+func checkStrictFirst(clause *FEFirstClause) error {
+	if clause == nil {
+		return nil
+	}
+	if err := checkStrictField(clause.Result); err != nil {
+		return err
+	}
+	if err := checkStrictField(clause.In); err != nil {
+		return err
+	}
+	if clause.When == nil {
+		return nil
+	}
+
+	checker := &strictChecker{}
+	return checker.check(clause.When, " in "+clause.String())
+}
+
+func checkStrictLetValue(value *FELetValue) error {
+	for _, term := range value.Terms {
+		if term.Paren != nil {
+			if err := checkStrictLetValue(term.Paren); err != nil {
+				return err
+			}
+		}
+		if err := checkStrictField(term.Field); err != nil {
+			return err
+		}
+		if err := checkStrictFunc(term.Func); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkStrictFunc(fn *FEConstFuncExpression) error {
+	if fn == nil {
+		return nil
+	}
+	if fn.ConstFuncOneArg != nil {
+		return checkStrictFuncArg(fn.ConstFuncOneArg.Argument)
+	}
+	if fn.ConstFuncTwoArgs != nil {
+		if err := checkStrictFuncArg(fn.ConstFuncTwoArgs.Argument0); err != nil {
+			return err
+		}
+		return checkStrictFuncArg(fn.ConstFuncTwoArgs.Argument1)
+	}
+	if fn.DateTruncStr != nil {
+		return checkStrictFuncArg(fn.DateTruncStr.Argument)
+	}
+	return nil
+}
+
+func checkStrictFuncArg(arg *FEConstFuncArgument) error {
+	if arg == nil {
+		return nil
+	}
+	if err := checkStrictField(arg.Field); err != nil {
+		return err
+	}
+	return checkStrictFunc(arg.SubFunc)
+}
+
+// Quoted strings are read as field names wherever a field is allowed before
+// a value, which is almost never what was intended
+func checkStrictField(field *FEField) error {
+	if field == nil || field.ShouldHandleSpecialValue() {
+		return nil
+	}
+	if err := checkStrictField(field.DecodeJson); err != nil {
+		return err
+	}
+	for _, onePath := range field.Path {
+		if onePath.StrValue == nil {
+			continue
+		}
+		if len(onePath.StrValue.EscapedStrVal) > 0 || len(onePath.StrValue.CharVal) > 0 {
+			return newFilterExpressionError(ErrorStrictQuotedField, "%v: %v", ErrorStrictQuotedField, field.String())
+		}
+	}
+	return nil
+}
+
+// A lone unquoted word on the right hand side, such as `a = hello`, is most
+// likely a literal missing its quotes.  Strict mode requires backticks.
+func isBareIdentField(field *FEField) bool {
+	if len(field.Path) != 1 || field.Self != nil || field.DecodeJson != nil || field.MathOp != nil || field.MathNeg != nil {
+		return false
+	}
+	onePath := field.Path[0]
+	return onePath.StrValue != nil && len(onePath.StrValue.StrValue) > 0 && len(onePath.ArrayIndexes) == 0
+}
+
+// The lexer silently skips comments, which would let trailing text through
+func checkStrictComments(expression string) error {
+	var s scanner.Scanner
+	s.Init(strings.NewReader(expression))
+	s.Mode = scanner.GoTokens &^ scanner.SkipComments
+	s.Error = func(*scanner.Scanner, string) {}
+
+	for tok := s.Scan(); tok != scanner.EOF; tok = s.Scan() {
+		if tok == scanner.Comment {
+			return newFilterExpressionError(ErrorStrictComment, "%v: %v at %v", ErrorStrictComment, s.TokenText(), s.Position)
+		}
+	}
+	return nil
+}
+
+func checkStrictFilterExpression(expression string, fe *FilterExpression) error {
+	if err := checkStrictComments(expression); err != nil {
+		return err
+	}
+
+	checker := &strictChecker{}
+	return checker.check(fe, "")
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestFilterExpressionStrictMode(t *testing.T) {
+	assert := assert.New(t)
+
+	strict := FilterExpressionParserOptions{Strict: true}
+
+	accepted := []string{
+		"a = 1",
+		"(a = 1 OR b = 2) AND c = 3",
+		"a = 1 OR (b = 2 AND c = 3)",
+		"a = 1 AND (b = 2 OR c = 3)",
+		"(a = 1 AND (b = 2 OR c = 3))",
+		"((a = 1 OR b = 2) AND c = 3) OR d = 4",
+		"a = `b` AND c = d.e",
+		"DATE(a) > DATE(\"2019-01-01\")",
+		"REGEXP_CONTAINS(`a b`, \"x\")",
+	}
+	for _, input := range accepted {
+		_, _, err := NewFilterExpressionParserWithOptions(input, strict)
+		assert.Nil(err, input)
+	}
+
+	rejected := map[string]error{
+		"a = 1)":                     ErrorStrictParenthesis,
+		"a = 1) AND (b = 2":          ErrorStrictParenthesis,
+		"a = 1 OR b = 2 AND c = 3":   ErrorStrictAndOr,
+		"a = 1 OR b = 2 AND (c = 3)": ErrorStrictAndOr,
+		"(a = 1 OR b = 2 AND c = 3)": ErrorStrictAndOr,
+		"a = hello":                  ErrorStrictBareField,
+		"\"a\" = 1":                  ErrorStrictQuotedField,
+		"ABS('xy') = 1":              ErrorStrictQuotedField,
+		"a = 1 // AND b = 2":         ErrorStrictComment,
+	}
+	for input, expectedErr := range rejected {
+		// Lenient mode still accepts these
+		_, _, err := NewFilterExpressionParser(input)
+		assert.Nil(err, input)
+
+		_, _, err = NewFilterExpressionParserWithOptions(input, strict)
+		if assert.NotNil(err, input) {
+			assert.True(strings.HasPrefix(err.Error(), expectedErr.Error()), err.Error())
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"regexp"
+	"strings"
+)
+
+// TemplateField is a template parameter naming a field of the document,
+// given as the elements of its path
+type TemplateField []string
+
+// FilterTemplate is a filter expression with `{{name}}` placeholders which
+// are filled in with parameters before it is parsed.  Each parameter is
+// written as a single field name or value of the expression, quoted and
+// escaped as needed, so parameters from untrusted sources cannot change the
+// shape of the expression the way they could if they were concatenated in.
+type FilterTemplate struct {
+	// The text around the placeholders, which always has one more element
+	// than names
+	text  []string
+	names []string
+}
+
+var templatePlaceholderRegex = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// NewFilterTemplate parses the placeholders of a template
+func NewFilterTemplate(template string) (*FilterTemplate, error) {
+	t := &FilterTemplate{}
+	last := 0
+	for _, loc := range templatePlaceholderRegex.FindAllStringSubmatchIndex(template, -1) {
+		t.text = append(t.text, template[last:loc[0]])
+		t.names = append(t.names, template[loc[2]:loc[3]])
+		last = loc[1]
+	}
+	t.text = append(t.text, template[last:])
+
+	for _, text := range t.text {
+		if strings.Contains(text, "{{") || strings.Contains(text, "}}") {
+			return nil, ErrorTemplateSyntax
+		}
+	}
+	return t, nil
+}
+
+// Names returns the names of the placeholders in the order they appear
+func (t *FilterTemplate) Names() []string {
+	return append([]string(nil), t.names...)
+}
+
+// templateParam formats a parameter as it is written in a filter expression
+func templateParam(param interface{}) (string, error) {
+	switch param := param.(type) {
+	case TemplateField:
+		return fmtField(FieldExpr{Root: 0, Path: param})
+	case FieldExpr:
+		return fmtField(param)
+	case ValueExpr:
+		return fmtValue(param, fmtPosRhs)
+	}
+	return fmtValue(ValueExpr{param}, fmtPosRhs)
+}
+
+// Expand fills in the placeholders of the template with the parameters of
+// the same name.  Strings, numbers and booleans are written as values, and
+// TemplateField and FieldExpr parameters as field names.
+func (t *FilterTemplate) Expand(params map[string]interface{}) (string, error) {
+	var out strings.Builder
+	for i, name := range t.names {
+		out.WriteString(t.text[i])
+
+		param, ok := params[name]
+		if !ok {
+			return "", ErrorTemplateMissingParam
+		}
+		paramStr, err := templateParam(param)
+		if err != nil {
+			return "", ErrorTemplateParam
+		}
+		out.WriteString(paramStr)
+	}
+	out.WriteString(t.text[len(t.text)-1])
+	return out.String(), nil
+}
+
+// Parse expands the template and parses the resulting filter expression
+func (t *FilterTemplate) Parse(params map[string]interface{}) (Expression, error) {
+	expression, err := t.Expand(params)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFilterExpression(expression)
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterTemplateExpand(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpl, err := NewFilterTemplate(`{{ field }} = {{value}} AND total > {{min}}`)
+	assert.Nil(err)
+	assert.Equal([]string{"field", "value", "min"}, tmpl.Names())
+
+	expression, err := tmpl.Expand(map[string]interface{}{
+		"field": TemplateField{"customer", "first name"},
+		"value": "Neil",
+		"min":   100,
+	})
+	assert.Nil(err)
+	assert.Equal("customer.`first name` = \"Neil\" AND total > 100", expression)
+
+	_, err = tmpl.Expand(map[string]interface{}{"field": TemplateField{"name"}, "value": "Neil"})
+	assert.Equal(ErrorTemplateMissingParam, err)
+
+	_, err = tmpl.Expand(map[string]interface{}{"field": TemplateField{"a`b"}, "value": "Neil", "min": 1})
+	assert.Equal(ErrorTemplateParam, err)
+
+	_, err = tmpl.Expand(map[string]interface{}{"field": TemplateField{"name"}, "value": []int{1}, "min": 1})
+	assert.Equal(ErrorTemplateParam, err)
+
+	_, err = NewFilterTemplate(`name = {{value}`)
+	assert.Equal(ErrorTemplateSyntax, err)
+	_, err = NewFilterTemplate(`name = {{1value}}`)
+	assert.Equal(ErrorTemplateSyntax, err)
+}
+
+func TestFilterTemplateInjection(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpl, err := NewFilterTemplate(`type = {{type}}`)
+	assert.Nil(err)
+
+	// A value trying to close the string and add a clause stays one string
+	expr, err := tmpl.Parse(map[string]interface{}{"type": `x" OR type = "order`})
+	assert.Nil(err)
+
+	matcher, err := GetFilterExpressionMatcher(`type = "order"`)
+	assert.Nil(err)
+	m := NewFastMatcher(new(Transformer).Transform([]Expression{expr}))
+	matched, err := m.Match([]byte(`{"type":"order"}`))
+	assert.Nil(err)
+	assert.False(matched)
+	matched, err = matcher.Match([]byte(`{"type":"order"}`))
+	assert.Nil(err)
+	assert.True(matched)
+
+	m.Reset()
+	matched, err = m.Match([]byte(`{"type":"x\" OR type = \"order"}`))
+	assert.Nil(err)
+	assert.True(matched)
+}
@@ -0,0 +1,323 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+// FilterExpressionVersion pins the grammar features a parser will accept, so
+// that expressions can be kept compatible with older downstream evaluators
+type FilterExpressionVersion int
+
+const (
+	// Accept everything the current grammar supports
+	FilterExpressionVersionLatest FilterExpressionVersion = iota
+	// Comparisons, AND/OR/NOT, EXISTS, IS [NOT] NULL/MISSING and META()
+	FilterExpressionV1 FilterExpressionVersion = iota
+	// V1 with REGEXP_CONTAINS
+	FilterExpressionV2 FilterExpressionVersion = iota
+	// V2 with the built-in math/date functions and field arithmetic
+	FilterExpressionV3 FilterExpressionVersion = iota
+	// V3 with ANY ... WITHIN and `**` field paths
+	FilterExpressionV4 FilterExpressionVersion = iota
+	// V4 with FIRST ... FOR ... IN range expressions
+	FilterExpressionV5 FilterExpressionVersion = iota
+	// V5 with LET bindings
+	FilterExpressionV6 FilterExpressionVersion = iota
+	// V6 with SELF references to the whole document
+	FilterExpressionV7 FilterExpressionVersion = iota
+	// V7 with ARRAY_CONTAINS and TOKENS
+	FilterExpressionV8 FilterExpressionVersion = iota
+	// V8 with BASE64_DECODE and BASE64_ENCODE
+	FilterExpressionV9 FilterExpressionVersion = iota
+	// V9 with DECODE_JSON and ENCODE_JSON
+	FilterExpressionV10 FilterExpressionVersion = iota
+	// V10 with DATE_TRUNC_STR and WEEKDAY_STR
+	FilterExpressionV11 FilterExpressionVersion = iota
+	// V11 with array literals such as `["a", "b"]`
+	FilterExpressionV12 FilterExpressionVersion = iota
+	// V12 with object literals such as `{"city": "NYC"}`
+	FilterExpressionV13 FilterExpressionVersion = iota
+	// V13 with NOW_MILLIS
+	FilterExpressionV14 FilterExpressionVersion = iota
+	// V14 with `$name` references to named inputs
+	FilterExpressionV15 FilterExpressionVersion = iota
+	// V15 with LOG10 and LOG2
+	FilterExpressionV16 FilterExpressionVersion = iota
+	// V16 with ROUND_EVEN
+	FilterExpressionV17 FilterExpressionVersion = iota
+)
+
+const filterExpressionCurrentVersion = FilterExpressionV17
+
+func (v FilterExpressionVersion) String() string {
+	switch v {
+	case FilterExpressionVersionLatest:
+		return "latest"
+	case FilterExpressionV1:
+		return "v1"
+	case FilterExpressionV2:
+		return "v2"
+	case FilterExpressionV3:
+		return "v3"
+	case FilterExpressionV4:
+		return "v4"
+	case FilterExpressionV5:
+		return "v5"
+	case FilterExpressionV6:
+		return "v6"
+	case FilterExpressionV7:
+		return "v7"
+	case FilterExpressionV8:
+		return "v8"
+	case FilterExpressionV9:
+		return "v9"
+	case FilterExpressionV10:
+		return "v10"
+	case FilterExpressionV11:
+		return "v11"
+	case FilterExpressionV12:
+		return "v12"
+	case FilterExpressionV13:
+		return "v13"
+	case FilterExpressionV14:
+		return "v14"
+	case FilterExpressionV15:
+		return "v15"
+	case FilterExpressionV16:
+		return "v16"
+	case FilterExpressionV17:
+		return "v17"
+	default:
+		return "unknown"
+	}
+}
+
+type FilterExpressionParserOptions struct {
+	Version FilterExpressionVersion
+	// Reject ambiguities that the parser otherwise tolerates
+	Strict bool
+	// Keyspace names and aliases that may prefix fields, such as the `t` in
+	// `t.type = "hotel"` or `META(t).id`, which are dropped so that WHERE
+	// clauses copied out of N1QL queries parse as they are
+	Aliases []string
+	// Only match values of the same JSON type with `==`, so that `5 == "5"`
+	// and `1 == true` are false whatever coercion the matcher is set to
+	// apply, while `=` keeps applying it
+	StrictEquals bool
+	// Caps on the size of the expressions the parser accepts
+	Limits FilterExpressionLimits
+}
+
+// Returns the lowest grammar version able to express the given expression
+func filterExpressionMinVersion(expr Expression) FilterExpressionVersion {
+	version := FilterExpressionV1
+	raise := func(other FilterExpressionVersion) {
+		if other > version {
+			version = other
+		}
+	}
+
+	switch expr := expr.(type) {
+	case AndExpr:
+		for _, subExpr := range expr {
+			raise(filterExpressionMinVersion(subExpr))
+		}
+	case OrExpr:
+		for _, subExpr := range expr {
+			raise(filterExpressionMinVersion(subExpr))
+		}
+	case NotExpr:
+		raise(filterExpressionMinVersion(expr.SubExpr))
+	case ExistsExpr:
+		raise(filterExpressionMinVersion(expr.SubExpr))
+	case NotExistsExpr:
+		raise(filterExpressionMinVersion(expr.SubExpr))
+	case EqualsExpr:
+		raise(filterExpressionMinVersion(expr.Lhs))
+		raise(filterExpressionMinVersion(expr.Rhs))
+	case StrictEqualsExpr:
+		raise(filterExpressionMinVersion(expr.Lhs))
+		raise(filterExpressionMinVersion(expr.Rhs))
+	case NotEqualsExpr:
+		raise(filterExpressionMinVersion(expr.Lhs))
+		raise(filterExpressionMinVersion(expr.Rhs))
+	case LessThanExpr:
+		raise(filterExpressionMinVersion(expr.Lhs))
+		raise(filterExpressionMinVersion(expr.Rhs))
+	case LessEqualsExpr:
+		raise(filterExpressionMinVersion(expr.Lhs))
+		raise(filterExpressionMinVersion(expr.Rhs))
+	case GreaterThanExpr:
+		raise(filterExpressionMinVersion(expr.Lhs))
+		raise(filterExpressionMinVersion(expr.Rhs))
+	case GreaterEqualsExpr:
+		raise(filterExpressionMinVersion(expr.Lhs))
+		raise(filterExpressionMinVersion(expr.Rhs))
+	case LikeExpr:
+		raise(FilterExpressionV2)
+		raise(filterExpressionMinVersion(expr.Lhs))
+	case FuncExpr:
+		raise(FilterExpressionV3)
+		switch expr.FuncName {
+		case TokenMatchFunc:
+			raise(FilterExpressionV8)
+		case Base64DecFunc, Base64EncFunc:
+			raise(FilterExpressionV9)
+		case DecodeJsonFunc, EncodeJsonFunc:
+			raise(FilterExpressionV10)
+		case DateTruncFunc, DateWeekdayFunc:
+			raise(FilterExpressionV11)
+		case NowMillisFunc:
+			raise(FilterExpressionV14)
+		case MathFuncLog10, MathFuncLog2:
+			raise(FilterExpressionV16)
+		case MathFuncRoundEven:
+			raise(FilterExpressionV17)
+		}
+		for _, param := range expr.Params {
+			raise(filterExpressionMinVersion(param))
+		}
+	case ValueExpr:
+		raise(valueMinVersion(expr.Value))
+	case FieldExpr:
+		if expr.Root == 0 && len(expr.Path) == 0 {
+			raise(FilterExpressionV7)
+		} else if expr.Root == 0 && fmtInputRegex.MatchString(expr.Path[0]) {
+			raise(FilterExpressionV15)
+		}
+	case AnyInExpr:
+		// Only written as ARRAY_CONTAINS
+		raise(FilterExpressionV8)
+		raise(filterExpressionMinVersion(expr.SubExpr))
+	case AnyWithinExpr:
+		// Ranging over the whole document is also written as `doc`
+		raise(FilterExpressionV4)
+		raise(filterExpressionMinVersion(expr.SubExpr))
+	case FirstInExpr:
+		raise(FilterExpressionV5)
+		if expr.SubExpr != nil {
+			raise(filterExpressionMinVersion(expr.SubExpr))
+		}
+	}
+
+	return version
+}
+
+// valueMinVersion returns the lowest grammar version able to write the
+// value, which for arrays and objects also depends on what they hold
+func valueMinVersion(value interface{}) FilterExpressionVersion {
+	version := FilterExpressionV1
+	raise := func(other FilterExpressionVersion) {
+		if other > version {
+			version = other
+		}
+	}
+
+	switch value := value.(type) {
+	case []interface{}:
+		raise(FilterExpressionV12)
+		for _, elem := range value {
+			raise(valueMinVersion(elem))
+		}
+	case map[string]interface{}:
+		raise(FilterExpressionV13)
+		for _, field := range value {
+			raise(valueMinVersion(field))
+		}
+	}
+	return version
+}
+
+// CheckFilterExpressionVersion returns an error if the expression uses
+// grammar features newer than the given version
+func CheckFilterExpressionVersion(expr Expression, version FilterExpressionVersion) error {
+	if version == FilterExpressionVersionLatest {
+		return nil
+	}
+	if version > filterExpressionCurrentVersion {
+		return newFilterExpressionError(ErrorUnknownGrammarVersion, "%v: %v", ErrorUnknownGrammarVersion, version)
+	}
+
+	if required := filterExpressionMinVersion(expr); required > version {
+		return newFilterExpressionError(ErrorGrammarVersion, "%v: expression requires %v but %v was requested", ErrorGrammarVersion, required, version)
+	}
+	return nil
+}
+
+// NewFilterExpressionParserWithOptions behaves like NewFilterExpressionParser,
+// returning nils on error too, but drops the aliases given in the options from the start of fields, and
+// rejects expressions that need a newer grammar version than the one
+// requested in the options, and, in strict mode, expressions that are only
+// accepted because of the grammar's leniency
+func NewFilterExpressionParserWithOptions(expression string, options FilterExpressionParserOptions) (*FilterExpressionParser, *FilterExpression, error) {
+	if len(expression) == 0 {
+		return nil, nil, ErrorEmptyInput
+	}
+
+	parser := &FilterExpressionParser{aliases: options.Aliases, strictEquals: options.StrictEquals, limits: options.Limits}
+	fe := &FilterExpression{}
+	if err := parser.ParseString(expression, fe); err != nil {
+		return nil, nil, err
+	}
+
+	if options.Strict {
+		if err := checkStrictFilterExpression(expression, fe); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if options.Version != FilterExpressionVersionLatest {
+		expr, err := fe.OutputExpression()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = CheckFilterExpressionVersion(expr, options.Version); err != nil {
+			return nil, nil, err
+		}
+		// Bindings are replaced by their values in the output, so they are
+		// looked for in the parsed expression instead
+		if fe.hasLets() && options.Version < FilterExpressionV6 {
+			return nil, nil, newFilterExpressionError(ErrorGrammarVersion, "%v: %v requires %v but %v was requested",
+				ErrorGrammarVersion, OperatorLet, FilterExpressionV6, options.Version)
+		}
+	}
+
+	return parser, fe, nil
+}
+
+// hasLets checks whether LET is used anywhere within the expression
+func (fe *FilterExpression) hasLets() bool {
+	if len(fe.Lets) > 0 {
+		return true
+	}
+	for _, ac := range fe.AndConditions {
+		for _, cond := range ac.OrConditions {
+			if cond.hasLets() {
+				return true
+			}
+		}
+	}
+	for _, sub := range fe.SubFilterExpr {
+		if sub.hasLets() {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FECondition) hasLets() bool {
+	switch {
+	case f.Not != nil:
+		return f.Not.hasLets()
+	case f.AnyWithin != nil:
+		return f.AnyWithin.Satisfies.hasLets()
+	case f.Operand != nil:
+		if f.Operand.LHS != nil && f.Operand.LHS.First != nil && f.Operand.LHS.First.When != nil {
+			if f.Operand.LHS.First.When.hasLets() {
+				return true
+			}
+		}
+		if f.Operand.RHS != nil && f.Operand.RHS.First != nil && f.Operand.RHS.First.When != nil {
+			return f.Operand.RHS.First.When.hasLets()
+		}
+	}
+	return false
+}
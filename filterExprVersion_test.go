@@ -0,0 +1,129 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFilterExpressionVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	v1Options := FilterExpressionParserOptions{Version: FilterExpressionV1}
+	v2Options := FilterExpressionParserOptions{Version: FilterExpressionV2}
+
+	_, _, err := NewFilterExpressionParserWithOptions("a = 1 AND EXISTS(b) OR META().id IS NOT NULL", v1Options)
+	assert.Nil(err)
+
+	_, _, err = NewFilterExpressionParserWithOptions("REGEXP_CONTAINS(a, \"^b\")", v1Options)
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("REGEXP_CONTAINS(a, \"^b\")", v2Options)
+	assert.Nil(err)
+
+	_, _, err = NewFilterExpressionParserWithOptions("ABS(a) > 1", v2Options)
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("a + 1 > 1", v2Options)
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("a + 1 > 1", FilterExpressionParserOptions{})
+	assert.Nil(err)
+
+	_, _, err = NewFilterExpressionParserWithOptions("a.**.b = 1", FilterExpressionParserOptions{Version: FilterExpressionV3})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("ANY x WITHIN doc SATISFIES x = 1 END", FilterExpressionParserOptions{Version: FilterExpressionV4})
+	assert.Nil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("FIRST x FOR x IN a END = 1", FilterExpressionParserOptions{Version: FilterExpressionV4})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("FIRST x FOR x IN a END = 1", FilterExpressionParserOptions{Version: FilterExpressionV5})
+	assert.Nil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("ANY x WITHIN a SATISFIES LET y = x WHERE y = 1 END", FilterExpressionParserOptions{Version: FilterExpressionV5})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("LET y = a + 1 WHERE y = 1", FilterExpressionParserOptions{Version: FilterExpressionV6})
+	assert.Nil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("SELF IS NOT MISSING", FilterExpressionParserOptions{Version: FilterExpressionV6})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("SELF.a = 1 AND ABS(SELF) > 1", FilterExpressionParserOptions{Version: FilterExpressionV7})
+	assert.Nil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("ARRAY_CONTAINS(TOKENS(a), \"b\")", FilterExpressionParserOptions{Version: FilterExpressionV7})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("ARRAY_CONTAINS(a, 1)", FilterExpressionParserOptions{Version: FilterExpressionV7})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("ARRAY_CONTAINS(TOKENS(a), \"b\")", FilterExpressionParserOptions{Version: FilterExpressionV8})
+	assert.Nil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("BASE64_DECODE(a) = \"b\"", FilterExpressionParserOptions{Version: FilterExpressionV8})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("BASE64_DECODE(a) = \"b\"", FilterExpressionParserOptions{Version: FilterExpressionV9})
+	assert.Nil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("DECODE_JSON(a).b = 1", FilterExpressionParserOptions{Version: FilterExpressionV9})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("ENCODE_JSON(a) = \"b\"", FilterExpressionParserOptions{Version: FilterExpressionV9})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("EXISTS(DECODE_JSON(a).b)", FilterExpressionParserOptions{Version: FilterExpressionV10})
+	assert.Nil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("WEEKDAY_STR(a) = \"Sunday\"", FilterExpressionParserOptions{Version: FilterExpressionV10})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("DATE_TRUNC_STR(a, \"day\") = DATE_TRUNC_STR(b, \"day\")", FilterExpressionParserOptions{Version: FilterExpressionV11})
+	assert.Nil(err)
+	_, _, err = NewFilterExpressionParserWithOptions(`tags = ["a", "b"]`, FilterExpressionParserOptions{Version: FilterExpressionV1})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions(`tags = ["a", "b"] OR ABS(a) = 1`, FilterExpressionParserOptions{Version: FilterExpressionV11})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions(`tags = ["a", "b"]`, FilterExpressionParserOptions{Version: FilterExpressionV12})
+	assert.Nil(err)
+	_, _, err = NewFilterExpressionParserWithOptions(`addr = {"city":"NYC"}`, FilterExpressionParserOptions{Version: FilterExpressionV1})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions(`addrs = [{"city":"NYC"}]`, FilterExpressionParserOptions{Version: FilterExpressionV12})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions(`addr = {"city":"NYC","loc":[1, 2]}`, FilterExpressionParserOptions{Version: FilterExpressionV13})
+	assert.Nil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("LOG10(a) > LOG(b)", FilterExpressionParserOptions{Version: FilterExpressionV15})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("LOG2(a) = 3", FilterExpressionParserOptions{Version: FilterExpressionV16})
+	assert.Nil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("ROUND_EVEN(a) = 2", FilterExpressionParserOptions{Version: FilterExpressionV16})
+	assert.NotNil(err)
+	_, _, err = NewFilterExpressionParserWithOptions("ROUND_EVEN(a) = ROUND(a)", FilterExpressionParserOptions{Version: FilterExpressionV17})
+	assert.Nil(err)
+
+	_, _, err = NewFilterExpressionParserWithOptions("a = 1", FilterExpressionParserOptions{Version: 100})
+	assert.NotNil(err)
+}
+
+func TestFilterExpressionAliases(t *testing.T) {
+	assert := assert.New(t)
+
+	options := FilterExpressionParserOptions{Aliases: []string{"t", "travel-sample"}}
+
+	tests := map[string]string{
+		"t.type = \"hotel\"":                      "type = \"hotel\"",
+		"`travel-sample`.geo.alt > 10":            "geo.alt > 10",
+		"META(t).id = \"a\" AND t.t = 1":          "META().id = \"a\" AND t = 1",
+		"t = 1":                                   "t = 1",
+		"ANY x WITHIN t.tags SATISFIES x = 1 END": "ANY x WITHIN tags SATISFIES x = 1 END",
+	}
+
+	for expression, expected := range tests {
+		_, fe, err := NewFilterExpressionParserWithOptions(expression, options)
+		if !assert.Nil(err, expression) {
+			continue
+		}
+		_, plain, err := NewFilterExpressionParser(expected)
+		if !assert.Nil(err, expected) {
+			continue
+		}
+
+		expr, err := fe.OutputExpression()
+		assert.Nil(err, expression)
+		plainExpr, err := plain.OutputExpression()
+		assert.Nil(err, expected)
+		assert.Equal(plainExpr, expr, expression)
+	}
+
+	// Without the options the prefix remains part of the field
+	expr, err := ParseFilterExpression("t.type = 1")
+	assert.Nil(err)
+	assert.Equal(OrExpr{AndExpr{EqualsExpr{FieldExpr{0, []string{"t", "type"}}, ValueExpr{1}}}}, expr)
+
+	_, _, err = NewFilterExpressionParserWithOptions("META(x).id = 1", options)
+	assert.NotNil(err)
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+// Filters compiled from expression strings can be kept for reuse, for
+// services which are given the same filter expressions over and over, such as
+// XDCR creating a matcher for each replication.  The cache is off by default.
+
+const filterCacheKind = "filter"
+
+var sharedFilterCache = newCompileCache(0)
+
+// SetFilterCacheSize sets the number of compiled filter expressions kept for
+// reuse by GetFilterExpressionMatcher and GetFilterExpressionMatchDef, a size
+// of 0, which is the default, disables the cache
+func SetFilterCacheSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	sharedFilterCache.resize(size)
+}
+
+// GetFilterExpressionMatchDef parses and transforms a filter expression into
+// a match definition, which any number of matchers can be created from with
+// NewFastMatcher.  The definition may be shared with other callers, and must
+// not be changed.
+func GetFilterExpressionMatchDef(expression string) (*MatchDef, error) {
+	value, err := sharedFilterCache.get(compileCacheKey{filterCacheKind, expression}, func() (interface{}, error) {
+		return compileFilterExpression(expression)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*MatchDef), nil
+}
+
+func compileFilterExpression(expression string) (*MatchDef, error) {
+	expr, err := ParseFilterExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	var trans Transformer
+	matchDef := trans.Transform([]Expression{expr})
+	// Compiled up front, so matchers created from a cached definition only
+	// ever read it
+	matchDef.compilePrograms()
+	return matchDef, nil
+}
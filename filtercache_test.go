@@ -0,0 +1,62 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterCache(t *testing.T) {
+	assert := assert.New(t)
+	defer SetFilterCacheSize(0)
+
+	// Off by default
+	first, err := GetFilterExpressionMatchDef(`cached = 1`)
+	assert.Nil(err)
+	second, err := GetFilterExpressionMatchDef(`cached = 1`)
+	assert.Nil(err)
+	assert.False(first == second)
+
+	SetFilterCacheSize(2)
+	first, err = GetFilterExpressionMatchDef(`cached = 1`)
+	assert.Nil(err)
+	second, err = GetFilterExpressionMatchDef(`cached = 1`)
+	assert.Nil(err)
+	assert.True(first == second)
+
+	_, err = GetFilterExpressionMatchDef(`cached = `)
+	assert.NotNil(err)
+	_, err = GetFilterExpressionMatcher(`cached = `)
+	assert.NotNil(err)
+
+	GetFilterExpressionMatchDef(`cached = 2`)
+	GetFilterExpressionMatchDef(`cached = 3`)
+	third, err := GetFilterExpressionMatchDef(`cached = 1`)
+	assert.Nil(err)
+	assert.False(first == third)
+
+	// Matchers created from the same definition can run at once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			matcher, err := GetFilterExpressionMatcher(`cached = 1 AND REGEXP_CONTAINS(name, "^N")`)
+			assert.Nil(err)
+			for j := 0; j < 100; j++ {
+				matcher.Reset()
+				matched, err := matcher.Match([]byte(`{"cached":1,"name":"Neil"}`))
+				assert.Nil(err)
+				assert.True(matched)
+				matcher.Reset()
+				matched, err = matcher.Match([]byte(`{"cached":2,"name":"Neil"}`))
+				assert.Nil(err)
+				assert.False(matched)
+			}
+		}()
+	}
+	wg.Wait()
+}
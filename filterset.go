@@ -0,0 +1,304 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// Bitmask holds one bit per expression of a FilterSet, set when the
+// expression matched the document
+type Bitmask []uint64
+
+func (mask Bitmask) set(i int) {
+	mask[i/64] |= 1 << uint(i%64)
+}
+
+// IsSet returns whether the bit for the expression at index i is set
+func (mask Bitmask) IsSet(i int) bool {
+	if i < 0 || i/64 >= len(mask) {
+		return false
+	}
+	return mask[i/64]&(1<<uint(i%64)) != 0
+}
+
+// Count returns the number of bits which are set
+func (mask Bitmask) Count() int {
+	count := 0
+	for _, word := range mask {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
+
+// filterSetShardSize is the most filters which are compiled together,
+// bounding the cost of recompiling a shard when one of its filters is added
+// or removed
+const filterSetShardSize = 64
+
+// filterSetShard is a group of the filters of a FilterSet which are compiled
+// into a single definition
+type filterSetShard struct {
+	ids     []int
+	exprs   []Expression
+	def     *MatchDef
+	matcher *FastMatcher
+}
+
+func (shard *filterSetShard) compile() {
+	var trans Transformer
+	shard.def = trans.Transform(shard.exprs)
+	shard.matcher = NewFastMatcher(shard.def)
+}
+
+// FilterSet matches documents against many expressions at once.  The
+// expressions are compiled into a single definition, so each document is
+// only scanned once, and clauses used by several of the expressions, such
+// as `type = "order"`, are only evaluated once per document.
+//
+// Filters can be added and removed afterwards, which only recompiles the
+// shard of filters they belong to rather than the whole set.  Each filter is
+// identified by the index of its bit in the result of MatchSet, and the
+// indexes of removed filters are reused so the bitmask stays compact.
+type FilterSet struct {
+	shards []*filterSetShard
+	// The shard holding each filter, indexed by its ID
+	shardOf []*filterSetShard
+	freeIDs []int
+	mask    Bitmask
+	stats   *MatchStats
+}
+
+// NewFilterSet compiles a list of expressions into a FilterSet, where the
+// ID of each expression is its index in the list
+func NewFilterSet(exprs []Expression) *FilterSet {
+	set := &FilterSet{shardOf: make([]*filterSetShard, len(exprs))}
+	ids := make([]int, len(exprs))
+	for i := range exprs {
+		ids[i] = i
+	}
+	set.shards = set.compileShards(ids, exprs)
+	return set
+}
+
+// compileShards compiles filters into shards of at most filterSetShardSize
+// of them, recording the shard of each
+func (set *FilterSet) compileShards(ids []int, exprs []Expression) []*filterSetShard {
+	var shards []*filterSetShard
+	for start := 0; start < len(exprs); start += filterSetShardSize {
+		end := start + filterSetShardSize
+		if end > len(exprs) {
+			end = len(exprs)
+		}
+
+		shard := &filterSetShard{
+			ids:   append([]int(nil), ids[start:end]...),
+			exprs: append([]Expression(nil), exprs[start:end]...),
+		}
+		shard.compile()
+		for _, id := range shard.ids {
+			set.shardOf[id] = shard
+		}
+		shards = append(shards, shard)
+	}
+	return shards
+}
+
+// NewFilterSetFromStrings parses a list of filter expressions and compiles
+// them into a FilterSet
+func NewFilterSetFromStrings(expressions []string) (*FilterSet, error) {
+	exprs := make([]Expression, len(expressions))
+	for i, expression := range expressions {
+		expr, err := ParseFilterExpression(expression)
+		if err != nil {
+			return nil, err
+		}
+		exprs[i] = expr
+	}
+	return NewFilterSet(exprs), nil
+}
+
+// Len returns the number of expressions in the set
+func (set *FilterSet) Len() int {
+	return len(set.shardOf) - len(set.freeIDs)
+}
+
+// Add compiles an expression into the set and returns its ID, reusing the
+// lowest ID of a removed filter when there is one
+func (set *FilterSet) Add(expr Expression) int {
+	var id int
+	if len(set.freeIDs) > 0 {
+		id = set.freeIDs[0]
+		set.freeIDs = set.freeIDs[1:]
+	} else {
+		id = len(set.shardOf)
+		set.shardOf = append(set.shardOf, nil)
+	}
+
+	var shard *filterSetShard
+	if len(set.shards) > 0 && len(set.shards[len(set.shards)-1].exprs) < filterSetShardSize {
+		shard = set.shards[len(set.shards)-1]
+	} else {
+		shard = &filterSetShard{}
+		set.shards = append(set.shards, shard)
+	}
+
+	shard.ids = append(shard.ids, id)
+	shard.exprs = append(shard.exprs, expr)
+	shard.compile()
+	set.shardOf[id] = shard
+	return id
+}
+
+// AddString parses a filter expression and adds it to the set
+func (set *FilterSet) AddString(expression string) (int, error) {
+	expr, err := ParseFilterExpression(expression)
+	if err != nil {
+		return 0, err
+	}
+	return set.Add(expr), nil
+}
+
+// Remove removes the filter with an ID from the set
+func (set *FilterSet) Remove(id int) error {
+	if id < 0 || id >= len(set.shardOf) || set.shardOf[id] == nil {
+		return ErrorFilterSetID
+	}
+
+	shard := set.shardOf[id]
+	for i, shardID := range shard.ids {
+		if shardID == id {
+			shard.ids = append(shard.ids[:i], shard.ids[i+1:]...)
+			shard.exprs = append(shard.exprs[:i], shard.exprs[i+1:]...)
+			break
+		}
+	}
+	set.shardOf[id] = nil
+	if set.stats != nil {
+		set.stats.resetFilter(id)
+	}
+
+	if len(shard.exprs) > 0 {
+		shard.compile()
+	} else {
+		for i, other := range set.shards {
+			if other == shard {
+				set.shards = append(set.shards[:i], set.shards[i+1:]...)
+				break
+			}
+		}
+	}
+
+	// Trailing IDs are dropped rather than kept for reuse, so that the
+	// bitmask shrinks along with the set
+	set.freeIDs = append(set.freeIDs, id)
+	for len(set.shardOf) > 0 && set.shardOf[len(set.shardOf)-1] == nil {
+		set.shardOf = set.shardOf[:len(set.shardOf)-1]
+	}
+	freeIDs := set.freeIDs[:0]
+	for _, freeID := range set.freeIDs {
+		if freeID < len(set.shardOf) {
+			freeIDs = append(freeIDs, freeID)
+		}
+	}
+	set.freeIDs = freeIDs
+	sort.Ints(set.freeIDs)
+	return nil
+}
+
+// Compact recompiles the filters of the set into as few shards as they fit
+// in, so that clauses are shared across more of them again after many
+// filters have been removed
+func (set *FilterSet) Compact() {
+	if len(set.shards) <= 1 {
+		return
+	}
+
+	var ids []int
+	var exprs []Expression
+	for _, shard := range set.shards {
+		ids = append(ids, shard.ids...)
+		exprs = append(exprs, shard.exprs...)
+	}
+	set.shards = set.compileShards(ids, exprs)
+}
+
+// SetStats starts recording statistics about the documents matched by the
+// set into a collector, or stops recording them when it is nil
+func (set *FilterSet) SetStats(stats *MatchStats) {
+	set.stats = stats
+}
+
+// MatchSet matches a document against every expression of the set, and
+// returns a bitmask where the bit of each expression's ID is set if it
+// matched.  The bitmask is only valid until the next document is matched.
+func (set *FilterSet) MatchSet(doc []byte) (Bitmask, error) {
+	if set.stats == nil {
+		_, err := set.matchSet(doc)
+		if err != nil {
+			return nil, err
+		}
+		return set.mask, nil
+	}
+
+	start := time.Now()
+	scanned, err := set.matchSet(doc)
+	latency := time.Since(start)
+
+	docBytes := len(bytes.TrimRight(doc, " \t\r\n"))
+	if scanned > docBytes {
+		scanned = docBytes
+	}
+	set.stats.recordDoc(len(set.shardOf), set.mask, latency, scanned, docBytes, err)
+	if err != nil {
+		return nil, err
+	}
+	return set.mask, nil
+}
+
+// matchSet fills in the bitmask for a document, returning how far into the
+// document the shards read before they were decided
+func (set *FilterSet) matchSet(doc []byte) (int, error) {
+	numWords := (len(set.shardOf) + 63) / 64
+	if cap(set.mask) < numWords {
+		set.mask = make(Bitmask, numWords)
+	}
+	set.mask = set.mask[:numWords]
+	for i := range set.mask {
+		set.mask[i] = 0
+	}
+
+	scanned := 0
+	for _, shard := range set.shards {
+		// Shards of only TRUE and FALSE filters have nothing to match
+		if shard.def.ParseNode != nil {
+			shard.matcher.Reset()
+			_, err := shard.matcher.Match(doc)
+			if pos := shard.matcher.tokens.Position(); pos > scanned {
+				scanned = pos
+			}
+			if err != nil {
+				return scanned, err
+			}
+		}
+
+		for i, bucket := range shard.def.MatchBuckets {
+			var matched bool
+			switch bucket {
+			case AlwaysTrueIdent:
+				matched = true
+			case AlwaysFalseIdent:
+				matched = false
+			default:
+				matched = shard.matcher.ExpressionMatched(i)
+			}
+			if matched {
+				set.mask.set(shard.ids[i])
+			}
+		}
+	}
+	return scanned, nil
+}
@@ -0,0 +1,243 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterSetMatchSet(t *testing.T) {
+	assert := assert.New(t)
+
+	set, err := NewFilterSetFromStrings([]string{
+		`type = "order" AND total > 100`,
+		`type = "order" AND total <= 100`,
+		`type = "refund"`,
+		`type = "order" OR EXISTS(note)`,
+	})
+	assert.Nil(err)
+	assert.Equal(4, set.Len())
+
+	mask, err := set.MatchSet([]byte(`{"type":"order","total":150}`))
+	assert.Nil(err)
+	assert.True(mask.IsSet(0))
+	assert.False(mask.IsSet(1))
+	assert.False(mask.IsSet(2))
+	assert.True(mask.IsSet(3))
+	assert.Equal(2, mask.Count())
+
+	mask, err = set.MatchSet([]byte(`{"type":"refund","note":"late"}`))
+	assert.Nil(err)
+	assert.False(mask.IsSet(0))
+	assert.False(mask.IsSet(1))
+	assert.True(mask.IsSet(2))
+	assert.True(mask.IsSet(3))
+	assert.Equal(2, mask.Count())
+
+	mask, err = set.MatchSet([]byte(`{"total":50}`))
+	assert.Nil(err)
+	assert.Equal(0, mask.Count())
+	assert.False(mask.IsSet(64))
+
+	_, err = NewFilterSetFromStrings([]string{`type = "order"`, `type = `})
+	assert.NotNil(err)
+}
+
+func TestFilterSetManyExpressions(t *testing.T) {
+	assert := assert.New(t)
+
+	var exprs []Expression
+	for i := 0; i < 100; i++ {
+		exprs = append(exprs, AndExpr{
+			EqualsExpr{FieldExpr{Root: 0, Path: []string{"type"}}, ValueExpr{"order"}},
+			GreaterEqualsExpr{FieldExpr{Root: 0, Path: []string{"total"}}, ValueExpr{i}},
+		})
+	}
+	set := NewFilterSet(exprs)
+
+	mask, err := set.MatchSet([]byte(`{"type":"order","total":70}`))
+	assert.Nil(err)
+	assert.Equal(71, mask.Count())
+	assert.True(mask.IsSet(70))
+	assert.False(mask.IsSet(71))
+	assert.True(mask.IsSet(0))
+	assert.False(mask.IsSet(99))
+
+	// The clause on type is shared by every expression of a shard, so it is
+	// only evaluated once per shard rather than once per expression
+	assert.Equal(2, len(set.shards))
+	prog := set.shards[0].def.ParseNode.Elems["type"].program.String()
+	assert.Equal(1, strings.Count(prog, "eq @?"))
+	assert.Equal(filterSetShardSize, strings.Count(prog, "result ["))
+}
+
+func TestMatchProgramSharedOps(t *testing.T) {
+	assert := assert.New(t)
+
+	name := FieldExpr{Root: 0, Path: []string{"name"}}
+	age := FieldExpr{Root: 0, Path: []string{"age"}}
+	var trans Transformer
+	def := trans.Transform([]Expression{
+		EqualsExpr{name, ValueExpr{"Neil"}},
+		OrExpr{EqualsExpr{name, ValueExpr{"Neil"}}, GreaterThanExpr{age, ValueExpr{40}}},
+	})
+
+	assert.Equal(`0: run [1] -> 2
+1: skip [3] -> 6
+2: eq @? (jsonString)"Neil" [-1]
+3: result [1]
+4: result [3]
+5: exit resolved`, def.ParseNode.Elems["name"].program.String())
+
+	m := NewFastMatcher(def)
+	matched, err := m.Match([]byte(`{"name":"Neil"}`))
+	assert.Nil(err)
+	assert.True(matched)
+	assert.True(m.ExpressionMatched(0))
+	assert.True(m.ExpressionMatched(1))
+
+	m.Reset()
+	matched, err = m.Match([]byte(`{"name":"Brett"}`))
+	assert.Nil(err)
+	assert.False(matched)
+}
+
+func TestFilterSetSharedExpressions(t *testing.T) {
+	assert := assert.New(t)
+
+	set, err := NewFilterSetFromStrings([]string{
+		`type = "order" AND total > 100`,
+		`status = "open"`,
+		`type = "order" AND total > 100`,
+	})
+	assert.Nil(err)
+
+	single, err := NewFilterSetFromStrings([]string{
+		`type = "order" AND total > 100`,
+		`status = "open"`,
+	})
+	assert.Nil(err)
+
+	// The repeated expression shares the bucket of the first one
+	assert.Equal(set.shards[0].def.MatchBuckets[0], set.shards[0].def.MatchBuckets[2])
+	assert.NotEqual(set.shards[0].def.MatchBuckets[0], set.shards[0].def.MatchBuckets[1])
+	assert.Equal(single.shards[0].def.NumBuckets, set.shards[0].def.NumBuckets)
+
+	mask, err := set.MatchSet([]byte(`{"type":"order","total":150,"status":"closed"}`))
+	assert.Nil(err)
+	assert.True(mask.IsSet(0))
+	assert.False(mask.IsSet(1))
+	assert.True(mask.IsSet(2))
+
+	mask, err = set.MatchSet([]byte(`{"type":"order","total":50,"status":"open"}`))
+	assert.Nil(err)
+	assert.False(mask.IsSet(0))
+	assert.True(mask.IsSet(1))
+	assert.False(mask.IsSet(2))
+}
+
+func TestFilterSetAddRemove(t *testing.T) {
+	assert := assert.New(t)
+
+	set, err := NewFilterSetFromStrings([]string{`type = "order"`, `type = "refund"`})
+	assert.Nil(err)
+
+	id, err := set.AddString(`total > 100`)
+	assert.Nil(err)
+	assert.Equal(2, id)
+	assert.Equal(3, set.Len())
+	assert.Equal(1, len(set.shards))
+
+	_, err = set.AddString(`total >`)
+	assert.NotNil(err)
+
+	doc := []byte(`{"type":"order","total":150}`)
+	mask, err := set.MatchSet(doc)
+	assert.Nil(err)
+	assert.True(mask.IsSet(0))
+	assert.False(mask.IsSet(1))
+	assert.True(mask.IsSet(2))
+
+	// Removing a filter frees its ID for the next one added
+	assert.Nil(set.Remove(0))
+	assert.Equal(ErrorFilterSetID, set.Remove(0))
+	assert.Equal(ErrorFilterSetID, set.Remove(7))
+	assert.Equal(2, set.Len())
+
+	mask, err = set.MatchSet(doc)
+	assert.Nil(err)
+	assert.False(mask.IsSet(0))
+	assert.True(mask.IsSet(2))
+
+	assert.Equal(0, set.Add(TrueExpr{}))
+	mask, err = set.MatchSet([]byte(`{"type":"refund"}`))
+	assert.Nil(err)
+	assert.True(mask.IsSet(0))
+	assert.True(mask.IsSet(1))
+	assert.False(mask.IsSet(2))
+
+	// Removing the last filters shrinks the bitmask
+	assert.Nil(set.Remove(2))
+	assert.Equal(1, len(set.shards))
+	assert.Nil(set.Remove(1))
+	mask, err = set.MatchSet(doc)
+	assert.Nil(err)
+	assert.Equal(1, len(mask))
+	assert.Equal(1, set.Len())
+	assert.Equal(1, set.Add(FalseExpr{}))
+}
+
+func TestFilterSetCompact(t *testing.T) {
+	assert := assert.New(t)
+
+	set := NewFilterSet(nil)
+	for i := 0; i < 2*filterSetShardSize+1; i++ {
+		assert.Equal(i, set.Add(GreaterEqualsExpr{FieldExpr{Root: 0, Path: []string{"total"}}, ValueExpr{i}}))
+	}
+	assert.Equal(3, len(set.shards))
+	assert.Nil(set.Remove(10))
+
+	set.Compact()
+	assert.Equal(2, len(set.shards))
+	assert.Equal(2*filterSetShardSize, set.Len())
+
+	mask, err := set.MatchSet([]byte(`{"total":100}`))
+	assert.Nil(err)
+	assert.Equal(100, mask.Count())
+	assert.True(mask.IsSet(100))
+	assert.False(mask.IsSet(10))
+	assert.False(mask.IsSet(101))
+}
+
+func TestFilterSetShardedRemove(t *testing.T) {
+	assert := assert.New(t)
+
+	var exprs []Expression
+	for i := 0; i < 150; i++ {
+		exprs = append(exprs, GreaterEqualsExpr{FieldExpr{Root: 0, Path: []string{"total"}}, ValueExpr{i}})
+	}
+	set := NewFilterSet(exprs)
+	assert.Equal(3, len(set.shards))
+	for _, shard := range set.shards {
+		assert.True(len(shard.ids) <= filterSetShardSize)
+	}
+
+	// Removing a filter only recompiles the shard which held it
+	defs := make([]*MatchDef, len(set.shards))
+	for i, shard := range set.shards {
+		defs[i] = shard.def
+	}
+	assert.Nil(set.Remove(70))
+	assert.True(defs[0] == set.shards[0].def)
+	assert.True(defs[1] != set.shards[1].def)
+	assert.True(defs[2] == set.shards[2].def)
+
+	mask, err := set.MatchSet([]byte(`{"total":100}`))
+	assert.Nil(err)
+	assert.Equal(100, mask.Count())
+	assert.False(mask.IsSet(70))
+	assert.True(mask.IsSet(100))
+}
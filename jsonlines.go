@@ -0,0 +1,70 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// JSONLinesMatch is a record of JSON Lines input which matched
+type JSONLinesMatch struct {
+	// Where the record starts in the input, and its length, which leave out
+	// the whitespace around it and its line ending
+	Offset int64
+	Length int
+	// The line holding the record, counting from 1
+	Line int
+}
+
+// MatchJSONLines matches each record of JSON Lines input, which holds one
+// JSON document per line, calling fn for each record which matched with
+// where it is in the input and its contents, so that matches can be sliced
+// out of large files without reading them again.  The contents are only
+// valid until fn returns.  Blank lines are skipped, and lines ending in
+// "\r\n" are accepted.  Matching stops at the first error, either from
+// reading the input, matching a record, which is given as a JSONLinesError,
+// or returned by fn.
+func (m *FastMatcher) MatchJSONLines(input io.Reader, fn func(match JSONLinesMatch, record []byte) error) error {
+	reader := bufio.NewReader(input)
+	var line []byte
+	var offset int64
+
+	for lineNum := 1; ; lineNum++ {
+		var err error
+		line = line[:0]
+		for {
+			var chunk []byte
+			chunk, err = reader.ReadSlice('\n')
+			line = append(line, chunk...)
+			if err != bufio.ErrBufferFull {
+				break
+			}
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		trimmed := bytes.TrimLeft(line, " \t\r\n")
+		start := offset + int64(len(line)-len(trimmed))
+		record := bytes.TrimRight(trimmed, " \t\r\n")
+		if len(record) > 0 {
+			m.Reset()
+			matched, matchErr := m.Match(record)
+			if matchErr != nil {
+				return &JSONLinesError{Line: lineNum, Offset: start, Err: matchErr}
+			}
+			if matched {
+				if err := fn(JSONLinesMatch{start, len(record), lineNum}, record); err != nil {
+					return err
+				}
+			}
+		}
+
+		offset += int64(len(line))
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
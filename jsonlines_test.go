@@ -0,0 +1,60 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchJSONLines(t *testing.T) {
+	assert := assert.New(t)
+
+	matcher, err := GetFilterExpressionMatcher(`level = "error"`)
+	assert.Nil(err)
+	m := matcher.(*FastMatcher)
+
+	long := strings.Repeat("x", bufio.MaxScanTokenSize)
+	input := "{\"level\":\"info\"}\n" +
+		"  {\"level\":\"error\",\"msg\":\"a\"}  \r\n" +
+		"\n" +
+		"{\"level\":\"error\",\"msg\":\"" + long + "\"}\n" +
+		"{\"level\":\"error\"}"
+
+	var matches []JSONLinesMatch
+	err = m.MatchJSONLines(strings.NewReader(input), func(match JSONLinesMatch, record []byte) error {
+		matches = append(matches, match)
+		assert.Equal(input[match.Offset:match.Offset+int64(match.Length)], string(record))
+		return nil
+	})
+	assert.Nil(err)
+	if assert.Equal(3, len(matches)) {
+		assert.Equal(JSONLinesMatch{Offset: 19, Length: 27, Line: 2}, matches[0])
+		assert.Equal(4, matches[1].Line)
+		assert.Equal(len(long)+26, matches[1].Length)
+		assert.Equal(JSONLinesMatch{Offset: int64(len(input) - 17), Length: 17, Line: 5}, matches[2])
+	}
+
+	// Errors from fn stop matching
+	stop := errors.New("stop")
+	count := 0
+	err = m.MatchJSONLines(strings.NewReader(input), func(JSONLinesMatch, []byte) error {
+		count++
+		return stop
+	})
+	assert.Equal(stop, err)
+	assert.Equal(1, count)
+
+	err = m.MatchJSONLines(strings.NewReader("{\"level\":\"info\"}\n{\"level\":x}\n"), func(JSONLinesMatch, []byte) error {
+		return nil
+	})
+	var linesErr *JSONLinesError
+	if assert.True(errors.As(err, &linesErr)) {
+		assert.Equal(2, linesErr.Line)
+		assert.Equal(int64(17), linesErr.Offset)
+	}
+}
@@ -0,0 +1,514 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A JSONPath is converted into an expression which matches a document when
+// the path selects at least one value from it.  Filters such as
+// `$.store.book[?(@.price < 10)]` become any-in loops over the filtered
+// array, with `@` referring to the loop variable.
+
+// jsonPathFilter is a single `[?(...)]` or `[*]` step of a path
+type jsonPathFilter struct {
+	varID  VariableID
+	inExpr FieldExpr
+	pred   Expression
+}
+
+// jsonPathSelection is the parsed form of a path, the filters it goes through
+// followed by the plain path that remains after the last of them.  A filter
+// placed directly on the root, `$[?(...)]`, tests the document itself.
+type jsonPathSelection struct {
+	rootPred Expression
+	filters  []jsonPathFilter
+	tail     FieldExpr
+}
+
+func (sel *jsonPathSelection) hasFilters() bool {
+	return len(sel.filters) > 0
+}
+
+// Returns an expression which is true when the selection is non-empty
+func (sel *jsonPathSelection) existsExpr() Expression {
+	var subExpr Expression
+	if !sel.hasFilters() || len(sel.tail.Path) > 0 {
+		if sel.tail.Root == 0 && len(sel.tail.Path) == 0 {
+			subExpr = TrueExpr{}
+		} else {
+			subExpr = ExistsExpr{sel.tail}
+		}
+	}
+
+	for i := len(sel.filters) - 1; i >= 0; i-- {
+		filter := sel.filters[i]
+
+		body := filter.pred
+		if body == nil {
+			body = subExpr
+		} else if subExpr != nil {
+			body = AndExpr{body, subExpr}
+		}
+		if body == nil {
+			body = ExistsExpr{FieldExpr{filter.varID, nil}}
+		}
+
+		subExpr = AnyInExpr{filter.varID, filter.inExpr, body}
+	}
+
+	if sel.rootPred != nil {
+		if _, ok := subExpr.(TrueExpr); ok {
+			return sel.rootPred
+		}
+		return AndExpr{sel.rootPred, subExpr}
+	}
+	return subExpr
+}
+
+type jsonPathParser struct {
+	input   string
+	pos     int
+	nextVar VariableID
+}
+
+func (p *jsonPathParser) errorf(format string, args ...interface{}) error {
+	return &FilterExpressionError{
+		Kind:   ErrSyntax,
+		Line:   1,
+		Column: p.pos + 1,
+		Msg:    fmt.Sprintf(format, args...),
+		Offset: p.pos,
+	}
+}
+
+func (p *jsonPathParser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *jsonPathParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *jsonPathParser) skipSpaces() {
+	for !p.eof() && strings.IndexByte(" \t\r\n", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *jsonPathParser) consume(token string) bool {
+	if strings.HasPrefix(p.input[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *jsonPathParser) expect(token string) error {
+	p.skipSpaces()
+	if !p.consume(token) {
+		return p.errorf("expected %q", token)
+	}
+	return nil
+}
+
+func isJsonPathNameChar(c byte) bool {
+	return c == '_' || c == '-' || c == '$' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+func (p *jsonPathParser) parseName() (string, error) {
+	start := p.pos
+	for !p.eof() && isJsonPathNameChar(p.input[p.pos]) {
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf("expected a member name")
+	}
+	return p.input[start:p.pos], nil
+}
+
+func (p *jsonPathParser) parseQuoted() (string, error) {
+	quote := p.peek()
+	if quote != '\'' && quote != '"' {
+		return "", p.errorf("expected a quoted string")
+	}
+	p.pos++
+
+	var out strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.input[p.pos]
+		p.pos++
+
+		if c == quote {
+			return out.String(), nil
+		}
+		if c != '\\' {
+			out.WriteByte(c)
+			continue
+		}
+
+		if p.eof() {
+			return "", p.errorf("unterminated string")
+		}
+		escaped := p.input[p.pos]
+		p.pos++
+		switch escaped {
+		case '\\', '\'', '"', '/':
+			out.WriteByte(escaped)
+		case 'n':
+			out.WriteByte('\n')
+		case 't':
+			out.WriteByte('\t')
+		case 'r':
+			out.WriteByte('\r')
+		default:
+			return "", p.errorf("invalid escape sequence \\%c", escaped)
+		}
+	}
+}
+
+func (p *jsonPathParser) parseIndex() (string, error) {
+	start := p.pos
+	for !p.eof() && p.input[p.pos] >= '0' && p.input[p.pos] <= '9' {
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf("expected an array index")
+	}
+	return fmt.Sprintf("[%s]", p.input[start:p.pos]), nil
+}
+
+// parseSegments reads the path steps following `$` or `@`, stopping at the
+// first character that cannot continue a path.
+func (p *jsonPathParser) parseSegments(root VariableID) (*jsonPathSelection, error) {
+	sel := &jsonPathSelection{tail: FieldExpr{root, nil}}
+
+	for !p.eof() {
+		switch {
+		case p.consume(".."):
+			return nil, p.errorf("recursive descent is not supported")
+		case p.consume(".*"):
+			sel.addFilter(p, nil)
+		case p.consume("."):
+			name, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			sel.tail.Path = append(sel.tail.Path, name)
+		case p.consume("["):
+			p.skipSpaces()
+			switch c := p.peek(); {
+			case c == '?':
+				p.pos++
+				if err := p.expect("("); err != nil {
+					return nil, err
+				}
+				isRoot := root == 0 && !sel.hasFilters() && sel.rootPred == nil && len(sel.tail.Path) == 0
+				varID := VariableID(0)
+				if !isRoot {
+					varID = p.allocVar()
+				}
+				pred, err := p.parseOr(varID)
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(")"); err != nil {
+					return nil, err
+				}
+				if isRoot {
+					sel.rootPred = pred
+				} else {
+					sel.addFilterWithVar(varID, pred)
+				}
+			case c == '*':
+				p.pos++
+				sel.addFilter(p, nil)
+			case c == '\'' || c == '"':
+				name, err := p.parseQuoted()
+				if err != nil {
+					return nil, err
+				}
+				sel.tail.Path = append(sel.tail.Path, name)
+			case c >= '0' && c <= '9':
+				index, err := p.parseIndex()
+				if err != nil {
+					return nil, err
+				}
+				sel.tail.Path = append(sel.tail.Path, index)
+			default:
+				return nil, p.errorf("unsupported subscript")
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+		default:
+			return sel, nil
+		}
+	}
+
+	return sel, nil
+}
+
+func (p *jsonPathParser) allocVar() VariableID {
+	p.nextVar++
+	return p.nextVar
+}
+
+func (sel *jsonPathSelection) addFilter(p *jsonPathParser, pred Expression) {
+	sel.addFilterWithVar(p.allocVar(), pred)
+}
+
+func (sel *jsonPathSelection) addFilterWithVar(varID VariableID, pred Expression) {
+	sel.filters = append(sel.filters, jsonPathFilter{varID, sel.tail, pred})
+	sel.tail = FieldExpr{varID, nil}
+}
+
+func (p *jsonPathParser) parseOr(current VariableID) (Expression, error) {
+	var exprs OrExpr
+	for {
+		expr, err := p.parseAnd(current)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+
+		p.skipSpaces()
+		if !p.consume("||") {
+			break
+		}
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (p *jsonPathParser) parseAnd(current VariableID) (Expression, error) {
+	var exprs AndExpr
+	for {
+		expr, err := p.parseUnary(current)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+
+		p.skipSpaces()
+		if !p.consume("&&") {
+			break
+		}
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (p *jsonPathParser) parseUnary(current VariableID) (Expression, error) {
+	p.skipSpaces()
+
+	if p.peek() == '!' && !strings.HasPrefix(p.input[p.pos:], "!=") {
+		p.pos++
+		subExpr, err := p.parseUnary(current)
+		if err != nil {
+			return nil, err
+		}
+		return NotExpr{subExpr}, nil
+	}
+
+	if p.consume("(") {
+		subExpr, err := p.parseOr(current)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return subExpr, nil
+	}
+
+	return p.parseComparison(current)
+}
+
+var jsonPathCompareOps []string = []string{"==", "!=", "<=", ">=", "<", ">", "=~"}
+
+func (p *jsonPathParser) parseComparison(current VariableID) (Expression, error) {
+	lhs, lhsSel, err := p.parseOperand(current)
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	var op string
+	for _, candidate := range jsonPathCompareOps {
+		if p.consume(candidate) {
+			op = candidate
+			break
+		}
+	}
+
+	// A lone path tests for existence
+	if op == "" {
+		if lhsSel == nil {
+			return nil, p.errorf("expected a comparison operator")
+		}
+		return lhsSel.existsExpr(), nil
+	}
+	if lhsSel != nil && lhsSel.hasFilters() {
+		return nil, p.errorf("filtered paths cannot be compared")
+	}
+
+	if op == "=~" {
+		p.skipSpaces()
+		regex, err := p.parseRegex()
+		if err != nil {
+			return nil, err
+		}
+		return LikeExpr{lhs, RegexExpr{regex}}, nil
+	}
+
+	rhs, rhsSel, err := p.parseOperand(current)
+	if err != nil {
+		return nil, err
+	}
+	if rhsSel != nil && rhsSel.hasFilters() {
+		return nil, p.errorf("filtered paths cannot be compared")
+	}
+
+	switch op {
+	case "==":
+		return EqualsExpr{lhs, rhs}, nil
+	case "!=":
+		return NotEqualsExpr{lhs, rhs}, nil
+	case "<":
+		return LessThanExpr{lhs, rhs}, nil
+	case "<=":
+		return LessEqualsExpr{lhs, rhs}, nil
+	case ">":
+		return GreaterThanExpr{lhs, rhs}, nil
+	default:
+		return GreaterEqualsExpr{lhs, rhs}, nil
+	}
+}
+
+// parseOperand returns the operand, along with its selection if it was a path
+func (p *jsonPathParser) parseOperand(current VariableID) (Expression, *jsonPathSelection, error) {
+	p.skipSpaces()
+
+	switch c := p.peek(); {
+	case c == '@' || c == '$':
+		p.pos++
+		root := current
+		if c == '$' {
+			root = 0
+		}
+		sel, err := p.parseSegments(root)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sel.tail, sel, nil
+	case c == '\'' || c == '"':
+		str, err := p.parseQuoted()
+		if err != nil {
+			return nil, nil, err
+		}
+		return ValueExpr{str}, nil, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		p.pos++
+		for !p.eof() && strings.IndexByte("0123456789.eE+-", p.input[p.pos]) >= 0 {
+			p.pos++
+		}
+		numStr := p.input[start:p.pos]
+		if intVal, err := strconv.ParseInt(numStr, 10, 64); err == nil {
+			return ValueExpr{int(intVal)}, nil, nil
+		}
+		floatVal, err := strconv.ParseFloat(numStr, 64)
+		if err != nil {
+			p.pos = start
+			return nil, nil, p.errorf("invalid number %q", numStr)
+		}
+		return ValueExpr{floatVal}, nil, nil
+	case p.consume("true"):
+		return ValueExpr{true}, nil, nil
+	case p.consume("false"):
+		return ValueExpr{false}, nil, nil
+	case p.consume("null"):
+		return ValueExpr{nil}, nil, nil
+	}
+
+	return nil, nil, p.errorf("expected a path or literal")
+}
+
+func (p *jsonPathParser) parseRegex() (string, error) {
+	if !p.consume("/") {
+		return "", p.errorf("expected a regular expression")
+	}
+
+	var out strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated regular expression")
+		}
+		c := p.input[p.pos]
+		p.pos++
+		if c == '/' {
+			break
+		}
+		if c == '\\' && p.peek() == '/' {
+			c = '/'
+			p.pos++
+		}
+		out.WriteByte(c)
+	}
+
+	regex := out.String()
+	if p.consume("i") {
+		regex = "(?i)" + regex
+	}
+	return regex, nil
+}
+
+// ParseJsonPathExpression converts a JSONPath into an expression that
+// matches documents for which the path selects at least one value.
+func ParseJsonPathExpression(path string) (Expression, error) {
+	p := &jsonPathParser{input: strings.TrimSpace(path)}
+
+	if !p.consume("$") {
+		return nil, p.errorf("path must start with $")
+	}
+
+	sel, err := p.parseSegments(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+
+	return sel.existsExpr(), nil
+}
+
+func GetJsonPathMatcher(path string) (Matcher, error) {
+	expr, err := ParseJsonPathExpression(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var trans Transformer
+	matchDef := trans.Transform([]Expression{expr})
+
+	matcher := NewFastMatcher(matchDef)
+	return matcher, nil
+}
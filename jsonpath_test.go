@@ -0,0 +1,83 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func runJsonPathMatchTest(t *testing.T, path string, expectedDocIDs []string) {
+	expr, err := ParseJsonPathExpression(path)
+	if err != nil {
+		t.Fatalf("Failed to parse %v: %v", path, err)
+	}
+
+	runExprMatchTest(t, expr, expectedDocIDs)
+}
+
+func TestJsonPathExpression(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseJsonPathExpression("$.store.book[?(@.price < 10)]")
+	assert.Nil(err)
+	assert.Equal(AnyInExpr{
+		1,
+		FieldExpr{0, []string{"store", "book"}},
+		LessThanExpr{FieldExpr{1, []string{"price"}}, ValueExpr{10}},
+	}, expr)
+
+	expr, err = ParseJsonPathExpression("$['store'].book[0].title")
+	assert.Nil(err)
+	assert.Equal(ExistsExpr{FieldExpr{0, []string{"store", "book", "[0]", "title"}}}, expr)
+
+	expr, err = ParseJsonPathExpression("$.a[?(@.b && !(@.c == 'x' || @.d >= -1.5))].e")
+	assert.Nil(err)
+	assert.Equal(AnyInExpr{
+		1,
+		FieldExpr{0, []string{"a"}},
+		AndExpr{
+			AndExpr{
+				ExistsExpr{FieldExpr{1, []string{"b"}}},
+				NotExpr{OrExpr{
+					EqualsExpr{FieldExpr{1, []string{"c"}}, ValueExpr{"x"}},
+					GreaterEqualsExpr{FieldExpr{1, []string{"d"}}, ValueExpr{-1.5}},
+				}},
+			},
+			ExistsExpr{FieldExpr{1, []string{"e"}}},
+		},
+	}, expr)
+
+	_, err = ParseJsonPathExpression("$..book")
+	assert.NotNil(err)
+	_, err = ParseJsonPathExpression("store.book")
+	assert.NotNil(err)
+	_, err = ParseJsonPathExpression("$.a[?(@.b == )]")
+	assert.NotNil(err)
+}
+
+func TestJsonPathMatcher(t *testing.T) {
+	runJsonPathMatchTest(t, "$.tags[?(@ == 'cillum')]", []string{
+		"5b47eb0936ff92a567a0307e",
+		"5b47eb09ffac5a6ce37042e7",
+		"5b47eb095c3ad73b9925f7f8",
+	})
+
+	runJsonPathMatchTest(t, "$.friends[?(@.name == \"Melva Berry\")]", []string{
+		"5b47eb0936ff92a567a0307e",
+	})
+
+	runJsonPathMatchTest(t, "$.friends[?(@.id == $.index)]", []string{
+		"5b47eb0936ff92a567a0307e",
+		"5b47eb096b1d911c0b9492fb",
+		"5b47eb0950e9076fc0aecd52",
+	})
+
+	runJsonPathMatchTest(t, "$[?(@.age > 35 && @.isActive == true)]", []string{
+		"5b47eb098eee4b4c4330ec64",
+	})
+
+	runJsonPathMatchTest(t, "$.friends[?(@.id == 2 && @.name =~ /^o/i)]", []string{
+		"5b47eb0936ff92a567a0307e",
+	})
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+// The tokenizer spends most of its time walking over the contents of
+// strings and over whitespace one byte at a time.  These scanners find the
+// end of such runs instead, using AVX2 or NEON where the platform supports
+// it (see jsonscan_amd64.go and jsonscan_arm64.go).  Building with the
+// gojsonsm_noasm tag, or for other platforms, uses the portable versions.
+
+// Below this length the vector scanners cost more to call than they save
+const jsonScanMinLen = 16
+
+// jsonStringSpanGeneric returns the number of leading bytes which can be
+// part of a string without ending it or needing any special handling, which
+// is every byte other than a quote, a backslash or a control character
+func jsonStringSpanGeneric(data []byte) int {
+	for i, c := range data {
+		if c == '"' || c == '\\' || c < 0x20 {
+			return i
+		}
+	}
+	return len(data)
+}
+
+// jsonSpaceSpanGeneric returns the number of leading whitespace bytes, that
+// is the position of the next structural character or value
+func jsonSpaceSpanGeneric(data []byte) int {
+	for i, c := range data {
+		if !tokIsSpaceChar(c) {
+			return i
+		}
+	}
+	return len(data)
+}
+
+func jsonStringSpan(data []byte) int {
+	if jsonScanVectorized && len(data) >= jsonScanMinLen {
+		return jsonStringSpanVector(data)
+	}
+	return jsonStringSpanGeneric(data)
+}
+
+func jsonSpaceSpan(data []byte) int {
+	if jsonScanVectorized && len(data) >= jsonScanMinLen {
+		return jsonSpaceSpanVector(data)
+	}
+	return jsonSpaceSpanGeneric(data)
+}
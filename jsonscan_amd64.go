@@ -0,0 +1,48 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+// +build !tinygo,!gojsonsm_noasm
+
+package gojsonsm
+
+// Implemented in jsonscan_amd64.s
+func jsonCpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+func jsonXgetbv() (eax, edx uint32)
+
+//go:noescape
+func jsonStringSpanAVX2(data []byte) int
+
+//go:noescape
+func jsonSpaceSpanAVX2(data []byte) int
+
+var jsonScanVectorized = jsonHasAVX2()
+
+// jsonHasAVX2 checks that both the processor and the operating system
+// support AVX2, the latter by saving the YMM registers on context switches
+func jsonHasAVX2() bool {
+	maxID, _, _, _ := jsonCpuid(0, 0)
+	if maxID < 7 {
+		return false
+	}
+
+	_, _, ecx1, _ := jsonCpuid(1, 0)
+	const osxsave = 1 << 27
+	const avx = 1 << 28
+	if ecx1&osxsave == 0 || ecx1&avx == 0 {
+		return false
+	}
+	if xcr0, _ := jsonXgetbv(); xcr0&0x6 != 0x6 {
+		return false
+	}
+
+	_, ebx7, _, _ := jsonCpuid(7, 0)
+	const avx2 = 1 << 5
+	return ebx7&avx2 != 0
+}
+
+func jsonStringSpanVector(data []byte) int {
+	return jsonStringSpanAVX2(data)
+}
+
+func jsonSpaceSpanVector(data []byte) int {
+	return jsonSpaceSpanAVX2(data)
+}
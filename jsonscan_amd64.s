@@ -0,0 +1,156 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+// +build !tinygo,!gojsonsm_noasm
+
+#include "textflag.h"
+
+// func jsonCpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+TEXT ·jsonCpuid(SB), NOSPLIT, $0-24
+	MOVL eaxArg+0(FP), AX
+	MOVL ecxArg+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// func jsonXgetbv() (eax, edx uint32)
+TEXT ·jsonXgetbv(SB), NOSPLIT, $0-8
+	MOVL $0, CX
+	XGETBV
+	MOVL AX, eax+0(FP)
+	MOVL DX, edx+4(FP)
+	RET
+
+// func jsonStringSpanAVX2(data []byte) int
+TEXT ·jsonStringSpanAVX2(SB), NOSPLIT, $0-32
+	MOVQ data_base+0(FP), SI
+	MOVQ data_len+8(FP), CX
+	XORQ AX, AX
+
+	// The constants are moved with VEX encoded instructions, mixing in
+	// legacy SSE ones is very slow once the upper halves are in use
+	MOVL $0x22, DX
+	VMOVD DX, X1
+	VPBROADCASTB X1, Y1
+	MOVL $0x5c, DX
+	VMOVD DX, X2
+	VPBROADCASTB X2, Y2
+	MOVL $0x1f, DX
+	VMOVD DX, X3
+	VPBROADCASTB X3, Y3
+
+stringLoop:
+	MOVQ CX, DX
+	SUBQ AX, DX
+	CMPQ DX, $32
+	JB   stringTail
+
+	VMOVDQU  (SI)(AX*1), Y0
+	VPCMPEQB Y0, Y1, Y4
+	VPCMPEQB Y0, Y2, Y5
+	VPOR     Y4, Y5, Y4
+
+	// Control characters are those left unchanged by min(c, 0x1f)
+	VPMINUB  Y0, Y3, Y5
+	VPCMPEQB Y0, Y5, Y5
+	VPOR     Y4, Y5, Y4
+
+	VPMOVMSKB Y4, DX
+	TESTL     DX, DX
+	JNZ       stringFound
+	ADDQ      $32, AX
+	JMP       stringLoop
+
+stringFound:
+	BSFL DX, DX
+	ADDQ DX, AX
+	JMP  stringDone
+
+stringTail:
+	CMPQ    AX, CX
+	JAE     stringDone
+	MOVBLZX (SI)(AX*1), DX
+	CMPB    DL, $0x22
+	JEQ     stringDone
+	CMPB    DL, $0x5c
+	JEQ     stringDone
+	CMPB    DL, $0x20
+	JB      stringDone
+	INCQ    AX
+	JMP     stringTail
+
+stringDone:
+	VZEROUPPER
+	MOVQ AX, ret+24(FP)
+	RET
+
+// func jsonSpaceSpanAVX2(data []byte) int
+TEXT ·jsonSpaceSpanAVX2(SB), NOSPLIT, $0-32
+	MOVQ data_base+0(FP), SI
+	MOVQ data_len+8(FP), CX
+	XORQ AX, AX
+
+	MOVL $0x20, DX
+	VMOVD DX, X1
+	VPBROADCASTB X1, Y1
+	MOVL $0x09, DX
+	VMOVD DX, X2
+	VPBROADCASTB X2, Y2
+	MOVL $0x0d, DX
+	VMOVD DX, X3
+	VPBROADCASTB X3, Y3
+	MOVL $0x0a, DX
+	VMOVD DX, X4
+	VPBROADCASTB X4, Y4
+
+spaceLoop:
+	MOVQ CX, DX
+	SUBQ AX, DX
+	CMPQ DX, $32
+	JB   spaceTail
+
+	VMOVDQU  (SI)(AX*1), Y0
+	VPCMPEQB Y0, Y1, Y5
+	VPCMPEQB Y0, Y2, Y6
+	VPOR     Y5, Y6, Y5
+	VPCMPEQB Y0, Y3, Y6
+	VPOR     Y5, Y6, Y5
+	VPCMPEQB Y0, Y4, Y6
+	VPOR     Y5, Y6, Y5
+
+	// Look for the first byte which is not whitespace
+	VPMOVMSKB Y5, DX
+	NOTL      DX
+	TESTL     DX, DX
+	JNZ       spaceFound
+	ADDQ      $32, AX
+	JMP       spaceLoop
+
+spaceFound:
+	BSFL DX, DX
+	ADDQ DX, AX
+	JMP  spaceDone
+
+spaceTail:
+	CMPQ    AX, CX
+	JAE     spaceDone
+	MOVBLZX (SI)(AX*1), DX
+	CMPB    DL, $0x20
+	JEQ     spaceNext
+	CMPB    DL, $0x09
+	JEQ     spaceNext
+	CMPB    DL, $0x0d
+	JEQ     spaceNext
+	CMPB    DL, $0x0a
+	JNE     spaceDone
+
+spaceNext:
+	INCQ AX
+	JMP  spaceTail
+
+spaceDone:
+	VZEROUPPER
+	MOVQ AX, ret+24(FP)
+	RET
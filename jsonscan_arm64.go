@@ -0,0 +1,24 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+// +build !tinygo,!gojsonsm_noasm
+
+package gojsonsm
+
+// NEON is part of the base arm64 architecture, so there is nothing to detect
+const jsonScanVectorized = true
+
+// Implemented in jsonscan_arm64.s
+
+//go:noescape
+func jsonStringSpanNEON(data []byte) int
+
+//go:noescape
+func jsonSpaceSpanNEON(data []byte) int
+
+func jsonStringSpanVector(data []byte) int {
+	return jsonStringSpanNEON(data)
+}
+
+func jsonSpaceSpanVector(data []byte) int {
+	return jsonSpaceSpanNEON(data)
+}
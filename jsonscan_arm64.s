@@ -0,0 +1,144 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+// +build !tinygo,!gojsonsm_noasm
+
+#include "textflag.h"
+
+// func jsonStringSpanNEON(data []byte) int
+TEXT ·jsonStringSpanNEON(SB), NOSPLIT, $0-32
+	MOVD data_base+0(FP), R0
+	MOVD data_len+8(FP), R1
+	MOVD $0, R2
+
+	MOVD  $0x22, R3
+	VDUP  R3, V1.B16
+	MOVD  $0x5c, R3
+	VDUP  R3, V2.B16
+	MOVD  $0xe0, R3
+	VDUP  R3, V3.B16
+	VCMEQ V1.B16, V1.B16, V7.B16
+
+stringLoop:
+	SUB  R2, R1, R3
+	CMP  $16, R3
+	BLT  stringTail
+	ADD  R0, R2, R4
+	VLD1 (R4), [V0.B16]
+
+	VCMEQ V0.B16, V1.B16, V4.B16
+	VCMEQ V0.B16, V2.B16, V5.B16
+	VORR  V4.B16, V5.B16, V4.B16
+
+	// Control characters have none of the bits of 0xe0 set
+	VCMTST V0.B16, V3.B16, V5.B16
+	VEOR   V5.B16, V7.B16, V5.B16
+	VORR   V4.B16, V5.B16, V4.B16
+
+	VMOV V4.D[0], R5
+	VMOV V4.D[1], R6
+	ORR  R5, R6, R7
+	CBNZ R7, stringFound
+	ADD  $16, R2, R2
+	B    stringLoop
+
+stringFound:
+	CBNZ R5, stringFoundLow
+	ADD  $8, R2, R2
+	MOVD R6, R5
+
+stringFoundLow:
+	// Each matching lane is a 0xff byte, count the bytes before the first
+	RBIT R5, R5
+	CLZ  R5, R5
+	ADD  R5>>3, R2, R2
+	B    stringDone
+
+stringTail:
+	CMP   R1, R2
+	BGE   stringDone
+	MOVBU (R0)(R2), R3
+	CMP   $0x22, R3
+	BEQ   stringDone
+	CMP   $0x5c, R3
+	BEQ   stringDone
+	CMP   $0x20, R3
+	BLO   stringDone
+	ADD   $1, R2, R2
+	B     stringTail
+
+stringDone:
+	MOVD R2, ret+24(FP)
+	RET
+
+// func jsonSpaceSpanNEON(data []byte) int
+TEXT ·jsonSpaceSpanNEON(SB), NOSPLIT, $0-32
+	MOVD data_base+0(FP), R0
+	MOVD data_len+8(FP), R1
+	MOVD $0, R2
+
+	MOVD  $0x20, R3
+	VDUP  R3, V1.B16
+	MOVD  $0x09, R3
+	VDUP  R3, V2.B16
+	MOVD  $0x0d, R3
+	VDUP  R3, V3.B16
+	MOVD  $0x0a, R3
+	VDUP  R3, V4.B16
+	VCMEQ V1.B16, V1.B16, V7.B16
+
+spaceLoop:
+	SUB  R2, R1, R3
+	CMP  $16, R3
+	BLT  spaceTail
+	ADD  R0, R2, R4
+	VLD1 (R4), [V0.B16]
+
+	VCMEQ V0.B16, V1.B16, V5.B16
+	VCMEQ V0.B16, V2.B16, V6.B16
+	VORR  V5.B16, V6.B16, V5.B16
+	VCMEQ V0.B16, V3.B16, V6.B16
+	VORR  V5.B16, V6.B16, V5.B16
+	VCMEQ V0.B16, V4.B16, V6.B16
+	VORR  V5.B16, V6.B16, V5.B16
+
+	// Look for the first byte which is not whitespace
+	VEOR V5.B16, V7.B16, V5.B16
+
+	VMOV V5.D[0], R5
+	VMOV V5.D[1], R6
+	ORR  R5, R6, R7
+	CBNZ R7, spaceFound
+	ADD  $16, R2, R2
+	B    spaceLoop
+
+spaceFound:
+	CBNZ R5, spaceFoundLow
+	ADD  $8, R2, R2
+	MOVD R6, R5
+
+spaceFoundLow:
+	RBIT R5, R5
+	CLZ  R5, R5
+	ADD  R5>>3, R2, R2
+	B    spaceDone
+
+spaceTail:
+	CMP   R1, R2
+	BGE   spaceDone
+	MOVBU (R0)(R2), R3
+	CMP   $0x20, R3
+	BEQ   spaceNext
+	CMP   $0x09, R3
+	BEQ   spaceNext
+	CMP   $0x0d, R3
+	BEQ   spaceNext
+	CMP   $0x0a, R3
+	BNE   spaceDone
+
+spaceNext:
+	ADD $1, R2, R2
+	B   spaceTail
+
+spaceDone:
+	MOVD R2, ret+24(FP)
+	RET
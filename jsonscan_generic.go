@@ -0,0 +1,15 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+// +build !amd64,!arm64 tinygo gojsonsm_noasm
+
+package gojsonsm
+
+const jsonScanVectorized = false
+
+func jsonStringSpanVector(data []byte) int {
+	return jsonStringSpanGeneric(data)
+}
+
+func jsonSpaceSpanVector(data []byte) int {
+	return jsonSpaceSpanGeneric(data)
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestJsonStringSpan(t *testing.T) {
+	for _, stop := range []byte{'"', '\\', 0x00, 0x0a, 0x1f} {
+		for length := 0; length < 100; length++ {
+			for pos := 0; pos <= length; pos++ {
+				data := bytes.Repeat([]byte{'a'}, length)
+				if pos < length {
+					data[pos] = stop
+				}
+				// Bytes above 0x7f are part of multi-byte characters
+				if pos > 0 {
+					data[0] = 0xc3
+				}
+
+				if span := jsonStringSpan(data); span != pos {
+					t.Fatalf("Expected span %d of %q but got %d", pos, data, span)
+				}
+				if span := jsonStringSpanGeneric(data); span != pos {
+					t.Fatalf("Expected generic span %d of %q but got %d", pos, data, span)
+				}
+			}
+		}
+	}
+}
+
+func TestJsonSpaceSpan(t *testing.T) {
+	spaces := []byte(" \t\r\n")
+	for _, stop := range []byte{'{', '"', '0', 0x00, 0x0b, 0xff} {
+		for length := 0; length < 100; length++ {
+			for pos := 0; pos <= length; pos++ {
+				data := make([]byte, length)
+				for i := range data {
+					data[i] = spaces[i%len(spaces)]
+				}
+				if pos < length {
+					data[pos] = stop
+				}
+
+				if span := jsonSpaceSpan(data); span != pos {
+					t.Fatalf("Expected span %d of %q but got %d", pos, data, span)
+				}
+				if span := jsonSpaceSpanGeneric(data); span != pos {
+					t.Fatalf("Expected generic span %d of %q but got %d", pos, data, span)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkJsonStringSpan(b *testing.B) {
+	data := append(bytes.Repeat([]byte{'a'}, 4096), '"')
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		jsonStringSpan(data)
+	}
+}
@@ -108,15 +108,17 @@ func tokIsSpaceChar(c byte) bool {
 }
 
 type jsonTokenizer struct {
-	data    []byte
-	dataLen int
-	pos     int
+	data     []byte
+	dataLen  int
+	pos      int
+	litParse fastLitParser
 }
 
 func (tkn *jsonTokenizer) Reset(data []byte) {
 	tkn.data = data
 	tkn.dataLen = len(data)
 	tkn.pos = 0
+	tkn.litParse.arena.reset()
 }
 
 func (tkn *jsonTokenizer) Position() int {
@@ -172,6 +174,7 @@ DataLoop:
 		switch state {
 		case toksBeginValueOrEmpty:
 			if c <= ' ' && tokIsSpaceChar(c) {
+				dataPos += jsonSpaceSpan(dataSlice[dataPos:dataLen])
 				startPos = dataPos
 				continue DataLoop
 			}
@@ -183,6 +186,7 @@ DataLoop:
 
 		case toksBeginValue:
 			if c <= ' ' && tokIsSpaceChar(c) {
+				dataPos += jsonSpaceSpan(dataSlice[dataPos:dataLen])
 				startPos = dataPos
 				continue DataLoop
 			}
@@ -235,6 +239,7 @@ DataLoop:
 
 		case toksBeginStringOrEmpty:
 			if c <= ' ' && tokIsSpaceChar(c) {
+				dataPos += jsonSpaceSpan(dataSlice[dataPos:dataLen])
 				startPos = dataPos
 				continue DataLoop
 			}
@@ -246,6 +251,7 @@ DataLoop:
 
 		case toksBeginString:
 			if c <= ' ' && tokIsSpaceChar(c) {
+				dataPos += jsonSpaceSpan(dataSlice[dataPos:dataLen])
 				startPos = dataPos
 				continue DataLoop
 			}
@@ -268,7 +274,8 @@ DataLoop:
 				return tknUnknown, nil, 0, errors.New("in string literal")
 			}
 
-			// continue with current state
+			// skip the plain characters which follow, staying in the current state
+			dataPos += jsonStringSpan(dataSlice[dataPos:dataLen])
 			continue DataLoop
 
 		case toksInStringEsc:
@@ -491,3 +498,49 @@ DataLoop:
 	return tokenType, tokenData, tokenDataLen, nil
 
 }
+
+func (tkn *jsonTokenizer) ParseLiteral(token tokenType, data []byte) FastVal {
+	return tkn.litParse.Parse(token, data)
+}
+
+// SkipValue moves past the rest of the object or array whose start token
+// was just read.  Only brackets and strings are looked at, so the contents
+// are not validated.
+func (tkn *jsonTokenizer) SkipValue() error {
+	data := tkn.data[:tkn.dataLen]
+	depth := 0
+
+	for pos := tkn.pos; pos < len(data); pos++ {
+		switch data[pos] {
+		case '"':
+			// Find the closing quote, passing over escaped characters
+			for pos++; pos < len(data); pos++ {
+				pos += jsonStringSpan(data[pos:])
+				if pos >= len(data) || data[pos] == '"' {
+					break
+				}
+				if data[pos] == '\\' {
+					pos++
+				}
+			}
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth == 0 {
+				tkn.pos = pos + 1
+				return nil
+			}
+			depth--
+		}
+	}
+
+	tkn.pos = len(data)
+	return errors.New("unexpected end of input")
+}
+
+func (tkn *jsonTokenizer) ParseKey(token tokenType, data []byte, dataLen int) []byte {
+	if token == tknEscString {
+		return tkn.litParse.ParseEscStringWLen(data, dataLen)
+	}
+	return tkn.litParse.ParseStringWLen(data, dataLen)
+}
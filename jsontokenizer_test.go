@@ -186,6 +186,24 @@ func TestTokenizerLong(t *testing.T) {
 	}
 }
 
+func TestTokenizerSkipValue(t *testing.T) {
+	var tok jsonTokenizer
+	tok.Reset([]byte(`{"a": [1, {"b": "}]"}, "\\\"{"], "c": "x"} , 3`))
+
+	testTokenizedStep(t, &tok, tknObjectStart, "{")
+	if err := tok.SkipValue(); err != nil {
+		t.Fatalf("encountered skipping error: %s", err)
+	}
+	testTokenizedStep(t, &tok, tknListDelim, ",")
+	testTokenizedStep(t, &tok, tknInteger, "3")
+
+	tok.Reset([]byte(`["]"`))
+	testTokenizedStep(t, &tok, tknArrayStart, "[")
+	if err := tok.SkipValue(); err == nil {
+		t.Fatalf("expected an error skipping an unterminated array")
+	}
+}
+
 func BenchmarkTokenize(b *testing.B) {
 	var tok jsonTokenizer
 
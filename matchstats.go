@@ -0,0 +1,190 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// MatchStats collects statistics about the documents matched by a FilterSet,
+// which help find filters which are expensive or which never match.  A
+// collector is only used once it is given to FilterSet.SetStats, and is safe
+// to share between sets matching on different goroutines.
+type MatchStats struct {
+	lock      sync.Mutex
+	documents uint64
+	errors    uint64
+	matches   []uint64
+	latencies [len(matchLatencyBounds) + 1]uint64
+	scanned   uint64
+	docBytes  uint64
+	exits     uint64
+}
+
+// The upper bounds of the buckets of the latency histogram, with a final
+// bucket for anything slower
+var matchLatencyBounds = [...]time.Duration{
+	time.Microsecond,
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// LatencyBucket is a bucket of the latency histogram of a MatchStatsSnapshot,
+// counting the documents which took at most UpperBound to match and more
+// than the bound of the bucket before
+type LatencyBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// MatchStatsSnapshot is a copy of the statistics of a MatchStats
+type MatchStatsSnapshot struct {
+	// The number of documents matched, including those which failed
+	Documents uint64
+	// The number of documents which failed to match
+	Errors uint64
+	// The number of documents each filter matched, indexed by its ID
+	Matches []uint64
+	// The time taken to match each document against the whole set
+	Latency []LatencyBucket
+	// The bytes of the documents read before matching finished, and the
+	// total size of the documents, which show how soon matching exits
+	ScannedBytes uint64
+	DocBytes     uint64
+	// The number of documents which were decided before reaching their end
+	EarlyExits uint64
+}
+
+// NewMatchStats creates an empty statistics collector
+func NewMatchStats() *MatchStats {
+	return &MatchStats{}
+}
+
+// ScanRatio returns the average fraction of each document which was read
+// before matching finished
+func (snap MatchStatsSnapshot) ScanRatio() float64 {
+	if snap.DocBytes == 0 {
+		return 0
+	}
+	return float64(snap.ScannedBytes) / float64(snap.DocBytes)
+}
+
+// NeverMatched returns the IDs of the filters which have not matched any
+// document
+func (snap MatchStatsSnapshot) NeverMatched() []int {
+	var ids []int
+	for id, count := range snap.Matches {
+		if count == 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (snap MatchStatsSnapshot) String() string {
+	var out string
+	out += fmt.Sprintf("documents: %d\n", snap.Documents)
+	out += fmt.Sprintf("errors: %d\n", snap.Errors)
+	for id, count := range snap.Matches {
+		out += fmt.Sprintf("filter %d matches: %d\n", id, count)
+	}
+	for _, bucket := range snap.Latency {
+		if bucket.UpperBound == math.MaxInt64 {
+			out += fmt.Sprintf("latency > %v: %d\n", matchLatencyBounds[len(matchLatencyBounds)-1], bucket.Count)
+		} else {
+			out += fmt.Sprintf("latency <= %v: %d\n", bucket.UpperBound, bucket.Count)
+		}
+	}
+	out += fmt.Sprintf("scan ratio: %.2f\n", snap.ScanRatio())
+	out += fmt.Sprintf("early exits: %d", snap.EarlyExits)
+	return out
+}
+
+// recordDoc records a document matched by a set of numFilters IDs, along
+// with the bitmask of the filters which matched when there was no error
+func (stats *MatchStats) recordDoc(numFilters int, mask Bitmask, latency time.Duration, scanned, docBytes int, err error) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.documents++
+	bucket := 0
+	for bucket < len(matchLatencyBounds) && latency > matchLatencyBounds[bucket] {
+		bucket++
+	}
+	stats.latencies[bucket]++
+	if err != nil {
+		stats.errors++
+		return
+	}
+
+	for len(stats.matches) < numFilters {
+		stats.matches = append(stats.matches, 0)
+	}
+	for i, word := range mask {
+		for word != 0 {
+			bit := bits.TrailingZeros64(word)
+			word &^= 1 << uint(bit)
+			stats.matches[i*64+bit]++
+		}
+	}
+
+	stats.scanned += uint64(scanned)
+	stats.docBytes += uint64(docBytes)
+	if scanned < docBytes {
+		stats.exits++
+	}
+}
+
+// resetFilter clears the match count of a filter, so that a filter which is
+// later given the same ID starts from nothing
+func (stats *MatchStats) resetFilter(id int) {
+	stats.lock.Lock()
+	if id < len(stats.matches) {
+		stats.matches[id] = 0
+	}
+	stats.lock.Unlock()
+}
+
+// Snapshot returns a copy of the statistics collected so far
+func (stats *MatchStats) Snapshot() MatchStatsSnapshot {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	snap := MatchStatsSnapshot{
+		Documents:    stats.documents,
+		Errors:       stats.errors,
+		Matches:      append([]uint64(nil), stats.matches...),
+		ScannedBytes: stats.scanned,
+		DocBytes:     stats.docBytes,
+		EarlyExits:   stats.exits,
+	}
+	for i, count := range stats.latencies {
+		bound := time.Duration(math.MaxInt64)
+		if i < len(matchLatencyBounds) {
+			bound = matchLatencyBounds[i]
+		}
+		snap.Latency = append(snap.Latency, LatencyBucket{bound, count})
+	}
+	return snap
+}
+
+// Reset clears every statistic collected so far
+func (stats *MatchStats) Reset() {
+	stats.lock.Lock()
+	stats.documents = 0
+	stats.errors = 0
+	stats.matches = stats.matches[:0]
+	stats.latencies = [len(matchLatencyBounds) + 1]uint64{}
+	stats.scanned = 0
+	stats.docBytes = 0
+	stats.exits = 0
+	stats.lock.Unlock()
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchStats(t *testing.T) {
+	assert := assert.New(t)
+
+	set, err := NewFilterSetFromStrings([]string{`type = "order"`, `type = "refund"`, `total > 100`})
+	assert.Nil(err)
+
+	stats := NewMatchStats()
+	set.SetStats(stats)
+
+	docs := []string{
+		`{"type":"order","total":150}`,
+		`{"type":"order","total":50}`,
+		`{"total":150,"type":"order","items":[1,2,3]}`,
+		`{"type":@}`,
+	}
+	for _, doc := range docs {
+		set.MatchSet([]byte(doc))
+	}
+
+	snap := stats.Snapshot()
+	assert.Equal(uint64(4), snap.Documents)
+	assert.Equal(uint64(1), snap.Errors)
+	assert.Equal([]uint64{3, 0, 2}, snap.Matches)
+	assert.Equal([]int{1}, snap.NeverMatched())
+
+	var latencyCount uint64
+	for _, bucket := range snap.Latency {
+		latencyCount += bucket.Count
+	}
+	assert.Equal(uint64(4), latencyCount)
+	assert.Equal(len(matchLatencyBounds)+1, len(snap.Latency))
+
+	// Every filter is decided once type and total have been read, so the
+	// matcher stops before the end of each document
+	assert.Equal(uint64(3), snap.EarlyExits)
+	assert.True(snap.ScanRatio() < 1)
+	assert.Contains(snap.String(), "filter 1 matches: 0")
+
+	// A filter added in place of a removed one starts with no matches
+	assert.Nil(set.Remove(0))
+	assert.Equal(0, set.Add(TrueExpr{}))
+	assert.Equal([]uint64{0, 0, 2}, stats.Snapshot().Matches)
+
+	set.SetStats(nil)
+	set.MatchSet([]byte(`{"type":"order"}`))
+	assert.Equal(uint64(4), stats.Snapshot().Documents)
+
+	stats.Reset()
+	snap = stats.Snapshot()
+	assert.Equal(uint64(0), snap.Documents)
+	assert.Equal(0, len(snap.Matches))
+	assert.Equal(uint64(0), snap.Latency[0].Count)
+}
@@ -0,0 +1,1021 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The ops of each ExecNode and AfterNode are compiled into a flat program
+// which the FastMatcher runs with a small stack machine, rather than walking
+// the OpNode and DataRef structures and type switching on every value for
+// every document.
+
+type vmOpcode uint8
+
+const (
+	// Jump to arg if the bucket has already been resolved
+	vmSkipResolved vmOpcode = iota
+	// Push the active literal, or a missing value when there is none
+	vmLoadActive
+	// Push the active literal, which must exist
+	vmLoadActiveRef
+	// Push consts[arg]
+	vmLoadConst
+	// Push the literal stored in slot arg
+	vmLoadSlot
+	// Push the time the document is being matched at, in milliseconds
+	vmLoadNow
+	// Replace the top value of the stack with funcs[arg] applied to it
+	vmCall1
+	// Replace the top two values of the stack with funcs[arg] applied to them
+	vmCall2
+	// Pop two values, compare them with op and mark the bucket with the result
+	vmCompare
+	// Check the active literal equals consts[arg], a string which needed no
+	// escaping, and mark the bucket with the result
+	vmEqualsLiteral
+	// Compare the active literal with consts[arg], an integer whose digits are
+	// held by consts[arg+1], using op and mark the bucket with the result
+	vmCompareInt
+	// Mark the bucket as true
+	vmMarkTrue
+	// Pop a value and mark the bucket as true if it is not missing
+	vmMarkExists
+	// Stop if the whole expression has been resolved
+	vmExitResolved
+	// Push locals[bucket] and jump to arg if it has already been computed
+	// during this run, otherwise continue on to computing it
+	vmLoadLocal
+	// Keep the top value of the stack in locals[arg] for the rest of the run
+	vmStoreLocal
+	// Pop a value into outputs[arg]
+	vmStoreOutput
+	// Jump to arg if the bucket has not been resolved yet
+	vmRunUnresolved
+	// Mark the bucket with the result of the last op run without a bucket,
+	// unless that op left it undecided or the bucket is already resolved
+	vmMarkResult
+)
+
+type vmInstr struct {
+	code   vmOpcode
+	op     OpType
+	bucket int32
+	arg    int32
+}
+
+type vmFunc struct {
+	name string
+	fn1  func(FastVal) FastVal
+	fn2  func(FastVal, FastVal) FastVal
+}
+
+var vmFuncs = map[string]vmFunc{
+	MathFuncAbs:       {fn1: FastValMathAbs},
+	MathFuncAcos:      {fn1: FastValMathAcos},
+	MathFuncAsin:      {fn1: FastValMathAsin},
+	MathFuncAtan:      {fn1: FastValMathAtan},
+	MathFuncAtan2:     {fn2: FastValMathAtan2},
+	MathFuncRound:     {fn1: FastValMathRound},
+	MathFuncRoundEven: {fn1: FastValMathRoundEven},
+	MathFuncCos:       {fn1: FastValMathCos},
+	MathFuncSin:       {fn1: FastValMathSin},
+	MathFuncTan:       {fn1: FastValMathTan},
+	MathFuncSqrt:      {fn1: FastValMathSqrt},
+	MathFuncExp:       {fn1: FastValMathExp},
+	MathFuncLn:        {fn1: FastValMathLn},
+	MathFuncLog:       {fn1: FastValMathLog},
+	MathFuncLog10:     {fn1: FastValMathLog10},
+	MathFuncLog2:      {fn1: FastValMathLog2},
+	MathFuncCeil:      {fn1: FastValMathCeil},
+	MathFuncFloor:     {fn1: FastValMathFloor},
+	MathFuncDegrees:   {fn1: FastValMathDegrees},
+	MathFuncRadians:   {fn1: FastValMathRadians},
+	MathFuncPow:       {fn2: FastValMathPow},
+	DateFunc:          {fn1: FastValDateFunc},
+	MathFuncAdd:       {fn2: FastValMathAdd},
+	MathFuncSub:       {fn2: FastValMathSub},
+	MathFuncMul:       {fn2: FastValMathMul},
+	MathFuncDiv:       {fn2: FastValMathDiv},
+	MathFuncMod:       {fn2: FastValMathMod},
+	MathFuncNeg:       {fn1: FastValMathNeg},
+	TokenMatchFunc:    {fn2: FastValTokenMatch},
+	Base64DecFunc:     {fn1: FastValBase64Decode},
+	Base64EncFunc:     {fn1: FastValBase64Encode},
+	DecodeJsonFunc:    {fn2: FastValDecodeJson},
+	EncodeJsonFunc:    {fn1: FastValEncodeJson},
+	DateTruncFunc:     {fn2: FastValDateTrunc},
+	DateWeekdayFunc:   {fn1: FastValWeekday},
+}
+
+type matchProgram struct {
+	code      []vmInstr
+	consts    []FastVal
+	funcs     []vmFunc
+	maxStack  int
+	numLocals int
+	// Whether the program compares with arrays or objects, so needs to be
+	// run with the value of those in the document as well as literals
+	readsContainers bool
+}
+
+type programCompiler struct {
+	prog  matchProgram
+	depth int
+	// The locals of the functions used more than once by the program, such
+	// as the value of a LET binding used by several comparisons, which are
+	// only computed the first time they are reached in a run
+	shared map[string]int32
+}
+
+func (c *programCompiler) emit(instr vmInstr) int {
+	c.prog.code = append(c.prog.code, instr)
+	return len(c.prog.code) - 1
+}
+
+func (c *programCompiler) push() {
+	c.depth++
+	if c.depth > c.prog.maxStack {
+		c.prog.maxStack = c.depth
+	}
+}
+
+func (c *programCompiler) compileFunc(fn FuncRef) {
+	local, shared := c.shared[fn.String()]
+	if !shared {
+		c.compileCall(fn)
+		return
+	}
+
+	loadIdx := c.emit(vmInstr{code: vmLoadLocal, bucket: local})
+	c.compileCall(fn)
+	c.emit(vmInstr{code: vmStoreLocal, arg: local})
+	c.prog.code[loadIdx].arg = int32(len(c.prog.code))
+}
+
+func (c *programCompiler) compileCall(fn FuncRef) {
+	if fn.FuncName == NowMillisFunc {
+		c.emit(vmInstr{code: vmLoadNow})
+		c.push()
+		return
+	}
+
+	impl, ok := vmFuncs[fn.FuncName]
+	if !ok {
+		// Unknown functions only fail if the op is actually reached, in the
+		// same way as they did before being compiled
+		name := fn.FuncName
+		impl.fn1 = func(FastVal) FastVal {
+			panic(fmt.Sprintf("encountered unexpected function name: %v", name))
+		}
+		c.compileParam(nil)
+	} else if impl.fn2 != nil {
+		c.compileParam(fn.Params[0])
+		c.compileParam(fn.Params[1])
+	} else {
+		c.compileParam(fn.Params[0])
+	}
+	impl.name = fn.FuncName
+
+	c.prog.funcs = append(c.prog.funcs, impl)
+	funcIdx := int32(len(c.prog.funcs) - 1)
+	if impl.fn2 != nil {
+		c.emit(vmInstr{code: vmCall2, arg: funcIdx})
+		c.depth--
+	} else {
+		c.emit(vmInstr{code: vmCall1, arg: funcIdx})
+	}
+}
+
+func (c *programCompiler) compileParam(in DataRef) {
+	switch opVal := in.(type) {
+	case nil:
+		c.emit(vmInstr{code: vmLoadActive})
+		c.push()
+	case FastVal:
+		if isContainerFastVal(opVal) {
+			c.prog.readsContainers = true
+		}
+		c.prog.consts = append(c.prog.consts, opVal)
+		c.emit(vmInstr{code: vmLoadConst, arg: int32(len(c.prog.consts) - 1)})
+		c.push()
+	case activeLitRef:
+		c.emit(vmInstr{code: vmLoadActiveRef})
+		c.push()
+	case SlotRef:
+		c.emit(vmInstr{code: vmLoadSlot, arg: int32(opVal.Slot)})
+		c.push()
+	case FuncRef:
+		c.compileFunc(opVal)
+	default:
+		panic(fmt.Sprintf("unexpected op value: %#v", in))
+	}
+}
+
+func (c *programCompiler) compileOp(op *OpNode) {
+	bucket := int32(op.BucketIdx)
+	skipIdx := c.emit(vmInstr{code: vmSkipResolved, bucket: bucket})
+	c.compileCond(op, bucket)
+	c.emit(vmInstr{code: vmExitResolved})
+	c.prog.code[skipIdx].arg = int32(len(c.prog.code))
+}
+
+// compileOpGroup compiles ops which only differ by their bucket so that the
+// condition is evaluated once, as long as any of the buckets is unresolved,
+// and its result is then used to mark all of them
+func (c *programCompiler) compileOpGroup(ops []*OpNode) {
+	var runIdxs []int
+	for _, op := range ops[:len(ops)-1] {
+		runIdxs = append(runIdxs, c.emit(vmInstr{code: vmRunUnresolved, bucket: int32(op.BucketIdx)}))
+	}
+	skipIdx := c.emit(vmInstr{code: vmSkipResolved, bucket: int32(ops[len(ops)-1].BucketIdx)})
+
+	for _, runIdx := range runIdxs {
+		c.prog.code[runIdx].arg = int32(len(c.prog.code))
+	}
+	c.compileCond(ops[0], -1)
+	for _, op := range ops {
+		c.emit(vmInstr{code: vmMarkResult, bucket: int32(op.BucketIdx)})
+	}
+
+	c.emit(vmInstr{code: vmExitResolved})
+	c.prog.code[skipIdx].arg = int32(len(c.prog.code))
+}
+
+// compileCond compiles the condition of an op, marking the bucket with its
+// result, or only keeping the result when the bucket is -1
+func (c *programCompiler) compileCond(op *OpNode, bucket int32) {
+	if _, ok := op.Lhs.(FuncRef); ok && op.Op == OpTypeExists {
+		// Functions, such as DECODE_JSON() of a path, can give missing
+		c.compileParam(op.Lhs)
+		c.emit(vmInstr{code: vmMarkExists, bucket: bucket})
+		c.depth--
+	} else if op.Op == OpTypeExists {
+		c.emit(vmInstr{code: vmMarkTrue, bucket: bucket})
+	} else if rhsVal, ok := op.Rhs.(FastVal); ok && isEqualityOp(op.Op) && op.Lhs == nil && isPlainJsonString(rhsVal) {
+		c.prog.consts = append(c.prog.consts, rhsVal)
+		c.emit(vmInstr{code: vmEqualsLiteral, op: op.Op, bucket: bucket, arg: int32(len(c.prog.consts) - 1)})
+	} else if rhsVal, ok := op.Rhs.(FastVal); ok && isOrderingOp(op.Op) && op.Lhs == nil && rhsVal.dataType == IntValue {
+		digits := strconv.AppendInt(nil, rhsVal.GetInt(), 10)
+		c.prog.consts = append(c.prog.consts, rhsVal, NewJsonIntFastVal(digits))
+		c.emit(vmInstr{code: vmCompareInt, op: op.Op, bucket: bucket, arg: int32(len(c.prog.consts) - 2)})
+	} else {
+		c.compileParam(op.Lhs)
+		c.compileParam(op.Rhs)
+		c.emit(vmInstr{code: vmCompare, op: op.Op, bucket: bucket})
+		c.depth -= 2
+	}
+}
+
+// isPlainJsonString checks whether a value is a JSON string which is the same
+// as the string it encodes, so a string from the document can be checked
+// against it byte for byte rather than being escaped first
+func isPlainJsonString(val FastVal) bool {
+	if val.dataType != JsonStringValue {
+		return false
+	}
+	quotedBytes := strconv.AppendQuote(nil, string(val.sliceData))
+	return bytes.Equal(quotedBytes[1:len(quotedBytes)-1], val.sliceData)
+}
+
+func isEqualityOp(op OpType) bool {
+	return op == OpTypeEquals || op == OpTypeStrictEquals
+}
+
+func isOrderingOp(op OpType) bool {
+	switch op {
+	case OpTypeEquals, OpTypeLessThan, OpTypeLessEquals, OpTypeGreaterThan, OpTypeGreaterEquals:
+		return true
+	}
+	return false
+}
+
+// compileOps builds the program running a list of ops, returning nil when
+// there are no ops to run
+func compileOps(ops []OpNode) *matchProgram {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	groups := groupOps(ops)
+	var c programCompiler
+	c.shareFuncs(groups)
+	for _, group := range groups {
+		if len(group) == 1 {
+			c.compileOp(group[0])
+		} else {
+			c.compileOpGroup(group)
+		}
+	}
+	return &c.prog
+}
+
+// groupOps groups together the ops which only differ by their bucket, such
+// as the same clause used by several expressions of a FilterSet, keeping
+// the groups in the order the ops first appear
+func groupOps(ops []OpNode) [][]*OpNode {
+	var groups [][]*OpNode
+	groupIdxs := make(map[string]int)
+	for i := range ops {
+		op := &ops[i]
+		if !isGroupableRef(op.Lhs) || !isGroupableRef(op.Rhs) {
+			groups = append(groups, []*OpNode{op})
+			continue
+		}
+
+		key := fmt.Sprintf("%s %s %s", dataRefToString(op.Lhs), op.Op, dataRefToString(op.Rhs))
+		groupIdx, ok := groupIdxs[key]
+		if !ok {
+			groupIdx = len(groups)
+			groupIdxs[key] = groupIdx
+			groups = append(groups, nil)
+		}
+		groups[groupIdx] = append(groups[groupIdx], op)
+	}
+	return groups
+}
+
+// isGroupableRef checks whether the String form of a value is enough to tell
+// it apart from every other value, which is not the case for values such as
+// floats, arrays and objects
+func isGroupableRef(ref DataRef) bool {
+	switch ref := ref.(type) {
+	case FastVal:
+		switch ref.dataType {
+		case MissingValue, IntValue, UintValue, JsonIntValue, JsonUintValue, JsonFloatValue,
+			StringValue, BinStringValue, JsonStringValue, RegexValue, NullValue, TrueValue, FalseValue:
+			return true
+		}
+		return false
+	case FuncRef:
+		for _, param := range ref.Params {
+			if !isGroupableRef(param) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// shareFuncs gives a local to every function which is used by more than one
+// group of ops, or more than once within an op
+func (c *programCompiler) shareFuncs(groups [][]*OpNode) {
+	counts := make(map[string]int)
+	var names []string
+	var countFuncs func(ref DataRef)
+	countFuncs = func(ref DataRef) {
+		if fn, ok := ref.(FuncRef); ok {
+			name := fn.String()
+			if counts[name] == 0 {
+				names = append(names, name)
+			}
+			counts[name]++
+			for _, param := range fn.Params {
+				countFuncs(param)
+			}
+		}
+	}
+	for _, group := range groups {
+		countFuncs(group[0].Lhs)
+		countFuncs(group[0].Rhs)
+	}
+
+	for _, name := range names {
+		if counts[name] > 1 {
+			if c.shared == nil {
+				c.shared = make(map[string]int32)
+			}
+			c.shared[name] = int32(c.prog.numLocals)
+			c.prog.numLocals++
+		}
+	}
+}
+
+// compileOutputs builds the program computing a list of outputs into the
+// outputs of the matcher, returning nil when there are none
+func compileOutputs(outputs []DataRef) *matchProgram {
+	if len(outputs) == 0 {
+		return nil
+	}
+
+	var c programCompiler
+	for i, output := range outputs {
+		c.compileParam(output)
+		c.emit(vmInstr{code: vmStoreOutput, arg: int32(i)})
+		c.depth--
+	}
+	return &c.prog
+}
+
+func compileExecNode(node *ExecNode) {
+	if node == nil {
+		return
+	}
+
+	node.program = compileOps(node.Ops)
+	node.elemTrie = newFieldTrie(node.Elems)
+	for _, elem := range node.Elems {
+		compileExecNode(elem)
+	}
+	for _, loop := range node.Loops {
+		compileExecNode(loop.Node)
+	}
+	if node.After != nil {
+		node.After.program = compileOps(node.After.Ops)
+		for _, loop := range node.After.Loops {
+			compileExecNode(loop.Node)
+		}
+	}
+}
+
+// compilePrograms compiles the ops and builds the field tries of every node
+// in the definition, along with marking the subtrees of the match tree, which
+// must be done before the definition is shared between matchers
+func (def *MatchDef) compilePrograms() {
+	compileExecNode(def.ParseNode)
+	def.outputProgram = compileOutputs(def.Outputs)
+	def.MatchTree.markSubtreeEnds()
+	def.keyOnly = def.readsOnlyKey()
+	def.compiled = true
+}
+
+func (prog *matchProgram) String() string {
+	var out string
+	for pc, instr := range prog.code {
+		out += fmt.Sprintf("%d: ", pc)
+		switch instr.code {
+		case vmSkipResolved:
+			out += fmt.Sprintf("skip [%d] -> %d", instr.bucket, instr.arg)
+		case vmLoadActive:
+			out += "load @?"
+		case vmLoadActiveRef:
+			out += "load @"
+		case vmLoadConst:
+			out += fmt.Sprintf("load %s", prog.consts[instr.arg])
+		case vmLoadSlot:
+			out += fmt.Sprintf("load $%d", instr.arg)
+		case vmLoadNow:
+			out += "load now"
+		case vmCall1, vmCall2:
+			out += fmt.Sprintf("call func:%s", prog.funcs[instr.arg].name)
+		case vmCompare:
+			out += fmt.Sprintf("%s [%d]", instr.op, instr.bucket)
+		case vmEqualsLiteral:
+			out += fmt.Sprintf("%s @? %s [%d]", instr.op, prog.consts[instr.arg], instr.bucket)
+		case vmCompareInt:
+			out += fmt.Sprintf("%s @? %s [%d]", instr.op, prog.consts[instr.arg], instr.bucket)
+		case vmMarkTrue:
+			out += fmt.Sprintf("true [%d]", instr.bucket)
+		case vmMarkExists:
+			out += fmt.Sprintf("exists [%d]", instr.bucket)
+		case vmExitResolved:
+			out += "exit resolved"
+		case vmLoadLocal:
+			out += fmt.Sprintf("load local %d or continue -> %d", instr.bucket, instr.arg)
+		case vmStoreLocal:
+			out += fmt.Sprintf("store local %d", instr.arg)
+		case vmStoreOutput:
+			out += fmt.Sprintf("store output %d", instr.arg)
+		case vmRunUnresolved:
+			out += fmt.Sprintf("run [%d] -> %d", instr.bucket, instr.arg)
+		case vmMarkResult:
+			out += fmt.Sprintf("result [%d]", instr.bucket)
+		}
+		out += "\n"
+	}
+	return strings.TrimRight(out, "\n")
+}
+
+// activeLiteral is the literal token the ops of an ExecNode run against,
+// which is only parsed once an op needs its value
+type activeLiteral struct {
+	token  tokenType
+	data   []byte
+	val    FastVal
+	parsed bool
+}
+
+func (m *FastMatcher) literalValue(lit *activeLiteral) FastVal {
+	if !lit.parsed {
+		lit.val = m.tokens.ParseLiteral(lit.token, lit.data)
+		lit.parsed = true
+	}
+	return lit.val
+}
+
+func compareValues(op OpType, lhsVal, rhsVal FastVal) bool {
+	// Arrays and objects are only ever compared with values of their type
+	if (isContainerFastVal(lhsVal) || isContainerFastVal(rhsVal)) && lhsVal.dataType != rhsVal.dataType {
+		return false
+	}
+
+	switch op {
+	case OpTypeEquals:
+		return lhsVal.Equals(rhsVal)
+	case OpTypeStrictEquals:
+		return fastValKind(lhsVal) == fastValKind(rhsVal) && lhsVal.Equals(rhsVal)
+	case OpTypeLessThan:
+		return lhsVal.Compare(rhsVal) < 0
+	case OpTypeLessEquals:
+		return lhsVal.Compare(rhsVal) <= 0
+	case OpTypeGreaterThan:
+		return lhsVal.Compare(rhsVal) > 0
+	case OpTypeGreaterEquals:
+		return lhsVal.Compare(rhsVal) >= 0
+	case OpTypeMatches:
+		return lhsVal.Matches(rhsVal)
+	}
+	panic("invalid op type")
+}
+
+// compareValues compares two values in the same way as compareValues,
+// except that numbers are compared using the FloatEquality of the matcher
+// when it has one and either of them is a float, and strings holding a
+// number are compared with numbers as that number when the matcher coerces
+// numeric strings, while other strings do not match numbers at all.  Strict
+// equality never coerces, and only matches values of the same JSON type.
+func (m *FastMatcher) compareValues(op OpType, lhsVal, rhsVal FastVal) bool {
+	if op == OpTypeStrictEquals {
+		if fastValKind(lhsVal) != fastValKind(rhsVal) {
+			return false
+		}
+		op = OpTypeEquals
+	} else if m.coerceStrings && op != OpTypeMatches {
+		var ok bool
+		if lhsVal.IsString() && rhsVal.IsNumeric() {
+			if lhsVal, ok = numericStringValue(lhsVal); !ok {
+				return false
+			}
+		} else if rhsVal.IsString() && lhsVal.IsNumeric() {
+			if rhsVal, ok = numericStringValue(rhsVal); !ok {
+				return false
+			}
+		}
+	}
+
+	if m.floatEq != nil && op != OpTypeMatches &&
+		(lhsVal.IsFloat() || rhsVal.IsFloat()) &&
+		lhsVal.IsNumeric() && rhsVal.IsNumeric() {
+		return compareResult(op, compareNumbers(lhsVal, rhsVal, *m.floatEq))
+	}
+	return compareValues(op, lhsVal, rhsVal)
+}
+
+var numericStringRegex *regexp.Regexp = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// numericStringValue parses a string which holds a JSON number, such as
+// "42" or "-1.5e3", into that number
+func numericStringValue(val FastVal) (FastVal, bool) {
+	var data []byte
+	if val.dataType == StringValue {
+		data = []byte(val.data.(string))
+	} else {
+		data = val.sliceData
+	}
+	if !numericStringRegex.Match(data) {
+		return val, false
+	}
+
+	var parser fastLitParser
+	if bytes.ContainsAny(data, ".eE") {
+		return NewFloatFastVal(parser.ParseNumber(data)), true
+	}
+	return parser.parseIntValue(data), true
+}
+
+func isContainerFastVal(val FastVal) bool {
+	return val.dataType == ArrayValue || val.dataType == ObjectValue
+}
+
+// containerValue reads the rest of the array or object whose start token
+// was just read into a value, so that it can be compared as a whole
+func (m *FastMatcher) containerValue(token tokenType) (FastVal, error) {
+	var elems []FastVal
+	var fields map[string]FastVal
+	if token == tknObjectStart {
+		fields = make(map[string]FastVal)
+	}
+
+	var key string
+	var haveKey bool
+	for {
+		token, tokenData, tokenDataLen, err := m.tokens.Step()
+		if err != nil {
+			return NewInvalidFastVal(), err
+		}
+
+		var elem FastVal
+		switch token {
+		case tknArrayEnd:
+			return NewArrayFastVal(elems), nil
+		case tknObjectEnd:
+			return NewObjectFastVal(fields), nil
+		case tknListDelim, tknObjectKeyDelim:
+			continue
+		case tknArrayStart, tknObjectStart:
+			elem, err = m.containerValue(token)
+			if err != nil {
+				return elem, err
+			}
+		default:
+			if !isLiteralToken(token) {
+				return NewInvalidFastVal(), ErrorJsonMalformed
+			}
+			if fields != nil && !haveKey {
+				if token != tknString && token != tknEscString {
+					return NewInvalidFastVal(), ErrorJsonMalformed
+				}
+				key = string(m.tokens.ParseKey(token, tokenData, tokenDataLen))
+				haveKey = true
+				continue
+			}
+			elem = m.tokens.ParseLiteral(token, tokenData)
+		}
+
+		if fields != nil {
+			fields[key] = elem
+			haveKey = false
+		} else {
+			elems = append(elems, elem)
+		}
+	}
+}
+
+// matchContainer runs a program which compares with arrays or objects
+// against the array or object whose start token was just read, leaving the
+// tokenizer where it was
+func (m *FastMatcher) matchContainer(token tokenType, prog *matchProgram) error {
+	savePos := m.tokens.Position()
+	val, err := m.containerValue(token)
+	if err != nil {
+		return err
+	}
+	m.tokens.Seek(savePos)
+
+	lit := activeLiteral{token: token, val: val, parsed: true}
+	m.runProgram(prog, &lit)
+	return nil
+}
+
+// compareResult applies an ordering op to the result of a comparison
+func compareResult(op OpType, res int) bool {
+	switch op {
+	case OpTypeEquals:
+		return res == 0
+	case OpTypeLessThan:
+		return res < 0
+	case OpTypeLessEquals:
+		return res <= 0
+	case OpTypeGreaterThan:
+		return res > 0
+	case OpTypeGreaterEquals:
+		return res >= 0
+	}
+	panic("invalid op type")
+}
+
+// compareIntDigits compares two integers written as their shortest decimal
+// form, as in JSON, without parsing them.  It fails when either is not in
+// that form or is long enough that parsing it could overflow.
+func compareIntDigits(lhs, rhs []byte) (int, bool) {
+	lhsNeg, lhsOk := plainIntDigits(lhs)
+	rhsNeg, rhsOk := plainIntDigits(rhs)
+	if !lhsOk || !rhsOk {
+		return 0, false
+	}
+
+	if lhsNeg != rhsNeg {
+		if lhsNeg {
+			return -1, true
+		}
+		return 1, true
+	}
+
+	var res int
+	if len(lhs) != len(rhs) {
+		res = 1
+		if len(lhs) < len(rhs) {
+			res = -1
+		}
+	} else {
+		res = bytes.Compare(lhs, rhs)
+	}
+
+	if lhsNeg {
+		return -res, true
+	}
+	return res, true
+}
+
+func plainIntDigits(data []byte) (bool, bool) {
+	neg := len(data) > 0 && data[0] == '-'
+	digits := data
+	if neg {
+		digits = data[1:]
+	}
+
+	if len(digits) == 0 || len(digits) > 18 {
+		return neg, false
+	}
+	if digits[0] == '0' && (len(digits) > 1 || neg) {
+		return neg, false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return neg, false
+		}
+	}
+	return neg, true
+}
+
+func (m *FastMatcher) runProgram(prog *matchProgram, lit *activeLiteral) {
+	if len(m.stack) < prog.maxStack {
+		m.stack = make([]FastVal, prog.maxStack)
+	}
+	stack := m.stack
+	sp := 0
+
+	if prog.numLocals > 0 {
+		if len(m.locals) < prog.numLocals {
+			m.locals = make([]FastVal, prog.numLocals)
+			m.localsSet = make([]bool, prog.numLocals)
+		}
+		for i := 0; i < prog.numLocals; i++ {
+			m.localsSet[i] = false
+		}
+	}
+
+	code := prog.code
+	for pc := 0; pc < len(code); pc++ {
+		instr := &code[pc]
+		switch instr.code {
+		case vmSkipResolved:
+			if m.buckets.IsResolved(int(instr.bucket)) {
+				pc = int(instr.arg) - 1
+			}
+		case vmLoadActive:
+			if lit != nil {
+				stack[sp] = m.literalValue(lit)
+			} else {
+				stack[sp] = NewMissingFastVal()
+			}
+			sp++
+		case vmLoadActiveRef:
+			if lit == nil {
+				panic("cannot resolve active literal without having an active context")
+			}
+			stack[sp] = m.literalValue(lit)
+			sp++
+		case vmLoadConst:
+			stack[sp] = prog.consts[instr.arg]
+			sp++
+		case vmLoadSlot:
+			stack[sp] = m.literalFromSlot(SlotID(instr.arg))
+			sp++
+		case vmLoadNow:
+			stack[sp] = m.nowMillis()
+			sp++
+		case vmLoadLocal:
+			if m.localsSet[instr.bucket] {
+				stack[sp] = m.locals[instr.bucket]
+				sp++
+				pc = int(instr.arg) - 1
+			}
+		case vmStoreLocal:
+			m.locals[instr.arg] = stack[sp-1]
+			m.localsSet[instr.arg] = true
+		case vmCall1:
+			stack[sp-1] = prog.funcs[instr.arg].fn1(stack[sp-1])
+		case vmCall2:
+			sp--
+			stack[sp-1] = prog.funcs[instr.arg].fn2(stack[sp-1], stack[sp])
+		case vmCompare:
+			sp -= 2
+			lhsVal, rhsVal := stack[sp], stack[sp+1]
+			if isNonFiniteFastVal(lhsVal) || isNonFiniteFastVal(rhsVal) {
+				m.markNonFinite(instr.bucket)
+				break
+			}
+			if lhsVal.IsString() {
+				lhsVal, rhsVal = m.jsonStringValue(lhsVal), m.jsonStringValue(rhsVal)
+			}
+
+			m.markOp(instr.bucket, m.compareValues(instr.op, lhsVal, rhsVal))
+		case vmEqualsLiteral:
+			var opRes bool
+			if lit != nil {
+				constVal := prog.consts[instr.arg]
+				litVal := m.literalValue(lit)
+				if litVal.dataType == BinStringValue {
+					// Strings from the document are already unescaped, so
+					// they can be compared with the literal as they are
+					opRes = bytes.Equal(litVal.sliceData, constVal.sliceData)
+				} else {
+					opRes = m.compareValues(instr.op, litVal, constVal)
+				}
+			}
+
+			m.markOp(instr.bucket, opRes)
+		case vmCompareInt:
+			var opRes bool
+			if lit == nil {
+				opRes = m.compareValues(instr.op, NewMissingFastVal(), prog.consts[instr.arg])
+			} else if res, ok := m.compareIntToken(lit, prog.consts[instr.arg+1].sliceData); ok {
+				opRes = compareResult(instr.op, res)
+			} else {
+				opRes = m.compareValues(instr.op, m.literalValue(lit), prog.consts[instr.arg])
+			}
+
+			m.markOp(instr.bucket, opRes)
+		case vmMarkTrue:
+			if m.emptyAsMissing != 0 && m.activeEmptyKind(lit)&m.emptyAsMissing != 0 {
+				m.opDecided = false
+			} else {
+				m.markOp(instr.bucket, true)
+			}
+		case vmMarkExists:
+			sp--
+			if isNonFiniteFastVal(stack[sp]) {
+				m.markNonFinite(instr.bucket)
+			} else if !stack[sp].IsMissing() && emptyFastValKind(stack[sp])&m.emptyAsMissing == 0 {
+				m.markOp(instr.bucket, true)
+			} else {
+				m.opDecided = false
+			}
+		case vmExitResolved:
+			if m.buckets.IsResolved(0) {
+				return
+			}
+		case vmStoreOutput:
+			sp--
+			m.outputs[instr.arg] = stack[sp]
+			if isContainerFastVal(stack[sp]) {
+				// Outputs only hold values which are not nested
+				m.outputs[instr.arg] = NewMissingFastVal()
+			} else if isNonFiniteFastVal(stack[sp]) {
+				switch m.nonFinite {
+				case NonFiniteMissing:
+					m.outputs[instr.arg] = NewMissingFastVal()
+				case NonFiniteError:
+					m.buckets.setErr(ErrorNonFiniteValue)
+				}
+			}
+		case vmRunUnresolved:
+			if !m.buckets.IsResolved(int(instr.bucket)) {
+				pc = int(instr.arg) - 1
+			}
+		case vmMarkResult:
+			if m.opDecided && !m.buckets.IsResolved(int(instr.bucket)) {
+				m.buckets.MarkNode(int(instr.bucket), m.opResult)
+			}
+		}
+	}
+}
+
+// NonFinitePolicy decides how a FastMatcher treats the NaN and infinite
+// values which math functions can give, such as SQRT(-1) or a division or
+// modulo by zero, when they are compared or tested with EXISTS
+type NonFinitePolicy int
+
+const (
+	// NonFiniteNoMatch makes any comparison with the value false
+	NonFiniteNoMatch NonFinitePolicy = iota
+	// NonFiniteMissing treats the value as MISSING, leaving comparisons with
+	// it undecided in the same way as comparisons with a missing field
+	NonFiniteMissing
+	// NonFiniteError makes Match return ErrorNonFiniteValue
+	NonFiniteError
+)
+
+func isNonFiniteFastVal(val FastVal) bool {
+	if val.dataType != FloatValue {
+		return false
+	}
+	floatVal := val.AsFloat()
+	return math.IsNaN(floatVal) || math.IsInf(floatVal, 0)
+}
+
+// markNonFinite decides the bucket of an op on a NaN or infinite value
+func (m *FastMatcher) markNonFinite(bucket int32) {
+	switch m.nonFinite {
+	case NonFiniteMissing:
+		m.opDecided = false
+	case NonFiniteError:
+		m.opDecided = false
+		m.buckets.setErr(ErrorNonFiniteValue)
+	default:
+		m.markOp(bucket, false)
+	}
+}
+
+// EmptyValues picks the kinds of empty values which a FastMatcher treats as
+// missing, so that EXISTS is false and IS MISSING is true for them
+type EmptyValues int
+
+const (
+	// EmptyStrings treats "" as missing
+	EmptyStrings EmptyValues = 1 << iota
+	// EmptyArrays treats [] as missing
+	EmptyArrays
+	// EmptyObjects treats {} as missing
+	EmptyObjects
+	// EmptyAll treats every kind of empty value as missing
+	EmptyAll = EmptyStrings | EmptyArrays | EmptyObjects
+)
+
+// emptyFastValKind returns the kind of empty value a value is, or 0 when it
+// is not empty
+func emptyFastValKind(val FastVal) EmptyValues {
+	switch val.dataType {
+	case StringValue:
+		if len(val.data.(string)) == 0 {
+			return EmptyStrings
+		}
+	case BinStringValue, JsonStringValue:
+		if len(val.sliceData) == 0 {
+			return EmptyStrings
+		}
+	case ArrayValue:
+		if len(val.data.([]FastVal)) == 0 {
+			return EmptyArrays
+		}
+	case ObjectValue:
+		if len(val.data.(map[string]FastVal)) == 0 {
+			return EmptyObjects
+		}
+	}
+	return 0
+}
+
+// emptyTokenKind returns the kind of empty value the value starting with a
+// token which was just read is, or 0 when it is not empty
+func (m *FastMatcher) emptyTokenKind(token tokenType, tokenData []byte) EmptyValues {
+	switch token {
+	case tknString, tknEscString:
+		return emptyFastValKind(m.tokens.ParseLiteral(token, tokenData))
+	case tknArrayStart, tknObjectStart:
+		savePos := m.tokens.Position()
+		next, _, _, err := m.tokens.Step()
+		m.tokens.Seek(savePos)
+		if err == nil && next == tknArrayEnd {
+			return EmptyArrays
+		} else if err == nil && next == tknObjectEnd {
+			return EmptyObjects
+		}
+	}
+	return 0
+}
+
+// activeEmptyKind returns the kind of empty value the value an op runs on
+// is, which is the value the after node runs for when there is no literal
+func (m *FastMatcher) activeEmptyKind(lit *activeLiteral) EmptyValues {
+	if lit == nil {
+		return m.activeEmpty
+	}
+	if !lit.parsed && lit.token != tknString && lit.token != tknEscString {
+		return 0
+	}
+	return emptyFastValKind(m.literalValue(lit))
+}
+
+// markOp keeps the result of an op for any vmMarkResult which follows it and
+// marks the bucket of the op with it, unless the op has no bucket
+func (m *FastMatcher) markOp(bucket int32, res bool) {
+	m.opResult = res
+	m.opDecided = true
+	if bucket >= 0 {
+		m.buckets.MarkNode(int(bucket), res)
+	}
+}
+
+// compareIntToken compares an integer token with the digits of an integer
+// directly when the tokenizer keeps integers as their decimal text
+func (m *FastMatcher) compareIntToken(lit *activeLiteral, digits []byte) (int, bool) {
+	if lit.token != tknInteger || !m.textIntegers {
+		return 0, false
+	}
+	return compareIntDigits(lit.data, digits)
+}
+
+// jsonStringValue converts a string value into a JSON string held in the
+// arena, which comparisons would otherwise allocate for every document
+func (m *FastMatcher) jsonStringValue(val FastVal) FastVal {
+	var str string
+	switch val.dataType {
+	case StringValue:
+		str = val.data.(string)
+	case BinStringValue:
+		str = string(val.sliceData)
+	default:
+		return val
+	}
+
+	quotedBytes := strconv.AppendQuote(m.arena.alloc(len(str) + 2)[:0], str)
+	return NewJsonStringFastVal(quotedBytes[1 : len(quotedBytes)-1])
+}
@@ -0,0 +1,230 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchProgramCompile(t *testing.T) {
+	assert := assert.New(t)
+
+	var trans Transformer
+	def := trans.Transform([]Expression{AndExpr{
+		GreaterThanExpr{
+			FuncExpr{MathFuncAdd, []Expression{FieldExpr{Root: 0, Path: []string{"age"}}, ValueExpr{2}}},
+			ValueExpr{40},
+		},
+		EqualsExpr{FieldExpr{Root: 0, Path: []string{"name"}}, ValueExpr{"Neil"}},
+	}})
+
+	assert.Equal(`0: skip [1] -> 7
+1: load @
+2: load (int)2
+3: call func:mathAdd
+4: load (int)40
+5: gt [1]
+6: exit resolved`, def.ParseNode.Elems["age"].program.String())
+
+	assert.Equal(`0: skip [2] -> 3
+1: eq @? (jsonString)"Neil" [2]
+2: exit resolved`, def.ParseNode.Elems["name"].program.String())
+
+	assert.Nil(def.ParseNode.program)
+	assert.Equal(len(def.MatchTree.data), def.MatchTree.data[0].SubtreeEnd)
+}
+
+func TestMatchProgramUncompiledDef(t *testing.T) {
+	assert := assert.New(t)
+
+	// Definitions built by hand are compiled when the first matcher is created
+	def := &MatchDef{
+		ParseNode: &ExecNode{
+			Elems: map[string]*ExecNode{
+				"age": {
+					Ops: []OpNode{
+						{BucketIdx: 0, Op: OpTypeGreaterThan, Rhs: NewIntFastVal(30)},
+					},
+				},
+			},
+		},
+		MatchTree:    binTree{data: []binTreeNode{*NewBinTreeNode(nodeTypeLeaf, 0, 0, 0)}},
+		MatchBuckets: []int{0},
+		NumBuckets:   1,
+	}
+
+	m := NewFastMatcher(def)
+	assert.True(def.compiled)
+
+	matched, err := m.Match([]byte(`{"name":"Brett","age":31}`))
+	assert.Nil(err)
+	assert.True(matched)
+
+	m = NewFastMatcher(def)
+	matched, err = m.Match([]byte(`{"name":"Neil","age":29}`))
+	assert.Nil(err)
+	assert.False(matched)
+}
+
+func TestMatchProgramEqualsLiteral(t *testing.T) {
+	assert := assert.New(t)
+
+	var trans Transformer
+	def := trans.Transform([]Expression{OrExpr{
+		EqualsExpr{FieldExpr{Root: 0, Path: []string{"name"}}, ValueExpr{"Néil"}},
+		EqualsExpr{FieldExpr{Root: 0, Path: []string{"quote"}}, ValueExpr{"a\"b"}},
+	}})
+
+	// Literals which need escaping are still compared as JSON strings
+	assert.Equal(`0: skip [1] -> 3
+1: eq @? (jsonString)"Néil" [1]
+2: exit resolved`, def.ParseNode.Elems["name"].program.String())
+	assert.Equal(`0: skip [2] -> 5
+1: load @?
+2: load (jsonString)"a\"b"
+3: eq [2]
+4: exit resolved`, def.ParseNode.Elems["quote"].program.String())
+
+	m := NewFastMatcher(def)
+	docs := map[string]bool{
+		`{"name":"Néil"}`:      true,
+		`{"name":"N\u00e9il"}`: true,
+		`{"name":"Neil"}`:      false,
+		`{"name":"Néil2"}`:     false,
+		`{"name":14}`:          false,
+		`{"name":["Néil"]}`:    false,
+		`{"quote":"a\"b"}`:     true,
+		`{"quote":"ab"}`:       false,
+		`{}`:                   false,
+	}
+	for doc, expected := range docs {
+		m.Reset()
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err)
+		assert.Equal(expected, matched, doc)
+	}
+}
+
+func TestCompareIntDigits(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		lhs, rhs string
+		res      int
+		ok       bool
+	}{
+		{"0", "0", 0, true},
+		{"31", "30", 1, true},
+		{"30", "31", -1, true},
+		{"9", "10", -1, true},
+		{"-9", "-10", 1, true},
+		{"-1", "0", -1, true},
+		{"5", "-500", 1, true},
+		{"123456789012345678", "123456789012345678", 0, true},
+		{"1234567890123456789", "1", 0, false},
+		{"-0", "0", 0, false},
+		{"007", "7", 0, false},
+		{"1.5", "1", 0, false},
+		{"", "1", 0, false},
+		{"-", "1", 0, false},
+	}
+	for _, test := range tests {
+		res, ok := compareIntDigits([]byte(test.lhs), []byte(test.rhs))
+		assert.Equal(test.ok, ok, "%s vs %s", test.lhs, test.rhs)
+		if test.ok {
+			assert.Equal(test.res, res, "%s vs %s", test.lhs, test.rhs)
+		}
+	}
+}
+
+func TestMatchProgramCompareInt(t *testing.T) {
+	assert := assert.New(t)
+
+	var trans Transformer
+	def := trans.Transform([]Expression{AndExpr{
+		GreaterEqualsExpr{FieldExpr{Root: 0, Path: []string{"age"}}, ValueExpr{30}},
+		LessThanExpr{FieldExpr{Root: 0, Path: []string{"age"}}, ValueExpr{40}},
+	}})
+
+	assert.Equal(`0: skip [1] -> 3
+1: gte @? (int)30 [1]
+2: exit resolved
+3: skip [2] -> 6
+4: lt @? (int)40 [2]
+5: exit resolved`, def.ParseNode.Elems["age"].program.String())
+
+	docs := map[string]bool{
+		`{"age":30}`:      true,
+		`{"age":39}`:      true,
+		`{"age":40}`:      false,
+		`{"age":4}`:       false,
+		`{"age":-35}`:     false,
+		`{"age":35.5}`:    true,
+		`{"age":3.5e1}`:   true,
+		`{"age":"35"}`:    false,
+		`{"age":null}`:    false,
+		`{"name":"Neil"}`: false,
+	}
+	for doc, expected := range docs {
+		m := NewFastMatcher(def)
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err)
+		assert.Equal(expected, matched, doc)
+
+		// Integers in BSON are not text, so are always parsed
+		m = NewBSONMatcher(def)
+		matched, err = m.Match(jsonToBson(t, []byte(doc)))
+		assert.Nil(err)
+		assert.Equal(expected, matched, doc)
+	}
+}
+
+func TestMatchProgramSharedFuncs(t *testing.T) {
+	assert := assert.New(t)
+
+	total := FuncExpr{MathFuncMul, []Expression{
+		FieldExpr{Root: 0, Path: []string{"price"}},
+		FieldExpr{Root: 0, Path: []string{"qty"}},
+	}}
+	var trans Transformer
+	def := trans.Transform([]Expression{AndExpr{
+		GreaterThanExpr{total, ValueExpr{100}},
+		LessThanExpr{total, ValueExpr{500}},
+	}})
+
+	// The product is only computed by whichever comparison runs first
+	assert.Equal(`0: skip [1] -> 9
+1: load local 0 or continue -> 6
+2: load $1
+3: load $2
+4: call func:mathMultiply
+5: store local 0
+6: load (int)100
+7: gt [1]
+8: exit resolved
+9: skip [2] -> 18
+10: load local 0 or continue -> 15
+11: load $1
+12: load $2
+13: call func:mathMultiply
+14: store local 0
+15: load (int)500
+16: lt [2]
+17: exit resolved`, def.ParseNode.After.program.String())
+
+	m := NewFastMatcher(def)
+	tests := map[string]bool{
+		`{"price":20,"qty":6}`:  true,
+		`{"price":20,"qty":5}`:  false,
+		`{"price":100,"qty":5}`: false,
+		`{"qty":6,"price":50}`:  true,
+	}
+	for doc, expected := range tests {
+		m.Reset()
+		matched, err := m.Match([]byte(doc))
+		assert.Nil(err, doc)
+		assert.Equal(expected, matched, doc)
+	}
+}
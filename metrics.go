@@ -0,0 +1,90 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import "time"
+
+// MetricsCounter is a metric which only goes up, such as a
+// prometheus.Counter
+type MetricsCounter interface {
+	Inc()
+}
+
+// MetricsGauge is a metric which goes up and down, such as a
+// prometheus.Gauge
+type MetricsGauge interface {
+	Inc()
+	Dec()
+}
+
+// MetricsObserver records samples of a value, such as a prometheus.Histogram
+// or prometheus.Summary
+type MetricsObserver interface {
+	Observe(float64)
+}
+
+// CounterFunc adapts a function to a MetricsCounter, for registries which
+// are not written against these interfaces
+type CounterFunc func()
+
+func (fn CounterFunc) Inc() {
+	fn()
+}
+
+// ObserverFunc adapts a function to a MetricsObserver
+type ObserverFunc func(float64)
+
+func (fn ObserverFunc) Observe(value float64) {
+	fn(value)
+}
+
+// MatcherMetrics holds the metrics a FastMatcher updates for each document
+// it matches, set with FastMatcher.SetMetrics.  Any of them can be left nil.
+// Metrics shared between matchers on different goroutines must be safe for
+// concurrent use, which those of Prometheus are.
+type MatcherMetrics struct {
+	// Documents which matched, did not match, or failed to match, so that
+	// each document counts towards exactly one of them
+	Matches MetricsCounter
+	Misses  MetricsCounter
+	Errors  MetricsCounter
+	// The time taken to evaluate each document, in seconds as Prometheus
+	// expects durations to be given
+	EvalSeconds MetricsObserver
+	// The documents being evaluated at the moment
+	InFlight MetricsGauge
+}
+
+func (metrics *MatcherMetrics) start() {
+	if metrics.InFlight != nil {
+		metrics.InFlight.Inc()
+	}
+}
+
+// record updates the metrics for a document, which may be nil
+func (metrics *MatcherMetrics) record(matched bool, err error, elapsed time.Duration) {
+	if metrics == nil {
+		return
+	}
+
+	var counter MetricsCounter
+	if err != nil {
+		counter = metrics.Errors
+	} else if matched {
+		counter = metrics.Matches
+	} else {
+		counter = metrics.Misses
+	}
+	if counter != nil {
+		counter.Inc()
+	}
+	if metrics.EvalSeconds != nil {
+		metrics.EvalSeconds.Observe(elapsed.Seconds())
+	}
+}
+
+func (metrics *MatcherMetrics) finish() {
+	if metrics.InFlight != nil {
+		metrics.InFlight.Dec()
+	}
+}
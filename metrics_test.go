@@ -0,0 +1,72 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testGauge struct {
+	value, max int
+}
+
+func (g *testGauge) Inc() {
+	g.value++
+	if g.value > g.max {
+		g.max = g.value
+	}
+}
+
+func (g *testGauge) Dec() {
+	g.value--
+}
+
+func TestMatcherMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	var matches, misses, errors int
+	var samples []float64
+	inFlight := &testGauge{}
+	metrics := &MatcherMetrics{
+		Matches:     CounterFunc(func() { matches++ }),
+		Misses:      CounterFunc(func() { misses++ }),
+		Errors:      CounterFunc(func() { errors++ }),
+		EvalSeconds: ObserverFunc(func(value float64) { samples = append(samples, value) }),
+		InFlight:    inFlight,
+	}
+
+	matcher, err := GetFilterExpressionMatcher(`a = 1`)
+	assert.Nil(err)
+	m := matcher.(*FastMatcher)
+	m.SetMetrics(metrics)
+	for _, doc := range []string{`{"a":1}`, `{"a":2}`, `{"a":x}`, ``, `{"a":1}`} {
+		m.Reset()
+		m.Match([]byte(doc))
+	}
+	assert.Equal(2, matches)
+	assert.Equal(2, misses)
+	assert.Equal(1, errors)
+	assert.Equal(5, len(samples))
+	for _, sample := range samples {
+		assert.True(sample >= 0 && sample < 1)
+	}
+	assert.Equal(0, inFlight.value)
+	assert.Equal(1, inFlight.max)
+
+	// Metrics left nil are skipped, and the matcher stops updating them once
+	// they are unset
+	m.SetMetrics(&MatcherMetrics{Matches: CounterFunc(func() { matches++ })})
+	m.Reset()
+	matched, err := m.Match([]byte(`{"a":2}`))
+	assert.Nil(err)
+	assert.False(matched)
+	m.SetMetrics(nil)
+	m.Reset()
+	matched, err = m.Match([]byte(`{"a":1}`))
+	assert.Nil(err)
+	assert.True(matched)
+	assert.Equal(2, matches)
+	assert.Equal(2, misses)
+}
@@ -0,0 +1,359 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var mongoArrayIndexRegex *regexp.Regexp = regexp.MustCompile(`^[0-9]+$`)
+
+type mongoQueryConverter struct {
+	nextVar VariableID
+}
+
+func (c *mongoQueryConverter) allocVar() VariableID {
+	c.nextVar++
+	return c.nextVar
+}
+
+func mongoFieldPath(root VariableID, name string) FieldExpr {
+	field := FieldExpr{Root: root}
+	for _, elem := range strings.Split(name, ".") {
+		if mongoArrayIndexRegex.MatchString(elem) {
+			elem = "[" + elem + "]"
+		}
+		field.Path = append(field.Path, elem)
+	}
+	return field
+}
+
+func mongoSortedKeys(doc map[string]interface{}) []string {
+	var keys []string
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func mongoJoinAnd(exprs []Expression) Expression {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return AndExpr(exprs)
+}
+
+func mongoScalar(value interface{}) (ValueExpr, error) {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return ValueExpr{}, fmt.Errorf("%v: matching against embedded documents or arrays", ErrorMongoUnsupported)
+	}
+	return ValueExpr{value}, nil
+}
+
+// Mongo compares a field against each element of an array as well as the
+// field itself, so a value predicate matches either of them
+func (c *mongoQueryConverter) matchValue(field FieldExpr, pred func(Expression) Expression) Expression {
+	varID := c.allocVar()
+	return OrExpr{
+		pred(field),
+		AnyInExpr{varID, field, pred(FieldExpr{varID, nil})},
+	}
+}
+
+func (c *mongoQueryConverter) convertQuery(root VariableID, query map[string]interface{}) (Expression, error) {
+	var exprs []Expression
+
+	for _, key := range mongoSortedKeys(query) {
+		value := query[key]
+
+		var expr Expression
+		var err error
+		switch key {
+		case "$and", "$or", "$nor":
+			expr, err = c.convertLogical(root, key, value)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, fmt.Errorf("%v: %v", ErrorMongoUnsupported, key)
+			}
+			expr, err = c.convertField(mongoFieldPath(root, key), value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+
+	if len(exprs) == 0 {
+		return TrueExpr{}, nil
+	}
+	return mongoJoinAnd(exprs), nil
+}
+
+func (c *mongoQueryConverter) convertLogical(root VariableID, op string, value interface{}) (Expression, error) {
+	clauses, ok := value.([]interface{})
+	if !ok || len(clauses) == 0 {
+		return nil, fmt.Errorf("%v requires a non-empty array", op)
+	}
+
+	var exprs []Expression
+	for _, clause := range clauses {
+		clauseDoc, ok := clause.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v requires an array of query documents", op)
+		}
+		expr, err := c.convertQuery(root, clauseDoc)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+
+	switch op {
+	case "$and":
+		return mongoJoinAnd(exprs), nil
+	case "$or":
+		return OrExpr(exprs), nil
+	default:
+		return NotExpr{OrExpr(exprs)}, nil
+	}
+}
+
+func isMongoOperatorDoc(doc map[string]interface{}) bool {
+	for key := range doc {
+		if strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *mongoQueryConverter) convertField(field FieldExpr, value interface{}) (Expression, error) {
+	if opDoc, ok := value.(map[string]interface{}); ok && isMongoOperatorDoc(opDoc) {
+		return c.convertOperators(field, opDoc)
+	}
+	return c.convertEquals(field, value)
+}
+
+func (c *mongoQueryConverter) convertEquals(field FieldExpr, value interface{}) (Expression, error) {
+	// null matches both null values and missing fields
+	if value == nil {
+		return OrExpr{
+			EqualsExpr{field, ValueExpr{nil}},
+			NotExistsExpr{field},
+		}, nil
+	}
+
+	valueExpr, err := mongoScalar(value)
+	if err != nil {
+		return nil, err
+	}
+	return c.matchValue(field, func(lhs Expression) Expression {
+		return EqualsExpr{lhs, valueExpr}
+	}), nil
+}
+
+func (c *mongoQueryConverter) convertOperators(field FieldExpr, ops map[string]interface{}) (Expression, error) {
+	var exprs []Expression
+
+	for _, op := range mongoSortedKeys(ops) {
+		value := ops[op]
+
+		var expr Expression
+		var err error
+		switch op {
+		case "$eq":
+			expr, err = c.convertEquals(field, value)
+		case "$ne":
+			expr, err = c.convertEquals(field, value)
+			expr = NotExpr{expr}
+		case "$gt", "$gte", "$lt", "$lte":
+			expr, err = c.convertRange(field, op, value)
+		case "$in":
+			expr, err = c.convertIn(field, value)
+		case "$nin":
+			expr, err = c.convertIn(field, value)
+			expr = NotExpr{expr}
+		case "$all":
+			expr, err = c.convertAll(field, value)
+		case "$exists":
+			exists, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("$exists requires a boolean")
+			}
+			if exists {
+				expr = ExistsExpr{field}
+			} else {
+				expr = NotExistsExpr{field}
+			}
+		case "$regex":
+			expr, err = c.convertRegex(field, value, ops["$options"])
+		case "$options":
+			if _, ok := ops["$regex"]; !ok {
+				return nil, fmt.Errorf("$options requires $regex")
+			}
+			continue
+		case "$not":
+			subOps, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("$not requires an operator document")
+			}
+			expr, err = c.convertOperators(field, subOps)
+			expr = NotExpr{expr}
+		case "$elemMatch":
+			expr, err = c.convertElemMatch(field, value)
+		default:
+			return nil, fmt.Errorf("%v: %v", ErrorMongoUnsupported, op)
+		}
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+
+	return mongoJoinAnd(exprs), nil
+}
+
+func (c *mongoQueryConverter) convertRange(field FieldExpr, op string, value interface{}) (Expression, error) {
+	valueExpr, err := mongoScalar(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.matchValue(field, func(lhs Expression) Expression {
+		switch op {
+		case "$gt":
+			return GreaterThanExpr{lhs, valueExpr}
+		case "$gte":
+			return GreaterEqualsExpr{lhs, valueExpr}
+		case "$lt":
+			return LessThanExpr{lhs, valueExpr}
+		default:
+			return LessEqualsExpr{lhs, valueExpr}
+		}
+	}), nil
+}
+
+func (c *mongoQueryConverter) convertIn(field FieldExpr, value interface{}) (Expression, error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("$in requires an array")
+	}
+	if len(values) == 0 {
+		return FalseExpr{}, nil
+	}
+
+	var exprs OrExpr
+	for _, value := range values {
+		expr, err := c.convertEquals(field, value)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (c *mongoQueryConverter) convertAll(field FieldExpr, value interface{}) (Expression, error) {
+	values, ok := value.([]interface{})
+	if !ok || len(values) == 0 {
+		return nil, fmt.Errorf("$all requires a non-empty array")
+	}
+
+	var exprs []Expression
+	for _, value := range values {
+		expr, err := c.convertEquals(field, value)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	return mongoJoinAnd(exprs), nil
+}
+
+func (c *mongoQueryConverter) convertRegex(field FieldExpr, value, options interface{}) (Expression, error) {
+	pattern, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("$regex requires a string")
+	}
+
+	if options != nil {
+		optStr, ok := options.(string)
+		if !ok {
+			return nil, fmt.Errorf("$options requires a string")
+		}
+		var flags string
+		for _, opt := range optStr {
+			switch opt {
+			case 'i', 'm', 's':
+				flags += string(opt)
+			default:
+				return nil, fmt.Errorf("%v: regex option %c", ErrorMongoUnsupported, opt)
+			}
+		}
+		if len(flags) > 0 {
+			pattern = "(?" + flags + ")" + pattern
+		}
+	}
+
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, newFilterExpressionError(ErrBadRegex, "Invalid regular expression %v: %v", pattern, err)
+	}
+
+	return c.matchValue(field, func(lhs Expression) Expression {
+		return LikeExpr{lhs, RegexExpr{pattern}}
+	}), nil
+}
+
+func (c *mongoQueryConverter) convertElemMatch(field FieldExpr, value interface{}) (Expression, error) {
+	query, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("$elemMatch requires a query document")
+	}
+
+	varID := c.allocVar()
+	var subExpr Expression
+	var err error
+	if isMongoOperatorDoc(query) {
+		// Operators apply directly to the elements, e.g. {$gte: 80, $lt: 85}
+		subExpr, err = c.convertOperators(FieldExpr{varID, nil}, query)
+	} else {
+		subExpr, err = c.convertQuery(varID, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return AnyInExpr{varID, field, subExpr}, nil
+}
+
+// ParseMongoQuery converts a MongoDB style filter document into an expression
+func ParseMongoQuery(q []byte) (Expression, error) {
+	var query map[string]interface{}
+	if err := json.Unmarshal(q, &query); err != nil {
+		return nil, err
+	}
+
+	converter := &mongoQueryConverter{}
+	return converter.convertQuery(0, query)
+}
+
+func MatcherFromMongoQuery(q []byte) (Matcher, error) {
+	expr, err := ParseMongoQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	var trans Transformer
+	matchDef := trans.Transform([]Expression{expr})
+
+	return NewFastMatcher(matchDef), nil
+}
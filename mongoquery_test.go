@@ -0,0 +1,76 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func runMongoQueryMatchTest(t *testing.T, query string, expectedDocIDs []string) {
+	expr, err := ParseMongoQuery([]byte(query))
+	if err != nil {
+		t.Fatalf("Failed to parse %v: %v", query, err)
+	}
+
+	runExprMatchTest(t, expr, expectedDocIDs)
+}
+
+func TestMongoQueryMatcher(t *testing.T) {
+	runMongoQueryMatchTest(t, `{"age": 29}`, []string{
+		"5b47eb0936ff92a567a0307e",
+		"5b47eb095c3ad73b9925f7f8",
+	})
+
+	runMongoQueryMatchTest(t, `{"tags": {"$in": ["cillum", "dolor"]}}`, []string{
+		"5b47eb0936ff92a567a0307e",
+		"5b47eb096b1d911c0b9492fb",
+		"5b47eb09ffac5a6ce37042e7",
+		"5b47eb095c3ad73b9925f7f8",
+	})
+
+	runMongoQueryMatchTest(t, `{"tags": {"$all": ["cillum", "esse"]}}`, []string{
+		"5b47eb0936ff92a567a0307e",
+	})
+
+	runMongoQueryMatchTest(t, `{"friends": {"$elemMatch": {"id": 1, "name": {"$regex": "^W"}}}}`, []string{
+		"5b47eb0936ff92a567a0307e",
+		"5b47eb096b1d911c0b9492fb",
+	})
+
+	runMongoQueryMatchTest(t, `{"age": {"$gte": 30}, "eyeColor": {"$nin": ["brown", "blue"]}}`, []string{
+		"5b47eb09996a4154c35b2f98",
+		"5b47eb098eee4b4c4330ec64",
+	})
+
+	runMongoQueryMatchTest(t, `{"gender": "male", "$or": [{"age": {"$lt": 25}}, {"isActive": true}]}`, []string{
+		"5b47eb095c3ad73b9925f7f8",
+		"5b47eb0962222a37d066e231",
+		"5b47eb09996a4154c35b2f98",
+		"5b47eb098eee4b4c4330ec64",
+	})
+
+	runMongoQueryMatchTest(t, `{"name": {"$regex": "^d", "$options": "i"}}`, []string{
+		"5b47eb0936ff92a567a0307e",
+		"5b47eb095c3ad73b9925f7f8",
+	})
+
+	runMongoQueryMatchTest(t, `{"notAField": {"$exists": true}}`, []string{})
+}
+
+func TestMongoQueryErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := ParseMongoQuery([]byte(`{"a": {"$size": 2}}`))
+	assert.NotNil(err)
+	_, err = ParseMongoQuery([]byte(`{"$where": "this.a > 1"}`))
+	assert.NotNil(err)
+	_, err = ParseMongoQuery([]byte(`{"a": {"b": 1}}`))
+	assert.NotNil(err)
+	_, err = ParseMongoQuery([]byte(`{"a": {"$regex": "["}}`))
+	assert.NotNil(err)
+
+	expr, err := ParseMongoQuery([]byte(`{"a.0.b": {"$exists": false}}`))
+	assert.Nil(err)
+	assert.Equal(NotExistsExpr{FieldExpr{0, []string{"a", "[0]", "b"}}}, expr)
+}
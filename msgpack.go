@@ -0,0 +1,341 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	msgpackNil      = 0xc0
+	msgpackFalse    = 0xc2
+	msgpackTrue     = 0xc3
+	msgpackBin8     = 0xc4
+	msgpackBin16    = 0xc5
+	msgpackBin32    = 0xc6
+	msgpackExt8     = 0xc7
+	msgpackExt16    = 0xc8
+	msgpackExt32    = 0xc9
+	msgpackFloat32  = 0xca
+	msgpackFloat64  = 0xcb
+	msgpackUint8    = 0xcc
+	msgpackUint16   = 0xcd
+	msgpackUint32   = 0xce
+	msgpackUint64   = 0xcf
+	msgpackInt8     = 0xd0
+	msgpackInt16    = 0xd1
+	msgpackInt32    = 0xd2
+	msgpackInt64    = 0xd3
+	msgpackFixExt1  = 0xd4
+	msgpackFixExt2  = 0xd5
+	msgpackFixExt4  = 0xd6
+	msgpackFixExt8  = 0xd7
+	msgpackFixExt16 = 0xd8
+	msgpackStr8     = 0xd9
+	msgpackStr16    = 0xda
+	msgpackStr32    = 0xdb
+	msgpackArray16  = 0xdc
+	msgpackArray32  = 0xdd
+	msgpackMap16    = 0xde
+	msgpackMap32    = 0xdf
+
+	msgpackExtTimestamp = -1
+
+	// Guards against stack exhaustion on hostile input
+	msgpackMaxDepth = 512
+)
+
+// msgpackTokenizer produces the JSON token sequence for a MessagePack value.
+// Binary data becomes a base64 string, timestamps become RFC3339 strings
+// usable with DATE(), and other extension types are matched as null.
+type msgpackTokenizer struct {
+	tokenStream
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (tkn *msgpackTokenizer) Reset(data []byte) {
+	tkn.reset()
+	tkn.data = data
+	tkn.pos = 0
+	tkn.depth = 0
+	if len(data) == 0 {
+		return
+	}
+
+	if err := tkn.decodeValue(); err != nil {
+		tkn.err = err
+	} else if tkn.pos != len(data) {
+		tkn.err = ErrorMsgpackMalformed
+	}
+}
+
+// read consumes the next n bytes of the input
+func (tkn *msgpackTokenizer) read(n uint64) ([]byte, error) {
+	if uint64(len(tkn.data)-tkn.pos) < n {
+		return nil, ErrorMsgpackMalformed
+	}
+	value := tkn.data[tkn.pos : tkn.pos+int(n)]
+	tkn.pos += int(n)
+	return value, nil
+}
+
+// readUint reads a big endian unsigned integer of the given byte size
+func (tkn *msgpackTokenizer) readUint(size int) (uint64, error) {
+	data, err := tkn.read(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value, nil
+}
+
+func (tkn *msgpackTokenizer) readKey() error {
+	if tkn.pos >= len(tkn.data) {
+		return ErrorMsgpackMalformed
+	}
+	format := tkn.data[tkn.pos]
+
+	var length uint64
+	var err error
+	switch {
+	case format>>5 == 0x05:
+		tkn.pos++
+		length = uint64(format & 0x1f)
+	case format == msgpackStr8 || format == msgpackBin8:
+		tkn.pos++
+		length, err = tkn.readUint(1)
+	case format == msgpackStr16 || format == msgpackBin16:
+		tkn.pos++
+		length, err = tkn.readUint(2)
+	case format == msgpackStr32 || format == msgpackBin32:
+		tkn.pos++
+		length, err = tkn.readUint(4)
+	default:
+		// Integer keys are matched by their decimal representation
+		start := len(tkn.tokens)
+		if err := tkn.decodeValue(); err != nil {
+			return err
+		}
+		keyToken := tkn.tokens[start]
+		tkn.tokens = tkn.tokens[:start]
+		switch keyToken.token {
+		case tknInteger:
+			value := int64(binary.LittleEndian.Uint64(keyToken.data))
+			tkn.key(strconv.AppendInt(tkn.scratchBytes(20)[:0], value, 10))
+		case tknNumber:
+			value := math.Float64frombits(binary.LittleEndian.Uint64(keyToken.data))
+			if value < 0 || value != math.Trunc(value) {
+				return fmt.Errorf("%v: non-integer map key", ErrorMsgpackUnsupported)
+			}
+			tkn.key(strconv.AppendUint(tkn.scratchBytes(20)[:0], uint64(value), 10))
+		default:
+			return fmt.Errorf("%v: map key of format 0x%02x", ErrorMsgpackUnsupported, format)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	name, err := tkn.read(length)
+	if err != nil {
+		return err
+	}
+	tkn.key(name)
+	return nil
+}
+
+func (tkn *msgpackTokenizer) decodeArray(length uint64) error {
+	tkn.beginArray()
+	for i := uint64(0); i < length; i++ {
+		if err := tkn.decodeValue(); err != nil {
+			return err
+		}
+	}
+	tkn.end()
+	return nil
+}
+
+func (tkn *msgpackTokenizer) decodeMap(length uint64) error {
+	tkn.beginObject()
+	for i := uint64(0); i < length; i++ {
+		if err := tkn.readKey(); err != nil {
+			return err
+		}
+		if err := tkn.decodeValue(); err != nil {
+			return err
+		}
+	}
+	tkn.end()
+	return nil
+}
+
+func (tkn *msgpackTokenizer) decodeString(length uint64) error {
+	value, err := tkn.read(length)
+	if err != nil {
+		return err
+	}
+	tkn.stringValue(value)
+	return nil
+}
+
+func (tkn *msgpackTokenizer) decodeBinary(length uint64) error {
+	value, err := tkn.read(length)
+	if err != nil {
+		return err
+	}
+	encoded := tkn.scratchBytes(base64.StdEncoding.EncodedLen(len(value)))
+	base64.StdEncoding.Encode(encoded, value)
+	tkn.stringValue(encoded)
+	return nil
+}
+
+func (tkn *msgpackTokenizer) decodeExt(length uint64) error {
+	extType, err := tkn.read(1)
+	if err != nil {
+		return err
+	}
+	data, err := tkn.read(length)
+	if err != nil {
+		return err
+	}
+
+	if int8(extType[0]) != msgpackExtTimestamp {
+		tkn.nullValue()
+		return nil
+	}
+
+	var timeVal time.Time
+	switch len(data) {
+	case 4:
+		timeVal = time.Unix(int64(binary.BigEndian.Uint32(data)), 0)
+	case 8:
+		packed := binary.BigEndian.Uint64(data)
+		timeVal = time.Unix(int64(packed&0x3ffffffff), int64(packed>>34))
+	case 12:
+		nanos := binary.BigEndian.Uint32(data)
+		timeVal = time.Unix(int64(binary.BigEndian.Uint64(data[4:])), int64(nanos))
+	default:
+		return ErrorMsgpackMalformed
+	}
+	encoded := tkn.scratchBytes(len(time.RFC3339Nano) + 8)
+	tkn.stringValue(timeVal.UTC().AppendFormat(encoded[:0], time.RFC3339Nano))
+	return nil
+}
+
+func (tkn *msgpackTokenizer) decodeValue() error {
+	tkn.depth++
+	defer func() { tkn.depth-- }()
+	if tkn.depth > msgpackMaxDepth {
+		return ErrorMsgpackMalformed
+	}
+
+	if tkn.pos >= len(tkn.data) {
+		return ErrorMsgpackMalformed
+	}
+	format := tkn.data[tkn.pos]
+	tkn.pos++
+
+	switch {
+	case format <= 0x7f:
+		tkn.intValue(int64(format))
+		return nil
+	case format>>4 == 0x08:
+		return tkn.decodeMap(uint64(format & 0x0f))
+	case format>>4 == 0x09:
+		return tkn.decodeArray(uint64(format & 0x0f))
+	case format>>5 == 0x05:
+		return tkn.decodeString(uint64(format & 0x1f))
+	case format >= 0xe0:
+		tkn.intValue(int64(int8(format)))
+		return nil
+	}
+
+	sizedValue := func(size int, handler func(uint64) error) error {
+		value, err := tkn.readUint(size)
+		if err != nil {
+			return err
+		}
+		return handler(value)
+	}
+
+	switch format {
+	case msgpackNil:
+		tkn.nullValue()
+	case msgpackFalse:
+		tkn.boolValue(false)
+	case msgpackTrue:
+		tkn.boolValue(true)
+	case msgpackBin8:
+		return sizedValue(1, tkn.decodeBinary)
+	case msgpackBin16:
+		return sizedValue(2, tkn.decodeBinary)
+	case msgpackBin32:
+		return sizedValue(4, tkn.decodeBinary)
+	case msgpackExt8:
+		return sizedValue(1, tkn.decodeExt)
+	case msgpackExt16:
+		return sizedValue(2, tkn.decodeExt)
+	case msgpackExt32:
+		return sizedValue(4, tkn.decodeExt)
+	case msgpackFloat32:
+		return sizedValue(4, func(bits uint64) error {
+			tkn.floatValue(float64(math.Float32frombits(uint32(bits))))
+			return nil
+		})
+	case msgpackFloat64:
+		return sizedValue(8, func(bits uint64) error {
+			tkn.floatValue(math.Float64frombits(bits))
+			return nil
+		})
+	case msgpackUint8, msgpackUint16, msgpackUint32, msgpackUint64:
+		return sizedValue(1<<(format-msgpackUint8), func(value uint64) error {
+			tkn.uintValue(value)
+			return nil
+		})
+	case msgpackInt8, msgpackInt16, msgpackInt32, msgpackInt64:
+		size := 1 << (format - msgpackInt8)
+		return sizedValue(size, func(value uint64) error {
+			// Sign extend from the encoded width
+			shift := uint(64 - 8*size)
+			tkn.intValue(int64(value<<shift) >> shift)
+			return nil
+		})
+	case msgpackFixExt1, msgpackFixExt2, msgpackFixExt4, msgpackFixExt8, msgpackFixExt16:
+		return tkn.decodeExt(1 << (format - msgpackFixExt1))
+	case msgpackStr8:
+		return sizedValue(1, tkn.decodeString)
+	case msgpackStr16:
+		return sizedValue(2, tkn.decodeString)
+	case msgpackStr32:
+		return sizedValue(4, tkn.decodeString)
+	case msgpackArray16:
+		return sizedValue(2, tkn.decodeArray)
+	case msgpackArray32:
+		return sizedValue(4, tkn.decodeArray)
+	case msgpackMap16:
+		return sizedValue(2, tkn.decodeMap)
+	case msgpackMap32:
+		return sizedValue(4, tkn.decodeMap)
+	default:
+		return fmt.Errorf("%v: format 0x%02x", ErrorMsgpackUnsupported, format)
+	}
+
+	return nil
+}
+
+// NewMsgpackMatcher returns a matcher which evaluates documents encoded as
+// MessagePack
+func NewMsgpackMatcher(def *MatchDef) *FastMatcher {
+	return newFastMatcherWithTokenizer(def, &msgpackTokenizer{})
+}
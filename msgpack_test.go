@@ -0,0 +1,169 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func msgpackAppendUint(out []byte, format byte, size int, value uint64) []byte {
+	out = append(out, format)
+	for shift := 8 * (size - 1); shift >= 0; shift -= 8 {
+		out = append(out, byte(value>>uint(shift)))
+	}
+	return out
+}
+
+func msgpackAppendValue(out []byte, value interface{}) []byte {
+	switch value := value.(type) {
+	case nil:
+		return append(out, msgpackNil)
+	case bool:
+		if value {
+			return append(out, msgpackTrue)
+		}
+		return append(out, msgpackFalse)
+	case json.Number:
+		if intVal, err := value.Int64(); err == nil {
+			switch {
+			case intVal >= 0 && intVal <= 0x7f:
+				return append(out, byte(intVal))
+			case intVal >= -32 && intVal < 0:
+				return append(out, byte(int8(intVal)))
+			case intVal >= math.MinInt16 && intVal <= math.MaxInt16:
+				return msgpackAppendUint(out, msgpackInt16, 2, uint64(intVal))
+			}
+			return msgpackAppendUint(out, msgpackInt64, 8, uint64(intVal))
+		}
+		floatVal, _ := value.Float64()
+		return msgpackAppendUint(out, msgpackFloat64, 8, math.Float64bits(floatVal))
+	case string:
+		if len(value) < 32 {
+			out = append(out, 0xa0|byte(len(value)))
+		} else {
+			out = msgpackAppendUint(out, msgpackStr16, 2, uint64(len(value)))
+		}
+		return append(out, value...)
+	case map[string]interface{}:
+		out = msgpackAppendUint(out, msgpackMap16, 2, uint64(len(value)))
+		for _, key := range mongoSortedKeys(value) {
+			out = msgpackAppendValue(out, key)
+			out = msgpackAppendValue(out, value[key])
+		}
+		return out
+	case []interface{}:
+		out = msgpackAppendUint(out, msgpackArray32, 4, uint64(len(value)))
+		for _, elem := range value {
+			out = msgpackAppendValue(out, elem)
+		}
+		return out
+	}
+	panic("unexpected value")
+}
+
+func jsonToMsgpack(t *testing.T, data []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("Failed to decode test document: %v", err)
+	}
+	return msgpackAppendValue(nil, value)
+}
+
+func runMsgpackMatchTest(t *testing.T, expr Expression) {
+	t.Helper()
+
+	var trans Transformer
+	matchDef := trans.Transform([]Expression{expr})
+
+	jsonMatcher := NewFastMatcher(matchDef)
+	msgpackMatcher := NewMsgpackMatcher(matchDef)
+	for _, doc := range getTestPeopleDocs() {
+		jsonMatcher.Reset()
+		expected, err := jsonMatcher.Match(doc)
+		if err != nil {
+			t.Fatalf("JSON matcher error: %v", err)
+		}
+
+		msgpackMatcher.Reset()
+		matched, err := msgpackMatcher.Match(jsonToMsgpack(t, doc))
+		if err != nil {
+			t.Fatalf("MessagePack matcher error: %v", err)
+		}
+
+		if matched != expected {
+			t.Fatalf("MessagePack match result %v differs from JSON for %v", matched, expr)
+		}
+	}
+}
+
+func TestMsgpackMatcherPeople(t *testing.T) {
+	runMsgpackMatchTest(t, AndExpr{
+		GreaterThanExpr{FieldExpr{0, []string{"age"}}, ValueExpr{25}},
+		EqualsExpr{FieldExpr{0, []string{"isActive"}}, ValueExpr{true}},
+	})
+	runMsgpackMatchTest(t, OrExpr{
+		EqualsExpr{FieldExpr{0, []string{"name"}}, ValueExpr{"Daphne Sutton"}},
+		LessThanExpr{FieldExpr{0, []string{"latitude"}}, ValueExpr{-50.5}},
+	})
+	runMsgpackMatchTest(t, AnyInExpr{1, FieldExpr{0, []string{"friends"}},
+		LikeExpr{FieldExpr{1, []string{"name"}}, RegexExpr{"^G"}}})
+	runMsgpackMatchTest(t, EveryInExpr{1, FieldExpr{0, []string{"tags"}},
+		NotEqualsExpr{FieldExpr{1, nil}, ValueExpr{"ex"}}})
+	runMsgpackMatchTest(t, EqualsExpr{FieldExpr{0, []string{"tags", "[1]"}}, ValueExpr{"laborum"}})
+	runMsgpackMatchTest(t, NotExistsExpr{FieldExpr{0, []string{"sometimesValue"}}})
+	runMsgpackMatchTest(t, EqualsExpr{FieldExpr{0, []string{"sometimesValue"}}, ValueExpr{nil}})
+}
+
+func TestMsgpackMatcherTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	// {"at": timestamp32(1551434400), "bin": bin8("hi"), "f": float32(1.5),
+	//  "n": int8(-100), "u": uint64(1<<40), 7: "seven"}
+	var doc []byte
+	doc = append(doc, 0x86)
+	var seconds [4]byte
+	binary.BigEndian.PutUint32(seconds[:], 1551434400)
+	doc = append(doc, 0xa2, 'a', 't', msgpackFixExt4, 0xff)
+	doc = append(doc, seconds[:]...)
+	doc = append(doc, 0xa3, 'b', 'i', 'n', msgpackBin8, 2, 'h', 'i')
+	doc = append(doc, 0xa1, 'f')
+	doc = msgpackAppendUint(doc, msgpackFloat32, 4, uint64(math.Float32bits(1.5)))
+	doc = append(doc, 0xa1, 'n', msgpackInt8, 0x9c)
+	doc = append(doc, 0xa1, 'u')
+	doc = msgpackAppendUint(doc, msgpackUint64, 8, 1<<40)
+	doc = append(doc, 0x07, 0xa5, 's', 'e', 'v', 'e', 'n')
+
+	expr := AndExpr{
+		EqualsExpr{
+			FuncExpr{DateFunc, []Expression{FieldExpr{0, []string{"at"}}}},
+			FuncExpr{DateFunc, []Expression{ValueExpr{"2019-03-01T10:00:00Z"}}},
+		},
+		EqualsExpr{FieldExpr{0, []string{"bin"}}, ValueExpr{"aGk="}},
+		EqualsExpr{FieldExpr{0, []string{"f"}}, ValueExpr{1.5}},
+		EqualsExpr{FieldExpr{0, []string{"n"}}, ValueExpr{-100}},
+		EqualsExpr{FieldExpr{0, []string{"u"}}, ValueExpr{1 << 40}},
+		EqualsExpr{FieldExpr{0, []string{"7"}}, ValueExpr{"seven"}},
+	}
+
+	var trans Transformer
+	matcher := NewMsgpackMatcher(trans.Transform([]Expression{expr}))
+	matched, err := matcher.Match(doc)
+	assert.Nil(err)
+	assert.True(matched)
+
+	matcher.Reset()
+	_, err = matcher.Match(doc[:len(doc)-3])
+	assert.Equal(ErrorMsgpackMalformed, err)
+
+	matcher.Reset()
+	_, err = matcher.Match([]byte{0x81, 0xa1, 'a', 0xc1})
+	assert.NotNil(err)
+}
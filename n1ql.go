@@ -0,0 +1,420 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var n1qlFuncs map[string]string = map[string]string{
+	MathFuncAbs:     "ABS",
+	MathFuncAcos:    "ACOS",
+	MathFuncAsin:    "ASIN",
+	MathFuncAtan:    "ATAN",
+	MathFuncAtan2:   "ATAN2",
+	MathFuncCeil:    "CEIL",
+	MathFuncCos:     "COS",
+	MathFuncDegrees: "DEGREES",
+	MathFuncE:       "E",
+	MathFuncExp:     "EXP",
+	MathFuncFloor:   "FLOOR",
+	MathFuncLog:     "LOG",
+	MathFuncLn:      "LN",
+	MathFuncLog10:   "LOG", // N1QL only has LOG, which is base 10
+	MathFuncPi:      "PI",
+	MathFuncPow:     "POWER",
+	MathFuncRadians: "RADIANS",
+	MathFuncRound:   "ROUND",
+	MathFuncSin:     "SIN",
+	MathFuncSqrt:    "SQRT",
+	MathFuncTan:     "TAN",
+	// Dates are compared as milliseconds since the epoch
+	DateFunc:       "STR_TO_MILLIS",
+	EncodeJsonFunc: "ENCODE_JSON",
+	// Both give strings, which for RFC3339 dates are in the same format
+	DateTruncFunc:   "DATE_TRUNC_STR",
+	DateWeekdayFunc: "WEEKDAY_STR",
+	NowMillisFunc:   "NOW_MILLIS",
+}
+
+// n1qlVariable names loop variables so they are unlikely to shadow the
+// top level fields of the document
+func n1qlVariable(varID VariableID) string {
+	return fmt.Sprintf("`_v%d`", varID)
+}
+
+func n1qlField(expr FieldExpr) (string, error) {
+	var out string
+	path := expr.Path
+	if expr.Root != 0 {
+		out = n1qlVariable(expr.Root)
+	} else if len(path) == 0 {
+		// N1QL has no way to refer to the document without knowing its alias
+		return "", ErrorN1qlNotRepresentable
+	} else if path[0] == OperatorMeta+"()" {
+		out = path[0]
+		path = path[1:]
+	}
+
+	for _, elem := range path {
+		if fmtArrayIndexRegex.MatchString(elem) {
+			out += elem
+			continue
+		}
+		if strings.Contains(elem, "`") {
+			return "", ErrorN1qlNotRepresentable
+		}
+		if len(out) > 0 {
+			out += "."
+		}
+		out += "`" + elem + "`"
+	}
+
+	if len(out) == 0 || out[0] == '[' {
+		return "", ErrorN1qlNotRepresentable
+	}
+	return out, nil
+}
+
+func n1qlString(value string) (string, error) {
+	// JSON string escapes are also valid in N1QL
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+func n1qlValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "NULL", nil
+	case bool:
+		if value {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case string:
+		return n1qlString(value)
+	case float32:
+		return n1qlValue(float64(value))
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return "", ErrorN1qlNotRepresentable
+		}
+		return strconv.FormatFloat(value, 'g', -1, 64), nil
+	}
+
+	// Unlike the filter expression grammar, N1QL accepts negative literals
+	if numStr, _ := fmtNumber(value); len(numStr) > 0 {
+		return numStr, nil
+	}
+	return "", ErrorN1qlNotRepresentable
+}
+
+func n1qlFunc(expr FuncExpr) (string, error) {
+	if inner, path, ok := decodeJsonOf(expr); ok {
+		innerStr, err := n1qlOperand(inner)
+		if err != nil {
+			return "", err
+		}
+		out := fmt.Sprintf("DECODE_JSON(%s)", innerStr)
+		for _, elem := range path {
+			if fmtArrayIndexRegex.MatchString(elem) {
+				out += elem
+				continue
+			}
+			if strings.Contains(elem, "`") {
+				return "", ErrorN1qlNotRepresentable
+			}
+			out += ".`" + elem + "`"
+		}
+		return out, nil
+	}
+
+	var params []string
+	for _, param := range expr.Params {
+		paramStr, err := n1qlOperand(param)
+		if err != nil {
+			return "", err
+		}
+		params = append(params, paramStr)
+	}
+
+	if opStr, ok := fmtMathOps[expr.FuncName]; ok {
+		if len(params) != 2 {
+			return "", ErrorN1qlNotRepresentable
+		}
+		return fmt.Sprintf("(%s %s %s)", params[0], opStr, params[1]), nil
+	}
+	if expr.FuncName == MathFuncNeg {
+		if len(params) != 1 {
+			return "", ErrorN1qlNotRepresentable
+		}
+		return fmt.Sprintf("-(%s)", params[0]), nil
+	}
+
+	name, ok := n1qlFuncs[expr.FuncName]
+	if !ok {
+		return "", ErrorN1qlNotRepresentable
+	}
+	return fmt.Sprintf("%s(%s)", name, strings.Join(params, ", ")), nil
+}
+
+func n1qlFirst(expr FirstInExpr) (string, error) {
+	resultStr, err := n1qlOperand(expr.ResultExpr)
+	if err != nil {
+		return "", err
+	}
+	inStr, err := n1qlOperand(expr.InExpr)
+	if err != nil {
+		return "", err
+	}
+	if expr.SubExpr == nil {
+		return fmt.Sprintf("FIRST %s FOR %s IN %s END", resultStr, n1qlVariable(expr.VarId), inStr), nil
+	}
+	subStr, err := n1qlCondition(expr.SubExpr)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("FIRST %s FOR %s IN %s WHEN %s END", resultStr, n1qlVariable(expr.VarId), inStr, subStr), nil
+}
+
+func n1qlOperand(expr Expression) (string, error) {
+	switch expr := expr.(type) {
+	case FirstInExpr:
+		return n1qlFirst(expr)
+	case FieldExpr:
+		return n1qlField(expr)
+	case ValueExpr:
+		return n1qlValue(expr.Value)
+	case TimeExpr:
+		timeStr, ok := expr.Time.(string)
+		if !ok {
+			return "", ErrorN1qlNotRepresentable
+		}
+		quoted, err := n1qlString(timeStr)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s(%s)", n1qlFuncs[DateFunc], quoted), nil
+	case FuncExpr:
+		return n1qlFunc(expr)
+	}
+	return "", ErrorN1qlNotRepresentable
+}
+
+func n1qlComparison(op string, lhs, rhs Expression) (string, error) {
+	// The matcher treats comparisons against null as type checks
+	if rhsVal, ok := rhs.(ValueExpr); ok && rhsVal.Value == nil && (op == "=" || op == "!=") {
+		lhs, rhs = rhs, lhs
+	}
+	if lhsVal, ok := lhs.(ValueExpr); ok && lhsVal.Value == nil && (op == "=" || op == "!=") {
+		rhsStr, err := n1qlOperand(rhs)
+		if err != nil {
+			return "", err
+		}
+		if op == "=" {
+			return fmt.Sprintf("%s IS NULL", rhsStr), nil
+		}
+		return fmt.Sprintf("%s IS NOT NULL", rhsStr), nil
+	}
+
+	lhsStr, err := n1qlOperand(lhs)
+	if err != nil {
+		return "", err
+	}
+	rhsStr, err := n1qlOperand(rhs)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s", lhsStr, op, rhsStr), nil
+}
+
+func n1qlJoin(exprs []Expression, op string) (string, error) {
+	if len(exprs) == 0 {
+		if op == "AND" {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	}
+
+	var parts []string
+	for _, subExpr := range exprs {
+		subStr, err := n1qlCondition(subExpr)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, subStr)
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return "(" + strings.Join(parts, " "+op+" ") + ")", nil
+}
+
+func n1qlLoop(kind, rangeOp string, varID VariableID, inExpr, subExpr Expression) (string, error) {
+	inStr, err := n1qlOperand(inExpr)
+	if err != nil {
+		return "", err
+	}
+	subStr, err := n1qlCondition(subExpr)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s %s SATISFIES %s END", kind, n1qlVariable(varID), rangeOp, inStr, subStr), nil
+}
+
+func n1qlCondition(expr Expression) (string, error) {
+	switch expr := expr.(type) {
+	case TrueExpr:
+		return "TRUE", nil
+	case FalseExpr:
+		return "FALSE", nil
+	case AndExpr:
+		return n1qlJoin(expr, "AND")
+	case OrExpr:
+		return n1qlJoin(expr, "OR")
+	case NotExpr:
+		subStr, err := n1qlCondition(expr.SubExpr)
+		if err != nil {
+			return "", err
+		}
+		// A comparison against a missing field is false in the matcher, so
+		// its negation has to be true rather than MISSING
+		return fmt.Sprintf("NOT IFMISSINGORNULL(%s, FALSE)", subStr), nil
+	case ExistsExpr:
+		subStr, err := n1qlOperand(expr.SubExpr)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s IS NOT MISSING", subStr), nil
+	case NotExistsExpr:
+		subStr, err := n1qlOperand(expr.SubExpr)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s IS MISSING", subStr), nil
+	case EqualsExpr:
+		if str, word, ok := tokenMatchOf(expr); ok {
+			strStr, err := n1qlOperand(str)
+			if err != nil {
+				return "", err
+			}
+			wordStr, err := n1qlOperand(word)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("ARRAY_CONTAINS(TOKENS(%s), %s)", strStr, wordStr), nil
+		}
+		return n1qlComparison("=", expr.Lhs, expr.Rhs)
+	case StrictEqualsExpr:
+		// N1QL never converts values between types when comparing them
+		return n1qlComparison("=", expr.Lhs, expr.Rhs)
+	case NotEqualsExpr:
+		return n1qlComparison("!=", expr.Lhs, expr.Rhs)
+	case LessThanExpr:
+		return n1qlComparison("<", expr.Lhs, expr.Rhs)
+	case LessEqualsExpr:
+		return n1qlComparison("<=", expr.Lhs, expr.Rhs)
+	case GreaterThanExpr:
+		return n1qlComparison(">", expr.Lhs, expr.Rhs)
+	case GreaterEqualsExpr:
+		return n1qlComparison(">=", expr.Lhs, expr.Rhs)
+	case LikeExpr:
+		lhsStr, err := n1qlOperand(expr.Lhs)
+		if err != nil {
+			return "", err
+		}
+		var pattern string
+		switch rhs := expr.Rhs.(type) {
+		case RegexExpr:
+			pattern = fmt.Sprintf("%v", rhs.Regex)
+		case ValueExpr:
+			strVal, ok := rhs.Value.(string)
+			if !ok {
+				return "", ErrorN1qlNotRepresentable
+			}
+			pattern = strVal
+		default:
+			// N1QL regular expressions do not support the PCRE syntax
+			return "", ErrorN1qlNotRepresentable
+		}
+		patternStr, err := n1qlString(pattern)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("REGEXP_CONTAINS(%s, %s)", lhsStr, patternStr), nil
+	case AnyInExpr:
+		return n1qlLoop("ANY", "IN", expr.VarId, expr.InExpr, expr.SubExpr)
+	case EveryInExpr:
+		return n1qlLoop("EVERY", "IN", expr.VarId, expr.InExpr, expr.SubExpr)
+	case AnyEveryInExpr:
+		return n1qlLoop("ANY AND EVERY", "IN", expr.VarId, expr.InExpr, expr.SubExpr)
+	case AnyWithinExpr:
+		return n1qlLoop("ANY", "WITHIN", expr.VarId, expr.InExpr, expr.SubExpr)
+	}
+
+	return "", ErrorN1qlNotRepresentable
+}
+
+// ToN1QL produces a N1QL WHERE clause which selects the same documents as
+// the expression.  Fields are referenced without a keyspace alias, and loop
+// variables are named `_v<id>`.  Values of mixed types are ordered using the
+// N1QL collation rules, which can differ from the matcher.
+func ToN1QL(expr Expression) (string, error) {
+	return n1qlCondition(expr)
+}
+
+// n1qlConjuncts flattens nested conjunctions into their clauses
+func n1qlConjuncts(expr Expression) []Expression {
+	andExpr, ok := expr.(AndExpr)
+	if !ok {
+		return []Expression{expr}
+	}
+	var out []Expression
+	for _, subExpr := range andExpr {
+		out = append(out, n1qlConjuncts(subExpr)...)
+	}
+	return out
+}
+
+// SplitN1QL divides an expression into a N1QL WHERE clause which can be
+// pushed down to the query service, and the residual expression which must
+// still be evaluated locally on the documents it returns.  The expression is
+// split on its top level conjunctions, the where clause is "TRUE" if nothing
+// could be pushed down and the residual is a TrueExpr if everything was.
+func SplitN1QL(expr Expression) (string, Expression) {
+	var pushed []string
+	var residual AndExpr
+	for _, subExpr := range n1qlConjuncts(expr) {
+		subStr, err := n1qlCondition(subExpr)
+		if err != nil {
+			residual = append(residual, subExpr)
+			continue
+		}
+		pushed = append(pushed, subStr)
+	}
+
+	where := "TRUE"
+	if len(pushed) == 1 {
+		where = pushed[0]
+	} else if len(pushed) > 1 {
+		where = "(" + strings.Join(pushed, " AND ") + ")"
+	}
+
+	switch len(residual) {
+	case 0:
+		return where, TrueExpr{}
+	case 1:
+		return where, residual[0]
+	}
+	return where, residual
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestToN1QL(t *testing.T) {
+	assert := assert.New(t)
+
+	n1ql, err := ToN1QL(AndExpr{
+		EqualsExpr{FieldExpr{0, []string{"name", "first"}}, ValueExpr{"Bob \"<b>\""}},
+		OrExpr{
+			LessThanExpr{FieldExpr{0, []string{"arr", "[1]"}}, ValueExpr{-2}},
+			NotExpr{ExistsExpr{FieldExpr{0, []string{"a b"}}}},
+		},
+	})
+	assert.Nil(err)
+	assert.Equal("(`name`.`first` = \"Bob \\\"<b>\\\"\" AND "+
+		"(`arr`[1] < -2 OR NOT IFMISSINGORNULL(`a b` IS NOT MISSING, FALSE)))", n1ql)
+
+	n1ql, err = ToN1QL(AnyInExpr{1, FieldExpr{0, []string{"friends"}},
+		AndExpr{
+			LikeExpr{FieldExpr{1, []string{"name"}}, RegexExpr{"^B"}},
+			EqualsExpr{ValueExpr{nil}, FieldExpr{1, []string{"age"}}},
+		},
+	})
+	assert.Nil(err)
+	assert.Equal("ANY `_v1` IN `friends` SATISFIES "+
+		"(REGEXP_CONTAINS(`_v1`.`name`, \"^B\") AND `_v1`.`age` IS NULL) END", n1ql)
+
+	n1ql, err = ToN1QL(GreaterEqualsExpr{
+		FuncExpr{DateFunc, []Expression{FieldExpr{0, []string{"META()", "expiration"}}}},
+		FuncExpr{MathFuncAdd, []Expression{
+			FuncExpr{MathFuncPow, []Expression{ValueExpr{2}, ValueExpr{1.5}}},
+			ValueExpr{uint8(3)},
+		}},
+	})
+	assert.Nil(err)
+	assert.Equal("STR_TO_MILLIS(META().`expiration`) >= (POWER(2, 1.5) + 3)", n1ql)
+
+	n1ql, err = ToN1QL(EveryInExpr{2, FieldExpr{0, []string{"tags"}},
+		NotEqualsExpr{FieldExpr{2, nil}, TimeExpr{"2019-01-01"}}})
+	assert.Nil(err)
+	assert.Equal("EVERY `_v2` IN `tags` SATISFIES `_v2` != STR_TO_MILLIS(\"2019-01-01\") END", n1ql)
+
+	n1ql, err = ToN1QL(EqualsExpr{FuncExpr{TokenMatchFunc, []Expression{FieldExpr{0, []string{"title"}}, ValueExpr{"fox"}}}, ValueExpr{true}})
+	assert.Nil(err)
+	assert.Equal("ARRAY_CONTAINS(TOKENS(`title`), \"fox\")", n1ql)
+
+	n1ql, err = ToN1QL(EqualsExpr{FuncExpr{DecodeJsonFunc, []Expression{FieldExpr{0, []string{"payload"}}, ValueExpr{`["a","[1]"]`}}}, ValueExpr{"x"}})
+	assert.Nil(err)
+	assert.Equal("DECODE_JSON(`payload`).`a`[1] = \"x\"", n1ql)
+
+	n1ql, err = ToN1QL(EqualsExpr{FuncExpr{DateTruncFunc, []Expression{FieldExpr{0, []string{"created"}}, ValueExpr{"day"}}}, FuncExpr{DateWeekdayFunc, []Expression{FieldExpr{0, []string{"updated"}}}}})
+	assert.Nil(err)
+	assert.Equal("DATE_TRUNC_STR(`created`, \"day\") = WEEKDAY_STR(`updated`)", n1ql)
+
+	_, err = ToN1QL(LikeExpr{FieldExpr{0, []string{"a"}}, PcreExpr{"x"}})
+	assert.Equal(ErrorN1qlNotRepresentable, err)
+	_, err = ToN1QL(EqualsExpr{FieldExpr{0, []string{"a`b"}}, ValueExpr{1}})
+	assert.Equal(ErrorN1qlNotRepresentable, err)
+	_, err = ToN1QL(EqualsExpr{FieldExpr{0, nil}, ValueExpr{1}})
+	assert.Equal(ErrorN1qlNotRepresentable, err)
+}
+
+func TestToN1QLFromFilterExpression(t *testing.T) {
+	assert := assert.New(t)
+
+	_, fe, err := NewFilterExpressionParser("a.b = \"x\" AND (c IS NOT NULL OR NOT d > 5)")
+	assert.Nil(err)
+	expr, err := fe.OutputExpression()
+	assert.Nil(err)
+
+	n1ql, err := ToN1QL(expr)
+	assert.Nil(err)
+	assert.Equal("(`a`.`b` = \"x\" AND (NOT IFMISSINGORNULL(`c` IS NULL, FALSE) OR "+
+		"NOT IFMISSINGORNULL(`d` > 5, FALSE)))", n1ql)
+}
+
+func TestSplitN1QL(t *testing.T) {
+	assert := assert.New(t)
+
+	pcreExpr := LikeExpr{FieldExpr{0, []string{"a"}}, PcreExpr{"x"}}
+	rootExpr := EqualsExpr{FieldExpr{0, nil}, ValueExpr{1}}
+
+	where, residual := SplitN1QL(AndExpr{
+		EqualsExpr{FieldExpr{0, []string{"b"}}, ValueExpr{"x"}},
+		AndExpr{
+			pcreExpr,
+			GreaterThanExpr{FieldExpr{0, []string{"c"}}, ValueExpr{5}},
+		},
+		rootExpr,
+	})
+	assert.Equal("(`b` = \"x\" AND `c` > 5)", where)
+	assert.Equal(AndExpr{pcreExpr, rootExpr}, residual)
+
+	where, residual = SplitN1QL(OrExpr{
+		EqualsExpr{FieldExpr{0, []string{"b"}}, ValueExpr{"x"}},
+		pcreExpr,
+	})
+	assert.Equal("TRUE", where)
+	assert.Equal(OrExpr{EqualsExpr{FieldExpr{0, []string{"b"}}, ValueExpr{"x"}}, pcreExpr}, residual)
+
+	where, residual = SplitN1QL(AndExpr{
+		NotExistsExpr{FieldExpr{0, []string{"d"}}},
+		pcreExpr,
+	})
+	assert.Equal("`d` IS MISSING", where)
+	assert.Equal(pcreExpr, residual)
+
+	where, residual = SplitN1QL(NotExistsExpr{FieldExpr{0, []string{"d"}}})
+	assert.Equal("`d` IS MISSING", where)
+	assert.Equal(TrueExpr{}, residual)
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// MatchResult is the outcome of matching a single document
+type MatchResult struct {
+	Doc     []byte
+	Matched bool
+	Err     error
+}
+
+type parallelJob struct {
+	doc    []byte
+	result chan MatchResult
+}
+
+// matchOne matches a document, turning a panic caused by a malformed
+// document into an error.  The matcher must not be reused after a panic.
+func matchOne(m *FastMatcher, doc []byte) (result MatchResult, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = MatchResult{Doc: doc, Err: fmt.Errorf("Error: Failed to match document: %v", r)}
+		}
+	}()
+
+	m.Reset()
+	matched, err := m.Match(doc)
+	return MatchResult{Doc: doc, Matched: matched, Err: err}, true
+}
+
+// ParallelMatch matches the documents received from docs using a number of
+// workers, each with their own FastMatcher, and sends the results in the
+// same order as the documents.  A workers count of 0 or less uses one worker
+// per CPU.  The results channel is closed once docs has been closed and
+// every document has been matched.
+func ParallelMatch(def MatchDef, docs <-chan []byte, workers int) <-chan MatchResult {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// The definition is compiled here as the workers would otherwise each
+	// try to compile the same nodes when creating their matchers
+	if !def.compiled {
+		def.compilePrograms()
+	}
+
+	jobs := make(chan parallelJob)
+	// Holds the pending results in document order, bounding how far ahead
+	// the workers can get of the reader
+	order := make(chan chan MatchResult, workers)
+	results := make(chan MatchResult)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			m := NewFastMatcher(&def)
+			for job := range jobs {
+				result, ok := matchOne(m, job.doc)
+				if !ok {
+					m = NewFastMatcher(&def)
+				}
+				job.result <- result
+			}
+		}()
+	}
+
+	go func() {
+		for doc := range docs {
+			job := parallelJob{doc, make(chan MatchResult, 1)}
+			order <- job.result
+			jobs <- job
+		}
+		close(jobs)
+		close(order)
+	}()
+
+	go func() {
+		for result := range order {
+			results <- <-result
+		}
+		close(results)
+	}()
+
+	return results
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParallelMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseFilterExpression(`age > 30 AND isActive = true`)
+	assert.Nil(err)
+
+	var trans Transformer
+	matchDef := trans.Transform([]Expression{expr})
+
+	docs := getTestPeopleDocs()
+	var expected []bool
+	for _, doc := range docs {
+		matched, err := NewFastMatcher(matchDef).Match(doc)
+		assert.Nil(err)
+		expected = append(expected, matched)
+	}
+
+	for _, workers := range []int{0, 1, 3} {
+		input := make(chan []byte)
+		go func() {
+			for i := 0; i < 10; i++ {
+				for _, doc := range docs {
+					input <- doc
+				}
+			}
+			close(input)
+		}()
+
+		count := 0
+		for result := range ParallelMatch(*matchDef, input, workers) {
+			idx := count % len(docs)
+			assert.Nil(result.Err)
+			assert.Equal(docs[idx], result.Doc)
+			assert.Equal(expected[idx], result.Matched)
+			count++
+		}
+		assert.Equal(10*len(docs), count)
+	}
+}
+
+func TestParallelMatchMalformed(t *testing.T) {
+	assert := assert.New(t)
+
+	var trans Transformer
+	matchDef := trans.Transform([]Expression{EqualsExpr{FieldExpr{Root: 0, Path: []string{"a"}}, ValueExpr{1}}})
+
+	input := make(chan []byte, 3)
+	input <- []byte(`{"a": 1}`)
+	input <- []byte(`{"a" 1}`)
+	input <- []byte(`{"a": 1}`)
+	close(input)
+
+	var results []MatchResult
+	for result := range ParallelMatch(*matchDef, input, 1) {
+		results = append(results, result)
+	}
+	assert.Equal(3, len(results))
+	assert.True(results[0].Matched)
+	assert.NotNil(results[1].Err)
+	assert.True(results[2].Matched)
+}
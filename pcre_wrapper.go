@@ -5,7 +5,6 @@
 package gojsonsm
 
 import (
-	"errors"
 	"github.com/glenn-brown/golang-pkg-pcre/src/pkg/pcre"
 )
 
@@ -18,7 +17,7 @@ func MakePcreWrapper(expression string) (PcreWrapperInterface, error) {
 
 	pcreRegex, err := pcre.Compile(expression, 0)
 	if err != nil {
-		return pcreWrapper, errors.New("failed to compile PcreExpr: " + err.Message)
+		return pcreWrapper, newFilterExpressionError(ErrBadRegex, "failed to compile PcreExpr: %v", err.Message)
 	}
 	pcreWrapper.pcreRegex = &pcreRegex
 
@@ -0,0 +1,189 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+// Projection copies a fixed set of fields out of JSON documents into a new
+// document, keeping the bytes of each value exactly as they were.  Fields
+// which are missing from a document are left out.  As with FastMatcher, a
+// Projection must not be used by more than one goroutine at a time.
+type Projection struct {
+	root   *projectionNode
+	tokens jsonTokenizer
+}
+
+type projectionNode struct {
+	// Whether the whole value is copied, rather than just some of its fields
+	keep  bool
+	elems map[string]*projectionNode
+}
+
+// NewProjection builds a projection of the given fields, which can only be
+// made up of object keys.  A field with an empty path projects the whole
+// document, and a field which is within another projected field adds
+// nothing to it.
+func NewProjection(fields []FieldExpr) (*Projection, error) {
+	root := &projectionNode{}
+	for _, field := range fields {
+		if field.Root != 0 {
+			return nil, ErrorProjectionPath
+		}
+
+		node := root
+		for _, elem := range field.Path {
+			if fmtArrayIndexRegex.MatchString(elem) {
+				return nil, ErrorProjectionPath
+			}
+			if node.keep {
+				break
+			}
+			if node.elems == nil {
+				node.elems = make(map[string]*projectionNode)
+			}
+			child := node.elems[elem]
+			if child == nil {
+				child = &projectionNode{}
+				node.elems[elem] = child
+			}
+			node = child
+		}
+		node.keep = true
+		node.elems = nil
+	}
+	return &Projection{root: root}, nil
+}
+
+// Project appends the projection of a document to out, returning the
+// extended buffer.  Documents which are not objects project to an empty
+// object, unless the whole document is projected.
+func (p *Projection) Project(data []byte, out []byte) ([]byte, error) {
+	p.tokens.Reset(data)
+	outLen := len(out)
+
+	token, tokenData, _, err := p.tokens.Step()
+	if err != nil {
+		return out, err
+	}
+	if p.root.keep {
+		start := p.tokens.Position() - len(tokenData)
+		if err := p.skipValue(token); err != nil {
+			return out, err
+		}
+		return append(out, data[start:p.tokens.Position()]...), nil
+	}
+	if token != tknObjectStart {
+		if !isLiteralToken(token) && token != tknArrayStart {
+			return out, ErrorJsonMalformed
+		}
+		return append(out, '{', '}'), nil
+	}
+
+	out, _, err = p.projectObject(p.root, out)
+	if err != nil {
+		// Nothing is left behind from a document which was only partly read
+		return out[:outLen], err
+	}
+	return out, nil
+}
+
+// projectObject appends the fields of the object which was just started that
+// the node projects, returning the number of fields which were found
+func (p *Projection) projectObject(node *projectionNode, out []byte) ([]byte, int, error) {
+	data := p.tokens.data
+	out = append(out, '{')
+	numFields := 0
+
+	for i := 0; ; i++ {
+		token, tokenData, tokenDataLen, err := p.tokens.Step()
+		if err != nil {
+			return out, numFields, err
+		}
+		if token == tknObjectEnd {
+			break
+		}
+		if i != 0 {
+			if token != tknListDelim {
+				return out, numFields, ErrorJsonMalformed
+			}
+			token, tokenData, tokenDataLen, err = p.tokens.Step()
+			if err != nil {
+				return out, numFields, err
+			}
+		}
+		if token != tknString && token != tknEscString {
+			return out, numFields, ErrorJsonMalformed
+		}
+		keyBytes := p.tokens.ParseKey(token, tokenData, tokenDataLen)
+		child := node.elems[string(keyBytes)]
+		// The key is copied as it was written, escapes and all
+		keyStart := p.tokens.Position() - tokenDataLen
+		keyEnd := p.tokens.Position()
+
+		if token, _, _, err = p.tokens.Step(); err != nil || token != tknObjectKeyDelim {
+			return out, numFields, ErrorJsonMalformed
+		}
+		token, tokenData, _, err = p.tokens.Step()
+		if err != nil {
+			return out, numFields, err
+		}
+		valueStart := p.tokens.Position() - len(tokenData)
+
+		if child == nil || (!child.keep && token != tknObjectStart) {
+			if err := p.skipValue(token); err != nil {
+				return out, numFields, err
+			}
+			continue
+		}
+
+		fieldStart := len(out)
+		if numFields > 0 {
+			out = append(out, ',')
+		}
+		out = append(out, data[keyStart:keyEnd]...)
+		out = append(out, ':')
+
+		if child.keep {
+			if err := p.skipValue(token); err != nil {
+				return out, numFields, err
+			}
+			out = append(out, data[valueStart:p.tokens.Position()]...)
+		} else {
+			var numChildFields int
+			out, numChildFields, err = p.projectObject(child, out)
+			if err != nil {
+				return out, numFields, err
+			}
+			// Objects without any of the projected fields are left out
+			if numChildFields == 0 {
+				out = out[:fieldStart]
+				continue
+			}
+		}
+		numFields++
+	}
+
+	return append(out, '}'), numFields, nil
+}
+
+func (p *Projection) skipValue(token tokenType) error {
+	switch token {
+	case tknObjectStart, tknArrayStart:
+		return p.tokens.SkipValue()
+	case tknObjectEnd, tknArrayEnd, tknListDelim, tknObjectKeyDelim, tknEnd, tknUnknown:
+		return ErrorJsonMalformed
+	}
+	return nil
+}
+
+// MatchAndProject matches a document and, if it matched, appends the
+// projection of it to out.  Documents which do not match are never scanned
+// by the projection, and leave out as it was, so that a pipeline can filter
+// and trim its documents with a single call for each.
+func (m *FastMatcher) MatchAndProject(data []byte, projection *Projection, out []byte) (bool, []byte, error) {
+	matched, err := m.Match(data)
+	if err != nil || !matched {
+		return matched, out, err
+	}
+
+	out, err = projection.Project(data, out)
+	return true, out, err
+}
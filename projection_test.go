@@ -0,0 +1,79 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestProjection(t *testing.T) {
+	assert := assert.New(t)
+
+	projection, err := NewProjection([]FieldExpr{
+		{0, []string{"name"}},
+		{0, []string{"geo", "lat"}},
+		{0, []string{"meta", "x\"y"}},
+		{0, []string{"tags"}},
+		{0, []string{"tags", "first"}},
+		{0, []string{"none", "here"}},
+	})
+	if !assert.Nil(err) {
+		return
+	}
+
+	tests := map[string]string{
+		`{"name":"a b","geo":{"lat":1.5, "lon":2},"age":3,"tags":["x",{"y":[]}]}`: `{"name":"a b","geo":{"lat":1.5},"tags":["x",{"y":[]}]}`,
+		` { "age" : 3 , "geo" : { "lon" : 2 } , "none" : { } } `:                  `{}`,
+		`{"meta":{"x\"y":{"z":null},"x":1},"name":"A"}`:                           `{"meta":{"x\"y":{"z":null}},"name":"A"}`,
+		`{"none":1,"geo":[{"lat":1}]}`:                                            `{}`,
+		`[1,2]`:                                                                   `{}`,
+	}
+	for doc, expected := range tests {
+		out, err := projection.Project([]byte(doc), nil)
+		assert.Nil(err, doc)
+		assert.Equal(expected, string(out), doc)
+	}
+
+	out, err := projection.Project([]byte(`{"name":"a","geo":{"lat"`), []byte("prefix"))
+	assert.NotNil(err)
+	assert.Equal("prefix", string(out))
+
+	whole, err := NewProjection([]FieldExpr{{0, []string{"a"}}, {0, nil}})
+	assert.Nil(err)
+	out, err = whole.Project([]byte(` {"a":1,"b":2} `), nil)
+	assert.Nil(err)
+	assert.Equal(`{"a":1,"b":2}`, string(out))
+
+	_, err = NewProjection([]FieldExpr{{0, []string{"a", "[0]"}}})
+	assert.Equal(ErrorProjectionPath, err)
+	_, err = NewProjection([]FieldExpr{{1, []string{"a"}}})
+	assert.Equal(ErrorProjectionPath, err)
+}
+
+func TestMatchAndProject(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseFilterExpression("type = \"hotel\"")
+	if !assert.Nil(err) {
+		return
+	}
+	var trans Transformer
+	m := NewFastMatcher(trans.Transform([]Expression{expr}))
+
+	projection, err := NewProjection([]FieldExpr{{0, []string{"id"}}})
+	if !assert.Nil(err) {
+		return
+	}
+
+	out := []byte("[")
+	matched, out, err := m.MatchAndProject([]byte(`{"type":"hotel","id":1,"big":[1,2,3]}`), projection, out)
+	assert.Nil(err)
+	assert.True(matched)
+
+	m.Reset()
+	matched, out, err = m.MatchAndProject([]byte(`{"type":"airport","id":2}`), projection, out)
+	assert.Nil(err)
+	assert.False(matched)
+	assert.Equal(`[{"id":1}`, string(out))
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Minimal implementation of the protocol buffers wire format, enough to
+// read and write the messages described in gojsonsm.proto.
+
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+func protoAppendUvarint(buf []byte, value uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], value)
+	return append(buf, tmp[:n]...)
+}
+
+func protoAppendFixed64(buf []byte, value uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], value)
+	return append(buf, tmp[:]...)
+}
+
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) tag(field int, wireType int) {
+	w.buf = protoAppendUvarint(w.buf, uint64(field)<<3|uint64(wireType))
+}
+
+func (w *protoWriter) uvarint(field int, value uint64) {
+	if value == 0 {
+		return
+	}
+	w.tag(field, protoWireVarint)
+	w.buf = protoAppendUvarint(w.buf, value)
+}
+
+func (w *protoWriter) varint(field int, value int64) {
+	w.uvarint(field, uint64(value))
+}
+
+func (w *protoWriter) svarint(field int, value int64) {
+	w.uvarint(field, uint64(value<<1)^uint64(value>>63))
+}
+
+func (w *protoWriter) double(field int, value float64) {
+	if value == 0 && !math.Signbit(value) {
+		return
+	}
+	w.tag(field, protoWireFixed64)
+	w.buf = protoAppendFixed64(w.buf, math.Float64bits(value))
+}
+
+func (w *protoWriter) bytes(field int, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	w.tag(field, protoWireBytes)
+	w.buf = protoAppendUvarint(w.buf, uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *protoWriter) string(field int, value string) {
+	w.bytes(field, []byte(value))
+}
+
+// message writes a nested message.  Unlike the scalar helpers, the field
+// is always written so that empty messages keep their presence.
+func (w *protoWriter) message(field int, encode func(w *protoWriter) error) error {
+	var sub protoWriter
+	if err := encode(&sub); err != nil {
+		return err
+	}
+	w.tag(field, protoWireBytes)
+	w.buf = protoAppendUvarint(w.buf, uint64(len(sub.buf)))
+	w.buf = append(w.buf, sub.buf...)
+	return nil
+}
+
+type protoField struct {
+	num      int
+	wireType int
+	value    uint64
+	data     []byte
+}
+
+func (f protoField) int() int64 {
+	return int64(f.value)
+}
+
+func (f protoField) sint() int64 {
+	return int64(f.value>>1) ^ -int64(f.value&1)
+}
+
+func (f protoField) double() float64 {
+	return math.Float64frombits(f.value)
+}
+
+// packedVarints returns the values of a repeated varint field, which may be
+// either packed or not
+func (f protoField) packedVarints() ([]uint64, error) {
+	if f.wireType == protoWireVarint {
+		return []uint64{f.value}, nil
+	}
+	if f.wireType != protoWireBytes {
+		return nil, ErrorProtoMalformed
+	}
+
+	var values []uint64
+	data := f.data
+	for len(data) > 0 {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, ErrorProtoMalformed
+		}
+		values = append(values, value)
+		data = data[n:]
+	}
+	return values, nil
+}
+
+// readProtoFields calls handler for each field of an encoded message
+func readProtoFields(data []byte, handler func(f protoField) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrorProtoMalformed
+		}
+		data = data[n:]
+
+		f := protoField{
+			num:      int(key >> 3),
+			wireType: int(key & 7),
+		}
+		switch f.wireType {
+		case protoWireVarint:
+			f.value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return ErrorProtoMalformed
+			}
+			data = data[n:]
+		case protoWireFixed64:
+			if len(data) < 8 {
+				return ErrorProtoMalformed
+			}
+			f.value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case protoWireFixed32:
+			if len(data) < 4 {
+				return ErrorProtoMalformed
+			}
+			f.value = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case protoWireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return ErrorProtoMalformed
+			}
+			f.data = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return ErrorProtoMalformed
+		}
+
+		if err := handler(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Redaction writes copies of JSON documents with a set of fields removed or
+// replaced by a mask, such as for scrubbing personal data from documents
+// which have passed a filter.  Paths may contain array indexes, and `**`
+// elements which stand for any number of levels of objects and arrays, so
+// that `**.ssn` redacts every ssn field wherever it is.  As with
+// FastMatcher, a Redaction must not be used by more than one goroutine at a
+// time.
+type Redaction struct {
+	root   *redactionNode
+	mask   []byte
+	tokens jsonTokenizer
+	// The states of the path set for each level being read
+	states [][]*redactionNode
+}
+
+type redactionNode struct {
+	redact bool
+	elems  map[string]*redactionNode
+	// The node following a `**`, which applies from this level downwards
+	deep *redactionNode
+	// Whether this node follows a `**`, and so applies at every level below
+	// the one it was reached at
+	afterDeep bool
+}
+
+// NewRedaction builds a redaction of the given fields.  Fields are removed
+// when mask is nil, and otherwise have their value replaced by the mask,
+// which must be a JSON value such as `"***"`.
+func NewRedaction(fields []FieldExpr, mask []byte) (*Redaction, error) {
+	if mask != nil && !json.Valid(mask) {
+		return nil, ErrorRedactionMask
+	}
+
+	root := &redactionNode{}
+	for _, field := range fields {
+		if field.Root != 0 || len(field.Path) == 0 {
+			return nil, ErrorRedactionPath
+		}
+
+		node := root
+		for _, elem := range field.Path {
+			if elem == OperatorDeepWildcard {
+				if node.deep == nil {
+					node.deep = &redactionNode{afterDeep: true}
+				}
+				node = node.deep
+				continue
+			}
+			if node.elems == nil {
+				node.elems = make(map[string]*redactionNode)
+			}
+			child := node.elems[elem]
+			if child == nil {
+				child = &redactionNode{}
+				node.elems[elem] = child
+			}
+			node = child
+		}
+		node.redact = true
+	}
+	return &Redaction{root: root, mask: mask}, nil
+}
+
+// addRedactionState adds a node to a set of states, along with the nodes
+// following any `**` from it, which also match at the same level
+func addRedactionState(states []*redactionNode, node *redactionNode) []*redactionNode {
+	for ; node != nil; node = node.deep {
+		states = append(states, node)
+	}
+	return states
+}
+
+// nextStates works out the states for the value under a key from those of
+// its parent, returning whether the value is redacted
+func (r *Redaction) nextStates(depth int, key string) bool {
+	for len(r.states) <= depth+1 {
+		r.states = append(r.states, nil)
+	}
+
+	next := r.states[depth+1][:0]
+	redact := false
+	for _, state := range r.states[depth] {
+		if child := state.elems[key]; child != nil {
+			next = addRedactionState(next, child)
+		}
+	}
+	for _, state := range r.states[depth] {
+		if state.afterDeep {
+			next = append(next, state)
+		}
+	}
+	for _, state := range next {
+		if state.redact {
+			redact = true
+		}
+	}
+	r.states[depth+1] = next
+	return redact
+}
+
+// Redact appends the redacted copy of a document to out, returning the
+// extended buffer.  Values which contain nothing to redact are copied
+// exactly as they were.
+func (r *Redaction) Redact(data []byte, out []byte) ([]byte, error) {
+	r.tokens.Reset(data)
+	outLen := len(out)
+
+	if len(r.states) == 0 {
+		r.states = append(r.states, nil)
+	}
+	r.states[0] = addRedactionState(r.states[0][:0], r.root)
+
+	token, tokenData, _, err := r.tokens.Step()
+	if err != nil {
+		return out, err
+	}
+	out, err = r.redactValue(0, token, tokenData, out)
+	if err != nil {
+		// Nothing is left behind from a document which was only partly read
+		return out[:outLen], err
+	}
+	return out, nil
+}
+
+// redactValue appends the value whose first token was just read, redacting
+// whatever the states at its depth call for within it
+func (r *Redaction) redactValue(depth int, token tokenType, tokenData []byte, out []byte) ([]byte, error) {
+	start := r.tokens.Position() - len(tokenData)
+	switch token {
+	case tknObjectStart, tknArrayStart:
+		if len(r.states[depth]) == 0 {
+			if err := r.tokens.SkipValue(); err != nil {
+				return out, err
+			}
+			return append(out, r.tokens.data[start:r.tokens.Position()]...), nil
+		}
+		return r.redactContainer(depth, token, out)
+	case tknObjectEnd, tknArrayEnd, tknListDelim, tknObjectKeyDelim, tknEnd, tknUnknown:
+		return out, ErrorJsonMalformed
+	}
+	return append(out, tokenData...), nil
+}
+
+// redactContainer appends the object or array which was just started,
+// leaving out or masking its redacted elements
+func (r *Redaction) redactContainer(depth int, startToken tokenType, out []byte) ([]byte, error) {
+	arrayMode := startToken == tknArrayStart
+	endToken := tknObjectEnd
+	out = append(out, '{')
+	if arrayMode {
+		endToken = tknArrayEnd
+		out[len(out)-1] = '['
+	}
+
+	numElems := 0
+	for i := 0; ; i++ {
+		token, tokenData, tokenDataLen, err := r.tokens.Step()
+		if err != nil {
+			return out, err
+		}
+		if token == endToken {
+			break
+		}
+		if i != 0 {
+			if token != tknListDelim {
+				return out, ErrorJsonMalformed
+			}
+			token, tokenData, tokenDataLen, err = r.tokens.Step()
+			if err != nil {
+				return out, err
+			}
+		}
+
+		var key string
+		var keyBytes []byte
+		if arrayMode {
+			key = "[" + strconv.Itoa(i) + "]"
+		} else {
+			if token != tknString && token != tknEscString {
+				return out, ErrorJsonMalformed
+			}
+			keyBytes = tokenData
+			key = string(r.tokens.ParseKey(token, tokenData, tokenDataLen))
+
+			if token, _, _, err = r.tokens.Step(); err != nil || token != tknObjectKeyDelim {
+				return out, ErrorJsonMalformed
+			}
+			token, tokenData, _, err = r.tokens.Step()
+			if err != nil {
+				return out, err
+			}
+		}
+
+		redact := r.nextStates(depth, key)
+		if redact && r.mask == nil {
+			if token == tknObjectStart || token == tknArrayStart {
+				err = r.tokens.SkipValue()
+			} else if !isLiteralToken(token) {
+				err = ErrorJsonMalformed
+			}
+			if err != nil {
+				return out, err
+			}
+			continue
+		}
+
+		if numElems > 0 {
+			out = append(out, ',')
+		}
+		numElems++
+		if !arrayMode {
+			// The key is copied as it was written, escapes and all
+			out = append(out, keyBytes...)
+			out = append(out, ':')
+		}
+
+		if redact {
+			if token == tknObjectStart || token == tknArrayStart {
+				err = r.tokens.SkipValue()
+			} else if !isLiteralToken(token) {
+				err = ErrorJsonMalformed
+			}
+			if err != nil {
+				return out, err
+			}
+			out = append(out, r.mask...)
+			continue
+		}
+		out, err = r.redactValue(depth+1, token, tokenData, out)
+		if err != nil {
+			return out, err
+		}
+	}
+
+	if arrayMode {
+		return append(out, ']'), nil
+	}
+	return append(out, '}'), nil
+}
+
+// MatchAndRedact matches a document and, if it matched, appends the
+// redacted copy of it to out.  Documents which do not match leave out as it
+// was.
+func (m *FastMatcher) MatchAndRedact(data []byte, redaction *Redaction, out []byte) (bool, []byte, error) {
+	matched, err := m.Match(data)
+	if err != nil || !matched {
+		return matched, out, err
+	}
+
+	out, err = redaction.Redact(data, out)
+	return true, out, err
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	assert := assert.New(t)
+
+	fields := []FieldExpr{
+		{0, []string{"password"}},
+		{0, []string{"card", "number"}},
+		{0, []string{"phones", "[1]"}},
+		{0, []string{"**", "ssn"}},
+	}
+
+	removed, err := NewRedaction(fields, nil)
+	if !assert.Nil(err) {
+		return
+	}
+	masked, err := NewRedaction(fields, []byte(`"***"`))
+	if !assert.Nil(err) {
+		return
+	}
+
+	tests := []struct {
+		doc     string
+		removed string
+		masked  string
+	}{
+		{
+			`{"name":"a", "password":"x"}`,
+			`{"name":"a"}`,
+			`{"name":"a","password":"***"}`,
+		},
+		{
+			`{"password":{"a":[1]},"card":{"number":1234,"exp":"01/20"}}`,
+			`{"card":{"exp":"01/20"}}`,
+			`{"password":"***","card":{"number":"***","exp":"01/20"}}`,
+		},
+		{
+			`{"phones":["1", "2", "3"],"people":[{"ssn":1,"x":{"ssn":2}}],"ssn":3}`,
+			`{"phones":["1","3"],"people":[{"x":{}}]}`,
+			`{"phones":["1","***","3"],"people":[{"ssn":"***","x":{"ssn":"***"}}],"ssn":"***"}`,
+		},
+		{
+			`{"searched": { "a" : [ 1, 2 ] }}`,
+			`{"searched":{"a":[1,2]}}`,
+			`{"searched":{"a":[1,2]}}`,
+		},
+		{
+			`"just a string"`,
+			`"just a string"`,
+			`"just a string"`,
+		},
+	}
+	for _, test := range tests {
+		out, err := removed.Redact([]byte(test.doc), nil)
+		assert.Nil(err, test.doc)
+		assert.Equal(test.removed, string(out), test.doc)
+
+		out, err = masked.Redact([]byte(test.doc), nil)
+		assert.Nil(err, test.doc)
+		assert.Equal(test.masked, string(out), test.doc)
+	}
+
+	// Values which cannot contain a redacted field are copied as they are
+	shallow, err := NewRedaction([]FieldExpr{{0, []string{"password"}}}, nil)
+	assert.Nil(err)
+	out, err := shallow.Redact([]byte(`{"untouched": { "a" : [ 1, 2 ] }, "password": 1}`), nil)
+	assert.Nil(err)
+	assert.Equal(`{"untouched":{ "a" : [ 1, 2 ] }}`, string(out))
+
+	out, err = removed.Redact([]byte(`{"password":"x","ssn":`), []byte("prefix"))
+	assert.NotNil(err)
+	assert.Equal("prefix", string(out))
+
+	_, err = NewRedaction([]FieldExpr{{0, nil}}, nil)
+	assert.Equal(ErrorRedactionPath, err)
+	_, err = NewRedaction(fields, []byte("not json"))
+	assert.Equal(ErrorRedactionMask, err)
+}
+
+func TestMatchAndRedact(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseFilterExpression("type = \"user\"")
+	if !assert.Nil(err) {
+		return
+	}
+	var trans Transformer
+	m := NewFastMatcher(trans.Transform([]Expression{expr}))
+
+	redaction, err := NewRedaction([]FieldExpr{{0, []string{"email"}}}, []byte("null"))
+	if !assert.Nil(err) {
+		return
+	}
+
+	matched, out, err := m.MatchAndRedact([]byte(`{"type":"user","email":"a@b.c"}`), redaction, nil)
+	assert.Nil(err)
+	assert.True(matched)
+	assert.Equal(`{"type":"user","email":null}`, string(out))
+
+	m.Reset()
+	matched, out, err = m.MatchAndRedact([]byte(`{"type":"group","email":"a@b.c"}`), redaction, nil)
+	assert.Nil(err)
+	assert.False(matched)
+	assert.Equal(0, len(out))
+}
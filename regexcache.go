@@ -0,0 +1,124 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"container/list"
+	"regexp"
+	"sync"
+)
+
+// Compiled regular expressions are shared between all of the matchers in the
+// process, as applications such as XDCR create thousands of matchers whose
+// filters often use the same patterns.  Programs of every engine must be
+// safe for concurrent use.
+
+const defaultRegexCacheSize = 1024
+
+// compileCacheKey identifies a cached program by the kind of program, such
+// as the regex engine, and the source it was compiled from
+type compileCacheKey struct {
+	kind   string
+	source string
+}
+
+type compileCacheEntry struct {
+	key   compileCacheKey
+	value interface{}
+}
+
+// compileCache is a least recently used cache of compiled programs
+type compileCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[compileCacheKey]*list.Element
+	// Most recently used entries are at the front
+	order list.List
+}
+
+func newCompileCache(size int) *compileCache {
+	return &compileCache{
+		size:    size,
+		entries: make(map[compileCacheKey]*list.Element),
+	}
+}
+
+var sharedRegexCache = newCompileCache(defaultRegexCacheSize)
+
+// SetRegexCacheSize changes the number of compiled regular expressions kept
+// for reuse across matchers, a size of 0 disables the cache
+func SetRegexCacheSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+
+	sharedRegexCache.resize(size)
+}
+
+func (c *compileCache) resize(size int) {
+	c.lock.Lock()
+	c.size = size
+	c.evict()
+	c.lock.Unlock()
+}
+
+// evict drops the least recently used entries until the cache fits its size,
+// the lock must be held
+func (c *compileCache) evict() {
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*compileCacheEntry).key)
+	}
+}
+
+// get returns the cached program for the key, or compiles and caches it.
+// Sources which fail to compile are not cached.
+func (c *compileCache) get(key compileCacheKey, compile func() (interface{}, error)) (interface{}, error) {
+	c.lock.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		c.lock.Unlock()
+		return elem.Value.(*compileCacheEntry).value, nil
+	}
+	c.lock.Unlock()
+
+	// Compile outside of the lock, so a slow source does not hold up others.
+	// Two callers may compile the same source, in which case the first one
+	// stored is kept.
+	value, err := compile()
+	if err != nil {
+		return value, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.size == 0 {
+		return value, nil
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*compileCacheEntry).value, nil
+	}
+	c.entries[key] = c.order.PushFront(&compileCacheEntry{key, value})
+	c.evict()
+	return value, nil
+}
+
+func compileCachedRegex(pattern string) (*regexp.Regexp, error) {
+	value, err := sharedRegexCache.get(compileCacheKey{RegexEngineRE2, pattern}, func() (interface{}, error) {
+		return regexp.Compile(pattern)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*regexp.Regexp), nil
+}
+
+func compileCachedPcre(pattern string) (PcreWrapperInterface, error) {
+	value, err := sharedRegexCache.get(compileCacheKey{RegexEnginePCRE, pattern}, func() (interface{}, error) {
+		return MakePcreWrapper(pattern)
+	})
+	wrapper, _ := value.(PcreWrapperInterface)
+	return wrapper, err
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegexCacheSharing(t *testing.T) {
+	assert := assert.New(t)
+
+	first, err := compileCachedRegex("^shared[0-9]+$")
+	assert.Nil(err)
+	second, err := compileCachedRegex("^shared[0-9]+$")
+	assert.Nil(err)
+	assert.True(first == second)
+
+	_, err = compileCachedRegex("[a-")
+	assert.NotNil(err)
+
+	// Matchers built from the same pattern share the compiled program
+	var trans Transformer
+	expr := LikeExpr{FieldExpr{0, []string{"name"}}, RegexExpr{"^shared[0-9]+$"}}
+	matchDef := trans.Transform([]Expression{expr})
+	assert.NotNil(matchDef)
+	third, err := compileCachedRegex("^shared[0-9]+$")
+	assert.Nil(err)
+	assert.True(first == third)
+}
+
+func TestRegexCacheEviction(t *testing.T) {
+	assert := assert.New(t)
+	defer SetRegexCacheSize(defaultRegexCacheSize)
+
+	SetRegexCacheSize(2)
+	a, _ := compileCachedRegex("evict-a")
+	b, _ := compileCachedRegex("evict-b")
+	again, _ := compileCachedRegex("evict-a")
+	assert.True(a == again)
+
+	// evict-b is now the least recently used
+	compileCachedRegex("evict-c")
+	again, _ = compileCachedRegex("evict-a")
+	assert.True(a == again)
+	again, _ = compileCachedRegex("evict-b")
+	assert.False(b == again)
+
+	SetRegexCacheSize(0)
+	a, _ = compileCachedRegex("evict-a")
+	again, _ = compileCachedRegex("evict-a")
+	assert.False(a == again)
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"sync"
+)
+
+// Names of the built-in regular expression engines
+const (
+	// Go's RE2 based regexp package, always available
+	RegexEngineRE2 = "re2"
+	// PCRE, only available when built with the pcre tag
+	RegexEnginePCRE = "pcre"
+)
+
+// RegexProgram is a compiled regular expression, it must be safe for
+// concurrent use as programs are shared between matchers
+type RegexProgram interface {
+	Match(b []byte) bool
+}
+
+// RegexEngine compiles the patterns of REGEXP_CONTAINS clauses, allowing
+// applications to supply their own regular expression implementation
+type RegexEngine interface {
+	Compile(pattern string) (RegexProgram, error)
+}
+
+var regexEnginesLock sync.RWMutex
+var regexEngines = make(map[string]RegexEngine)
+
+// RegisterRegexEngine makes an engine available under the given name, for
+// use with MakeRegexExpression and WithRegexEngine
+func RegisterRegexEngine(name string, engine RegexEngine) error {
+	if len(name) == 0 || engine == nil {
+		return ErrorUnknownRegexEngine
+	}
+
+	regexEnginesLock.Lock()
+	defer regexEnginesLock.Unlock()
+	if _, ok := regexEngines[name]; ok || name == RegexEngineRE2 || name == RegexEnginePCRE {
+		return ErrorRegexEngineExists
+	}
+	regexEngines[name] = engine
+	return nil
+}
+
+func getRegexEngine(name string) (RegexEngine, error) {
+	regexEnginesLock.RLock()
+	defer regexEnginesLock.RUnlock()
+	engine, ok := regexEngines[name]
+	if !ok {
+		return nil, newFilterExpressionError(ErrorUnknownRegexEngine, "%v: %v", ErrorUnknownRegexEngine, name)
+	}
+	return engine, nil
+}
+
+func compileCachedEngineRegex(name string, pattern string) (RegexProgram, error) {
+	engine, err := getRegexEngine(name)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := sharedRegexCache.get(compileCacheKey{name, pattern}, func() (interface{}, error) {
+		return engine.Compile(pattern)
+	})
+	if err != nil {
+		return nil, newFilterExpressionError(ErrBadRegex, "failed to compile %v regular expression: %v", name, err)
+	}
+	return value.(RegexProgram), nil
+}
+
+// MakeRegexExpression returns the expression for a pattern compiled by the
+// named engine, to be used as the right hand side of a LikeExpr.  An empty
+// engine name selects RE2.
+func MakeRegexExpression(engine string, pattern string) (Expression, error) {
+	switch engine {
+	case "", RegexEngineRE2:
+		if _, err := compileCachedRegex(pattern); err != nil {
+			return nil, newFilterExpressionError(ErrBadRegex, "Invalid regular expression %v: %v", pattern, err)
+		}
+		return RegexExpr{pattern}, nil
+	case RegexEnginePCRE:
+		return MakePcreExpression(pattern)
+	}
+
+	if _, err := compileCachedEngineRegex(engine, pattern); err != nil {
+		return nil, err
+	}
+	return EngineRegexExpr{engine, pattern}, nil
+}
+
+func regexPattern(expr Expression) (string, bool) {
+	var pattern interface{}
+	switch expr := expr.(type) {
+	case RegexExpr:
+		pattern = expr.Regex
+	case PcreExpr:
+		pattern = expr.Pcre
+	case EngineRegexExpr:
+		pattern = expr.Regex
+	default:
+		return "", false
+	}
+	patternStr, ok := pattern.(string)
+	return patternStr, ok
+}
+
+// WithRegexEngine returns a copy of the expression with the patterns of all
+// of its regular expressions compiled by the named engine instead
+func WithRegexEngine(expr Expression, engine string) (Expression, error) {
+	rewriteAll := func(exprs []Expression) ([]Expression, error) {
+		out := make([]Expression, len(exprs))
+		for i, subExpr := range exprs {
+			newExpr, err := WithRegexEngine(subExpr, engine)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = newExpr
+		}
+		return out, nil
+	}
+
+	var err error
+	switch expr := expr.(type) {
+	case AndExpr:
+		out, err := rewriteAll(expr)
+		return AndExpr(out), err
+	case OrExpr:
+		out, err := rewriteAll(expr)
+		return OrExpr(out), err
+	case NotExpr:
+		expr.SubExpr, err = WithRegexEngine(expr.SubExpr, engine)
+		return expr, err
+	case AnyInExpr:
+		expr.SubExpr, err = WithRegexEngine(expr.SubExpr, engine)
+		return expr, err
+	case EveryInExpr:
+		expr.SubExpr, err = WithRegexEngine(expr.SubExpr, engine)
+		return expr, err
+	case AnyEveryInExpr:
+		expr.SubExpr, err = WithRegexEngine(expr.SubExpr, engine)
+		return expr, err
+	case AnyWithinExpr:
+		expr.SubExpr, err = WithRegexEngine(expr.SubExpr, engine)
+		return expr, err
+	case LikeExpr:
+		if pattern, ok := regexPattern(expr.Rhs); ok {
+			expr.Rhs, err = MakeRegexExpression(engine, pattern)
+		}
+		return expr, err
+	}
+	return expr, nil
+}
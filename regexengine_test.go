@@ -0,0 +1,92 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// substringEngine matches patterns as plain substrings
+type substringEngine struct {
+	compiled int
+}
+
+type substringProgram []byte
+
+func (p substringProgram) Match(b []byte) bool {
+	return bytes.Contains(b, p)
+}
+
+func (e *substringEngine) Compile(pattern string) (RegexProgram, error) {
+	if len(pattern) == 0 {
+		return nil, errors.New("empty pattern")
+	}
+	e.compiled++
+	return substringProgram(pattern), nil
+}
+
+func TestRegexEngineRegistration(t *testing.T) {
+	assert := assert.New(t)
+
+	engine := &substringEngine{}
+	assert.Nil(RegisterRegexEngine("test-substring", engine))
+	assert.Equal(ErrorRegexEngineExists, RegisterRegexEngine("test-substring", engine))
+	assert.Equal(ErrorRegexEngineExists, RegisterRegexEngine(RegexEngineRE2, engine))
+
+	// Per clause
+	rhs, err := MakeRegexExpression("test-substring", "a.c")
+	assert.Nil(err)
+	assert.Equal(EngineRegexExpr{"test-substring", "a.c"}, rhs)
+
+	var trans Transformer
+	matcher := NewFastMatcher(trans.Transform([]Expression{
+		LikeExpr{FieldExpr{0, []string{"name"}}, rhs},
+	}))
+	matched, err := matcher.Match([]byte(`{"name":"xa.cx"}`))
+	assert.Nil(err)
+	assert.True(matched)
+	matcher.Reset()
+	matched, err = matcher.Match([]byte(`{"name":"abc"}`))
+	assert.Nil(err)
+	assert.False(matched)
+
+	// Compiled programs are shared
+	compiled := engine.compiled
+	_, err = MakeRegexExpression("test-substring", "a.c")
+	assert.Nil(err)
+	assert.Equal(compiled, engine.compiled)
+
+	_, err = MakeRegexExpression("test-substring", "")
+	assert.True(errors.Is(err, ErrBadRegex))
+	_, err = MakeRegexExpression("test-missing", "x")
+	assert.True(errors.Is(err, ErrorUnknownRegexEngine))
+
+	rhs, err = MakeRegexExpression("", "^a")
+	assert.Nil(err)
+	assert.Equal(RegexExpr{"^a"}, rhs)
+}
+
+func TestWithRegexEngine(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(RegisterRegexEngine("test-rewrite", &substringEngine{}))
+
+	expr, err := ParseFilterExpression(`REGEXP_CONTAINS(a, "^x") AND NOT REGEXP_CONTAINS(b, "y$")`)
+	assert.Nil(err)
+	rewritten, err := WithRegexEngine(expr, "test-rewrite")
+	assert.Nil(err)
+
+	var trans Transformer
+	matcher := NewFastMatcher(trans.Transform([]Expression{rewritten}))
+	// Anchors mean nothing to the substring engine
+	matched, err := matcher.Match([]byte(`{"a":"1^x2","b":"y"}`))
+	assert.Nil(err)
+	assert.True(matched)
+
+	_, err = WithRegexEngine(expr, "test-missing")
+	assert.True(errors.Is(err, ErrorUnknownRegexEngine))
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+// relaxedJsonTokenizer reads JSON written by hand, such as configuration
+// files, which may have comments, trailing commas, unquoted keys and single
+// quoted strings.  The document is rewritten as strict JSON, which is then
+// read by the JSON tokenizer.
+type relaxedJsonTokenizer struct {
+	jsonTokenizer
+	strict []byte
+	err    error
+}
+
+func (tkn *relaxedJsonTokenizer) Reset(data []byte) {
+	tkn.strict, tkn.err = appendStrictJson(tkn.strict[:0], data)
+	tkn.jsonTokenizer.Reset(tkn.strict)
+}
+
+func (tkn *relaxedJsonTokenizer) Step() (tokenType, []byte, int, error) {
+	if tkn.err != nil {
+		return tknEnd, nil, 0, tkn.err
+	}
+	return tkn.jsonTokenizer.Step()
+}
+
+// NewRelaxedJSONMatcher creates a matcher for JSON written by hand, which
+// also accepts `//` and `/* */` comments, commas after the last element of
+// objects and arrays, keys which are identifiers without quotes, and strings
+// in single quotes
+func NewRelaxedJSONMatcher(def *MatchDef) *FastMatcher {
+	return newFastMatcherWithTokenizer(def, &relaxedJsonTokenizer{})
+}
+
+func isRelaxedIdentStart(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isRelaxedIdentChar(c byte) bool {
+	return isRelaxedIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+// skipRelaxedSpace returns the position of the first character at or after
+// pos which is neither whitespace nor part of a comment
+func skipRelaxedSpace(data []byte, pos int) (int, error) {
+	for pos < len(data) {
+		switch {
+		case tokIsSpaceChar(data[pos]):
+			pos++
+		case data[pos] == '/' && pos+1 < len(data) && data[pos+1] == '/':
+			for pos < len(data) && data[pos] != '\n' {
+				pos++
+			}
+		case data[pos] == '/' && pos+1 < len(data) && data[pos+1] == '*':
+			end := pos + 2
+			for end+1 < len(data) && !(data[end] == '*' && data[end+1] == '/') {
+				end++
+			}
+			if end+1 >= len(data) {
+				return pos, ErrorJsonMalformed
+			}
+			pos = end + 2
+		default:
+			return pos, nil
+		}
+	}
+	return pos, nil
+}
+
+// appendStrictJson appends data rewritten as strict JSON, dropping comments
+// and trailing commas, and quoting keys and single quoted strings with
+// double quotes.  Anything else is copied as it is, so that errors in it are
+// reported by the JSON tokenizer.
+func appendStrictJson(out, data []byte) ([]byte, error) {
+	pendingComma := false
+	for pos := 0; ; {
+		next, err := skipRelaxedSpace(data, pos)
+		if err != nil {
+			return out, err
+		}
+		if pendingComma && next < len(data) && data[next] != '}' && data[next] != ']' {
+			out = append(out, ',')
+		}
+		pendingComma = false
+		if next > pos {
+			out = append(out, ' ')
+		}
+		pos = next
+		if pos >= len(data) {
+			return out, nil
+		}
+
+		c := data[pos]
+		switch {
+		case c == ',':
+			// Only written once the next element is known to follow
+			pendingComma = true
+			pos++
+		case c == '"':
+			end := pos + 1
+			for end < len(data) && data[end] != '"' {
+				if data[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(data) {
+				return out, ErrorJsonMalformed
+			}
+			out = append(out, data[pos:end+1]...)
+			pos = end + 1
+		case c == '\'':
+			out = append(out, '"')
+			for pos++; pos < len(data) && data[pos] != '\''; pos++ {
+				switch {
+				case data[pos] == '\\' && pos+1 < len(data) && data[pos+1] == '\'':
+					out = append(out, '\'')
+					pos++
+				case data[pos] == '\\' && pos+1 < len(data):
+					out = append(out, data[pos], data[pos+1])
+					pos++
+				case data[pos] == '"':
+					out = append(out, '\\', '"')
+				default:
+					out = append(out, data[pos])
+				}
+			}
+			if pos >= len(data) {
+				return out, ErrorJsonMalformed
+			}
+			out = append(out, '"')
+			pos++
+		case isRelaxedIdentStart(c):
+			end := pos + 1
+			for end < len(data) && isRelaxedIdentChar(data[end]) {
+				end++
+			}
+			// Identifiers followed by a colon are keys, anything else such
+			// as `true` is left to the JSON tokenizer
+			colon, err := skipRelaxedSpace(data, end)
+			if err != nil {
+				return out, err
+			}
+			if colon < len(data) && data[colon] == ':' {
+				out = append(out, '"')
+				out = append(out, data[pos:end]...)
+				out = append(out, '"')
+			} else {
+				out = append(out, data[pos:end]...)
+			}
+			pos = end
+		default:
+			out = append(out, c)
+			pos++
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendStrictJson(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]string{
+		`{"a":1}`:                          `{"a":1}`,
+		`{a: 1, $b_2: [1, 2,],}`:           `{"a": 1, "$b_2": [1, 2]}`,
+		"{a: 1 // one\n}":                  `{"a": 1 }`,
+		`{/* x */ a /* y */: 'it\'s "q"'}`: `{ "a" : "it's \"q\""}`,
+		`{"s": "// not a comment", "t": '/* nor this */'}`: `{"s": "// not a comment", "t": "/* nor this */"}`,
+		`[true, null, 1e5, -2.5,]`:                         `[true, null, 1e5, -2.5]`,
+		`[1,,2]`:                                           `[1,,2]`,
+	}
+	for relaxed, strict := range tests {
+		out, err := appendStrictJson(nil, []byte(relaxed))
+		assert.Nil(err, relaxed)
+		assert.Equal(strict, string(out), relaxed)
+	}
+
+	for _, relaxed := range []string{`{a: "x}`, `{a: 'x}`, `{a: 1 /* x }`} {
+		_, err := appendStrictJson(nil, []byte(relaxed))
+		assert.Equal(ErrorJsonMalformed, err, relaxed)
+	}
+}
+
+func TestRelaxedJSONMatcher(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseFilterExpression(`server.port = 8080 AND ARRAY_CONTAINS(server.hosts, "b") AND name = "it's"`)
+	assert.Nil(err)
+	var trans Transformer
+	m := NewRelaxedJSONMatcher(trans.Transform([]Expression{expr}))
+
+	doc := `
+	// Hand written configuration
+	{
+		name: 'it\'s',
+		server: {
+			port: 8080, /* the default */
+			hosts: ['a', 'b',],
+		},
+	}`
+	matched, err := m.Match([]byte(doc))
+	assert.Nil(err)
+	assert.True(matched)
+
+	m.Reset()
+	matched, err = m.Match([]byte(`{name: "it's", server: {port: 8081, hosts: ["b"]}}`))
+	assert.Nil(err)
+	assert.False(matched)
+
+	m.Reset()
+	_, err = m.Match([]byte(`{name: 'it's'}`))
+	assert.NotNil(err)
+	m.Reset()
+	_, err = m.Match([]byte(`{name: "x" /* unterminated`))
+	assert.Equal(ErrorJsonMalformed, err)
+
+	// The strict matcher still rejects relaxed documents
+	_, err = NewFastMatcher(trans.Transform([]Expression{expr})).Match([]byte(doc))
+	assert.NotNil(err)
+}
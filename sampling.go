@@ -0,0 +1,83 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"hash/fnv"
+)
+
+// SampleMode decides what a SamplingMatcher returns for documents which are
+// not part of the sample
+type SampleMode int
+
+const (
+	// Documents outside of the sample do not match
+	SampleNoMatch SampleMode = iota
+	// Documents outside of the sample match without being evaluated
+	SamplePassThrough
+)
+
+// SamplingMatcher only evaluates a fraction of the documents it is given,
+// which allows a new filter to be tried out on part of the traffic cheaply.
+// Whether a document is sampled depends only on a hash of its key, so the
+// same documents are always chosen for the same rate, and the documents
+// chosen for a rate are also chosen for any higher rate.
+type SamplingMatcher struct {
+	matcher Matcher
+	rate    float64
+	mode    SampleMode
+}
+
+// NewSamplingMatcher wraps a matcher so that only the given fraction of
+// documents, between 0 and 1, are evaluated
+func NewSamplingMatcher(matcher Matcher, rate float64, mode SampleMode) *SamplingMatcher {
+	if rate < 0 {
+		rate = 0
+	} else if rate > 1 {
+		rate = 1
+	}
+	return &SamplingMatcher{
+		matcher: matcher,
+		rate:    rate,
+		mode:    mode,
+	}
+}
+
+// Sampled returns whether the document with a key is part of the sample
+func (m *SamplingMatcher) Sampled(key []byte) bool {
+	if m.rate >= 1 {
+		return true
+	}
+
+	hash := fnv.New64a()
+	hash.Write(key)
+	// The high bits of FNV barely change between similar keys, such as
+	// keys only differing by a counter, so they are mixed first
+	sum := hash.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	sum *= 0xc4ceb9fe1a85ec53
+	sum ^= sum >> 33
+	// The top 53 bits give a fraction which a float64 holds exactly
+	return float64(sum>>11)/(1<<53) < m.rate
+}
+
+// MatchKey matches a document when its key is part of the sample, and
+// otherwise returns the result of the sampling mode
+func (m *SamplingMatcher) MatchKey(key, data []byte) (bool, error) {
+	if !m.Sampled(key) {
+		return m.mode == SamplePassThrough, nil
+	}
+	return m.matcher.Match(data)
+}
+
+// Match samples a document by the hash of its contents, for documents which
+// have no separate key
+func (m *SamplingMatcher) Match(data []byte) (bool, error) {
+	return m.MatchKey(data, data)
+}
+
+func (m *SamplingMatcher) Reset() {
+	m.matcher.Reset()
+}
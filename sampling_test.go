@@ -0,0 +1,59 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSamplingMatcher(t *testing.T) {
+	assert := assert.New(t)
+
+	matcher, err := GetFilterExpressionMatcher(`type = "order"`)
+	assert.Nil(err)
+	doc := []byte(`{"type":"order"}`)
+	other := []byte(`{"type":"refund"}`)
+
+	half := NewSamplingMatcher(matcher, 0.5, SampleNoMatch)
+	tenth := NewSamplingMatcher(matcher, 0.1, SamplePassThrough)
+
+	numSampled := 0
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("doc::%d", i))
+
+		matcher.Reset()
+		matched, err := half.MatchKey(key, doc)
+		assert.Nil(err)
+		assert.Equal(half.Sampled(key), matched)
+		if half.Sampled(key) {
+			numSampled++
+		}
+
+		// Documents sampled at a lower rate are sampled at higher ones
+		if tenth.Sampled(key) {
+			assert.True(half.Sampled(key))
+		}
+
+		matcher.Reset()
+		matched, err = tenth.MatchKey(key, other)
+		assert.Nil(err)
+		assert.Equal(!tenth.Sampled(key), matched)
+	}
+	assert.InDelta(500, numSampled, 60)
+
+	all := NewSamplingMatcher(matcher, 2, SampleNoMatch)
+	none := NewSamplingMatcher(matcher, -1, SamplePassThrough)
+	all.Reset()
+	matched, err := all.Match(doc)
+	assert.Nil(err)
+	assert.True(matched)
+	none.Reset()
+	matched, err = none.Match(other)
+	assert.Nil(err)
+	assert.True(matched)
+
+	var _ Matcher = all
+}
@@ -0,0 +1,306 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+// Package server provides HTTP handlers for running gojsonsm as a filter
+// service.  Expressions are registered under a name, and documents are then
+// POSTed to be evaluated against them:
+//
+//	POST   /validate              {"expression": "..."}
+//	GET    /filters
+//	PUT    /filters/{name}        {"expression": "..."}
+//	GET    /filters/{name}
+//	DELETE /filters/{name}
+//	POST   /filters/{name}/match  <JSON document>
+//
+// Responses are JSON objects, with failures described by an "error" field.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/couchbaselabs/gojsonsm"
+)
+
+const (
+	filtersPath  = "/filters/"
+	matchSuffix  = "/match"
+	validatePath = "/validate"
+
+	// Limits the size of documents and requests read into memory
+	defaultMaxBodySize = 20 * 1024 * 1024
+)
+
+var ErrFilterNotFound = errors.New("filter not found")
+
+// filter is a compiled expression.  Matchers hold per-document state, so a
+// pool of them is kept for concurrent requests.
+type filter struct {
+	expression string
+	matchers   sync.Pool
+}
+
+func newFilter(expression string) (*filter, error) {
+	expr, err := gojsonsm.ParseFilterExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	var trans gojsonsm.Transformer
+	matchDef := trans.Transform([]gojsonsm.Expression{expr})
+
+	f := &filter{expression: expression}
+	f.matchers.New = func() interface{} {
+		return gojsonsm.NewFastMatcher(matchDef)
+	}
+	return f, nil
+}
+
+func (f *filter) match(doc []byte) (bool, error) {
+	matcher := f.matchers.Get().(*gojsonsm.FastMatcher)
+	defer f.matchers.Put(matcher)
+
+	matcher.Reset()
+	return matcher.Match(doc)
+}
+
+// Server holds the registered filters and serves the HTTP API for them.  It
+// is safe for concurrent use.
+type Server struct {
+	// MaxBodySize limits the size of request bodies, defaulting to 20MiB
+	MaxBodySize int64
+
+	lock    sync.RWMutex
+	filters map[string]*filter
+}
+
+func New() *Server {
+	return &Server{
+		filters: make(map[string]*filter),
+	}
+}
+
+// Register compiles an expression and stores it under the given name,
+// replacing any filter previously registered with that name
+func (s *Server) Register(name, expression string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid filter name %q", name)
+	}
+
+	f, err := newFilter(expression)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.filters[name] = f
+	s.lock.Unlock()
+	return nil
+}
+
+// Remove deletes a registered filter, returning ErrFilterNotFound if there
+// was none with the given name
+func (s *Server) Remove(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.filters[name]; !ok {
+		return ErrFilterNotFound
+	}
+	delete(s.filters, name)
+	return nil
+}
+
+// Match evaluates a JSON document against a registered filter
+func (s *Server) Match(name string, doc []byte) (bool, error) {
+	f := s.lookup(name)
+	if f == nil {
+		return false, ErrFilterNotFound
+	}
+	return f.match(doc)
+}
+
+func (s *Server) lookup(name string) *filter {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.filters[name]
+}
+
+type expressionRequest struct {
+	Expression string `json:"expression"`
+}
+
+type validateResponse struct {
+	Valid     bool   `json:"valid"`
+	Canonical string `json:"canonical,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Column    int    `json:"column,omitempty"`
+}
+
+type filterResponse struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+type matchResponse struct {
+	Matched bool `json:"matched"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{err.Error()})
+}
+
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	maxSize := s.MaxBodySize
+	if maxSize <= 0 {
+		maxSize = defaultMaxBodySize
+	}
+	return ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+}
+
+func (s *Server) readExpression(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req expressionRequest
+	body, err := s.readBody(w, r)
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return "", false
+	}
+	return req.Expression, true
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == validatePath:
+		s.serveValidate(w, r)
+	case r.URL.Path == strings.TrimSuffix(filtersPath, "/") || r.URL.Path == filtersPath:
+		s.serveList(w, r)
+	case strings.HasPrefix(r.URL.Path, filtersPath):
+		name := strings.TrimPrefix(r.URL.Path, filtersPath)
+		if strings.HasSuffix(name, matchSuffix) {
+			s.serveMatch(w, r, strings.TrimSuffix(name, matchSuffix))
+		} else {
+			s.serveFilter(w, r, name)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	expression, ok := s.readExpression(w, r)
+	if !ok {
+		return
+	}
+
+	expr, err := gojsonsm.ParseFilterExpression(expression)
+	if err != nil {
+		resp := validateResponse{Error: err.Error()}
+		var feErr *gojsonsm.FilterExpressionError
+		if errors.As(err, &feErr) {
+			resp.Line = feErr.Line
+			resp.Column = feErr.Column
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	resp := validateResponse{Valid: true}
+	if canonical, err := gojsonsm.FormatExpression(expr); err == nil {
+		resp.Canonical = canonical
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) serveList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	s.lock.RLock()
+	filters := make([]filterResponse, 0, len(s.filters))
+	for name, f := range s.filters {
+		filters = append(filters, filterResponse{name, f.expression})
+	}
+	s.lock.RUnlock()
+
+	sort.Slice(filters, func(i, j int) bool {
+		return filters[i].Name < filters[j].Name
+	})
+	writeJSON(w, http.StatusOK, filters)
+}
+
+func (s *Server) serveFilter(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		f := s.lookup(name)
+		if f == nil {
+			writeError(w, http.StatusNotFound, ErrFilterNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, filterResponse{name, f.expression})
+	case http.MethodPut:
+		expression, ok := s.readExpression(w, r)
+		if !ok {
+			return
+		}
+		if err := s.Register(name, expression); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, filterResponse{name, expression})
+	case http.MethodDelete:
+		if err := s.Remove(name); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) serveMatch(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	doc, err := s.readBody(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	matched, err := s.Match(name, doc)
+	if err == ErrFilterNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, matchResponse{matched})
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func doRequest(s *Server, method, path, body string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+func TestServerFilterLifecycle(t *testing.T) {
+	assert := assert.New(t)
+	s := New()
+
+	status, _ := doRequest(s, http.MethodPut, "/filters/adults", `{"expression": "age >= 18"}`)
+	assert.Equal(http.StatusOK, status)
+
+	status, resp := doRequest(s, http.MethodGet, "/filters/adults", "")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("age >= 18", resp["expression"])
+
+	status, resp = doRequest(s, http.MethodPost, "/filters/adults/match", `{"age": 30}`)
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(true, resp["matched"])
+
+	status, resp = doRequest(s, http.MethodPost, "/filters/adults/match", `{"age": 10}`)
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(false, resp["matched"])
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/filters", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`[{"name": "adults", "expression": "age >= 18"}]`, w.Body.String())
+
+	status, _ = doRequest(s, http.MethodDelete, "/filters/adults", "")
+	assert.Equal(http.StatusNoContent, status)
+
+	status, _ = doRequest(s, http.MethodPost, "/filters/adults/match", `{"age": 30}`)
+	assert.Equal(http.StatusNotFound, status)
+}
+
+func TestServerValidate(t *testing.T) {
+	assert := assert.New(t)
+	s := New()
+
+	status, resp := doRequest(s, http.MethodPost, "/validate", `{"expression": "a  =  1"}`)
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(true, resp["valid"])
+	assert.Equal("a = 1", resp["canonical"])
+
+	status, resp = doRequest(s, http.MethodPost, "/validate", `{"expression": "a = 1 b"}`)
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(false, resp["valid"])
+	assert.NotEmpty(resp["error"])
+
+	status, _ = doRequest(s, http.MethodPut, "/filters/bad", `{"expression": "a = "}`)
+	assert.Equal(http.StatusBadRequest, status)
+
+	status, _ = doRequest(s, http.MethodGet, "/validate", "")
+	assert.Equal(http.StatusMethodNotAllowed, status)
+}
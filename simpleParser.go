@@ -59,23 +59,26 @@ var fieldIndexNoLeadingZero *regexp.Regexp = regexp.MustCompile(`[^0][0-9]+`)
 
 // Functions patterns
 var funcTranslateTable map[string]string = map[string]string{
-	FuncAbs:   MathFuncAbs,
-	FuncAcos:  MathFuncAcos,
-	FuncAsin:  MathFuncAsin,
-	FuncAtan:  MathFuncAtan,
-	FuncCeil:  MathFuncCeil,
-	FuncCos:   MathFuncCos,
-	FuncDate:  DateFunc,
-	FuncDeg:   MathFuncDegrees,
-	FuncExp:   MathFuncExp,
-	FuncFloor: MathFuncFloor,
-	FuncLog:   MathFuncLog,
-	FuncLn:    MathFuncLn,
-	FuncSin:   MathFuncSin,
-	FuncTan:   MathFuncTan,
-	FuncRad:   MathFuncRadians,
-	FuncRound: MathFuncRound,
-	FuncSqrt:  MathFuncSqrt,
+	FuncAbs:       MathFuncAbs,
+	FuncAcos:      MathFuncAcos,
+	FuncAsin:      MathFuncAsin,
+	FuncAtan:      MathFuncAtan,
+	FuncCeil:      MathFuncCeil,
+	FuncCos:       MathFuncCos,
+	FuncDate:      DateFunc,
+	FuncDeg:       MathFuncDegrees,
+	FuncExp:       MathFuncExp,
+	FuncFloor:     MathFuncFloor,
+	FuncLog:       MathFuncLog,
+	FuncLn:        MathFuncLn,
+	FuncLog10:     MathFuncLog10,
+	FuncLog2:      MathFuncLog2,
+	FuncSin:       MathFuncSin,
+	FuncTan:       MathFuncTan,
+	FuncRad:       MathFuncRadians,
+	FuncRound:     MathFuncRound,
+	FuncRoundEven: MathFuncRoundEven,
+	FuncSqrt:      MathFuncSqrt,
 }
 
 var func0VarTranslateTable map[string]string = map[string]string{
@@ -87,6 +90,7 @@ var func0VarTranslateTable map[string]string = map[string]string{
 var func2VarsTranslateTable map[string]string = map[string]string{
 	FuncAtan2: MathFuncAtan2,
 	FuncPower: MathFuncPow,
+	FuncMod:   MathFuncMod,
 }
 
 func funcIsConstantType(fxName string) (bool, interface{}) {
@@ -3,15 +3,28 @@
 package gojsonsm
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// SlowMatcher is the reference implementation of the matcher, which
+// evaluates expressions directly against the decoded document, and gives
+// the same results as a FastMatcher with its default policies.
 type SlowMatcher struct {
 	exprs       []Expression
 	exprMatches []bool
 	vars        map[VariableID]interface{}
+	// The variable of the innermost loop being matched, or 0 outside of them
+	loopVar VariableID
+	// Whether a loop over a value which is not an array is being matched,
+	// whose body is then matched with none of its conditions holding
+	unread bool
+	// The value NOW_MILLIS() has for the current document, once it is read
+	now    FastVal
+	nowSet bool
 }
 
 func NewSlowMatcher(exprs []Expression) *SlowMatcher {
@@ -21,30 +34,261 @@ func NewSlowMatcher(exprs []Expression) *SlowMatcher {
 	}
 }
 
-func (m *SlowMatcher) resolveFieldParam(expr FieldExpr) (interface{}, error) {
-	rootVal := m.vars[expr.Root]
+// slowArrayIndex parses a path part such as `[1]` into the index it holds
+func slowArrayIndex(part string) (int, bool) {
+	if !strings.HasPrefix(part, "[") || !strings.HasSuffix(part, "]") {
+		return 0, false
+	}
+	idx, err := strconv.Atoi(part[1 : len(part)-1])
+	return idx, err == nil && idx >= 0
+}
 
-	curVal := rootVal
+// slowFastVal converts a decoded value to the FastVal FastMatcher would read
+// for it, where strings hold their JSON text
+func slowFastVal(val interface{}) FastVal {
+	switch val := val.(type) {
+	case json.Number:
+		if intVal, err := val.Int64(); err == nil {
+			return NewIntFastVal(intVal)
+		}
+		if uintVal, err := strconv.ParseUint(string(val), 10, 64); err == nil {
+			return NewUintFastVal(uintVal)
+		}
+		floatVal, _ := val.Float64()
+		return NewFloatFastVal(floatVal)
+	case string:
+		jsonVal, _ := NewStringFastVal(val).ToJsonString()
+		return jsonVal
+	case []interface{}:
+		elems := make([]FastVal, len(val))
+		for i, elem := range val {
+			elems[i] = slowFastVal(elem)
+		}
+		return NewArrayFastVal(elems)
+	case map[string]interface{}:
+		fields := make(map[string]FastVal, len(val))
+		for key, field := range val {
+			fields[key] = slowFastVal(field)
+		}
+		return NewObjectFastVal(fields)
+	}
+	return NewFastVal(val)
+}
+
+// resolveField returns the decoded value the field refers to, and whether
+// there is one
+func (m *SlowMatcher) resolveField(expr FieldExpr) (interface{}, bool) {
+	curVal, ok := m.vars[expr.Root]
 	for _, field := range expr.Path {
-		if mapVal, ok := curVal.(map[string]interface{}); ok {
-			curVal = mapVal[field]
-		} else {
-			return NewNullFastVal(), errors.New("invalid path")
+		if !ok {
+			return nil, false
 		}
+		switch container := curVal.(type) {
+		case map[string]interface{}:
+			curVal, ok = container[field]
+		case []interface{}:
+			idx, isIdx := slowArrayIndex(field)
+			ok = isIdx && idx < len(container)
+			if ok {
+				curVal = container[idx]
+			}
+		default:
+			return nil, false
+		}
+	}
+	if !ok {
+		return nil, false
 	}
+	return curVal, true
+}
 
-	return curVal, nil
+// resolveElems returns the elements of the array a loop iterates over, and
+// whether it is an array
+func (m *SlowMatcher) resolveElems(expr Expression) ([]interface{}, bool) {
+	var val interface{}
+	switch expr := expr.(type) {
+	case FieldExpr:
+		val, _ = m.resolveField(expr)
+	case ValueExpr:
+		val = expr.Value
+	}
+	elems, ok := val.([]interface{})
+	return elems, ok
 }
 
-func (m *SlowMatcher) resolveParam(expr Expression) (interface{}, error) {
+func (m *SlowMatcher) resolveParam(expr Expression) (FastVal, error) {
 	switch expr := expr.(type) {
 	case FieldExpr:
-		return m.resolveFieldParam(expr)
+		if val, ok := m.resolveField(expr); ok {
+			return slowFastVal(val), nil
+		}
+		return NewMissingFastVal(), nil
 	case ValueExpr:
-		return expr.Value, nil
+		return slowFastVal(expr.Value), nil
+	case TimeExpr:
+		return GetNewTimeFastVal(expr.Time.(string))
+	case FuncExpr:
+		return m.resolveFuncParam(expr)
+	case FirstInExpr:
+		val, _, err := m.resolveFirst(expr)
+		return val, err
+	case RegexExpr:
+		regex, err := compileCachedRegex(expr.Regex.(string))
+		if err != nil {
+			return NewInvalidFastVal(), newFilterExpressionError(ErrBadRegex, "failed to compile RegexExpr: %v", err)
+		}
+		return NewFastVal(regex), nil
+	case PcreExpr:
+		pcreWrapper, err := compileCachedPcre(expr.Pcre.(string))
+		return NewFastVal(pcreWrapper), err
+	case EngineRegexExpr:
+		program, err := compileCachedEngineRegex(expr.Engine, expr.Regex.(string))
+		return NewFastVal(program), err
 	}
 
-	panic("unexpected param expression")
+	return NewInvalidFastVal(), newFilterExpressionError(ErrorUnsupportedExpression, "%v: %v", ErrorUnsupportedExpression, expr)
+}
+
+func (m *SlowMatcher) nowMillis() FastVal {
+	if !m.nowSet {
+		m.now = NewIntFastVal(time.Now().UnixNano() / int64(time.Millisecond))
+		m.nowSet = true
+	}
+	return m.now
+}
+
+func (m *SlowMatcher) resolveFuncParam(expr FuncExpr) (FastVal, error) {
+	if expr.FuncName == NowMillisFunc {
+		return m.nowMillis(), nil
+	}
+
+	impl, ok := vmFuncs[expr.FuncName]
+	numParams := 1
+	if impl.fn2 != nil {
+		numParams = 2
+	}
+	if !ok || len(expr.Params) != numParams {
+		return NewInvalidFastVal(), newFilterExpressionError(ErrUnsupportedFunction, "unsupported function: %v", expr.FuncName)
+	}
+
+	var params [2]FastVal
+	for i, paramExpr := range expr.Params {
+		param, err := m.resolveParam(paramExpr)
+		if err != nil {
+			return NewInvalidFastVal(), err
+		}
+		params[i] = param
+	}
+
+	var val FastVal
+	if impl.fn2 != nil {
+		val = impl.fn2(params[0], params[1])
+	} else {
+		val = impl.fn1(params[0])
+	}
+	if val.IsString() {
+		// Functions may give strings which are not JSON text
+		val, _ = val.ToJsonString()
+	}
+	return val, nil
+}
+
+// resolveFirst gives the result of a FIRST expression, and whether any
+// element was found for it
+func (m *SlowMatcher) resolveFirst(expr FirstInExpr) (FastVal, bool, error) {
+	elems, _ := m.resolveElems(expr.InExpr)
+	outerVar := m.loopVar
+	defer func() { m.loopVar = outerVar }()
+
+	for _, elem := range elems {
+		m.vars[expr.VarId] = elem
+		m.loopVar = expr.VarId
+		res := true
+		var err error
+		if expr.SubExpr != nil {
+			res, err = m.matchOne(expr.SubExpr)
+		}
+		val := NewMissingFastVal()
+		if err == nil && res {
+			val, err = m.resolveParam(expr.ResultExpr)
+		}
+		delete(m.vars, expr.VarId)
+
+		if err != nil || res {
+			return val, res, err
+		}
+	}
+
+	return NewMissingFastVal(), false, nil
+}
+
+// resolveOperand resolves an operand of a condition, returning false when
+// it is a FIRST expression which found no element, as the condition is then
+// false as well
+func (m *SlowMatcher) resolveOperand(expr Expression) (FastVal, bool, error) {
+	if first, ok := expr.(FirstInExpr); ok {
+		return m.resolveFirst(first)
+	}
+	val, err := m.resolveParam(expr)
+	return val, true, err
+}
+
+// conditionRuns checks whether FastMatcher evaluates a condition on the
+// operands for the current document, which it only does once it reads the
+// value the condition is attached to
+func (m *SlowMatcher) conditionRuns(operands ...Expression) bool {
+	var paths [][]string
+	hasFirst, readsContainers := false, false
+	for _, operand := range operands {
+		switch operand := operand.(type) {
+		case FirstInExpr:
+			hasFirst = true
+		case ValueExpr:
+			switch operand.Value.(type) {
+			case []interface{}, map[string]interface{}:
+				readsContainers = true
+			}
+		}
+		for _, field := range fetchExprFieldRefs(operand) {
+			if field.Root == m.loopVar {
+				paths = append(paths, field.Path)
+			}
+		}
+	}
+
+	var basePath []string
+	for _, path := range paths {
+		if len(path) > len(basePath) {
+			basePath = path
+		}
+	}
+	commonPath := basePath
+	for _, path := range paths {
+		i := 0
+		for i < len(path) && i < len(commonPath) && path[i] == commonPath[i] {
+			i++
+		}
+		commonPath = commonPath[:i]
+	}
+
+	// Conditions on several fields, or on the result of a FIRST, run once the
+	// value holding all of them has been read, whatever its type
+	if hasFirst || len(commonPath) < len(basePath) {
+		_, ok := m.resolveField(FieldExpr{m.loopVar, commonPath})
+		return ok
+	}
+
+	// Otherwise they run as the field is read, which is only done for
+	// arrays and objects when they are compared with literals of their own
+	val, ok := m.resolveField(FieldExpr{m.loopVar, basePath})
+	if !ok {
+		return false
+	}
+	switch val.(type) {
+	case []interface{}, map[string]interface{}:
+		return readsContainers
+	}
+	return true
 }
 
 func (m *SlowMatcher) matchOrExpr(expr OrExpr) (bool, error) {
@@ -81,189 +325,207 @@ func (m *SlowMatcher) matchAndExpr(expr AndExpr) (bool, error) {
 	return true, nil
 }
 
-func (m *SlowMatcher) compareExprs(lhs Expression, rhs Expression) (int, error) {
-	lhsVal, err := m.resolveParam(lhs)
+func (m *SlowMatcher) matchNotExpr(expr NotExpr) (bool, error) {
+	res, err := m.matchOne(expr.SubExpr)
+	return !res && err == nil, err
+}
+
+// compareExprs compares both sides of a comparison with the op, which never
+// holds when either of them is NaN or infinite
+func (m *SlowMatcher) compareExprs(op OpType, lhs Expression, rhs Expression) (bool, error) {
+	if m.unread {
+		return false, nil
+	}
+
+	lhsVal, lhsFound, err := m.resolveOperand(lhs)
 	if err != nil {
-		return 0, err
+		return false, err
 	}
 
-	rhsVal, err := m.resolveParam(rhs)
+	rhsVal, rhsFound, err := m.resolveOperand(rhs)
 	if err != nil {
-		return 0, err
+		return false, err
 	}
 
-	switch lhsVal := lhsVal.(type) {
-	case string:
-		switch rhsVal := rhsVal.(type) {
-		case string:
-			return strings.Compare(lhsVal, rhsVal), nil
-		}
-		return 0, errors.New("invalid type comparisons")
-	case float64:
-		switch rhsVal := rhsVal.(type) {
-		case float64:
-			if lhsVal < rhsVal {
-				return -1, nil
-			} else if lhsVal > rhsVal {
-				return 1, nil
-			}
-			return 0, nil
-		}
-		return 0, errors.New("invalid type comparisons")
-	case bool:
-		switch rhsVal := rhsVal.(type) {
-		case bool:
-			if lhsVal == true && rhsVal == false {
-				return 1, nil
-			} else if lhsVal == false && rhsVal == true {
-				return -1, nil
-			}
-			return 0, nil
+	if !lhsFound || !rhsFound || !m.conditionRuns(lhs, rhs) ||
+		isNonFiniteFastVal(lhsVal) || isNonFiniteFastVal(rhsVal) {
+		return false, nil
+	}
+	return compareValues(op, lhsVal, rhsVal), nil
+}
+
+// matchLoop runs the body of a loop over the elements of its array, and
+// returns whether the value is an array, and whether the body held for any
+// of its elements and for all of them.  It stops at the first element the
+// body holds for when stopOnAny is set, and otherwise at the first it does
+// not hold for.
+func (m *SlowMatcher) matchLoop(varID VariableID, inExpr Expression, subExpr Expression, stopOnAny bool) (bool, bool, error) {
+	elems, isArray := m.resolveElems(inExpr)
+	if !isArray {
+		unread := m.unread
+		m.unread = true
+		res, err := m.matchOne(subExpr)
+		m.unread = unread
+		return res, res, err
+	}
+
+	anyRes, allRes := false, true
+	outerVar := m.loopVar
+	defer func() { m.loopVar = outerVar }()
+
+	for _, elem := range elems {
+		m.vars[varID] = elem
+		m.loopVar = varID
+		res, err := m.matchOne(subExpr)
+		delete(m.vars, varID)
+
+		if err != nil {
+			return false, false, err
 		}
-	case nil:
-		switch rhsVal.(type) {
-		case nil:
-			return 0, nil
+		anyRes = anyRes || res
+		allRes = allRes && res
+		if (stopOnAny && res) || (!stopOnAny && !allRes) {
+			break
 		}
-		return -1, nil
 	}
 
-	return 0, errors.New("unexpected lhs type")
+	return anyRes, allRes, nil
 }
 
 func (m *SlowMatcher) matchAnyInExpr(expr AnyInExpr) (bool, error) {
-	vals, err := m.resolveParam(expr.InExpr)
-	if err != nil {
-		return false, err
-	}
+	anyRes, _, err := m.matchLoop(expr.VarId, expr.InExpr, expr.SubExpr, true)
+	return anyRes, err
+}
+
+func (m *SlowMatcher) matchEveryInExpr(expr EveryInExpr) (bool, error) {
+	_, allRes, err := m.matchLoop(expr.VarId, expr.InExpr, expr.SubExpr, false)
+	return allRes, err
+}
+
+func (m *SlowMatcher) matchAnyEveryInExpr(expr AnyEveryInExpr) (bool, error) {
+	anyRes, allRes, err := m.matchLoop(expr.VarId, expr.InExpr, expr.SubExpr, false)
+	return anyRes && allRes, err
+}
 
+// matchWithinValues tries the loop body against each value within vals,
+// and then against the values nested inside of those
+func (m *SlowMatcher) matchWithinValues(expr AnyWithinExpr, vals interface{}) (bool, error) {
+	var children []interface{}
 	switch vals := vals.(type) {
 	case map[string]interface{}:
 		for _, val := range vals {
-			m.vars[expr.VarId] = val
-			res, err := m.matchOne(expr.SubExpr)
-			delete(m.vars, expr.VarId)
-
-			if err != nil {
-				return false, err
-			}
-
-			if res {
-				return true, nil
-			}
+			children = append(children, val)
 		}
-
-		return false, nil
 	case []interface{}:
-		for _, val := range vals {
-			m.vars[expr.VarId] = val
-			res, err := m.matchOne(expr.SubExpr)
-			delete(m.vars, expr.VarId)
-
-			if err != nil {
-				return false, err
-			}
-
-			if res {
-				return true, nil
-			}
-		}
-
-		return false, nil
+		children = vals
 	}
 
-	panic("unexpected any in param type")
-}
+	outerVar := m.loopVar
+	defer func() { m.loopVar = outerVar }()
 
-func (m *SlowMatcher) matchEqualsExpr(expr EqualsExpr) (bool, error) {
-	val, err := m.compareExprs(expr.Lhs, expr.Rhs)
-	if err != nil {
-		return false, err
-	}
+	for _, val := range children {
+		m.vars[expr.VarId] = val
+		m.loopVar = expr.VarId
+		res, err := m.matchOne(expr.SubExpr)
+		m.loopVar = outerVar
+		delete(m.vars, expr.VarId)
 
-	return val == 0, nil
-}
+		if err != nil || res {
+			return res, err
+		}
 
-func (m *SlowMatcher) matchNotEqualsExpr(expr NotEqualsExpr) (bool, error) {
-	val, err := m.compareExprs(expr.Lhs, expr.Rhs)
-	if err != nil {
-		return false, err
+		res, err = m.matchWithinValues(expr, val)
+		if err != nil || res {
+			return res, err
+		}
 	}
 
-	return val != 0, nil
+	return false, nil
 }
 
-func (m *SlowMatcher) matchLessThanExpr(expr LessThanExpr) (bool, error) {
-	val, err := m.compareExprs(expr.Lhs, expr.Rhs)
-	if err != nil {
-		return false, err
+func (m *SlowMatcher) matchAnyWithinExpr(expr AnyWithinExpr) (bool, error) {
+	var vals interface{}
+	switch inExpr := expr.InExpr.(type) {
+	case FieldExpr:
+		vals, _ = m.resolveField(inExpr)
+	case ValueExpr:
+		vals = inExpr.Value
 	}
 
-	return val < 0, nil
+	return m.matchWithinValues(expr, vals)
 }
 
-func (m *SlowMatcher) matchLessEqualsExpr(expr LessEqualsExpr) (bool, error) {
-	val, err := m.compareExprs(expr.Lhs, expr.Rhs)
-	if err != nil {
-		return false, err
+func (m *SlowMatcher) matchExistsExpr(expr ExistsExpr) (bool, error) {
+	if m.unread {
+		return false, nil
 	}
 
-	return val <= 0, nil
-}
+	switch subExpr := expr.SubExpr.(type) {
+	case FieldExpr:
+		_, ok := m.resolveField(subExpr)
+		return ok, nil
+	case FirstInExpr:
+		_, found, err := m.resolveFirst(subExpr)
+		return found, err
+	}
 
-func (m *SlowMatcher) matchGreaterThanExpr(expr GreaterThanExpr) (bool, error) {
-	val, err := m.compareExprs(expr.Lhs, expr.Rhs)
+	val, err := m.resolveParam(expr.SubExpr)
 	if err != nil {
 		return false, err
 	}
 
-	return val > 0, nil
+	return m.conditionRuns(expr.SubExpr) && !val.IsMissing() && !isNonFiniteFastVal(val), nil
 }
 
-func (m *SlowMatcher) matchGreaterEqualsExpr(expr GreaterEqualsExpr) (bool, error) {
-	val, err := m.compareExprs(expr.Lhs, expr.Rhs)
-	if err != nil {
-		return false, err
-	}
-
-	return val >= 0, nil
+func (m *SlowMatcher) matchNotExistsExpr(expr NotExistsExpr) (bool, error) {
+	res, err := m.matchExistsExpr(ExistsExpr{expr.SubExpr})
+	return !res && err == nil, err
 }
 
 func (m *SlowMatcher) matchOne(expr Expression) (bool, error) {
 	switch expr := expr.(type) {
+	case TrueExpr:
+		return true, nil
+	case FalseExpr:
+		return false, nil
 	case OrExpr:
 		return m.matchOrExpr(expr)
 	case AndExpr:
 		return m.matchAndExpr(expr)
+	case NotExpr:
+		return m.matchNotExpr(expr)
 	case AnyInExpr:
 		return m.matchAnyInExpr(expr)
+	case EveryInExpr:
+		return m.matchEveryInExpr(expr)
+	case AnyEveryInExpr:
+		return m.matchAnyEveryInExpr(expr)
+	case AnyWithinExpr:
+		return m.matchAnyWithinExpr(expr)
+	case ExistsExpr:
+		return m.matchExistsExpr(expr)
+	case NotExistsExpr:
+		return m.matchNotExistsExpr(expr)
 	case EqualsExpr:
-		return m.matchEqualsExpr(expr)
+		return m.compareExprs(OpTypeEquals, expr.Lhs, expr.Rhs)
+	case StrictEqualsExpr:
+		return m.compareExprs(OpTypeStrictEquals, expr.Lhs, expr.Rhs)
 	case NotEqualsExpr:
-		return m.matchNotEqualsExpr(expr)
+		res, err := m.compareExprs(OpTypeEquals, expr.Lhs, expr.Rhs)
+		return !res && err == nil, err
 	case LessThanExpr:
-		return m.matchLessThanExpr(expr)
+		return m.compareExprs(OpTypeLessThan, expr.Lhs, expr.Rhs)
 	case LessEqualsExpr:
-		return m.matchLessEqualsExpr(expr)
+		return m.compareExprs(OpTypeLessEquals, expr.Lhs, expr.Rhs)
 	case GreaterThanExpr:
-		return m.matchGreaterThanExpr(expr)
+		return m.compareExprs(OpTypeGreaterThan, expr.Lhs, expr.Rhs)
 	case GreaterEqualsExpr:
-		return m.matchGreaterEqualsExpr(expr)
+		return m.compareExprs(OpTypeGreaterEquals, expr.Lhs, expr.Rhs)
+	case LikeExpr:
+		return m.compareExprs(OpTypeMatches, expr.Lhs, expr.Rhs)
 	}
 
-	panic("unexpected expression")
-}
-
-func (m *SlowMatcher) matchOneRootExpr(expr Expression) (bool, error) {
-	// We do this to match the Matcher requirement that all non-root
-	// expressions be already compressed of all constant values.
-	switch expr.(type) {
-	case TrueExpr:
-		return true, nil
-	case FalseExpr:
-		return false, nil
-	}
-	return m.matchOne(expr)
+	return false, newFilterExpressionError(ErrorUnsupportedExpression, "%v: %v", ErrorUnsupportedExpression, expr)
 }
 
 func (m *SlowMatcher) Reset() {
@@ -273,11 +535,16 @@ func (m *SlowMatcher) Reset() {
 	for i := range m.exprMatches {
 		m.exprMatches[i] = false
 	}
+	m.loopVar = 0
+	m.unread = false
+	m.nowSet = false
 }
 
 func (m *SlowMatcher) Match(data []byte) (bool, error) {
 	var parsedData interface{}
-	if err := json.Unmarshal(data, &parsedData); err != nil {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&parsedData); err != nil {
 		return false, err
 	}
 
@@ -285,10 +552,11 @@ func (m *SlowMatcher) Match(data []byte) (bool, error) {
 		m.vars = make(map[VariableID]interface{})
 	}
 	m.vars[0] = parsedData
+	m.nowSet = false
 
 	matched := false
 	for i, expr := range m.exprs {
-		res, err := m.matchOneRootExpr(expr)
+		res, err := m.matchOne(expr)
 		if err != nil {
 			return false, err
 		}
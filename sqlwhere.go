@@ -0,0 +1,519 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A dialect-neutral subset of SQL WHERE clauses:
+//
+//   cond      = andCond { OR andCond }
+//   andCond   = notCond { AND notCond }
+//   notCond   = NOT notCond | predicate
+//   predicate = "(" cond ")" | operand [ compareOp operand
+//               | IS [ NOT ] NULL
+//               | [ NOT ] IN "(" operand { "," operand } ")"
+//               | [ NOT ] BETWEEN operand AND operand
+//               | [ NOT ] LIKE string [ ESCAPE string ] ]
+//   operand   = column { "." column } | string | number | TRUE | FALSE | NULL
+//
+// Columns may be quoted with double quotes or backticks, strings use single
+// quotes with '' as an escaped quote.  NULL and missing fields are treated
+// the same, as most SQL over JSON implementations do.
+
+type sqlTokenType int
+
+const (
+	sqlTokenEOF    sqlTokenType = iota
+	sqlTokenIdent  sqlTokenType = iota
+	sqlTokenQuoted sqlTokenType = iota
+	sqlTokenString sqlTokenType = iota
+	sqlTokenNumber sqlTokenType = iota
+	sqlTokenSymbol sqlTokenType = iota
+)
+
+type sqlToken struct {
+	tokenType sqlTokenType
+	value     string
+	pos       int
+}
+
+func sqlTokenize(input string) ([]sqlToken, error) {
+	var tokens []sqlToken
+
+	pos := 0
+	for pos < len(input) {
+		c := input[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			pos++
+		case c == '\'' || c == '"' || c == '`':
+			start := pos
+			pos++
+			var value strings.Builder
+			for {
+				if pos >= len(input) {
+					return nil, sqlErrorAt(start, "unterminated quote")
+				}
+				if input[pos] == c {
+					// Doubled quotes stand for the quote itself
+					if pos+1 < len(input) && input[pos+1] == c {
+						value.WriteByte(c)
+						pos += 2
+						continue
+					}
+					pos++
+					break
+				}
+				value.WriteByte(input[pos])
+				pos++
+			}
+			tokenType := sqlTokenQuoted
+			if c == '\'' {
+				tokenType = sqlTokenString
+			}
+			tokens = append(tokens, sqlToken{tokenType, value.String(), start})
+		case c >= '0' && c <= '9':
+			start := pos
+			for pos < len(input) && strings.IndexByte("0123456789.eE", input[pos]) >= 0 {
+				if (input[pos] == 'e' || input[pos] == 'E') && pos+1 < len(input) &&
+					(input[pos+1] == '-' || input[pos+1] == '+') {
+					pos++
+				}
+				pos++
+			}
+			tokens = append(tokens, sqlToken{sqlTokenNumber, input[start:pos], start})
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80:
+			start := pos
+			for pos < len(input) {
+				c = input[pos]
+				if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80 {
+					pos++
+					continue
+				}
+				break
+			}
+			tokens = append(tokens, sqlToken{sqlTokenIdent, input[start:pos], start})
+		default:
+			start := pos
+			symbol := string(c)
+			if pos+1 < len(input) {
+				switch input[pos : pos+2] {
+				case "<>", "!=", "<=", ">=", "==":
+					symbol = input[pos : pos+2]
+				}
+			}
+			if strings.Index("=<>!(),.-", symbol[:1]) < 0 {
+				return nil, sqlErrorAt(start, "unexpected character %q", symbol)
+			}
+			pos += len(symbol)
+			tokens = append(tokens, sqlToken{sqlTokenSymbol, symbol, start})
+		}
+	}
+
+	tokens = append(tokens, sqlToken{sqlTokenEOF, "", len(input)})
+	return tokens, nil
+}
+
+func sqlErrorAt(pos int, format string, args ...interface{}) error {
+	return &FilterExpressionError{
+		Kind:   ErrSyntax,
+		Line:   1,
+		Column: pos + 1,
+		Msg:    fmt.Sprintf(format, args...),
+		Offset: pos,
+	}
+}
+
+type sqlWhereParser struct {
+	tokens []sqlToken
+	pos    int
+}
+
+func (p *sqlWhereParser) peek() sqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *sqlWhereParser) next() sqlToken {
+	token := p.tokens[p.pos]
+	if token.tokenType != sqlTokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *sqlWhereParser) errorf(format string, args ...interface{}) error {
+	return sqlErrorAt(p.peek().pos, format, args...)
+}
+
+func (p *sqlWhereParser) isKeyword(keyword string) bool {
+	token := p.peek()
+	return token.tokenType == sqlTokenIdent && strings.EqualFold(token.value, keyword)
+}
+
+func (p *sqlWhereParser) acceptKeyword(keyword string) bool {
+	if p.isKeyword(keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlWhereParser) isSymbol(symbol string) bool {
+	token := p.peek()
+	return token.tokenType == sqlTokenSymbol && token.value == symbol
+}
+
+func (p *sqlWhereParser) acceptSymbol(symbol string) bool {
+	if p.isSymbol(symbol) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlWhereParser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return p.errorf("expected %q", symbol)
+	}
+	return nil
+}
+
+var sqlReservedWords map[string]bool = map[string]bool{
+	"AND": true, "OR": true, "NOT": true, "IS": true, "NULL": true, "IN": true,
+	"BETWEEN": true, "LIKE": true, "ESCAPE": true, "TRUE": true, "FALSE": true,
+}
+
+func (p *sqlWhereParser) parseOr() (Expression, error) {
+	var exprs OrExpr
+	for {
+		expr, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.acceptKeyword("OR") {
+			break
+		}
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (p *sqlWhereParser) parseAnd() (Expression, error) {
+	var exprs AndExpr
+	for {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.acceptKeyword("AND") {
+			break
+		}
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (p *sqlWhereParser) parseNot() (Expression, error) {
+	if p.acceptKeyword("NOT") {
+		subExpr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return NotExpr{subExpr}, nil
+	}
+	return p.parsePredicate()
+}
+
+func sqlIsNull(operand Expression) Expression {
+	return OrExpr{
+		EqualsExpr{operand, ValueExpr{nil}},
+		NotExistsExpr{operand},
+	}
+}
+
+func (p *sqlWhereParser) parsePredicate() (Expression, error) {
+	if p.acceptSymbol("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+
+	lhs, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.acceptKeyword("IS") {
+		negate := p.acceptKeyword("NOT")
+		if !p.acceptKeyword("NULL") {
+			return nil, p.errorf("expected NULL")
+		}
+		if negate {
+			return NotExpr{sqlIsNull(lhs)}, nil
+		}
+		return sqlIsNull(lhs), nil
+	}
+
+	negate := p.acceptKeyword("NOT")
+	var expr Expression
+	switch {
+	case p.acceptKeyword("IN"):
+		expr, err = p.parseIn(lhs)
+	case p.acceptKeyword("BETWEEN"):
+		expr, err = p.parseBetween(lhs)
+	case p.acceptKeyword("LIKE"):
+		expr, err = p.parseLike(lhs)
+	default:
+		if negate {
+			return nil, p.errorf("expected IN, BETWEEN or LIKE after NOT")
+		}
+		expr, err = p.parseComparison(lhs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if negate {
+		return NotExpr{expr}, nil
+	}
+	return expr, nil
+}
+
+func (p *sqlWhereParser) parseComparison(lhs Expression) (Expression, error) {
+	token := p.next()
+	if token.tokenType != sqlTokenSymbol {
+		return nil, sqlErrorAt(token.pos, "expected a comparison operator")
+	}
+
+	rhs, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token.value {
+	case "=", "==":
+		return EqualsExpr{lhs, rhs}, nil
+	case "<>", "!=":
+		return NotEqualsExpr{lhs, rhs}, nil
+	case "<":
+		return LessThanExpr{lhs, rhs}, nil
+	case "<=":
+		return LessEqualsExpr{lhs, rhs}, nil
+	case ">":
+		return GreaterThanExpr{lhs, rhs}, nil
+	case ">=":
+		return GreaterEqualsExpr{lhs, rhs}, nil
+	}
+	return nil, sqlErrorAt(token.pos, "unexpected %q", token.value)
+}
+
+func (p *sqlWhereParser) parseIn(lhs Expression) (Expression, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+
+	var exprs OrExpr
+	for {
+		value, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, EqualsExpr{lhs, value})
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (p *sqlWhereParser) parseBetween(lhs Expression) (Expression, error) {
+	low, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if !p.acceptKeyword("AND") {
+		return nil, p.errorf("expected AND in BETWEEN")
+	}
+	high, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	return AndExpr{
+		GreaterEqualsExpr{lhs, low},
+		LessEqualsExpr{lhs, high},
+	}, nil
+}
+
+// sqlLikeToRegex converts a LIKE pattern into an anchored regular expression
+func sqlLikeToRegex(pattern string, escape rune) string {
+	var out strings.Builder
+	out.WriteString("^(?s)")
+
+	escaped := false
+	for _, c := range pattern {
+		if escaped {
+			out.WriteString(regexp.QuoteMeta(string(c)))
+			escaped = false
+			continue
+		}
+		switch {
+		case escape != 0 && c == escape:
+			escaped = true
+		case c == '%':
+			out.WriteString(".*")
+		case c == '_':
+			out.WriteString(".")
+		default:
+			out.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	out.WriteString("$")
+	return out.String()
+}
+
+func (p *sqlWhereParser) parseLike(lhs Expression) (Expression, error) {
+	token := p.next()
+	if token.tokenType != sqlTokenString {
+		return nil, sqlErrorAt(token.pos, "LIKE requires a string pattern")
+	}
+
+	var escape rune
+	if p.acceptKeyword("ESCAPE") {
+		escToken := p.next()
+		escRunes := []rune(escToken.value)
+		if escToken.tokenType != sqlTokenString || len(escRunes) != 1 {
+			return nil, sqlErrorAt(escToken.pos, "ESCAPE requires a single character string")
+		}
+		escape = escRunes[0]
+	}
+
+	return LikeExpr{lhs, RegexExpr{sqlLikeToRegex(token.value, escape)}}, nil
+}
+
+func (p *sqlWhereParser) parseOperand() (Expression, error) {
+	token := p.peek()
+
+	switch token.tokenType {
+	case sqlTokenString:
+		p.pos++
+		return ValueExpr{token.value}, nil
+	case sqlTokenNumber:
+		p.pos++
+		return sqlNumber(token, false)
+	case sqlTokenSymbol:
+		if token.value == "-" && p.tokens[p.pos+1].tokenType == sqlTokenNumber {
+			p.pos++
+			return sqlNumber(p.next(), true)
+		}
+	case sqlTokenIdent:
+		switch strings.ToUpper(token.value) {
+		case "TRUE":
+			p.pos++
+			return ValueExpr{true}, nil
+		case "FALSE":
+			p.pos++
+			return ValueExpr{false}, nil
+		case "NULL":
+			p.pos++
+			return ValueExpr{nil}, nil
+		}
+		if sqlReservedWords[strings.ToUpper(token.value)] {
+			return nil, p.errorf("unexpected keyword %v", token.value)
+		}
+		return p.parseColumn()
+	case sqlTokenQuoted:
+		return p.parseColumn()
+	}
+
+	return nil, p.errorf("expected a column or value")
+}
+
+func sqlNumber(token sqlToken, negate bool) (Expression, error) {
+	numStr := token.value
+	if negate {
+		numStr = "-" + numStr
+	}
+	if intVal, err := strconv.ParseInt(numStr, 10, 64); err == nil {
+		return ValueExpr{int(intVal)}, nil
+	}
+	floatVal, err := strconv.ParseFloat(numStr, 64)
+	if err != nil {
+		return nil, sqlErrorAt(token.pos, "invalid number %v", token.value)
+	}
+	return ValueExpr{floatVal}, nil
+}
+
+func (p *sqlWhereParser) parseColumn() (Expression, error) {
+	var field FieldExpr
+	for {
+		token := p.next()
+		if token.tokenType != sqlTokenIdent && token.tokenType != sqlTokenQuoted {
+			return nil, sqlErrorAt(token.pos, "expected a column name")
+		}
+		field.Path = append(field.Path, token.value)
+		if !p.acceptSymbol(".") {
+			break
+		}
+	}
+	return field, nil
+}
+
+// ParseSqlWhereExpression converts a SQL WHERE clause, with or without the
+// leading WHERE keyword, into an expression
+func ParseSqlWhereExpression(where string) (Expression, error) {
+	tokens, err := sqlTokenize(where)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &sqlWhereParser{tokens: tokens}
+	p.acceptKeyword("WHERE")
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().tokenType != sqlTokenEOF {
+		return nil, p.errorf("unexpected %q", p.peek().value)
+	}
+	return expr, nil
+}
+
+func GetSqlWhereMatcher(where string) (Matcher, error) {
+	expr, err := ParseSqlWhereExpression(where)
+	if err != nil {
+		return nil, err
+	}
+
+	var trans Transformer
+	matchDef := trans.Transform([]Expression{expr})
+
+	return NewFastMatcher(matchDef), nil
+}
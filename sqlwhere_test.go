@@ -0,0 +1,67 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func runSqlWhereMatchTest(t *testing.T, where string, expectedDocIDs []string) {
+	expr, err := ParseSqlWhereExpression(where)
+	if err != nil {
+		t.Fatalf("Failed to parse %v: %v", where, err)
+	}
+
+	runExprMatchTest(t, expr, expectedDocIDs)
+}
+
+func TestSqlWhereExpression(t *testing.T) {
+	assert := assert.New(t)
+
+	expr, err := ParseSqlWhereExpression("WHERE \"a b\".c = 'it''s' AND NOT d IN (1, -2.5)")
+	assert.Nil(err)
+	assert.Equal(AndExpr{
+		EqualsExpr{FieldExpr{0, []string{"a b", "c"}}, ValueExpr{"it's"}},
+		NotExpr{OrExpr{
+			EqualsExpr{FieldExpr{0, []string{"d"}}, ValueExpr{1}},
+			EqualsExpr{FieldExpr{0, []string{"d"}}, ValueExpr{-2.5}},
+		}},
+	}, expr)
+
+	expr, err = ParseSqlWhereExpression("a like 'x!%_%' escape '!' or b = c")
+	assert.Nil(err)
+	assert.Equal(OrExpr{
+		LikeExpr{FieldExpr{0, []string{"a"}}, RegexExpr{"^(?s)x%..*$"}},
+		EqualsExpr{FieldExpr{0, []string{"b"}}, FieldExpr{0, []string{"c"}}},
+	}, expr)
+
+	_, err = ParseSqlWhereExpression("a = 'unterminated")
+	assert.NotNil(err)
+	_, err = ParseSqlWhereExpression("a BETWEEN 1 OR 2")
+	assert.NotNil(err)
+	_, err = ParseSqlWhereExpression("a = 1 b")
+	assert.NotNil(err)
+	_, err = ParseSqlWhereExpression("(a = 1")
+	assert.NotNil(err)
+}
+
+func TestSqlWhereMatcher(t *testing.T) {
+	runSqlWhereMatchTest(t, "age BETWEEN 25 AND 29 AND eyeColor IN ('brown', 'green')", []string{
+		"5b47eb0936ff92a567a0307e",
+		"5b47eb091f57571d3c3b1aa1",
+	})
+
+	runSqlWhereMatchTest(t, "name LIKE 'D%' OR (email LIKE '%.com' AND company LIKE 'A%')", []string{
+		"5b47eb0936ff92a567a0307e",
+		"5b47eb095c3ad73b9925f7f8",
+	})
+
+	runSqlWhereMatchTest(t, "gender NOT IN ('male') AND isActive = FALSE", []string{
+		"5b47eb096b1d911c0b9492fb",
+		"5b47eb09ffac5a6ce37042e7",
+		"5b47eb091f57571d3c3b1aa1",
+	})
+
+	runSqlWhereMatchTest(t, "notAField IS NOT NULL", []string{})
+}
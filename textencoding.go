@@ -0,0 +1,105 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var utf8Bom = []byte{0xef, 0xbb, 0xbf}
+
+// SetTranscodeUTF16 sets whether JSON documents encoded as UTF-16 are
+// converted to UTF-8 before they are matched.  Otherwise they are rejected
+// with ErrorUTF16Input.  A UTF-8 byte order mark is always skipped.
+func (m *FastMatcher) SetTranscodeUTF16(transcode bool) {
+	m.transcodeUTF16 = transcode
+}
+
+// readsJsonText returns whether the matcher reads JSON text, as opposed to
+// one of the binary formats
+func (m *FastMatcher) readsJsonText() bool {
+	switch m.tokens.(type) {
+	case *jsonTokenizer, *relaxedJsonTokenizer:
+		return true
+	}
+	return false
+}
+
+// utf16Order detects a UTF-16 document from its byte order mark, or from
+// the zero bytes of its first character, which for JSON is always ASCII.
+// It returns whether the document is UTF-16 and whether it is big endian.
+func utf16Order(data []byte) (bool, bool) {
+	if len(data) < 2 {
+		return false, false
+	}
+	switch {
+	case data[0] == 0xfe && data[1] == 0xff:
+		return true, true
+	case data[0] == 0xff && data[1] == 0xfe:
+		return true, false
+	case data[0] == 0 && data[1] != 0:
+		return true, true
+	case data[0] != 0 && data[1] == 0:
+		return true, false
+	}
+	return false, false
+}
+
+// appendUTF16AsUTF8 appends a UTF-16 document converted to UTF-8, without
+// its byte order mark.  Unpaired surrogates become U+FFFD.
+func appendUTF16AsUTF8(out, data []byte, bigEndian bool) ([]byte, error) {
+	if len(data)%2 != 0 {
+		return out, ErrorJsonMalformed
+	}
+
+	unit := func(i int) rune {
+		if bigEndian {
+			return rune(data[i])<<8 | rune(data[i+1])
+		}
+		return rune(data[i+1])<<8 | rune(data[i])
+	}
+
+	var encoded [utf8.UTFMax]byte
+	for i := 0; i < len(data); i += 2 {
+		r := unit(i)
+		if i == 0 && r == 0xfeff {
+			continue
+		}
+		if utf16.IsSurrogate(r) {
+			r2 := utf8.RuneError
+			if i+3 < len(data) {
+				r2 = unit(i + 2)
+			}
+			if r = utf16.DecodeRune(r, r2); r != utf8.RuneError {
+				i += 2
+			}
+		}
+		n := utf8.EncodeRune(encoded[:], r)
+		out = append(out, encoded[:n]...)
+	}
+	return out, nil
+}
+
+// normalizeText prepares a JSON document for the tokenizer, skipping a
+// UTF-8 byte order mark and converting UTF-16 documents to UTF-8
+func (m *FastMatcher) normalizeText(data []byte) ([]byte, error) {
+	if len(data) >= len(utf8Bom) && string(data[:len(utf8Bom)]) == string(utf8Bom) {
+		return data[len(utf8Bom):], nil
+	}
+
+	isUTF16, bigEndian := utf16Order(data)
+	if !isUTF16 {
+		return data, nil
+	}
+	if !m.transcodeUTF16 {
+		return nil, ErrorUTF16Input
+	}
+
+	var err error
+	m.transcoded, err = appendUTF16AsUTF8(m.transcoded[:0], data, bigEndian)
+	if err != nil {
+		return nil, err
+	}
+	return m.transcoded, nil
+}
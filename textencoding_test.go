@@ -0,0 +1,68 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeUTF16(text string, bigEndian, bom bool) []byte {
+	units := utf16.Encode([]rune(text))
+	if bom {
+		units = append([]uint16{0xfeff}, units...)
+	}
+	var out []byte
+	for _, unit := range units {
+		if bigEndian {
+			out = append(out, byte(unit>>8), byte(unit))
+		} else {
+			out = append(out, byte(unit), byte(unit>>8))
+		}
+	}
+	return out
+}
+
+func TestMatchTextEncodings(t *testing.T) {
+	assert := assert.New(t)
+
+	matcher, err := GetFilterExpressionMatcher(`name = "Zoë 😀" AND n = 1`)
+	assert.Nil(err)
+	m := matcher.(*FastMatcher)
+
+	doc := `{"name":"Zoë 😀","n":1}`
+	matched, err := m.Match(append([]byte{0xef, 0xbb, 0xbf}, doc...))
+	assert.Nil(err)
+	assert.True(matched)
+
+	utf16Docs := [][]byte{
+		encodeUTF16(doc, true, true),
+		encodeUTF16(doc, false, true),
+		encodeUTF16(doc, true, false),
+		encodeUTF16(doc, false, false),
+	}
+	for _, data := range utf16Docs {
+		m.Reset()
+		_, err := m.Match(data)
+		assert.Equal(ErrorUTF16Input, err)
+	}
+
+	m.SetTranscodeUTF16(true)
+	for _, data := range utf16Docs {
+		m.Reset()
+		matched, err := m.Match(data)
+		assert.Nil(err)
+		assert.True(matched)
+	}
+
+	m.Reset()
+	_, err = m.Match(encodeUTF16(doc, false, true)[1:])
+	assert.NotNil(err)
+
+	// Unpaired surrogates are replaced rather than failing
+	out, err := appendUTF16AsUTF8(nil, []byte{'"', 0, 0x00, 0xd8, '"', 0}, false)
+	assert.Nil(err)
+	assert.Equal("\"�\"", string(out))
+}
@@ -0,0 +1,46 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+// tokenizer is the interface the FastMatcher uses to walk over a document.
+// Every document format produces the same token sequence as JSON, so the
+// matcher logic is shared between all of them.
+type tokenizer interface {
+	Reset(data []byte)
+	Position() int
+	Seek(pos int)
+	// Step returns the next token, its data, and the number of positions
+	// the token occupies
+	Step() (tokenType, []byte, int, error)
+	// ParseLiteral converts the data of a literal token into a value
+	ParseLiteral(token tokenType, data []byte) FastVal
+	// ParseKey returns the name of an object key from a string token
+	ParseKey(token tokenType, data []byte, dataLen int) []byte
+}
+
+func newFastMatcherWithTokenizer(def *MatchDef, tokens tokenizer) *FastMatcher {
+	if !def.compiled {
+		def.compilePrograms()
+	}
+
+	skipper, _ := tokens.(valueSkipper)
+	textIntegers := false
+	switch tokens.(type) {
+	case *jsonTokenizer, *relaxedJsonTokenizer:
+		textIntegers = true
+	}
+	var seenKeys []bool
+	if def.ParseNode != nil {
+		seenKeys = make([]bool, len(def.ParseNode.Elems))
+	}
+
+	return &FastMatcher{
+		def:          *def,
+		slots:        make([]slotData, def.NumSlots),
+		buckets:      def.MatchTree.NewState(),
+		tokens:       tokens,
+		skipper:      skipper,
+		seenKeys:     seenKeys,
+		textIntegers: textIntegers,
+	}
+}
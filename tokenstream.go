@@ -0,0 +1,181 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+type streamToken struct {
+	token tokenType
+	data  []byte
+}
+
+type streamContainer struct {
+	endToken tokenType
+	count    int
+}
+
+// tokenStream is a tokenizer over tokens decoded up front from a binary
+// document format.  Decoders fill it with the same token sequence the JSON
+// tokenizer would produce for the equivalent document, and positions are
+// token indexes.  Literal data is stored in a fixed binary form:
+//
+//	tknString  - the raw string bytes
+//	tknInteger - a little endian int64
+//	tknNumber  - the bits of a little endian float64
+type tokenStream struct {
+	tokens     []streamToken
+	pos        int
+	err        error
+	containers []streamContainer
+	scratch    byteArena
+}
+
+func (s *tokenStream) reset() {
+	s.tokens = s.tokens[:0]
+	s.pos = 0
+	s.err = nil
+	s.containers = s.containers[:0]
+	s.scratch.reset()
+}
+
+func (s *tokenStream) Position() int {
+	return s.pos
+}
+
+func (s *tokenStream) Seek(pos int) {
+	s.pos = pos
+}
+
+func (s *tokenStream) Step() (tokenType, []byte, int, error) {
+	if s.err != nil {
+		return tknEnd, nil, 0, s.err
+	}
+	if s.pos >= len(s.tokens) {
+		return tknEnd, nil, 0, nil
+	}
+
+	token := s.tokens[s.pos]
+	s.pos++
+	return token.token, token.data, 1, nil
+}
+
+func (s *tokenStream) ParseLiteral(token tokenType, data []byte) FastVal {
+	switch token {
+	case tknString:
+		return NewBinStringFastVal(data)
+	case tknInteger:
+		return NewIntFastVal(int64(binary.LittleEndian.Uint64(data)))
+	case tknNumber:
+		return NewFloatFastVal(math.Float64frombits(binary.LittleEndian.Uint64(data)))
+	case tknNull:
+		return NewNullFastVal()
+	case tknTrue:
+		return NewBoolFastVal(true)
+	case tknFalse:
+		return NewBoolFastVal(false)
+	}
+
+	panic("invalid token")
+}
+
+func (s *tokenStream) ParseKey(token tokenType, data []byte, dataLen int) []byte {
+	return data
+}
+
+func (s *tokenStream) emit(token tokenType, data []byte) {
+	s.tokens = append(s.tokens, streamToken{token, data})
+}
+
+// beginValue emits the delimiter needed ahead of an array element
+func (s *tokenStream) beginValue() {
+	if len(s.containers) == 0 {
+		return
+	}
+	container := &s.containers[len(s.containers)-1]
+	if container.endToken != tknArrayEnd {
+		return
+	}
+	if container.count > 0 {
+		s.emit(tknListDelim, nil)
+	}
+	container.count++
+}
+
+func (s *tokenStream) beginObject() {
+	s.beginValue()
+	s.emit(tknObjectStart, nil)
+	s.containers = append(s.containers, streamContainer{tknObjectEnd, 0})
+}
+
+func (s *tokenStream) beginArray() {
+	s.beginValue()
+	s.emit(tknArrayStart, nil)
+	s.containers = append(s.containers, streamContainer{tknArrayEnd, 0})
+}
+
+func (s *tokenStream) end() {
+	container := s.containers[len(s.containers)-1]
+	s.containers = s.containers[:len(s.containers)-1]
+	s.emit(container.endToken, nil)
+}
+
+func (s *tokenStream) key(name []byte) {
+	container := &s.containers[len(s.containers)-1]
+	if container.count > 0 {
+		s.emit(tknListDelim, nil)
+	}
+	container.count++
+	s.emit(tknString, name)
+	s.emit(tknObjectKeyDelim, nil)
+}
+
+// scratchBytes returns n bytes which stay valid until the next reset
+func (s *tokenStream) scratchBytes(n int) []byte {
+	return s.scratch.alloc(n)
+}
+
+func (s *tokenStream) stringValue(value []byte) {
+	s.beginValue()
+	s.emit(tknString, value)
+}
+
+func (s *tokenStream) intValue(value int64) {
+	s.beginValue()
+	data := s.scratchBytes(8)
+	binary.LittleEndian.PutUint64(data, uint64(value))
+	s.emit(tknInteger, data)
+}
+
+// uintValue stores values beyond the range of an int64 as floats, as the
+// JSON tokenizer has no unsigned representation either
+func (s *tokenStream) uintValue(value uint64) {
+	if value > math.MaxInt64 {
+		s.floatValue(float64(value))
+		return
+	}
+	s.intValue(int64(value))
+}
+
+func (s *tokenStream) floatValue(value float64) {
+	s.beginValue()
+	data := s.scratchBytes(8)
+	binary.LittleEndian.PutUint64(data, math.Float64bits(value))
+	s.emit(tknNumber, data)
+}
+
+func (s *tokenStream) boolValue(value bool) {
+	s.beginValue()
+	if value {
+		s.emit(tknTrue, nil)
+	} else {
+		s.emit(tknFalse, nil)
+	}
+}
+
+func (s *tokenStream) nullValue() {
+	s.beginValue()
+	s.emit(tknNull, nil)
+}
@@ -5,7 +5,6 @@ package gojsonsm
 import (
 	"errors"
 	"fmt"
-	"regexp"
 	"strings"
 )
 
@@ -57,6 +56,18 @@ func (ctx *compileContext) String() string {
 	return fmt.Sprintf("$%d@%d", ctx.Var, ctx.Depth)
 }
 
+// TransformLimits bounds the size of the definitions built by
+// TransformWithLimits.  A limit of 0 leaves that size unbounded.
+type TransformLimits struct {
+	// Maximum number of leaves in the match tree, which is roughly the
+	// number of comparisons in the expression
+	MaxLeaves int
+	// Maximum number of nodes in the match tree
+	MaxNodes int
+	// Maximum number of loops nested within each other
+	MaxLoopDepth int
+}
+
 type Transformer struct {
 	SlotIdx   SlotID
 	BucketIdx BucketID
@@ -65,6 +76,15 @@ type Transformer struct {
 
 	ContextStack    []*compileContext
 	ActiveBucketIdx BucketID
+
+	// Exhaustive disables short-circuiting of AND and OR, so that every
+	// clause of an expression is evaluated to true or false rather than being
+	// left undefined once the result is known.  This is slower, and is meant
+	// for reporting which clauses of an expression matched a document.
+	Exhaustive bool
+
+	limits    TransformLimits
+	numLeaves int
 }
 
 func (t *Transformer) getExecNode(field resolvedFieldRef) *ExecNode {
@@ -107,6 +127,17 @@ func (t *Transformer) newBucket() BucketID {
 	newBucketIdx := t.BucketIdx
 	t.BucketIdx++
 
+	// The parent stops being a leaf when it is given its first child
+	if t.RootTree.data[t.ActiveBucketIdx].Left != 0 {
+		t.numLeaves++
+	}
+	if t.limits.MaxNodes > 0 && int(t.BucketIdx) > t.limits.MaxNodes {
+		panic(&TransformLimitError{"nodes", t.limits.MaxNodes})
+	}
+	if t.limits.MaxLeaves > 0 && t.numLeaves > t.limits.MaxLeaves {
+		panic(&TransformLimitError{"leaves", t.limits.MaxLeaves})
+	}
+
 	t.RootTree.data = append(t.RootTree.data, *NewBinTreeNode(
 		nodeTypeLeaf,
 		int(t.ActiveBucketIdx),
@@ -157,7 +188,7 @@ func (t *Transformer) getContext(varID VariableID) *compileContext {
 		return nil
 	}
 
-	for i := len(t.ContextStack) - 1; i >= 0; i++ {
+	for i := len(t.ContextStack) - 1; i >= 0; i-- {
 		if t.ContextStack[i].Var == varID {
 			return t.ContextStack[i]
 		}
@@ -207,7 +238,7 @@ PathLoop:
 	for j := 0; j < len(basePath); j++ {
 		for i := 0; i < len(contextFields); i++ {
 			deepField := contextFields[i]
-			if len(deepField.Path) < j || deepField.Path[j] != basePath[j] {
+			if len(deepField.Path) <= j || deepField.Path[j] != basePath[j] {
 				break PathLoop
 			}
 		}
@@ -304,16 +335,26 @@ func (t *Transformer) makeDataRefRecurse(expr Expression, context nodeRef, isRoo
 		return val, nil
 	case RegexExpr:
 	    // if this fails, it would fail for every mutation. should xdcr handle this error differently?
-		regex, err := regexp.Compile(expr.Regex.(string))
+		regex, err := compileCachedRegex(expr.Regex.(string))
 		if err != nil {
-			return nil, errors.New("failed to compile RegexExpr: " + err.Error())
+			return nil, newFilterExpressionError(ErrBadRegex, "failed to compile RegexExpr: %v", err)
 		}
 		return NewFastVal(regex), nil
 	case PcreExpr:
 	    // same here. this could fail for every mutation
-		pcreWrapper, err := MakePcreWrapper(expr.Pcre.(string))
+		pcreWrapper, err := compileCachedPcre(expr.Pcre.(string))
 		return NewFastVal(pcreWrapper), err
+	case EngineRegexExpr:
+		program, err := compileCachedEngineRegex(expr.Engine, expr.Regex.(string))
+		if err != nil {
+			return nil, err
+		}
+		return NewFastVal(program), nil
 	case FuncExpr:
+		if !isSupportedFunc(expr.FuncName) {
+			return nil, newFilterExpressionError(ErrUnsupportedFunction, "unsupported function: %v", expr.FuncName)
+		}
+
 		var params []DataRef
 
 		for _, paramExpr := range expr.Params {
@@ -330,6 +371,8 @@ func (t *Transformer) makeDataRefRecurse(expr Expression, context nodeRef, isRoo
 		}, nil
 	case TimeExpr:
 		return GetNewTimeFastVal(expr.Time.(string))
+	case capturedExpr:
+		return SlotRef{expr.Slot}, nil
 	}
 
 	return nil, errors.New("unsupported expression in parameter")
@@ -382,7 +425,11 @@ func (t *Transformer) transformOr(expr OrExpr) *ExecNode {
 	}
 
 	baseBucketIdx := t.ActiveBucketIdx
-	t.RootTree.data[baseBucketIdx].NodeType = nodeTypeOr
+	if t.Exhaustive {
+		t.RootTree.data[baseBucketIdx].NodeType = nodeTypeNeor
+	} else {
+		t.RootTree.data[baseBucketIdx].NodeType = nodeTypeOr
+	}
 
 	t.newBucket()
 	t.RootTree.data[baseBucketIdx].Left = int(t.ActiveBucketIdx)
@@ -402,7 +449,11 @@ func (t *Transformer) transformAnd(expr AndExpr) *ExecNode {
 	}
 
 	baseBucketIdx := t.ActiveBucketIdx
-	t.RootTree.data[baseBucketIdx].NodeType = nodeTypeAnd
+	if t.Exhaustive {
+		t.RootTree.data[baseBucketIdx].NodeType = nodeTypeNeand
+	} else {
+		t.RootTree.data[baseBucketIdx].NodeType = nodeTypeAnd
+	}
 
 	t.newBucket()
 	t.RootTree.data[baseBucketIdx].Left = int(t.ActiveBucketIdx)
@@ -417,6 +468,14 @@ func (t *Transformer) transformAnd(expr AndExpr) *ExecNode {
 }
 
 func (t *Transformer) transformLoop(expr Expression, loopType LoopType, varID VariableID, inExpr, subExpr Expression) *ExecNode {
+	t.transformCaptureLoop(expr, loopType, varID, inExpr, subExpr, nil)
+	return nil
+}
+
+// transformCaptureLoop transforms a loop in the same way as transformLoop,
+// additionally storing the value of capture, which must be a field of the
+// loop variable, for each element.  It returns the slot of the capture.
+func (t *Transformer) transformCaptureLoop(expr Expression, loopType LoopType, varID VariableID, inExpr, subExpr, capture Expression) SlotID {
 	baseNode := t.pickBaseNode(expr)
 
 	newNode := &ExecNode{}
@@ -426,28 +485,53 @@ func (t *Transformer) transformLoop(expr Expression, loopType LoopType, varID Va
 		panic(err)
 	}
 
+	if t.limits.MaxLoopDepth > 0 && len(t.ContextStack) >= t.limits.MaxLoopDepth {
+		panic(&TransformLimitError{"loop depth", t.limits.MaxLoopDepth})
+	}
+
 	baseBucketIdx := t.ActiveBucketIdx
 	t.RootTree.data[baseBucketIdx].NodeType = nodeTypeLoop
 	t.newBucket()
 	t.RootTree.data[baseBucketIdx].Left = int(t.ActiveBucketIdx)
 
+	// Push this context to the stack
+	t.pushContext(varID, newNode)
+
+	var captureSlot SlotID
+	if capture != nil {
+		captureField, ok := capture.(FieldExpr)
+		if !ok || captureField.Root != varID {
+			panic(ErrorFirstResultNotLoopField)
+		}
+		captureSlot = t.storeExecNode(t.getExecNode(t.resolveRef(captureField)))
+	}
+
 	baseNode.AddLoop(LoopNode{
 		t.ActiveBucketIdx,
 		loopType,
 		loopTarget,
 		newNode,
+		captureSlot,
 	})
 
-	// Push this context to the stack
-	t.pushContext(varID, newNode)
-
-	// Transform the loops expression body
-	t.transformOne(subExpr)
+	// Transform the loops expression body.  Without one every element
+	// matches, which is marked once the element has been read.
+	if subExpr != nil {
+		t.transformOne(subExpr)
+	} else {
+		afterRef := nodeRef{after: t.getAfterNode(newNode)}
+		afterRef.AddOp(OpNode{
+			t.ActiveBucketIdx,
+			OpTypeExists,
+			nil,
+			nil,
+		})
+	}
 
 	// Pop from the context stack
 	t.popContext(newNode)
 
-	return nil
+	return captureSlot
 }
 
 func (t *Transformer) transformAnyIn(expr AnyInExpr) *ExecNode {
@@ -462,14 +546,92 @@ func (t *Transformer) transformAnyEveryIn(expr AnyEveryInExpr) *ExecNode {
 	return t.transformLoop(expr, LoopTypeAnyEvery, expr.VarId, expr.InExpr, expr.SubExpr)
 }
 
-func (t *Transformer) transformExists(expr ExistsExpr) *ExecNode {
+func (t *Transformer) transformAnyWithin(expr AnyWithinExpr) *ExecNode {
+	return t.transformLoop(expr, LoopTypeAnyWithin, expr.VarId, expr.InExpr, expr.SubExpr)
+}
+
+// capturedExpr stands in for a FIRST expression once its loop has been
+// transformed, referring to the slot its result is captured into
+type capturedExpr struct {
+	Slot SlotID
+}
+
+func (expr capturedExpr) String() string {
+	return fmt.Sprintf("$slot%d", expr.Slot)
+}
+
+// transformFirstOperand transforms a condition with a FIRST expression as one
+// of its operands.  The FIRST loop and the condition become the two sides of
+// an AND, with the condition being run against the captured result once the
+// loop is done, so that no element matching leaves the condition false.
+func (t *Transformer) transformFirstOperand(expr FirstInExpr, transformCond func(captured Expression)) *ExecNode {
+	baseBucketIdx := t.ActiveBucketIdx
+	if t.Exhaustive {
+		t.RootTree.data[baseBucketIdx].NodeType = nodeTypeNeand
+	} else {
+		t.RootTree.data[baseBucketIdx].NodeType = nodeTypeAnd
+	}
+
+	t.newBucket()
+	t.RootTree.data[baseBucketIdx].Left = int(t.ActiveBucketIdx)
+	captureSlot := t.transformCaptureLoop(expr, LoopTypeFirst, expr.VarId, expr.InExpr, expr.SubExpr, expr.ResultExpr)
+
+	t.ActiveBucketIdx = baseBucketIdx
+	t.newBucket()
+	t.RootTree.data[baseBucketIdx].Right = int(t.ActiveBucketIdx)
+	transformCond(capturedExpr{captureSlot})
+
+	return nil
+}
+
+// pickCondNode picks the node for a condition in the same way as
+// pickBaseNode, except that conditions on the result of a FIRST expression
+// are moved after the node so that its loop has run
+func (t *Transformer) pickCondNode(expr Expression, operands ...Expression) nodeRef {
 	baseNode := t.pickBaseNode(expr)
+	if baseNode.node == nil {
+		return baseNode
+	}
+
+	for _, operand := range operands {
+		if _, ok := operand.(capturedExpr); ok {
+			return nodeRef{
+				node:  nil,
+				after: t.getAfterNode(baseNode.node),
+			}
+		}
+	}
+	return baseNode
+}
+
+func (t *Transformer) transformExists(expr ExistsExpr) *ExecNode {
+	return t.transformExistsOf(expr, expr.SubExpr)
+}
+
+func (t *Transformer) transformExistsOf(expr Expression, subExpr Expression) *ExecNode {
+	if first, ok := subExpr.(FirstInExpr); ok {
+		return t.transformFirstOperand(first, func(captured Expression) {
+			t.transformExistsOf(expr, captured)
+		})
+	}
+
+	baseNode := t.pickCondNode(expr, subExpr)
 
-	lhsDataRef, err := t.makeDataRef(expr.SubExpr, baseNode)
+	lhsDataRef, err := t.makeDataRef(subExpr, baseNode)
 	if err != nil {
 		panic(err)
 	}
 
+	// The ops of a node only run for literals, whereas its after node runs
+	// for any value, so that objects and arrays (such as the document
+	// itself) are found to exist as well
+	if lhsDataRef == nil && baseNode.node != nil {
+		baseNode = nodeRef{
+			node:  nil,
+			after: t.getAfterNode(baseNode.node),
+		}
+	}
+
 	baseNode.AddOp(OpNode{
 		t.ActiveBucketIdx,
 		OpTypeExists,
@@ -489,7 +651,18 @@ func (t *Transformer) transformNotExists(expr NotExistsExpr) *ExecNode {
 }
 
 func (t *Transformer) transformComparison(expr Expression, op OpType, lhs, rhs Expression) *ExecNode {
-	baseNode := t.pickBaseNode(expr)
+	if first, ok := lhs.(FirstInExpr); ok {
+		return t.transformFirstOperand(first, func(captured Expression) {
+			t.transformComparison(expr, op, captured, rhs)
+		})
+	}
+	if first, ok := rhs.(FirstInExpr); ok {
+		return t.transformFirstOperand(first, func(captured Expression) {
+			t.transformComparison(expr, op, lhs, captured)
+		})
+	}
+
+	baseNode := t.pickCondNode(expr, lhs, rhs)
 
 	lhsRef, err := t.makeDataRef(lhs, baseNode)
 	if err != nil {
@@ -515,6 +688,10 @@ func (t *Transformer) transformEquals(expr EqualsExpr) *ExecNode {
 	return t.transformComparison(expr, OpTypeEquals, expr.Lhs, expr.Rhs)
 }
 
+func (t *Transformer) transformStrictEquals(expr StrictEqualsExpr) *ExecNode {
+	return t.transformComparison(expr, OpTypeStrictEquals, expr.Lhs, expr.Rhs)
+}
+
 func (t *Transformer) transformNotEquals(expr NotEqualsExpr) *ExecNode {
 	return t.transformOne(NotExpr{EqualsExpr{expr.Lhs, expr.Rhs}})
 }
@@ -549,6 +726,8 @@ func (t *Transformer) transformOne(expr Expression) *ExecNode {
 		return t.transformEveryIn(expr)
 	case AnyEveryInExpr:
 		return t.transformAnyEveryIn(expr)
+	case AnyWithinExpr:
+		return t.transformAnyWithin(expr)
 	case NotExpr:
 		return t.transformNot(expr)
 	case OrExpr:
@@ -561,6 +740,8 @@ func (t *Transformer) transformOne(expr Expression) *ExecNode {
 		return t.transformNotExists(expr)
 	case EqualsExpr:
 		return t.transformEquals(expr)
+	case StrictEqualsExpr:
+		return t.transformStrictEquals(expr)
 	case NotEqualsExpr:
 		return t.transformNotEquals(expr)
 	case LessThanExpr:
@@ -581,10 +762,51 @@ var AlwaysTrueIdent = -1
 var AlwaysFalseIdent = -2
 
 func (t *Transformer) Transform(exprs []Expression) *MatchDef {
+	def, err := t.transformWithOutputs(exprs, nil)
+	if err != nil {
+		panic(err)
+	}
+	return def
+}
+
+// TransformWithOutputs transforms expressions in the same way as Transform,
+// along with output expressions such as `price * qty` which the matcher can
+// evaluate for each document.  Outputs are made up of fields outside of any
+// loop, values and functions.
+func (t *Transformer) TransformWithOutputs(exprs []Expression, outputs []Expression) (*MatchDef, error) {
+	for _, output := range outputs {
+		if exprMaxVarID(output) > 0 {
+			return nil, fmt.Errorf("%v: %v", ErrorOutputExpression, output)
+		}
+		switch output.(type) {
+		case FieldExpr, ValueExpr, FuncExpr, TimeExpr:
+		default:
+			return nil, fmt.Errorf("%v: %v", ErrorOutputExpression, output)
+		}
+	}
+	return t.transformWithOutputs(exprs, outputs)
+}
+
+// outputKeepExpr is an expression which is always false, but which cannot be
+// resolved until the field has been read or the document has ended, so that
+// the matcher reads every field the outputs need before it stops early
+func outputKeepExpr(field FieldExpr) Expression {
+	return AndExpr{ExistsExpr{field}, NotExpr{ExistsExpr{field}}}
+}
+
+func (t *Transformer) transformWithOutputs(exprs []Expression, outputs []Expression) (*MatchDef, error) {
+	numExprs := len(exprs)
+	for _, output := range outputs {
+		for _, field := range fetchExprFieldRefs(output) {
+			exprs = append(exprs, outputKeepExpr(field))
+		}
+	}
+
 	t.RootExec = &ExecNode{}
 	t.ContextStack = nil
 	t.BucketIdx = 1
 	t.ActiveBucketIdx = 0
+	t.numLeaves = 1
 	t.RootTree = binTree{[]binTreeNode{
 		{
 			NodeType: nodeTypeLeaf,
@@ -596,6 +818,12 @@ func (t *Transformer) Transform(exprs []Expression) *MatchDef {
 	// expression contains the bucket index we need for that expression.
 	exprBucketIDs := make([]int, len(exprs))
 
+	// Expressions which are identical to an earlier one, such as the same
+	// filter used by several consumers of a FilterSet, share its bucket
+	// rather than being evaluated again.  Identical clauses within different
+	// expressions are instead shared when their ops are compiled.
+	genExprIdxs := make(map[string]int)
+
 	var genExprs []Expression
 	for i, expr := range exprs {
 		switch expr.(type) {
@@ -607,6 +835,13 @@ func (t *Transformer) Transform(exprs []Expression) *MatchDef {
 			continue
 		}
 
+		exprKey := fmt.Sprintf("%#v", expr)
+		if genIdx, ok := genExprIdxs[exprKey]; ok {
+			exprBucketIDs[i] = genIdx
+			continue
+		}
+		genExprIdxs[exprKey] = len(genExprs)
+
 		genExprs = append(genExprs, expr)
 		exprBucketIDs[i] = len(genExprs) - 1
 	}
@@ -641,11 +876,43 @@ func (t *Transformer) Transform(exprs []Expression) *MatchDef {
 		}
 	}
 
-	return &MatchDef{
+	var outputRefs []DataRef
+	for _, output := range outputs {
+		outputRef, err := t.makeDataRef(output, nodeRef{})
+		if err != nil {
+			return nil, err
+		}
+		outputRefs = append(outputRefs, outputRef)
+	}
+
+	def := &MatchDef{
 		ParseNode:    t.RootExec,
 		MatchTree:    t.RootTree,
-		MatchBuckets: exprBucketIDs,
+		MatchBuckets: exprBucketIDs[:numExprs],
 		NumBuckets:   int(t.BucketIdx),
 		NumSlots:     int(t.SlotIdx),
-	}
+		Outputs:      outputRefs,
+	}
+	def.compilePrograms()
+	return def, nil
+}
+
+// TransformWithLimits transforms expressions in the same way as Transform,
+// but stops with a *TransformLimitError as soon as the definition being
+// built exceeds one of the limits, bounding the cost of accepting arbitrary
+// expressions from users
+func (t *Transformer) TransformWithLimits(exprs []Expression, limits TransformLimits) (def *MatchDef, err error) {
+	t.limits = limits
+	defer func() {
+		t.limits = TransformLimits{}
+		if r := recover(); r != nil {
+			limitErr, ok := r.(*TransformLimitError)
+			if !ok {
+				panic(r)
+			}
+			def, err = nil, limitErr
+		}
+	}()
+
+	return t.Transform(exprs), nil
 }
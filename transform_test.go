@@ -0,0 +1,111 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransformWithLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	field := func(name string) FieldExpr {
+		return FieldExpr{Root: 0, Path: []string{name}}
+	}
+	expr := AndExpr{
+		EqualsExpr{field("a"), ValueExpr{1}},
+		OrExpr{
+			EqualsExpr{field("b"), ValueExpr{2}},
+			NotExpr{EqualsExpr{field("c"), ValueExpr{3}}},
+		},
+		AnyInExpr{
+			VarId:  1,
+			InExpr: field("d"),
+			SubExpr: AnyInExpr{
+				VarId:   2,
+				InExpr:  FieldExpr{Root: 1},
+				SubExpr: EqualsExpr{FieldExpr{Root: 2}, ValueExpr{4}},
+			},
+		},
+	}
+
+	var trans Transformer
+	def, err := trans.TransformWithLimits([]Expression{expr}, TransformLimits{})
+	assert.Nil(err)
+
+	numLeaves := 0
+	for _, node := range def.MatchTree.data {
+		if node.NodeType == nodeTypeLeaf {
+			numLeaves++
+		}
+	}
+	assert.Equal(4, numLeaves)
+	assert.Equal(numLeaves, trans.numLeaves)
+	numNodes := len(def.MatchTree.data)
+
+	limits := TransformLimits{MaxLeaves: 4, MaxNodes: numNodes, MaxLoopDepth: 2}
+	_, err = trans.TransformWithLimits([]Expression{expr}, limits)
+	assert.Nil(err)
+
+	tests := map[string]TransformLimits{
+		"leaves":     {MaxLeaves: 3},
+		"nodes":      {MaxNodes: numNodes - 1},
+		"loop depth": {MaxLoopDepth: 1},
+	}
+	for limit, limits := range tests {
+		def, err := trans.TransformWithLimits([]Expression{expr}, limits)
+		assert.Nil(def)
+		assert.True(errors.Is(err, ErrLimitExceeded), limit)
+
+		var limitErr *TransformLimitError
+		if assert.True(errors.As(err, &limitErr), limit) {
+			assert.Equal(limit, limitErr.Limit)
+		}
+	}
+
+	// The limits only apply to the call they were given to
+	def = trans.Transform([]Expression{expr})
+	assert.Equal(numNodes, len(def.MatchTree.data))
+}
+
+func TestTransformExhaustive(t *testing.T) {
+	assert := assert.New(t)
+
+	expr := AndExpr{
+		EqualsExpr{FieldExpr{Root: 0, Path: []string{"a"}}, ValueExpr{1}},
+		OrExpr{
+			EqualsExpr{FieldExpr{Root: 0, Path: []string{"b"}}, ValueExpr{2}},
+			EqualsExpr{FieldExpr{Root: 0, Path: []string{"c"}}, ValueExpr{3}},
+		},
+	}
+	doc := []byte(`{"a":0,"b":2,"c":3}`)
+
+	// Once a is known not to match nothing else needs to be evaluated
+	var trans Transformer
+	def := trans.Transform([]Expression{expr})
+	m := NewFastMatcher(def)
+	matched, err := m.Match(doc)
+	assert.Nil(err)
+	assert.False(matched)
+	assert.Equal(`[0] and = false
+  [1] leaf = false
+  [2] or = undefined
+    [3] leaf = undefined
+    [4] leaf = undefined`, m.buckets.String())
+
+	trans = Transformer{Exhaustive: true}
+	def = trans.Transform([]Expression{expr})
+	assert.Nil(def.Validate())
+	m = NewFastMatcher(def)
+	matched, err = m.Match(doc)
+	assert.Nil(err)
+	assert.False(matched)
+	assert.Equal(`[0] neand = false
+  [1] leaf = false
+  [2] neor = true
+    [3] leaf = true
+    [4] leaf = true`, m.buckets.String())
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Guards against alias cycles and stack exhaustion on hostile input
+const yamlMaxDepth = 512
+
+// yamlTokenizer produces the JSON token sequence for a YAML document.
+// Scalars are resolved with the YAML core schema, timestamps become RFC3339
+// strings usable with DATE(), binary scalars become base64 strings, and
+// aliases are matched as the node they refer to.
+type yamlTokenizer struct {
+	tokenStream
+}
+
+func (tkn *yamlTokenizer) Reset(data []byte) {
+	tkn.reset()
+	if len(data) == 0 {
+		return
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		tkn.err = fmt.Errorf("%v: %v", ErrorYamlMalformed, err)
+		return
+	}
+	tkn.resetNode(&doc)
+}
+
+// resetNode replaces the current token sequence with that of an already
+// parsed document
+func (tkn *yamlTokenizer) resetNode(doc *yaml.Node) {
+	tkn.reset()
+	if err := tkn.decodeNode(doc, 0); err != nil {
+		tkn.err = err
+	}
+}
+
+func (tkn *yamlTokenizer) decodeNode(node *yaml.Node, depth int) error {
+	if depth > yamlMaxDepth {
+		return ErrorYamlMalformed
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			tkn.nullValue()
+			return nil
+		}
+		return tkn.decodeNode(node.Content[0], depth+1)
+	case yaml.AliasNode:
+		return tkn.decodeNode(node.Alias, depth+1)
+	case yaml.SequenceNode:
+		tkn.beginArray()
+		for _, elem := range node.Content {
+			if err := tkn.decodeNode(elem, depth+1); err != nil {
+				return err
+			}
+		}
+		tkn.end()
+		return nil
+	case yaml.MappingNode:
+		tkn.beginObject()
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode := node.Content[i]
+			for keyNode.Kind == yaml.AliasNode {
+				keyNode = keyNode.Alias
+			}
+			if keyNode.Kind != yaml.ScalarNode {
+				return fmt.Errorf("%v: non-scalar map key", ErrorYamlUnsupported)
+			}
+			tkn.key([]byte(keyNode.Value))
+			if err := tkn.decodeNode(node.Content[i+1], depth+1); err != nil {
+				return err
+			}
+		}
+		tkn.end()
+		return nil
+	case yaml.ScalarNode:
+		return tkn.decodeScalar(node)
+	}
+
+	return fmt.Errorf("%v: node kind %d", ErrorYamlUnsupported, node.Kind)
+}
+
+func (tkn *yamlTokenizer) decodeScalar(node *yaml.Node) error {
+	switch node.ShortTag() {
+	case "!!str":
+		tkn.stringValue([]byte(node.Value))
+		return nil
+	case "!!binary":
+		// Normalize the encoding, as YAML allows it to be split over lines
+		value, err := base64.StdEncoding.DecodeString(string(bytes.Join(
+			bytes.Fields([]byte(node.Value)), nil)))
+		if err != nil {
+			return fmt.Errorf("%v: %v", ErrorYamlMalformed, err)
+		}
+		encoded := tkn.scratchBytes(base64.StdEncoding.EncodedLen(len(value)))
+		base64.StdEncoding.Encode(encoded, value)
+		tkn.stringValue(encoded)
+		return nil
+	}
+
+	var value interface{}
+	if err := node.Decode(&value); err != nil {
+		return fmt.Errorf("%v: %v", ErrorYamlMalformed, err)
+	}
+
+	switch value := value.(type) {
+	case nil:
+		tkn.nullValue()
+	case bool:
+		tkn.boolValue(value)
+	case int:
+		tkn.intValue(int64(value))
+	case int64:
+		tkn.intValue(value)
+	case uint64:
+		tkn.uintValue(value)
+	case float64:
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			// JSON has no representation for these either
+			tkn.stringValue([]byte(node.Value))
+		} else {
+			tkn.floatValue(value)
+		}
+	case string:
+		tkn.stringValue([]byte(value))
+	case time.Time:
+		encoded := tkn.scratchBytes(len(time.RFC3339Nano) + 8)
+		tkn.stringValue(value.UTC().AppendFormat(encoded[:0], time.RFC3339Nano))
+	default:
+		return fmt.Errorf("%v: scalar tag %s", ErrorYamlUnsupported, node.ShortTag())
+	}
+	return nil
+}
+
+// NewYAMLMatcher returns a matcher which evaluates single YAML documents
+func NewYAMLMatcher(def *MatchDef) *FastMatcher {
+	return newFastMatcherWithTokenizer(def, &yamlTokenizer{})
+}
+
+// MatchYAMLStream evaluates every document in a YAML stream, such as a set of
+// Kubernetes manifests separated by '---', and returns the match result of
+// each document in order.
+func MatchYAMLStream(def *MatchDef, stream io.Reader) ([]bool, error) {
+	tokens := &yamlTokenizer{}
+	matcher := newFastMatcherWithTokenizer(def, tokens)
+	decoder := yaml.NewDecoder(stream)
+
+	var results []bool
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return results, nil
+		} else if err != nil {
+			return results, fmt.Errorf("%v: %v", ErrorYamlMalformed, err)
+		}
+
+		matcher.Reset()
+		tokens.resetNode(&doc)
+		matched, err := matcher.matchTokens()
+		if err != nil {
+			return results, err
+		}
+		results = append(results, matched)
+	}
+}
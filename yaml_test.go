@@ -0,0 +1,90 @@
+// Copyright 2019 Couchbase, Inc. All rights reserved.
+
+package gojsonsm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestYAMLMatcherPeople(t *testing.T) {
+	expr := AndExpr{
+		GreaterThanExpr{FieldExpr{0, []string{"age"}}, ValueExpr{25}},
+		AnyInExpr{1, FieldExpr{0, []string{"friends"}},
+			LikeExpr{FieldExpr{1, []string{"name"}}, RegexExpr{"^G"}}},
+	}
+
+	var trans Transformer
+	matchDef := trans.Transform([]Expression{expr})
+
+	jsonMatcher := NewFastMatcher(matchDef)
+	yamlMatcher := NewYAMLMatcher(matchDef)
+	for _, doc := range getTestPeopleDocs() {
+		jsonMatcher.Reset()
+		expected, err := jsonMatcher.Match(doc)
+		if err != nil {
+			t.Fatalf("JSON matcher error: %v", err)
+		}
+
+		// JSON documents are valid YAML
+		yamlMatcher.Reset()
+		matched, err := yamlMatcher.Match(doc)
+		if err != nil {
+			t.Fatalf("YAML matcher error: %v", err)
+		}
+
+		if matched != expected {
+			t.Fatalf("YAML match result %v differs from JSON for %v", matched, expr)
+		}
+	}
+}
+
+func TestYAMLMatcherStream(t *testing.T) {
+	assert := assert.New(t)
+
+	stream := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  created: 2019-03-01T10:00:00Z
+spec:
+  replicas: 0x3
+  template: &tmpl
+    labels: [frontend, "prod"]
+  other: *tmpl
+---
+kind: Deployment
+spec:
+  replicas: 1
+`
+
+	expr, err := ParseFilterExpression(
+		"kind = \"Deployment\" AND spec.replicas >= 3 AND spec.other.labels[0] = \"frontend\"")
+	if !assert.Nil(err) {
+		return
+	}
+
+	var trans Transformer
+	results, err := MatchYAMLStream(trans.Transform([]Expression{expr}), strings.NewReader(stream))
+	assert.Nil(err)
+	assert.Equal([]bool{false, true, false}, results)
+
+	dateExpr := GreaterThanExpr{
+		FuncExpr{DateFunc, []Expression{FieldExpr{0, []string{"metadata", "created"}}}},
+		FuncExpr{DateFunc, []Expression{ValueExpr{"2019-02-28"}}},
+	}
+	results, err = MatchYAMLStream(trans.Transform([]Expression{dateExpr}), strings.NewReader(stream))
+	assert.Nil(err)
+	assert.Equal([]bool{false, true, false}, results)
+
+	_, err = MatchYAMLStream(trans.Transform([]Expression{expr}), strings.NewReader("a: [1, 2"))
+	assert.NotNil(err)
+}